@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"fintech-go/internal/api"
+	"fintech-go/internal/store"
+)
+
+// Account statuses. Frozen accounts can still receive funds but cannot send;
+// closed accounts reject both directions.
+const (
+	accountActive = store.AccountActive
+	accountFrozen = store.AccountFrozen
+	accountClosed = store.AccountClosed
+)
+
+var accountIDPattern = store.AccountIDPattern
+
+type Account = store.Account
+
+// Store is the Postgres store.Store behind the internal/api handlers.
+var _ store.Store = (*Store)(nil)
+
+// newAPIHandler serves the account, statement and operation endpoints from
+// st, with this server's tenant resolution and error bodies.
+func newAPIHandler(st store.Store) *api.Handler {
+	return &api.Handler{
+		Store:    st,
+		Currency: serviceCurrency,
+		Tenant: func(r *http.Request) (string, bool) {
+			p := principalFromContext(r.Context())
+			return metaFromRequest(r).Tenant, p != nil && p.Tenant != ""
+		},
+		Error: func(w http.ResponseWriter, status int, msg string) {
+			writeJSON(w, status, TransferResponse{Status: "error", Message: msg})
+		},
+		Path: apiPath,
+	}
+}
+
+// registerAPIRoutes registers the internal/api endpoints on r. Both the
+// Postgres server and STORE=memory go through here, so an endpoint added to
+// one cannot be missing from the other.
+func registerAPIRoutes(r *apiRouter, h *api.Handler) {
+	r.HandleFunc("POST /accounts", h.CreateAccount)
+	r.HandleFunc("GET /accounts", h.ListAccounts)
+	r.HandleFunc("GET /accounts/{id}", h.GetAccount)
+	r.HandleFunc("POST /accounts:batchGet", h.BatchGetAccounts)
+	r.HandleFunc("GET /accounts/{id}/transactions", h.AccountTransactions)
+	r.HandleFunc("GET /operations/{id}", h.Operation)
+}
+
+const accountColumns = "id, tenant_id, display_name, balance, held, currency, status, transfer_limit, daily_limit, overdraft_limit, created_at, closed_at"
+
+func scanAccount(row pgx.Row) (Account, error) {
+	var a Account
+	err := row.Scan(&a.ID, &a.TenantID, &a.DisplayName, &a.Balance, &a.Held, &a.Currency, &a.Status, &a.TransferLimit, &a.DailyLimit, &a.OverdraftLimit, &a.CreatedAt, &a.ClosedAt)
+	a.Available = a.Balance - a.Held
+	return a, err
+}
+
+// CreateAccount inserts an active account with a zero balance once the
+// currency is one the tenant may hold.
+func (s *Store) CreateAccount(ctx context.Context, na store.NewAccount) (Account, error) {
+	if _, err := currencyUnit(na.Currency); err != nil {
+		return Account{}, store.InvalidError(err.Error())
+	}
+	if !s.tenants.effective(na.TenantID).allowsCurrency(na.Currency) {
+		return Account{}, store.InvalidError("tenant is not enabled for " + na.Currency)
+	}
+	a, err := scanAccount(s.pool.QueryRow(ctx, `
+		INSERT INTO accounts (id, balance, tenant_id, display_name, status, currency) VALUES ($1, 0, $2, $3, $4, $5)
+		RETURNING `+accountColumns, na.ID, na.TenantID, na.DisplayName, accountActive, na.Currency))
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return Account{}, store.ErrAccountExists
+	}
+	if err != nil {
+		return Account{}, err
+	}
+	accountBalance.WithLabelValues(a.ID).Set(a.Balance.Float())
+	return a, nil
+}
+
+func (s *Store) ListAccounts(ctx context.Context, q store.AccountQuery) (store.AccountPage, error) {
+	f := accountFilter{TenantID: q.TenantID, Status: q.Status}
+	where, args := f.sql()
+	args = append(args, q.Cursor, q.Limit)
+	rows, err := s.pool.Query(withQueryPattern(ctx, patternSearch), "SELECT "+accountColumns+" FROM accounts WHERE "+where+
+		" AND id > $"+strconv.Itoa(len(args)-1)+" ORDER BY id LIMIT $"+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return store.AccountPage{}, err
+	}
+	defer rows.Close()
+	accounts := make([]Account, 0)
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			return store.AccountPage{}, err
+		}
+		accounts = append(accounts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return store.AccountPage{}, err
+	}
+	page := store.AccountPage{Accounts: accounts}
+	if len(accounts) == q.Limit {
+		page.NextCursor = accounts[len(accounts)-1].ID
+	}
+	return page, nil
+}
+
+// Account is getAccount, for store.Store.
+func (s *Store) Account(ctx context.Context, id string) (Account, error) {
+	return s.getAccount(ctx, id)
+}
+
+// Accounts reads the accounts in one query. It skips the read cache: one
+// round trip for the lot is what batch callers want.
+func (s *Store) Accounts(ctx context.Context, ids []string) ([]Account, error) {
+	rows, err := s.pool.Query(ctx, "SELECT "+accountColumns+" FROM accounts WHERE id = ANY($1) ORDER BY id", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	accounts := make([]Account, 0, len(ids))
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// getAccount loads an account through the read cache (see cache.go), or
+// returns errAccountNotFound.
+func (s *Store) getAccount(ctx context.Context, id string) (Account, error) {
+	return s.cache.accounts.fetch(id, func() (Account, error) {
+		a, err := scanAccount(s.pool.QueryRow(ctx, "SELECT "+accountColumns+" FROM accounts WHERE id=$1", id))
+		if err == pgx.ErrNoRows {
+			return a, errAccountNotFound
+		}
+		return a, err
+	})
+}
+
+// handleCloseAccount closes an account. Accounts still holding funds cannot
+// be closed; the balance has to be moved out first.
+func (s *Store) handleCloseAccount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	if isSystemAccount(id) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "account is reserved"})
+		return
+	}
+	tx, err := s.beginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		http.Error(w, "failed to start tx", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	a, err := scanAccount(tx.QueryRow(ctx, "SELECT "+accountColumns+" FROM accounts WHERE id=$1 FOR UPDATE", id))
+	if err == pgx.ErrNoRows {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "account not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	if a.Status == accountClosed {
+		writeJSON(w, http.StatusOK, a)
+		return
+	}
+	if a.Balance != 0 {
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: "account balance must be zero to close"})
+		return
+	}
+	if a.Held != 0 {
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: "account has active holds"})
+		return
+	}
+	from := a.Status
+	a, err = scanAccount(tx.QueryRow(ctx, "UPDATE accounts SET status=$2, closed_at=now() WHERE id=$1 RETURNING "+accountColumns, id, accountClosed))
+	if err != nil {
+		http.Error(w, "failed to close account", http.StatusInternalServerError)
+		return
+	}
+	if err := recordStatusChange(ctx, tx, id, statusChange{FromStatus: from, ToStatus: accountClosed,
+		Actor: metaFromRequest(r).Client, Reason: "closed by account holder", Source: "api"}); err != nil {
+		http.Error(w, "failed to close account", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, "failed to close account", http.StatusInternalServerError)
+		return
+	}
+	s.cache.accounts.invalidate(id)
+	accountBalance.DeleteLabelValues(id)
+	writeJSON(w, http.StatusOK, a)
+}
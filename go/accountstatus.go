@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Account status transitions. Closing is final, and only accounts holding
+// no funds can be closed. Every transition, whichever path makes it (this
+// endpoint, DELETE /accounts/{id} or a bulk job), is written to
+// account_status_changes in the same transaction as the change itself.
+var accountTransitions = map[string][]string{
+	accountActive: {accountFrozen, accountClosed},
+	accountFrozen: {accountActive, accountClosed},
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range accountTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+type statusChange struct {
+	FromStatus string    `json:"fromStatus"`
+	ToStatus   string    `json:"toStatus"`
+	Actor      string    `json:"actor"`
+	Reason     string    `json:"reason"`
+	Source     string    `json:"source"`
+	ChangedAt  time.Time `json:"changedAt"`
+}
+
+func recordStatusChange(ctx context.Context, tx pgx.Tx, accountID string, c statusChange) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO account_status_changes (account_id, from_status, to_status, actor, reason, source)
+		VALUES ($1, $2, $3, $4, $5, $6)`, accountID, c.FromStatus, c.ToStatus, c.Actor, c.Reason, c.Source)
+	return err
+}
+
+type setStatusRequest struct {
+	Status string `json:"status"`
+	Actor  string `json:"actor"`
+	Reason string `json:"reason"`
+}
+
+var errInvalidTransition = errors.New("invalid status transition")
+
+// handleSetAccountStatus moves an account to another status. Setting the
+// status it already has answers 200 without recording a transition.
+func (s *Store) handleSetAccountStatus(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req setStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Actor == "" || req.Reason == "":
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor and reason are required"})
+		return
+	case req.Status != accountActive && req.Status != accountFrozen && req.Status != accountClosed:
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "status must be active, frozen or closed"})
+		return
+	case isSystemAccount(id):
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "account is reserved"})
+		return
+	}
+	ctx := r.Context()
+	var (
+		a       Account
+		changed bool
+	)
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		var err error
+		if a, err = scanAccount(tx.QueryRow(ctx, "SELECT "+accountColumns+" FROM accounts WHERE id=$1 FOR UPDATE", id)); err != nil {
+			return err
+		}
+		if a.Status == req.Status {
+			return nil
+		}
+		if !canTransition(a.Status, req.Status) {
+			return fmt.Errorf("%w from %s to %s", errInvalidTransition, a.Status, req.Status)
+		}
+		if req.Status == accountClosed && a.Balance != 0 {
+			return fmt.Errorf("%w: account balance must be zero to close", errInvalidTransition)
+		}
+		from := a.Status
+		if a, err = scanAccount(tx.QueryRow(ctx, `
+			UPDATE accounts SET status=$2, closed_at=CASE WHEN $2=$3 THEN now() END WHERE id=$1 RETURNING `+accountColumns,
+			id, req.Status, accountClosed)); err != nil {
+			return err
+		}
+		changed = true
+		return recordStatusChange(ctx, tx, id, statusChange{FromStatus: from, ToStatus: req.Status, Actor: req.Actor, Reason: req.Reason, Source: "admin"})
+	})
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "account not found"})
+		return
+	case errors.Is(err, errInvalidTransition):
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	case err != nil:
+		http.Error(w, "failed to change account status", http.StatusInternalServerError)
+		return
+	}
+	if changed {
+		s.cache.accounts.invalidate(id)
+		logger(ctx).Info("account status changed", "account_id", id, "status", req.Status, "actor", req.Actor, "reason", req.Reason)
+		if err := s.recordEvent(ctx, "account.status_changed", "account/"+id, map[string]any{
+			"status": req.Status, "actor": req.Actor, "reason": req.Reason,
+		}); err != nil {
+			logger(ctx).Warn("record status event", "account_id", id, "error", err)
+		}
+		if req.Status == accountClosed {
+			accountBalance.DeleteLabelValues(id)
+		}
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// handleAccountStatusHistory lists an account's transitions, newest first.
+func (s *Store) handleAccountStatusHistory(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.pool.Query(r.Context(), `
+		SELECT from_status, to_status, actor, reason, source, changed_at FROM account_status_changes
+		WHERE account_id=$1 ORDER BY id DESC LIMIT 200`, r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "failed to load history", http.StatusInternalServerError)
+		return
+	}
+	history, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (statusChange, error) {
+		var c statusChange
+		err := row.Scan(&c.FromStatus, &c.ToStatus, &c.Actor, &c.Reason, &c.Source, &c.ChangedAt)
+		return c, err
+	})
+	if err != nil {
+		http.Error(w, "failed to load history", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"accountId": r.PathValue("id"), "history": history})
+}
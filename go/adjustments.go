@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/ledger"
+)
+
+// adjustmentsAccountID is the counterpart of operator balance corrections.
+// An adjustment is booked as a transfer between the account and this one,
+// so the correction is a ledger entry like any other movement (the DEBIT
+// and CREDIT pair, the hash chain, reconciliation) and reads as an
+// adjustment on statements through its counterparty. Daily limits and the
+// velocity rules leave this counterparty out, so a correction never uses up
+// the customer's allowance. Its balance is the negated total of all
+// adjustments and may go negative.
+const adjustmentsAccountID = "ADJUSTMENTS"
+
+// A balance adjustment corrects a balance that is wrong for reasons the
+// ledger cannot express: a posting the bank made outside the service, a
+// migration error, a chargeback settled offline. It replaces editing
+// accounts.balance in SQL, which left the balance out of step with the
+// ledger and no trace of who changed it. Every adjustment is kept in
+// balance_adjustments with the actor, the reason and the balance before
+// and after, in the same transaction as the posting.
+
+type balanceAdjustment struct {
+	ID            int64     `json:"id"`
+	AccountID     string    `json:"accountId"`
+	Amount        Money     `json:"amount"`
+	Currency      string    `json:"currency"`
+	BalanceBefore Money     `json:"balanceBefore"`
+	BalanceAfter  Money     `json:"balanceAfter"`
+	Actor         string    `json:"actor"`
+	Reason        string    `json:"reason"`
+	OperationID   *string   `json:"operationId,omitempty"`
+	TransferID    int64     `json:"transferId"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+const adjustmentColumns = `id, account_id, amount, currency, balance_before, balance_after, actor, reason, operation_id, transfer_id, created_at`
+
+func scanAdjustment(row pgx.Row) (balanceAdjustment, error) {
+	var a balanceAdjustment
+	err := row.Scan(&a.ID, &a.AccountID, &a.Amount, &a.Currency, &a.BalanceBefore, &a.BalanceAfter, &a.Actor, &a.Reason,
+		&a.OperationID, &a.TransferID, &a.CreatedAt)
+	return a, err
+}
+
+type adjustBalanceRequest struct {
+	// Amount is signed: positive credits the account, negative debits it.
+	Amount Money  `json:"amount"`
+	Actor  string `json:"actor"`
+	Reason string `json:"reason"`
+	// OperationID makes the adjustment idempotent: a retry returns the one
+	// already booked under it.
+	OperationID string `json:"operationId,omitempty"`
+}
+
+func (req adjustBalanceRequest) validate() string {
+	switch {
+	case req.Actor == "":
+		return "actor is required"
+	case req.Reason == "":
+		return "reason is required"
+	case req.Amount == 0:
+		return "amount must not be zero"
+	}
+	return ""
+}
+
+// handleAdjustBalance books a correction to an account's balance. Frozen
+// accounts can be adjusted, closed ones cannot, and a debit may take the
+// balance below the overdraft limit: the correction states what the
+// customer owes, not what they may spend.
+func (s *Store) handleAdjustBalance(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req adjustBalanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if errors.Is(err, ledger.ErrTooPrecise) {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+			return
+		}
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if msg := req.validate(); msg != "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: msg})
+		return
+	}
+	if isSystemAccount(id) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "account is reserved"})
+		return
+	}
+	a, status, err := s.adjustBalance(r.Context(), id, req)
+	if status == http.StatusInternalServerError {
+		logger(r.Context()).Error("adjust balance", "account_id", id, "error", err)
+		http.Error(w, "failed to adjust balance", status)
+		return
+	}
+	if err != nil {
+		writeJSON(w, status, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	writeJSON(w, status, a)
+}
+
+// adjustBalance posts the adjustment and its audit row under the account's
+// row lock, so before and after are the balances the posting moved between.
+// The adjustments account is updated after that lock, as chargeFee does
+// with the fees account. It answers 201 for a new adjustment and 200 for
+// one already booked under the operation id.
+func (s *Store) adjustBalance(ctx context.Context, id string, req adjustBalanceRequest) (balanceAdjustment, int, error) {
+	var (
+		a      balanceAdjustment
+		status = http.StatusCreated
+	)
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		locked, err := lockAccounts(ctx, tx, id)
+		if err != nil {
+			return fmt.Errorf("lock account: %w", err)
+		}
+		acc := locked[id]
+		if acc == nil {
+			status = http.StatusNotFound
+			return errors.New("account not found")
+		}
+		if req.OperationID != "" {
+			prev, err := scanAdjustment(tx.QueryRow(ctx, "SELECT "+adjustmentColumns+" FROM balance_adjustments WHERE operation_id=$1", req.OperationID))
+			switch {
+			case err == nil && (prev.AccountID != id || prev.Amount != req.Amount):
+				status = http.StatusConflict
+				return errors.New("operationId was already used for a different adjustment")
+			case err == nil:
+				a, status = prev, http.StatusOK
+				return nil
+			case !errors.Is(err, pgx.ErrNoRows):
+				return err
+			}
+		}
+		if acc.status == accountClosed {
+			status = http.StatusConflict
+			return errAccountClosed
+		}
+		if err := checkCurrencyPrecision(req.Amount, acc.currency); err != nil {
+			status = http.StatusBadRequest
+			return err
+		}
+
+		from, to, amount := adjustmentsAccountID, id, req.Amount
+		if amount < 0 {
+			from, to, amount = id, adjustmentsAccountID, -amount
+		}
+		if _, err := tx.Exec(ctx, "UPDATE accounts SET balance=$1 WHERE id=$2", acc.balance+req.Amount, id); err != nil {
+			return fmt.Errorf("update account: %w", err)
+		}
+		if _, err := tx.Exec(ctx, "UPDATE accounts SET balance=balance-$1 WHERE id=$2", req.Amount, adjustmentsAccountID); err != nil {
+			return fmt.Errorf("update adjustments account: %w", err)
+		}
+		var transferID int64
+		if err := tx.QueryRow(ctx, "INSERT INTO transfers (from_account_id, to_account_id, amount, currency, destination_amount, destination_currency) VALUES ($1,$2,$3,$4,$3,$4) RETURNING id",
+			from, to, amount, acc.currency).Scan(&transferID); err != nil {
+			return fmt.Errorf("insert adjustment transfer: %w", err)
+		}
+		if err := insertTransferEntries(ctx, tx, transferID, s.clocks.now(acc.tenantID).UTC(),
+			ledgerEntry{accountID: from, amount: amount, currency: acc.currency},
+			ledgerEntry{accountID: to, amount: amount, currency: acc.currency}); err != nil {
+			return fmt.Errorf("adjustment: %w", err)
+		}
+		a, err = scanAdjustment(tx.QueryRow(ctx, `
+			INSERT INTO balance_adjustments (account_id, amount, currency, balance_before, balance_after, actor, reason, operation_id, transfer_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9) RETURNING `+adjustmentColumns,
+			id, req.Amount, acc.currency, acc.balance, acc.balance+req.Amount, req.Actor, req.Reason, req.OperationID, transferID))
+		if err != nil {
+			return fmt.Errorf("insert adjustment: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		if status == http.StatusCreated {
+			status = http.StatusInternalServerError
+		}
+		return balanceAdjustment{}, status, err
+	}
+	if status == http.StatusCreated {
+		s.cache.accounts.invalidate(id, adjustmentsAccountID)
+		accountBalance.WithLabelValues(id).Set(a.BalanceAfter.Float())
+		logger(ctx).Info("balance adjusted", "account_id", id, "actor", a.Actor, "reason", a.Reason,
+			"amount", a.Amount, "balance_before", a.BalanceBefore, "balance_after", a.BalanceAfter, "transfer_id", a.TransferID)
+		if err := s.recordEvent(ctx, "account.balance_adjusted", "account/"+id, map[string]any{
+			"adjustmentId": a.ID, "amount": a.Amount, "balanceBefore": a.BalanceBefore, "balanceAfter": a.BalanceAfter,
+			"actor": a.Actor, "reason": a.Reason,
+		}); err != nil {
+			logger(ctx).Warn("record adjustment event", "account_id", id, "error", err)
+		}
+	}
+	return a, status, nil
+}
+
+// handleListAdjustments returns an account's adjustments, newest first.
+func (s *Store) handleListAdjustments(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	var exists bool
+	if err := s.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM accounts WHERE id=$1)", id).Scan(&exists); err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "account not found"})
+		return
+	}
+	rows, err := s.pool.Query(ctx, "SELECT "+adjustmentColumns+" FROM balance_adjustments WHERE account_id=$1 ORDER BY id DESC LIMIT 100", id)
+	if err != nil {
+		http.Error(w, "failed to load adjustments", http.StatusInternalServerError)
+		return
+	}
+	adjustments, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (balanceAdjustment, error) {
+		return scanAdjustment(row)
+	})
+	if err != nil {
+		http.Error(w, "failed to load adjustments", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"accountId": id, "adjustments": adjustments})
+}
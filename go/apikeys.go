@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Partners rotate their own API keys with POST /api-keys/rotate, sent with
+// the key being replaced. It returns a new key with the same client, tenant
+// and scopes, and the old key keeps working for the overlap window
+// (API_KEY_ROTATION_OVERLAP, default 24h; the caller may ask for up to
+// API_KEY_ROTATION_MAX_OVERLAP, default 7 days), so they deploy the new key
+// before the old one stops. A key is rotated once: a second rotation of it
+// is refused rather than forking a leaked key into two.
+//
+// Admins list keys with GET /admin/api-keys and force a key's expiry, or
+// move it, with POST /admin/api-keys/{id}/expire. Keys from API_KEYS_FILE
+// take part through a row in api_keys carrying their hash, which overrides
+// the file entry; remove retired keys from the file at leisure.
+//
+// Each replica caches api_keys and reloads it every API_KEYS_REFRESH_INTERVAL
+// (default 15s), so a forced expiry reaches the other replicas within that
+// interval; the replica that took the change applies it at once.
+
+const (
+	apiKeySourceFile     = "file"
+	apiKeySourceRotation = "rotation"
+)
+
+type apiKey struct {
+	id     string
+	sum    [sha256.Size]byte
+	source string
+	// principal is what the key authenticates as.
+	principal  *principal
+	createdAt  *time.Time
+	expiresAt  *time.Time
+	replacedBy string
+}
+
+// apiKeyID is a key's public name: the start of its hash, enough to tell
+// keys apart without identifying the secret.
+func apiKeyID(sum [sha256.Size]byte) string {
+	return "ak_" + hex.EncodeToString(sum[:8])
+}
+
+func newAPIKeySecret() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return "fk_" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (a *apiKeyAuth) lookup(sum [sha256.Size]byte) *apiKey {
+	if m := a.stored.Load(); m != nil {
+		if k, ok := (*m)[sum]; ok {
+			return k
+		}
+	}
+	return a.static[sum]
+}
+
+// all lists every known key, stored rows replacing their file entries.
+func (a *apiKeyAuth) all() []*apiKey {
+	merged := map[[sha256.Size]byte]*apiKey{}
+	for sum, k := range a.static {
+		merged[sum] = k
+	}
+	if m := a.stored.Load(); m != nil {
+		for sum, k := range *m {
+			merged[sum] = k
+		}
+	}
+	keys := make([]*apiKey, 0, len(merged))
+	for _, k := range merged {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(x, y *apiKey) int {
+		if c := strings.Compare(x.principal.Client, y.principal.Client); c != 0 {
+			return c
+		}
+		return strings.Compare(x.id, y.id)
+	})
+	return keys
+}
+
+func (a *apiKeyAuth) byID(id string) *apiKey {
+	for _, k := range a.all() {
+		if k.id == id {
+			return k
+		}
+	}
+	return nil
+}
+
+// load reads every row of api_keys, expired ones included: an expired row
+// is what keeps a retired file key out.
+func (a *apiKeyAuth) load(ctx context.Context, db *pgxpool.Pool) error {
+	rows, err := db.Query(ctx, `SELECT id, sha256, client_id, tenant_id, scopes, source, created_at, expires_at, COALESCE(replaced_by, '')
+		FROM api_keys`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	m := map[[sha256.Size]byte]*apiKey{}
+	for rows.Next() {
+		var (
+			k   apiKey
+			sum []byte
+			p   = principal{Method: "api_key"}
+		)
+		if err := rows.Scan(&k.id, &sum, &p.Client, &p.Tenant, &p.Scopes, &k.source, &k.createdAt, &k.expiresAt, &k.replacedBy); err != nil {
+			return err
+		}
+		if len(sum) != sha256.Size {
+			continue
+		}
+		k.sum = [sha256.Size]byte(sum)
+		p.KeyID = k.id
+		k.principal = &p
+		m[k.sum] = &k
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	a.stored.Store(&m)
+	return nil
+}
+
+func (a *apiKeyAuth) watch(ctx context.Context, db *pgxpool.Pool, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.load(ctx, db); err != nil {
+				slog.Error("refresh api keys", "error", err)
+			}
+		}
+	}
+}
+
+type apiKeyView struct {
+	ID         string     `json:"id"`
+	Client     string     `json:"client"`
+	Tenant     string     `json:"tenant"`
+	Scopes     []string   `json:"scopes"`
+	Source     string     `json:"source"`
+	CreatedAt  *time.Time `json:"createdAt,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	Expired    bool       `json:"expired"`
+	ReplacedBy string     `json:"replacedBy,omitempty"`
+}
+
+func (a *apiKeyAuth) view(k *apiKey) apiKeyView {
+	return apiKeyView{ID: k.id, Client: k.principal.Client, Tenant: k.principal.Tenant, Scopes: k.principal.Scopes,
+		Source: k.source, CreatedAt: k.createdAt, ExpiresAt: k.expiresAt,
+		Expired: k.expiresAt != nil && !a.now().Before(*k.expiresAt), ReplacedBy: k.replacedBy}
+}
+
+type rotateAPIKeyRequest struct {
+	// Overlap is how long the old key keeps working, as a Go duration.
+	Overlap string `json:"overlap"`
+}
+
+type apiKeyRotation struct {
+	// Key is the new secret. It is only ever shown here.
+	Key      string     `json:"key"`
+	New      apiKeyView `json:"new"`
+	Previous apiKeyView `json:"previous"`
+}
+
+var errAlreadyRotated = errors.New("api key was already rotated")
+
+func (s *Store) handleRotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+	if s.apiKeys == nil || p == nil || p.KeyID == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "rotation must be called with the api key it replaces"})
+		return
+	}
+	var req rotateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	overlap := durationOrDefault("API_KEY_ROTATION_OVERLAP", 24*time.Hour)
+	maxOverlap := durationOrDefault("API_KEY_ROTATION_MAX_OVERLAP", 7*24*time.Hour)
+	if req.Overlap != "" {
+		d, err := time.ParseDuration(req.Overlap)
+		if err != nil || d < 0 || d > maxOverlap {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "overlap must be a duration between 0s and " + maxOverlap.String()})
+			return
+		}
+		overlap = d
+	}
+	old := s.apiKeys.byID(p.KeyID)
+	if old == nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if old.replacedBy != "" {
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: errAlreadyRotated.Error() + "; it is replaced by " + old.replacedBy})
+		return
+	}
+
+	ctx := r.Context()
+	secret := newAPIKeySecret()
+	sum := sha256.Sum256([]byte(secret))
+	newID := apiKeyID(sum)
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `INSERT INTO api_keys (id, sha256, client_id, tenant_id, scopes, source, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			newID, sum[:], p.Client, p.Tenant, p.Scopes, apiKeySourceRotation, p.Client); err != nil {
+			return err
+		}
+		// the old key's row may not exist yet (a file key); an expiry an
+		// admin already forced earlier is kept
+		tag, err := tx.Exec(ctx, `INSERT INTO api_keys (id, sha256, client_id, tenant_id, scopes, source, created_by, expires_at, replaced_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, now() + $8 * interval '1 millisecond', $9)
+			ON CONFLICT (id) DO UPDATE SET expires_at = LEAST(api_keys.expires_at, EXCLUDED.expires_at), replaced_by = EXCLUDED.replaced_by
+			WHERE api_keys.replaced_by IS NULL`,
+			old.id, old.sum[:], p.Client, p.Tenant, p.Scopes, old.source, p.Client, overlap.Milliseconds(), newID)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return errAlreadyRotated
+		}
+		return nil
+	})
+	if errors.Is(err, errAlreadyRotated) {
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("rotate api key", "key_id", old.id, "error", err)
+		http.Error(w, "failed to rotate api key", http.StatusInternalServerError)
+		return
+	}
+	if err := s.apiKeys.load(ctx, s.pool); err != nil {
+		logger(ctx).Error("refresh api keys", "error", err)
+	}
+	resp := apiKeyRotation{Key: secret, New: apiKeyView{ID: newID, Client: p.Client, Tenant: p.Tenant, Scopes: p.Scopes, Source: apiKeySourceRotation}}
+	if k := s.apiKeys.byID(newID); k != nil {
+		resp.New = s.apiKeys.view(k)
+	}
+	if k := s.apiKeys.byID(old.id); k != nil {
+		resp.Previous = s.apiKeys.view(k)
+	}
+	logger(ctx).Info("api key rotated", "client", p.Client, "key_id", old.id, "new_key_id", newID, "overlap", overlap)
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+func (s *Store) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	views := []apiKeyView{}
+	if s.apiKeys != nil {
+		client := r.URL.Query().Get("client")
+		for _, k := range s.apiKeys.all() {
+			if client == "" || k.principal.Client == client {
+				views = append(views, s.apiKeys.view(k))
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": views})
+}
+
+type expireAPIKeyRequest struct {
+	// At defaults to now. A later time than a rotation set extends the
+	// overlap, for partners who missed the window.
+	At    *time.Time `json:"at"`
+	Actor string     `json:"actor"`
+}
+
+func (s *Store) handleExpireAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req expireAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	var k *apiKey
+	if s.apiKeys != nil {
+		k = s.apiKeys.byID(r.PathValue("id"))
+	}
+	if k == nil {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "api key not found"})
+		return
+	}
+	at := time.Now()
+	if req.At != nil {
+		at = *req.At
+	}
+	ctx := r.Context()
+	p := k.principal
+	if _, err := s.pool.Exec(ctx, `INSERT INTO api_keys (id, sha256, client_id, tenant_id, scopes, source, created_by, expires_at, expired_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $7)
+		ON CONFLICT (id) DO UPDATE SET expires_at = EXCLUDED.expires_at, expired_by = EXCLUDED.expired_by`,
+		k.id, k.sum[:], p.Client, p.Tenant, p.Scopes, k.source, req.Actor, at); err != nil {
+		http.Error(w, "failed to expire api key", http.StatusInternalServerError)
+		return
+	}
+	if err := s.apiKeys.load(ctx, s.pool); err != nil {
+		logger(ctx).Error("refresh api keys", "error", err)
+	}
+	logger(ctx).Info("api key expiry set", "key_id", k.id, "client", p.Client, "expires_at", at, "actor", req.Actor)
+	if k = s.apiKeys.byID(k.id); k == nil {
+		http.Error(w, "failed to expire api key", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.apiKeys.view(k))
+}
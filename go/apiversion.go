@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The HTTP API is versioned by path: /v1/transfer, /v1/accounts/{id} and so
+// on. Routes are registered once with apiRouter and mounted under every
+// version; a version that changes a route's contract registers its own
+// handler with HandleVersion, which later versions inherit, and the rest
+// keep serving the earlier handler. Handlers shared between versions that
+// only differ in rendering (v2 might send amounts as strings) branch on
+// apiVersion(ctx) instead.
+//
+// The unversioned paths of before /v1 remain as deprecated aliases of v1.
+// Their responses carry "Deprecation: true", a successor-version Link and,
+// with LEGACY_API_SUNSET set (an HTTP date), a Sunset header; each request
+// counts in legacy_api_requests_total so we can tell who still calls them.
+// Probes and /metrics stay unversioned.
+
+// apiLatestVersion is the newest version mounted.
+const apiLatestVersion = 1
+
+type apiVersionKey struct{}
+
+// apiVersion is the version the request was routed under; legacy paths are
+// v1.
+func apiVersion(ctx context.Context) int {
+	if v, ok := ctx.Value(apiVersionKey{}).(int); ok {
+		return v
+	}
+	return 1
+}
+
+// apiPath is path under the request's version, for Location headers and
+// links.
+func apiPath(ctx context.Context, path string) string {
+	return fmt.Sprintf("/v%d%s", apiVersion(ctx), path)
+}
+
+// unversionedPath strips a leading /vN, so path-based policy (scopes,
+// read-only mode) applies alike to every version and the legacy paths.
+func unversionedPath(path string) string {
+	rest, ok := strings.CutPrefix(path, "/v")
+	if !ok {
+		return path
+	}
+	n, tail, _ := strings.Cut(rest, "/")
+	if _, err := strconv.Atoi(n); err != nil || n == "" {
+		return path
+	}
+	return "/" + tail
+}
+
+type apiRoute struct {
+	method, path string
+	// handlers maps the version a handler was introduced in to it.
+	handlers map[int]http.Handler
+}
+
+type apiRouter struct {
+	mux    *http.ServeMux
+	routes []*apiRoute
+	byKey  map[string]*apiRoute
+	sunset string
+}
+
+func newAPIRouter(mux *http.ServeMux) *apiRouter {
+	return &apiRouter{mux: mux, byKey: map[string]*apiRoute{}, sunset: os.Getenv("LEGACY_API_SUNSET")}
+}
+
+// Handle registers h for pattern ("POST /accounts", or a bare path that
+// takes every method) from v1 on.
+func (a *apiRouter) Handle(pattern string, h http.Handler) {
+	a.HandleVersion(1, pattern, h)
+}
+
+func (a *apiRouter) HandleFunc(pattern string, h http.HandlerFunc) {
+	a.Handle(pattern, h)
+}
+
+// HandleVersion registers h for pattern from version v on.
+func (a *apiRouter) HandleVersion(v int, pattern string, h http.Handler) {
+	route, ok := a.byKey[pattern]
+	if !ok {
+		method, path, found := strings.Cut(pattern, " ")
+		if !found {
+			method, path = "", pattern
+		}
+		route = &apiRoute{method: method, path: path, handlers: map[int]http.Handler{}}
+		a.byKey[pattern] = route
+		a.routes = append(a.routes, route)
+	}
+	if _, dup := route.handlers[v]; dup {
+		panic(fmt.Sprintf("api route %q registered twice for v%d", pattern, v))
+	}
+	route.handlers[v] = h
+}
+
+// mount registers every route on the mux: under each version it exists
+// in, and at its legacy path.
+func (a *apiRouter) mount() {
+	for _, route := range a.routes {
+		var current http.Handler
+		for v := 1; v <= apiLatestVersion; v++ {
+			if h, ok := route.handlers[v]; ok {
+				current = h
+			}
+			if current == nil {
+				continue
+			}
+			a.mux.Handle(route.pattern(fmt.Sprintf("/v%d%s", v, route.path)), withAPIVersion(v, current))
+		}
+		if v1, ok := route.handlers[1]; ok {
+			a.mux.Handle(route.pattern(route.path), a.legacy(route.pattern(route.path), v1))
+		}
+	}
+}
+
+func (r *apiRoute) pattern(path string) string {
+	if r.method == "" {
+		return path
+	}
+	return r.method + " " + path
+}
+
+func withAPIVersion(v int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, v)))
+	})
+}
+
+func (a *apiRouter) legacy(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		legacyRequests.WithLabelValues(pattern).Inc()
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, "/v1"+r.URL.EscapedPath()))
+		if a.sunset != "" {
+			w.Header().Set("Sunset", a.sunset)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// A balance attestation is a signed statement that an account held a given
+// balance at a ledger sequence. The signature covers the exact bytes of
+// "statement" (base64 of a JSON document), so a verifier needs only those
+// bytes, the signature and the public key published at
+// /attestations/public-key: no canonicalisation rules to reimplement. The
+// signing key comes from the keyring (purpose attestation); claims name it,
+// so attestations issued before a rotation still verify.
+//
+// The ledger sequence is the account's highest ledger id at the time of the
+// statement; see Store.Statement for why per-account ids are a
+// consistent point in time.
+
+type attestationClaims struct {
+	AccountID      string    `json:"accountId"`
+	TenantID       string    `json:"tenantId"`
+	Balance        Money     `json:"balance"`
+	Currency       string    `json:"currency"`
+	LedgerSequence int64     `json:"ledgerSequence"`
+	IssuedAt       time.Time `json:"issuedAt"`
+	KeyID          string    `json:"keyId"`
+}
+
+type attestation struct {
+	Algorithm string            `json:"algorithm"`
+	KeyID     string            `json:"keyId"`
+	Statement string            `json:"statement"`
+	Signature string            `json:"signature"`
+	Claims    attestationClaims `json:"claims"`
+}
+
+// handleAttestation signs the account's balance at its latest ledger
+// sequence, or at ?sequence=N for an earlier point: the balance then is the
+// current one with every later ledger row undone, read in one snapshot.
+func (s *Store) handleAttestation(w http.ResponseWriter, r *http.Request) {
+	key, err := s.keys.active(purposeAttestation)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, TransferResponse{Status: "error", Message: "attestations are not configured"})
+		return
+	}
+	ctx := r.Context()
+	id := r.PathValue("id")
+	if isSystemAccount(id) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "account not found"})
+		return
+	}
+	var at *int64
+	if v := r.URL.Query().Get("sequence"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "sequence must be a non-negative integer"})
+			return
+		}
+		at = &n
+	}
+
+	c := attestationClaims{AccountID: id, KeyID: key.ID}
+	var head int64
+	err = s.pool.QueryRow(ctx, `
+		SELECT a.tenant_id, a.currency, a.balance - COALESCE(sum(CASE l.type WHEN 'CREDIT' THEN l.amount ELSE -l.amount END)
+				FILTER (WHERE $2::bigint IS NOT NULL AND l.id > $2), 0),
+			COALESCE(max(l.id), 0)
+		FROM accounts a LEFT JOIN ledger l ON l.account_id = a.id
+		WHERE a.id=$1 GROUP BY a.id`, id, at).Scan(&c.TenantID, &c.Currency, &c.Balance, &head)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "account not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load balance", http.StatusInternalServerError)
+		return
+	}
+	c.LedgerSequence = head
+	if at != nil {
+		if *at > head {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "sequence is beyond the account's ledger"})
+			return
+		}
+		// a summary covers entries on both sides of the sequence, so the
+		// balance in between is no longer in the ledger
+		var compacted bool
+		if err := s.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM ledger WHERE account_id=$1 AND summary_first_id <= $2 AND id > $2)", id, *at).
+			Scan(&compacted); err != nil {
+			http.Error(w, "failed to load balance", http.StatusInternalServerError)
+			return
+		}
+		if compacted {
+			writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: "sequence falls inside a compacted period"})
+			return
+		}
+		c.LedgerSequence = *at
+	}
+	c.IssuedAt = time.Now().UTC().Truncate(time.Second)
+
+	stmt, err := json.Marshal(c)
+	if err != nil {
+		http.Error(w, "failed to encode statement", http.StatusInternalServerError)
+		return
+	}
+	sig := key.sign(stmt)
+	logger(ctx).Info("balance attested", "account_id", id, "ledger_sequence", c.LedgerSequence, "key_id", key.ID)
+	writeJSON(w, http.StatusOK, attestation{
+		Algorithm: "Ed25519",
+		KeyID:     key.ID,
+		Statement: base64.StdEncoding.EncodeToString(stmt),
+		Signature: base64.StdEncoding.EncodeToString(sig),
+		Claims:    c,
+	})
+}
+
+// handleAttestationKey publishes the verification keys as PEM: the active
+// one and those kept for attestations issued before a rotation.
+func (s *Store) handleAttestationKey(w http.ResponseWriter, r *http.Request) {
+	keys := s.keys.verificationKeys(purposeAttestation)
+	if len(keys) == 0 {
+		writeJSON(w, http.StatusServiceUnavailable, TransferResponse{Status: "error", Message: "attestations are not configured"})
+		return
+	}
+	type publicKey struct {
+		KeyID     string `json:"keyId"`
+		Algorithm string `json:"algorithm"`
+		Status    string `json:"status"`
+		PublicKey string `json:"publicKey"`
+	}
+	out := make([]publicKey, 0, len(keys))
+	for _, k := range keys {
+		der, err := x509.MarshalPKIXPublicKey(k.publicKey())
+		if err != nil {
+			http.Error(w, "failed to encode key", http.StatusInternalServerError)
+			return
+		}
+		out = append(out, publicKey{KeyID: k.ID, Algorithm: "Ed25519", Status: k.Status,
+			PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))})
+	}
+	// the first entry keeps the single-key shape earlier clients read
+	writeJSON(w, http.StatusOK, map[string]any{
+		"algorithm": "Ed25519",
+		"keyId":     out[0].KeyID,
+		"publicKey": out[0].PublicKey,
+		"keys":      out,
+	})
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Scopes a credential can carry. Each API route requires exactly one,
+// decided by its path: /admin/* needs admin, /debug/* needs debug and
+// everything else needs transfers, except that any API key may rotate
+// itself. Scopes do not imply one another, so an
+// admin credential cannot move money unless it is also given transfers.
+const (
+	scopeTransfers = "transfers"
+	scopeAdmin     = "admin"
+	scopeDebug     = "debug"
+)
+
+// principal is an authenticated caller. Once auth is on, it replaces the
+// X-Client-ID / X-Tenant-ID headers as the source of requestMeta.
+type principal struct {
+	Client string
+	Tenant string
+	Scopes []string
+	Method string
+	// KeyID names the API key that authenticated the call.
+	KeyID string
+}
+
+func (p *principal) has(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+func principalFromContext(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey).(*principal)
+	return p
+}
+
+// onBehalfOf makes bookTransfer check account ownership against tenant
+// rather than the caller's. Bank callbacks and operator actions pass "":
+// they book on the service's behalf, between system accounts and accounts
+// of any tenant.
+func onBehalfOf(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, bookingTenantKey, tenant)
+}
+
+// bookingTenant is the tenant whose money a transfer in ctx may move; ""
+// means any.
+func bookingTenant(ctx context.Context) string {
+	if t, ok := ctx.Value(bookingTenantKey).(string); ok {
+		return t
+	}
+	if p := principalFromContext(ctx); p != nil {
+		return p.Tenant
+	}
+	return ""
+}
+
+var errNoCredentials = errors.New("no credentials")
+
+// authenticator checks one kind of credential. It returns errNoCredentials
+// when the request does not carry its kind, so the next one can try.
+type authenticator interface {
+	authenticate(r *http.Request) (*principal, error)
+}
+
+// unauthenticatedPaths stay open for probes and scrapers on the API port.
+var unauthenticatedPaths = map[string]bool{"GET /healthz": true, "GET /readyz": true, "/metrics": true}
+
+func requiredScope(path string) string {
+	path = unversionedPath(path)
+	switch {
+	case strings.HasPrefix(path, "/admin/sandbox/"):
+		// acts on the caller's own tenant, and only a sandbox
+		return scopeTransfers
+	case strings.HasPrefix(path, "/admin/"):
+		return scopeAdmin
+	case strings.HasPrefix(path, "/debug/"):
+		return scopeDebug
+	case path == "/api-keys/rotate":
+		return ""
+	default:
+		return scopeTransfers
+	}
+}
+
+// withAuth rejects requests without valid credentials (401) or without the
+// scope the route needs (403). With no authenticators configured it is a
+// pass-through and callers are identified by headers as before.
+func withAuth(mux *http.ServeMux, auths []authenticator, next http.Handler) http.Handler {
+	if len(auths) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); unauthenticatedPaths[pattern] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := authenticate(auths, r)
+		if err != nil {
+			authFailures.WithLabelValues("unauthenticated").Inc()
+			if !errors.Is(err, errNoCredentials) {
+				logger(r.Context()).Warn("authentication failed", "error", err)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fintech"`)
+			writeJSON(w, http.StatusUnauthorized, TransferResponse{Status: "error", Message: "authentication required"})
+			return
+		}
+		if scope := requiredScope(r.URL.Path); scope != "" && !p.has(scope) {
+			authFailures.WithLabelValues("forbidden").Inc()
+			writeJSON(w, http.StatusForbidden, TransferResponse{Status: "error", Message: "credential lacks the " + scope + " scope"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	})
+}
+
+// authenticate tries each authenticator in turn; errNoCredentials means
+// the request carried none of the configured kinds.
+func authenticate(auths []authenticator, r *http.Request) (*principal, error) {
+	for _, a := range auths {
+		if p, err := a.authenticate(r); !errors.Is(err, errNoCredentials) {
+			return p, err
+		}
+	}
+	return nil, errNoCredentials
+}
+
+// authenticatorsFromEnv builds the configured authenticators. AUTH_ENABLED
+// must be set explicitly; enabling it without any credential source is a
+// configuration error rather than a locked-out service.
+func authenticatorsFromEnv() ([]authenticator, error) {
+	if envOrDefault("AUTH_ENABLED", "false") != "true" {
+		slog.Warn("authentication disabled; callers are identified by X-Client-ID and X-Tenant-ID headers")
+		return nil, nil
+	}
+	var auths []authenticator
+	keys, err := apiKeysFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		auths = append(auths, keys)
+	}
+	jwt, err := jwtAuthFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if jwt != nil {
+		auths = append(auths, jwt)
+	}
+	if len(auths) == 0 {
+		return nil, errors.New("AUTH_ENABLED is set but neither API_KEYS_FILE nor JWT_ISSUER is configured")
+	}
+	return auths, nil
+}
+
+// apiKeyAuth accepts static keys sent as "Authorization: ApiKey <key>" or
+// X-API-Key. Keys are configured by their SHA-256 so the file holding them is
+// not itself a credential. Keys issued by rotation, and expiries set by
+// rotation or by an admin, live in api_keys (see apikeys.go) and take
+// precedence over the file.
+type apiKeyAuth struct {
+	static map[[sha256.Size]byte]*apiKey
+	stored atomic.Pointer[map[[sha256.Size]byte]*apiKey]
+	now    func() time.Time
+}
+
+type apiKeyConfig struct {
+	SHA256 string   `json:"sha256"`
+	Client string   `json:"client"`
+	Tenant string   `json:"tenant"`
+	Scopes []string `json:"scopes"`
+}
+
+func apiKeysFromEnv() (*apiKeyAuth, error) {
+	path := os.Getenv("API_KEYS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("API_KEYS_FILE: %w", err)
+	}
+	var list []apiKeyConfig
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("API_KEYS_FILE: %w", err)
+	}
+	a := &apiKeyAuth{static: map[[sha256.Size]byte]*apiKey{}, now: time.Now}
+	for i, k := range list {
+		sum, err := hex.DecodeString(k.SHA256)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("API_KEYS_FILE entry %d: sha256 must be 64 hex characters", i)
+		}
+		if k.Client == "" || len(k.Scopes) == 0 {
+			return nil, fmt.Errorf("API_KEYS_FILE entry %d: client and scopes are required", i)
+		}
+		if k.Tenant == "" {
+			k.Tenant = "default"
+		}
+		id := apiKeyID([sha256.Size]byte(sum))
+		a.static[[sha256.Size]byte(sum)] = &apiKey{
+			id:        id,
+			sum:       [sha256.Size]byte(sum),
+			source:    apiKeySourceFile,
+			principal: &principal{Client: k.Client, Tenant: k.Tenant, Scopes: k.Scopes, Method: "api_key", KeyID: id},
+		}
+	}
+	slog.Info("api key authentication enabled", "keys", len(a.static))
+	return a, nil
+}
+
+func (a *apiKeyAuth) authenticate(r *http.Request) (*principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if v, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey "); ok {
+		key = v
+	}
+	if key == "" {
+		return nil, errNoCredentials
+	}
+	// looking up the hash rather than comparing keys leaks nothing useful
+	// through timing
+	k := a.lookup(sha256.Sum256([]byte(key)))
+	if k == nil {
+		return nil, errors.New("unknown api key")
+	}
+	if k.expiresAt != nil && !a.now().Before(*k.expiresAt) {
+		return nil, fmt.Errorf("api key %s expired", k.id)
+	}
+	return k.principal, nil
+}
+
+// jwtAuth verifies bearer tokens signed with HS256 (shared secret) or
+// RS256 (public keys from a PEM file, matched by kid when the token has
+// one). iss and aud must match the configuration and exp is required.
+type jwtAuth struct {
+	issuer, audience string
+	secret           []byte
+	rsaKeys          map[string]*rsa.PublicKey
+	leeway           time.Duration
+	now              func() time.Time
+}
+
+func jwtAuthFromEnv() (*jwtAuth, error) {
+	issuer := os.Getenv("JWT_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	a := &jwtAuth{
+		issuer:   issuer,
+		audience: os.Getenv("JWT_AUDIENCE"),
+		secret:   []byte(os.Getenv("JWT_HS256_SECRET")),
+		rsaKeys:  map[string]*rsa.PublicKey{},
+		leeway:   durationOrDefault("JWT_LEEWAY", 30*time.Second),
+		now:      time.Now,
+	}
+	if a.audience == "" {
+		return nil, errors.New("JWT_AUDIENCE is required with JWT_ISSUER")
+	}
+	if path := os.Getenv("JWT_PUBLIC_KEYS_FILE"); path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_PUBLIC_KEYS_FILE: %w", err)
+		}
+		for i := 0; ; i++ {
+			var block *pem.Block
+			block, raw = pem.Decode(raw)
+			if block == nil {
+				break
+			}
+			pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("JWT_PUBLIC_KEYS_FILE key %d: %w", i, err)
+			}
+			key, ok := pub.(*rsa.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("JWT_PUBLIC_KEYS_FILE key %d: only RSA keys are supported", i)
+			}
+			// a "kid" PEM header names the key; unnamed keys are tried in turn
+			kid := block.Headers["kid"]
+			if kid == "" {
+				kid = fmt.Sprintf("#%d", i)
+			}
+			a.rsaKeys[kid] = key
+		}
+	}
+	if len(a.secret) == 0 && len(a.rsaKeys) == 0 {
+		return nil, errors.New("JWT_ISSUER needs JWT_HS256_SECRET or JWT_PUBLIC_KEYS_FILE")
+	}
+	slog.Info("jwt authentication enabled", "issuer", a.issuer, "audience", a.audience, "rsa_keys", len(a.rsaKeys), "hs256", len(a.secret) > 0)
+	return a, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	Expiry    *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+	Tenant    string          `json:"tenant"`
+	Scope     string          `json:"scope"`
+	Scp       []string        `json:"scp"`
+}
+
+func (a *jwtAuth) authenticate(r *http.Request) (*principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, errNoCredentials
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var h jwtHeader
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("token signature: %w", err)
+	}
+	if err := a.verify(h, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+	var c jwtClaims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, fmt.Errorf("token claims: %w", err)
+	}
+	now := a.now()
+	switch {
+	case c.Issuer != a.issuer:
+		return nil, errors.New("token issuer mismatch")
+	case !audienceContains(c.Audience, a.audience):
+		return nil, errors.New("token audience mismatch")
+	case c.Expiry == nil:
+		return nil, errors.New("token has no exp")
+	case now.After(time.Unix(*c.Expiry, 0).Add(a.leeway)):
+		return nil, errors.New("token expired")
+	case c.NotBefore != nil && now.Add(a.leeway).Before(time.Unix(*c.NotBefore, 0)):
+		return nil, errors.New("token not yet valid")
+	case c.Subject == "":
+		return nil, errors.New("token has no sub")
+	}
+	scopes := c.Scp
+	if c.Scope != "" {
+		scopes = strings.Fields(c.Scope)
+	}
+	tenant := c.Tenant
+	if tenant == "" {
+		tenant = "default"
+	}
+	return &principal{Client: c.Subject, Tenant: tenant, Scopes: scopes, Method: "jwt"}, nil
+}
+
+// verify checks the signature with the algorithm the token names, but only
+// among the algorithms configured: "none" and HS256-with-an-RSA-key
+// confusion are rejected because neither has a key here.
+func (a *jwtAuth) verify(h jwtHeader, signed string, sig []byte) error {
+	switch h.Alg {
+	case "HS256":
+		if len(a.secret) == 0 {
+			return errors.New("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case "RS256":
+		digest := sha256.Sum256([]byte(signed))
+		if h.Kid != "" {
+			if key, ok := a.rsaKeys[h.Kid]; ok {
+				if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+					return nil
+				}
+				return errors.New("invalid token signature")
+			}
+		}
+		for _, key := range a.rsaKeys {
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+				return nil
+			}
+		}
+		return errors.New("invalid token signature")
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", h.Alg)
+	}
+}
+
+func decodeSegment(seg string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// audienceContains accepts aud as a single string or an array.
+func audienceContains(raw json.RawMessage, want string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == want
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		return slices.Contains(many, want)
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT builds a token with header and claims, signed for alg with key:
+// a []byte secret for HS256, an *rsa.PrivateKey for RS256, nothing for
+// anything else.
+func signJWT(t *testing.T, header, claims map[string]any, key any) string {
+	t.Helper()
+	seg := func(v any) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("encode token: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signed := seg(header) + "." + seg(claims)
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("sign token: %v", err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	secret := []byte("shared-secret")
+	signer, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&signer.PublicKey)
+	if err != nil {
+		t.Fatalf("encode public key: %v", err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+
+	hsOnly := &jwtAuth{issuer: "idp", audience: "fintech", secret: secret, leeway: 30 * time.Second, now: func() time.Time { return now }}
+	rsOnly := &jwtAuth{issuer: "idp", audience: "fintech", rsaKeys: map[string]*rsa.PublicKey{"k1": &signer.PublicKey},
+		leeway: 30 * time.Second, now: func() time.Time { return now }}
+
+	claims := func(edit func(map[string]any)) map[string]any {
+		c := map[string]any{"iss": "idp", "aud": "fintech", "sub": "acme-app", "tenant": "acme",
+			"exp": now.Add(time.Hour).Unix(), "scope": "transfers admin"}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	hs := map[string]any{"alg": "HS256", "typ": "JWT"}
+	rs := map[string]any{"alg": "RS256", "kid": "k1"}
+
+	tests := []struct {
+		name  string
+		auth  *jwtAuth
+		token string
+		want  *principal
+		err   string
+	}{
+		{name: "HS256", auth: hsOnly, token: signJWT(t, hs, claims(nil), secret),
+			want: &principal{Client: "acme-app", Tenant: "acme", Scopes: []string{"transfers", "admin"}, Method: "jwt"}},
+		{name: "RS256 by kid", auth: rsOnly, token: signJWT(t, rs, claims(nil), signer),
+			want: &principal{Client: "acme-app", Tenant: "acme", Scopes: []string{"transfers", "admin"}, Method: "jwt"}},
+		{name: "RS256 without kid tries every key", auth: rsOnly, token: signJWT(t, map[string]any{"alg": "RS256"}, claims(nil), signer),
+			want: &principal{Client: "acme-app", Tenant: "acme", Scopes: []string{"transfers", "admin"}, Method: "jwt"}},
+		{name: "scp list and default tenant", auth: hsOnly,
+			token: signJWT(t, hs, claims(func(c map[string]any) { delete(c, "scope"); delete(c, "tenant"); c["scp"] = []string{"debug"} }), secret),
+			want:  &principal{Client: "acme-app", Tenant: "default", Scopes: []string{"debug"}, Method: "jwt"}},
+		{name: "audience list", auth: hsOnly, token: signJWT(t, hs, claims(func(c map[string]any) { c["aud"] = []string{"other", "fintech"} }), secret),
+			want: &principal{Client: "acme-app", Tenant: "acme", Scopes: []string{"transfers", "admin"}, Method: "jwt"}},
+
+		{name: "wrong secret", auth: hsOnly, token: signJWT(t, hs, claims(nil), []byte("guess")), err: "invalid token signature"},
+		{name: "RS256 signed by an unknown key", auth: rsOnly, token: signJWT(t, rs, claims(nil), other), err: "invalid token signature"},
+		{name: "RS256 when only HS256 is configured", auth: hsOnly, token: signJWT(t, rs, claims(nil), signer), err: "invalid token signature"},
+		{name: "HS256 keyed with the RSA public key", auth: rsOnly, token: signJWT(t, hs, claims(nil), pubPEM), err: "HS256 tokens are not accepted"},
+		{name: "alg none", auth: hsOnly, token: signJWT(t, map[string]any{"alg": "none"}, claims(nil), nil), err: `unsupported token algorithm "none"`},
+		{name: "alg none with a signature", auth: hsOnly, token: signJWT(t, map[string]any{"alg": "none"}, claims(nil), secret), err: "unsupported token algorithm"},
+		{name: "claims altered after signing", auth: hsOnly, token: func() string {
+			parts := strings.Split(signJWT(t, hs, claims(nil), secret), ".")
+			forged := strings.Split(signJWT(t, hs, claims(func(c map[string]any) { c["tenant"] = "globex" }), secret), ".")
+			return parts[0] + "." + forged[1] + "." + parts[2]
+		}(), err: "invalid token signature"},
+
+		{name: "expired", auth: hsOnly, token: signJWT(t, hs, claims(func(c map[string]any) { c["exp"] = now.Add(-time.Minute).Unix() }), secret), err: "token expired"},
+		{name: "expired within leeway", auth: hsOnly, token: signJWT(t, hs, claims(func(c map[string]any) { c["exp"] = now.Add(-10 * time.Second).Unix() }), secret),
+			want: &principal{Client: "acme-app", Tenant: "acme", Scopes: []string{"transfers", "admin"}, Method: "jwt"}},
+		{name: "no exp", auth: hsOnly, token: signJWT(t, hs, claims(func(c map[string]any) { delete(c, "exp") }), secret), err: "token has no exp"},
+		{name: "not yet valid", auth: hsOnly, token: signJWT(t, hs, claims(func(c map[string]any) { c["nbf"] = now.Add(time.Minute).Unix() }), secret), err: "token not yet valid"},
+		{name: "nbf within leeway", auth: hsOnly, token: signJWT(t, hs, claims(func(c map[string]any) { c["nbf"] = now.Add(10 * time.Second).Unix() }), secret),
+			want: &principal{Client: "acme-app", Tenant: "acme", Scopes: []string{"transfers", "admin"}, Method: "jwt"}},
+		{name: "missing sub", auth: hsOnly, token: signJWT(t, hs, claims(func(c map[string]any) { delete(c, "sub") }), secret), err: "token has no sub"},
+		{name: "issuer mismatch", auth: hsOnly, token: signJWT(t, hs, claims(func(c map[string]any) { c["iss"] = "evil" }), secret), err: "token issuer mismatch"},
+		{name: "audience mismatch", auth: hsOnly, token: signJWT(t, hs, claims(func(c map[string]any) { c["aud"] = "other" }), secret), err: "token audience mismatch"},
+		{name: "malformed", auth: hsOnly, token: "a.b", err: "malformed token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			got, err := tt.auth.authenticate(r)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %+v, %v; want error %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticate: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "ApiKey abc")
+	if _, err := hsOnly.authenticate(r); err != errNoCredentials {
+		t.Errorf("non-bearer credentials: got %v, want errNoCredentials", err)
+	}
+}
+
+// TestBookingTenant covers whose accounts a transfer may touch: the
+// principal's tenant, unless the flow books for another tenant or, for
+// system-account flows, for the service itself.
+func TestBookingTenant(t *testing.T) {
+	acme := context.WithValue(context.Background(), principalKey, &principal{Client: "acme-app", Tenant: "acme"})
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{name: "no principal", ctx: context.Background(), want: ""},
+		{name: "principal", ctx: acme, want: "acme"},
+		{name: "on behalf of the service", ctx: onBehalfOf(acme, ""), want: ""},
+		{name: "on behalf of another tenant", ctx: onBehalfOf(acme, "globex"), want: "globex"},
+		{name: "without a principal", ctx: onBehalfOf(context.Background(), "globex"), want: "globex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bookingTenant(tt.ctx); got != tt.want {
+				t.Errorf("bookingTenant = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
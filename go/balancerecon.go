@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// The balance_reconciliation job checks every account's balance against its
+// ledger: opening_balance plus credits minus debits. Summaries stand in for
+// the entries compaction archived and carry the same sums, so the ledger
+// table alone is enough. Each batch is one statement, which reads every
+// balance and its entries in the same snapshot; a transfer committing
+// mid-run lands wholly inside or outside it.
+//
+// An account with drift has one open row in reconciliation_issues, updated
+// by each run that still finds it and resolved by the first that does not.
+// The reconciliation_drift gauge is the summed absolute drift per currency
+// from the last full run.
+
+const reconBatch = 500
+
+type balanceReconParams struct {
+	// AccountID restricts the run to one account; the gauge is only set by
+	// full runs.
+	AccountID string `json:"accountId,omitempty"`
+}
+
+type balanceReconRequest struct {
+	balanceReconParams
+	DryRun bool   `json:"dryRun"`
+	Actor  string `json:"actor"`
+}
+
+type balanceDrift struct {
+	AccountID     string `json:"accountId"`
+	Currency      string `json:"currency"`
+	Balance       Money  `json:"balance"`
+	LedgerBalance Money  `json:"ledgerBalance"`
+	Drift         Money  `json:"drift"`
+}
+
+type balanceReconResult struct {
+	Accounts int            `json:"accounts"`
+	Drifted  int            `json:"drifted"`
+	Resolved int64          `json:"resolved"`
+	Drift    []balanceDrift `json:"drift,omitempty"`
+}
+
+func (s *Store) handleReconcileBalances(w http.ResponseWriter, r *http.Request) {
+	var req balanceReconRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	id, err := s.enqueueJob(r.Context(), "balance_reconciliation", req.balanceReconParams, req.DryRun, req.Actor)
+	if err != nil {
+		http.Error(w, "failed to enqueue job", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", apiPath(r.Context(), fmt.Sprintf("/admin/jobs/%d", id)))
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"jobId": id, "dryRun": req.DryRun})
+}
+
+// runBalanceReconciliation walks the accounts in id order. A dry run
+// reports the drift without touching reconciliation_issues or the gauge.
+func (s *Store) runBalanceReconciliation(ctx context.Context, j *job) (any, error) {
+	var p balanceReconParams
+	if err := json.Unmarshal(j.Params, &p); err != nil {
+		return nil, err
+	}
+	var total int64
+	if err := s.pool.QueryRow(ctx, "SELECT count(*) FROM accounts WHERE $1 = '' OR id = $1", p.AccountID).Scan(&total); err != nil {
+		return nil, err
+	}
+	j.progress(ctx, 0, total)
+	var (
+		res    balanceReconResult
+		byCcy  = map[string]Money{}
+		cursor string
+	)
+	for {
+		rows, err := s.pool.Query(ctx, `
+			SELECT a.id, a.currency, a.balance,
+				a.opening_balance + COALESCE((SELECT sum(CASE l.type WHEN 'CREDIT' THEN l.amount ELSE -l.amount END)
+					FROM ledger l WHERE l.account_id = a.id), 0)
+			FROM accounts a
+			WHERE a.id > $1 AND ($2 = '' OR a.id = $2)
+			ORDER BY a.id LIMIT $3`, cursor, p.AccountID, reconBatch)
+		if err != nil {
+			return res, err
+		}
+		batch, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (balanceDrift, error) {
+			var d balanceDrift
+			err := row.Scan(&d.AccountID, &d.Currency, &d.Balance, &d.LedgerBalance)
+			d.Drift = d.Balance - d.LedgerBalance
+			return d, err
+		})
+		if err != nil {
+			return res, err
+		}
+		for _, d := range batch {
+			res.Accounts++
+			if d.Drift != 0 {
+				res.Drifted++
+				res.Drift = append(res.Drift, d)
+				byCcy[d.Currency] += max(d.Drift, -d.Drift)
+			}
+			if !j.DryRun {
+				resolved, err := s.recordDrift(ctx, j.ID, d)
+				if err != nil {
+					return res, fmt.Errorf("%s: %w", d.AccountID, err)
+				}
+				res.Resolved += resolved
+			}
+		}
+		j.progress(ctx, int64(res.Accounts), total)
+		if len(batch) < reconBatch {
+			break
+		}
+		cursor = batch[len(batch)-1].AccountID
+	}
+	if res.Drifted > 0 {
+		logger(ctx).Warn("balance drift found", "job_id", j.ID, "accounts", res.Drifted)
+	}
+	if !j.DryRun && p.AccountID == "" {
+		reconciliationDrift.Reset()
+		for ccy, v := range byCcy {
+			reconciliationDrift.WithLabelValues(ccy).Set(v.Float())
+		}
+	}
+	return res, nil
+}
+
+// recordDrift opens or refreshes the account's issue when it drifts and
+// resolves the open one when it no longer does. It returns the number of
+// issues resolved.
+func (s *Store) recordDrift(ctx context.Context, jobID int64, d balanceDrift) (int64, error) {
+	if d.Drift == 0 {
+		tag, err := s.pool.Exec(ctx, `
+			UPDATE reconciliation_issues SET resolved_at = now(), resolved_by_job_id = $2
+			WHERE account_id = $1 AND resolved_at IS NULL`, d.AccountID, jobID)
+		return tag.RowsAffected(), err
+	}
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO reconciliation_issues (account_id, currency, balance, ledger_balance, drift, job_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (account_id) WHERE resolved_at IS NULL DO UPDATE
+		SET balance = EXCLUDED.balance, ledger_balance = EXCLUDED.ledger_balance, drift = EXCLUDED.drift,
+			job_id = EXCLUDED.job_id, last_seen_at = now()`,
+		d.AccountID, d.Currency, d.Balance, d.LedgerBalance, d.Drift, jobID)
+	return 0, err
+}
+
+type reconciliationIssue struct {
+	ID            int64      `json:"id"`
+	AccountID     string     `json:"accountId"`
+	Currency      string     `json:"currency"`
+	Balance       Money      `json:"balance"`
+	LedgerBalance Money      `json:"ledgerBalance"`
+	Drift         Money      `json:"drift"`
+	JobID         int64      `json:"jobId"`
+	DetectedAt    time.Time  `json:"detectedAt"`
+	LastSeenAt    time.Time  `json:"lastSeenAt"`
+	ResolvedAt    *time.Time `json:"resolvedAt"`
+}
+
+// handleReconciliationIssues lists the open issues, or every issue with
+// ?status=all, newest first.
+func (s *Store) handleReconciliationIssues(w http.ResponseWriter, r *http.Request) {
+	all := false
+	switch r.URL.Query().Get("status") {
+	case "", "open":
+	case "all":
+		all = true
+	default:
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "status must be open or all"})
+		return
+	}
+	rows, err := s.pool.Query(r.Context(), `
+		SELECT id, account_id, currency, balance, ledger_balance, drift, job_id, detected_at, last_seen_at, resolved_at
+		FROM reconciliation_issues WHERE $1 OR resolved_at IS NULL ORDER BY id DESC LIMIT 500`, all)
+	if err != nil {
+		http.Error(w, "failed to load issues", http.StatusInternalServerError)
+		return
+	}
+	issues, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (reconciliationIssue, error) {
+		var i reconciliationIssue
+		err := row.Scan(&i.ID, &i.AccountID, &i.Currency, &i.Balance, &i.LedgerBalance, &i.Drift, &i.JobID, &i.DetectedAt, &i.LastSeenAt, &i.ResolvedAt)
+		return i, err
+	})
+	if err != nil {
+		http.Error(w, "failed to load issues", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"issues": issues})
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"fintech-go/internal/ledger"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// A batch carries many transfers in one round-trip, e.g. a payroll run. Each
+// item goes through the same path as POST /transfer (operation lock, journal,
+// risk screening, its own transaction) in the order given, so an earlier
+// item can fund a later one. Items succeed or fail independently: holding
+// every account lock of a payroll for one all-or-nothing transaction would
+// stall the source account for the whole run. Instead every item must carry
+// an operationId, and resubmitting the whole batch after a partial failure
+// or a lost response replays the items that already ran and executes only
+// the rest.
+//
+// Clients that need all or nothing ask for it with ?atomic=true: the items
+// are screened first, then booked in a single transaction that locks every
+// account of the batch up front, in ascending id order like lockAccounts, so
+// two atomic batches cannot deadlock on each other or on single transfers.
+// The first failing item rolls the whole batch back and answers for it. A
+// rule that would hold an item for review blocks it instead, since the
+// batch cannot wait for a reviewer. Resubmitting a committed atomic batch
+// replays it; reusing some of its operationIds in another batch is refused.
+//
+// The transfer rate limit is charged per item, on the item's own source
+// account. Items past the last one it allows are answered 429 and run on
+// resubmission; an atomic batch is refused whole instead.
+//
+// The body is decoded one item at a time and never held whole: reading stops
+// at the first item past BATCH_MAX_ITEMS, or at an item longer than
+// BATCH_MAX_ITEM_BYTES, so an oversized upload costs at most about one item
+// of memory before it is rejected with 413.
+
+const (
+	defaultBatchMaxItems     = 500
+	defaultBatchMaxItemBytes = 64 << 10
+)
+
+type batchItemResult struct {
+	Index       int             `json:"index"`
+	OperationID string          `json:"operationId"`
+	HTTPStatus  int             `json:"httpStatus"`
+	Response    json.RawMessage `json:"response"`
+}
+
+type batchResponse struct {
+	Results   []batchItemResult `json:"results"`
+	Total     int               `json:"total"`
+	Succeeded int               `json:"succeeded"`
+	Pending   int               `json:"pending"`
+	Failed    int               `json:"failed"`
+}
+
+func (s *Store) handleBatchTransfers(w http.ResponseWriter, r *http.Request) {
+	reqs, err := decodeBatch(r.Body, intOrDefault("BATCH_MAX_ITEMS", defaultBatchMaxItems),
+		int64(intOrDefault("BATCH_MAX_ITEM_BYTES", defaultBatchMaxItemBytes)))
+	var tooLarge batchTooLarge
+	switch {
+	case errors.As(err, &tooLarge):
+		writeJSON(w, http.StatusRequestEntityTooLarge, TransferResponse{Status: "error", Message: tooLarge.Error()})
+		return
+	case errors.Is(err, ledger.ErrTooPrecise):
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	case err != nil:
+		http.Error(w, "invalid json: expected an array of transfers", http.StatusBadRequest)
+		return
+	}
+	if len(reqs) == 0 {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "batch is empty"})
+		return
+	}
+	// reject the whole batch on malformed items, before any of it runs: a
+	// client fixing one item resubmits the same operationIds
+	seen := make(map[string]int, len(reqs))
+	for i, req := range reqs {
+		msg := validateTransfer(req)
+		if req.OperationID == "" {
+			msg = "operationId is required for batch items"
+		} else if j, dup := seen[req.OperationID]; dup {
+			msg = fmt.Sprintf("operationId repeats item %d", j)
+		}
+		if msg != "" {
+			transferRequests.WithLabelValues("validation_error").Inc()
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: fmt.Sprintf("item %d: %s", i, msg)})
+			return
+		}
+		seen[req.OperationID] = i
+	}
+
+	// every item spends a token on its own source account; past the ones
+	// that got one, an atomic batch is refused whole and any other is cut
+	// short, its remaining items answered 429 to run on resubmission
+	atomic := r.URL.Query().Get("atomic") == "true"
+	accounts := make([]string, len(reqs))
+	for i, req := range reqs {
+		accounts[i] = req.FromAccountID
+	}
+	allowed, scope, wait := s.limiter.allowBatch(accounts, atomic, time.Now())
+	if scope != "" {
+		rateLimited.WithLabelValues(scope).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		if allowed == 0 {
+			writeJSON(w, http.StatusTooManyRequests, TransferResponse{Status: "error", Message: "rate limit exceeded"})
+			return
+		}
+	}
+
+	ctx := withMeta(r.Context(), metaFromRequest(r))
+	if atomic {
+		out, status, err := s.runAtomicBatch(ctx, reqs)
+		if err != nil {
+			logger(ctx).Error("atomic batch failed", "items", len(reqs), "status", status, "error", err)
+			writeError(w, status, err)
+			return
+		}
+		logger(ctx).Info("atomic transfer batch", "items", out.Total)
+		writeJSON(w, http.StatusOK, out)
+		for _, req := range reqs {
+			s.markJournal(ctx, req.OperationID, journalResponded, "")
+		}
+		return
+	}
+	out := batchResponse{Results: make([]batchItemResult, 0, len(reqs)), Total: len(reqs)}
+	limited, _ := json.Marshal(TransferResponse{Status: "error", Message: "rate limit exceeded"})
+	for i, req := range reqs {
+		if i >= allowed {
+			out.Failed++
+			out.Results = append(out.Results, batchItemResult{Index: i, OperationID: req.OperationID, HTTPStatus: http.StatusTooManyRequests, Response: limited})
+			continue
+		}
+		if ctx.Err() != nil {
+			// the client is gone; the items not run are simply not in the
+			// journal and will run on resubmission
+			return
+		}
+		resp, status, err := s.transfer(ctx, req)
+		if err != nil {
+			logger(ctx).Error("batch transfer failed", "index", i, "operation_id", req.OperationID, "from", req.FromAccountID,
+				"to", req.ToAccountID, "amount", req.Amount, "status", status, "error", err)
+			status, resp = errorResponse(status, err)
+		}
+		raw := resp.raw
+		if raw == nil {
+			if raw, err = json.Marshal(resp); err != nil {
+				http.Error(w, "failed to encode response", http.StatusInternalServerError)
+				return
+			}
+		}
+		switch {
+		case status == http.StatusAccepted:
+			out.Pending++
+		case status < 300:
+			out.Succeeded++
+		default:
+			out.Failed++
+		}
+		out.Results = append(out.Results, batchItemResult{Index: i, OperationID: req.OperationID, HTTPStatus: status, Response: raw})
+	}
+	logger(ctx).Info("transfer batch", "items", out.Total, "succeeded", out.Succeeded, "pending", out.Pending, "failed", out.Failed)
+	writeJSON(w, http.StatusOK, out)
+	for i, req := range reqs {
+		if out.Results[i].HTTPStatus < 300 {
+			s.markJournal(ctx, req.OperationID, journalResponded, "")
+		}
+	}
+}
+
+var errBatchPartlyProcessed = errors.New("operationId was already processed outside this batch")
+
+// runAtomicBatch runs reqs all or nothing. The error of a failing item is
+// wrapped with its index.
+func (s *Store) runAtomicBatch(ctx context.Context, reqs []TransferRequest) (batchResponse, int, error) {
+	if out, status, err := s.replayAtomicBatch(ctx, reqs); out != nil || err != nil {
+		return *out, status, err
+	}
+	for i := range reqs {
+		reqs[i].atomic, reqs[i].screened = true, true
+	}
+	// fail marks the journal entry of every item this call claimed but the
+	// failing one, which is marked with its own error; failed is -1 when no
+	// item is to blame
+	claimed := 0
+	fail := func(failed int, status int, err error) (batchResponse, int, error) {
+		for i, req := range reqs[:claimed] {
+			if i != failed {
+				s.markJournal(ctx, req.OperationID, journalFailed, "batch rolled back")
+			}
+		}
+		if failed < 0 {
+			return batchResponse{}, status, err
+		}
+		return batchResponse{}, status, fmt.Errorf("item %d: %w", failed, err)
+	}
+	// every item is journaled before any of them runs; without the
+	// operation locks of the single path, an entry this call could not
+	// claim belongs to a concurrent request with the same operationId
+	for i, req := range reqs {
+		ok, err := s.journalClaim(ctx, req)
+		if err != nil {
+			return fail(i, http.StatusInternalServerError, fmt.Errorf("journal operation: %w", err))
+		}
+		if !ok {
+			return fail(i, http.StatusConflict, errOperationInFlight)
+		}
+		claimed++
+	}
+	for i, req := range reqs {
+		outcome, caseID, err := s.evaluateRisk(ctx, riskInput{Req: req, Meta: metaFromContext(ctx)})
+		if err != nil {
+			s.markJournal(ctx, req.OperationID, journalFailed, err.Error())
+			s.transferFailed(ctx, req, http.StatusInternalServerError, err)
+			return fail(i, http.StatusInternalServerError, err)
+		}
+		if outcome.Decision != riskAllow {
+			_, status, err := s.riskResponse(ctx, req, outcome, caseID)
+			return fail(i, status, err)
+		}
+	}
+	for _, req := range reqs {
+		s.markJournal(ctx, req.OperationID, journalExecuting, "")
+	}
+
+	var (
+		booked []booking
+		failed int
+	)
+	status, err := s.retryTx(ctx, func() (status int, err error) {
+		booked, failed, status, err = s.bookBatch(ctx, reqs)
+		return status, err
+	})
+	var held *errRuleHits
+	switch {
+	case errors.As(err, &held):
+		req := reqs[failed]
+		outcome, caseID, err := s.decideRisk(ctx, riskInput{Req: req, Meta: metaFromContext(ctx)}, riskStagePreCommit, held.hits)
+		if err != nil {
+			s.markJournal(ctx, req.OperationID, journalFailed, err.Error())
+			s.transferFailed(ctx, req, http.StatusInternalServerError, err)
+			return fail(failed, http.StatusInternalServerError, err)
+		}
+		_, status, err = s.riskResponse(ctx, req, outcome, caseID)
+		return fail(failed, status, err)
+	case errors.Is(err, errAlreadyProcessed):
+		// a concurrent copy of the batch committed first
+		if out, status, err := s.replayAtomicBatch(ctx, reqs); out != nil || err != nil {
+			return *out, status, err
+		}
+		return batchResponse{}, http.StatusInternalServerError, errors.New("processed operation disappeared")
+	case err != nil && failed < 0:
+		return fail(failed, status, err)
+	case err != nil:
+		s.markJournal(ctx, reqs[failed].OperationID, journalFailed, err.Error())
+		s.transferFailed(ctx, reqs[failed], status, err)
+		return fail(failed, status, err)
+	}
+
+	out := batchResponse{Results: make([]batchItemResult, 0, len(reqs)), Total: len(reqs), Succeeded: len(reqs)}
+	for i, req := range reqs {
+		s.transferCommitted(req, booked[i])
+		out.Results = append(out.Results, batchItemResult{Index: i, OperationID: req.OperationID, HTTPStatus: http.StatusOK, Response: booked[i].resp.raw})
+	}
+	return out, http.StatusOK, nil
+}
+
+// replayAtomicBatch answers a resubmitted atomic batch from processed_ops.
+// It returns a nil response and no error when none of reqs has run.
+func (s *Store) replayAtomicBatch(ctx context.Context, reqs []TransferRequest) (*batchResponse, int, error) {
+	processed := make([]*processedOp, len(reqs))
+	n := 0
+	for i, req := range reqs {
+		p, err := s.findProcessed(ctx, req.OperationID)
+		if err != nil {
+			return &batchResponse{}, http.StatusInternalServerError, fmt.Errorf("item %d: failed to check duplicate: %w", i, err)
+		}
+		if p != nil {
+			processed[i] = p
+			n++
+		}
+	}
+	switch n {
+	case 0:
+		return nil, 0, nil
+	case len(reqs):
+	default:
+		// an atomic batch commits whole, so a mix means the operationIds
+		// were reused
+		i := slices.IndexFunc(processed, func(p *processedOp) bool { return (p == nil) != (processed[0] == nil) })
+		return &batchResponse{}, http.StatusConflict, fmt.Errorf("item %d: %w", i, errBatchPartlyProcessed)
+	}
+	out := batchResponse{Results: make([]batchItemResult, 0, len(reqs)), Total: len(reqs)}
+	for i, req := range reqs {
+		resp, status, err := replayProcessed(ctx, req, processed[i])
+		if err != nil {
+			return &out, status, fmt.Errorf("item %d: %w", i, err)
+		}
+		raw := resp.raw
+		if raw == nil {
+			if raw, err = json.Marshal(resp); err != nil {
+				return &out, http.StatusInternalServerError, fmt.Errorf("item %d: encode response: %w", i, err)
+			}
+		}
+		out.Succeeded++
+		out.Results = append(out.Results, batchItemResult{Index: i, OperationID: req.OperationID, HTTPStatus: status, Response: raw})
+	}
+	return &out, http.StatusOK, nil
+}
+
+// bookBatch books reqs in one transaction. On error it also returns the
+// index of the item that failed, or -1 when the transaction itself did.
+func (s *Store) bookBatch(ctx context.Context, reqs []TransferRequest) ([]booking, int, int, error) {
+	tx, err := s.beginTx(ctx, pgx.TxOptions{IsoLevel: s.isoLevel})
+	if err != nil {
+		return nil, -1, http.StatusInternalServerError, fmt.Errorf("failed to start tx: %w", err)
+	}
+	defer tx.Rollback(ctx) // safe to call after commit
+
+	ids := make([]string, 0, 2*len(reqs))
+	for _, req := range reqs {
+		ids = append(ids, req.FromAccountID, req.ToAccountID)
+	}
+	// locking item by item would take the accounts in batch order; each
+	// item's own lockAccounts then finds its rows already held
+	if _, err := lockAccounts(ctx, tx, ids...); err != nil {
+		return nil, -1, http.StatusInternalServerError, fmt.Errorf("lock accounts: %w", err)
+	}
+	booked := make([]booking, len(reqs))
+	for i, req := range reqs {
+		b, status, err := s.bookTransfer(ctx, tx, req)
+		if err != nil {
+			return nil, i, status, err
+		}
+		booked[i] = b
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, -1, http.StatusInternalServerError, fmt.Errorf("commit tx: %w", err)
+	}
+	return booked, 0, http.StatusOK, nil
+}
+
+// batchTooLarge is a batch past the item count or item size limits.
+type batchTooLarge string
+
+func (e batchTooLarge) Error() string { return string(e) }
+
+var errItemTooLarge = errors.New("item too large")
+
+// decodeBatch reads a JSON array of transfers item by item. Each item may
+// read at most maxItemBytes from body (the decoder's read-ahead included),
+// so memory stays bounded whatever the client sends.
+func decodeBatch(body io.Reader, maxItems int, maxItemBytes int64) ([]TransferRequest, error) {
+	lr := &itemLimitReader{r: body, left: maxItemBytes}
+	dec := json.NewDecoder(lr)
+	if t, err := dec.Token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('[') {
+		return nil, errors.New("expected an array")
+	}
+	var reqs []TransferRequest
+	for dec.More() {
+		i := len(reqs)
+		if i == maxItems {
+			return nil, batchTooLarge(fmt.Sprintf("batch has more than %d items", maxItems))
+		}
+		lr.left = maxItemBytes
+		start := dec.InputOffset()
+		var req TransferRequest
+		err := dec.Decode(&req)
+		if errors.Is(err, errItemTooLarge) || dec.InputOffset()-start > maxItemBytes {
+			return nil, batchTooLarge(fmt.Sprintf("item %d: larger than %d bytes", i, maxItemBytes))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %w", i, err)
+		}
+		reqs = append(reqs, req)
+	}
+	lr.left = maxItemBytes
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// itemLimitReader fails reads once left bytes have been read.
+type itemLimitReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *itemLimitReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		return 0, errItemTooLarge
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/ledger"
+)
+
+// tenantBranding lets a white-label partner replace customer-facing text.
+// Templates use {placeholder} substitution only; unknown placeholders are
+// left as written so a typo shows up in review instead of vanishing.
+type tenantBranding struct {
+	// Descriptors maps a counterparty category, optionally suffixed with
+	// ".in" or ".out" for the direction, to a statement descriptor
+	// template. Placeholders: {name}, {account}, {virtualAccount}.
+	Descriptors map[string]string `json:"descriptors,omitempty"`
+	// Notifications maps an event type to a message template; every
+	// top-level field of the event payload is a placeholder, and
+	// {displayAmount} and {displayAt} are the amount and time in the
+	// tenant's locale.
+	Notifications map[string]string `json:"notifications,omitempty"`
+	// Support is added to error responses for the tenant's callers.
+	Support *supportContact `json:"support,omitempty"`
+}
+
+type supportContact struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+	Phone string `json:"phone,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+// defaultNotifications are used for event types a tenant does not override.
+var defaultNotifications = map[string]string{
+	"payout.returned":  "Your payout of {displayAmount} was returned by the receiving bank ({reasonCode}) and credited back. Receipt {receiptNumber}.",
+	"transfer.expired": "A transfer awaiting {state} expired and was not executed.",
+	"hold.released":    "The authorization of {displayAmount} was released and the funds are available again.",
+	"hold.expired":     "The authorization of {displayAmount} expired and the funds are available again.",
+}
+
+const maxTemplateLength = 500
+
+var placeholderPattern = regexp.MustCompile(`\{[A-Za-z]+\}`)
+
+func (b *tenantBranding) validate() error {
+	if b == nil {
+		return nil
+	}
+	for _, m := range []map[string]string{b.Descriptors, b.Notifications} {
+		for k, tpl := range m {
+			if len(tpl) == 0 || len(tpl) > maxTemplateLength {
+				return fmt.Errorf("template %q must be 1-%d characters", k, maxTemplateLength)
+			}
+		}
+	}
+	for k := range b.Descriptors {
+		category, _, _ := strings.Cut(k, ".")
+		if _, ok := categoryIcons[category]; !ok {
+			return fmt.Errorf("unknown descriptor category %q", category)
+		}
+	}
+	return nil
+}
+
+func renderTemplate(tpl string, vars map[string]string) string {
+	return placeholderPattern.ReplaceAllStringFunc(tpl, func(ph string) string {
+		if v, ok := vars[ph[1:len(ph)-1]]; ok {
+			return v
+		}
+		return ph
+	})
+}
+
+// descriptor returns the branded statement descriptor for a counterparty,
+// or "" when the tenant keeps the default.
+func (b *tenantBranding) descriptor(c *ledger.Counterparty, outgoing bool, virtualAccount *string) string {
+	if b == nil || len(b.Descriptors) == 0 {
+		return ""
+	}
+	dir := ".in"
+	if outgoing {
+		dir = ".out"
+	}
+	tpl, ok := b.Descriptors[c.Category+dir]
+	if !ok {
+		if tpl, ok = b.Descriptors[c.Category]; !ok {
+			return ""
+		}
+	}
+	vars := map[string]string{"name": c.Name, "account": c.MaskedAccount}
+	if vars["name"] == "" {
+		vars["name"] = c.MaskedAccount
+	}
+	if virtualAccount != nil {
+		vars["virtualAccount"] = maskAccount(*virtualAccount)
+	}
+	return renderTemplate(tpl, vars)
+}
+
+// withBranding resolves the caller's tenant once per request and exposes its
+// support contact to writeJSON. It sits inside withAuth so the tenant is the
+// authenticated one when auth is enabled.
+func withBranding(tenants *tenantConfigs, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := tenants.effective(metaFromRequest(r).Tenant).Branding
+		if b == nil || b.Support == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&brandedWriter{ResponseWriter: w, support: b.Support}, r)
+	})
+}
+
+type brandedWriter struct {
+	http.ResponseWriter
+	support *supportContact
+}
+
+func (w *brandedWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// supportFor finds the support contact through any wrapping writers.
+func supportFor(w http.ResponseWriter) *supportContact {
+	for w != nil {
+		if bw, ok := w.(*brandedWriter); ok {
+			return bw.support
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+	return nil
+}
+
+type notification struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Message   string          `json:"message"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// handleAccountNotifications lists the events about an account with their
+// customer-facing message rendered from the account tenant's templates.
+func (s *Store) handleAccountNotifications(w http.ResponseWriter, r *http.Request) {
+	ctx := withQueryPattern(r.Context(), patternStatements)
+	id := r.PathValue("id")
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	var tenant, ccy string
+	err = s.pool.QueryRow(ctx, "SELECT tenant_id, currency FROM accounts WHERE id=$1", id).Scan(&tenant, &ccy)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "account not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	cfg := s.tenants.effective(tenant)
+	branding, format := cfg.Branding, cfg.formatter()
+
+	rows, err := s.pool.Query(ctx, "SELECT id, type, payload, created_at FROM events WHERE subject=$1 ORDER BY id DESC LIMIT $2", "account/"+id, limit)
+	if err != nil {
+		http.Error(w, "failed to load notifications", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := make([]notification, 0)
+	for rows.Next() {
+		var n notification
+		if err := rows.Scan(&n.ID, &n.Type, &n.Payload, &n.CreatedAt); err != nil {
+			http.Error(w, "failed to parse notifications", http.StatusInternalServerError)
+			return
+		}
+		tpl, ok := defaultNotifications[n.Type]
+		if branding != nil {
+			if t, found := branding.Notifications[n.Type]; found {
+				tpl, ok = t, true
+			}
+		}
+		if ok {
+			n.Message = renderTemplate(tpl, displayVars(payloadVars(n.Payload), format, ccy, n.CreatedAt))
+		}
+		list = append(list, n)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "failed to load notifications", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// payloadVars flattens the top-level scalar fields of an event payload.
+// Numbers keep their JSON text so amounts render as "10.50", not "10.5".
+func payloadVars(raw json.RawMessage) map[string]string {
+	var m map[string]any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil
+	}
+	vars := make(map[string]string, len(m))
+	for k, v := range m {
+		switch v := v.(type) {
+		case string:
+			vars[k] = v
+		case json.Number:
+			vars[k] = v.String()
+		case bool:
+			vars[k] = strconv.FormatBool(v)
+		}
+	}
+	return vars
+}
+
+// displayVars adds the formatted amount and time to a payload's
+// placeholders. The amount is in the payload's currency, or the account's
+// when it names none; the time is the payload's, or the event's.
+func displayVars(vars map[string]string, f ledger.Formatter, currency string, at time.Time) map[string]string {
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	if c, ok := vars["currency"]; ok {
+		currency = c
+	}
+	if v, ok := vars["amount"]; ok {
+		if m, err := ledger.ParseMoney(v, moneyExponent); err == nil {
+			vars["displayAmount"] = f.Money(m, currency)
+		}
+	}
+	if v, ok := vars["at"]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			at = t
+		}
+	}
+	vars["displayAt"] = f.DateTime(at)
+	return vars
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+const bulkBatchSize = 500
+
+// accountFilter selects the accounts a bulk operation applies to. Empty
+// fields do not filter; at least one field must be set so a typo cannot
+// freeze every account in the system.
+type accountFilter struct {
+	TenantID string   `json:"tenantId,omitempty"`
+	IDs      []string `json:"ids,omitempty"`
+	Status   string   `json:"status,omitempty"`
+}
+
+func (f accountFilter) empty() bool {
+	return f.TenantID == "" && len(f.IDs) == 0 && f.Status == ""
+}
+
+type bulkAccountParams struct {
+	Action string        `json:"action"`
+	Filter accountFilter `json:"filter"`
+	// TransferLimit is the new per-transfer maximum for set_limit, and
+	// DailyLimit the new daily one for set_daily_limit; null removes the
+	// limit.
+	TransferLimit *Money `json:"transferLimit,omitempty"`
+	DailyLimit    *Money `json:"dailyLimit,omitempty"`
+}
+
+type bulkAccountResult struct {
+	Matched int64            `json:"matched"`
+	Changed int64            `json:"changed"`
+	Skipped map[string]int64 `json:"skipped"`
+	Sample  []string         `json:"sample"`
+}
+
+type bulkAccountRequest struct {
+	bulkAccountParams
+	DryRun bool   `json:"dryRun"`
+	Actor  string `json:"actor"`
+}
+
+func (s *Store) handleBulkAccounts(w http.ResponseWriter, r *http.Request) {
+	var req bulkAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	id, err := s.enqueueJob(r.Context(), "bulk_accounts", req.bulkAccountParams, req.DryRun, req.Actor)
+	if err != nil {
+		http.Error(w, "failed to enqueue job", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", apiPath(r.Context(), fmt.Sprintf("/admin/jobs/%d", id)))
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"jobId": id, "dryRun": req.DryRun})
+}
+
+func (req bulkAccountRequest) validate() error {
+	if req.Actor == "" {
+		return fmt.Errorf("actor is required")
+	}
+	switch req.Action {
+	case "freeze", "unfreeze", "close", "set_limit", "set_daily_limit":
+	default:
+		return fmt.Errorf("action must be freeze, unfreeze, close, set_limit or set_daily_limit")
+	}
+	if req.Filter.empty() {
+		return fmt.Errorf("filter must select accounts by tenantId, ids or status")
+	}
+	if req.TransferLimit != nil && *req.TransferLimit <= 0 {
+		return fmt.Errorf("transferLimit must be > 0")
+	}
+	if req.DailyLimit != nil && *req.DailyLimit <= 0 {
+		return fmt.Errorf("dailyLimit must be > 0")
+	}
+	return nil
+}
+
+// runBulkAccounts walks the filtered accounts in id order, one batch per
+// transaction, so a large closure makes steady progress and a crash loses at
+// most one batch. Accounts already in the target state are skipped rather
+// than rewritten; closure also skips accounts that still hold funds.
+func (s *Store) runBulkAccounts(ctx context.Context, j *job) (any, error) {
+	var p bulkAccountParams
+	if err := json.Unmarshal(j.Params, &p); err != nil {
+		return nil, err
+	}
+	res := bulkAccountResult{Skipped: map[string]int64{}, Sample: make([]string, 0)}
+
+	where, args := p.Filter.sql()
+	if err := s.pool.QueryRow(ctx, "SELECT count(*) FROM accounts WHERE "+where, args...).Scan(&res.Matched); err != nil {
+		return nil, err
+	}
+	j.progress(ctx, 0, res.Matched)
+
+	cursor := ""
+	var processed int64
+	for {
+		batchArgs := append(append([]any{}, args...), cursor, bulkBatchSize)
+		n := len(args)
+		rows, err := s.pool.Query(ctx, fmt.Sprintf(`
+			SELECT id, status, balance FROM accounts
+			WHERE %s AND id > $%d ORDER BY id LIMIT $%d`, where, n+1, n+2), batchArgs...)
+		if err != nil {
+			return res, err
+		}
+		var change []string
+		last := ""
+		for rows.Next() {
+			var (
+				id, status string
+				balance    Money
+			)
+			if err := rows.Scan(&id, &status, &balance); err != nil {
+				rows.Close()
+				return res, err
+			}
+			last = id
+			processed++
+			if reason := p.skipReason(status, balance); reason != "" {
+				res.Skipped[reason]++
+				continue
+			}
+			change = append(change, id)
+			if len(res.Sample) < 20 {
+				res.Sample = append(res.Sample, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return res, err
+		}
+		if last == "" {
+			break
+		}
+		cursor = last
+
+		if !j.DryRun && len(change) > 0 {
+			changed, err := s.applyBulk(ctx, p, change, j)
+			if err != nil {
+				return res, err
+			}
+			res.Changed += changed
+		} else if j.DryRun {
+			res.Changed += int64(len(change))
+		}
+		j.progress(ctx, processed, res.Matched)
+	}
+	return res, nil
+}
+
+func (p bulkAccountParams) skipReason(status string, balance Money) string {
+	switch p.Action {
+	case "freeze":
+		if status != accountActive {
+			return "not_active"
+		}
+	case "unfreeze":
+		if status != accountFrozen {
+			return "not_frozen"
+		}
+	case "close":
+		if status == accountClosed {
+			return "already_closed"
+		}
+		if balance != 0 {
+			return "nonzero_balance"
+		}
+	case "set_limit", "set_daily_limit":
+		if status == accountClosed {
+			return "closed"
+		}
+	}
+	return ""
+}
+
+func (s *Store) applyBulk(ctx context.Context, p bulkAccountParams, ids []string, j *job) (int64, error) {
+	var (
+		sql  string
+		args []any
+	)
+	// status changes read the previous status under the row lock and write
+	// their audit rows in the same statement
+	const transition = `
+		WITH prev AS (
+			SELECT id, status FROM accounts WHERE id = ANY($1) AND %s FOR UPDATE
+		), changed AS (
+			UPDATE accounts a SET status=$2%s FROM prev WHERE a.id = prev.id RETURNING a.id, prev.status
+		)
+		INSERT INTO account_status_changes (account_id, from_status, to_status, actor, reason, source)
+		SELECT id, status, $2, $3, $4, $5 FROM changed`
+	reason, source := "bulk "+p.Action, fmt.Sprintf("bulk_job/%d", j.ID)
+	switch p.Action {
+	case "freeze":
+		sql = fmt.Sprintf(transition, "status=$6", "")
+		args = []any{ids, accountFrozen, j.CreatedBy, reason, source, accountActive}
+	case "unfreeze":
+		sql = fmt.Sprintf(transition, "status=$6", "")
+		args = []any{ids, accountActive, j.CreatedBy, reason, source, accountFrozen}
+	case "close":
+		// re-check the balance under the row lock: funds may have arrived
+		// since the batch was read, and an account with active holds stays
+		// open
+		sql = fmt.Sprintf(transition, "status<>$2 AND balance=0 AND held=0", ", closed_at=now()")
+		args = []any{ids, accountClosed, j.CreatedBy, reason, source}
+	case "set_limit":
+		sql, args = "UPDATE accounts SET transfer_limit=$2 WHERE id = ANY($1) AND status<>$3", []any{ids, p.TransferLimit, accountClosed}
+	case "set_daily_limit":
+		sql, args = "UPDATE accounts SET daily_limit=$2 WHERE id = ANY($1) AND status<>$3", []any{ids, p.DailyLimit, accountClosed}
+	}
+	tag, err := s.pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, err
+	}
+	s.cache.accounts.invalidate(ids...)
+	slog.Info("bulk action applied", "job_id", j.ID, "action", p.Action, "accounts", tag.RowsAffected(), "actor", j.CreatedBy)
+	return tag.RowsAffected(), nil
+}
+
+// sql renders the filter as a WHERE clause with positional arguments.
+func (f accountFilter) sql() (string, []any) {
+	where := "true"
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where += fmt.Sprintf(" AND "+cond, len(args))
+	}
+	if f.TenantID != "" {
+		add("tenant_id=$%d", f.TenantID)
+	}
+	if len(f.IDs) > 0 {
+		add("id = ANY($%d)", f.IDs)
+	}
+	if f.Status != "" {
+		add("status=$%d", f.Status)
+	}
+	return where, args
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The read caches keep hot lookups off the primary: accounts by id (GET
+// /accounts/{id} and the gRPC GetAccount), virtual account resolution of
+// inbound credits, and usage reports. Each has its TTL in READ_CACHE_*_TTL
+// (0 disables it) and holds at most READ_CACHE_SIZE entries. Writes made by
+// this process invalidate what they touch once committed; writes made by
+// other replicas are seen when the entry expires, so the TTL is how stale a
+// read may be. Money never moves on a cached read: transfers lock and read
+// the rows themselves.
+//
+// read_cache_requests_total counts hits and misses per cache.
+
+type readCaches struct {
+	accounts *readCache[Account]
+	aliases  *readCache[aliasResolution]
+	usage    *readCache[[]usageRow]
+}
+
+func readCachesFromEnv() readCaches {
+	size := intOrDefault("READ_CACHE_SIZE", 10000)
+	return readCaches{
+		accounts: newReadCache[Account]("accounts", durationOrDefault("READ_CACHE_ACCOUNT_TTL", 2*time.Second), size),
+		aliases:  newReadCache[aliasResolution]("aliases", durationOrDefault("READ_CACHE_ALIAS_TTL", time.Minute), size),
+		usage:    newReadCache[[]usageRow]("usage", durationOrDefault("READ_CACHE_USAGE_TTL", 30*time.Second), size),
+	}
+}
+
+type readCache[V any] struct {
+	name string
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry[V]
+	// gen is bumped by every invalidation. A load that started before one
+	// may have read the old row, so its result is not stored.
+	gen uint64
+}
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newReadCache[V any](name string, ttl time.Duration, size int) *readCache[V] {
+	return &readCache[V]{name: name, ttl: ttl, size: size, entries: map[string]cacheEntry[V]{}}
+}
+
+// fetch returns the cached value of key, or loads and caches it. Errors
+// are not cached.
+func (c *readCache[V]) fetch(key string, load func() (V, error)) (V, error) {
+	if c == nil || c.ttl <= 0 {
+		return load()
+	}
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	gen := c.gen
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		readCacheRequests.WithLabelValues(c.name, "hit").Inc()
+		return e.value, nil
+	}
+	readCacheRequests.WithLabelValues(c.name, "miss").Inc()
+	v, err := load()
+	if err != nil {
+		return v, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return v, nil
+	}
+	if len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = cacheEntry[V]{value: v, expires: now.Add(c.ttl)}
+	return v, nil
+}
+
+// evict drops the expired entries, and an arbitrary tenth of the rest when
+// that is not enough. c.mu must be held.
+func (c *readCache[V]) evict(now time.Time) {
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	drop := len(c.entries) - c.size + max(c.size/10, 1)
+	for k := range c.entries {
+		if drop <= 0 {
+			break
+		}
+		delete(c.entries, k)
+		drop--
+	}
+}
+
+// invalidate drops keys; call it after the write commits.
+func (c *readCache[V]) invalidate(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, k := range keys {
+		delete(c.entries, k)
+	}
+}
+
+// purge drops every entry, for writes that touch more than they can name.
+func (c *readCache[V]) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	clear(c.entries)
+}
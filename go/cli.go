@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"fintech-go/internal/ledger"
+)
+
+// The binary is a small CLI whose first argument names the command:
+//
+//	serve      run the service (the default, so "-role api" alone still works)
+//	migrate    up, down [n] or status
+//	seed       run the built-in seeds, and load accounts with -file or -csv
+//	reconcile  check balances against the ledger once and print the result
+//
+// Every command reads the same configuration (-config and the environment).
+// The one-off commands connect like the service but start none of its
+// background loops, so they can run next to a live deployment.
+
+type command struct {
+	run   func(args []string)
+	usage string
+}
+
+var commands = map[string]command{
+	"serve":     {runServe, "run the service"},
+	"migrate":   {runMigrate, "apply (up), roll back (down [n]) or list (status) migrations"},
+	"seed":      {runSeed, "run the built-in seeds and load accounts from -file or -csv"},
+	"reconcile": {runReconcile, "check every balance against the ledger and print the drift"},
+}
+
+func main() {
+	setupLogging()
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage()
+		os.Exit(2)
+	}
+	cmd.run(args)
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
+
+// commandFlags is the flag set of a command, with the -config flag every
+// command shares.
+func commandFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file; environment variables override it")
+	return fs, configFile
+}
+
+// openStore connects to the database and builds the Store with everything
+// it needs to move money; the caller starts the background loops. The
+// Vault credentials, when configured, are returned for the caller to keep
+// alive.
+func openStore(ctx context.Context, cfg Config) (*Store, *vaultDBCredentials) {
+	poolConfig, err := pgxpool.ParseConfig(cfg.DB.DSN())
+	if err != nil {
+		fatal("invalid database config", "error", err)
+	}
+	poolConfig.ConnConfig.Tracer = queryTracer{}
+	var dbCreds *vaultDBCredentials
+	if cfg.DB.VaultPath != "" {
+		if dbCreds, err = newVaultDBCredentials(ctx, cfg.DB.VaultPath); err != nil {
+			fatal("failed to load database credentials", "error", err)
+		}
+		poolConfig.BeforeConnect = dbCreds.beforeConnect
+	}
+	if _, ok := poolConfig.ConnConfig.RuntimeParams["application_name"]; !ok {
+		poolConfig.ConnConfig.RuntimeParams["application_name"] = applicationName
+	}
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		fatal("failed to open pool", "error", err)
+	}
+	// the operation locks get their own pool so lock holders can never
+	// take the connections their operations need
+	lockConfig := poolConfig.Copy()
+	lockConfig.MinConns = 0
+	if cfg.DB.LockConns > 0 {
+		lockConfig.MaxConns = int32(cfg.DB.LockConns)
+	}
+	locks, err := pgxpool.NewWithConfig(ctx, lockConfig)
+	if err != nil {
+		fatal("failed to open lock pool", "error", err)
+	}
+	// validated with the rest of the configuration
+	isoLevel, _ := parseIsolation(cfg.DB.Isolation)
+	keys, err := keyManagerFromEnv(ctx)
+	if err != nil {
+		fatal("failed to load keyring", "error", err)
+	}
+	rates, err := staticRatesFromEnv()
+	if err != nil {
+		fatal("invalid FX_RATES", "error", err)
+	}
+	riskRules, err := riskRulesFromEnv()
+	if err != nil {
+		fatal("invalid risk configuration", "error", err)
+	}
+	tenants := &tenantConfigs{}
+	rules := &dslEngine{tenants: tenants}
+	store := &Store{
+		pool:       pool,
+		locks:      locks,
+		isoLevel:   isoLevel,
+		maxRetries: cfg.DB.MaxRetries,
+		lockWait:   cfg.Timeouts.IdempotencyLockWait,
+		risk:       append(riskRules, rules),
+		checks:     []transferCheck{rules},
+		rules:      rules,
+		tenants:    tenants,
+		keys:       keys,
+		rates:      rates,
+		health:     newHealthMonitor(pool, healthThresholdsFromEnv()),
+		flags:      &runtimeFlags{},
+		templates:  &messageTemplates{},
+		clocks:     &tenantClocks{},
+		stats:      &statsCache{ttl: durationOrDefault("DEBUG_STATS_TTL", 5*time.Second)},
+		cache:      readCachesFromEnv(),
+		outbox:     cfg.Features.Outbox,
+		webhooks:   cfg.Features.Webhooks,
+	}
+	store.jobHandlers = map[string]jobHandler{
+		"bulk_accounts":          store.runBulkAccounts,
+		"balance_sweeps":         store.runSweeps,
+		"usage_meters":           store.runUsageMeters,
+		"usage_summary":          store.runUsageSummary,
+		"ledger_merkle":          store.runLedgerMerkle,
+		"ledger_compaction":      store.runLedgerCompaction,
+		"balance_reconciliation": store.runBalanceReconciliation,
+		"eod":                    store.runEOD,
+		"ledger_export":          store.runLedgerExport,
+	}
+	return store, dbCreds
+}
+
+// openCurrentStore opens the store for a one-off command, failing unless
+// the schema is current.
+func openCurrentStore(ctx context.Context, configFile string) *Store {
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	store, _ := openStore(ctx, cfg)
+	if state, detail := checkSchemaVersion(ctx, store); state == checkFail {
+		fatal("database schema is not ready", "detail", detail)
+	}
+	return store
+}
+
+func runMigrate(args []string) {
+	fs, configFile := commandFlags("migrate")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s migrate [-config file] [up | down [n] | status]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	store, _ := openStore(ctx, cfg)
+	store.runMigrateCommand(ctx, fs.Args())
+}
+
+// seedAccount is one account of a seed file. The balance becomes its
+// opening balance, so the account reconciles without ledger entries.
+type seedAccount struct {
+	ID          string `json:"id"`
+	TenantID    string `json:"tenantId"`
+	DisplayName string `json:"displayName"`
+	// Currency defaults to the service currency.
+	Currency       string `json:"currency"`
+	Balance        Money  `json:"balance"`
+	OverdraftLimit Money  `json:"overdraftLimit"`
+	// Status is active (the default) or frozen.
+	Status string `json:"status"`
+
+	// line is the account's line in a CSV file, for error messages.
+	line int
+}
+
+type seedResult struct {
+	Created []string `json:"created"`
+	// Updated lists the accounts a CSV load renamed.
+	Updated []string `json:"updated,omitempty"`
+	// Existing lists the accounts already there, which are left untouched.
+	Existing []string `json:"existing"`
+}
+
+// runSeed is the seed command. -file names a JSON array of seedAccount (see
+// accounts.example.json); the whole file is validated first and loaded in
+// one transaction. Running it again creates only the accounts that are
+// missing.
+//
+// -csv loads the same accounts from a CSV file whose header names the
+// columns by their JSON names (see accounts.example.csv), for environments
+// provisioned with thousands of accounts: the rows are copied into a
+// temporary table with COPY and merged from there in the one transaction.
+// The load is an idempotent upsert of what can safely change. A displayName
+// given that differs is updated; balance, status and limits of an existing
+// account move only through the API's audited paths and are left alone; an
+// existing account of another tenant or currency fails the whole load.
+func runSeed(args []string) {
+	fs, configFile := commandFlags("seed")
+	file := fs.String("file", "", "JSON file with the accounts to create")
+	csvFile := fs.String("csv", "", "CSV file with the accounts to create or rename, loaded with COPY")
+	fs.Parse(args)
+	if *file != "" && *csvFile != "" {
+		fatal("seed takes -file or -csv, not both")
+	}
+	var accounts []seedAccount
+	source := *file
+	switch {
+	case *file != "":
+		accounts = readSeedFile(*file)
+	case *csvFile != "":
+		accounts, source = readSeedCSV(*csvFile), *csvFile
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	store := openCurrentStore(ctx, *configFile)
+	if err := store.tenants.load(ctx, store.pool); err != nil {
+		fatal("failed to load tenant configs", "error", err)
+	}
+	if err := store.validateSeedAccounts(accounts); err != nil {
+		fatal("invalid seed file", "file", source, "error", err)
+	}
+	err := store.withBootLock(ctx, func(conn *pgxpool.Conn) error { return seed(ctx, conn) })
+	if err != nil {
+		fatal("failed to run seeds", "error", err)
+	}
+	load := store.seedAccounts
+	if *csvFile != "" {
+		load = store.copySeedAccounts
+	}
+	res, err := load(ctx, accounts)
+	if err != nil {
+		fatal("failed to seed accounts", "error", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(res)
+}
+
+func readSeedFile(path string) []seedAccount {
+	f, err := os.Open(path)
+	if err != nil {
+		fatal("failed to read seed file", "error", err)
+	}
+	defer f.Close()
+	var accounts []seedAccount
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&accounts); err != nil {
+		fatal("invalid seed file", "file", path, "error", err)
+	}
+	return accounts
+}
+
+func readSeedCSV(path string) []seedAccount {
+	f, err := os.Open(path)
+	if err != nil {
+		fatal("failed to read seed file", "error", err)
+	}
+	defer f.Close()
+	accounts, err := parseSeedCSV(f)
+	if err != nil {
+		fatal("invalid seed file", "file", path, "error", err)
+	}
+	return accounts
+}
+
+// parseSeedCSV reads seed accounts from CSV, reporting every malformed
+// line at once.
+func parseSeedCSV(r io.Reader) ([]seedAccount, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	known := []string{"id", "tenantId", "displayName", "currency", "balance", "overdraftLimit", "status"}
+	cols := map[string]int{}
+	for i, h := range header {
+		h = strings.TrimSpace(h)
+		if !slices.Contains(known, h) {
+			return nil, fmt.Errorf("unknown column %q; columns are %s", h, strings.Join(known, ", "))
+		}
+		cols[h] = i
+	}
+	if _, ok := cols["id"]; !ok {
+		return nil, errors.New("header must include an id column")
+	}
+	var (
+		accounts []seedAccount
+		errs     []error
+	)
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		field := func(name string) string {
+			if i, ok := cols[name]; ok {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		a := seedAccount{ID: field("id"), TenantID: field("tenantId"), DisplayName: field("displayName"),
+			Currency: field("currency"), Status: field("status"), line: line}
+		for _, m := range []struct {
+			name string
+			dst  *Money
+		}{{"balance", &a.Balance}, {"overdraftLimit", &a.OverdraftLimit}} {
+			if v := field(m.name); v != "" {
+				if *m.dst, err = ledger.ParseMoney(v, moneyExponent); err != nil {
+					errs = append(errs, fmt.Errorf("line %d: %s: %w", line, m.name, err))
+				}
+			}
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, errors.Join(errs...)
+}
+
+// validateSeedAccounts fills in the defaults and reports every invalid
+// account at once.
+func (s *Store) validateSeedAccounts(accounts []seedAccount) error {
+	var errs []error
+	seen := map[string]bool{}
+	for i := range accounts {
+		a := &accounts[i]
+		where := fmt.Sprintf("account %d", i)
+		if a.line > 0 {
+			where = fmt.Sprintf("line %d", a.line)
+		}
+		fail := func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("%s (%s): %s", where, a.ID, fmt.Sprintf(format, args...)))
+		}
+		if a.TenantID == "" {
+			a.TenantID = "default"
+		}
+		if a.Status == "" {
+			a.Status = accountActive
+		}
+		a.Currency = strings.ToUpper(a.Currency)
+		if a.Currency == "" {
+			a.Currency = serviceCurrency
+		}
+		switch {
+		case !accountIDPattern.MatchString(a.ID):
+			fail("id must be 1-64 letters, digits, '-' or '_'")
+		case seen[a.ID]:
+			fail("id is listed twice")
+		}
+		seen[a.ID] = true
+		if len(a.DisplayName) > 128 {
+			fail("displayName must be at most 128 characters")
+		}
+		if _, err := currencyUnit(a.Currency); err != nil {
+			fail("%v", err)
+		} else if !s.tenants.effective(a.TenantID).allowsCurrency(a.Currency) {
+			fail("tenant %s is not enabled for %s", a.TenantID, a.Currency)
+		}
+		if a.Balance < 0 || a.OverdraftLimit < 0 {
+			fail("balance and overdraftLimit must not be negative")
+		}
+		if a.Status != accountActive && a.Status != accountFrozen {
+			fail("status must be active or frozen")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) seedAccounts(ctx context.Context, accounts []seedAccount) (seedResult, error) {
+	res := seedResult{Created: []string{}, Existing: []string{}}
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		for _, a := range accounts {
+			tag, err := tx.Exec(ctx, `
+				INSERT INTO accounts (id, balance, opening_balance, tenant_id, display_name, status, currency, overdraft_limit)
+				VALUES ($1, $2, $2, $3, $4, $5, $6, $7)
+				ON CONFLICT (id) DO NOTHING`,
+				a.ID, a.Balance, a.TenantID, a.DisplayName, a.Status, a.Currency, a.OverdraftLimit)
+			if err != nil {
+				return fmt.Errorf("%s: %w", a.ID, err)
+			}
+			if tag.RowsAffected() == 0 {
+				res.Existing = append(res.Existing, a.ID)
+			} else {
+				res.Created = append(res.Created, a.ID)
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// copySeedAccounts is the -csv load: COPY into a temporary table, then one
+// statement each to check, rename and create.
+func (s *Store) copySeedAccounts(ctx context.Context, accounts []seedAccount) (seedResult, error) {
+	res := seedResult{Created: []string{}, Updated: []string{}, Existing: []string{}}
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `
+			CREATE TEMP TABLE seed_accounts (id TEXT PRIMARY KEY, tenant_id TEXT, display_name TEXT, currency TEXT,
+				balance NUMERIC, overdraft_limit NUMERIC, status TEXT) ON COMMIT DROP`); err != nil {
+			return fmt.Errorf("create staging table: %w", err)
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"seed_accounts"},
+			[]string{"id", "tenant_id", "display_name", "currency", "balance", "overdraft_limit", "status"},
+			pgx.CopyFromSlice(len(accounts), func(i int) ([]any, error) {
+				a := accounts[i]
+				return []any{a.ID, a.TenantID, a.DisplayName, a.Currency, a.Balance, a.OverdraftLimit, a.Status}, nil
+			})); err != nil {
+			return fmt.Errorf("copy accounts: %w", err)
+		}
+		rows, err := tx.Query(ctx, `
+			SELECT s.id, a.tenant_id, a.currency FROM seed_accounts s JOIN accounts a USING (id)
+			WHERE a.tenant_id <> s.tenant_id OR a.currency <> s.currency ORDER BY s.id`)
+		if err != nil {
+			return fmt.Errorf("check existing accounts: %w", err)
+		}
+		var conflicts []error
+		for rows.Next() {
+			var id, tenant, currency string
+			if err := rows.Scan(&id, &tenant, &currency); err != nil {
+				rows.Close()
+				return err
+			}
+			conflicts = append(conflicts, fmt.Errorf("%s already exists in tenant %s with currency %s", id, tenant, currency))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if err := errors.Join(conflicts...); err != nil {
+			return err
+		}
+		if res.Updated, err = collectIDs(tx.Query(ctx, `
+			UPDATE accounts a SET display_name = s.display_name FROM seed_accounts s
+			WHERE a.id = s.id AND s.display_name <> '' AND a.display_name IS DISTINCT FROM s.display_name RETURNING a.id`)); err != nil {
+			return fmt.Errorf("rename accounts: %w", err)
+		}
+		if res.Created, err = collectIDs(tx.Query(ctx, `
+			INSERT INTO accounts (id, balance, opening_balance, tenant_id, display_name, status, currency, overdraft_limit)
+			SELECT id, balance, balance, tenant_id, display_name, status, currency, overdraft_limit FROM seed_accounts
+			ON CONFLICT (id) DO NOTHING RETURNING id`)); err != nil {
+			return fmt.Errorf("create accounts: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return seedResult{}, err
+	}
+	touched := map[string]bool{}
+	for _, id := range append(res.Created, res.Updated...) {
+		touched[id] = true
+	}
+	for _, a := range accounts {
+		if !touched[a.ID] {
+			res.Existing = append(res.Existing, a.ID)
+		}
+	}
+	sort.Strings(res.Created)
+	sort.Strings(res.Updated)
+	sort.Strings(res.Existing)
+	return res, nil
+}
+
+func collectIDs(rows pgx.Rows, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// runReconcile is the reconcile command. It runs the balance_reconciliation
+// job in the foreground, recorded in jobs like any other run, prints its
+// result and exits 1 when any account drifts.
+func runReconcile(args []string) {
+	fs, configFile := commandFlags("reconcile")
+	var p balanceReconParams
+	fs.StringVar(&p.AccountID, "account", "", "reconcile only this account")
+	dryRun := fs.Bool("dry-run", false, "report the drift without recording reconciliation issues")
+	actor := fs.String("actor", envOrDefault("USER", "cli"), "who runs the reconciliation, recorded on the job")
+	fs.Parse(args)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	store := openCurrentStore(ctx, *configFile)
+	j, err := store.startJob(ctx, "balance_reconciliation", p, *dryRun, *actor)
+	if err != nil {
+		fatal("failed to start reconciliation", "error", err)
+	}
+	if err := store.runJob(ctx, j); err != nil {
+		fatal("reconciliation failed", "job_id", j.ID, "error", err)
+	}
+	var res balanceReconResult
+	if err := store.pool.QueryRow(ctx, "SELECT result FROM jobs WHERE id = $1", j.ID).Scan(&res); err != nil {
+		fatal("failed to read reconciliation result", "job_id", j.ID, "error", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(map[string]any{"jobId": j.ID, "dryRun": *dryRun, "result": res})
+	if res.Drifted > 0 {
+		os.Exit(1)
+	}
+}
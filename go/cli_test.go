@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSeedCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []seedAccount
+		errs []string // substrings of the error, none when empty
+	}{
+		{name: "all columns", in: "id,tenantId,displayName,currency,balance,overdraftLimit,status\n" +
+			"acme-main,acme,Acme main account,brl,1200.50,500.00,\n" +
+			"acme-held,acme,,,0,,frozen\n",
+			want: []seedAccount{
+				{ID: "acme-main", TenantID: "acme", DisplayName: "Acme main account", Currency: "brl", Balance: 120050, OverdraftLimit: 50000, line: 2},
+				{ID: "acme-held", TenantID: "acme", Status: "frozen", line: 3},
+			}},
+		{name: "columns in any order, spaces trimmed", in: "balance, id ,displayName\n 10 , a-1 ,\" Ops, float \"\n",
+			want: []seedAccount{{ID: "a-1", DisplayName: "Ops, float", Balance: 1000, line: 2}}},
+		{name: "header only", in: "id\n"},
+		{name: "empty", in: "", errs: []string{"read header"}},
+		{name: "unknown column", in: "id,name\na,b\n", errs: []string{`unknown column "name"`}},
+		{name: "no id column", in: "tenantId,balance\nacme,1\n", errs: []string{"header must include an id column"}},
+		{name: "ragged line", in: "id,balance\na,1\nb\n", errs: []string{"line 3"}},
+		{name: "every bad amount reported", in: "id,balance,overdraftLimit\na,1.005,\nb,abc,-+1\nc,1,1\n",
+			errs: []string{"line 2: balance", "line 3: balance", "line 3: overdraftLimit"}},
+	}
+	for _, tt := range tests {
+		got, err := parseSeedCSV(strings.NewReader(tt.in))
+		if len(tt.errs) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: got %+v; want %+v", tt.name, got, tt.want)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: got %+v; want an error", tt.name, got)
+			continue
+		}
+		for _, want := range tt.errs {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q lacks %q", tt.name, err, want)
+			}
+		}
+	}
+}
+
+// TestSeedCSVExample keeps accounts.example.csv loadable.
+func TestSeedCSVExample(t *testing.T) {
+	f, err := os.Open("accounts.example.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	accounts, err := parseSeedCSV(f)
+	if err != nil || len(accounts) != 3 {
+		t.Fatalf("got %d accounts, %v; want 3", len(accounts), err)
+	}
+	if err := (&Store{tenants: &tenantConfigs{}}).validateSeedAccounts(accounts); err != nil {
+		t.Errorf("validate: %v", err)
+	}
+}
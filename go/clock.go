@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Sandbox tenants can run on a test clock, moved forward with POST
+// /admin/sandbox/clock/advance so integrators can watch a month of standing
+// orders, retries, review expiries and statements play out in minutes.
+// The clock is an offset over real time kept in tenant_clocks; it only
+// moves forward, and a sandbox reset puts the tenant back on real time.
+// Tenants without a clock (every production tenant) run on real time.
+//
+// SQL that decides what is due compares against tenant_now(tenant_id)
+// rather than now(), so the clock applies on every replica as soon as it
+// is advanced. Go code reads the offset from a cache refreshed every
+// TENANT_CLOCK_REFRESH_INTERVAL (default 5s): ledger entries of sandbox
+// accounts are stamped with the tenant's time, which is what statements
+// filter on, and quote expiry and retry backoff are measured in it.
+
+// tenantClocks caches the offsets. A nil *tenantClocks, as in a Store
+// built without openStore, keeps every tenant on real time.
+type tenantClocks struct {
+	current atomic.Pointer[map[string]time.Duration]
+}
+
+func (c *tenantClocks) offset(tenant string) time.Duration {
+	if c == nil {
+		return 0
+	}
+	if m := c.current.Load(); m != nil {
+		return (*m)[tenant]
+	}
+	return 0
+}
+
+// now is the tenant's current time.
+func (c *tenantClocks) now(tenant string) time.Time {
+	return time.Now().Add(c.offset(tenant))
+}
+
+// maxOffset bounds the due-work queries: a row due after now()+maxOffset
+// is not due for any tenant, which keeps the next_*_at indexes usable.
+func (c *tenantClocks) maxOffset() time.Duration {
+	var longest time.Duration
+	if c == nil {
+		return longest
+	}
+	if m := c.current.Load(); m != nil {
+		for _, d := range *m {
+			longest = max(longest, d)
+		}
+	}
+	return longest
+}
+
+func (c *tenantClocks) load(ctx context.Context, db *pgxpool.Pool) error {
+	rows, err := db.Query(ctx, "SELECT tenant_id, offset_seconds FROM tenant_clocks")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	m := map[string]time.Duration{}
+	for rows.Next() {
+		var (
+			tenant  string
+			seconds int64
+		)
+		if err := rows.Scan(&tenant, &seconds); err != nil {
+			return err
+		}
+		m[tenant] = time.Duration(seconds) * time.Second
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	c.current.Store(&m)
+	return nil
+}
+
+func (c *tenantClocks) watch(ctx context.Context, db *pgxpool.Pool, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.load(ctx, db); err != nil {
+				slog.Error("refresh tenant clocks", "error", err)
+			}
+		}
+	}
+}
+
+type tenantClockView struct {
+	TenantID string    `json:"tenantId"`
+	Now      time.Time `json:"now"`
+	// Offset is how far the tenant runs ahead of real time, as a Go
+	// duration ("720h0m0s").
+	Offset string `json:"offset"`
+}
+
+type advanceClockRequest struct {
+	// By moves the clock forward by a duration ("36h"); To moves it to a
+	// point in time. Exactly one is required.
+	By    string     `json:"by,omitempty"`
+	To    *time.Time `json:"to,omitempty"`
+	Actor string     `json:"actor"`
+}
+
+// sandboxTenant is the caller's tenant when it is a sandbox; otherwise it
+// answers 403.
+func (s *Store) sandboxTenant(w http.ResponseWriter, r *http.Request) (string, bool) {
+	tenant := metaFromRequest(r).Tenant
+	if tenant == "system" || !s.tenants.effective(tenant).Sandbox {
+		writeJSON(w, http.StatusForbidden, TransferResponse{Status: "error", Message: "tenant is not a sandbox"})
+		return "", false
+	}
+	return tenant, true
+}
+
+func (s *Store) handleGetClock(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.sandboxTenant(w, r)
+	if !ok {
+		return
+	}
+	var seconds int64
+	if err := s.pool.QueryRow(r.Context(), "SELECT COALESCE((SELECT offset_seconds FROM tenant_clocks WHERE tenant_id=$1), 0)", tenant).
+		Scan(&seconds); err != nil {
+		http.Error(w, "failed to load clock", http.StatusInternalServerError)
+		return
+	}
+	offset := time.Duration(seconds) * time.Second
+	writeJSON(w, http.StatusOK, tenantClockView{TenantID: tenant, Now: time.Now().Add(offset).UTC(), Offset: offset.String()})
+}
+
+func (s *Store) handleAdvanceClock(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.sandboxTenant(w, r)
+	if !ok {
+		return
+	}
+	var req advanceClockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	if (req.By == "") == (req.To == nil) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "exactly one of by and to is required"})
+		return
+	}
+	ctx := r.Context()
+	var seconds int64
+	err := s.pool.QueryRow(ctx, "SELECT COALESCE((SELECT offset_seconds FROM tenant_clocks WHERE tenant_id=$1), 0)", tenant).Scan(&seconds)
+	if err != nil {
+		http.Error(w, "failed to load clock", http.StatusInternalServerError)
+		return
+	}
+	offset := time.Duration(seconds) * time.Second
+	var by time.Duration
+	if req.By != "" {
+		by, err = time.ParseDuration(req.By)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "invalid by: " + err.Error()})
+			return
+		}
+	} else {
+		by = time.Until(*req.To) - offset
+	}
+	if by <= 0 {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "the clock only moves forward"})
+		return
+	}
+	// whole seconds, applied to the stored offset so concurrent advances
+	// add up
+	by = by.Round(time.Second)
+	err = s.pool.QueryRow(ctx, `
+		INSERT INTO tenant_clocks (tenant_id, offset_seconds, updated_by) VALUES ($1, $2, $3)
+		ON CONFLICT (tenant_id) DO UPDATE SET offset_seconds = tenant_clocks.offset_seconds + EXCLUDED.offset_seconds,
+			updated_by = EXCLUDED.updated_by, updated_at = now()
+		RETURNING offset_seconds`, tenant, int64(by/time.Second), req.Actor).Scan(&seconds)
+	if err != nil {
+		http.Error(w, "failed to advance clock", http.StatusInternalServerError)
+		return
+	}
+	if err := s.clocks.load(ctx, s.pool); err != nil {
+		logger(ctx).Error("reload tenant clocks", "error", err)
+	}
+	offset = time.Duration(seconds) * time.Second
+	logger(ctx).Info("sandbox clock advanced", "tenant_id", tenant, "by", by.String(), "offset", offset.String(), "actor", req.Actor)
+	writeJSON(w, http.StatusOK, tenantClockView{TenantID: tenant, Now: time.Now().Add(offset).UTC(), Offset: offset.String()})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Ledger compaction keeps statements fast on accounts with millions of
+// entries. The ledger_compaction job moves an account's entries older than
+// N years into ledger_archive and replaces each month of them with at most
+// two summary entries, the month's debits and its credits, so balances and
+// every sum over whole months are unchanged.
+//
+// A summary entry takes the id of the last entry of its type it replaces.
+// Ids stay within the month they summarize and never exceed the sequence,
+// so statement ordering and the as-of bound of transaction cursors hold.
+//
+// Only entries already sealed in a published Merkle root are compacted.
+// Their raw rows stay in the archive, which is where proofs are rebuilt
+// from, so every published root and inclusion proof still verifies.
+
+type compactionParams struct {
+	// OlderThanYears is the age of the newest month compacted; the month
+	// containing the cutoff is left whole.
+	OlderThanYears int `json:"olderThanYears,omitempty"`
+	// AccountID restricts the run to one account.
+	AccountID string `json:"accountId,omitempty"`
+	// MinEntries skips accounts with fewer compactable entries, where a
+	// statement is fast enough without it.
+	MinEntries int64 `json:"minEntries,omitempty"`
+}
+
+type compactionRequest struct {
+	compactionParams
+	DryRun bool   `json:"dryRun"`
+	Actor  string `json:"actor"`
+}
+
+type compactionResult struct {
+	Cutoff    time.Time `json:"cutoff"`
+	Accounts  int       `json:"accounts"`
+	Periods   int       `json:"periods"`
+	Archived  int64     `json:"entriesArchived"`
+	Summaries int       `json:"summariesWritten"`
+}
+
+func (s *Store) handleLedgerCompaction(w http.ResponseWriter, r *http.Request) {
+	var req compactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	if req.OlderThanYears < 0 || req.MinEntries < 0 {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "olderThanYears and minEntries must be >= 0"})
+		return
+	}
+	id, err := s.enqueueJob(r.Context(), "ledger_compaction", req.compactionParams, req.DryRun, req.Actor)
+	if err != nil {
+		http.Error(w, "failed to enqueue job", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", apiPath(r.Context(), fmt.Sprintf("/admin/jobs/%d", id)))
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"jobId": id, "dryRun": req.DryRun})
+}
+
+// runLedgerCompaction compacts one account month per transaction, oldest
+// first, so a crash loses at most one month and a rerun resumes where it
+// stopped.
+func (s *Store) runLedgerCompaction(ctx context.Context, j *job) (any, error) {
+	p := compactionParams{OlderThanYears: 5, MinEntries: 100000}
+	if err := json.Unmarshal(j.Params, &p); err != nil {
+		return nil, err
+	}
+	if p.OlderThanYears < 1 {
+		return nil, errors.New("olderThanYears must be at least 1")
+	}
+	now := time.Now().UTC()
+	res := compactionResult{Cutoff: time.Date(now.Year()-p.OlderThanYears, now.Month(), 1, 0, 0, 0, 0, time.UTC)}
+
+	var sealed int64
+	if err := s.pool.QueryRow(ctx, "SELECT COALESCE(max(last_ledger_id), 0) FROM ledger_merkle_roots").Scan(&sealed); err != nil {
+		return nil, err
+	}
+	if sealed == 0 {
+		return res, nil
+	}
+	rows, err := s.pool.Query(ctx, `
+		SELECT account_id FROM ledger
+		WHERE at < $1 AND id <= $2 AND summary_entries IS NULL AND ($3 = '' OR account_id = $3)
+		GROUP BY account_id HAVING count(*) >= $4 ORDER BY account_id`,
+		res.Cutoff, sealed, p.AccountID, p.MinEntries)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	j.progress(ctx, 0, int64(len(accounts)))
+	for i, account := range accounts {
+		months, err := s.compactableMonths(ctx, account, res.Cutoff, sealed)
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", account, err)
+		}
+		for _, month := range months {
+			archived, summaries, err := s.compactMonth(ctx, account, month, sealed, j.DryRun)
+			if err != nil {
+				return res, fmt.Errorf("%s %s: %w", account, month.Format("2006-01"), err)
+			}
+			res.Periods++
+			res.Archived += archived
+			res.Summaries += summaries
+		}
+		res.Accounts++
+		j.progress(ctx, int64(i+1), int64(len(accounts)))
+	}
+	return res, nil
+}
+
+func (s *Store) compactableMonths(ctx context.Context, account string, cutoff time.Time, sealed int64) ([]time.Time, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT DISTINCT date_trunc('month', at AT TIME ZONE 'UTC') FROM ledger
+		WHERE account_id = $1 AND at < $2 AND id <= $3 AND summary_entries IS NULL ORDER BY 1`,
+		account, cutoff, sealed)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[time.Time])
+}
+
+// compactMonth archives one account's raw entries of a month and writes
+// their summaries. A month partly compacted before (entries sealed since
+// the last run) gets a further pair of summaries for the rest.
+func (s *Store) compactMonth(ctx context.Context, account string, month time.Time, sealed int64, dryRun bool) (int64, int, error) {
+	var (
+		archived  int64
+		summaries int
+	)
+	from, to := month, month.AddDate(0, 1, 0)
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		// serializes with another run on the same account
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('ledger_compaction/' || $1))", account); err != nil {
+			return err
+		}
+		rows, err := tx.Query(ctx, `
+			SELECT type, currency, count(*), sum(amount), min(id), max(id), max(at) FROM ledger
+			WHERE account_id = $1 AND at >= $2 AND at < $3 AND id <= $4 AND summary_entries IS NULL
+			GROUP BY type, currency`, account, from, to, sealed)
+		if err != nil {
+			return err
+		}
+		type group struct {
+			typ, currency string
+			count         int64
+			sum           Money
+			first, last   int64
+			at            time.Time
+		}
+		groups, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (group, error) {
+			var g group
+			err := row.Scan(&g.typ, &g.currency, &g.count, &g.sum, &g.first, &g.last, &g.at)
+			return g, err
+		})
+		if err != nil {
+			return err
+		}
+		for _, g := range groups {
+			archived += g.count
+		}
+		summaries = len(groups)
+		if dryRun || len(groups) == 0 {
+			return nil
+		}
+		for _, g := range groups {
+			if _, err := tx.Exec(ctx, `
+				WITH moved AS (
+					DELETE FROM ledger
+					WHERE account_id = $1 AND type = $2 AND currency = $3 AND at >= $4 AND at < $5 AND id <= $6 AND summary_entries IS NULL
+					RETURNING id, type, account_id, amount, at, transfer_id, currency, fx_rate, counterparty_account_id, hash)
+				INSERT INTO ledger_archive (id, type, account_id, amount, at, transfer_id, currency, fx_rate, counterparty_account_id, hash, compacted_into)
+				SELECT id, type, account_id, amount, at, transfer_id, currency, fx_rate, counterparty_account_id, hash, $7 FROM moved`,
+				account, g.typ, g.currency, from, to, sealed, g.last); err != nil {
+				return fmt.Errorf("archive %s entries: %w", g.typ, err)
+			}
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO ledger (id, type, account_id, amount, at, currency, summary_entries, summary_first_id, summary_period)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+				g.last, g.typ, account, g.sum, g.at, g.currency, g.count, g.first, from); err != nil {
+				return fmt.Errorf("write %s summary: %w", g.typ, err)
+			}
+		}
+		return nil
+	})
+	return archived, summaries, err
+}
+
+type archivedEntry struct {
+	ID         int64     `json:"id"`
+	Type       string    `json:"type"`
+	Amount     Money     `json:"amount"`
+	Currency   string    `json:"currency"`
+	FxRate     *string   `json:"fxRate,omitempty"`
+	At         time.Time `json:"at"`
+	TransferID *int64    `json:"transferId,omitempty"`
+	// CounterpartyAccountID is omitted for system accounts, as on statements.
+	CounterpartyAccountID *string `json:"counterpartyAccountId,omitempty"`
+}
+
+// handleArchivedEntries lists the raw entries a summary entry replaced,
+// in id order; ?after=<id> pages forward.
+func (s *Store) handleArchivedEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "invalid ledger id"})
+		return
+	}
+	var after int64
+	if v := r.URL.Query().Get("after"); v != "" {
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "invalid after"})
+			return
+		}
+	}
+	var summary bool
+	if err := s.pool.QueryRow(ctx, "SELECT summary_entries IS NOT NULL FROM ledger WHERE id=$1", id).Scan(&summary); errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "ledger entry not found"})
+		return
+	} else if err != nil {
+		http.Error(w, "failed to load entry", http.StatusInternalServerError)
+		return
+	}
+	if !summary {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "ledger entry is not a summary"})
+		return
+	}
+	const limit = 500
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, type, amount, currency, fx_rate::text, at, transfer_id, counterparty_account_id FROM ledger_archive
+		WHERE compacted_into = $1 AND id > $2 ORDER BY id LIMIT $3`, id, after, limit)
+	if err != nil {
+		http.Error(w, "failed to load archived entries", http.StatusInternalServerError)
+		return
+	}
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (archivedEntry, error) {
+		var e archivedEntry
+		err := row.Scan(&e.ID, &e.Type, &e.Amount, &e.Currency, &e.FxRate, &e.At, &e.TransferID, &e.CounterpartyAccountID)
+		e.CounterpartyAccountID = publicAccountID(e.CounterpartyAccountID)
+		return e, err
+	})
+	if err != nil {
+		http.Error(w, "failed to load archived entries", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]any{"entries": entries}
+	if len(entries) == limit {
+		resp["next"] = strconv.FormatInt(entries[len(entries)-1].ID, 10)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The core settings (database, listeners, timeouts, limits and feature
+// flags) live in Config. They come from the defaults below, then the YAML
+// file named by -config or CONFIG_FILE if any, then the environment: every
+// field has the environment variable it has always been read from, and a
+// variable that is set wins over the file. The result is validated before
+// anything connects, and every bad value is reported at once instead of
+// the first one a code path happens to read. Unknown keys in the file are
+// errors too, so a typo does not silently fall back to a default.
+//
+// config.example.yaml lists every key. Settings of the individual features
+// (webhooks, FX, risk and so on) stay environment-only.
+
+type Config struct {
+	DB       dbConfig       `yaml:"db"`
+	HTTP     httpConfig     `yaml:"http"`
+	Timeouts timeoutsConfig `yaml:"timeouts"`
+	Limits   limitsConfig   `yaml:"limits"`
+	Features featuresConfig `yaml:"features"`
+}
+
+type dbConfig struct {
+	Host     string `yaml:"host" env:"DB_HOST"`
+	Port     int    `yaml:"port" env:"DB_PORT"`
+	User     string `yaml:"user" env:"DB_USER"`
+	Password string `yaml:"password" env:"DB_PASSWORD"`
+	// PasswordFile replaces Password with the file's contents (a Docker
+	// or Kubernetes secret).
+	PasswordFile string `yaml:"password_file" env:"DB_PASSWORD_FILE"`
+	// VaultPath takes the user and password from a Vault database
+	// secrets engine role instead (see vault.go).
+	VaultPath string `yaml:"vault_path" env:"DB_VAULT_PATH"`
+	Name      string `yaml:"name" env:"DB_NAME"`
+	// MaxConns is the pool size; 0 leaves pgx's default.
+	MaxConns int `yaml:"max_conns" env:"DB_MAX_CONNS"`
+	// LockConns sizes the separate pool the operation locks hold their
+	// connections in (see oplock.go); 0 makes it as large as the main pool.
+	LockConns  int    `yaml:"lock_conns" env:"DB_LOCK_CONNS"`
+	Isolation  string `yaml:"isolation" env:"TX_ISOLATION"`
+	MaxRetries int    `yaml:"max_retries" env:"TX_MAX_RETRIES"`
+}
+
+type httpConfig struct {
+	Addr              string        `yaml:"addr" env:"HTTP_ADDR"`
+	AdminAddr         string        `yaml:"admin_addr" env:"ADMIN_ADDR"`
+	GRPCAddr          string        `yaml:"grpc_addr" env:"GRPC_ADDR"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT"`
+	// ReadTimeout and WriteTimeout default to none: exports and statements
+	// stream for as long as they need.
+	ReadTimeout  time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+}
+
+type timeoutsConfig struct {
+	Shutdown             time.Duration `yaml:"shutdown" env:"SHUTDOWN_TIMEOUT"`
+	IdempotencyLockWait  time.Duration `yaml:"idempotency_lock_wait" env:"IDEMPOTENCY_LOCK_WAIT"`
+	JournalRecoveryGrace time.Duration `yaml:"journal_recovery_grace" env:"JOURNAL_RECOVERY_GRACE"`
+}
+
+type limitsConfig struct {
+	AccountRPS         float64 `yaml:"account_rps" env:"RATE_LIMIT_ACCOUNT_RPS"`
+	AccountBurst       float64 `yaml:"account_burst" env:"RATE_LIMIT_ACCOUNT_BURST"`
+	GlobalRPS          float64 `yaml:"global_rps" env:"RATE_LIMIT_GLOBAL_RPS"`
+	GlobalBurst        float64 `yaml:"global_burst" env:"RATE_LIMIT_GLOBAL_BURST"`
+	WebhookConcurrency int     `yaml:"webhook_concurrency" env:"WEBHOOK_CONCURRENCY"`
+}
+
+type featuresConfig struct {
+	Outbox         bool `yaml:"outbox" env:"OUTBOX_ENABLED"`
+	Webhooks       bool `yaml:"webhooks" env:"WEBHOOKS_ENABLED"`
+	MigrateOnBoot  bool `yaml:"migrate_on_boot" env:"MIGRATE_ON_BOOT"`
+	SelftestOnBoot bool `yaml:"selftest_on_boot" env:"SELFTEST_ON_BOOT"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		DB: dbConfig{Host: "postgres", Port: 5432, User: "fintech", Password: "fintech", Name: "fintech", MaxRetries: 3},
+		HTTP: httpConfig{
+			Addr: ":8080", AdminAddr: ":9090", GRPCAddr: ":9000",
+			ReadHeaderTimeout: 10 * time.Second, IdleTimeout: 2 * time.Minute,
+		},
+		Timeouts: timeoutsConfig{Shutdown: 25 * time.Second, IdempotencyLockWait: 2 * time.Second, JournalRecoveryGrace: 30 * time.Second},
+		Limits:   limitsConfig{AccountBurst: 20, GlobalBurst: 200, WebhookConcurrency: 4},
+		Features: featuresConfig{MigrateOnBoot: true, SelftestOnBoot: true},
+	}
+}
+
+// loadConfig builds the configuration from the defaults, the file at path
+// (none when empty) and the environment, and validates it.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	errs := applyEnv(reflect.ValueOf(&cfg).Elem())
+	if cfg.DB.PasswordFile != "" {
+		raw, err := os.ReadFile(cfg.DB.PasswordFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("db.password_file: %w", err))
+		}
+		// secrets written by editors and echo end in a newline
+		cfg.DB.Password = strings.TrimRight(string(raw), "\r\n")
+	}
+	if len(errs) == 0 {
+		errs = cfg.validate()
+	}
+	return cfg, errors.Join(errs...)
+}
+
+// applyEnv overrides the fields of v with the environment variables named
+// by their env tags.
+func applyEnv(v reflect.Value) []error {
+	var errs []error
+	for i := 0; i < v.NumField(); i++ {
+		field, sf := v.Field(i), v.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			errs = append(errs, applyEnv(field)...)
+			continue
+		}
+		key := sf.Tag.Get("env")
+		raw := os.Getenv(key)
+		if key == "" || raw == "" {
+			continue
+		}
+		var err error
+		switch p := field.Addr().Interface().(type) {
+		case *string:
+			*p = raw
+		case *int:
+			*p, err = strconv.Atoi(raw)
+		case *float64:
+			*p, err = strconv.ParseFloat(raw, 64)
+		case *bool:
+			*p, err = strconv.ParseBool(raw)
+		case *time.Duration:
+			*p, err = time.ParseDuration(raw)
+		default:
+			panic(fmt.Sprintf("config field %s has unsupported type %s", sf.Name, sf.Type))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s=%q: %w", key, raw, err))
+		}
+	}
+	return errs
+}
+
+func (c Config) validate() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.DB.Host != "", "db.host is required")
+	check(c.DB.Port > 0 && c.DB.Port < 65536, "db.port %d is out of range", c.DB.Port)
+	check(c.DB.User != "" || c.DB.VaultPath != "", "db.user is required")
+	check(c.DB.PasswordFile == "" || c.DB.VaultPath == "", "db.password_file and db.vault_path are exclusive")
+	check(c.DB.Name != "", "db.name is required")
+	check(c.DB.MaxConns >= 0, "db.max_conns must not be negative")
+	check(c.DB.LockConns >= 0, "db.lock_conns must not be negative")
+	check(c.DB.MaxRetries >= 0, "db.max_retries must not be negative")
+	if _, err := parseIsolation(c.DB.Isolation); err != nil {
+		errs = append(errs, fmt.Errorf("db.isolation: %w", err))
+	}
+
+	for _, addr := range []struct{ name, addr string }{
+		{"http.addr", c.HTTP.Addr}, {"http.admin_addr", c.HTTP.AdminAddr}, {"http.grpc_addr", c.HTTP.GRPCAddr},
+	} {
+		if _, _, err := net.SplitHostPort(addr.addr); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", addr.name, err))
+		}
+	}
+	for _, d := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"http.read_header_timeout", c.HTTP.ReadHeaderTimeout}, {"http.read_timeout", c.HTTP.ReadTimeout},
+		{"http.write_timeout", c.HTTP.WriteTimeout}, {"http.idle_timeout", c.HTTP.IdleTimeout},
+		{"timeouts.idempotency_lock_wait", c.Timeouts.IdempotencyLockWait}, {"timeouts.journal_recovery_grace", c.Timeouts.JournalRecoveryGrace},
+	} {
+		check(d.d >= 0, "%s must not be negative", d.name)
+	}
+	check(c.Timeouts.Shutdown > 0, "timeouts.shutdown must be positive")
+
+	check(c.Limits.AccountRPS >= 0 && c.Limits.GlobalRPS >= 0, "limits: rates must not be negative (0 disables the limit)")
+	check(c.Limits.AccountRPS == 0 || c.Limits.AccountBurst >= 1, "limits.account_burst must be at least 1 when account_rps is set")
+	check(c.Limits.GlobalRPS == 0 || c.Limits.GlobalBurst >= 1, "limits.global_burst must be at least 1 when global_rps is set")
+	check(c.Limits.WebhookConcurrency >= 1, "limits.webhook_concurrency must be at least 1")
+	return errs
+}
+
+// server is an HTTP server on addr with the configured timeouts.
+func (c httpConfig) server(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr: addr, Handler: h,
+		ReadHeaderTimeout: c.ReadHeaderTimeout, ReadTimeout: c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout, IdleTimeout: c.IdleTimeout,
+	}
+}
+
+// DSN is the Postgres connection string of the database settings.
+func (c dbConfig) DSN() string {
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(c.User, c.Password),
+		Host:   net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		Path:   "/" + c.Name,
+	}
+	if c.MaxConns > 0 {
+		u.RawQuery = url.Values{"pool_max_conns": {strconv.Itoa(c.MaxConns)}}.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Consumers of our events keep contracts in contracts/: one JSON file per
+// consumer, channel ("kafka" or "webhook"), event and version, holding the
+// JSON schema of what that consumer relies on. The tests below render
+// sample events through the same code that builds Kafka values and webhook
+// bodies and validate them against every contract, so a change that breaks
+// a consumer fails here rather than in their production. A consumer adds or
+// tightens its contract with a pull request; relaxing one takes their
+// agreement.
+
+type eventContract struct {
+	Consumer string          `json:"consumer"`
+	Channel  string          `json:"channel"`
+	Event    string          `json:"event"`
+	Version  int             `json:"version"`
+	Schema   json.RawMessage `json:"schema"`
+}
+
+// sampleEvents are the events writers produce, covering the optional
+// fields: FX and fees, reversals, deposits and withdrawals, failures.
+func sampleEvents(t *testing.T) []outboxEvent {
+	t.Helper()
+	receipt, err := newReceiptNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fee := Money(150)
+	at := time.Date(2026, 3, 14, 15, 9, 26, 535000000, time.UTC)
+	completed := []transferEvent{
+		{TransferID: 1, OperationID: "op-1", FromAccountID: "A", ToAccountID: "B", Amount: 1050, Currency: "BRL",
+			DestinationAmount: 1050, DestinationCurrency: "BRL", ReceiptNumber: receipt, At: at},
+		{TransferID: 2, OperationID: "op-2", FromAccountID: "A", ToAccountID: "C", Amount: 10000, Currency: "BRL",
+			DestinationAmount: 1862, DestinationCurrency: "USD", Fee: &fee, ReceiptNumber: receipt, At: at,
+			FX: &fxConversion{SourceAmount: 10000, SourceCurrency: "BRL", DestinationAmount: 1862, DestinationCurrency: "USD", Rate: "0.1862", RateSource: "provider"}},
+		{TransferID: 3, FromAccountID: "B", ToAccountID: "A", Amount: 1050, Currency: "BRL",
+			DestinationAmount: 1050, DestinationCurrency: "BRL", ReversesID: 1, ReceiptNumber: receipt, At: at},
+		{TransferID: 4, OperationID: "dep-1", FromAccountID: settlementAccountID, ToAccountID: "A", Amount: 25000, Currency: "BRL",
+			DestinationAmount: 25000, DestinationCurrency: "BRL", ReceiptNumber: receipt, At: at},
+		{TransferID: 5, OperationID: "wd-1", FromAccountID: "A", ToAccountID: settlementAccountID, Amount: 5, Currency: "BRL",
+			DestinationAmount: 5, DestinationCurrency: "BRL", ReceiptNumber: receipt, At: at},
+	}
+	failed := []transferFailedEvent{
+		{OperationID: "op-9", FromAccountID: "A", ToAccountID: "B", Amount: 999999, Result: "insufficient_funds", Message: "insufficient funds"},
+		{FromAccountID: settlementAccountID, ToAccountID: "Z", Amount: 100, Result: "not_found", Message: "account not found"},
+	}
+	var events []outboxEvent
+	add := func(typ, key string, data any) {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, outboxEvent{ID: int64(len(events) + 1), Type: typ, Version: eventWriteVersion, Key: key, OccurredAt: at, Data: raw})
+	}
+	for _, e := range completed {
+		add("transfer.completed", fmt.Sprint(e.TransferID), e)
+	}
+	for _, e := range failed {
+		add("transfer.failed", e.FromAccountID, e)
+	}
+	return events
+}
+
+// rendered is a sample as one channel sends it at one version.
+type rendered struct {
+	channel, event string
+	body           []byte
+}
+
+func renderSamples(t *testing.T, version int) []rendered {
+	t.Helper()
+	var out []rendered
+	for _, e := range sampleEvents(t) {
+		value, err := kafkaEventValue(e, version)
+		if err != nil {
+			t.Fatalf("render %s v%d: %v", e.Type, version, err)
+		}
+		out = append(out, rendered{"kafka", e.Type, value})
+
+		var parties struct {
+			From string `json:"fromAccountId"`
+			To   string `json:"toAccountId"`
+		}
+		if err := json.Unmarshal(e.Data, &parties); err != nil {
+			t.Fatal(err)
+		}
+		typ, _ := webhookEvent(e.Type, parties.From, parties.To)
+		body, err := webhookBody(e.ID, typ, e.OccurredAt, e.Data, e.Version, version)
+		if err != nil {
+			t.Fatalf("render webhook %s v%d: %v", typ, version, err)
+		}
+		out = append(out, rendered{"webhook", typ, body})
+		if typ == "transfer.completed" {
+			data, err := receivedPayload(e.Data)
+			if err == nil {
+				body, err = webhookBody(e.ID, webhookTransferReceived, e.OccurredAt, data, e.Version, version)
+			}
+			if err != nil {
+				t.Fatalf("render webhook %s v%d: %v", webhookTransferReceived, version, err)
+			}
+			out = append(out, rendered{"webhook", webhookTransferReceived, body})
+		}
+	}
+	return out
+}
+
+func compileSchema(t *testing.T, name string, schema []byte) *jsonschema.Schema {
+	t.Helper()
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft7
+	if err := c.AddResource(name, bytes.NewReader(schema)); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	s, err := c.Compile(name)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return s
+}
+
+func validateJSON(s *jsonschema.Schema, body []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	return s.Validate(v)
+}
+
+func TestEventContracts(t *testing.T) {
+	files, err := filepath.Glob("contracts/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no contracts found in contracts/")
+	}
+	for _, f := range files {
+		raw, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c eventContract
+		if err := json.Unmarshal(raw, &c); err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		t.Run(strings.TrimSuffix(filepath.Base(f), ".json"), func(t *testing.T) {
+			if c.Channel != "kafka" && c.Channel != "webhook" {
+				t.Fatalf("channel must be kafka or webhook, got %q", c.Channel)
+			}
+			schema := compileSchema(t, f, c.Schema)
+			matched := 0
+			for _, r := range renderSamples(t, c.Version) {
+				if r.channel != c.Channel || r.event != c.Event {
+					continue
+				}
+				matched++
+				if err := validateJSON(schema, r.body); err != nil {
+					t.Errorf("%s breaks %s's contract:\n%s\n%v", r.event, c.Consumer, r.body, err)
+				}
+			}
+			if matched == 0 {
+				t.Errorf("%s relies on %s %s v%d, which is no longer emitted", c.Consumer, c.Channel, c.Event, c.Version)
+			}
+		})
+	}
+}
+
+// TestEventSchemasDescribeSamples keeps the schemas we publish and register
+// true to what the relay sends.
+func TestEventSchemasDescribeSamples(t *testing.T) {
+	for v := 1; v <= eventLatestVersion(); v++ {
+		schemas := map[string]*jsonschema.Schema{}
+		for typ := range eventVersions {
+			raw, err := eventSchema(typ, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			schemas[typ] = compileSchema(t, fmt.Sprintf("%s.v%d.json", typ, v), []byte(raw))
+		}
+		for _, r := range renderSamples(t, v) {
+			if r.channel != "kafka" {
+				continue
+			}
+			if err := validateJSON(schemas[r.event], r.body); err != nil {
+				t.Errorf("%s v%d does not match its schema:\n%s\n%v", r.event, v, r.body, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func bitsOf(vs ...int) uint64 {
+	var b uint64
+	for _, v := range vs {
+		b |= 1 << uint(v)
+	}
+	return b
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field  string
+		lo, hi int
+		want   uint64
+		err    string
+	}{
+		{field: "*", lo: 1, hi: 5, want: bitsOf(1, 2, 3, 4, 5)},
+		{field: "0,30", lo: 0, hi: 59, want: bitsOf(0, 30)},
+		{field: "1-5", lo: 0, hi: 59, want: bitsOf(1, 2, 3, 4, 5)},
+		{field: "1-5/2", lo: 0, hi: 59, want: bitsOf(1, 3, 5)},
+		{field: "*/15", lo: 0, hi: 59, want: bitsOf(0, 15, 30, 45)},
+		{field: "10/20", lo: 0, hi: 59, want: bitsOf(10, 30, 50)},
+		{field: "9-17/4,22", lo: 0, hi: 23, want: bitsOf(9, 13, 17, 22)},
+		{field: "*/0", lo: 0, hi: 59, err: `invalid step "0"`},
+		{field: "*/x", lo: 0, hi: 59, err: `invalid step "x"`},
+		{field: "a", lo: 0, hi: 59, err: `invalid value "a"`},
+		{field: "1-b", lo: 0, hi: 59, err: `invalid value "b"`},
+		{field: "60", lo: 0, hi: 59, err: "out of range 0-59"},
+		{field: "0", lo: 1, hi: 31, err: "out of range 1-31"},
+		{field: "5-1", lo: 0, hi: 59, err: "out of range"},
+	}
+	for _, tt := range tests {
+		got, err := parseCronField(tt.field, tt.lo, tt.hi)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseCronField(%q) error %v, want %q", tt.field, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseCronField(%q) = %b, %v; want %b", tt.field, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	c, err := parseCron("  30 2 * * 7 ")
+	if err != nil {
+		t.Fatalf("parseCron: %v", err)
+	}
+	if c.dow != bitsOf(0, 7) || !c.domAny || c.dowAny {
+		t.Errorf("day of week 7 parsed as %b (dom any %v, dow any %v); want Sunday as 0 and 7, only dom unrestricted", c.dow, c.domAny, c.dowAny)
+	}
+	for expr, want := range map[string]string{
+		"* * * *":     "must have 5 fields, got 4",
+		"@fortnight":  "must have 5 fields, got 1",
+		"60 * * * *":  "minute:",
+		"* 24 * * *":  "hour:",
+		"* * 32 * *":  "day of month:",
+		"* * * 13 *":  "month:",
+		"* * * * 8":   "day of week:",
+		"* * * 0 *":   "month:",
+		"*/0 * * * *": "minute: invalid step",
+	} {
+		if _, err := parseCron(expr); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseCron(%q) error %v, want %q", expr, err, want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatalf("parse %s: %v", s, err)
+		}
+		return v
+	}
+	// 2026-01-30 is a Friday
+	tests := []struct {
+		name, expr, from, want string
+	}{
+		{"step", "*/15 * * * *", "2026-01-30T10:07:30Z", "2026-01-30T10:15:00Z"},
+		{"hour range with step", "0 9-17/4 * * *", "2026-01-30T10:07:00Z", "2026-01-30T13:00:00Z"},
+		{"strictly after", "0 10 * * *", "2026-01-30T10:00:00Z", "2026-01-31T10:00:00Z"},
+		{"weekdays skip the weekend", "30 2 * * 1-5", "2026-01-30T03:00:00Z", "2026-02-02T02:30:00Z"},
+		{"7 is Sunday", "0 8 * * 7", "2026-01-30T00:00:00Z", "2026-02-01T08:00:00Z"},
+		{"macro", "@weekly", "2026-01-30T00:00:00Z", "2026-02-01T00:00:00Z"},
+		{"month rollover", "0 0 1 * *", "2026-01-30T12:00:00Z", "2026-02-01T00:00:00Z"},
+		{"year rollover", "0 0 1 1 *", "2026-12-31T23:59:00Z", "2027-01-01T00:00:00Z"},
+		{"day missing from the next month", "0 0 31 * *", "2026-01-31T00:00:00Z", "2026-03-31T00:00:00Z"},
+		{"leap day", "0 0 29 2 *", "2026-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		// with both day fields restricted either one matching is enough:
+		// Tuesday the 10th comes before Friday the 13th
+		{"day of month or week", "0 12 10 * 5", "2026-02-07T00:00:00Z", "2026-02-10T12:00:00Z"},
+		{"day of week or month", "0 12 20 * 5", "2026-02-07T00:00:00Z", "2026-02-13T12:00:00Z"},
+		{"restricted month and weekday", "0 6 * 3 1", "2026-01-30T00:00:00Z", "2026-03-02T06:00:00Z"},
+		{"evaluated in UTC", "0 8 * * *", "2026-01-30T10:07:00+03:00", "2026-01-30T08:00:00Z"},
+		{"never", "0 0 31 2 *", "2026-01-30T00:00:00Z", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			got := c.next(at(tt.from))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("next = %s, want no match", got)
+				}
+				return
+			}
+			if want := at(tt.want); !got.Equal(want) || got.Location() != time.UTC {
+				t.Errorf("next = %s, want %s", got, want)
+			}
+		})
+	}
+}
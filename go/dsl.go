@@ -0,0 +1,464 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The monitoring rules DSL. A rule set is plain text, one rule per line:
+//
+//	# comments and blank lines are ignored
+//	large_new_account: amount > 10000 && account.age_days < 7 -> review
+//	embargo: country in ["KP", "IR"] -> block
+//	burst: account.transfers_1m >= 5 -> block
+//	new_payee: dest.new && amount > 5000 -> review
+//
+// Expressions support && || !, comparisons (== != < <= > >=), "in" against a
+// list literal, parentheses, numbers, quoted strings and true/false.
+// Identifiers are resolved against the variables in ruleVariables.
+
+type dslRule struct {
+	Name   string
+	Source string
+	Action string
+	expr   dslNode
+	// precommit marks a rule on historyVariables.
+	precommit bool
+}
+
+// ruleVariables documents what rules can reference. Variables under
+// account./dest. need a database lookup and are only loaded when a rule set
+// uses them. Rules on the history variables, the source's earlier
+// transfers, are evaluated inside the transfer transaction instead; see
+// historyVariables.
+var ruleVariables = map[string]string{
+	"amount":           "transfer amount",
+	"from":             "source account id",
+	"to":               "destination account id",
+	"client":           "caller client id",
+	"tenant":           "caller tenant",
+	"ip":               "caller IP",
+	"country":          "declared origin country (upper-case ISO code)",
+	"hour":             "UTC hour of day, 0-23",
+	"account.age_days": "days since the source account was created",
+	"account.balance":  "current balance of the source account",
+	"dest.age_days":    "days since the destination account was created",
+	"dest.balance":     "current balance of the destination account",
+
+	"account.transfers_1m":  "transfers the source sent in the last minute, this one excluded",
+	"account.transfers_1h":  "transfers the source sent in the last hour, this one excluded",
+	"account.transfers_24h": "transfers the source sent in the last 24 hours, this one excluded",
+	"dest.new":              "true when the source has never paid the destination before",
+}
+
+// historyVariables are the variables read from the source's transfer
+// history. A rule using one is a pre-commit rule: counting the source's
+// transfers is only exact once its row is locked, otherwise a burst of
+// concurrent transfers would all count the same past.
+var historyVariables = []string{"account.transfers_", "dest.new"}
+
+func parseRuleSet(text string) ([]dslRule, error) {
+	var rules []dslRule
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("line %d: duplicate rule name %q", i+1, rule.Name)
+		}
+		seen[rule.Name] = true
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRule(line string) (dslRule, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsFunc(name, func(r rune) bool { return !isIdentRune(r) }) {
+		return dslRule{}, fmt.Errorf("rule must start with \"name:\"")
+	}
+	idx := strings.LastIndex(rest, "->")
+	if idx < 0 {
+		return dslRule{}, fmt.Errorf("rule %s: missing \"-> action\"", name)
+	}
+	action := strings.TrimSpace(rest[idx+2:])
+	if riskSeverity(action) == 0 {
+		return dslRule{}, fmt.Errorf("rule %s: action must be %s or %s", name, riskReview, riskBlock)
+	}
+	src := strings.TrimSpace(rest[:idx])
+	toks, err := lexDSL(src)
+	if err != nil {
+		return dslRule{}, fmt.Errorf("rule %s: %w", name, err)
+	}
+	p := &dslParser{toks: toks}
+	expr, err := p.parseOr()
+	if err != nil {
+		return dslRule{}, fmt.Errorf("rule %s: %w", name, err)
+	}
+	if p.peek().kind != tokEOF {
+		return dslRule{}, fmt.Errorf("rule %s: unexpected %q", name, p.peek().text)
+	}
+	rule := dslRule{Name: name, Source: src, Action: action, expr: expr}
+	for _, prefix := range historyVariables {
+		rule.precommit = rule.precommit || nodeUses(expr, prefix)
+	}
+	return rule, nil
+}
+
+// ruleSetUses reports whether any rule references a variable with prefix.
+func ruleSetUses(rules []dslRule, prefix string) bool {
+	for _, r := range rules {
+		if nodeUses(r.expr, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeUses(n dslNode, prefix string) bool {
+	switch n := n.(type) {
+	case identNode:
+		return strings.HasPrefix(string(n), prefix)
+	case unaryNode:
+		return nodeUses(n.x, prefix)
+	case binaryNode:
+		return nodeUses(n.l, prefix) || nodeUses(n.r, prefix)
+	case listNode:
+		for _, item := range n {
+			if nodeUses(item, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// --- lexer
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type dslToken struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func lexDSL(src string) ([]dslToken, error) {
+	var toks []dslToken
+	rs := []rune(src)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.') {
+				j++
+			}
+			toks = append(toks, dslToken{tokNumber, string(rs[i:j]), i})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(rs) && isIdentRune(rs[j]) {
+				j++
+			}
+			toks = append(toks, dslToken{tokIdent, string(rs[i:j]), i})
+			i = j
+		case r == '"' || r == '\'':
+			j := i + 1
+			for j < len(rs) && rs[j] != r {
+				j++
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			toks = append(toks, dslToken{tokString, string(rs[i+1 : j]), i})
+			i = j + 1
+		default:
+			two := ""
+			if i+1 < len(rs) {
+				two = string(rs[i : i+2])
+			}
+			switch two {
+			case "&&", "||", "==", "!=", "<=", ">=":
+				toks = append(toks, dslToken{tokOp, two, i})
+				i += 2
+				continue
+			}
+			if strings.ContainsRune("!<>()[],", r) {
+				toks = append(toks, dslToken{tokOp, string(r), i})
+				i++
+				continue
+			}
+			return nil, fmt.Errorf("unexpected character %q at %d", r, i)
+		}
+	}
+	return append(toks, dslToken{kind: tokEOF, pos: len(rs)}), nil
+}
+
+// --- parser
+
+type dslNode interface{}
+
+type (
+	identNode  string
+	literal    struct{ v any }
+	listNode   []dslNode
+	unaryNode  struct{ x dslNode }
+	binaryNode struct {
+		op   string
+		l, r dslNode
+	}
+)
+
+type dslParser struct {
+	toks []dslToken
+	pos  int
+}
+
+func (p *dslParser) peek() dslToken { return p.toks[p.pos] }
+
+func (p *dslParser) next() dslToken {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *dslParser) accept(op string) bool {
+	if t := p.peek(); (t.kind == tokOp || t.kind == tokIdent) && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *dslParser) parseOr() (dslNode, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryNode{"||", l, r}
+	}
+	return l, nil
+}
+
+func (p *dslParser) parseAnd() (dslNode, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryNode{"&&", l, r}
+	}
+	return l, nil
+}
+
+func (p *dslParser) parseNot() (dslNode, error) {
+	if p.accept("!") {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{x}, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *dslParser) parseCmp() (dslNode, error) {
+	l, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if p.accept(op) {
+			r, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			if _, isList := r.(listNode); op == "in" && !isList {
+				return nil, fmt.Errorf("\"in\" needs a list, e.g. [\"KP\", \"IR\"]")
+			}
+			return binaryNode{op, l, r}, nil
+		}
+	}
+	return l, nil
+}
+
+func (p *dslParser) parsePrimary() (dslNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at %d", t.text, t.pos)
+		}
+		return literal{f}, nil
+	case tokString:
+		return literal{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		}
+		if _, ok := ruleVariables[t.text]; !ok {
+			return nil, fmt.Errorf("unknown variable %q at %d", t.text, t.pos)
+		}
+		return identNode(t.text), nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.accept(")") {
+				return nil, fmt.Errorf("missing \")\" at %d", p.peek().pos)
+			}
+			return x, nil
+		case "[":
+			var items listNode
+			for !p.accept("]") {
+				if len(items) > 0 && !p.accept(",") {
+					return nil, fmt.Errorf("expected \",\" at %d", p.peek().pos)
+				}
+				item, err := p.parsePrimary()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+			return items, nil
+		}
+	}
+	if t.kind == tokEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+// --- evaluator
+
+// evalDSL evaluates n against vars. Missing variables evaluate to nil, and
+// every comparison involving nil is false, so a rule never fires on data it
+// could not see.
+func evalDSL(n dslNode, vars map[string]any) any {
+	switch n := n.(type) {
+	case literal:
+		return n.v
+	case identNode:
+		return vars[string(n)]
+	case unaryNode:
+		b, _ := evalDSL(n.x, vars).(bool)
+		return !b
+	case binaryNode:
+		switch n.op {
+		case "&&":
+			l, _ := evalDSL(n.l, vars).(bool)
+			if !l {
+				return false
+			}
+			r, _ := evalDSL(n.r, vars).(bool)
+			return r
+		case "||":
+			if l, _ := evalDSL(n.l, vars).(bool); l {
+				return true
+			}
+			r, _ := evalDSL(n.r, vars).(bool)
+			return r
+		case "in":
+			l := evalDSL(n.l, vars)
+			for _, item := range n.r.(listNode) {
+				if l != nil && l == evalDSL(item, vars) {
+					return true
+				}
+			}
+			return false
+		}
+		return compareDSL(n.op, evalDSL(n.l, vars), evalDSL(n.r, vars))
+	}
+	return nil
+}
+
+func compareDSL(op string, l, r any) bool {
+	if l == nil || r == nil {
+		return false
+	}
+	if lf, ok := l.(float64); ok {
+		rf, ok := r.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "==":
+			return lf == rf
+		case "!=":
+			return lf != rf
+		case "<":
+			return lf < rf
+		case "<=":
+			return lf <= rf
+		case ">":
+			return lf > rf
+		case ">=":
+			return lf >= rf
+		}
+		return false
+	}
+	switch op {
+	case "==":
+		return l == r
+	case "!=":
+		return l != r
+	}
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if !lok || !rok {
+		return false
+	}
+	switch op {
+	case "<":
+		return ls < rs
+	case "<=":
+		return ls <= rs
+	case ">":
+		return ls > rs
+	case ">=":
+		return ls >= rs
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fires parses expr as the body of one rule and evaluates it against vars.
+func fires(t *testing.T, expr string, vars map[string]any) bool {
+	t.Helper()
+	rule, err := parseRule("r: " + expr + " -> block")
+	if err != nil {
+		t.Fatalf("parse %q: %v", expr, err)
+	}
+	hit, _ := evalDSL(rule.expr, vars).(bool)
+	return hit
+}
+
+func TestDSLPrecedence(t *testing.T) {
+	rule, err := parseRule("r: amount > 1 || amount > 2 && !dest.new -> review")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := binaryNode{"||",
+		binaryNode{">", identNode("amount"), literal{1.0}},
+		binaryNode{"&&",
+			binaryNode{">", identNode("amount"), literal{2.0}},
+			unaryNode{identNode("dest.new")}}}
+	if !reflect.DeepEqual(rule.expr, want) {
+		t.Errorf("parsed as %#v, want && binding tighter than ||", rule.expr)
+	}
+
+	vars := map[string]any{"amount": 5.0, "hour": 3.0}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"true || false && false", true},
+		{"(true || false) && false", false},
+		{"false && true || true", true},
+		{"!amount > 10", true}, // ! applies to the comparison
+		{"!(amount > 1) || hour == 3", true},
+		{"!!true", true},
+		{"amount >= 5 && amount <= 5 && amount != 4", true},
+		{"amount < 5 || amount > 5", false},
+		{"hour == 3 && amount == 5 && !false", true},
+	}
+	for _, tt := range tests {
+		if got := fires(t, tt.expr, vars); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestDSLIn(t *testing.T) {
+	tests := []struct {
+		expr string
+		vars map[string]any
+		want bool
+	}{
+		{`country in ["KP", "IR"]`, map[string]any{"country": "IR"}, true},
+		{`country in ['KP', 'IR']`, map[string]any{"country": "KP"}, true},
+		{`country in ["KP", "IR"]`, map[string]any{"country": "BR"}, false},
+		{`country in ["KP", "IR"]`, map[string]any{}, false},
+		{`country in []`, map[string]any{"country": "KP"}, false},
+		{`hour in [0, 1, 2]`, map[string]any{"hour": 1.0}, true},
+		{`hour in ["1"]`, map[string]any{"hour": 1.0}, false},
+		{`!(country in ["KP"]) && amount > 0`, map[string]any{"country": "BR", "amount": 1.0}, true},
+	}
+	for _, tt := range tests {
+		if got := fires(t, tt.expr, tt.vars); got != tt.want {
+			t.Errorf("%s with %v = %v, want %v", tt.expr, tt.vars, got, tt.want)
+		}
+	}
+}
+
+// TestDSLNil checks that a rule never fires on data it could not see: any
+// comparison with a missing variable is false, whichever way it points.
+func TestDSLNil(t *testing.T) {
+	vars := map[string]any{"amount": 100.0}
+	for _, expr := range []string{
+		"account.age_days < 7",
+		"account.age_days >= 7",
+		`country == "KP"`,
+		`country != "KP"`,
+		"dest.new",
+		"dest.new == true",
+		"amount > 10 && account.balance < 0",
+		`amount == "100"`,
+		`country < "ZZ"`,
+	} {
+		if fires(t, expr, vars) {
+			t.Errorf("%s fired without the variables it reads", expr)
+		}
+	}
+	if !fires(t, "amount > 10 || account.balance < 0", vars) {
+		t.Error("|| with a missing operand did not fire on the one present")
+	}
+}
+
+func TestRuleSetPrecommit(t *testing.T) {
+	rules, err := parseRuleSet(`
+# velocity
+burst: account.transfers_1m >= 5 -> block
+new_payee: dest.new && amount > 5000 -> review
+
+large_new_account: amount > 10000 && account.age_days < 7 -> review
+embargo: country in ["KP", "IR"] -> block
+`)
+	if err != nil {
+		t.Fatalf("parseRuleSet: %v", err)
+	}
+	got := map[string]bool{}
+	for _, r := range rules {
+		got[r.Name] = r.precommit
+	}
+	want := map[string]bool{"burst": true, "new_payee": true, "large_new_account": false, "embargo": false}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("precommit rules %v, want %v", got, want)
+	}
+	if rules[1].Action != riskReview || rules[1].Source != "dest.new && amount > 5000" {
+		t.Errorf("rule parsed as %+v", rules[1])
+	}
+	if !ruleSetUses(rules, "account.") || !ruleSetUses(rules, "dest.") || ruleSetUses(rules, "ip") {
+		t.Error("ruleSetUses misreports the variables the rules read")
+	}
+}
+
+func TestParseRuleSetErrors(t *testing.T) {
+	tests := []struct {
+		name, text, err string
+	}{
+		{"unterminated string", `r: country == "KP -> block`, `line 1: rule r: unterminated string at 11`},
+		{"unknown variable", "r: amount > 1 && balance < 0 -> block", `line 1: rule r: unknown variable "balance" at 14`},
+		{"missing arrow", "r: amount > 1", `line 1: rule r: missing "-> action"`},
+		{"unknown action", "r: amount > 1 -> allow", "action must be review or block"},
+		{"no name", "amount > 1 -> block", `rule must start with "name:"`},
+		{"name with spaces", "big one: amount > 1 -> block", `rule must start with "name:"`},
+		{"duplicate name", "r: amount > 1 -> block\n\n# again\nr: amount > 2 -> review", `line 4: duplicate rule name "r"`},
+		{"trailing tokens", "r: amount > 1 1 -> block", `unexpected "1"`},
+		{"unclosed paren", "r: (amount > 1 -> block", `missing ")"`},
+		{"dangling operator", "r: amount > -> block", "unexpected end of expression"},
+		{"in without a list", `r: country in "KP" -> block`, `"in" needs a list`},
+		{"list without commas", `r: country in ["KP" "IR"] -> block`, `expected ","`},
+		{"bad character", "r: amount % 2 == 0 -> block", `unexpected character '%'`},
+		{"bad number", "r: amount > 1.2.3 -> block", `bad number "1.2.3"`},
+		{"error line counts comments", "# header\n\nr: amount >> 1 -> block", "line 3:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseRuleSet(tt.text)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
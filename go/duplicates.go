@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// errAlreadyProcessed is returned by executeTransfer when its processed_ops
+// claim finds the operation already applied by a concurrent request.
+var errAlreadyProcessed = errors.New("operation already processed")
+
+// processedOp is a previously applied operation. Raw and Status are the
+// response stored with the claim; Request and Response come from the journal.
+// Any of them may be missing for operations processed by older versions.
+type processedOp struct {
+	At       time.Time
+	Raw      []byte
+	Status   *int
+	Request  *TransferRequest
+	Response *TransferResponse
+}
+
+// findProcessed looks up a previously processed operation, returning nil
+// when operationID was never applied.
+func (s *Store) findProcessed(ctx context.Context, operationID string) (*processedOp, error) {
+	var (
+		p               processedOp
+		rawReq, rawResp []byte
+	)
+	err := s.pool.QueryRow(ctx, `
+		SELECT p.created_at, p.response, p.status, j.request, j.response
+		FROM processed_ops p LEFT JOIN op_journal j USING (operation_id)
+		WHERE p.operation_id=$1`, operationID).Scan(&p.At, &p.Raw, &p.Status, &rawReq, &rawResp)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rawReq != nil {
+		var req TransferRequest
+		if err := json.Unmarshal(rawReq, &req); err == nil {
+			p.Request = &req
+		}
+	}
+	if rawResp != nil {
+		var resp TransferResponse
+		if err := json.Unmarshal(rawResp, &resp); err == nil {
+			p.Response = &resp
+		}
+	}
+	return &p, nil
+}
+
+// replayProcessed answers a duplicate with the original response, byte for
+// byte when it was stored with the claim, falling back to the journal copy
+// and then to a bare acknowledgement for older operations.
+func replayProcessed(ctx context.Context, req TransferRequest, p *processedOp) (TransferResponse, int, error) {
+	transferRequests.WithLabelValues("duplicate").Inc()
+	recordDuplicate(ctx, req, p.At, p.Request)
+	if p.Raw != nil && p.Status != nil {
+		var resp TransferResponse
+		if err := json.Unmarshal(p.Raw, &resp); err == nil {
+			resp.raw = p.Raw
+			return resp, *p.Status, nil
+		}
+	}
+	if p.Response != nil {
+		return *p.Response, http.StatusOK, nil
+	}
+	return TransferResponse{Status: "ok", Message: "operation already processed"}, http.StatusOK, nil
+}
+
+// recordDuplicate classifies a replayed operationId. A replay whose
+// parameters differ from the original is almost always a client reusing
+// idempotency keys, which silently drops the second transfer.
+func recordDuplicate(ctx context.Context, req TransferRequest, processedAt time.Time, original *TransferRequest) {
+	client := duplicateClientLabel(ctx)
+	params := "unknown"
+	if original != nil {
+		params = "match"
+		if original.FromAccountID != req.FromAccountID || original.ToAccountID != req.ToAccountID || original.Amount != req.Amount {
+			params = "mismatch"
+		}
+	}
+	duplicateSubmissions.WithLabelValues(client, params).Inc()
+	duplicateAge.WithLabelValues(client).Observe(time.Since(processedAt).Seconds())
+	if params == "mismatch" {
+		idempotencyMismatches.WithLabelValues(client).Inc()
+		logger(ctx).Warn("idempotency key reused with different parameters",
+			"operation_id", req.OperationID, "client", clientFromContext(ctx),
+			"original_from", original.FromAccountID, "original_to", original.ToAccountID, "original_amount", original.Amount,
+			"replay_from", req.FromAccountID, "replay_to", req.ToAccountID, "replay_amount", req.Amount)
+	}
+}
+
+// duplicateClients bounds the client label of the duplicate metrics. The
+// client is the X-Client-ID header of unauthenticated callers and the sub
+// claim of JWT ones, so only the clients in METRICS_CLIENTS get their own
+// series.
+var duplicateClients = newLabelGuard("client", append(strings.Split(envOrDefault("METRICS_CLIENTS", ""), ","), "unknown"))
+
+// duplicateClientLabel is the client label of the duplicate metrics.
+func duplicateClientLabel(ctx context.Context) string {
+	if p := principalFromContext(ctx); p != nil {
+		return duplicateClients.label(p.Client)
+	}
+	return duplicateClients.label(clientFromContext(ctx))
+}
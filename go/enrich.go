@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"fintech-go/internal/ledger"
+)
+
+// Counterparty categories.
+const (
+	categoryTransfer     = "transfer"
+	categoryDeposit      = "deposit"
+	categoryWithdrawal   = "withdrawal"
+	categoryInbound      = "inbound_payment"
+	categoryPayoutReturn = "payout_return"
+	categoryReversal     = "reversal"
+	categorySweep        = "sweep"
+	categorySuspense     = "suspense"
+	categoryFee          = "fee"
+	categoryAdjustment   = "adjustment"
+)
+
+var categoryIcons = map[string]string{
+	categoryTransfer:     "person",
+	categoryDeposit:      "arrow-down",
+	categoryWithdrawal:   "arrow-up",
+	categoryInbound:      "bank",
+	categoryPayoutReturn: "undo",
+	categoryReversal:     "undo",
+	categorySweep:        "repeat",
+	categorySuspense:     "hourglass",
+	categoryFee:          "receipt",
+	categoryAdjustment:   "sliders",
+}
+
+type transferParty struct {
+	operationID    string
+	from, to       string
+	reverses       *int64
+	virtualAccount *string
+	name           string
+}
+
+// enrichTransactions resolves the transfer behind each ledger entry and
+// fills in a statement descriptor and the counterparty, in one query for
+// the whole page, applying the tenant's branded descriptors when it has
+// them. Entries written before ledger rows carried a transfer id are left
+// as they are.
+func (s *Store) enrichTransactions(ctx context.Context, accountID string, branding *tenantBranding, txs []ledger.Transaction) error {
+	ids := make([]int64, 0, len(txs))
+	for _, t := range txs {
+		if t.TransactionID != nil {
+			ids = append(ids, *t.TransactionID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	rows, err := s.pool.Query(ctx, `
+		SELECT t.id, COALESCE(t.operation_id, ''), t.from_account_id, t.to_account_id, t.reverses_id, t.virtual_account_id, a.display_name
+		FROM transfers t
+		JOIN accounts a ON a.id = CASE WHEN t.from_account_id=$2 THEN t.to_account_id ELSE t.from_account_id END
+		WHERE t.id = ANY($1)`, ids, accountID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	parties := make(map[int64]transferParty, len(ids))
+	for rows.Next() {
+		var (
+			id int64
+			p  transferParty
+		)
+		if err := rows.Scan(&id, &p.operationID, &p.from, &p.to, &p.reverses, &p.virtualAccount, &p.name); err != nil {
+			return err
+		}
+		parties[id] = p
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range txs {
+		if txs[i].TransactionID == nil {
+			continue
+		}
+		p, ok := parties[*txs[i].TransactionID]
+		if !ok {
+			continue
+		}
+		txs[i].Counterparty, txs[i].Descriptor = describe(accountID, p)
+		if d := branding.descriptor(txs[i].Counterparty, p.from == accountID, p.virtualAccount); d != "" {
+			txs[i].Descriptor = d
+		}
+	}
+	return nil
+}
+
+// describe classifies a transfer from the point of view of accountID.
+// System accounts are never exposed by id or name.
+func describe(accountID string, p transferParty) (*ledger.Counterparty, string) {
+	outgoing := p.from == accountID
+	other := p.from
+	if outgoing {
+		other = p.to
+	}
+
+	c := &ledger.Counterparty{Category: categoryTransfer}
+	switch {
+	case p.reverses != nil && strings.HasPrefix(p.operationID, "reversal:"):
+		c.Category = categoryReversal
+	case p.reverses != nil:
+		c.Category = categoryPayoutReturn
+	case strings.HasPrefix(p.operationID, "sweep-"):
+		c.Category = categorySweep
+	case other == suspenseAccountID:
+		c.Category = categorySuspense
+	case other == feesAccountID:
+		c.Category = categoryFee
+	case other == adjustmentsAccountID:
+		c.Category = categoryAdjustment
+	case other == settlementAccountID && p.virtualAccount != nil:
+		c.Category = categoryInbound
+	case other == settlementAccountID && outgoing:
+		c.Category = categoryWithdrawal
+	case other == settlementAccountID:
+		c.Category = categoryDeposit
+	}
+	c.Icon = categoryIcons[c.Category]
+	if !isSystemAccount(other) {
+		c.AccountID = other
+		c.Name = p.name
+		c.MaskedAccount = maskAccount(other)
+	}
+
+	switch c.Category {
+	case categoryPayoutReturn:
+		return c, "Returned payout"
+	case categoryReversal:
+		return c, "Reversed transfer"
+	case categoryDeposit:
+		return c, "Deposit"
+	case categoryWithdrawal:
+		return c, "Withdrawal"
+	case categoryInbound:
+		return c, "Payment received via " + maskAccount(*p.virtualAccount)
+	case categorySuspense:
+		return c, "Payment allocated from suspense"
+	case categoryFee:
+		if !outgoing {
+			return c, "Transfer fee refunded"
+		}
+		return c, "Transfer fee"
+	case categoryAdjustment:
+		return c, "Balance adjustment"
+	}
+	label := c.Name
+	if label == "" {
+		label = c.MaskedAccount
+	}
+	prefix := "Transfer from "
+	if c.Category == categorySweep {
+		prefix = "Sweep from "
+	}
+	if outgoing {
+		prefix = strings.Replace(prefix, "from", "to", 1)
+	}
+	return c, prefix + label
+}
+
+// maskAccount keeps the last four characters of an account id.
+func maskAccount(id string) string {
+	if len(id) <= 4 {
+		return id
+	}
+	return "••••" + id[len(id)-4:]
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// End of day runs the nightly jobs as one pipeline instead of separate
+// schedules racing each other. The eod job walks eodSteps in order; each
+// step is an ordinary job of its type, started and run inline so it shows
+// up in /admin/jobs like any other, and its outcome is checkpointed in
+// eod_steps under the business date.
+//
+// A rerun of the same date skips the steps already succeeded, so after a
+// failure it resumes at the step that failed. A step runs only when the
+// steps it depends on succeeded; otherwise it is blocked, and steps not
+// depending on the failure still run. Rerunning named steps resets them and
+// everything depending on them first. Runs of the same date are serialized
+// through the operation lock. A new nightly job joins the pipeline as a
+// step, not as a schedule of its own.
+
+type eodStep struct {
+	name    string
+	jobType string
+	after   []string
+	params  func(day time.Time) any
+}
+
+// eodSteps is listed in dependency order: a step only names steps above it.
+// Reconciliation goes first so money is not moved on drifted books; the
+// usage rollup and the Merkle seal then take in the sweep transfers.
+var eodSteps = []eodStep{
+	{name: "reconciliation", jobType: "balance_reconciliation"},
+	{name: "sweeps", jobType: "balance_sweeps", after: []string{"reconciliation"}},
+	{name: "usage_rollup", jobType: "usage_meters", after: []string{"sweeps"},
+		params: func(day time.Time) any { return usageParams{Period: day.Format("2006-01")} }},
+	{name: "ledger_seal", jobType: "ledger_merkle", after: []string{"sweeps"}},
+}
+
+const eodBlocked = "blocked"
+
+type eodParams struct {
+	// BusinessDate is the day closed, YYYY-MM-DD; empty means the UTC day
+	// the job was enqueued on.
+	BusinessDate string `json:"businessDate,omitempty"`
+	// Rerun lists steps to run again although they succeeded.
+	Rerun []string `json:"rerun,omitempty"`
+}
+
+type eodRequest struct {
+	eodParams
+	Actor string `json:"actor"`
+}
+
+type eodStepStatus struct {
+	Step       string     `json:"step"`
+	Status     string     `json:"status"`
+	JobID      *int64     `json:"jobId,omitempty"`
+	Attempts   int        `json:"attempts"`
+	Error      *string    `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+type eodRun struct {
+	BusinessDate string          `json:"businessDate"`
+	Status       string          `json:"status"`
+	JobID        int64           `json:"jobId"`
+	StartedAt    time.Time       `json:"startedAt"`
+	FinishedAt   *time.Time      `json:"finishedAt,omitempty"`
+	Steps        []eodStepStatus `json:"steps"`
+}
+
+func findEODStep(name string) (eodStep, bool) {
+	for _, st := range eodSteps {
+		if st.name == name {
+			return st, true
+		}
+	}
+	return eodStep{}, false
+}
+
+// eodDependents returns names and every step depending on them, directly
+// or not.
+func eodDependents(names []string) map[string]bool {
+	out := map[string]bool{}
+	for _, n := range names {
+		out[n] = true
+	}
+	for _, st := range eodSteps {
+		for _, dep := range st.after {
+			if out[dep] {
+				out[st.name] = true
+			}
+		}
+	}
+	return out
+}
+
+func (s *Store) handleRunEOD(w http.ResponseWriter, r *http.Request) {
+	var req eodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	if req.BusinessDate != "" {
+		if _, err := time.Parse(time.DateOnly, req.BusinessDate); err != nil {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "businessDate must be YYYY-MM-DD"})
+			return
+		}
+	}
+	for _, n := range req.Rerun {
+		if _, ok := findEODStep(n); !ok {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: fmt.Sprintf("unknown step %q", n)})
+			return
+		}
+	}
+	id, err := s.enqueueJob(r.Context(), "eod", req.eodParams, false, req.Actor)
+	if err != nil {
+		http.Error(w, "failed to enqueue job", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", apiPath(r.Context(), fmt.Sprintf("/admin/jobs/%d", id)))
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"jobId": id})
+}
+
+// runEOD is the eod job. It fails when any step did not succeed, so a
+// scheduled run alerts like any other failed schedule.
+func (s *Store) runEOD(ctx context.Context, j *job) (any, error) {
+	var p eodParams
+	if err := json.Unmarshal(j.Params, &p); err != nil {
+		return nil, err
+	}
+	day := j.CreatedAt.UTC().Truncate(24 * time.Hour)
+	if p.BusinessDate != "" {
+		var err error
+		if day, err = time.Parse(time.DateOnly, p.BusinessDate); err != nil {
+			return nil, err
+		}
+	}
+	date := day.Format(time.DateOnly)
+	unlock, err := s.lockOperation(ctx, "eod/"+date)
+	if errors.Is(err, errOperationInFlight) {
+		return nil, fmt.Errorf("end of day %s is already running", date)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, err := s.pool.Exec(ctx, `
+		INSERT INTO eod_runs (business_date, status, job_id) VALUES ($1, $2, $3)
+		ON CONFLICT (business_date) DO UPDATE SET status = EXCLUDED.status, job_id = EXCLUDED.job_id, started_at = now(), finished_at = NULL`,
+		day, jobRunning, j.ID); err != nil {
+		return nil, err
+	}
+	if len(p.Rerun) > 0 {
+		var reset []string
+		for n := range eodDependents(p.Rerun) {
+			reset = append(reset, n)
+		}
+		if _, err := s.pool.Exec(ctx, "DELETE FROM eod_steps WHERE business_date = $1 AND step = ANY($2)", day, reset); err != nil {
+			return nil, err
+		}
+	}
+	done, err := s.eodCheckpoints(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+
+	j.progress(ctx, 0, int64(len(eodSteps)))
+	failed := 0
+	for i, st := range eodSteps {
+		if done[st.name] != jobSucceeded {
+			done[st.name] = s.runEODStep(ctx, j, day, st, done)
+			if done[st.name] != jobSucceeded {
+				failed++
+			}
+		}
+		j.progress(ctx, int64(i+1), int64(len(eodSteps)))
+	}
+
+	status := jobSucceeded
+	if failed > 0 {
+		status = jobFailed
+	}
+	if _, err := s.pool.Exec(context.WithoutCancel(ctx), "UPDATE eod_runs SET status = $2, finished_at = now() WHERE business_date = $1", day, status); err != nil {
+		return nil, err
+	}
+	run, err := s.loadEODRun(ctx, date)
+	if err != nil {
+		return nil, err
+	}
+	if failed > 0 {
+		return run, fmt.Errorf("end of day %s: %d of %d steps did not succeed", date, failed, len(eodSteps))
+	}
+	logger(ctx).Info("end of day completed", "business_date", date, "job_id", j.ID)
+	return run, nil
+}
+
+func (s *Store) eodCheckpoints(ctx context.Context, day time.Time) (map[string]string, error) {
+	rows, err := s.pool.Query(ctx, "SELECT step, status FROM eod_steps WHERE business_date = $1", day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	done := map[string]string{}
+	for rows.Next() {
+		var step, status string
+		if err := rows.Scan(&step, &status); err != nil {
+			return nil, err
+		}
+		done[step] = status
+	}
+	return done, rows.Err()
+}
+
+// runEODStep runs one step, or blocks it when a dependency did not
+// succeed, and checkpoints the outcome.
+func (s *Store) runEODStep(ctx context.Context, parent *job, day time.Time, st eodStep, done map[string]string) string {
+	for _, dep := range st.after {
+		if done[dep] != jobSucceeded {
+			s.checkpointEOD(ctx, day, st.name, eodBlocked, nil, "waiting on "+dep)
+			return eodBlocked
+		}
+	}
+	var params any = struct{}{}
+	if st.params != nil {
+		params = st.params(day)
+	}
+	child, err := s.startJob(ctx, st.jobType, params, false, fmt.Sprintf("eod/%d", parent.ID))
+	if err != nil {
+		logger(ctx).Error("start end of day step", "step", st.name, "error", err)
+		s.checkpointEOD(ctx, day, st.name, jobFailed, nil, err.Error())
+		return jobFailed
+	}
+	s.checkpointEOD(ctx, day, st.name, jobRunning, &child.ID, "")
+	if err := s.runJob(ctx, child); err != nil {
+		logger(ctx).Warn("end of day step failed", "business_date", day.Format(time.DateOnly), "step", st.name, "job_id", child.ID, "error", err)
+		s.checkpointEOD(ctx, day, st.name, jobFailed, &child.ID, err.Error())
+		return jobFailed
+	}
+	s.checkpointEOD(ctx, day, st.name, jobSucceeded, &child.ID, "")
+	return jobSucceeded
+}
+
+func (s *Store) checkpointEOD(ctx context.Context, day time.Time, step, status string, jobID *int64, errMsg string) {
+	if _, err := s.pool.Exec(context.WithoutCancel(ctx), `
+		INSERT INTO eod_steps (business_date, step, status, job_id, error, attempts, started_at, finished_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), CASE WHEN $3 = 'running' THEN 1 ELSE 0 END,
+			CASE WHEN $3 = 'running' THEN now() END, CASE WHEN $3 <> 'running' THEN now() END)
+		ON CONFLICT (business_date, step) DO UPDATE SET status = EXCLUDED.status, job_id = COALESCE(EXCLUDED.job_id, eod_steps.job_id),
+			error = EXCLUDED.error,
+			attempts = eod_steps.attempts + EXCLUDED.attempts,
+			started_at = COALESCE(EXCLUDED.started_at, eod_steps.started_at),
+			finished_at = EXCLUDED.finished_at`,
+		day, step, status, jobID, errMsg); err != nil {
+		logger(ctx).Error("checkpoint end of day step", "step", step, "status", status, "error", err)
+	}
+}
+
+func (s *Store) loadEODRun(ctx context.Context, date string) (eodRun, error) {
+	run := eodRun{BusinessDate: date}
+	if err := s.pool.QueryRow(ctx, "SELECT status, job_id, started_at, finished_at FROM eod_runs WHERE business_date = $1", date).
+		Scan(&run.Status, &run.JobID, &run.StartedAt, &run.FinishedAt); err != nil {
+		return run, err
+	}
+	rows, err := s.pool.Query(ctx, `
+		SELECT step, status, job_id, attempts, error, started_at, finished_at FROM eod_steps WHERE business_date = $1`, date)
+	if err != nil {
+		return run, err
+	}
+	got, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (eodStepStatus, error) {
+		var st eodStepStatus
+		err := row.Scan(&st.Step, &st.Status, &st.JobID, &st.Attempts, &st.Error, &st.StartedAt, &st.FinishedAt)
+		return st, err
+	})
+	if err != nil {
+		return run, err
+	}
+	// every step is listed, in pipeline order, pending when not reached
+	byName := map[string]eodStepStatus{}
+	for _, st := range got {
+		byName[st.Step] = st
+	}
+	for _, st := range eodSteps {
+		status, ok := byName[st.name]
+		if !ok {
+			status = eodStepStatus{Step: st.name, Status: "pending"}
+		}
+		run.Steps = append(run.Steps, status)
+	}
+	return run, nil
+}
+
+// handleEODRuns is the dashboard: the latest business dates, newest first,
+// with the state of every step.
+func (s *Store) handleEODRuns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rows, err := s.pool.Query(ctx, "SELECT to_char(business_date, 'YYYY-MM-DD') FROM eod_runs ORDER BY business_date DESC LIMIT 14")
+	if err != nil {
+		http.Error(w, "failed to load end of day runs", http.StatusInternalServerError)
+		return
+	}
+	dates, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		http.Error(w, "failed to load end of day runs", http.StatusInternalServerError)
+		return
+	}
+	runs := make([]eodRun, 0, len(dates))
+	for _, d := range dates {
+		run, err := s.loadEODRun(ctx, d)
+		if err != nil {
+			http.Error(w, "failed to load end of day runs", http.StatusInternalServerError)
+			return
+		}
+		runs = append(runs, run)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"runs": runs})
+}
+
+func (s *Store) handleGetEODRun(w http.ResponseWriter, r *http.Request) {
+	date := r.PathValue("date")
+	if _, err := time.Parse(time.DateOnly, date); err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "date must be YYYY-MM-DD"})
+		return
+	}
+	run, err := s.loadEODRun(r.Context(), date)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "no end of day run for this date"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load end of day run", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
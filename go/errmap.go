@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+
+	"fintech-go/internal/ledger"
+)
+
+// errorClass is how one kind of failure is reported to callers: the HTTP
+// status, the gRPC code and the transfer_requests_total result.
+type errorClass struct {
+	status int
+	code   codes.Code
+	result string
+}
+
+// errorClasses maps the domain errors to their class. The first match wins,
+// so more specific errors go first. Errors not listed are classed by the
+// status their caller picked, through statusClass.
+var errorClasses = []struct {
+	err   error
+	class errorClass
+}{
+	{errAccountNotFound, errorClass{http.StatusBadRequest, codes.NotFound, "account_not_found"}},
+	{errOtherTenant, errorClass{http.StatusForbidden, codes.PermissionDenied, "forbidden"}},
+	{errAccountFrozen, errorClass{http.StatusBadRequest, codes.FailedPrecondition, "account_frozen"}},
+	{errAccountClosed, errorClass{http.StatusBadRequest, codes.FailedPrecondition, "account_closed"}},
+	{errLimitExceeded, errorClass{http.StatusBadRequest, codes.FailedPrecondition, "limit_exceeded"}},
+	{errDailyLimitExceeded, errorClass{http.StatusBadRequest, codes.FailedPrecondition, "limit_exceeded"}},
+	{errInsufficientFunds, errorClass{http.StatusBadRequest, codes.FailedPrecondition, "insufficient_funds"}},
+	{errHoldNotFound, errorClass{http.StatusNotFound, codes.NotFound, "hold_not_found"}},
+	{errHoldNotActive, errorClass{http.StatusConflict, codes.FailedPrecondition, "hold_not_active"}},
+	{errHoldExceeded, errorClass{http.StatusBadRequest, codes.InvalidArgument, "validation_error"}},
+	{ledger.ErrTooPrecise, errorClass{http.StatusBadRequest, codes.InvalidArgument, "validation_error"}},
+	{errNoRate, errorClass{http.StatusUnprocessableEntity, codes.FailedPrecondition, "fx_rejected"}},
+	{errBlockedByRule, errorClass{http.StatusForbidden, codes.PermissionDenied, "blocked_by_rule"}},
+	{errOperationInFlight, errorClass{http.StatusConflict, codes.Aborted, "in_flight"}},
+	{errLocksBusy, errorClass{http.StatusServiceUnavailable, codes.Unavailable, "unavailable"}},
+	{errBatchPartlyProcessed, errorClass{http.StatusConflict, codes.AlreadyExists, "conflict"}},
+	{errAlreadyReversed, errorClass{http.StatusConflict, codes.AlreadyExists, "already_reversed"}},
+	{errIsReversal, errorClass{http.StatusConflict, codes.FailedPrecondition, "validation_error"}},
+	{context.DeadlineExceeded, errorClass{http.StatusGatewayTimeout, codes.DeadlineExceeded, "timeout"}},
+}
+
+// classify returns the class of err. status is what the failing code
+// returned alongside it and only decides for errors not in errorClasses.
+func classify(status int, err error) errorClass {
+	for _, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			return c.class
+		}
+	}
+	return statusClass(status)
+}
+
+func statusClass(status int) errorClass {
+	switch status {
+	case http.StatusBadRequest:
+		return errorClass{status, codes.InvalidArgument, "validation_error"}
+	case http.StatusForbidden:
+		return errorClass{status, codes.PermissionDenied, "forbidden"}
+	case http.StatusNotFound:
+		return errorClass{status, codes.NotFound, "not_found"}
+	case http.StatusConflict:
+		return errorClass{status, codes.Aborted, "conflict"}
+	case http.StatusUnprocessableEntity:
+		return errorClass{status, codes.FailedPrecondition, "unprocessable"}
+	case http.StatusTooManyRequests:
+		return errorClass{status, codes.ResourceExhausted, "rate_limited"}
+	case http.StatusServiceUnavailable:
+		return errorClass{status, codes.Unavailable, "unavailable"}
+	}
+	return errorClass{http.StatusInternalServerError, codes.Internal, "internal_error"}
+}
+
+// errorResponse builds the error body for err. Server errors are sent
+// without their text, which names tables and upstream hosts; the request
+// id in the body leads support to the logged error.
+func errorResponse(status int, err error) (int, TransferResponse) {
+	c := classify(status, err)
+	msg := err.Error()
+	if c.status >= 500 {
+		msg = strings.ToLower(http.StatusText(c.status))
+	}
+	return c.status, TransferResponse{Status: "error", Message: msg}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	status, resp := errorResponse(status, err)
+	writeJSON(w, status, resp)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Emitted events are versioned per type. The outbox stores a payload at
+// the version its writer produced (the version column) and each consumer
+// gets the version it asked for, rendered at delivery by chaining the
+// registered upgrades; nothing is ever downgraded. Kafka emits every
+// version in EVENT_VERSIONS (default 1): during a consumer migration set
+// "1,2", so each event is published once per version under the same key
+// and event-id with an event-version header, and drop 1 once the old
+// consumers are gone. Webhook subscriptions pick a version when created.
+//
+// v2 sends every amount as a decimal string: v1's JSON numbers lose cents
+// in consumers that parse them as floats.
+//
+// With SCHEMA_REGISTRY_URL the relay registers the JSON schema of each
+// version it emits with a Confluent-compatible registry, under
+// "<topic>-<type>.v<version>" (the TopicRecordNameStrategy), and frames
+// message values in the registry's wire format: a zero byte and the
+// big-endian schema id before the JSON.
+
+// eventWriteVersion is the version writeOutbox's callers produce.
+const eventWriteVersion = 1
+
+type eventVersion struct {
+	// upgrade turns the previous version's data into this one's; nil for
+	// version 1.
+	upgrade func(json.RawMessage) (json.RawMessage, error)
+	// data lists the JSON schema properties of the event's data.
+	data func() map[string]any
+}
+
+var eventVersions = map[string][]eventVersion{
+	"transfer.completed": {
+		{data: transferCompletedV1},
+		{upgrade: quoteAmounts("amount", "destinationAmount", "fee", "fx.sourceAmount", "fx.destinationAmount"), data: transferCompletedV2},
+	},
+	"transfer.failed": {
+		{data: transferFailedV1},
+		{upgrade: quoteAmounts("amount"), data: transferFailedV2},
+	},
+}
+
+// eventLatestVersion is the newest version every type has.
+func eventLatestVersion() int {
+	latest := 0
+	for _, vs := range eventVersions {
+		if latest == 0 || len(vs) < latest {
+			latest = len(vs)
+		}
+	}
+	return latest
+}
+
+// renderEvent upgrades data stored at version from to version to.
+func renderEvent(eventType string, from int, data json.RawMessage, to int) (json.RawMessage, error) {
+	vs := eventVersions[eventType]
+	switch {
+	case len(vs) == 0:
+		return nil, fmt.Errorf("event %s has no registered versions", eventType)
+	case to < from:
+		return nil, fmt.Errorf("event %s v%d cannot be rendered as v%d", eventType, from, to)
+	case to > len(vs):
+		return nil, fmt.Errorf("event %s has no v%d", eventType, to)
+	}
+	for v := from + 1; v <= to; v++ {
+		var err error
+		if data, err = vs[v-1].upgrade(data); err != nil {
+			return nil, fmt.Errorf("upgrade %s to v%d: %w", eventType, v, err)
+		}
+	}
+	return data, nil
+}
+
+// quoteAmounts returns an upgrade rewriting the numeric amount at each
+// path ("fx.sourceAmount" is nested) as a decimal string, digit for digit.
+func quoteAmounts(paths ...string) func(json.RawMessage) (json.RawMessage, error) {
+	return func(data json.RawMessage) (json.RawMessage, error) {
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			if err := quoteAt(doc, strings.Split(p, ".")); err != nil {
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+		}
+		return json.Marshal(doc)
+	}
+}
+
+func quoteAt(doc map[string]json.RawMessage, path []string) error {
+	raw, ok := doc[path[0]]
+	if !ok || string(raw) == "null" {
+		return nil
+	}
+	if len(path) > 1 {
+		var inner map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &inner); err != nil {
+			return err
+		}
+		if err := quoteAt(inner, path[1:]); err != nil {
+			return err
+		}
+		out, err := json.Marshal(inner)
+		doc[path[0]] = out
+		return err
+	}
+	if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '"' {
+		return nil
+	}
+	doc[path[0]] = json.RawMessage(strconv.Quote(string(raw)))
+	return nil
+}
+
+var (
+	schemaAmountV1 = map[string]any{"type": "number"}
+	schemaAmountV2 = map[string]any{"type": "string", "pattern": `^-?[0-9]+(\.[0-9]+)?$`}
+	schemaString   = map[string]any{"type": "string"}
+	schemaInteger  = map[string]any{"type": "integer"}
+)
+
+func transferCompleted(amount map[string]any) map[string]any {
+	return map[string]any{
+		"transferId": schemaInteger, "operationId": schemaString,
+		"fromAccountId": schemaString, "toAccountId": schemaString,
+		"amount": amount, "currency": schemaString,
+		"destinationAmount": amount, "destinationCurrency": schemaString,
+		"fx": map[string]any{"type": "object", "properties": map[string]any{
+			"sourceAmount": amount, "sourceCurrency": schemaString,
+			"destinationAmount": amount, "destinationCurrency": schemaString,
+			"rate": schemaString, "rateSource": schemaString,
+		}},
+		"fee": amount, "reversesId": schemaInteger, "receiptNumber": schemaString,
+		"at": map[string]any{"type": "string", "format": "date-time"},
+	}
+}
+
+func transferCompletedV1() map[string]any { return transferCompleted(schemaAmountV1) }
+func transferCompletedV2() map[string]any { return transferCompleted(schemaAmountV2) }
+
+func transferFailed(amount map[string]any) map[string]any {
+	return map[string]any{
+		"operationId": schemaString, "fromAccountId": schemaString, "toAccountId": schemaString,
+		"amount": amount, "result": schemaString, "message": schemaString,
+	}
+}
+
+func transferFailedV1() map[string]any { return transferFailed(schemaAmountV1) }
+func transferFailedV2() map[string]any { return transferFailed(schemaAmountV2) }
+
+// eventSchema is the JSON schema of a Kafka message value: the outboxEvent
+// envelope around the version's data.
+func eventSchema(eventType string, version int) (string, error) {
+	vs := eventVersions[eventType]
+	if version < 1 || version > len(vs) {
+		return "", fmt.Errorf("event %s has no v%d", eventType, version)
+	}
+	schema, err := json.Marshal(map[string]any{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title":   fmt.Sprintf("%s.v%d", eventType, version),
+		"type":    "object",
+		"properties": map[string]any{
+			"id": schemaInteger, "type": map[string]any{"const": eventType}, "version": map[string]any{"const": version},
+			"key": schemaString, "occurredAt": map[string]any{"type": "string", "format": "date-time"},
+			"data": map[string]any{"type": "object", "properties": vs[version-1].data()},
+		},
+		"required": []string{"id", "type", "version", "key", "occurredAt", "data"},
+	})
+	return string(schema), err
+}
+
+// parseEventVersions reads EVENT_VERSIONS, which every type must support.
+func parseEventVersions(v string) ([]int, error) {
+	var versions []int
+	latest := eventLatestVersion()
+	for _, f := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(f), "v"))
+		if err != nil || n < 1 || n > latest {
+			return nil, fmt.Errorf("EVENT_VERSIONS: %q is not a version between 1 and %d", f, latest)
+		}
+		if !slices.Contains(versions, n) {
+			versions = append(versions, n)
+		}
+	}
+	slices.Sort(versions)
+	return versions, nil
+}
+
+// handleEventSchemas publishes the schema of every event type and version,
+// for consumers without registry access. Webhook bodies carry the same
+// data in their own envelope.
+func (s *Store) handleEventSchemas(w http.ResponseWriter, r *http.Request) {
+	type version struct {
+		Version int             `json:"version"`
+		Schema  json.RawMessage `json:"schema"`
+	}
+	out := map[string][]version{}
+	for typ, vs := range eventVersions {
+		for v := range vs {
+			schema, err := eventSchema(typ, v+1)
+			if err != nil {
+				http.Error(w, "failed to render schemas", http.StatusInternalServerError)
+				return
+			}
+			out[typ] = append(out[typ], version{Version: v + 1, Schema: json.RawMessage(schema)})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"latestVersion": eventLatestVersion(), "events": out})
+}
+
+type schemaRegistry struct {
+	url        string
+	user, pass string
+	client     *http.Client
+}
+
+func schemaRegistryFromEnv() *schemaRegistry {
+	u := os.Getenv("SCHEMA_REGISTRY_URL")
+	if u == "" {
+		return nil
+	}
+	return &schemaRegistry{
+		url:    strings.TrimRight(u, "/"),
+		user:   os.Getenv("SCHEMA_REGISTRY_USER"),
+		pass:   os.Getenv("SCHEMA_REGISTRY_PASSWORD"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// register returns the id of schema under subject, registering it if the
+// registry does not have it yet; the registry rejects it when it breaks
+// the subject's compatibility rules.
+func (r *schemaRegistry) register(ctx context.Context, subject, schema string) (int, error) {
+	body, err := json.Marshal(map[string]string{"schemaType": "JSON", "schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url+"/subjects/"+url.PathEscape(subject)+"/versions", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if r.user != "" {
+		req.SetBasicAuth(r.user, r.pass)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("schema registry: register %s: %s: %s", subject, resp.Status, bytes.TrimSpace(msg))
+	}
+	var out struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, fmt.Errorf("schema registry: register %s: %w", subject, err)
+	}
+	return out.ID, nil
+}
+
+// frameSchema prefixes a message value with the registry's wire format
+// header.
+func frameSchema(id int, value []byte) []byte {
+	b := make([]byte, 5, 5+len(value))
+	binary.BigEndian.PutUint32(b[1:], uint32(id))
+	return append(b, value...)
+}
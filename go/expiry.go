@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// pendingKind is one kind of item that parks a transfer waiting for
+// something external (a reviewer, a challenge, an acceptance). Every kind
+// must expire: expire cancels items older than ttl, releases whatever they
+// reserved and returns what it cancelled so the sweeper can emit events.
+type pendingKind struct {
+	state  string
+	ttl    time.Duration
+	expire func(ctx context.Context, cutoff time.Time) ([]expiredItem, error)
+}
+
+type expiredItem struct {
+	OperationID string `json:"operationId,omitempty"`
+	Subject     string `json:"subject"`
+	AccountID   string `json:"accountId"`
+}
+
+func (s *Store) pendingKinds() []pendingKind {
+	return []pendingKind{
+		{state: journalPendingReview, ttl: durationOrDefault("PENDING_REVIEW_TTL", 72*time.Hour), expire: s.expireReviews},
+	}
+}
+
+// sweepPending runs every pending kind once.
+func (s *Store) sweepPending(ctx context.Context, kinds []pendingKind) {
+	for _, k := range kinds {
+		items, err := k.expire(ctx, time.Now().Add(-k.ttl))
+		if err != nil {
+			slog.Error("expire pending items", "state", k.state, "error", err)
+			continue
+		}
+		for _, it := range items {
+			pendingExpired.WithLabelValues(k.state).Inc()
+			s.markJournal(ctx, it.OperationID, journalFailed, k.state+" expired")
+			if err := s.recordEvent(ctx, "transfer.expired", it.Subject, map[string]any{
+				"state":       k.state,
+				"operationId": it.OperationID,
+				"accountId":   it.AccountID,
+				"ttl":         k.ttl.String(),
+			}); err != nil {
+				slog.Error("record expiry event", "subject", it.Subject, "error", err)
+			}
+			slog.Info("pending item expired", "state", k.state, "subject", it.Subject, "ttl", k.ttl.String())
+		}
+	}
+}
+
+// runPendingSweeper expires pending items until ctx is cancelled. Expiry
+// updates are conditional on the item still being pending, so several
+// replicas can sweep concurrently without cancelling anything twice.
+func (s *Store) runPendingSweeper(ctx context.Context, every time.Duration) {
+	kinds := s.pendingKinds()
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.sweepPending(ctx, kinds)
+			s.purgeExpiredQuotes(ctx)
+			s.expireHolds(ctx)
+		}
+	}
+}
+
+func (s *Store) expireReviews(ctx context.Context, cutoff time.Time) ([]expiredItem, error) {
+	rows, err := s.pool.Query(ctx, `
+		UPDATE risk_cases SET status='expired', resolved_by='system', resolution='review window elapsed', resolved_at=now()
+		WHERE status='open' AND decision=$1
+			AND created_at < $2 + tenant_clock_offset((SELECT tenant_id FROM accounts WHERE accounts.id = risk_cases.account_id))
+		RETURNING id, COALESCE(operation_id, ''), account_id`, riskReview, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []expiredItem
+	for rows.Next() {
+		var (
+			id int64
+			it expiredItem
+		)
+		if err := rows.Scan(&id, &it.OperationID, &it.AccountID); err != nil {
+			return nil, err
+		}
+		it.Subject = "risk_case/" + strconv.FormatInt(id, 10)
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// recordEvent appends a domain event. Events are the feed notifications are
+// built from; they are written best-effort next to the state change they
+// describe.
+func (s *Store) recordEvent(ctx context.Context, eventType, subject string, payload map[string]any) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(context.WithoutCancel(ctx), "INSERT INTO events (type, subject, payload) VALUES ($1, $2, $3)", eventType, subject, raw)
+	return err
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Export jobs write the ledger entries of a time range, optionally of one
+// account, as NDJSON in the incremental export's ledger_entry records. The
+// output is kept in export_chunks; each chunk is written in the same
+// transaction as the cursor past its last entry, so a run that dies
+// resumes after the last chunk it wrote, and the ledger_export job is
+// resumable (see jobs.go) so that happens without an operator.
+//
+// The entries exported are fixed when the export is created: those with
+// ids up to the export watermark at that time. Compacted entries are read
+// from the archive in place of their summaries.
+//
+// The ETag is a hash chain over the chunks, SHA-256(previous ETag ||
+// chunk), so it names the exact partial output and is extended, not
+// recomputed, when a chunk is added. An idempotency key returns the
+// existing export instead of creating another.
+
+type exportRequest struct {
+	AccountID      string    `json:"accountId,omitempty"`
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	IdempotencyKey string    `json:"idempotencyKey,omitempty"`
+	Actor          string    `json:"actor"`
+}
+
+type exportState struct {
+	ID             int64      `json:"id"`
+	JobID          int64      `json:"jobId"`
+	AccountID      *string    `json:"accountId,omitempty"`
+	From           time.Time  `json:"from"`
+	To             time.Time  `json:"to"`
+	Status         string     `json:"status"`
+	TotalEntries   *int64     `json:"totalEntries"`
+	EntriesWritten int64      `json:"entriesWritten"`
+	Percent        float64    `json:"percentComplete"`
+	Chunks         int        `json:"chunks"`
+	Bytes          int64      `json:"bytes"`
+	ETag           string     `json:"etag"`
+	CreatedBy      string     `json:"createdBy"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	CompletedAt    *time.Time `json:"completedAt,omitempty"`
+
+	watermark int64
+	cursor    int64
+}
+
+const exportStateColumns = `e.id, e.job_id, e.account_id, e.range_from, e.range_to, j.status, e.total_entries, e.entries_written,
+	e.chunks, e.bytes, e.etag, e.created_by, e.created_at, e.completed_at, e.watermark, e.cursor`
+
+const selectExport = "SELECT " + exportStateColumns + " FROM exports e JOIN jobs j ON j.id = e.job_id WHERE "
+
+func scanExportState(row pgx.Row) (exportState, error) {
+	var e exportState
+	err := row.Scan(&e.ID, &e.JobID, &e.AccountID, &e.From, &e.To, &e.Status, &e.TotalEntries, &e.EntriesWritten,
+		&e.Chunks, &e.Bytes, &e.ETag, &e.CreatedBy, &e.CreatedAt, &e.CompletedAt, &e.watermark, &e.cursor)
+	switch {
+	case e.CompletedAt != nil:
+		e.Percent = 100
+	case e.TotalEntries != nil && *e.TotalEntries > 0:
+		e.Percent = float64(e.EntriesWritten*1000/(*e.TotalEntries)) / 10
+	}
+	return e, err
+}
+
+func (s *Store) handleCreateExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Actor == "":
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	case req.From.IsZero() || req.To.IsZero() || !req.From.Before(req.To):
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "from and to are required and from must be before to"})
+		return
+	}
+	if req.IdempotencyKey != "" {
+		e, err := scanExportState(s.pool.QueryRow(ctx, selectExport+"e.idempotency_key=$1", req.IdempotencyKey))
+		if err == nil {
+			s.replayExport(w, r, req, e)
+			return
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "failed to load export", http.StatusInternalServerError)
+			return
+		}
+	}
+	watermark, err := s.exportWatermark(ctx, 0)
+	if err != nil {
+		http.Error(w, "failed to compute watermark", http.StatusInternalServerError)
+		return
+	}
+	var id int64
+	err = s.beginFunc(ctx, func(tx pgx.Tx) error {
+		// the job goes in with the export, its params once the export has
+		// an id
+		var jobID int64
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO jobs (type, params, dry_run, status, created_by) VALUES ('ledger_export', '{}', false, $1, $2) RETURNING id`,
+			jobQueued, req.Actor).Scan(&jobID); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO exports (job_id, account_id, range_from, range_to, watermark, idempotency_key, created_by)
+			VALUES ($1, NULLIF($2, ''), $3, $4, $5, NULLIF($6, ''), $7) RETURNING id`,
+			jobID, req.AccountID, req.From, req.To, watermark, req.IdempotencyKey, req.Actor).Scan(&id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, "UPDATE jobs SET params=jsonb_build_object('exportId', $2::bigint) WHERE id=$1", jobID, id)
+		return err
+	})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		// a concurrent request with the same key won
+		e, err := scanExportState(s.pool.QueryRow(ctx, selectExport+"e.idempotency_key=$1", req.IdempotencyKey))
+		if err != nil {
+			http.Error(w, "failed to load export", http.StatusInternalServerError)
+			return
+		}
+		s.replayExport(w, r, req, e)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to create export", http.StatusInternalServerError)
+		return
+	}
+	logger(ctx).Info("export created", "export_id", id, "account_id", req.AccountID, "from", req.From, "to", req.To, "actor", req.Actor)
+	w.Header().Set("Location", apiPath(r.Context(), fmt.Sprintf("/admin/exports/%d", id)))
+	writeJSON(w, http.StatusAccepted, map[string]any{"exportId": id})
+}
+
+// replayExport answers a repeated idempotency key with the export it
+// created, or 409 when the range differs.
+func (s *Store) replayExport(w http.ResponseWriter, r *http.Request, req exportRequest, e exportState) {
+	account := ""
+	if e.AccountID != nil {
+		account = *e.AccountID
+	}
+	if account != req.AccountID || !e.From.Equal(req.From) || !e.To.Equal(req.To) {
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: "idempotencyKey was used for a different export"})
+		return
+	}
+	w.Header().Set("Location", apiPath(r.Context(), fmt.Sprintf("/admin/exports/%d", e.ID)))
+	writeJSON(w, http.StatusOK, map[string]any{"exportId": e.ID})
+}
+
+// runLedgerExport writes the export's remaining chunks from its cursor on.
+func (s *Store) runLedgerExport(ctx context.Context, j *job) (any, error) {
+	var p struct {
+		ExportID int64 `json:"exportId"`
+	}
+	if err := json.Unmarshal(j.Params, &p); err != nil {
+		return nil, err
+	}
+	e, err := scanExportState(s.pool.QueryRow(ctx, selectExport+"e.id=$1", p.ExportID))
+	if err != nil {
+		return nil, err
+	}
+	if e.CompletedAt != nil {
+		return e, nil
+	}
+	if e.cursor > 0 {
+		logger(ctx).Info("export resumed", "export_id", e.ID, "cursor", e.cursor, "chunks", e.Chunks)
+	}
+	if e.TotalEntries == nil {
+		var total int64
+		if err := s.pool.QueryRow(ctx, `
+			SELECT (SELECT count(*) FROM ledger `+exportRangeFilter+` AND summary_entries IS NULL)
+				+ (SELECT count(*) FROM ledger_archive `+exportRangeFilter+`)`,
+			0, e.watermark, e.From, e.To, e.AccountID).Scan(&total); err != nil {
+			return nil, err
+		}
+		if _, err := s.pool.Exec(ctx, "UPDATE exports SET total_entries=$2 WHERE id=$1", e.ID, total); err != nil {
+			return nil, err
+		}
+		e.TotalEntries = &total
+	}
+	j.progress(ctx, e.EntriesWritten, *e.TotalEntries)
+	for {
+		n, err := s.writeExportChunk(ctx, &e)
+		if err != nil {
+			return nil, fmt.Errorf("export %d chunk %d: %w", e.ID, e.Chunks, err)
+		}
+		j.progress(ctx, e.EntriesWritten, *e.TotalEntries)
+		if n < exportBatch {
+			break
+		}
+	}
+	if _, err := s.pool.Exec(ctx, "UPDATE exports SET completed_at=now() WHERE id=$1", e.ID); err != nil {
+		return nil, err
+	}
+	return map[string]any{"exportId": e.ID, "entries": e.EntriesWritten, "chunks": e.Chunks, "etag": e.ETag}, nil
+}
+
+// exportRangeFilter selects the entries of an export after a cursor:
+// $1 cursor, $2 watermark, $3 from, $4 to, $5 account or NULL.
+const exportRangeFilter = `WHERE id > $1 AND id <= $2 AND at >= $3 AND at < $4 AND ($5::text IS NULL OR account_id = $5)`
+
+// writeExportChunk encodes the next batch of entries and stores it with the
+// advanced cursor. It returns the number of entries written.
+func (s *Store) writeExportChunk(ctx context.Context, e *exportState) (int, error) {
+	const cols = `id, type, account_id, amount, currency, fx_rate::text, at, transfer_id, counterparty_account_id`
+	rows, err := s.pool.Query(ctx, `
+		SELECT * FROM (
+			(SELECT `+cols+` FROM ledger `+exportRangeFilter+` AND summary_entries IS NULL ORDER BY id LIMIT $6)
+			UNION ALL
+			(SELECT `+cols+` FROM ledger_archive `+exportRangeFilter+` ORDER BY id LIMIT $6)
+		) u ORDER BY id LIMIT $6`,
+		e.cursor, e.watermark, e.From, e.To, e.AccountID, exportBatch)
+	if err != nil {
+		return 0, err
+	}
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (exportEntry, error) {
+		x := exportEntry{Type: "ledger_entry"}
+		err := row.Scan(&x.Sequence, &x.Direction, &x.AccountID, &x.Amount, &x.Currency, &x.FxRate, &x.At, &x.TransferID, &x.CounterpartyAccountID)
+		return x, err
+	})
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+	var buf []byte
+	for _, x := range entries {
+		line, err := json.Marshal(x)
+		if err != nil {
+			return 0, err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	prev, _ := hex.DecodeString(e.ETag)
+	h := sha256.New()
+	h.Write(prev)
+	h.Write(buf)
+	etag := hex.EncodeToString(h.Sum(nil))
+	cursor := entries[len(entries)-1].Sequence
+
+	err = s.beginFunc(ctx, func(tx pgx.Tx) error {
+		// the cursor guard keeps a second worker that claimed the job
+		// from appending the same chunk twice
+		tag, err := tx.Exec(ctx, `
+			UPDATE exports SET cursor=$3, chunks=chunks+1, entries_written=entries_written+$4, bytes=bytes+$5, etag=$6, updated_at=now()
+			WHERE id=$1 AND cursor=$2`, e.ID, e.cursor, cursor, len(entries), len(buf), etag)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return errors.New("export advanced by another worker")
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO export_chunks (export_id, seq, data, last_ledger_id) VALUES ($1, $2, $3, $4)", e.ID, e.Chunks, buf, cursor)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	e.cursor, e.ETag = cursor, etag
+	e.Chunks++
+	e.EntriesWritten += int64(len(entries))
+	e.Bytes += int64(len(buf))
+	return len(entries), nil
+}
+
+func (s *Store) exportFromPath(w http.ResponseWriter, r *http.Request) (exportState, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid export id", http.StatusBadRequest)
+		return exportState{}, false
+	}
+	e, err := scanExportState(s.pool.QueryRow(r.Context(), selectExport+"e.id=$1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "export not found"})
+		return exportState{}, false
+	}
+	if err != nil {
+		http.Error(w, "failed to load export", http.StatusInternalServerError)
+		return exportState{}, false
+	}
+	w.Header().Set("ETag", strconv.Quote(e.ETag))
+	if r.Header.Get("If-None-Match") == strconv.Quote(e.ETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return exportState{}, false
+	}
+	return e, true
+}
+
+func (s *Store) handleGetExport(w http.ResponseWriter, r *http.Request) {
+	if e, ok := s.exportFromPath(w, r); ok {
+		writeJSON(w, http.StatusOK, e)
+	}
+}
+
+// handleExportOutput streams the chunks written so far; X-Export-Complete
+// tells a partial download from the finished one, and the ETag matches the
+// bytes sent.
+func (s *Store) handleExportOutput(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	e, ok := s.exportFromPath(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Export-Complete", strconv.FormatBool(e.CompletedAt != nil))
+	for seq := 0; seq < e.Chunks; seq++ {
+		var data []byte
+		if err := s.pool.QueryRow(ctx, "SELECT data FROM export_chunks WHERE export_id=$1 AND seq=$2", e.ID, seq).Scan(&data); err != nil {
+			logger(ctx).Error("export output", "export_id", e.ID, "seq", seq, "error", err)
+			return
+		}
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	// the alpine image ships no zoneinfo
+	_ "time/tzdata"
+
+	"fintech-go/internal/ledger"
+)
+
+// Customer-facing amounts and dates are formatted here, once, so
+// statements, receipts, notifications and any client asking GET /format
+// render them alike. Each tenant reads in its locale and time zone,
+// DISPLAY_LOCALE (default pt-BR) and DISPLAY_TIME_ZONE (default
+// America/Sao_Paulo) unless its configuration overrides them. Machine
+// fields keep their decimal and RFC 3339 forms; the formatted strings sit
+// beside them under "display".
+
+var defaultLocale, defaultTimeZone = loadDisplayDefaults()
+
+func loadDisplayDefaults() (string, string) {
+	tag := envOrDefault("DISPLAY_LOCALE", "pt-BR")
+	if _, ok := ledger.LookupLocale(tag); !ok {
+		fatal("unsupported DISPLAY_LOCALE", "locale", tag)
+	}
+	zone := envOrDefault("DISPLAY_TIME_ZONE", "America/Sao_Paulo")
+	if _, err := timeZone(zone); err != nil {
+		fatal("invalid DISPLAY_TIME_ZONE", "zone", zone, "error", err)
+	}
+	return tag, zone
+}
+
+// zones caches loaded time zones; time.LoadLocation parses the zone file
+// on every call.
+var zones sync.Map
+
+func timeZone(name string) (*time.Location, error) {
+	if loc, ok := zones.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	zones.Store(name, loc)
+	return loc, nil
+}
+
+func validateLocale(tag string) error {
+	if _, ok := ledger.LookupLocale(tag); !ok {
+		tags := ledger.Locales()
+		slices.Sort(tags)
+		return fmt.Errorf("locale must be one of %s", strings.Join(tags, ", "))
+	}
+	return nil
+}
+
+func validateTimeZone(name string) error {
+	if _, err := timeZone(name); err != nil || name == "" || name == "Local" {
+		return fmt.Errorf("unknown time zone %q", name)
+	}
+	return nil
+}
+
+func newFormatter(tag, zone string) (ledger.Formatter, error) {
+	if err := validateLocale(tag); err != nil {
+		return ledger.Formatter{}, err
+	}
+	if err := validateTimeZone(zone); err != nil {
+		return ledger.Formatter{}, err
+	}
+	l, _ := ledger.LookupLocale(tag)
+	loc, _ := timeZone(zone)
+	return ledger.Formatter{Locale: l, Location: loc}, nil
+}
+
+// formatter is how the tenant's customers read amounts and dates.
+func (c effectiveConfig) formatter() ledger.Formatter {
+	f, err := newFormatter(c.Locale, c.TimeZone)
+	if err != nil {
+		// tenant overrides are validated when saved
+		f, _ = newFormatter(defaultLocale, defaultTimeZone)
+	}
+	return f
+}
+
+// requestFormatter is the caller's tenant formatter, with the locale and
+// timeZone query parameters taking precedence.
+func (s *Store) requestFormatter(r *http.Request) (ledger.Formatter, error) {
+	cfg := s.tenants.effective(metaFromRequest(r).Tenant)
+	q := r.URL.Query()
+	if !q.Has("locale") && !q.Has("timeZone") {
+		return cfg.formatter(), nil
+	}
+	tag, zone := cfg.Locale, cfg.TimeZone
+	if q.Has("locale") {
+		tag = q.Get("locale")
+	}
+	if q.Has("timeZone") {
+		zone = q.Get("timeZone")
+	}
+	return newFormatter(tag, zone)
+}
+
+type formatResult struct {
+	Locale   string `json:"locale"`
+	TimeZone string `json:"timeZone"`
+	Amount   string `json:"amount,omitempty"`
+	Date     string `json:"date,omitempty"`
+	DateTime string `json:"dateTime,omitempty"`
+}
+
+// handleFormat formats an amount, a time or both for clients that would
+// rather not carry their own locale tables:
+// GET /format?amount=1234.56&currency=BRL&at=2026-03-14T15:09:26Z.
+func (s *Store) handleFormat(w http.ResponseWriter, r *http.Request) {
+	f, err := s.requestFormatter(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("amount") == "" && q.Get("at") == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "amount or at is required"})
+		return
+	}
+	res := formatResult{Locale: f.Locale.Tag, TimeZone: f.Location.String()}
+	if v := q.Get("amount"); v != "" {
+		code := strings.ToUpper(q.Get("currency"))
+		if code == "" {
+			code = serviceCurrency
+		}
+		if _, err := currency(code); err != nil {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+			return
+		}
+		m, err := ledger.ParseMoney(v, moneyExponent)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "amount must be a decimal number"})
+			return
+		}
+		res.Amount = f.Money(m, code)
+	}
+	if v := q.Get("at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "at must be an RFC 3339 timestamp"})
+			return
+		}
+		res.Date, res.DateTime = f.Date(t), f.DateTime(t)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"fintech-go/internal/ledger"
+)
+
+// Accounts hold a single currency each. A transfer between accounts of
+// different currencies debits the amount in the sender's currency and
+// credits it converted at a rate the client supplies (fxRate) or, failing
+// that, the rate provider quotes. Both ledger rows carry their own
+// currency and the applied rate, and the transfer row keeps both amounts,
+// so a statement line never needs a rate table to be read back.
+//
+// Money keeps minor units at the service currency's exponent, so accounts
+// can only use currencies with at most that many decimals; amounts in a
+// currency with fewer decimals (JPY on a BRL service) must be whole
+// multiples of its smallest unit.
+//
+// System accounts have no currency of their own: a deposit, withdrawal or
+// fee is booked in the customer account's currency.
+
+// fxRateScale is the number of decimals a rate is kept with. The rate
+// stored on the ledger is the one applied, after this rounding.
+const fxRateScale = 10
+
+var errNoRate = errors.New("no exchange rate")
+
+// rateProvider quotes how many units of to one unit of from buys.
+type rateProvider interface {
+	rate(ctx context.Context, from, to string) (*big.Rat, error)
+}
+
+// staticRates is the default provider: a fixed table from FX_RATES, e.g.
+// "USD/BRL=5.1,EUR/BRL=5.55". Inverse pairs are derived, and pairs not
+// listed are crossed through the service currency when both legs are.
+type staticRates map[string]*big.Rat
+
+func staticRatesFromEnv() (staticRates, error) {
+	t := staticRates{}
+	for _, entry := range strings.Split(envOrDefault("FX_RATES", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pair, value, ok := strings.Cut(entry, "=")
+		from, to, ok2 := strings.Cut(strings.ToUpper(strings.TrimSpace(pair)), "/")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("FX_RATES entry %q: want FROM/TO=rate", entry)
+		}
+		for _, code := range []string{from, to} {
+			if _, known := ledger.LookupCurrency(code); !known {
+				return nil, fmt.Errorf("FX_RATES entry %q: unknown currency %s", entry, code)
+			}
+		}
+		r, err := parseRate(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("FX_RATES entry %q: %w", entry, err)
+		}
+		t[from+"/"+to] = r
+	}
+	return t, nil
+}
+
+func (t staticRates) rate(_ context.Context, from, to string) (*big.Rat, error) {
+	if r := t.direct(from, to); r != nil {
+		return r, nil
+	}
+	if from != serviceCurrency && to != serviceCurrency {
+		if a, b := t.direct(from, serviceCurrency), t.direct(serviceCurrency, to); a != nil && b != nil {
+			return new(big.Rat).Mul(a, b), nil
+		}
+	}
+	return nil, fmt.Errorf("%w for %s/%s", errNoRate, from, to)
+}
+
+func (t staticRates) direct(from, to string) *big.Rat {
+	if r, ok := t[from+"/"+to]; ok {
+		return r
+	}
+	if r, ok := t[to+"/"+from]; ok {
+		return new(big.Rat).Inv(r)
+	}
+	return nil
+}
+
+// fxRate is a client-supplied rate, a positive plain decimal as a JSON
+// string or number.
+type fxRate struct{ *big.Rat }
+
+func (r *fxRate) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '"' {
+		s, err := strconv.Unquote(string(b))
+		if err != nil {
+			return err
+		}
+		b = []byte(s)
+	}
+	v, err := parseRate(string(b))
+	if err != nil {
+		return err
+	}
+	r.Rat = v
+	return nil
+}
+
+func (r fxRate) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(formatRate(r.Rat))), nil
+}
+
+func parseRate(s string) (*big.Rat, error) {
+	if strings.ContainsAny(s, "eE/") {
+		return nil, fmt.Errorf("rate must be a plain decimal, not %s", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid rate %q", s)
+	}
+	if r.Sign() <= 0 {
+		return nil, errors.New("rate must be > 0")
+	}
+	return r, nil
+}
+
+// formatRate renders r with fxRateScale decimals, trailing zeros trimmed.
+func formatRate(r *big.Rat) string {
+	s := r.FloatString(fxRateScale)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// fxConversion is how a cross-currency transfer was converted; it is
+// returned with the transfer response.
+type fxConversion struct {
+	SourceAmount        Money  `json:"sourceAmount"`
+	SourceCurrency      string `json:"sourceCurrency"`
+	DestinationAmount   Money  `json:"destinationAmount"`
+	DestinationCurrency string `json:"destinationCurrency"`
+	Rate                string `json:"rate"`
+	// RateSource is "client" when the request carried fxRate, otherwise
+	// "provider".
+	RateSource string `json:"rateSource"`
+}
+
+// currency looks code up in the ISO 4217 registry.
+func currency(code string) (ledger.Currency, error) {
+	c, ok := ledger.LookupCurrency(code)
+	if !ok {
+		return c, fmt.Errorf("unknown currency %q", code)
+	}
+	return c, nil
+}
+
+// currencyUnit is the smallest amount of code expressible in Money minor
+// units: 1 for the service currency, 100 for JPY on a BRL service.
+func currencyUnit(code string) (int64, error) {
+	c, err := currency(code)
+	if err != nil {
+		return 0, err
+	}
+	unit, err := c.Unit()
+	return int64(unit), err
+}
+
+// convertAmount applies rate to amount and rounds half-to-even to the
+// smallest unit of the destination currency.
+func convertAmount(amount Money, rate *big.Rat, to string) (Money, error) {
+	c, err := currency(to)
+	if err != nil {
+		return 0, err
+	}
+	converted, err := c.Round(new(big.Int).Mul(big.NewInt(int64(amount)), rate.Num()), rate.Denom())
+	if err != nil {
+		return 0, fmt.Errorf("converted %w", err)
+	}
+	return converted, nil
+}
+
+// checkCurrencyPrecision rejects amounts finer than code's smallest unit.
+func checkCurrencyPrecision(amount Money, code string) error {
+	unit, err := currencyUnit(code)
+	if err != nil {
+		return err
+	}
+	if int64(amount)%unit != 0 {
+		return ledger.ErrTooPrecise
+	}
+	return nil
+}
+
+// convertTransfer prices a transfer from one currency into another. The
+// rate is rounded to fxRateScale decimals before it is applied, so the
+// recorded rate reproduces the credited amount exactly.
+func (s *Store) convertTransfer(ctx context.Context, req TransferRequest, from, to string) (*fxConversion, int, error) {
+	if err := checkCurrencyPrecision(req.Amount, from); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	fx := &fxConversion{SourceAmount: req.Amount, SourceCurrency: from, DestinationCurrency: to, RateSource: "client"}
+	var rate *big.Rat
+	if req.FxRate != nil {
+		rate = req.FxRate.Rat
+	} else {
+		if s.rates == nil {
+			return nil, http.StatusUnprocessableEntity, fmt.Errorf("%w for %s/%s; supply fxRate", errNoRate, from, to)
+		}
+		r, err := s.rates.rate(ctx, from, to)
+		if errors.Is(err, errNoRate) {
+			return nil, http.StatusUnprocessableEntity, fmt.Errorf("%w; supply fxRate", err)
+		}
+		if err != nil {
+			return nil, http.StatusServiceUnavailable, fmt.Errorf("quote %s/%s: %w", from, to, err)
+		}
+		rate, fx.RateSource = r, "provider"
+	}
+	fx.Rate = formatRate(rate)
+	applied, _ := new(big.Rat).SetString(fx.Rate)
+	if applied.Sign() <= 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("rate rounds to zero at %d decimals", fxRateScale)
+	}
+	dest, err := convertAmount(req.Amount, applied, to)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if dest <= 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("amount converts to zero %s", to)
+	}
+	fx.DestinationAmount = dest
+	return fx, http.StatusOK, nil
+}
+
+// feeIn converts a tenant fee, which is configured in the service currency,
+// into the currency the sender is debited in, at the provider's rate.
+func (s *Store) feeIn(ctx context.Context, fee Money, code string) (Money, int, error) {
+	if code == serviceCurrency {
+		return fee, http.StatusOK, nil
+	}
+	if s.rates == nil {
+		return 0, http.StatusUnprocessableEntity, fmt.Errorf("%w for the transfer fee in %s", errNoRate, code)
+	}
+	r, err := s.rates.rate(ctx, serviceCurrency, code)
+	if errors.Is(err, errNoRate) {
+		return 0, http.StatusUnprocessableEntity, fmt.Errorf("transfer fee: %w", err)
+	}
+	if err != nil {
+		return 0, http.StatusServiceUnavailable, fmt.Errorf("quote %s/%s: %w", serviceCurrency, code, err)
+	}
+	converted, err := convertAmount(fee, r, code)
+	if err != nil {
+		return 0, http.StatusInternalServerError, fmt.Errorf("transfer fee: %w", err)
+	}
+	return converted, http.StatusOK, nil
+}
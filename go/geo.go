@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// geoPolicy lists ISO 3166 alpha-2 country codes a tenant blocks outright or
+// routes to manual review.
+type geoPolicy struct {
+	Block  []string `json:"block"`
+	Review []string `json:"review"`
+}
+
+type geoRange struct {
+	prefix  netip.Prefix
+	country string
+}
+
+// geoRule enforces per-tenant country restrictions. The origin country comes
+// from two independent inputs: the caller IP, resolved against a CIDR table,
+// and the geo metadata declared in the request. Either one hitting a
+// restricted country is enough; both are recorded in the case so reviewers
+// can see what the decision was based on.
+type geoRule struct {
+	policies map[string]geoPolicy // keyed by tenant, "*" applies to the rest
+	ranges   []geoRange
+}
+
+func (r *geoRule) Name() string { return "geofence" }
+
+func (r *geoRule) Evaluate(ctx context.Context, db querier, in riskInput) (riskOutcome, error) {
+	policy, ok := r.policies[in.Meta.Tenant]
+	if !ok {
+		if policy, ok = r.policies["*"]; !ok {
+			return riskOutcome{Decision: riskAllow}, nil
+		}
+	}
+
+	ipCountry := r.lookup(in.Meta.IP)
+	declared := ""
+	if in.Req.Geo != nil {
+		declared = strings.ToUpper(strings.TrimSpace(in.Req.Geo.Country))
+	}
+
+	out := riskOutcome{Decision: riskAllow}
+	for _, src := range []struct{ name, country string }{{"ip", ipCountry}, {"declared", declared}} {
+		if src.country == "" {
+			continue
+		}
+		decision := riskAllow
+		if containsCountry(policy.Block, src.country) {
+			decision = riskBlock
+		} else if containsCountry(policy.Review, src.country) {
+			decision = riskReview
+		}
+		if riskSeverity(decision) > riskSeverity(out.Decision) {
+			out.Decision = decision
+			out.Reason = fmt.Sprintf("origin country %s (%s) is restricted for tenant %s", src.country, src.name, in.Meta.Tenant)
+		}
+	}
+	if out.Decision == riskAllow {
+		return out, nil
+	}
+	out.Details = map[string]any{
+		"tenant":          in.Meta.Tenant,
+		"ip":              in.Meta.IP,
+		"ipCountry":       ipCountry,
+		"declaredCountry": declared,
+	}
+	return out, nil
+}
+
+// lookup returns the country for ip, preferring the most specific prefix.
+// The table is scanned linearly; it is meant for the few hundred ranges a
+// tenant restriction list needs, not a full GeoIP database.
+func (r *geoRule) lookup(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	best, bits := "", -1
+	for _, gr := range r.ranges {
+		if gr.prefix.Bits() > bits && gr.prefix.Contains(addr) {
+			best, bits = gr.country, gr.prefix.Bits()
+		}
+	}
+	return best
+}
+
+func containsCountry(list []string, country string) bool {
+	for _, c := range list {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoRuleFromEnv reads GEO_RESTRICTIONS, a JSON object of tenant -> policy
+// such as {"*":{"block":["KP","IR"]},"acme":{"review":["RU"]}}, and the
+// optional GEO_IP_RANGES_FILE CSV with "cidr,country" rows. It returns nil
+// when no restrictions are configured.
+func geoRuleFromEnv() (*geoRule, error) {
+	raw := os.Getenv("GEO_RESTRICTIONS")
+	if raw == "" {
+		return nil, nil
+	}
+	rule := &geoRule{}
+	if err := json.Unmarshal([]byte(raw), &rule.policies); err != nil {
+		return nil, fmt.Errorf("GEO_RESTRICTIONS: %w", err)
+	}
+	if path := os.Getenv("GEO_IP_RANGES_FILE"); path != "" {
+		ranges, err := loadGeoRanges(path)
+		if err != nil {
+			return nil, fmt.Errorf("GEO_IP_RANGES_FILE: %w", err)
+		}
+		rule.ranges = ranges
+	}
+	return rule, nil
+}
+
+func loadGeoRanges(path string) ([]geoRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cr := csv.NewReader(f)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 2
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	ranges := make([]geoRange, 0, len(records))
+	for i, rec := range records {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(rec[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		ranges = append(ranges, geoRange{prefix: prefix.Masked(), country: strings.ToUpper(strings.TrimSpace(rec[1]))})
+	}
+	return ranges, nil
+}
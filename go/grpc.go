@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"fintech-go/internal/ledger"
+	"fintech-go/internal/store"
+	transferv1 "fintech-go/proto/transfer/v1"
+)
+
+//go:generate buf generate
+
+// The gRPC API (proto/transfer/v1) serves internal callers on GRPC_ADDR
+// from the same Store as the HTTP API. Its methods go through the same
+// functions as their HTTP handlers, validateTransfer and s.transfer for
+// transfers, so screening, journaling and idempotency cannot drift apart;
+// errors are classed by errmap.go like HTTP ones. Credentials and caller
+// headers are read from metadata by the HTTP authenticators, and callers'
+// deadlines bound the work through the context.
+
+type grpcTransferServer struct {
+	transferv1.UnimplementedTransferServiceServer
+	store *Store
+}
+
+func newGRPCServer(s *Store, auths []authenticator, tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(grpcObserve, grpcAuth(auths), grpcReadOnly(s.flags))}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	srv := grpc.NewServer(opts...)
+	transferv1.RegisterTransferServiceServer(srv, &grpcTransferServer{store: s})
+	reflection.Register(srv)
+	return srv
+}
+
+// grpcRequest presents the call's metadata as an HTTP request, for the
+// authenticators and metaFromRequest.
+func grpcRequest(ctx context.Context) *http.Request {
+	r := (&http.Request{Header: http.Header{}}).WithContext(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, vs := range md {
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	return r
+}
+
+// grpcObserve assigns the request id, like withRequestID, and records the
+// call's duration and code.
+func grpcObserve(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(requestIDHeader)) > 0 {
+		id = md.Get(requestIDHeader)[0]
+	}
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, id))
+	ctx = withMeta(ctx, requestMeta{Client: "unknown", Tenant: "default", RequestID: id})
+	resp, err := handler(ctx, req)
+	grpcDuration.WithLabelValues(info.FullMethod, status.Code(err).String()).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// grpcAuth is withAuth for gRPC: every method needs the transfers scope.
+func grpcAuth(auths []authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if len(auths) > 0 {
+			p, err := authenticate(auths, grpcRequest(ctx))
+			if err != nil {
+				authFailures.WithLabelValues("unauthenticated").Inc()
+				if !errors.Is(err, errNoCredentials) {
+					logger(ctx).Warn("authentication failed", "error", err)
+				}
+				return nil, status.Error(codes.Unauthenticated, "authentication required")
+			}
+			if !p.has(scopeTransfers) {
+				authFailures.WithLabelValues("forbidden").Inc()
+				return nil, status.Error(codes.PermissionDenied, "credential lacks the "+scopeTransfers+" scope")
+			}
+			ctx = context.WithValue(ctx, principalKey, p)
+		}
+		meta := metaFromRequest(grpcRequest(ctx))
+		meta.RequestID = metaFromContext(ctx).RequestID
+		return handler(withMeta(ctx, meta), req)
+	}
+}
+
+// grpcReadOnly refuses transfers while the service is read-only.
+func grpcReadOnly(flags *runtimeFlags) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if flags.readOnly.Load() && strings.HasSuffix(info.FullMethod, "/Transfer") {
+			return nil, status.Error(codes.Unavailable, "service is read-only for maintenance")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// grpcError reports a failure with its class's code and the message the
+// HTTP API would send.
+func grpcError(code int, err error) error {
+	_, resp := errorResponse(code, err)
+	return status.Error(classify(code, err).code, resp.Message)
+}
+
+func (g *grpcTransferServer) Transfer(ctx context.Context, in *transferv1.TransferRequest) (*transferv1.TransferResponse, error) {
+	amount, err := ledger.ParseMoney(in.Amount, moneyExponent)
+	if err != nil {
+		transferRequests.WithLabelValues("validation_error").Inc()
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	req := TransferRequest{FromAccountID: in.FromAccountId, ToAccountID: in.ToAccountId, Amount: amount,
+		OperationID: in.OperationId, QuoteID: in.QuoteId}
+	if in.FxRate != "" {
+		rate, err := parseRate(in.FxRate)
+		if err != nil {
+			transferRequests.WithLabelValues("validation_error").Inc()
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		req.FxRate = &fxRate{rate}
+	}
+	if msg := validateTransfer(req); msg != "" {
+		transferRequests.WithLabelValues("validation_error").Inc()
+		return nil, status.Error(codes.InvalidArgument, msg)
+	}
+
+	resp, code, err := g.store.transfer(ctx, req)
+	if err != nil {
+		logger(ctx).Error("transfer failed", "operation_id", req.OperationID, "from", req.FromAccountID, "to", req.ToAccountID,
+			"amount", req.Amount, "status", code, "error", err)
+		return nil, grpcError(code, err)
+	}
+	logger(ctx).Info("transfer", "operation_id", req.OperationID, "from", req.FromAccountID, "to", req.ToAccountID,
+		"amount", req.Amount, "status", code, "result", resp.Status, "api", "grpc")
+	if resp.raw != nil {
+		// a replay carries the stored body
+		if err := json.Unmarshal(resp.raw, &resp); err != nil {
+			return nil, status.Error(codes.Internal, "internal server error")
+		}
+	}
+	g.store.markJournal(ctx, req.OperationID, journalResponded, "")
+	out := &transferv1.TransferResponse{Status: resp.Status, Message: resp.Message, CaseId: resp.CaseID,
+		ReceiptNumber: resp.ReceiptNumber, Balances: map[string]string{}}
+	for id, b := range resp.Balances {
+		out.Balances[id] = b.String()
+	}
+	if resp.Fee != nil {
+		fee := resp.Fee.String()
+		out.Fee = &fee
+	}
+	if fx := resp.FX; fx != nil {
+		out.Fx = &transferv1.FxConversion{SourceAmount: fx.SourceAmount.String(), SourceCurrency: fx.SourceCurrency,
+			DestinationAmount: fx.DestinationAmount.String(), DestinationCurrency: fx.DestinationCurrency,
+			Rate: fx.Rate, RateSource: fx.RateSource}
+	}
+	return out, nil
+}
+
+func (g *grpcTransferServer) GetAccount(ctx context.Context, in *transferv1.GetAccountRequest) (*transferv1.GetAccountResponse, error) {
+	a, err := g.store.getAccount(ctx, in.AccountId)
+	if errors.Is(err, errAccountNotFound) {
+		return nil, status.Error(codes.NotFound, "account not found")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to load account")
+	}
+	out := &transferv1.Account{Id: a.ID, TenantId: a.TenantID, DisplayName: a.DisplayName, Balance: a.Balance.String(),
+		Currency: a.Currency, Status: a.Status, OverdraftLimit: a.OverdraftLimit.String(), CreatedAt: timestamppb.New(a.CreatedAt)}
+	if a.TransferLimit != nil {
+		limit := a.TransferLimit.String()
+		out.TransferLimit = &limit
+	}
+	if a.ClosedAt != nil {
+		out.ClosedAt = timestamppb.New(*a.ClosedAt)
+	}
+	return &transferv1.GetAccountResponse{Account: out}, nil
+}
+
+func (g *grpcTransferServer) ListTransactions(ctx context.Context, in *transferv1.ListTransactionsRequest) (*transferv1.ListTransactionsResponse, error) {
+	sq := store.StatementQuery{Type: in.Type, Cursor: in.Cursor, Limit: int(in.Limit)}
+	if in.From != nil {
+		sq.From = in.From.AsTime()
+	}
+	if in.To != nil {
+		sq.To = in.To.AsTime()
+	}
+	page, err := g.store.Statement(ctx, in.AccountId, sq)
+	var invalid store.InvalidError
+	switch {
+	case errors.As(err, &invalid):
+		return nil, status.Error(codes.InvalidArgument, invalid.Error())
+	case errors.Is(err, errAccountNotFound):
+		return nil, status.Error(codes.NotFound, "account not found")
+	case err != nil:
+		return nil, status.Error(codes.Internal, "failed to load transactions")
+	}
+	out := &transferv1.ListTransactionsResponse{AsOf: strconv.FormatInt(page.AsOf, 10), NextCursor: page.NextCursor}
+	if page.Balance != nil {
+		b := page.Balance.String()
+		out.Balance = &b
+	}
+	for _, t := range page.Transactions {
+		pt := &transferv1.Transaction{Id: t.ID, Type: t.Type, Amount: t.Amount.String(), At: timestamppb.New(t.At),
+			Currency: t.Currency, FxRate: t.FxRate, TransactionId: t.TransactionID, CounterpartyAccountId: t.CounterpartyAccountID,
+			VirtualAccountId: t.VirtualAccountID, StandingOrderId: t.StandingOrderID, Descriptor_: t.Descriptor}
+		if c := t.Counterparty; c != nil {
+			pt.Counterparty = &transferv1.Counterparty{AccountId: c.AccountID, Name: c.Name, MaskedAccount: c.MaskedAccount,
+				Category: c.Category, Icon: c.Icon}
+		}
+		if sm := t.Summary; sm != nil {
+			pt.Summary = &transferv1.Summary{Entries: sm.Entries, FirstLedgerId: sm.FirstLedgerID, Period: sm.Period}
+		}
+		out.Transactions = append(out.Transactions, pt)
+	}
+	return out, nil
+}
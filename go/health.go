@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The health score summarises how close an instance is to timing out
+// transfers, on a 0-100 scale. Each signal scores 100 below its warn
+// threshold, 0 at or above its critical threshold and linearly in between;
+// the instance score is the worst signal, since any one of them saturating is
+// enough to fail requests. Load balancers read it from the admin port and
+// drain the instance below the drain threshold.
+
+type healthThresholds struct {
+	dbLatencyWarn, dbLatencyCrit time.Duration
+	errorRateWarn, errorRateCrit float64
+	queueWarn, queueCrit         int
+	drainBelow                   int
+}
+
+func healthThresholdsFromEnv() healthThresholds {
+	return healthThresholds{
+		dbLatencyWarn: durationOrDefault("HEALTH_DB_LATENCY_WARN", 50*time.Millisecond),
+		dbLatencyCrit: durationOrDefault("HEALTH_DB_LATENCY_CRIT", 500*time.Millisecond),
+		errorRateWarn: floatOrDefault("HEALTH_ERROR_RATE_WARN", 0.01),
+		errorRateCrit: floatOrDefault("HEALTH_ERROR_RATE_CRIT", 0.10),
+		queueWarn:     intOrDefault("HEALTH_QUEUE_WARN", 100),
+		queueCrit:     intOrDefault("HEALTH_QUEUE_CRIT", 1000),
+		drainBelow:    intOrDefault("HEALTH_DRAIN_SCORE", 50),
+	}
+}
+
+type healthReport struct {
+	Score      int                        `json:"score"`
+	Status     string                     `json:"status"`
+	Components map[string]healthComponent `json:"components"`
+	SampledAt  time.Time                  `json:"sampledAt"`
+}
+
+type healthComponent struct {
+	Value float64 `json:"value"`
+	Score int     `json:"score"`
+	Error string  `json:"error,omitempty"`
+}
+
+// healthMonitor samples the signals in the background so load balancer
+// score probes never touch the database themselves; only the readiness
+// probe pings it directly.
+type healthMonitor struct {
+	pool         *pgxpool.Pool
+	thresholds   healthThresholds
+	readyTimeout time.Duration
+
+	mu      sync.Mutex
+	buckets [6]errorBucket // 10s buckets covering the last minute
+
+	last atomic.Pointer[healthReport]
+	// draining is set on shutdown and forces the drain status.
+	draining atomic.Bool
+}
+
+type errorBucket struct {
+	start         int64
+	total, failed int
+}
+
+func newHealthMonitor(pool *pgxpool.Pool, t healthThresholds) *healthMonitor {
+	return &healthMonitor{pool: pool, thresholds: t, readyTimeout: durationOrDefault("READY_TIMEOUT", 2*time.Second)}
+}
+
+// track wraps a handler and counts 5xx responses towards the error rate.
+// Client errors and rule blocks are the caller's problem, not the instance's.
+func (h *healthMonitor) track(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r)
+		h.observe(time.Now(), sw.status >= 500)
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (h *healthMonitor) observe(at time.Time, failed bool) {
+	slot := at.Unix() / 10
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := &h.buckets[slot%int64(len(h.buckets))]
+	if b.start != slot {
+		*b = errorBucket{start: slot}
+	}
+	b.total++
+	if failed {
+		b.failed++
+	}
+}
+
+func (h *healthMonitor) errorRate(now time.Time) float64 {
+	oldest := now.Unix()/10 - int64(len(h.buckets)) + 1
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var total, failed int
+	for _, b := range h.buckets {
+		if b.start >= oldest {
+			total += b.total
+			failed += b.failed
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(failed) / float64(total)
+}
+
+func (h *healthMonitor) sample(ctx context.Context) *healthReport {
+	t := h.thresholds
+	rep := &healthReport{Components: map[string]healthComponent{}, SampledAt: time.Now()}
+
+	pingCtx, cancel := context.WithTimeout(ctx, 2*t.dbLatencyCrit)
+	start := time.Now()
+	err := h.pool.Ping(pingCtx)
+	cancel()
+	latency := time.Since(start)
+	db := healthComponent{Value: latency.Seconds(), Score: linearScore(float64(latency), float64(t.dbLatencyWarn), float64(t.dbLatencyCrit))}
+	if err != nil {
+		db.Score, db.Error = 0, err.Error()
+	}
+	rep.Components["db_latency_seconds"] = db
+
+	rate := h.errorRate(rep.SampledAt)
+	rep.Components["error_rate"] = healthComponent{Value: rate, Score: linearScore(rate, t.errorRateWarn, t.errorRateCrit)}
+
+	var depth int
+	queue := healthComponent{}
+	if err := h.pool.QueryRow(ctx, "SELECT count(*) FROM jobs WHERE status=$1", jobQueued).Scan(&depth); err != nil {
+		queue.Error = err.Error()
+	}
+	queue.Value = float64(depth)
+	queue.Score = linearScore(float64(depth), float64(t.queueWarn), float64(t.queueCrit))
+	rep.Components["queue_depth"] = queue
+
+	rep.Score = 100
+	for _, c := range rep.Components {
+		rep.Score = min(rep.Score, c.Score)
+	}
+	rep.Status = "up"
+	if rep.Score < t.drainBelow {
+		rep.Status = "drain"
+	}
+	return rep
+}
+
+func linearScore(v, warn, crit float64) int {
+	switch {
+	case v <= warn:
+		return 100
+	case v >= crit:
+		return 0
+	}
+	return int(math.Round(100 * (crit - v) / (crit - warn)))
+}
+
+func (h *healthMonitor) run(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		rep := h.sample(ctx)
+		h.last.Store(rep)
+		instanceHealthScore.Set(float64(rep.Score))
+		if rep.Status == "drain" {
+			slog.Warn("health score below drain threshold", "score", rep.Score, "threshold", h.thresholds.drainBelow)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// handleScore serves the last sample. The default JSON body comes with 200
+// or 503 for plain HTTP checks; ?format=agent answers in the HAProxy
+// agent-check protocol ("up 80%" or "drain") so the weight follows the score.
+func (h *healthMonitor) handleScore(w http.ResponseWriter, r *http.Request) {
+	rep := h.last.Load()
+	if rep == nil {
+		http.Error(w, "health not sampled yet", http.StatusServiceUnavailable)
+		return
+	}
+	if h.draining.Load() {
+		draining := *rep
+		draining.Score, draining.Status = 0, "drain"
+		rep = &draining
+	}
+	if r.URL.Query().Get("format") == "agent" {
+		w.Header().Set("Content-Type", "text/plain")
+		if rep.Status == "drain" {
+			fmt.Fprintln(w, "drain")
+			return
+		}
+		fmt.Fprintln(w, "up "+strconv.Itoa(max(rep.Score, 1))+"%")
+		return
+	}
+	status := http.StatusOK
+	if rep.Status == "drain" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, rep)
+}
+
+// handleLive is the liveness probe: it only proves the process is serving
+// HTTP. It deliberately ignores the database, so an outage does not get
+// every replica restarted at once.
+func (h *healthMonitor) handleLive(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady is the readiness probe: 503 while the pool cannot reach
+// Postgres within READY_TIMEOUT, and from the moment shutdown starts so
+// Kubernetes stops routing before the listeners close.
+func (h *healthMonitor) handleReady(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), h.readyTimeout)
+	defer cancel()
+	if err := h.pool.Ping(ctx); err != nil {
+		logger(ctx).Warn("readiness check failed", "error", err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": "database unreachable"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
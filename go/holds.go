@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/ledger"
+)
+
+// An authorization hold reserves funds for a card-style two-phase payment:
+// POST /holds authorizes, POST /holds/{id}/capture books the payment and
+// POST /holds/{id}/release gives the funds back. While a hold is active its
+// amount is in the account's held column: the booked balance does not
+// move, but transfers, sweeps and new holds may only spend balance - held.
+//
+// A hold names its destination when placed. Capturing runs the amount,
+// at most the hold's, through the transfer pipeline from the account to
+// that destination, with the hold marked captured and released in the same
+// transaction; a partial capture gives back the rest. The capture is
+// idempotent under operationId, "hold/<id>/capture" unless the caller
+// picks one. Risk rules are not re-run at capture: the authorization was
+// the decision, as with returns and sweeps.
+//
+// Holds expire at expiresAt, HOLD_TTL (default 7 days) after placement on
+// the tenant's clock unless the request asks for less; the pending sweeper
+// releases them.
+
+const (
+	holdActive   = "active"
+	holdCaptured = "captured"
+	holdReleased = "released"
+	holdExpired  = "expired"
+)
+
+const maxHoldTTL = 30 * 24 * time.Hour
+
+var defaultHoldTTL = durationOrDefault("HOLD_TTL", 7*24*time.Hour)
+
+var (
+	errHoldNotFound  = errors.New("hold not found")
+	errHoldNotActive = errors.New("hold is not active")
+	errHoldExceeded  = errors.New("capture exceeds the held amount")
+)
+
+type hold struct {
+	ID          int64     `json:"id"`
+	TenantID    string    `json:"tenantId"`
+	AccountID   string    `json:"accountId"`
+	ToAccountID string    `json:"toAccountId"`
+	Amount      Money     `json:"amount"`
+	Currency    string    `json:"currency"`
+	OperationID *string   `json:"operationId,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Status      string    `json:"status"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	// CapturedAmount and TransferID are set once captured.
+	CapturedAmount *Money     `json:"capturedAmount,omitempty"`
+	TransferID     *int64     `json:"transferId,omitempty"`
+	CreatedBy      string     `json:"createdBy"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	ClosedAt       *time.Time `json:"closedAt,omitempty"`
+}
+
+const holdColumns = `id, tenant_id, account_id, to_account_id, amount, currency, operation_id, description, status, expires_at,
+	captured_amount, transfer_id, created_by, created_at, closed_at`
+
+func scanHold(row pgx.Row) (hold, error) {
+	var h hold
+	err := row.Scan(&h.ID, &h.TenantID, &h.AccountID, &h.ToAccountID, &h.Amount, &h.Currency, &h.OperationID, &h.Description, &h.Status,
+		&h.ExpiresAt, &h.CapturedAmount, &h.TransferID, &h.CreatedBy, &h.CreatedAt, &h.ClosedAt)
+	return h, err
+}
+
+type placeHoldRequest struct {
+	AccountID   string `json:"accountId"`
+	ToAccountID string `json:"toAccountId"`
+	Amount      Money  `json:"amount"`
+	// OperationID makes placement idempotent: a retry returns the hold
+	// already placed under it.
+	OperationID string `json:"operationId,omitempty"`
+	// ExpiresIn shortens the hold's life ("72h"); at most 30 days.
+	ExpiresIn   string `json:"expiresIn,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+func (s *Store) handlePlaceHold(w http.ResponseWriter, r *http.Request) {
+	var req placeHoldRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if errors.Is(err, ledger.ErrTooPrecise) {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+			return
+		}
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if msg := validateTransfer(TransferRequest{FromAccountID: req.AccountID, ToAccountID: req.ToAccountID, Amount: req.Amount}); msg != "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: msg})
+		return
+	}
+	if isSystemAccount(req.AccountID) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "account is reserved"})
+		return
+	}
+	ttl := defaultHoldTTL
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxHoldTTL {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "expiresIn must be a positive duration of at most 720h"})
+			return
+		}
+		ttl = d
+	}
+	h, status, err := s.placeHold(r.Context(), req, ttl, metaFromRequest(r).Client)
+	if status == http.StatusInternalServerError {
+		logger(r.Context()).Error("place hold", "account_id", req.AccountID, "error", err)
+		http.Error(w, "failed to place hold", status)
+		return
+	}
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, status, h)
+}
+
+// placeHold reserves the amount under the account's row lock, so two holds
+// or a hold and a transfer cannot both spend the same funds. It answers 201
+// for a new hold and 200 for one already placed under the operation id.
+func (s *Store) placeHold(ctx context.Context, req placeHoldRequest, ttl time.Duration, actor string) (hold, int, error) {
+	var (
+		h      hold
+		status = http.StatusCreated
+	)
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		locked, err := lockAccounts(ctx, tx, req.AccountID)
+		if err != nil {
+			return fmt.Errorf("lock account: %w", err)
+		}
+		from := locked[req.AccountID]
+		if from == nil {
+			status = http.StatusBadRequest
+			return fmt.Errorf("from %w", errAccountNotFound)
+		}
+		if p := principalFromContext(ctx); p != nil && p.Tenant != "" && p.Tenant != from.tenantID {
+			status = http.StatusForbidden
+			return errOtherTenant
+		}
+		if req.OperationID != "" {
+			prev, err := scanHold(tx.QueryRow(ctx, "SELECT "+holdColumns+" FROM holds WHERE operation_id=$1", req.OperationID))
+			switch {
+			case err == nil && (prev.AccountID != req.AccountID || prev.ToAccountID != req.ToAccountID || prev.Amount != req.Amount):
+				status = http.StatusConflict
+				return errors.New("operationId was already used for a different hold")
+			case err == nil:
+				h, status = prev, http.StatusOK
+				return nil
+			case !errors.Is(err, pgx.ErrNoRows):
+				return err
+			}
+		}
+		var toStatus string
+		if err := tx.QueryRow(ctx, "SELECT status FROM accounts WHERE id=$1", req.ToAccountID).Scan(&toStatus); errors.Is(err, pgx.ErrNoRows) {
+			status = http.StatusBadRequest
+			return fmt.Errorf("to %w", errAccountNotFound)
+		} else if err != nil {
+			return err
+		}
+		cfg := s.tenants.effective(from.tenantID)
+		limit := from.transferLimit
+		if limit == nil {
+			limit = cfg.TransferLimit
+		}
+		switch {
+		case from.status == accountFrozen:
+			err = fmt.Errorf("from %w", errAccountFrozen)
+		case from.status != accountActive:
+			err = fmt.Errorf("from %w", errAccountClosed)
+		case toStatus == accountClosed:
+			err = fmt.Errorf("to %w", errAccountClosed)
+		case limit != nil && req.Amount > *limit:
+			err = errLimitExceeded
+		case from.balance-from.held-req.Amount < -from.overdraftLimit:
+			err = errInsufficientFunds
+		default:
+			err = checkCurrencyPrecision(req.Amount, from.currency)
+		}
+		if err != nil {
+			status = http.StatusBadRequest
+			return err
+		}
+		expires := s.clocks.now(from.tenantID).Add(ttl)
+		if h, err = scanHold(tx.QueryRow(ctx, `
+			INSERT INTO holds (tenant_id, account_id, to_account_id, amount, currency, operation_id, description, expires_at, created_by)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9) RETURNING `+holdColumns,
+			from.tenantID, req.AccountID, req.ToAccountID, req.Amount, from.currency, req.OperationID, req.Description, expires, actor)); err != nil {
+			return fmt.Errorf("insert hold: %w", err)
+		}
+		_, err = tx.Exec(ctx, "UPDATE accounts SET held = held + $2 WHERE id=$1", req.AccountID, req.Amount)
+		return err
+	})
+	if err != nil {
+		if status == http.StatusCreated {
+			status = http.StatusInternalServerError
+		}
+		return hold{}, status, err
+	}
+	if status == http.StatusCreated {
+		s.cache.accounts.invalidate(req.AccountID)
+		logger(ctx).Info("hold placed", "hold_id", h.ID, "account_id", h.AccountID, "to", h.ToAccountID, "amount", h.Amount, "expires_at", h.ExpiresAt)
+	}
+	return h, status, nil
+}
+
+// claimHold captures req.hold for the transfer being executed, after the
+// accounts are locked: the hold must be active, unexpired, for these
+// accounts and at least the amount. The whole hold is released from
+// from.held, so the funds check that follows sees it as available.
+func claimHold(ctx context.Context, tx pgx.Tx, req TransferRequest, from *lockedAccount, now time.Time) (int, error) {
+	var (
+		account, to, status string
+		amount              Money
+		expires             time.Time
+	)
+	err := tx.QueryRow(ctx, "SELECT account_id, to_account_id, amount, status, expires_at FROM holds WHERE id=$1 FOR UPDATE", req.hold).
+		Scan(&account, &to, &amount, &status, &expires)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return http.StatusNotFound, errHoldNotFound
+	}
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("lock hold: %w", err)
+	}
+	switch {
+	case account != req.FromAccountID || to != req.ToAccountID:
+		return http.StatusBadRequest, errors.New("hold is for other accounts")
+	case status != holdActive:
+		return http.StatusConflict, fmt.Errorf("%w: %s", errHoldNotActive, status)
+	case !now.Before(expires):
+		return http.StatusConflict, fmt.Errorf("%w: %s", errHoldNotActive, holdExpired)
+	case req.Amount > amount:
+		return http.StatusBadRequest, fmt.Errorf("%w of %s", errHoldExceeded, amount)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE holds SET status=$2, captured_amount=$3, closed_at=$4 WHERE id=$1",
+		req.hold, holdCaptured, req.Amount, now); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("capture hold: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE accounts SET held = held - $2 WHERE id=$1", req.FromAccountID, amount); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("release held funds: %w", err)
+	}
+	from.held -= amount
+	return http.StatusOK, nil
+}
+
+type captureHoldRequest struct {
+	// Amount is at most the hold's; the whole hold by default.
+	Amount      Money  `json:"amount,omitempty"`
+	OperationID string `json:"operationId,omitempty"`
+}
+
+func (s *Store) handleCaptureHold(w http.ResponseWriter, r *http.Request) {
+	h, ok := s.loadHold(w, r)
+	if !ok {
+		return
+	}
+	var req captureHoldRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		if errors.Is(err, ledger.ErrTooPrecise) {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+			return
+		}
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Amount < 0 {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "amount must be > 0"})
+		return
+	}
+	if req.Amount == 0 {
+		req.Amount = h.Amount
+	}
+	if req.OperationID == "" {
+		req.OperationID = "hold/" + strconv.FormatInt(h.ID, 10) + "/capture"
+	}
+	ctx := withMeta(r.Context(), metaFromRequest(r))
+	resp, status, err := s.runTransfer(ctx, TransferRequest{FromAccountID: h.AccountID, ToAccountID: h.ToAccountID, Amount: req.Amount,
+		OperationID: req.OperationID, hold: h.ID}, false)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	logger(ctx).Info("hold captured", "hold_id", h.ID, "amount", req.Amount, "operation_id", req.OperationID)
+	writeJSON(w, status, resp)
+}
+
+func (s *Store) handleReleaseHold(w http.ResponseWriter, r *http.Request) {
+	h, ok := s.loadHold(w, r)
+	if !ok {
+		return
+	}
+	h, status, err := s.releaseHold(r.Context(), h.ID, holdReleased)
+	if status == http.StatusInternalServerError {
+		logger(r.Context()).Error("release hold", "hold_id", h.ID, "error", err)
+		http.Error(w, "failed to release hold", status)
+		return
+	}
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, h)
+}
+
+// releaseHold ends an active hold as released or expired and gives its
+// amount back. Releasing a hold already released answers it as is. The
+// account is locked before the hold, in the order captures take them.
+func (s *Store) releaseHold(ctx context.Context, id int64, to string) (hold, int, error) {
+	var (
+		h       hold
+		status  = http.StatusOK
+		changed bool
+	)
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		var account string
+		if err := tx.QueryRow(ctx, "SELECT account_id FROM holds WHERE id=$1", id).Scan(&account); errors.Is(err, pgx.ErrNoRows) {
+			status = http.StatusNotFound
+			return errHoldNotFound
+		} else if err != nil {
+			return err
+		}
+		if _, err := lockAccounts(ctx, tx, account); err != nil {
+			return fmt.Errorf("lock account: %w", err)
+		}
+		var err error
+		if h, err = scanHold(tx.QueryRow(ctx, "SELECT "+holdColumns+" FROM holds WHERE id=$1 FOR UPDATE", id)); err != nil {
+			return err
+		}
+		switch {
+		case h.Status == to:
+			return nil
+		case h.Status != holdActive:
+			status = http.StatusConflict
+			return fmt.Errorf("%w: %s", errHoldNotActive, h.Status)
+		}
+		if h, err = scanHold(tx.QueryRow(ctx, "UPDATE holds SET status=$2, closed_at=now() WHERE id=$1 RETURNING "+holdColumns, id, to)); err != nil {
+			return err
+		}
+		changed = true
+		_, err = tx.Exec(ctx, "UPDATE accounts SET held = held - $2 WHERE id=$1", h.AccountID, h.Amount)
+		return err
+	})
+	if err != nil {
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+		return hold{}, status, err
+	}
+	if changed {
+		s.cache.accounts.invalidate(h.AccountID)
+		if to == holdExpired {
+			pendingExpired.WithLabelValues("hold").Inc()
+		}
+		if err := s.recordEvent(ctx, "hold."+to, "account/"+h.AccountID, map[string]any{
+			"holdId": h.ID, "amount": h.Amount, "currency": h.Currency, "description": h.Description,
+		}); err != nil {
+			logger(ctx).Error("record hold event", "hold_id", h.ID, "error", err)
+		}
+		logger(ctx).Info("hold "+to, "hold_id", h.ID, "account_id", h.AccountID, "amount", h.Amount)
+	}
+	return h, status, nil
+}
+
+// expireHolds releases the holds past their expiry on their tenant's
+// clock. A hold captured or released meanwhile is left alone by
+// releaseHold, so replicas can sweep concurrently.
+func (s *Store) expireHolds(ctx context.Context) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT id FROM holds WHERE status=$1 AND expires_at < now() + tenant_clock_offset(tenant_id)
+		ORDER BY expires_at LIMIT 500`, holdActive)
+	if err != nil {
+		slog.Error("find expired holds", "error", err)
+		return
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		slog.Error("find expired holds", "error", err)
+		return
+	}
+	for _, id := range ids {
+		if _, _, err := s.releaseHold(ctx, id, holdExpired); err != nil && !errors.Is(err, errHoldNotActive) {
+			slog.Error("expire hold", "hold_id", id, "error", err)
+		}
+	}
+}
+
+// loadHold reads the hold named in the path, answering 404 or 403 itself.
+func (s *Store) loadHold(w http.ResponseWriter, r *http.Request) (hold, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid hold id", http.StatusBadRequest)
+		return hold{}, false
+	}
+	h, err := scanHold(s.pool.QueryRow(r.Context(), "SELECT "+holdColumns+" FROM holds WHERE id=$1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: errHoldNotFound.Error()})
+		return hold{}, false
+	}
+	if err != nil {
+		http.Error(w, "failed to load hold", http.StatusInternalServerError)
+		return hold{}, false
+	}
+	if p := principalFromContext(r.Context()); p != nil && p.Tenant != "" && p.Tenant != h.TenantID {
+		writeJSON(w, http.StatusForbidden, TransferResponse{Status: "error", Message: "hold belongs to another tenant"})
+		return hold{}, false
+	}
+	return h, true
+}
+
+func (s *Store) handleGetHold(w http.ResponseWriter, r *http.Request) {
+	if h, ok := s.loadHold(w, r); ok {
+		writeJSON(w, http.StatusOK, h)
+	}
+}
+
+// handleListHolds lists an account's holds, newest first, optionally by
+// ?status=.
+func (s *Store) handleListHolds(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	account := q.Get("accountId")
+	if account == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "accountId is required"})
+		return
+	}
+	args := []any{account}
+	where := "account_id=$1"
+	if p := principalFromContext(r.Context()); p != nil && p.Tenant != "" {
+		args = append(args, p.Tenant)
+		where += " AND tenant_id=$2"
+	}
+	if v := q.Get("status"); v != "" {
+		args = append(args, v)
+		where += fmt.Sprintf(" AND status=$%d", len(args))
+	}
+	rows, err := s.pool.Query(r.Context(), "SELECT "+holdColumns+" FROM holds WHERE "+where+" ORDER BY id DESC LIMIT 100", args...)
+	if err != nil {
+		http.Error(w, "failed to load holds", http.StatusInternalServerError)
+		return
+	}
+	holds, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (hold, error) { return scanHold(row) })
+	if err != nil {
+		http.Error(w, "failed to load holds", http.StatusInternalServerError)
+		return
+	}
+	if holds == nil {
+		holds = make([]hold, 0)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"holds": holds})
+}
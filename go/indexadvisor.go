@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The index advisor answers "is the ledger missing an index for how it is
+// queried?". Code paths that read the ledger in bulk tag their context with
+// a query pattern (statements, search, analytics); the query tracer times
+// every query issued under a tag. GET /admin/index-advisor combines those
+// timings with pg_stat_statements and table scan counters to judge a vetted
+// set of candidate indexes, each known to serve one of the patterns.
+//
+// Only vetted candidates are ever recommended or created: an index is a
+// write cost on every transfer, so choosing one stays a code review
+// decision. With INDEX_ADVISOR_AUTO_CREATE=true the migration step creates
+// the whole vetted set CONCURRENTLY at boot, outside the migration
+// transactions (CONCURRENTLY cannot run inside one).
+
+const (
+	patternStatements = "statements"
+	patternSearch     = "search"
+	patternAnalytics  = "analytics"
+)
+
+type queryPatternKey struct{}
+
+// withQueryPattern tags the queries issued under ctx for the advisor.
+func withQueryPattern(ctx context.Context, pattern string) context.Context {
+	return context.WithValue(ctx, queryPatternKey{}, pattern)
+}
+
+func queryPatternFromContext(ctx context.Context) string {
+	p, _ := ctx.Value(queryPatternKey{}).(string)
+	return p
+}
+
+type patternStat struct {
+	Calls   int64   `json:"calls"`
+	TotalMs float64 `json:"totalMs"`
+	MaxMs   float64 `json:"maxMs"`
+}
+
+// patternStats aggregates per-pattern query timings since process start.
+var patternStats = struct {
+	sync.Mutex
+	m map[string]*patternStat
+}{m: map[string]*patternStat{}}
+
+func observeQueryPattern(pattern string, d time.Duration) {
+	queryPatternDuration.WithLabelValues(pattern).Observe(d.Seconds())
+	ms := float64(d) / float64(time.Millisecond)
+	patternStats.Lock()
+	defer patternStats.Unlock()
+	st := patternStats.m[pattern]
+	if st == nil {
+		st = &patternStat{}
+		patternStats.m[pattern] = st
+	}
+	st.Calls++
+	st.TotalMs += ms
+	if ms > st.MaxMs {
+		st.MaxMs = ms
+	}
+}
+
+type indexCandidate struct {
+	Name    string `json:"name"`
+	Table   string `json:"table"`
+	Columns string `json:"definition"`
+	Pattern string `json:"pattern"`
+	Serves  string `json:"serves"`
+	// leading is the first indexed column: an existing index on the same
+	// table leading with it covers most of the benefit.
+	leading string
+	// match selects the pg_stat_statements entries the index would serve.
+	match string
+}
+
+var indexCandidates = []indexCandidate{
+	{Name: "idx_events_subject", Table: "events", Columns: "(subject, id DESC)", Pattern: patternStatements,
+		Serves: "per-account notification feeds and the events usage meter", leading: "subject", match: "%FROM events%subject%"},
+	{Name: "idx_ledger_transfer", Table: "ledger", Columns: "(transfer_id)", Pattern: patternStatements,
+		Serves: "joining statement lines to their transfer", leading: "transfer_id", match: "%ledger%transfer_id%"},
+	{Name: "idx_transfers_to_created", Table: "transfers", Columns: "(to_account_id, created_at DESC)", Pattern: patternAnalytics,
+		Serves: "reconciliation and analytics filtering on the receiving account", leading: "to_account_id", match: "%FROM transfers%to_account_id%"},
+	{Name: "idx_accounts_status", Table: "accounts", Columns: "(status, id)", Pattern: patternSearch,
+		Serves: "account search filtered by status across tenants", leading: "status", match: "%FROM accounts%status%"},
+}
+
+type statementStat struct {
+	Query  string  `json:"query"`
+	Calls  int64   `json:"calls"`
+	MeanMs float64 `json:"meanMs"`
+	Total  float64 `json:"totalMs"`
+}
+
+type candidateReport struct {
+	indexCandidate
+	Present        bool            `json:"present"`
+	CoveredBy      string          `json:"coveredBy,omitempty"`
+	SeqScans       int64           `json:"seqScans"`
+	IndexScans     int64           `json:"indexScans"`
+	LiveRows       int64           `json:"liveRows"`
+	Statements     []statementStat `json:"statements,omitempty"`
+	Recommendation string          `json:"recommendation"`
+}
+
+type indexAdvisorReport struct {
+	Patterns          map[string]patternStat `json:"patterns"`
+	PgStatStatements  bool                   `json:"pgStatStatements"`
+	Note              string                 `json:"note,omitempty"`
+	Candidates        []candidateReport      `json:"candidates"`
+	TopLedgerQueries  []statementStat        `json:"topLedgerQueries,omitempty"`
+	AutoCreateEnabled bool                   `json:"autoCreateEnabled"`
+	GeneratedAt       time.Time              `json:"generatedAt"`
+}
+
+// indexAdvisorMinRows is the table size below which a sequential scan is
+// cheaper than any index and nothing is recommended.
+const indexAdvisorMinRows = 10000
+
+func (s *Store) handleIndexAdvisor(w http.ResponseWriter, r *http.Request) {
+	report, err := s.indexAdvice(r.Context())
+	if err != nil {
+		logger(r.Context()).Error("index advisor", "error", err)
+		http.Error(w, "failed to build index report", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Store) indexAdvice(ctx context.Context) (indexAdvisorReport, error) {
+	rep := indexAdvisorReport{Patterns: map[string]patternStat{}, AutoCreateEnabled: indexAutoCreate(), GeneratedAt: time.Now().UTC()}
+	patternStats.Lock()
+	for p, st := range patternStats.m {
+		rep.Patterns[p] = *st
+	}
+	patternStats.Unlock()
+
+	if err := s.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname='pg_stat_statements')").
+		Scan(&rep.PgStatStatements); err != nil {
+		return rep, err
+	}
+	if !rep.PgStatStatements {
+		rep.Note = "pg_stat_statements is not installed; add it to shared_preload_libraries and CREATE EXTENSION pg_stat_statements for per-statement evidence"
+	}
+
+	for _, c := range indexCandidates {
+		cr := candidateReport{indexCandidate: c}
+		// an index leading with the same column covers the candidate, whatever
+		// its name
+		err := s.pool.QueryRow(ctx, `
+			SELECT COALESCE((SELECT ic.relname FROM pg_index i
+				JOIN pg_class ic ON ic.oid = i.indexrelid
+				JOIN pg_class t ON t.oid = i.indrelid
+				JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = i.indkey[0]
+				WHERE t.relname = $1 AND pg_table_is_visible(t.oid) AND i.indisvalid AND (ic.relname = $2 OR a.attname = $3)
+				ORDER BY ic.relname <> $2 LIMIT 1), ''),
+				COALESCE(st.seq_scan, 0), COALESCE(st.idx_scan, 0), COALESCE(st.n_live_tup, 0)
+			FROM (SELECT 1) one LEFT JOIN pg_stat_user_tables st ON st.relname = $1`,
+			c.Table, c.Name, c.leading).Scan(&cr.CoveredBy, &cr.SeqScans, &cr.IndexScans, &cr.LiveRows)
+		if err != nil {
+			return rep, fmt.Errorf("%s: %w", c.Name, err)
+		}
+		cr.Present = cr.CoveredBy != ""
+		if cr.CoveredBy == c.Name {
+			cr.CoveredBy = ""
+		}
+		if rep.PgStatStatements {
+			if cr.Statements, err = s.statementStats(ctx, c.match, 5); err != nil {
+				return rep, err
+			}
+		}
+		cr.Recommendation = recommendIndex(cr, rep.Patterns[c.Pattern])
+		rep.Candidates = append(rep.Candidates, cr)
+	}
+	if rep.PgStatStatements {
+		top, err := s.statementStats(ctx, "%ledger%", 10)
+		if err != nil {
+			return rep, err
+		}
+		rep.TopLedgerQueries = top
+	}
+	return rep, nil
+}
+
+func recommendIndex(cr candidateReport, pattern patternStat) string {
+	var calls int64
+	for _, st := range cr.Statements {
+		calls += st.Calls
+	}
+	switch {
+	case cr.Present && cr.CoveredBy != "":
+		return "covered by " + cr.CoveredBy
+	case cr.Present:
+		return "present"
+	case cr.LiveRows < indexAdvisorMinRows:
+		return "not needed: table is small enough for sequential scans"
+	case calls == 0 && pattern.Calls == 0:
+		return "not needed: no matching queries observed"
+	case cr.SeqScans > cr.IndexScans:
+		return fmt.Sprintf("create: CREATE INDEX CONCURRENTLY %s ON %s%s", cr.Name, cr.Table, cr.Columns)
+	}
+	return fmt.Sprintf("consider: matching queries run, but %s is mostly read through other indexes", cr.Table)
+}
+
+// statementStats reads pg_stat_statements entries whose text matches the
+// LIKE pattern, by total time; the view is per database, so only this
+// service's database is considered.
+func (s *Store) statementStats(ctx context.Context, like string, limit int) ([]statementStat, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT left(query, 300), calls, mean_exec_time, total_exec_time FROM pg_stat_statements
+		WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database()) AND query ILIKE $1
+		ORDER BY total_exec_time DESC LIMIT $2`, like, limit)
+	if err != nil {
+		return nil, fmt.Errorf("pg_stat_statements: %w", err)
+	}
+	defer rows.Close()
+	var out []statementStat
+	for rows.Next() {
+		var st statementStat
+		if err := rows.Scan(&st.Query, &st.Calls, &st.MeanMs, &st.Total); err != nil {
+			return nil, err
+		}
+		out = append(out, st)
+	}
+	return out, rows.Err()
+}
+
+func indexAutoCreate() bool {
+	return envOrDefault("INDEX_ADVISOR_AUTO_CREATE", "false") == "true"
+}
+
+// createVettedIndexes builds the candidates that are not present. It runs
+// under the boot lock, so only one instance builds while the others wait.
+// A failed concurrent build leaves an invalid index behind, which is
+// dropped so the next boot retries cleanly; failures never stop the boot.
+func createVettedIndexes(ctx context.Context, conn *pgxpool.Conn) {
+	for _, c := range indexCandidates {
+		start := time.Now()
+		if _, err := conn.Exec(ctx, "CREATE INDEX CONCURRENTLY IF NOT EXISTS "+c.Name+" ON "+c.Table+c.Columns); err != nil {
+			slog.Error("create vetted index", "index", c.Name, "error", err)
+			if _, err := conn.Exec(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+c.Name); err != nil {
+				slog.Error("drop invalid index", "index", c.Name, "error", err)
+			}
+			continue
+		}
+		slog.Info("vetted index ensured", "index", c.Name, "took", time.Since(start).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,802 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+
+	"fintech-go/internal/store"
+)
+
+// The integration suite runs the transfer pipeline end to end against a
+// throwaway Postgres started with testcontainers, so it needs Docker:
+//
+//	go test -tags integration ./...
+//
+// TestMain points TEST_DATABASE_URL at the container as well, so the tests
+// built on testStore run against it too.
+
+// integrationDB is the container's database settings, on top of the
+// configuration defaults.
+var integrationDB dbConfig
+
+func TestMain(m *testing.M) {
+	ctx := context.Background()
+	pg, err := postgres.Run(ctx, "postgres:16-alpine",
+		postgres.WithDatabase("fintech"),
+		postgres.WithUsername("fintech"),
+		postgres.WithPassword("fintech"),
+		postgres.WithInitScripts("../db/init.sql"),
+		postgres.BasicWaitStrategies(),
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "start postgres: %v\n", err)
+		os.Exit(1)
+	}
+	code := func() int {
+		defer pg.Terminate(context.Background())
+		host, err := pg.Host(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "postgres host: %v\n", err)
+			return 1
+		}
+		port, err := pg.MappedPort(ctx, "5432/tcp")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "postgres port: %v\n", err)
+			return 1
+		}
+		integrationDB = dbConfig{Host: host, Port: port.Int(), User: "fintech", Password: "fintech", Name: "fintech", MaxRetries: 3}
+		os.Setenv("TEST_DATABASE_URL", integrationDB.DSN())
+		return m.Run()
+	}()
+	os.Exit(code)
+}
+
+// integrationStore opens the store the way serve does, migrations and
+// tenant configs included.
+func integrationStore(t *testing.T) *Store {
+	t.Helper()
+	return integrationStoreWith(t, integrationDB)
+}
+
+// integrationStoreWith is integrationStore on db, which must point at the
+// test database.
+func integrationStoreWith(t *testing.T, db dbConfig) *Store {
+	t.Helper()
+	ctx := context.Background()
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	cfg.DB = db
+	s, _ := openStore(ctx, cfg)
+	t.Cleanup(s.pool.Close)
+	t.Cleanup(s.locks.Close)
+	if err := s.prepareDatabase(ctx); err != nil {
+		t.Fatalf("prepare database: %v", err)
+	}
+	if err := s.tenants.load(ctx, s.pool); err != nil {
+		t.Fatalf("load tenant configs: %v", err)
+	}
+	return s
+}
+
+// openAccounts creates accounts named after the test, each holding balance
+// as its opening balance so reconciliation starts clean.
+func openAccounts(t *testing.T, s *Store, balance Money, names ...string) []string {
+	t.Helper()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	ids := make([]string, len(names))
+	for i, name := range names {
+		ids[i] = name + "-" + suffix
+		if _, err := s.pool.Exec(context.Background(), `
+			INSERT INTO accounts (id, balance, opening_balance, currency) VALUES ($1, $2, $2, $3)`,
+			ids[i], balance, serviceCurrency); err != nil {
+			t.Fatalf("create account %s: %v", ids[i], err)
+		}
+	}
+	return ids
+}
+
+func balanceOf(t *testing.T, s *Store, id string) Money {
+	t.Helper()
+	var b Money
+	if err := s.pool.QueryRow(context.Background(), "SELECT balance FROM accounts WHERE id=$1", id).Scan(&b); err != nil {
+		t.Fatalf("balance of %s: %v", id, err)
+	}
+	return b
+}
+
+// TestConcurrentTransfersConserveMoney drains one account from many
+// goroutines at once. Exactly as many transfers as the balance covers must
+// succeed, the rest failing for insufficient funds, and no money may be
+// created or lost on the way.
+func TestConcurrentTransfersConserveMoney(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	ids := openAccounts(t, s, 10000, "conc-from", "conc-to")
+	from, to := ids[0], ids[1]
+
+	const workers, perWorker, amount = 8, 25, 100 // 200 attempts, 100 covered
+	var (
+		wg          sync.WaitGroup
+		mu          sync.Mutex
+		ok, refused int
+		failures    []error
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				req := TransferRequest{FromAccountID: from, ToAccountID: to, Amount: amount,
+					OperationID: fmt.Sprintf("%s-%d-%d", from, w, i)}
+				_, status, err := s.transfer(ctx, req)
+				mu.Lock()
+				switch {
+				case err == nil:
+					ok++
+				case status == http.StatusBadRequest && errors.Is(err, errInsufficientFunds):
+					refused++
+				default:
+					failures = append(failures, err)
+				}
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range failures {
+		t.Errorf("transfer failed: %v", err)
+	}
+	if ok != 100 || refused != workers*perWorker-100 {
+		t.Fatalf("%d transfers succeeded and %d were refused, want 100 and %d", ok, refused, workers*perWorker-100)
+	}
+	if b := balanceOf(t, s, from); b != 0 {
+		t.Errorf("sender holds %s, want 0", b)
+	}
+	if b := balanceOf(t, s, to); b != 20000 {
+		t.Errorf("recipient holds %s, want 200.00", b)
+	}
+}
+
+// TestIdempotentReplay sends the same operation three times: it moves money
+// once and every replay answers with the original response.
+func TestIdempotentReplay(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	ids := openAccounts(t, s, 5000, "idem-from", "idem-to")
+	req := TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 1250, OperationID: "idem-" + ids[0]}
+
+	first, status, err := s.transfer(ctx, req)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("first transfer: status %d, %v", status, err)
+	}
+	for i := 0; i < 2; i++ {
+		replay, status, err := s.transfer(ctx, req)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("replay %d: status %d, %v", i+1, status, err)
+		}
+		if replay.ReceiptNumber != first.ReceiptNumber || replay.Balances[ids[0]] != first.Balances[ids[0]] {
+			t.Fatalf("replay %d answered %+v, want %+v", i+1, replay, first)
+		}
+	}
+	if b := balanceOf(t, s, ids[0]); b != 3750 {
+		t.Errorf("sender holds %s after replays, want 37.50", b)
+	}
+	var entries int
+	if err := s.pool.QueryRow(ctx, "SELECT count(*) FROM ledger WHERE account_id = ANY($1)", ids).Scan(&entries); err != nil {
+		t.Fatalf("count ledger rows: %v", err)
+	}
+	if entries != 2 {
+		t.Errorf("%d ledger rows, want one debit and one credit", entries)
+	}
+}
+
+// TestOperationLocksDoNotStarvePool runs more idempotent transfers at once
+// than the pool has connections. Every lock holder needs pool connections
+// to finish, so the locks must not take them.
+func TestOperationLocksDoNotStarvePool(t *testing.T) {
+	db := integrationDB
+	db.MaxConns = 2
+	s := integrationStoreWith(t, db)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ids := openAccounts(t, s, 10000, "starve-from", "starve-to")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 100,
+				OperationID: fmt.Sprintf("%s-%d", ids[0], i)}
+			if _, _, err := s.transfer(ctx, req); err != nil && !errors.Is(err, errLocksBusy) {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("transfer failed: %v", err)
+	}
+}
+
+// TestInsufficientFunds refuses a transfer larger than the balance and
+// leaves both accounts untouched.
+func TestInsufficientFunds(t *testing.T) {
+	s := integrationStore(t)
+	ids := openAccounts(t, s, 999, "poor-from", "poor-to")
+
+	_, status, err := s.transfer(context.Background(), TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 1000})
+	if status != http.StatusBadRequest || !errors.Is(err, errInsufficientFunds) {
+		t.Fatalf("got status %d, %v; want %d, %v", status, err, http.StatusBadRequest, errInsufficientFunds)
+	}
+	if a, b := balanceOf(t, s, ids[0]), balanceOf(t, s, ids[1]); a != 999 || b != 999 {
+		t.Fatalf("balances are %s and %s, want both 9.99", a, b)
+	}
+}
+
+// TestBalanceReconciliation moves money and reconciles the sender through
+// the job, first clean and then after corrupting its balance behind the
+// ledger's back.
+func TestBalanceReconciliation(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	ids := openAccounts(t, s, 10000, "recon-from", "recon-to")
+	for i := 0; i < 3; i++ {
+		if _, _, err := s.transfer(ctx, TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 700}); err != nil {
+			t.Fatalf("transfer %d: %v", i+1, err)
+		}
+	}
+
+	reconcile := func() balanceReconResult {
+		t.Helper()
+		j, err := s.startJob(ctx, "balance_reconciliation", balanceReconParams{AccountID: ids[0]}, false, "integration-test")
+		if err != nil {
+			t.Fatalf("start job: %v", err)
+		}
+		if err := s.runJob(ctx, j); err != nil {
+			t.Fatalf("run job: %v", err)
+		}
+		var raw []byte
+		if err := s.pool.QueryRow(ctx, "SELECT result FROM jobs WHERE id=$1", j.ID).Scan(&raw); err != nil {
+			t.Fatalf("load job result: %v", err)
+		}
+		var res balanceReconResult
+		if err := json.Unmarshal(raw, &res); err != nil {
+			t.Fatalf("decode job result: %v", err)
+		}
+		return res
+	}
+
+	if res := reconcile(); res.Accounts != 1 || res.Drifted != 0 {
+		t.Fatalf("clean ledger reconciled as %+v, want one account without drift", res)
+	}
+	if _, err := s.pool.Exec(ctx, "UPDATE accounts SET balance = balance + 5 WHERE id=$1", ids[0]); err != nil {
+		t.Fatalf("corrupt balance: %v", err)
+	}
+	res := reconcile()
+	if res.Drifted != 1 || len(res.Drift) != 1 {
+		t.Fatalf("corrupted ledger reconciled as %+v, want one drifted account", res)
+	}
+	if d := res.Drift[0]; d.Balance != 7905 || d.LedgerBalance != 7900 || d.Drift != 5 {
+		t.Fatalf("drift is %+v, want balance 79.05 against ledger 79.00", d)
+	}
+}
+
+// TestDailyLimit refuses the transfer that would take the sender's debits
+// for the day over its daily limit.
+func TestDailyLimit(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	ids := openAccounts(t, s, 10000, "daily-from", "daily-to")
+	if _, err := s.pool.Exec(ctx, "UPDATE accounts SET daily_limit=$2 WHERE id=$1", ids[0], Money(100)); err != nil {
+		t.Fatalf("set daily limit: %v", err)
+	}
+	req := TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 60}
+	if _, _, err := s.transfer(ctx, req); err != nil {
+		t.Fatalf("first transfer: %v", err)
+	}
+	_, status, err := s.transfer(ctx, req)
+	if status != http.StatusBadRequest || !errors.Is(err, errDailyLimitExceeded) {
+		t.Fatalf("got status %d, %v; want %d, %v", status, err, http.StatusBadRequest, errDailyLimitExceeded)
+	}
+	if b := balanceOf(t, s, ids[0]); b != 9940 {
+		t.Errorf("sender holds %s, want 99.40", b)
+	}
+}
+
+// TestDailyLimitWarning warns on the transfer that takes the sender past
+// 80% of its daily limit, not on the one before it.
+func TestDailyLimitWarning(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	ids := openAccounts(t, s, 10000, "warn-from", "warn-to")
+	if _, err := s.pool.Exec(ctx, "UPDATE accounts SET daily_limit=$2 WHERE id=$1", ids[0], Money(100)); err != nil {
+		t.Fatalf("set daily limit: %v", err)
+	}
+	resp, _, err := s.transfer(ctx, TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 50})
+	if err != nil || len(resp.Warnings) != 0 {
+		t.Fatalf("first transfer: warnings %+v, %v; want none", resp.Warnings, err)
+	}
+	resp, _, err = s.transfer(ctx, TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 35})
+	if err != nil {
+		t.Fatalf("second transfer: %v", err)
+	}
+	if len(resp.Warnings) != 1 || resp.Warnings[0].Code != warningDailyLimit || resp.Warnings[0].Remaining != 15 {
+		t.Errorf("warnings %+v, want %s with 0.15 left", resp.Warnings, warningDailyLimit)
+	}
+}
+
+// TestProjection projects two scheduled transfers: the first goes through,
+// the second would overdraw the account by then and is shown failing
+// without moving the projected balance.
+func TestProjection(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	ids := openAccounts(t, s, 10000, "proj-from", "proj-to")
+	now := s.clocks.now("default")
+	for i, amount := range []Money{3000, 9000} {
+		at := now.Add(time.Duration(i+1) * 24 * time.Hour)
+		if _, err := s.pool.Exec(ctx, `
+			INSERT INTO scheduled_transfers (tenant_id, from_account_id, to_account_id, amount, execute_at, next_attempt_at, created_by)
+			SELECT tenant_id, id, $2, $3, $4, $4, 'integration-test' FROM accounts WHERE id=$1`,
+			ids[0], ids[1], amount, at); err != nil {
+			t.Fatalf("schedule transfer %d: %v", i+1, err)
+		}
+	}
+	p, status, err := s.projectAccount(ctx, ids[0], projectionRequest{Days: 7})
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("project: status %d, %v", status, err)
+	}
+	var moves []projectedEvent
+	for _, e := range p.Events {
+		if e.Type == projectedScheduled {
+			moves = append(moves, e)
+		}
+	}
+	if len(moves) != 2 || moves[0].Fails != "" || moves[1].Fails != "insufficient_funds" {
+		t.Fatalf("scheduled transfers projected as %+v, want the second failing for insufficient funds", moves)
+	}
+	if want := 7000 - p.Fees; p.ProjectedBalance != want || len(p.Days) != 7 {
+		t.Fatalf("projected %s over %d days, want %s over 7", p.ProjectedBalance, len(p.Days), want)
+	}
+}
+
+// TestVelocityRule blocks the third transfer within a minute under a rule on
+// the source's history, evaluated inside the transfer transaction, and
+// records the hit as a pre-commit risk event.
+func TestVelocityRule(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	rules, err := parseRuleSet("burst: account.transfers_1m >= 2 -> block")
+	if err != nil {
+		t.Fatalf("parse rules: %v", err)
+	}
+	s.rules.current.Store(&ruleSet{Version: 1, Rules: rules})
+	ids := openAccounts(t, s, 10000, "velo-from", "velo-to")
+	req := TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 100}
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.transfer(ctx, req); err != nil {
+			t.Fatalf("transfer %d: %v", i+1, err)
+		}
+	}
+	_, status, err := s.transfer(ctx, req)
+	if status != http.StatusForbidden || !errors.Is(err, errBlockedByRule) {
+		t.Fatalf("got status %d, %v; want %d, %v", status, err, http.StatusForbidden, errBlockedByRule)
+	}
+	var stage, rule string
+	if err := s.pool.QueryRow(ctx, "SELECT stage, rule FROM risk_events WHERE account_id=$1", ids[0]).Scan(&stage, &rule); err != nil {
+		t.Fatalf("load risk event: %v", err)
+	}
+	if stage != riskStagePreCommit || rule != "burst" {
+		t.Errorf("risk event is %s/%s, want %s/burst", stage, rule, riskStagePreCommit)
+	}
+}
+
+// TestHoldCapture places a hold, checks that it blocks spending the held
+// funds without moving the balance, and captures part of it: the captured
+// amount is booked and the rest is given back.
+func TestHoldCapture(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	ids := openAccounts(t, s, 10000, "hold-from", "hold-to")
+	h, status, err := s.placeHold(ctx, placeHoldRequest{AccountID: ids[0], ToAccountID: ids[1], Amount: 8000}, time.Hour, "integration-test")
+	if err != nil || status != http.StatusCreated {
+		t.Fatalf("place hold: status %d, %v", status, err)
+	}
+	if _, status, err := s.transfer(ctx, TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 5000}); !errors.Is(err, errInsufficientFunds) {
+		t.Fatalf("transfer over available: status %d, %v; want %d", status, err, http.StatusBadRequest)
+	}
+	if got := balanceOf(t, s, ids[0]); got != 10000 {
+		t.Fatalf("balance with hold is %s, want 10000", got)
+	}
+	if _, status, err := s.runTransfer(ctx, TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 6000,
+		OperationID: "hold-capture-" + ids[0], hold: h.ID}, false); err != nil || status != http.StatusOK {
+		t.Fatalf("capture: status %d, %v", status, err)
+	}
+	var held Money
+	var holdStatus string
+	if err := s.pool.QueryRow(ctx, "SELECT a.held, h.status FROM accounts a JOIN holds h ON h.account_id=a.id WHERE h.id=$1", h.ID).
+		Scan(&held, &holdStatus); err != nil {
+		t.Fatalf("load hold: %v", err)
+	}
+	if held != 0 || holdStatus != holdCaptured {
+		t.Errorf("after capture held=%s status=%s, want 0/%s", held, holdStatus, holdCaptured)
+	}
+	if got := balanceOf(t, s, ids[1]); got != 16000 {
+		t.Errorf("destination balance %s, want 16000", got)
+	}
+}
+
+// TestMonthlyStatement builds the current month's statement of an account
+// that sent one transfer: the opening balance predates the ledger and the
+// closing balance matches the account's.
+func TestMonthlyStatement(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	ids := openAccounts(t, s, 10000, "stmt-from", "stmt-to")
+	if _, _, err := s.transfer(ctx, TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 2500}); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	month := s.clocks.now("default").In(s.tenants.effective("default").formatter().Location)
+	st, status, err := s.monthlyStatement(ctx, ids[0], month)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("statement: status %d, %v", status, err)
+	}
+	if st.OpeningBalance != 10000 || len(st.Entries) != 1 || st.Entries[0].BalanceAfter != 7500 {
+		t.Fatalf("statement opens at %s with %d entries, want 100.00 and one entry leaving 75.00", st.OpeningBalance, len(st.Entries))
+	}
+	if b := balanceOf(t, s, ids[0]); st.ClosingBalance != b {
+		t.Errorf("statement closes at %s, account holds %s", st.ClosingBalance, b)
+	}
+}
+
+// TestCopySeedAccounts loads accounts from CSV twice: the second run
+// renames the one whose displayName changed and leaves the other alone.
+func TestCopySeedAccounts(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	load := func(csv string) seedResult {
+		t.Helper()
+		accounts, err := parseSeedCSV(strings.NewReader(strings.ReplaceAll(csv, "$", suffix)))
+		if err == nil {
+			err = s.validateSeedAccounts(accounts)
+		}
+		if err != nil {
+			t.Fatalf("parse seed csv: %v", err)
+		}
+		res, err := s.copySeedAccounts(ctx, accounts)
+		if err != nil {
+			t.Fatalf("copy seed accounts: %v", err)
+		}
+		return res
+	}
+	res := load("id,displayName,balance\ncsv-a-$,First,10.00\ncsv-b-$,Second,0\n")
+	if len(res.Created) != 2 {
+		t.Fatalf("first load created %v, want both", res.Created)
+	}
+	res = load("id,displayName,balance\ncsv-a-$,First,99.00\ncsv-b-$,Renamed,0\n")
+	if len(res.Created) != 0 || len(res.Updated) != 1 || len(res.Existing) != 1 {
+		t.Fatalf("second load: %+v, want one renamed and one untouched", res)
+	}
+	if b := balanceOf(t, s, "csv-a-"+suffix); b != 1000 {
+		t.Errorf("reloaded account holds %s, want its original 10.00", b)
+	}
+}
+
+// TestTransferReceivedWebhook subscribes the payee's account and checks
+// that a transfer queues it a transfer.received delivery without the
+// payer's fee or operation id.
+func TestTransferReceivedWebhook(t *testing.T) {
+	s := integrationStore(t)
+	s.webhooks = true
+	ctx := context.Background()
+	ids := openAccounts(t, s, 10000, "hook-from", "hook-to")
+	if _, err := s.pool.Exec(ctx, `
+		INSERT INTO webhook_subscriptions (tenant_id, url, events, account_id, created_by)
+		SELECT tenant_id, 'https://payee.example/hooks', ARRAY['transfer.received'], id, 'integration-test' FROM accounts WHERE id=$1`,
+		ids[1]); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	req := TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 1200, OperationID: "hook-op-" + ids[0]}
+	if _, _, err := s.transfer(ctx, req); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	var payload map[string]any
+	if err := s.pool.QueryRow(ctx, "SELECT payload FROM webhook_deliveries WHERE account_id=$1 AND event_type=$2",
+		ids[1], webhookTransferReceived).Scan(&payload); err != nil {
+		t.Fatalf("load delivery: %v", err)
+	}
+	if _, ok := payload["operationId"]; ok || payload["toAccountId"] != ids[1] {
+		t.Errorf("payee payload %v, want the credit to %s without the payer's operation id", payload, ids[1])
+	}
+}
+
+// TestBalanceAdjustment debits an account through an adjustment: the audit
+// row records both balances, the ledger still explains the balance, and a
+// retry under the operation id books nothing more.
+func TestBalanceAdjustment(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	ids := openAccounts(t, s, 10000, "adjust")
+	req := adjustBalanceRequest{Amount: -2500, Actor: "ops@example.com", Reason: "duplicate deposit", OperationID: "adjust-" + ids[0]}
+	a, status, err := s.adjustBalance(ctx, ids[0], req)
+	if err != nil || status != http.StatusCreated {
+		t.Fatalf("adjust: status %d, %v", status, err)
+	}
+	if a.BalanceBefore != 10000 || a.BalanceAfter != 7500 {
+		t.Errorf("adjustment moved %s to %s, want 100.00 to 75.00", a.BalanceBefore, a.BalanceAfter)
+	}
+	if _, status, err := s.adjustBalance(ctx, ids[0], req); err != nil || status != http.StatusOK {
+		t.Fatalf("retry: status %d, %v", status, err)
+	}
+	var ledgered Money
+	if err := s.pool.QueryRow(ctx, `
+		SELECT a.opening_balance + COALESCE(sum(CASE l.type WHEN 'CREDIT' THEN l.amount ELSE -l.amount END), 0)
+		FROM accounts a LEFT JOIN ledger l ON l.account_id = a.id WHERE a.id=$1 GROUP BY a.opening_balance`, ids[0]).Scan(&ledgered); err != nil {
+		t.Fatalf("ledger balance: %v", err)
+	}
+	if b := balanceOf(t, s, ids[0]); b != 7500 || ledgered != b {
+		t.Errorf("balance %s, ledger gives %s; want 75.00 for both", b, ledgered)
+	}
+}
+
+// TestCrossTenantTransfer refuses a transfer out of another tenant's
+// account, and a deposit into one, for credentials bound to a tenant.
+func TestCrossTenantTransfer(t *testing.T) {
+	s := integrationStore(t)
+	ids := openAccounts(t, s, 10000, "tenant-a", "tenant-b")
+	if _, err := s.pool.Exec(context.Background(), "UPDATE accounts SET tenant_id=CASE id WHEN $1 THEN 'tenant-a' ELSE 'tenant-b' END WHERE id = ANY($2)",
+		ids[0], ids); err != nil {
+		t.Fatalf("assign tenants: %v", err)
+	}
+	ctx := context.WithValue(context.Background(), principalKey, &principal{Client: "a", Tenant: "tenant-a", Scopes: []string{scopeTransfers}})
+	for _, req := range []TransferRequest{
+		{FromAccountID: ids[1], ToAccountID: ids[0], Amount: 100},
+		{FromAccountID: settlementAccountID, ToAccountID: ids[1], Amount: 100},
+	} {
+		_, status, err := s.transfer(ctx, req)
+		if status != http.StatusForbidden || !errors.Is(err, errOtherTenant) {
+			t.Errorf("%s -> %s: got status %d, %v; want %d, %v", req.FromAccountID, req.ToAccountID, status, err, http.StatusForbidden, errOtherTenant)
+		}
+	}
+	if _, _, err := s.transfer(ctx, TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 100}); err != nil {
+		t.Fatalf("transfer out of the tenant's own account: %v", err)
+	}
+	if b := balanceOf(t, s, ids[1]); b != 10100 {
+		t.Errorf("tenant-b account holds %s, want 101.00", b)
+	}
+}
+
+// postAs runs handler on a POST of body sent with p's credentials, id
+// being the {id} path value.
+func postAs(t *testing.T, p *principal, handler http.HandlerFunc, id string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("encode body: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+	r = r.WithContext(context.WithValue(r.Context(), principalKey, p))
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// TestSystemFlowsAcrossTenants runs the flows that book between system
+// accounts and customer accounts on the service's behalf with credentials
+// of an unrelated tenant: none of them may be refused for the tenant.
+func TestSystemFlowsAcrossTenants(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	ids := openAccounts(t, s, 10000, "sysflow-a", "sysflow-b")
+	if _, err := s.pool.Exec(ctx, "UPDATE accounts SET tenant_id='tenant-a' WHERE id = ANY($1)", ids); err != nil {
+		t.Fatalf("assign tenant: %v", err)
+	}
+	ops := &principal{Client: "ops", Tenant: "ops-tenant", Scopes: []string{scopeTransfers}}
+
+	t.Run("unmatched inbound credit", func(t *testing.T) {
+		w := postAs(t, ops, s.handleInboundCredit, "", inboundCredit{Reference: "nobody-" + ids[0], Amount: 500, OperationID: "sysflow-in-" + ids[0]})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	})
+	t.Run("suspense return", func(t *testing.T) {
+		var item int64
+		if err := s.pool.QueryRow(ctx, "SELECT id FROM suspense_items WHERE operation_id=$1", "sysflow-in-"+ids[0]).Scan(&item); err != nil {
+			t.Fatalf("find suspense item: %v", err)
+		}
+		w := postAs(t, ops, s.handleReturnSuspense, strconv.FormatInt(item, 10), suspenseResolution{Actor: "ops@example.com"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	})
+	t.Run("payout return", func(t *testing.T) {
+		payout := TransferRequest{FromAccountID: ids[0], ToAccountID: settlementAccountID, Amount: 300}
+		if _, _, err := s.transfer(ctx, payout); err != nil {
+			t.Fatalf("payout: %v", err)
+		}
+		var id int64
+		if err := s.pool.QueryRow(ctx, "SELECT max(id) FROM transfers WHERE from_account_id=$1", ids[0]).Scan(&id); err != nil {
+			t.Fatalf("find payout: %v", err)
+		}
+		w := postAs(t, ops, s.handlePayoutReturn, strconv.FormatInt(id, 10), payoutReturnRequest{ReasonCode: "AC04"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	})
+	t.Run("approve case", func(t *testing.T) {
+		for _, tc := range []struct {
+			tenant string
+			want   int
+		}{
+			{"tenant-a", http.StatusOK},
+			{"tenant-b", http.StatusForbidden},
+		} {
+			req, _ := json.Marshal(TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 100})
+			details, _ := json.Marshal(map[string]any{"tenant": tc.tenant})
+			var id int64
+			if err := s.pool.QueryRow(ctx, `
+				INSERT INTO risk_cases (rule, decision, reason, account_id, client, details, request)
+				VALUES ('test', $1, 'held', $2, 'a', $3, $4) RETURNING id`, riskReview, ids[0], details, req).Scan(&id); err != nil {
+				t.Fatalf("open case: %v", err)
+			}
+			w := postAs(t, ops, s.handleApproveCase, strconv.FormatInt(id, 10), caseResolution{Actor: "ops@example.com"})
+			if w.Code != tc.want {
+				t.Errorf("case sent by %s: status %d, want %d: %s", tc.tenant, w.Code, tc.want, w.Body)
+			}
+		}
+	})
+}
+
+// TestAdjustmentNotCountedTowardDailyLimit debits an account by
+// adjustment up to its whole daily limit; the customer can still send the
+// full limit afterwards.
+func TestAdjustmentNotCountedTowardDailyLimit(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	ids := openAccounts(t, s, 10000, "adjlimit-from", "adjlimit-to")
+	if _, err := s.pool.Exec(ctx, "UPDATE accounts SET daily_limit=$2 WHERE id=$1", ids[0], Money(100)); err != nil {
+		t.Fatalf("set daily limit: %v", err)
+	}
+	if _, _, err := s.adjustBalance(ctx, ids[0], adjustBalanceRequest{Amount: -100, Actor: "ops@example.com", Reason: "duplicate deposit"}); err != nil {
+		t.Fatalf("adjust: %v", err)
+	}
+	if _, status, err := s.transfer(ctx, TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 100}); err != nil {
+		t.Fatalf("transfer after adjustment: status %d, %v", status, err)
+	}
+}
+
+// postBatch sends items to the batch endpoint and decodes a 200 answer into
+// out.
+func postBatch(t *testing.T, s *Store, query string, items []TransferRequest, out *batchResponse) (int, string) {
+	t.Helper()
+	body, err := json.Marshal(items)
+	if err != nil {
+		t.Fatalf("encode batch: %v", err)
+	}
+	w := httptest.NewRecorder()
+	s.handleBatchTransfers(w, httptest.NewRequest(http.MethodPost, "/transfers/batch"+query, bytes.NewReader(body)))
+	if w.Code == http.StatusOK && out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("decode batch response: %v", err)
+		}
+	}
+	return w.Code, w.Body.String()
+}
+
+// TestAtomicBatch runs a batch with ?atomic=true: a failing item rolls the
+// earlier ones back, a clean batch commits whole and replays on
+// resubmission, and reusing part of it in another batch is refused.
+func TestAtomicBatch(t *testing.T) {
+	s := integrationStore(t)
+	ids := openAccounts(t, s, 1000, "atomic-a", "atomic-b", "atomic-c")
+	a, b, c := ids[0], ids[1], ids[2]
+
+	failing := []TransferRequest{
+		{OperationID: a + "-1", FromAccountID: a, ToAccountID: b, Amount: 400},
+		{OperationID: a + "-2", FromAccountID: b, ToAccountID: c, Amount: 5000},
+	}
+	if status, body := postBatch(t, s, "?atomic=true", failing, nil); status != http.StatusBadRequest || !strings.Contains(body, "item 1: insufficient funds") {
+		t.Fatalf("failing batch: got %d %s, want %d naming item 1", status, body, http.StatusBadRequest)
+	}
+	for _, id := range ids {
+		if got := balanceOf(t, s, id); got != 1000 {
+			t.Fatalf("%s holds %s after a rolled back batch, want 10.00", id, got)
+		}
+	}
+
+	// the second item spends what the first one credits
+	clean := []TransferRequest{
+		{OperationID: a + "-3", FromAccountID: a, ToAccountID: b, Amount: 400},
+		{OperationID: a + "-4", FromAccountID: b, ToAccountID: c, Amount: 1400},
+	}
+	var first, replay batchResponse
+	if status, body := postBatch(t, s, "?atomic=true", clean, &first); status != http.StatusOK {
+		t.Fatalf("clean batch: got %d %s", status, body)
+	}
+	if status, body := postBatch(t, s, "?atomic=true", clean, &replay); status != http.StatusOK {
+		t.Fatalf("resubmitted batch: got %d %s", status, body)
+	}
+	if first.Succeeded != 2 || replay.Succeeded != 2 || string(first.Results[1].Response) != string(replay.Results[1].Response) {
+		t.Fatalf("batch answered %+v, replay %+v", first, replay)
+	}
+	for id, want := range map[string]Money{a: 600, b: 0, c: 2400} {
+		if got := balanceOf(t, s, id); got != want {
+			t.Errorf("%s holds %s, want %s", id, got, want)
+		}
+	}
+
+	mixed := []TransferRequest{clean[0], {OperationID: a + "-5", FromAccountID: c, ToAccountID: a, Amount: 100}}
+	if status, body := postBatch(t, s, "?atomic=true", mixed, nil); status != http.StatusConflict {
+		t.Fatalf("batch reusing an operationId: got %d %s, want %d", status, body, http.StatusConflict)
+	}
+
+	// an operation another request has in flight stops the batch, which
+	// leaves that request's journal entry alone
+	ctx := context.Background()
+	busy := TransferRequest{OperationID: a + "-6", FromAccountID: c, ToAccountID: a, Amount: 100}
+	if _, err := s.journalReceive(ctx, busy); err != nil {
+		t.Fatalf("journal the in-flight operation: %v", err)
+	}
+	racing := []TransferRequest{{OperationID: a + "-7", FromAccountID: c, ToAccountID: b, Amount: 100}, busy}
+	if status, body := postBatch(t, s, "?atomic=true", racing, nil); status != http.StatusConflict {
+		t.Fatalf("batch with an operation in flight: got %d %s, want %d", status, body, http.StatusConflict)
+	}
+	for id, want := range map[string]string{racing[0].OperationID: journalFailed, busy.OperationID: journalReceived} {
+		var state string
+		if err := s.pool.QueryRow(ctx, "SELECT state FROM op_journal WHERE operation_id=$1", id).Scan(&state); err != nil {
+			t.Fatalf("journal state of %s: %v", id, err)
+		}
+		if state != want {
+			t.Errorf("%s is %s, want %s", id, state, want)
+		}
+	}
+}
+
+// TestStoreTransfer runs transfers through store.Store: documented
+// refusals keep their errors, other ones become InvalidError.
+func TestStoreTransfer(t *testing.T) {
+	s := integrationStore(t)
+	ctx := context.Background()
+	ids := openAccounts(t, s, 1000, "iface-from", "iface-to")
+	if _, err := s.pool.Exec(ctx, "UPDATE accounts SET daily_limit=$2 WHERE id=$1", ids[0], Money(600)); err != nil {
+		t.Fatalf("set daily limit: %v", err)
+	}
+	var st store.Store = s
+
+	res, err := st.Transfer(ctx, store.Transfer{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 500})
+	if err != nil || res.Balances[ids[0]] != 500 {
+		t.Fatalf("transfer = %+v, %v; want the sender at 5.00", res, err)
+	}
+	if _, err := st.Transfer(ctx, store.Transfer{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 501}); !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Errorf("overdrawing transfer: %v, want %v", err, store.ErrInsufficientFunds)
+	}
+	var invalid store.InvalidError
+	if _, err := st.Transfer(ctx, store.Transfer{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 200}); !errors.As(err, &invalid) {
+		t.Errorf("transfer past the daily limit: %v, want an InvalidError", err)
+	}
+	if _, err := st.Transfer(ctx, store.Transfer{FromAccountID: settlementAccountID, ToAccountID: ids[1], Amount: 1}); !errors.As(err, &invalid) {
+		t.Errorf("transfer from a system account: %v, want an InvalidError", err)
+	}
+}
@@ -0,0 +1,357 @@
+// Package api holds the HTTP handlers that only need a store.Store:
+// accounts, statements, operations and plain transfers. Transfers with FX
+// or quotes, batches, holds and the admin endpoints still live in package
+// main, on the Postgres store, which serves POST /transfer through its own
+// handler for that reason.
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"fintech-go/internal/ledger"
+	"fintech-go/internal/store"
+)
+
+// Handler serves the endpoints below from Store. The hooks tie it to the
+// rest of the server.
+type Handler struct {
+	Store store.Store
+	// Currency is the one accounts open in when the request names none.
+	Currency string
+	// Tenant is the tenant a request acts for, and whether its credentials
+	// bind it to that tenant.
+	Tenant func(r *http.Request) (tenant string, bound bool)
+	// Error writes a 4xx error body.
+	Error func(w http.ResponseWriter, status int, msg string)
+	// Path turns an unversioned path into the one clients should follow,
+	// for Location headers.
+	Path func(ctx context.Context, path string) string
+}
+
+type CreateAccountRequest struct {
+	ID       string `json:"id"`
+	TenantID string `json:"tenantId"`
+	// DisplayName is what the other side of a transfer sees on statements.
+	DisplayName string `json:"displayName"`
+	// Currency defaults to the service currency and cannot change later.
+	Currency string `json:"currency"`
+}
+
+// CreateAccount opens an account with a zero balance. Funds only ever
+// arrive through ledgered movements, never as an opening balance.
+func (h *Handler) CreateAccount(w http.ResponseWriter, r *http.Request) {
+	var req CreateAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" {
+		req.ID = newAccountID()
+	}
+	if !store.AccountIDPattern.MatchString(req.ID) {
+		h.Error(w, http.StatusBadRequest, "id must be 1-64 letters, digits, '-' or '_'")
+		return
+	}
+	tenant, bound := h.Tenant(r)
+	if bound && req.TenantID != "" && req.TenantID != tenant {
+		h.Error(w, http.StatusForbidden, "cannot open accounts for another tenant")
+		return
+	}
+	if req.TenantID == "" {
+		req.TenantID = tenant
+	}
+	if len(req.DisplayName) > 128 {
+		h.Error(w, http.StatusBadRequest, "displayName must be at most 128 characters")
+		return
+	}
+	req.Currency = strings.ToUpper(req.Currency)
+	if req.Currency == "" {
+		req.Currency = h.Currency
+	}
+
+	a, err := h.Store.CreateAccount(r.Context(), store.NewAccount{ID: req.ID, TenantID: req.TenantID,
+		DisplayName: req.DisplayName, Currency: req.Currency})
+	var invalid store.InvalidError
+	switch {
+	case errors.As(err, &invalid):
+		h.Error(w, http.StatusBadRequest, invalid.Error())
+		return
+	case errors.Is(err, store.ErrAccountExists):
+		h.Error(w, http.StatusConflict, "account already exists")
+		return
+	case err != nil:
+		http.Error(w, "failed to create account", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", h.Path(r.Context(), "/accounts/"+a.ID))
+	writeJSON(w, http.StatusCreated, a)
+}
+
+func newAccountID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return "acc_" + hex.EncodeToString(b)
+}
+
+// ListAccounts pages through accounts in id order. The cursor is the last
+// id of the previous page. Credentials bound to a tenant list that
+// tenant's accounts only.
+func (h *Handler) ListAccounts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	tenantID := q.Get("tenantId")
+	if tenant, bound := h.Tenant(r); bound {
+		if tenantID != "" && tenantID != tenant {
+			h.Error(w, http.StatusForbidden, "cannot list accounts of another tenant")
+			return
+		}
+		tenantID = tenant
+	}
+	page, err := h.Store.ListAccounts(r.Context(), store.AccountQuery{TenantID: tenantID, Status: q.Get("status"),
+		Cursor: q.Get("cursor"), Limit: limit})
+	if err != nil {
+		http.Error(w, "failed to load accounts", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (h *Handler) GetAccount(w http.ResponseWriter, r *http.Request) {
+	a, ok := h.account(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// account loads the account in the path for a caller allowed to see it.
+// It writes the error response itself and reports whether to go on.
+func (h *Handler) account(w http.ResponseWriter, r *http.Request) (store.Account, bool) {
+	a, err := h.Store.Account(r.Context(), r.PathValue("id"))
+	if errors.Is(err, store.ErrAccountNotFound) {
+		h.Error(w, http.StatusNotFound, "account not found")
+		return store.Account{}, false
+	}
+	if err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return store.Account{}, false
+	}
+	if tenant, bound := h.Tenant(r); bound && a.TenantID != tenant {
+		h.Error(w, http.StatusForbidden, store.ErrOtherTenant.Error())
+		return store.Account{}, false
+	}
+	return a, true
+}
+
+// MaxBatchGetIDs is how many accounts one batchGet may ask for.
+const MaxBatchGetIDs = 500
+
+type BatchGetAccountsRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// BatchGetAccountsResponse lists the accounts found in request order and
+// the ids that were not.
+type BatchGetAccountsResponse struct {
+	Accounts []store.Account `json:"accounts"`
+	NotFound []string        `json:"notFound"`
+}
+
+// BatchGetAccounts reads up to MaxBatchGetIDs accounts in one call, for
+// dashboards that would otherwise fan out a GET per account. Repeated ids
+// are answered once. Credentials bound to a tenant get that tenant's
+// accounts only; the rest are reported as not found.
+func (h *Handler) BatchGetAccounts(w http.ResponseWriter, r *http.Request) {
+	var req BatchGetAccountsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 {
+		h.Error(w, http.StatusBadRequest, "ids is required")
+		return
+	}
+	if len(req.IDs) > MaxBatchGetIDs {
+		h.Error(w, http.StatusBadRequest, "at most "+strconv.Itoa(MaxBatchGetIDs)+" ids per call")
+		return
+	}
+	accounts, err := h.Store.Accounts(r.Context(), req.IDs)
+	if err != nil {
+		http.Error(w, "failed to load accounts", http.StatusInternalServerError)
+		return
+	}
+	tenant, bound := h.Tenant(r)
+	byID := make(map[string]store.Account, len(accounts))
+	for _, a := range accounts {
+		if !bound || a.TenantID == tenant {
+			byID[a.ID] = a
+		}
+	}
+	resp := BatchGetAccountsResponse{Accounts: make([]store.Account, 0, len(byID)), NotFound: make([]string, 0)}
+	seen := make(map[string]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if a, ok := byID[id]; ok {
+			resp.Accounts = append(resp.Accounts, a)
+		} else {
+			resp.NotFound = append(resp.NotFound, id)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AccountTransactions pages through an account's ledger rows newest first.
+// from is inclusive and to exclusive, both RFC 3339. Every page of one
+// statement reads as of the same instant; the cursor carries the bound.
+func (h *Handler) AccountTransactions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sq := store.StatementQuery{Type: q.Get("type"), Cursor: q.Get("cursor")}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &sq.From}, {"to", &sq.To}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			h.Error(w, http.StatusBadRequest, p.name+" must be an RFC 3339 timestamp")
+			return
+		}
+		*p.dst = t
+	}
+	sq.Limit, _ = strconv.Atoi(q.Get("limit"))
+	if _, bound := h.Tenant(r); bound {
+		if _, ok := h.account(w, r); !ok {
+			return
+		}
+	}
+
+	page, err := h.Store.Statement(r.Context(), r.PathValue("id"), sq)
+	var invalid store.InvalidError
+	switch {
+	case errors.As(err, &invalid):
+		h.Error(w, http.StatusBadRequest, invalid.Error())
+		return
+	case errors.Is(err, store.ErrAccountNotFound):
+		h.Error(w, http.StatusNotFound, "account not found")
+		return
+	case err != nil:
+		http.Error(w, "failed to load transactions", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, TransactionPage{Transactions: page.Transactions, AsOf: strconv.FormatInt(page.AsOf, 10),
+		Balance: page.Balance, NextCursor: page.NextCursor})
+}
+
+// TransferRequest is a transfer as clients send it. FX rates and quotes
+// are refused here: they need the Postgres server's own handler.
+type TransferRequest struct {
+	store.Transfer
+	FxRate  json.RawMessage `json:"fxRate,omitempty"`
+	QuoteID string          `json:"quoteId,omitempty"`
+}
+
+// Transfer moves money between two accounts. Credentials bound to a tenant
+// may only debit that tenant's accounts. A transfer held for review is
+// answered with 202 and its case.
+func (h *Handler) Transfer(w http.ResponseWriter, r *http.Request) {
+	var req TransferRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	switch {
+	case errors.Is(err, ledger.ErrTooPrecise):
+		h.Error(w, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	t := req.Transfer
+	var msg string
+	switch {
+	case t.FromAccountID == "" || t.ToAccountID == "":
+		msg = "fromAccountId and toAccountId are required"
+	case t.FromAccountID == t.ToAccountID:
+		msg = "fromAccountId and toAccountId must differ"
+	case t.Amount <= 0:
+		msg = "amount must be > 0"
+	case req.FxRate != nil || req.QuoteID != "":
+		msg = "fxRate and quoteId are not supported by this server"
+	}
+	if msg != "" {
+		h.Error(w, http.StatusBadRequest, msg)
+		return
+	}
+	if tenant, bound := h.Tenant(r); bound {
+		t.TenantID = tenant
+	}
+
+	res, err := h.Store.Transfer(r.Context(), t)
+	var invalid store.InvalidError
+	switch {
+	case errors.As(err, &invalid), errors.Is(err, store.ErrAccountNotFound), errors.Is(err, store.ErrAccountFrozen),
+		errors.Is(err, store.ErrAccountClosed), errors.Is(err, store.ErrLimitExceeded), errors.Is(err, store.ErrInsufficientFunds):
+		h.Error(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, store.ErrOtherTenant), errors.Is(err, store.ErrBlockedByRule):
+		h.Error(w, http.StatusForbidden, err.Error())
+		return
+	case errors.Is(err, store.ErrOperationInFlight):
+		w.Header().Set("Location", h.Path(r.Context(), "/operations/"+url.PathEscape(t.OperationID)))
+		h.Error(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		http.Error(w, "failed to transfer", http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusOK
+	if res.Status == store.TransferPendingReview {
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, res)
+}
+
+// TransactionPage is a statement page as the HTTP API sends it.
+type TransactionPage struct {
+	Transactions []ledger.Transaction `json:"transactions"`
+	AsOf         string               `json:"asOf"`
+	Balance      *ledger.Money        `json:"balance,omitempty"`
+	NextCursor   string               `json:"nextCursor,omitempty"`
+}
+
+// Operation exposes the journal entry for an operation; it is the Location
+// given to clients that hit an in-flight duplicate.
+func (h *Handler) Operation(w http.ResponseWriter, r *http.Request) {
+	op, err := h.Store.Operation(r.Context(), r.PathValue("id"))
+	if errors.Is(err, store.ErrOperationNotFound) {
+		h.Error(w, http.StatusNotFound, "operation not found")
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load operation", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, op)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
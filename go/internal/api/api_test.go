@@ -0,0 +1,213 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"fintech-go/internal/store"
+)
+
+// tenantHeader stands in for authentication in these tests: a request
+// carrying it acts for that tenant with credentials bound to it.
+const tenantHeader = "X-Test-Tenant"
+
+// newTestServer serves the handlers from st the way the server mounts
+// them, minus auth and versioning.
+func newTestServer(t *testing.T, st store.Store) *httptest.Server {
+	t.Helper()
+	h := &Handler{
+		Store:    st,
+		Currency: "BRL",
+		Tenant: func(r *http.Request) (string, bool) {
+			if v := r.Header.Get(tenantHeader); v != "" {
+				return v, true
+			}
+			return "default", false
+		},
+		Error: func(w http.ResponseWriter, status int, msg string) {
+			writeJSON(w, status, map[string]string{"status": "error", "message": msg})
+		},
+		Path: func(ctx context.Context, path string) string { return path },
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /accounts", h.CreateAccount)
+	mux.HandleFunc("GET /accounts", h.ListAccounts)
+	mux.HandleFunc("GET /accounts/{id}", h.GetAccount)
+	mux.HandleFunc("POST /accounts:batchGet", h.BatchGetAccounts)
+	mux.HandleFunc("GET /accounts/{id}/transactions", h.AccountTransactions)
+	mux.HandleFunc("GET /operations/{id}", h.Operation)
+	mux.HandleFunc("POST /transfer", h.Transfer)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// call sends a request as tenant ("" for none) and decodes the JSON
+// response into out when given.
+func call(t *testing.T, srv *httptest.Server, method, path, tenant, body string, out any) int {
+	t.Helper()
+	status, _ := callHeader(t, srv, method, path, tenant, body, out)
+	return status
+}
+
+// callHeader is call returning the response headers as well.
+func callHeader(t *testing.T, srv *httptest.Server, method, path, tenant, body string, out any) (int, http.Header) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	if tenant != "" {
+		req.Header.Set(tenantHeader, tenant)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decode response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode, resp.Header
+}
+
+func TestTenantScoping(t *testing.T) {
+	mem := store.NewMemory()
+	mem.PutAccount(store.Account{ID: "a1", TenantID: "t1", Currency: "BRL", Status: store.AccountActive})
+	mem.PutAccount(store.Account{ID: "b1", TenantID: "t2", Currency: "BRL", Status: store.AccountActive})
+	srv := newTestServer(t, mem)
+
+	tests := []struct {
+		name, method, path, tenant, body string
+		want                             int
+	}{
+		{"own account", "GET", "/accounts/a1", "t1", "", http.StatusOK},
+		{"other tenant's account", "GET", "/accounts/b1", "t1", "", http.StatusForbidden},
+		{"unbound caller", "GET", "/accounts/b1", "", "", http.StatusOK},
+		{"unknown account", "GET", "/accounts/zz", "t1", "", http.StatusNotFound},
+		{"own transactions", "GET", "/accounts/a1/transactions", "t1", "", http.StatusOK},
+		{"other tenant's transactions", "GET", "/accounts/b1/transactions", "t1", "", http.StatusForbidden},
+		{"list another tenant", "GET", "/accounts?tenantId=t2", "t1", "", http.StatusForbidden},
+		{"open for another tenant", "POST", "/accounts", "t1", `{"id":"c1","tenantId":"t2"}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := call(t, srv, tt.method, tt.path, tt.tenant, tt.body, nil); got != tt.want {
+			t.Errorf("%s: %s %s got %d, want %d", tt.name, tt.method, tt.path, got, tt.want)
+		}
+	}
+
+	var page store.AccountPage
+	if status := call(t, srv, "GET", "/accounts", "t1", "", &page); status != http.StatusOK {
+		t.Fatalf("list: status %d", status)
+	}
+	if len(page.Accounts) != 1 || page.Accounts[0].ID != "a1" {
+		t.Errorf("bound list returned %+v, want only a1", page.Accounts)
+	}
+	if call(t, srv, "GET", "/accounts", "", "", &page); len(page.Accounts) != 2 {
+		t.Errorf("unbound list returned %d accounts, want 2", len(page.Accounts))
+	}
+
+	var batch BatchGetAccountsResponse
+	call(t, srv, "POST", "/accounts:batchGet", "t1", `{"ids":["b1","a1","a1"]}`, &batch)
+	if len(batch.Accounts) != 1 || batch.Accounts[0].ID != "a1" || len(batch.NotFound) != 1 || batch.NotFound[0] != "b1" {
+		t.Errorf("batchGet returned %+v, want a1 found and b1 not", batch)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	mem := store.NewMemory()
+	mem.PutAccount(store.Account{ID: "a1", TenantID: "t1", Currency: "BRL", Status: store.AccountActive, Balance: 10000})
+	mem.PutAccount(store.Account{ID: "a2", TenantID: "t1", Currency: "BRL", Status: store.AccountActive})
+	mem.PutAccount(store.Account{ID: "b1", TenantID: "t2", Currency: "BRL", Status: store.AccountActive, Balance: 10000})
+	mem.PutAccount(store.Account{ID: "frozen", TenantID: "t1", Currency: "BRL", Status: store.AccountFrozen, Balance: 10000})
+	srv := newTestServer(t, mem)
+
+	tests := []struct {
+		name, tenant, body string
+		want               int
+	}{
+		{"to own account", "t1", `{"fromAccountId":"a1","toAccountId":"a2","amount":"10.00"}`, http.StatusOK},
+		{"to another tenant", "t1", `{"fromAccountId":"a1","toAccountId":"b1","amount":1}`, http.StatusOK},
+		{"from another tenant", "t1", `{"fromAccountId":"b1","toAccountId":"a1","amount":1}`, http.StatusForbidden},
+		{"unbound caller", "", `{"fromAccountId":"b1","toAccountId":"a1","amount":1}`, http.StatusOK},
+		{"insufficient funds", "t1", `{"fromAccountId":"a1","toAccountId":"a2","amount":1000}`, http.StatusBadRequest},
+		{"frozen sender", "t1", `{"fromAccountId":"frozen","toAccountId":"a2","amount":1}`, http.StatusBadRequest},
+		{"unknown account", "t1", `{"fromAccountId":"a1","toAccountId":"zz","amount":1}`, http.StatusBadRequest},
+		{"same account", "t1", `{"fromAccountId":"a1","toAccountId":"a1","amount":1}`, http.StatusBadRequest},
+		{"zero amount", "t1", `{"fromAccountId":"a1","toAccountId":"a2","amount":0}`, http.StatusBadRequest},
+		{"too precise", "t1", `{"fromAccountId":"a1","toAccountId":"a2","amount":"0.001"}`, http.StatusBadRequest},
+		{"quote", "t1", `{"fromAccountId":"a1","toAccountId":"a2","amount":1,"quoteId":"q1"}`, http.StatusBadRequest},
+		{"fx rate", "t1", `{"fromAccountId":"a1","toAccountId":"a2","amount":1,"fxRate":{"rate":"5"}}`, http.StatusBadRequest},
+		{"invalid json", "t1", `{"fromAccountId":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if got := call(t, srv, "POST", "/transfer", tt.tenant, tt.body, nil); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	body := `{"operationId":"op-1","fromAccountId":"a2","toAccountId":"a1","amount":"2.50"}`
+	var first, replay store.TransferResult
+	if status := call(t, srv, "POST", "/transfer", "t1", body, &first); status != http.StatusOK {
+		t.Fatalf("transfer: status %d", status)
+	}
+	if status := call(t, srv, "POST", "/transfer", "t1", body, &replay); status != http.StatusOK {
+		t.Fatalf("replay: status %d", status)
+	}
+	if first.Status != "ok" || first.Balances["a2"] != 750 || replay.Balances["a2"] != 750 {
+		t.Errorf("transfer answered %+v and its replay %+v; want a2 at 7.50 in both", first, replay)
+	}
+	var op store.Operation
+	if status := call(t, srv, "GET", "/operations/op-1", "t1", "", &op); status != http.StatusOK || op.State != "committed" {
+		t.Errorf("operation: status %d, %+v", status, op)
+	}
+	var page TransactionPage
+	call(t, srv, "GET", "/accounts/a2/transactions", "t1", "", &page)
+	if len(page.Transactions) != 2 || page.Transactions[0].Type != "DEBIT" || page.Balance == nil || *page.Balance != 750 {
+		t.Errorf("a2 statement = %+v; want a debit over a credit and 7.50", page)
+	}
+}
+
+// failingStore answers every transfer with res and err.
+type failingStore struct {
+	*store.Memory
+	res store.TransferResult
+	err error
+}
+
+func (s failingStore) Transfer(ctx context.Context, t store.Transfer) (store.TransferResult, error) {
+	return s.res, s.err
+}
+
+// TestTransferOutcomes covers what only the Postgres store answers: review,
+// risk blocks, operations in flight and internal failures.
+func TestTransferOutcomes(t *testing.T) {
+	tests := []struct {
+		name     string
+		res      store.TransferResult
+		err      error
+		want     int
+		location string
+	}{
+		{"held for review", store.TransferResult{Status: store.TransferPendingReview, CaseID: 7}, nil, http.StatusAccepted, ""},
+		{"blocked", store.TransferResult{}, fmt.Errorf("%w: velocity", store.ErrBlockedByRule), http.StatusForbidden, ""},
+		{"in flight", store.TransferResult{}, store.ErrOperationInFlight, http.StatusConflict, "/operations/op%2F1"},
+		{"daily limit", store.TransferResult{}, store.InvalidError("amount exceeds account daily transfer limit"), http.StatusBadRequest, ""},
+		{"internal", store.TransferResult{}, errors.New("connection reset"), http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		srv := newTestServer(t, failingStore{Memory: store.NewMemory(), res: tt.res, err: tt.err})
+		status, header := callHeader(t, srv, "POST", "/transfer", "", `{"operationId":"op/1","fromAccountId":"a","toAccountId":"b","amount":1}`, nil)
+		if status != tt.want || header.Get("Location") != tt.location {
+			t.Errorf("%s: got %d with Location %q, want %d with %q", tt.name, status, header.Get("Location"), tt.want, tt.location)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package ledger
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Currency is an ISO 4217 currency. Exponent is its number of minor-unit
+// decimals (2 for BRL, 0 for JPY, 3 for KWD). CashIncrement is the smallest
+// amount payable in notes and coins, in the currency's own minor units,
+// for currencies whose coins stop short of the minor unit: 5 for CHF,
+// whose smallest coin is 0.05. It is 1 for the rest.
+//
+// Money holds every currency at the service currency's exponent, so the
+// methods below relate a currency to it: on a BRL service one JPY is 100
+// minor units and KWD cannot be held at all.
+type Currency struct {
+	Code          string
+	Numeric       string
+	Exponent      int
+	CashIncrement int64
+}
+
+// currencies is the registry. Rounding is half-to-even for accounting
+// (FX conversion, fees, amounts read back from NUMERIC) and half away from
+// zero for cash, as tills round.
+var currencies = func() map[string]Currency {
+	m := map[string]Currency{}
+	for _, c := range []Currency{
+		{"AED", "784", 2, 1}, {"ARS", "032", 2, 1}, {"AUD", "036", 2, 5}, {"BGN", "975", 2, 1},
+		{"BHD", "048", 3, 1}, {"BIF", "108", 0, 1}, {"BRL", "986", 2, 1}, {"CAD", "124", 2, 5},
+		{"CHF", "756", 2, 5}, {"CLF", "990", 4, 1}, {"CLP", "152", 0, 1}, {"CNY", "156", 2, 1},
+		{"COP", "170", 2, 1}, {"CZK", "203", 2, 100}, {"DJF", "262", 0, 1}, {"DKK", "208", 2, 50},
+		{"EGP", "818", 2, 1}, {"EUR", "978", 2, 1}, {"GBP", "826", 2, 1}, {"GNF", "324", 0, 1},
+		{"HKD", "344", 2, 1}, {"HUF", "348", 2, 500}, {"IDR", "360", 2, 1}, {"ILS", "376", 2, 1},
+		{"INR", "356", 2, 1}, {"IQD", "368", 3, 1}, {"ISK", "352", 0, 1}, {"JOD", "400", 3, 1},
+		{"JPY", "392", 0, 1}, {"KMF", "174", 0, 1}, {"KRW", "410", 0, 1}, {"KWD", "414", 3, 1},
+		{"LYD", "434", 3, 1}, {"MAD", "504", 2, 1}, {"MXN", "484", 2, 1}, {"MYR", "458", 2, 1},
+		{"NGN", "566", 2, 1}, {"NOK", "578", 2, 100}, {"NZD", "554", 2, 10}, {"OMR", "512", 3, 1},
+		{"PEN", "604", 2, 1}, {"PHP", "608", 2, 1}, {"PKR", "586", 2, 1}, {"PLN", "985", 2, 1},
+		{"PYG", "600", 0, 1}, {"RON", "946", 2, 1}, {"RWF", "646", 0, 1}, {"SAR", "682", 2, 1},
+		{"SEK", "752", 2, 100}, {"SGD", "702", 2, 1}, {"THB", "764", 2, 1}, {"TND", "788", 3, 1},
+		{"TRY", "949", 2, 1}, {"TWD", "901", 2, 1}, {"UAH", "980", 2, 1}, {"UGX", "800", 0, 1},
+		{"USD", "840", 2, 1}, {"UYI", "940", 0, 1}, {"UYU", "858", 2, 1}, {"UYW", "927", 4, 1},
+		{"VND", "704", 0, 1}, {"VUV", "548", 0, 1}, {"XAF", "950", 0, 1}, {"XOF", "952", 0, 1},
+		{"XPF", "953", 0, 1}, {"ZAR", "710", 2, 1},
+	} {
+		m[c.Code] = c
+	}
+	return m
+}()
+
+// LookupCurrency returns the registry entry for an upper-case code.
+func LookupCurrency(code string) (Currency, bool) {
+	c, ok := currencies[code]
+	return c, ok
+}
+
+// Unit is the smallest amount of c in Money minor units: 1 for the service
+// currency, 100 for JPY on a BRL service.
+func (c Currency) Unit() (Money, error) {
+	if c.Exponent > exponent {
+		return 0, fmt.Errorf("%s has more decimals than the service currency %s", c.Code, service.Code)
+	}
+	unit := Money(1)
+	for i := c.Exponent; i < exponent; i++ {
+		unit *= 10
+	}
+	return unit, nil
+}
+
+// CashUnit is the smallest cash amount of c in Money minor units.
+func (c Currency) CashUnit() (Money, error) {
+	unit, err := c.Unit()
+	return unit * Money(c.CashIncrement), err
+}
+
+// Round rounds num/den minor units half-to-even to a whole unit of c.
+func (c Currency) Round(num, den *big.Int) (Money, error) {
+	unit, err := c.Unit()
+	if err != nil {
+		return 0, err
+	}
+	q := RoundHalfEven(num, new(big.Int).Mul(den, big.NewInt(int64(unit))))
+	q.Mul(q, big.NewInt(int64(unit)))
+	if !q.IsInt64() {
+		return 0, fmt.Errorf("amount out of range")
+	}
+	return Money(q.Int64()), nil
+}
+
+// CashRound rounds m half away from zero to the nearest cash amount of c.
+func (c Currency) CashRound(m Money) (Money, error) {
+	unit, err := c.CashUnit()
+	if err != nil {
+		return 0, err
+	}
+	q, r := m/unit, m%unit
+	switch {
+	case 2*r >= unit:
+		q++
+	case 2*r <= -unit:
+		q--
+	}
+	return q * unit, nil
+}
+
+// Format renders m with c's own decimals, e.g. "1500" for JPY where
+// String gives "1500.00" on a BRL service. Digits finer than c are rounded
+// away half-to-even.
+func (c Currency) Format(m Money) string {
+	if c.Exponent >= exponent {
+		v := int64(m)
+		for i := exponent; i < c.Exponent; i++ {
+			v *= 10
+		}
+		return formatMinor(v, c.Exponent)
+	}
+	unit, _ := c.Unit()
+	q := RoundHalfEven(big.NewInt(int64(m)), big.NewInt(int64(unit)))
+	return formatMinor(q.Int64(), c.Exponent)
+}
@@ -0,0 +1,141 @@
+package ledger
+
+import (
+	"math/big"
+	"testing"
+)
+
+// The tests below run on the default service currency, BRL with two
+// decimals.
+
+func TestLookupCurrency(t *testing.T) {
+	tests := []struct {
+		code     string
+		ok       bool
+		numeric  string
+		exponent int
+	}{
+		{"BRL", true, "986", 2},
+		{"JPY", true, "392", 0},
+		{"KWD", true, "414", 3},
+		{"CLF", true, "990", 4},
+		{"brl", false, "", 0},
+		{"XXX", false, "", 0},
+		{"", false, "", 0},
+	}
+	for _, tt := range tests {
+		c, ok := LookupCurrency(tt.code)
+		if ok != tt.ok || c.Numeric != tt.numeric || c.Exponent != tt.exponent {
+			t.Errorf("LookupCurrency(%q) = %+v, %t; want numeric %q, exponent %d, %t", tt.code, c, ok, tt.numeric, tt.exponent, tt.ok)
+		}
+	}
+}
+
+func TestCurrencyUnit(t *testing.T) {
+	tests := []struct {
+		code     string
+		unit     Money
+		cashUnit Money
+		ok       bool
+	}{
+		{"BRL", 1, 1, true},
+		{"CHF", 1, 5, true},
+		{"SEK", 1, 100, true},
+		{"JPY", 100, 100, true},
+		{"KWD", 0, 0, false},
+		{"CLF", 0, 0, false},
+	}
+	for _, tt := range tests {
+		c, _ := LookupCurrency(tt.code)
+		unit, err := c.Unit()
+		cashUnit, cashErr := c.CashUnit()
+		if !tt.ok {
+			if err == nil || cashErr == nil {
+				t.Errorf("%s: Unit() = %d, CashUnit() = %d; want errors", tt.code, unit, cashUnit)
+			}
+			continue
+		}
+		if err != nil || cashErr != nil || unit != tt.unit || cashUnit != tt.cashUnit {
+			t.Errorf("%s: Unit() = %d, %v, CashUnit() = %d, %v; want %d and %d", tt.code, unit, err, cashUnit, cashErr, tt.unit, tt.cashUnit)
+		}
+	}
+}
+
+func TestCurrencyRound(t *testing.T) {
+	tests := []struct {
+		code     string
+		num, den int64
+		want     Money
+	}{
+		{"BRL", 1005, 10, 100}, // 100.5 rounds to the even 100
+		{"BRL", 1015, 10, 102},
+		{"BRL", -1005, 10, -100},
+		{"BRL", -1015, 10, -102},
+		{"BRL", 1, 3, 0},
+		{"BRL", 2, 3, 1},
+		{"JPY", 150, 1, 200},
+		{"JPY", 250, 1, 200},
+		{"JPY", 249, 1, 200},
+		{"JPY", -150, 1, -200},
+	}
+	for _, tt := range tests {
+		c, _ := LookupCurrency(tt.code)
+		got, err := c.Round(big.NewInt(tt.num), big.NewInt(tt.den))
+		if err != nil || got != tt.want {
+			t.Errorf("%s.Round(%d/%d) = %d, %v; want %d", tt.code, tt.num, tt.den, got, err, tt.want)
+		}
+	}
+	kwd, _ := LookupCurrency("KWD")
+	if _, err := kwd.Round(big.NewInt(1), big.NewInt(1)); err == nil {
+		t.Error("KWD.Round on a BRL service succeeded; want an error")
+	}
+}
+
+func TestCurrencyCashRound(t *testing.T) {
+	tests := []struct {
+		code string
+		in   Money
+		want Money
+	}{
+		{"CHF", 1002, 1000},
+		{"CHF", 1003, 1005},
+		{"CHF", 1005, 1005},
+		{"CHF", -1002, -1000},
+		{"CHF", -1003, -1005},
+		{"JPY", 150, 200}, // half away from zero, not to even
+		{"JPY", 250, 300},
+		{"JPY", 149, 100},
+		{"JPY", -150, -200},
+		{"BRL", 7, 7},
+	}
+	for _, tt := range tests {
+		c, _ := LookupCurrency(tt.code)
+		got, err := c.CashRound(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("%s.CashRound(%d) = %d, %v; want %d", tt.code, tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestCurrencyFormat(t *testing.T) {
+	tests := []struct {
+		code string
+		in   Money
+		want string
+	}{
+		{"BRL", 1050, "10.50"},
+		{"BRL", -1, "-0.01"},
+		{"JPY", 150000, "1500"},
+		{"JPY", 150, "2"},
+		{"JPY", 250, "2"},
+		{"JPY", -150, "-2"},
+		{"KWD", 1050, "10.500"},
+		{"CLF", 1, "0.0100"},
+	}
+	for _, tt := range tests {
+		c, _ := LookupCurrency(tt.code)
+		if got := c.Format(tt.in); got != tt.want {
+			t.Errorf("%s.Format(%d) = %q; want %q", tt.code, tt.in, got, tt.want)
+		}
+	}
+}
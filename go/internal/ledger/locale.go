@@ -0,0 +1,144 @@
+package ledger
+
+import (
+	"strings"
+	"time"
+)
+
+// Locale is how customers in one region read amounts and dates: "R$ 1.234,56"
+// and "14/03/2026" for pt-BR, "$1,234.56" and "03/14/2026" for en-US. The
+// space between an amount and its symbol is a no-break space (U+00A0), as
+// CLDR and so Intl.NumberFormat and the mobile SDKs write it, so a client
+// formatting on its own renders the same string the API sends.
+type Locale struct {
+	Tag            string
+	Decimal, Group string
+	// SymbolFirst puts the currency symbol before the amount, SymbolSpace
+	// separates them. A currency without a symbol is written as its code,
+	// always separated.
+	SymbolFirst, SymbolSpace   bool
+	DateLayout, DateTimeLayout string
+	// Symbols overrides the common symbols below, for the currencies the
+	// region calls by a bare one: "$" is USD in en-US but US$ elsewhere.
+	Symbols map[string]string
+}
+
+// symbols are the currency symbols readable anywhere. The rest go by code.
+var symbols = map[string]string{
+	"AUD": "A$", "BRL": "R$", "CAD": "CA$", "CNY": "CN¥", "EUR": "€", "GBP": "£", "HKD": "HK$",
+	"ILS": "₪", "INR": "₹", "JPY": "JP¥", "KRW": "₩", "MXN": "MX$", "NZD": "NZ$", "PHP": "₱",
+	"TWD": "NT$", "USD": "US$", "VND": "₫", "XAF": "FCFA", "XOF": "F CFA",
+}
+
+var locales = map[string]Locale{
+	"pt-BR": {Tag: "pt-BR", Decimal: ",", Group: ".", SymbolFirst: true, SymbolSpace: true,
+		DateLayout: "02/01/2006", DateTimeLayout: "02/01/2006 15:04"},
+	"en-US": {Tag: "en-US", Decimal: ".", Group: ",", SymbolFirst: true,
+		DateLayout: "01/02/2006", DateTimeLayout: "01/02/2006 3:04 PM", Symbols: map[string]string{"USD": "$"}},
+	"en-GB": {Tag: "en-GB", Decimal: ".", Group: ",", SymbolFirst: true,
+		DateLayout: "02/01/2006", DateTimeLayout: "02/01/2006 15:04"},
+	"es-ES": {Tag: "es-ES", Decimal: ",", Group: ".", SymbolSpace: true,
+		DateLayout: "02/01/2006", DateTimeLayout: "02/01/2006 15:04"},
+	"es-MX": {Tag: "es-MX", Decimal: ".", Group: ",", SymbolFirst: true,
+		DateLayout: "02/01/2006", DateTimeLayout: "02/01/2006 15:04", Symbols: map[string]string{"MXN": "$"}},
+	"de-DE": {Tag: "de-DE", Decimal: ",", Group: ".", SymbolSpace: true,
+		DateLayout: "02.01.2006", DateTimeLayout: "02.01.2006 15:04"},
+	"fr-FR": {Tag: "fr-FR", Decimal: ",", Group: "\u202f", SymbolSpace: true,
+		DateLayout: "02/01/2006", DateTimeLayout: "02/01/2006 15:04"},
+	"ja-JP": {Tag: "ja-JP", Decimal: ".", Group: ",", SymbolFirst: true,
+		DateLayout: "2006/01/02", DateTimeLayout: "2006/01/02 15:04", Symbols: map[string]string{"JPY": "￥"}},
+}
+
+// LookupLocale returns the locale for a BCP 47 tag such as "pt-BR".
+func LookupLocale(tag string) (Locale, bool) {
+	l, ok := locales[tag]
+	return l, ok
+}
+
+// Locales lists the supported tags, for error messages.
+func Locales() []string {
+	tags := make([]string, 0, len(locales))
+	for tag := range locales {
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func (l Locale) symbol(code string) string {
+	if s, ok := l.Symbols[code]; ok {
+		return s
+	}
+	if s, ok := symbols[code]; ok {
+		return s
+	}
+	return code
+}
+
+// Money renders m in c with the currency's own decimals, grouped and
+// signed the locale's way: "-R$ 1.234,56", "-1.234,56 €".
+func (l Locale) Money(m Money, c Currency) string {
+	digits, neg := strings.CutPrefix(c.Format(m), "-")
+	whole, frac, _ := strings.Cut(digits, ".")
+	var b strings.Builder
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(l.Group)
+		}
+		b.WriteRune(d)
+	}
+	if frac != "" {
+		b.WriteString(l.Decimal)
+		b.WriteString(frac)
+	}
+	sym := l.symbol(c.Code)
+	sep := ""
+	if l.SymbolSpace || sym == c.Code {
+		sep = "\u00a0"
+	}
+	out := b.String() + sep + sym
+	if l.SymbolFirst {
+		out = sym + sep + b.String()
+	}
+	if neg {
+		return "-" + out
+	}
+	return out
+}
+
+// Formatter renders for one reader: a locale and the time zone dates are
+// shown in, UTC when Location is nil.
+type Formatter struct {
+	Locale   Locale
+	Location *time.Location
+}
+
+// Money renders m in the currency with the given code, falling back to
+// the plain amount and code for one the registry does not know.
+func (f Formatter) Money(m Money, code string) string {
+	c, ok := LookupCurrency(code)
+	if !ok {
+		return m.String() + " " + code
+	}
+	return f.Locale.Money(m, c)
+}
+
+func (f Formatter) Date(t time.Time) string {
+	return f.in(t).Format(f.Locale.DateLayout)
+}
+
+func (f Formatter) DateTime(t time.Time) string {
+	return f.in(t).Format(f.Locale.DateTimeLayout)
+}
+
+func (f Formatter) in(t time.Time) time.Time {
+	if f.Location == nil {
+		return t.UTC()
+	}
+	return t.In(f.Location)
+}
+
+// Display is an amount and time as the reader's locale writes them.
+type Display struct {
+	Amount string `json:"amount"`
+	At     string `json:"at,omitempty"`
+}
@@ -0,0 +1,80 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocaleMoney(t *testing.T) {
+	tests := []struct {
+		tag  string
+		code string
+		in   Money
+		want string
+	}{
+		{"pt-BR", "BRL", 123456, "R$\u00a01.234,56"},
+		{"pt-BR", "BRL", -123456, "-R$\u00a01.234,56"},
+		{"pt-BR", "BRL", 0, "R$\u00a00,00"},
+		{"pt-BR", "JPY", 150000, "JP¥\u00a01.500"},
+		{"en-US", "USD", 123456, "$1,234.56"},
+		{"en-US", "USD", 99, "$0.99"},
+		{"en-US", "USD", 100000, "$1,000.00"},
+		{"en-US", "USD", 99999, "$999.99"},
+		{"en-US", "CHF", 500, "CHF\u00a05.00"},
+		{"en-GB", "USD", 123456, "US$1,234.56"},
+		{"en-GB", "GBP", -50, "-£0.50"},
+		{"es-ES", "EUR", 123456, "1.234,56\u00a0€"},
+		{"es-MX", "MXN", 100, "$1.00"},
+		{"de-DE", "EUR", -123456, "-1.234,56\u00a0€"},
+		{"fr-FR", "EUR", 123456789, "1\u202f234\u202f567,89\u00a0€"},
+		{"ja-JP", "JPY", 150000, "￥1,500"},
+		{"ja-JP", "KRW", 1234500, "₩12,345"},
+	}
+	for _, tt := range tests {
+		l, ok := LookupLocale(tt.tag)
+		if !ok {
+			t.Fatalf("LookupLocale(%q) failed", tt.tag)
+		}
+		c, _ := LookupCurrency(tt.code)
+		if got := l.Money(tt.in, c); got != tt.want {
+			t.Errorf("%s: Money(%d, %s) = %q; want %q", tt.tag, tt.in, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestFormatter(t *testing.T) {
+	at := time.Date(2026, 3, 14, 23, 30, 0, 0, time.UTC)
+	tests := []struct {
+		tag            string
+		loc            *time.Location
+		date, dateTime string
+	}{
+		{"pt-BR", nil, "14/03/2026", "14/03/2026 23:30"},
+		{"pt-BR", time.FixedZone("BRT", -3*3600), "14/03/2026", "14/03/2026 20:30"},
+		{"en-US", nil, "03/14/2026", "03/14/2026 11:30 PM"},
+		{"de-DE", nil, "14.03.2026", "14.03.2026 23:30"},
+		{"ja-JP", time.FixedZone("JST", 9*3600), "2026/03/15", "2026/03/15 08:30"},
+	}
+	for _, tt := range tests {
+		l, _ := LookupLocale(tt.tag)
+		f := Formatter{Locale: l, Location: tt.loc}
+		if got := f.Date(at); got != tt.date {
+			t.Errorf("%s in %v: Date = %q; want %q", tt.tag, tt.loc, got, tt.date)
+		}
+		if got := f.DateTime(at); got != tt.dateTime {
+			t.Errorf("%s in %v: DateTime = %q; want %q", tt.tag, tt.loc, got, tt.dateTime)
+		}
+	}
+
+	f := Formatter{Locale: locales["pt-BR"]}
+	if got, want := f.Money(1050, "BRL"), "R$\u00a010,50"; got != want {
+		t.Errorf("Money(1050, BRL) = %q; want %q", got, want)
+	}
+	// codes the registry does not know fall back to the plain amount
+	if got, want := f.Money(1050, "XYZ"), "10.50 XYZ"; got != want {
+		t.Errorf("Money(1050, XYZ) = %q; want %q", got, want)
+	}
+	if _, ok := LookupLocale("pt-PT"); ok {
+		t.Error("LookupLocale(pt-PT) succeeded; want an unknown locale")
+	}
+}
@@ -0,0 +1,180 @@
+// Package ledger is the ledger's data model: amounts in minor units and
+// the statement lines built from ledger rows. It has no storage of its own.
+package ledger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Money is an amount in minor units of the service currency (centavos for
+// BRL). It never goes through float64: JSON and NUMERIC columns are converted
+// digit by digit.
+//
+// Rounding rules: amounts coming from clients must not carry more decimals
+// than the currency allows and are rejected otherwise, since silently
+// rounding a payment instruction changes what the customer asked for.
+// Amounts read from the database are rounded half-to-even, because other
+// services sharing the tables may have written float-derived values.
+type Money int64
+
+// exponent is the minor-unit exponent of the service currency, and service
+// the currency itself; see SetCurrency.
+var (
+	exponent = currencies["BRL"].Exponent
+	service  = currencies["BRL"]
+)
+
+// SetCurrency makes code the service currency, the one Money amounts are
+// expressed in, and returns its exponent. It is called once at startup,
+// before any amount is parsed or rendered.
+func SetCurrency(code string) (int, error) {
+	c, ok := LookupCurrency(code)
+	if !ok {
+		return 0, fmt.Errorf("unsupported currency %q", code)
+	}
+	service, exponent = c, c.Exponent
+	return c.Exponent, nil
+}
+
+var ErrTooPrecise = errors.New("amount has more decimal places than the currency allows")
+
+// ParseMoney converts a plain decimal string ("10", "10.5", "-0.01") into
+// minor units. It takes at most one sign.
+func ParseMoney(s string, exp int) (Money, error) {
+	s = strings.TrimSpace(s)
+	in, neg := s, false
+	switch {
+	case strings.HasPrefix(s, "-"):
+		neg, s = true, s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return 0, fmt.Errorf("invalid amount %q", in)
+	}
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > exp {
+		return 0, ErrTooPrecise
+	}
+	digits := whole + frac + strings.Repeat("0", exp-len(frac))
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return 0, fmt.Errorf("invalid amount %q", in)
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("amount out of range")
+	}
+	if neg {
+		n = -n
+	}
+	return Money(n), nil
+}
+
+// String renders m as a plain decimal with exactly the currency's
+// decimals, e.g. "10.50".
+func (m Money) String() string {
+	return formatMinor(int64(m), exponent)
+}
+
+// formatMinor renders v minor units of a currency with exp decimals.
+func formatMinor(v int64, exp int) string {
+	neg := v < 0
+	if neg {
+		v = -v
+	}
+	digits := strconv.FormatInt(v, 10)
+	if exp > 0 {
+		if len(digits) <= exp {
+			digits = strings.Repeat("0", exp-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+	}
+	if neg {
+		return "-" + digits
+	}
+	return digits
+}
+
+// Float is only for metrics and risk-rule comparisons, never arithmetic.
+func (m Money) Float() float64 {
+	f, _ := strconv.ParseFloat(m.String(), 64)
+	return f
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts both JSON numbers and decimal strings.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '"' {
+		s, err := strconv.Unquote(string(b))
+		if err != nil {
+			return err
+		}
+		b = []byte(s)
+	}
+	if bytes.ContainsAny(b, "eE") {
+		return fmt.Errorf("amount must be a plain decimal, not %s", b)
+	}
+	v, err := ParseMoney(string(b), exponent)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// ScanNumeric implements pgtype.NumericScanner.
+func (m *Money) ScanNumeric(n pgtype.Numeric) error {
+	if !n.Valid {
+		return errors.New("cannot scan NULL into Money")
+	}
+	if n.NaN || n.InfinityModifier != pgtype.Finite {
+		return errors.New("cannot scan non-finite numeric into Money")
+	}
+	v := new(big.Int).Set(n.Int)
+	shift := int(n.Exp) + exponent
+	ten := big.NewInt(10)
+	if shift >= 0 {
+		v.Mul(v, new(big.Int).Exp(ten, big.NewInt(int64(shift)), nil))
+	} else {
+		v = RoundHalfEven(v, new(big.Int).Exp(ten, big.NewInt(int64(-shift)), nil))
+	}
+	if !v.IsInt64() {
+		return errors.New("numeric out of range for Money")
+	}
+	*m = Money(v.Int64())
+	return nil
+}
+
+// NumericValue implements pgtype.NumericValuer.
+func (m Money) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: big.NewInt(int64(m)), Exp: int32(-exponent), Valid: true}, nil
+}
+
+// RoundHalfEven divides v by d rounding ties to the even quotient.
+func RoundHalfEven(v, d *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(v, d, new(big.Int))
+	twice := new(big.Int).Mul(new(big.Int).Abs(r), big.NewInt(2))
+	switch cmp := twice.Cmp(d); {
+	case cmp > 0, cmp == 0 && q.Bit(0) == 1:
+		if v.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
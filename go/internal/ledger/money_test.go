@@ -0,0 +1,122 @@
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		exp     int
+		want    Money
+		wantErr error // nil with ok false means any error
+		ok      bool
+	}{
+		{in: "10", exp: 2, want: 1000, ok: true},
+		{in: "10.5", exp: 2, want: 1050, ok: true},
+		{in: "10.50", exp: 2, want: 1050, ok: true},
+		{in: "-0.01", exp: 2, want: -1, ok: true},
+		{in: "+5", exp: 2, want: 500, ok: true},
+		{in: " 7.25 ", exp: 2, want: 725, ok: true},
+		{in: ".5", exp: 2, want: 50, ok: true},
+		{in: "1.", exp: 2, want: 100, ok: true},
+		{in: "-0", exp: 2, want: 0, ok: true},
+		{in: "1.230", exp: 2, want: 123, ok: true},
+		{in: "12", exp: 0, want: 12, ok: true},
+		{in: "0.001", exp: 3, want: 1, ok: true},
+		{in: "92233720368547758.07", exp: 2, want: 9223372036854775807, ok: true},
+
+		{in: "1.005", exp: 2, wantErr: ErrTooPrecise},
+		{in: "0.5", exp: 0, wantErr: ErrTooPrecise},
+		{in: "-+5", exp: 2},
+		{in: "+-5", exp: 2},
+		{in: "--5", exp: 2},
+		{in: "++5", exp: 2},
+		{in: "-", exp: 2},
+		{in: ".", exp: 2},
+		{in: "", exp: 2},
+		{in: "null", exp: 2},
+		{in: "1e3", exp: 2},
+		{in: "1E-2", exp: 2},
+		{in: "1,5", exp: 2},
+		{in: "1.2.3", exp: 2},
+		{in: "5-", exp: 2},
+		{in: "92233720368547758.08", exp: 2},
+		{in: "99999999999999999999", exp: 2},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in, tt.exp)
+		switch {
+		case tt.ok:
+			if err != nil || got != tt.want {
+				t.Errorf("ParseMoney(%q, %d) = %d, %v; want %d", tt.in, tt.exp, got, err, tt.want)
+			}
+		case tt.wantErr != nil:
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseMoney(%q, %d) error = %v; want %v", tt.in, tt.exp, err, tt.wantErr)
+			}
+		default:
+			if err == nil {
+				t.Errorf("ParseMoney(%q, %d) = %d; want an error", tt.in, tt.exp, got)
+			}
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		v    int64
+		exp  int
+		want string
+	}{
+		{1050, 2, "10.50"},
+		{-1, 2, "-0.01"},
+		{0, 2, "0.00"},
+		{5, 0, "5"},
+		{1, 3, "0.001"},
+	}
+	for _, tt := range tests {
+		if got := formatMinor(tt.v, tt.exp); got != tt.want {
+			t.Errorf("formatMinor(%d, %d) = %q; want %q", tt.v, tt.exp, got, tt.want)
+		}
+	}
+}
+
+// TestMoneyJSON decodes amounts as clients send them, in the service
+// currency (BRL, two decimals).
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+		ok   bool
+	}{
+		{`10.5`, 1050, true},
+		{`"10.5"`, 1050, true},
+		{`"-0.01"`, -1, true},
+		{`0.1`, 10, true},
+		{`1e3`, 0, false},
+		{`"1e3"`, 0, false},
+		{`1.5E2`, 0, false},
+		{`null`, 0, false},
+		{`"-+5"`, 0, false},
+		{`true`, 0, false},
+		{`"10.005"`, 0, false},
+	}
+	for _, tt := range tests {
+		var m Money
+		err := json.Unmarshal([]byte(tt.in), &m)
+		if tt.ok && (err != nil || m != tt.want) {
+			t.Errorf("Unmarshal(%s) = %d, %v; want %d", tt.in, m, err, tt.want)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("Unmarshal(%s) = %d; want an error", tt.in, m)
+		}
+	}
+
+	out, err := json.Marshal(struct{ Amount Money }{1050})
+	if err != nil || string(out) != `{"Amount":10.50}` {
+		t.Errorf("Marshal = %s, %v; want {\"Amount\":10.50}", out, err)
+	}
+}
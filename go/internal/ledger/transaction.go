@@ -0,0 +1,52 @@
+package ledger
+
+import "time"
+
+// Transaction is one ledger entry as it appears on an account statement.
+type Transaction struct {
+	ID     int64     `json:"id"`
+	Type   string    `json:"type"`
+	Amount Money     `json:"amount"`
+	At     time.Time `json:"at"`
+	// Currency is the account's; FxRate is set when the transfer converted
+	// between currencies.
+	Currency string  `json:"currency"`
+	FxRate   *string `json:"fxRate,omitempty"`
+	// VirtualAccountID is set on credits received through a virtual account.
+	VirtualAccountID *string `json:"virtualAccountId,omitempty"`
+	// StandingOrderID is set on both sides of a standing order execution.
+	StandingOrderID *int64 `json:"standingOrderId,omitempty"`
+	// Summary is set on entries standing for compacted ones; the raw
+	// entries are at /ledger/entries/{id}/archived.
+	Summary *LedgerSummary `json:"summary,omitempty"`
+	// TransactionID is shared by the debit and the credit of one movement;
+	// the other side is on CounterpartyAccountID's statement under the same
+	// id. Both are unset on summaries and on entries older than transfer
+	// ids, and the counterparty is omitted when it is a system account.
+	TransactionID         *int64  `json:"transactionId,omitempty"`
+	CounterpartyAccountID *string `json:"counterpartyAccountId,omitempty"`
+	// Descriptor, Counterparty and Display are display information, filled
+	// in when the statement is read.
+	Descriptor   string        `json:"descriptor,omitempty"`
+	Counterparty *Counterparty `json:"counterparty,omitempty"`
+	Display      *Display      `json:"display,omitempty"`
+}
+
+// LedgerSummary marks a statement line standing for compacted entries. The
+// name is the one the OpenAPI spec has always published for it.
+type LedgerSummary struct {
+	Entries       int64  `json:"entries"`
+	FirstLedgerID int64  `json:"firstLedgerId"`
+	Period        string `json:"period"`
+}
+
+// Counterparty is the display information for the other side of a ledger
+// entry. Icon is a hint for client UIs, not an asset path; clients map it
+// to whatever icon set they ship.
+type Counterparty struct {
+	AccountID     string `json:"accountId,omitempty"`
+	Name          string `json:"name,omitempty"`
+	MaskedAccount string `json:"maskedAccount,omitempty"`
+	Category      string `json:"category"`
+	Icon          string `json:"icon"`
+}
@@ -0,0 +1,292 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fintech-go/internal/ledger"
+)
+
+// Memory is a Store held in maps, for handler tests and local demos. It
+// keeps every account's entries in id order and pages statements the way
+// the Postgres store does, bound and all. Nothing is persisted, and there
+// are no tenants: any currency the service currency can hold may be opened.
+//
+// Transfers check what every ledger must (account status, tenant, transfer
+// limit, funds and overdraft) and replay by operation id, but charge no
+// fees, convert no currencies and run no daily limits or risk rules.
+type Memory struct {
+	mu       sync.Mutex
+	accounts map[string]Account
+	// entries are each account's ledger rows, oldest first.
+	entries map[string][]ledger.Transaction
+	ops     map[string]Operation
+	// transfers are the results of operations, for replays.
+	transfers map[string]TransferResult
+	lastID    int64
+	lastTxnID int64
+}
+
+var _ Store = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{accounts: map[string]Account{}, entries: map[string][]ledger.Transaction{}, ops: map[string]Operation{},
+		transfers: map[string]TransferResult{}}
+}
+
+func (m *Memory) Account(ctx context.Context, id string) (Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.accounts[id]
+	if !ok {
+		return Account{}, ErrAccountNotFound
+	}
+	return a, nil
+}
+
+func (m *Memory) CreateAccount(ctx context.Context, na NewAccount) (Account, error) {
+	c, ok := ledger.LookupCurrency(na.Currency)
+	if !ok {
+		return Account{}, InvalidError(fmt.Sprintf("unknown currency %q", na.Currency))
+	}
+	if _, err := c.Unit(); err != nil {
+		return Account{}, InvalidError(err.Error())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.accounts[na.ID]; ok {
+		return Account{}, ErrAccountExists
+	}
+	a := Account{ID: na.ID, TenantID: na.TenantID, DisplayName: na.DisplayName, Currency: na.Currency,
+		Status: AccountActive, CreatedAt: time.Now().UTC()}
+	m.accounts[a.ID] = a
+	return a, nil
+}
+
+// PutAccount stores a as is, replacing any account with its id; tests and
+// demo seeds use it to start from a given balance or status.
+func (m *Memory) PutAccount(a Account) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = time.Now().UTC()
+	}
+	a.Available = a.Balance - a.Held
+	m.accounts[a.ID] = a
+}
+
+// Post appends a ledger entry to the account's statement and moves its
+// balance by it. The entry gets the next id, and the account's currency
+// and the current time unless it carries its own.
+func (m *Memory) Post(accountID string, t ledger.Transaction) (ledger.Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.post(accountID, t)
+}
+
+func (m *Memory) post(accountID string, t ledger.Transaction) (ledger.Transaction, error) {
+	a, ok := m.accounts[accountID]
+	if !ok {
+		return t, ErrAccountNotFound
+	}
+	switch t.Type {
+	case "CREDIT":
+		a.Balance += t.Amount
+	case "DEBIT":
+		a.Balance -= t.Amount
+	default:
+		return t, InvalidError("type must be DEBIT or CREDIT")
+	}
+	m.lastID++
+	t.ID = m.lastID
+	if t.Currency == "" {
+		t.Currency = a.Currency
+	}
+	if t.At.IsZero() {
+		t.At = time.Now().UTC()
+	}
+	a.Available = a.Balance - a.Held
+	m.accounts[accountID] = a
+	m.entries[accountID] = append(m.entries[accountID], t)
+	return t, nil
+}
+
+// Transfer books t as a debit and a credit sharing one transaction id. An
+// operation id seen before answers with its first result, whatever the
+// rest of t says.
+func (m *Memory) Transfer(ctx context.Context, t Transfer) (TransferResult, error) {
+	if t.FromAccountID == t.ToAccountID || t.Amount <= 0 {
+		return TransferResult{}, InvalidError("a transfer needs two accounts and an amount > 0")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if res, ok := m.transfers[t.OperationID]; ok && t.OperationID != "" {
+		return res, nil
+	}
+	from, ok := m.accounts[t.FromAccountID]
+	if !ok {
+		return TransferResult{}, fmt.Errorf("from %w", ErrAccountNotFound)
+	}
+	to, ok := m.accounts[t.ToAccountID]
+	if !ok {
+		return TransferResult{}, fmt.Errorf("to %w", ErrAccountNotFound)
+	}
+	switch {
+	case t.TenantID != "" && from.TenantID != t.TenantID:
+		return TransferResult{}, ErrOtherTenant
+	case from.Status == AccountFrozen:
+		return TransferResult{}, fmt.Errorf("from %w", ErrAccountFrozen)
+	case from.Status == AccountClosed:
+		return TransferResult{}, fmt.Errorf("from %w", ErrAccountClosed)
+	case to.Status == AccountClosed:
+		return TransferResult{}, fmt.Errorf("to %w", ErrAccountClosed)
+	case from.Currency != to.Currency:
+		return TransferResult{}, InvalidError("the in-memory store does not convert between currencies")
+	case from.TransferLimit != nil && t.Amount > *from.TransferLimit:
+		return TransferResult{}, ErrLimitExceeded
+	case from.Available-t.Amount < -from.OverdraftLimit:
+		return TransferResult{}, ErrInsufficientFunds
+	}
+
+	m.lastTxnID++
+	txnID, at := m.lastTxnID, time.Now().UTC()
+	for _, e := range []struct {
+		account, other, typ string
+	}{{t.FromAccountID, t.ToAccountID, "DEBIT"}, {t.ToAccountID, t.FromAccountID, "CREDIT"}} {
+		other := e.other
+		if _, err := m.post(e.account, ledger.Transaction{Type: e.typ, Amount: t.Amount, At: at, TransactionID: &txnID,
+			CounterpartyAccountID: &other}); err != nil {
+			return TransferResult{}, err
+		}
+	}
+	res := TransferResult{Status: "ok", Message: "transfer completed", Balances: map[string]ledger.Money{
+		t.FromAccountID: m.accounts[t.FromAccountID].Balance, t.ToAccountID: m.accounts[t.ToAccountID].Balance}}
+	if t.OperationID != "" {
+		raw, err := json.Marshal(res)
+		if err != nil {
+			return TransferResult{}, err
+		}
+		m.transfers[t.OperationID] = res
+		m.ops[t.OperationID] = Operation{OperationID: t.OperationID, State: "committed", Response: raw, CreatedAt: at, UpdatedAt: at}
+	}
+	return res, nil
+}
+
+func (m *Memory) Accounts(ctx context.Context, ids []string) ([]Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	accounts := make([]Account, 0, len(ids))
+	for _, id := range slices.Compact(ids) {
+		if a, ok := m.accounts[id]; ok {
+			accounts = append(accounts, a)
+		}
+	}
+	return accounts, nil
+}
+
+func (m *Memory) ListAccounts(ctx context.Context, q AccountQuery) (AccountPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]string, 0, len(m.accounts))
+	for id, a := range m.accounts {
+		if id > q.Cursor && (q.TenantID == "" || a.TenantID == q.TenantID) && (q.Status == "" || a.Status == q.Status) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	if q.Limit > 0 && len(ids) > q.Limit {
+		ids = ids[:q.Limit]
+	}
+	page := AccountPage{Accounts: make([]Account, 0, len(ids))}
+	for _, id := range ids {
+		page.Accounts = append(page.Accounts, m.accounts[id])
+	}
+	if len(ids) > 0 && len(ids) == q.Limit {
+		page.NextCursor = ids[len(ids)-1]
+	}
+	return page, nil
+}
+
+func (m *Memory) Statement(ctx context.Context, accountID string, q StatementQuery) (StatementPage, error) {
+	typ := strings.ToUpper(q.Type)
+	if typ != "" && typ != "DEBIT" && typ != "CREDIT" {
+		return StatementPage{}, InvalidError("type must be DEBIT or CREDIT")
+	}
+	var asOf, last int64
+	if q.Cursor != "" {
+		var err error
+		if asOf, last, err = ParseStatementCursor(q.Cursor); err != nil {
+			return StatementPage{}, InvalidError("invalid cursor")
+		}
+	}
+	limit := min(q.Limit, StatementMaxLimit)
+	if limit <= 0 {
+		limit = StatementDefaultLimit
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.accounts[accountID]
+	if !ok {
+		return StatementPage{}, ErrAccountNotFound
+	}
+	entries := m.entries[accountID]
+	var head int64
+	if len(entries) > 0 {
+		head = entries[len(entries)-1].ID
+	}
+	if asOf == 0 {
+		asOf = head
+	}
+	txs := make([]ledger.Transaction, 0, min(limit, len(entries)))
+	for i := len(entries) - 1; i >= 0 && len(txs) < limit; i-- {
+		t := entries[i]
+		switch {
+		case t.ID > asOf, q.Cursor != "" && t.ID >= last:
+		case !q.From.IsZero() && t.At.Before(q.From), !q.To.IsZero() && !t.At.Before(q.To):
+		case typ != "" && t.Type != typ:
+		default:
+			txs = append(txs, t)
+		}
+	}
+	page := StatementPage{Transactions: txs, AsOf: asOf}
+	if asOf == head {
+		balance := a.Balance
+		page.Balance = &balance
+	}
+	if len(txs) == limit {
+		page.NextCursor = StatementCursor(asOf, txs[len(txs)-1].ID)
+	}
+	return page, nil
+}
+
+func (m *Memory) Operation(ctx context.Context, id string) (Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op, ok := m.ops[id]
+	if !ok {
+		return Operation{OperationID: id}, ErrOperationNotFound
+	}
+	return op, nil
+}
+
+// PutOperation records a journal entry, as the transfer path would.
+func (m *Memory) PutOperation(op Operation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	if op.CreatedAt.IsZero() {
+		op.CreatedAt = now
+	}
+	if op.UpdatedAt.IsZero() {
+		op.UpdatedAt = now
+	}
+	m.ops[op.OperationID] = op
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"fintech-go/internal/ledger"
+)
+
+func newTestMemory() *Memory {
+	limit := ledger.Money(5000)
+	m := NewMemory()
+	for _, a := range []Account{
+		{ID: "a", TenantID: "t1", Currency: "BRL", Status: AccountActive, Balance: 10000},
+		{ID: "b", TenantID: "t2", Currency: "BRL", Status: AccountActive},
+		{ID: "overdraft", TenantID: "t1", Currency: "BRL", Status: AccountActive, OverdraftLimit: 1000},
+		{ID: "limited", TenantID: "t1", Currency: "BRL", Status: AccountActive, Balance: 10000, TransferLimit: &limit},
+		{ID: "frozen", TenantID: "t1", Currency: "BRL", Status: AccountFrozen, Balance: 10000},
+		{ID: "closed", TenantID: "t1", Currency: "BRL", Status: AccountClosed},
+		{ID: "usd", TenantID: "t1", Currency: "USD", Status: AccountActive},
+	} {
+		m.PutAccount(a)
+	}
+	return m
+}
+
+func TestMemoryTransfer(t *testing.T) {
+	tests := []struct {
+		name    string
+		t       Transfer
+		wantErr error // nil with invalid false means success
+		invalid bool
+	}{
+		{name: "ok", t: Transfer{FromAccountID: "a", ToAccountID: "b", Amount: 10000}},
+		{name: "into overdraft", t: Transfer{FromAccountID: "overdraft", ToAccountID: "b", Amount: 1000}},
+		{name: "frozen can receive", t: Transfer{FromAccountID: "a", ToAccountID: "frozen", Amount: 1}},
+		{name: "bound to the sender's tenant", t: Transfer{FromAccountID: "a", ToAccountID: "b", Amount: 1, TenantID: "t1"}},
+		{name: "insufficient funds", t: Transfer{FromAccountID: "a", ToAccountID: "b", Amount: 10001}, wantErr: ErrInsufficientFunds},
+		{name: "past the overdraft", t: Transfer{FromAccountID: "overdraft", ToAccountID: "b", Amount: 1001}, wantErr: ErrInsufficientFunds},
+		{name: "transfer limit", t: Transfer{FromAccountID: "limited", ToAccountID: "b", Amount: 5001}, wantErr: ErrLimitExceeded},
+		{name: "unknown sender", t: Transfer{FromAccountID: "zz", ToAccountID: "b", Amount: 1}, wantErr: ErrAccountNotFound},
+		{name: "unknown recipient", t: Transfer{FromAccountID: "a", ToAccountID: "zz", Amount: 1}, wantErr: ErrAccountNotFound},
+		{name: "frozen sender", t: Transfer{FromAccountID: "frozen", ToAccountID: "b", Amount: 1}, wantErr: ErrAccountFrozen},
+		{name: "closed sender", t: Transfer{FromAccountID: "closed", ToAccountID: "b", Amount: 1}, wantErr: ErrAccountClosed},
+		{name: "closed recipient", t: Transfer{FromAccountID: "a", ToAccountID: "closed", Amount: 1}, wantErr: ErrAccountClosed},
+		{name: "other tenant's account", t: Transfer{FromAccountID: "b", ToAccountID: "a", Amount: 1, TenantID: "t1"}, wantErr: ErrOtherTenant},
+		{name: "currencies differ", t: Transfer{FromAccountID: "a", ToAccountID: "usd", Amount: 1}, invalid: true},
+		{name: "same account", t: Transfer{FromAccountID: "a", ToAccountID: "a", Amount: 1}, invalid: true},
+		{name: "zero amount", t: Transfer{FromAccountID: "a", ToAccountID: "b"}, invalid: true},
+	}
+	for _, tt := range tests {
+		m := newTestMemory()
+		before := map[string]ledger.Money{}
+		for _, id := range []string{tt.t.FromAccountID, tt.t.ToAccountID} {
+			a, _ := m.Account(context.Background(), id)
+			before[id] = a.Balance
+		}
+		res, err := m.Transfer(context.Background(), tt.t)
+		var invalid InvalidError
+		switch {
+		case tt.invalid:
+			if !errors.As(err, &invalid) {
+				t.Errorf("%s: error %v; want an InvalidError", tt.name, err)
+			}
+		case tt.wantErr != nil:
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: error %v; want %v", tt.name, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		default:
+			from, to := before[tt.t.FromAccountID]-tt.t.Amount, before[tt.t.ToAccountID]+tt.t.Amount
+			if res.Balances[tt.t.FromAccountID] != from || res.Balances[tt.t.ToAccountID] != to {
+				t.Errorf("%s: balances %v; want %s and %s", tt.name, res.Balances, from, to)
+			}
+			continue
+		}
+		for id, b := range before {
+			if a, _ := m.Account(context.Background(), id); a.Balance != b {
+				t.Errorf("%s: refused transfer moved %s from %s to %s", tt.name, id, b, a.Balance)
+			}
+		}
+	}
+}
+
+// TestMemoryTransferReplay sends one operation twice: money moves once,
+// the replay answers with the first result and the journal holds it.
+func TestMemoryTransferReplay(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemory()
+	tr := Transfer{OperationID: "op-1", FromAccountID: "a", ToAccountID: "b", Amount: 2500}
+	first, err := m.Transfer(ctx, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Amount = 1
+	replay, err := m.Transfer(ctx, tr)
+	if err != nil || replay.Balances["a"] != first.Balances["a"] {
+		t.Fatalf("replay = %+v, %v; want %+v", replay, err, first)
+	}
+	if a, _ := m.Account(ctx, "a"); a.Balance != 7500 {
+		t.Errorf("sender holds %s after a replay, want 75.00", a.Balance)
+	}
+	op, err := m.Operation(ctx, "op-1")
+	if err != nil || op.State != "committed" || len(op.Response) == 0 {
+		t.Errorf("operation = %+v, %v; want committed with the response", op, err)
+	}
+
+	// both sides of the transfer share a transaction id and name each other
+	for _, side := range []struct{ account, other, typ string }{{"a", "b", "DEBIT"}, {"b", "a", "CREDIT"}} {
+		page, err := m.Statement(ctx, side.account, StatementQuery{})
+		if err != nil || len(page.Transactions) != 1 {
+			t.Fatalf("statement of %s = %+v, %v; want one entry", side.account, page, err)
+		}
+		e := page.Transactions[0]
+		if e.Type != side.typ || e.Amount != 2500 || e.TransactionID == nil || *e.TransactionID != 1 ||
+			e.CounterpartyAccountID == nil || *e.CounterpartyAccountID != side.other {
+			t.Errorf("%s entry = %+v; want a %s of 25.00 against %s", side.account, e, side.typ, side.other)
+		}
+	}
+}
+
+// TestMemoryStatementPaging pages through a statement while new entries
+// arrive: later pages stay at the first page's bound.
+func TestMemoryStatementPaging(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemory()
+	for i := 0; i < 5; i++ {
+		if _, err := m.Transfer(ctx, Transfer{FromAccountID: "a", ToAccountID: "b", Amount: 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := m.Statement(ctx, "a", StatementQuery{Limit: 2})
+	if err != nil || len(first.Transactions) != 2 || first.Balance == nil || *first.Balance != 9500 || first.NextCursor == "" {
+		t.Fatalf("first page = %+v, %v", first, err)
+	}
+	if _, err := m.Transfer(ctx, Transfer{FromAccountID: "a", ToAccountID: "b", Amount: 100}); err != nil {
+		t.Fatal(err)
+	}
+	var seen int
+	for cursor := first.NextCursor; cursor != ""; {
+		page, err := m.Statement(ctx, "a", StatementQuery{Limit: 2, Cursor: cursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.AsOf != first.AsOf || page.Balance != nil {
+			t.Errorf("page = %+v; want the first page's bound and no balance", page)
+		}
+		seen += len(page.Transactions)
+		cursor = page.NextCursor
+	}
+	if seen != 3 {
+		t.Errorf("later pages hold %d entries, want the 3 before the bound", seen)
+	}
+	if _, err := m.Statement(ctx, "a", StatementQuery{Type: "FEE"}); err == nil {
+		t.Error("statement of type FEE succeeded; want an InvalidError")
+	}
+}
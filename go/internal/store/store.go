@@ -0,0 +1,216 @@
+// Package store defines the storage the HTTP API reads and writes through:
+// accounts, their statements, transfers and the idempotency journal. The
+// Postgres implementation lives in package main next to the transfer
+// engine; Memory is the other one.
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"fintech-go/internal/ledger"
+)
+
+// Store is the storage behind the account, statement, transfer and
+// operation endpoints. Implementations return the errors below as
+// documented, and an InvalidError when the caller has to fix its input;
+// anything else is an internal failure.
+type Store interface {
+	// Account returns the account or ErrAccountNotFound.
+	Account(ctx context.Context, id string) (Account, error)
+	// Accounts returns those of ids that exist, in id order.
+	Accounts(ctx context.Context, ids []string) ([]Account, error)
+	// CreateAccount opens an active account with a zero balance, or
+	// returns ErrAccountExists.
+	CreateAccount(ctx context.Context, a NewAccount) (Account, error)
+	// ListAccounts pages through accounts in id order.
+	ListAccounts(ctx context.Context, q AccountQuery) (AccountPage, error)
+	// Statement reads one page of the account's statement, newest first,
+	// or returns ErrAccountNotFound.
+	Statement(ctx context.Context, accountID string, q StatementQuery) (StatementPage, error)
+	// Operation returns the journal entry of an idempotent operation, or
+	// ErrOperationNotFound.
+	Operation(ctx context.Context, id string) (Operation, error)
+	// Transfer moves money between two accounts, once per operation id:
+	// a repeated id answers with the first result. Refusals are the
+	// transfer errors below, ErrAccountNotFound and ErrOtherTenant.
+	Transfer(ctx context.Context, t Transfer) (TransferResult, error)
+}
+
+var (
+	ErrAccountNotFound   = errors.New("account not found")
+	ErrAccountExists     = errors.New("account already exists")
+	ErrOperationNotFound = errors.New("operation not found")
+	// ErrOtherTenant is returned when credentials bound to one tenant name
+	// another tenant's account.
+	ErrOtherTenant = errors.New("account belongs to another tenant")
+
+	// Transfer failures, wrapped with the side they apply to ("from account
+	// is frozen").
+	ErrAccountFrozen     = errors.New("account is frozen")
+	ErrAccountClosed     = errors.New("account is closed")
+	ErrLimitExceeded     = errors.New("amount exceeds account transfer limit")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrBlockedByRule     = errors.New("transfer blocked by risk rule")
+	// ErrOperationInFlight is a transfer whose operation id another request
+	// is still running.
+	ErrOperationInFlight = errors.New("operation already in progress")
+)
+
+// InvalidError is a request the caller has to fix; its text is safe to
+// show them.
+type InvalidError string
+
+func (e InvalidError) Error() string { return string(e) }
+
+// Account statuses. Frozen accounts can still receive funds but cannot send;
+// closed accounts reject both directions.
+const (
+	AccountActive = "active"
+	AccountFrozen = "frozen"
+	AccountClosed = "closed"
+)
+
+// AccountIDPattern is what account ids may look like.
+var AccountIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type Account struct {
+	ID          string `json:"id"`
+	TenantID    string `json:"tenantId"`
+	DisplayName string `json:"displayName,omitempty"`
+	// Balance is the booked balance. Held is reserved by active
+	// authorization holds, and Available, what the account may spend
+	// before its overdraft, is Balance less Held.
+	Balance       ledger.Money  `json:"balance"`
+	Held          ledger.Money  `json:"held"`
+	Available     ledger.Money  `json:"available"`
+	Currency      string        `json:"currency"`
+	Status        string        `json:"status"`
+	TransferLimit *ledger.Money `json:"transferLimit,omitempty"`
+	// DailyLimit caps the account's debits per day in its tenant's time
+	// zone, fees included.
+	DailyLimit *ledger.Money `json:"dailyLimit,omitempty"`
+	// OverdraftLimit is set through /admin/accounts/{id}/overdraft.
+	OverdraftLimit ledger.Money `json:"overdraftLimit"`
+	CreatedAt      time.Time    `json:"createdAt"`
+	ClosedAt       *time.Time   `json:"closedAt,omitempty"`
+}
+
+// NewAccount is an account to open. Currency is upper case and already
+// defaulted; the store checks it is one the tenant may hold.
+type NewAccount struct {
+	ID          string
+	TenantID    string
+	DisplayName string
+	Currency    string
+}
+
+// AccountQuery selects a page of accounts; empty fields leave a filter off.
+// Cursor is the last id of the previous page.
+type AccountQuery struct {
+	TenantID string
+	Status   string
+	Cursor   string
+	Limit    int
+}
+
+type AccountPage struct {
+	Accounts   []Account `json:"accounts"`
+	NextCursor string    `json:"nextCursor,omitempty"`
+}
+
+// StatementQuery selects a page of a statement; zero values leave a filter
+// off. From is inclusive and To exclusive. A zero Limit takes the default
+// page size.
+type StatementQuery struct {
+	From, To time.Time
+	Type     string
+	Cursor   string
+	Limit    int
+}
+
+// Statement page sizes.
+const (
+	StatementDefaultLimit = 50
+	StatementMaxLimit     = 500
+)
+
+type StatementPage struct {
+	Transactions []ledger.Transaction
+	// AsOf is the highest ledger id the statement reads; every page of one
+	// statement shares it.
+	AsOf int64
+	// Balance is only known on pages read at the bound; later pages would
+	// need the balance as of an older row.
+	Balance    *ledger.Money
+	NextCursor string
+}
+
+// StatementCursor is the cursor of the page after last in a statement
+// bounded by asOf.
+func StatementCursor(asOf, last int64) string {
+	return strconv.FormatInt(asOf, 10) + "." + strconv.FormatInt(last, 10)
+}
+
+// ParseStatementCursor splits "<asOf>.<lastId>". A bare id, as issued
+// before cursors carried a bound, pages without one.
+func ParseStatementCursor(v string) (asOf, last int64, err error) {
+	b, l, found := strings.Cut(v, ".")
+	if !found {
+		last, err = strconv.ParseInt(v, 10, 64)
+		return 0, last, err
+	}
+	if asOf, err = strconv.ParseInt(b, 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if last, err = strconv.ParseInt(l, 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if asOf <= 0 || last > asOf {
+		return 0, 0, fmt.Errorf("cursor out of range")
+	}
+	return asOf, last, nil
+}
+
+// Operation is an idempotency journal entry. Response is the response
+// stored for a finished operation, as sent to the client.
+type Operation struct {
+	OperationID string          `json:"operationId"`
+	State       string          `json:"state"`
+	RequestID   string          `json:"requestId,omitempty"`
+	Response    json.RawMessage `json:"response,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+// Transfer moves Amount from one account to another of the same currency.
+// TenantID is set when the caller's credentials are bound to a tenant, who
+// must then own the debited account.
+type Transfer struct {
+	OperationID   string       `json:"operationId,omitempty"`
+	FromAccountID string       `json:"fromAccountId"`
+	ToAccountID   string       `json:"toAccountId"`
+	Amount        ledger.Money `json:"amount"`
+	TenantID      string       `json:"-"`
+}
+
+// TransferResult is a transfer's outcome as the HTTP API answers it: a
+// completed transfer with both accounts' balances after it, or one held
+// for review behind CaseID.
+type TransferResult struct {
+	Status        string                  `json:"status"`
+	Message       string                  `json:"message"`
+	Balances      map[string]ledger.Money `json:"balances,omitempty"`
+	CaseID        int64                   `json:"caseId,omitempty"`
+	ReceiptNumber string                  `json:"receiptNumber,omitempty"`
+}
+
+// TransferPendingReview is the status of a transfer held for review.
+const TransferPendingReview = "pending_review"
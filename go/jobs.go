@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Background jobs live in the jobs table and are claimed with SKIP LOCKED, so
+// any number of replicas can run workers against the same queue. Handlers
+// report progress through the job passed to them.
+//
+// Progress doubles as a heartbeat. A job of a type in resumableJobs whose
+// heartbeat is older than JOB_LEASE was left running by a worker that
+// died, and is claimed again; its handler picks up from its own
+// checkpoints. Other types stay running until an operator marks them.
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// resumableJobs are the job types whose handlers resume from checkpoints
+// rather than start over.
+var resumableJobs = []string{"ledger_export"}
+
+type job struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Params    json.RawMessage `json:"params"`
+	DryRun    bool            `json:"dryRun"`
+	Status    string          `json:"status"`
+	Total     int64           `json:"total"`
+	Processed int64           `json:"processed"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     *string         `json:"error,omitempty"`
+	CreatedBy string          `json:"createdBy"`
+	// ScheduleID is set on runs enqueued by a schedule.
+	ScheduleID *int64     `json:"scheduleId,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	EndedAt    *time.Time `json:"finishedAt,omitempty"`
+
+	store *Store
+}
+
+// jobHandler runs a job to completion and returns its result document.
+type jobHandler func(ctx context.Context, j *job) (any, error)
+
+// progress records how far a running job got; total may be updated as the
+// handler learns it.
+func (j *job) progress(ctx context.Context, processed, total int64) {
+	j.Processed, j.Total = processed, total
+	if _, err := j.store.pool.Exec(ctx, "UPDATE jobs SET processed=$2, total=$3, heartbeat_at=now() WHERE id=$1", j.ID, processed, total); err != nil {
+		slog.Error("record job progress", "job_id", j.ID, "error", err)
+	}
+}
+
+func (s *Store) enqueueJob(ctx context.Context, jobType string, params any, dryRun bool, actor string) (int64, error) {
+	if _, ok := s.jobHandlers[jobType]; !ok {
+		return 0, fmt.Errorf("unknown job type %q", jobType)
+	}
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = s.pool.QueryRow(ctx, `
+		INSERT INTO jobs (type, params, dry_run, status, created_by) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		jobType, raw, dryRun, jobQueued, actor).Scan(&id)
+	return id, err
+}
+
+// startJob inserts a job already running, for callers that run it
+// themselves with runJob instead of leaving it to the workers.
+func (s *Store) startJob(ctx context.Context, jobType string, params any, dryRun bool, actor string) (*job, error) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	j := &job{store: s, Type: jobType, Params: raw, DryRun: dryRun, Status: jobRunning, CreatedBy: actor}
+	err = s.pool.QueryRow(ctx, `
+		INSERT INTO jobs (type, params, dry_run, status, created_by, started_at, heartbeat_at) VALUES ($1, $2, $3, $4, $5, now(), now())
+		RETURNING id, created_at`, jobType, raw, dryRun, jobRunning, actor).Scan(&j.ID, &j.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// claimJob marks the oldest queued job, or resumable job past its lease, as
+// running and returns it, or nil when there is none.
+func (s *Store) claimJob(ctx context.Context) (*job, error) {
+	j := &job{store: s}
+	lease := durationOrDefault("JOB_LEASE", 5*time.Minute)
+	err := s.pool.QueryRow(ctx, `
+		UPDATE jobs SET status=$1, started_at=now(), heartbeat_at=now()
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE status=$2 OR (status=$1 AND type = ANY($3) AND heartbeat_at < now() - $4 * interval '1 second')
+			ORDER BY id FOR UPDATE SKIP LOCKED LIMIT 1)
+		RETURNING id, type, params, dry_run, created_by, schedule_id, created_at`, jobRunning, jobQueued, resumableJobs, lease.Seconds()).
+		Scan(&j.ID, &j.Type, &j.Params, &j.DryRun, &j.CreatedBy, &j.ScheduleID, &j.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	j.Status = jobRunning
+	return j, nil
+}
+
+// runJob runs a claimed job and records its outcome, which it also returns.
+func (s *Store) runJob(ctx context.Context, j *job) error {
+	handler := s.jobHandlers[j.Type]
+	result, err := handler(ctx, j)
+	status, errMsg := jobSucceeded, ""
+	if err != nil {
+		status, errMsg = jobFailed, err.Error()
+	}
+	raw, merr := json.Marshal(result)
+	if merr != nil {
+		raw = nil
+	}
+	if _, uerr := s.pool.Exec(context.WithoutCancel(ctx), `
+		UPDATE jobs SET status=$2, result=$3, error=NULLIF($4, ''), finished_at=now() WHERE id=$1`,
+		j.ID, status, raw, errMsg); uerr != nil {
+		slog.Error("record job result", "job_id", j.ID, "error", uerr)
+	}
+	jobsFinished.WithLabelValues(j.Type, status).Inc()
+	if status == jobFailed && j.ScheduleID != nil {
+		s.scheduleFailed(context.WithoutCancel(ctx), j, errMsg)
+	}
+	slog.Info("job finished", "job_id", j.ID, "type", j.Type, "status", status)
+	return err
+}
+
+// runJobWorker drains the queue, polling every interval when it is empty.
+// Nothing is claimed while the service is read-only.
+func (s *Store) runJobWorker(ctx context.Context, every time.Duration) {
+	for {
+		var (
+			j   *job
+			err error
+		)
+		if !s.flags.readOnly.Load() {
+			if j, err = s.claimJob(ctx); err != nil {
+				slog.Error("claim job", "error", err)
+			}
+		}
+		if j != nil {
+			s.runJob(ctx, j)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(every):
+		}
+	}
+}
+
+func (s *Store) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid job id", http.StatusBadRequest)
+		return
+	}
+	var j job
+	err = s.pool.QueryRow(r.Context(), `
+		SELECT id, type, params, dry_run, status, total, processed, result, error, created_by, created_at, started_at, finished_at
+		FROM jobs WHERE id=$1`, id).
+		Scan(&j.ID, &j.Type, &j.Params, &j.DryRun, &j.Status, &j.Total, &j.Processed, &j.Result, &j.Error, &j.CreatedBy, &j.CreatedAt, &j.StartedAt, &j.EndedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "job not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load job", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
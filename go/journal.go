@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Journal states. An operation moves received -> executing -> committed ->
+// responded on the happy path. The committed transition is written inside the
+// transfer transaction, so a row left in received/executing after a crash
+// never touched balances, while a row left in committed did and only the
+// response was lost. pending_review parks an operation until a reviewer
+// approves or rejects its risk case. reversed marks an operation a later
+// reversal undid; its stored response still replays.
+const (
+	journalReceived      = "received"
+	journalExecuting     = "executing"
+	journalCommitted     = "committed"
+	journalResponded     = "responded"
+	journalFailed        = "failed"
+	journalAborted       = "aborted"
+	journalRecovered     = "recovered"
+	journalPendingReview = "pending_review"
+	journalReversed      = "reversed"
+)
+
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// journalReceive records an incoming operation and returns its current
+// state. Entries that previously failed or were aborted by recovery are reset
+// so the client can retry with the same operationId.
+func (s *Store) journalReceive(ctx context.Context, req TransferRequest) (string, error) {
+	if _, err := s.journalClaim(ctx, req); err != nil {
+		return "", err
+	}
+	var state string
+	err := s.pool.QueryRow(ctx, "SELECT state FROM op_journal WHERE operation_id=$1", req.OperationID).Scan(&state)
+	return state, err
+}
+
+// journalClaim records an incoming operation like journalReceive and
+// reports whether this call did: it inserted the entry or reset a failed
+// or aborted one. Callers not holding the operation lock move an entry on
+// only when they claimed it, since a received entry may be another
+// request's.
+func (s *Store) journalClaim(ctx context.Context, req TransferRequest) (bool, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	tag, err := s.pool.Exec(ctx, `
+		INSERT INTO op_journal (operation_id, state, request, request_id) VALUES ($1, $2, $3, $6)
+		ON CONFLICT (operation_id) DO UPDATE
+		SET state=EXCLUDED.state, request=EXCLUDED.request, request_id=EXCLUDED.request_id, response=NULL, error=NULL, updated_at=now()
+		WHERE op_journal.state IN ($4, $5)`,
+		req.OperationID, journalReceived, payload, journalFailed, journalAborted, metaFromContext(ctx).RequestID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// journalMark moves an operation to state. resp and errMsg are optional and
+// only overwrite the stored values when set.
+func journalMark(ctx context.Context, db execer, operationID, state string, resp *TransferResponse, errMsg string) error {
+	var payload []byte
+	if resp != nil {
+		var err error
+		if payload, err = json.Marshal(resp); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(ctx, `
+		UPDATE op_journal
+		SET state=$2, response=COALESCE($3, response), error=NULLIF($4, ''), updated_at=now()
+		WHERE operation_id=$1`,
+		operationID, state, payload, errMsg)
+	return err
+}
+
+// markJournal is the best-effort variant used outside the transaction: a
+// failing journal write must not change the outcome already decided for the
+// client.
+func (s *Store) markJournal(ctx context.Context, operationID, state string, errMsg string) {
+	if operationID == "" {
+		return
+	}
+	if err := journalMark(context.WithoutCancel(ctx), s.pool, operationID, state, nil, errMsg); err != nil {
+		logger(ctx).Error("journal transition", "operation_id", operationID, "state", state, "error", err)
+	}
+}
+
+// recoverJournal resolves operations left behind by a crashed instance.
+// Entries younger than grace are skipped since another replica may still be
+// working on them.
+func (s *Store) recoverJournal(ctx context.Context, grace time.Duration) error {
+	cutoff := time.Now().Add(-grace)
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT operation_id FROM op_journal
+		WHERE state=$1 AND updated_at < $2`, journalCommitted, cutoff)
+	if err != nil {
+		return fmt.Errorf("load committed journal entries: %w", err)
+	}
+	var committed []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		committed = append(committed, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range committed {
+		if _, err := s.pool.Exec(ctx, "INSERT INTO processed_ops (operation_id) VALUES ($1) ON CONFLICT DO NOTHING", id); err != nil {
+			return fmt.Errorf("mark %s processed: %w", id, err)
+		}
+		if err := journalMark(ctx, s.pool, id, journalRecovered, nil, ""); err != nil {
+			return fmt.Errorf("mark %s recovered: %w", id, err)
+		}
+		journalRecoveries.WithLabelValues(journalCommitted).Inc()
+		slog.Warn("journal recovery: committed but never responded, marked recovered", "operation_id", id)
+	}
+
+	tag, err := s.pool.Exec(ctx, `
+		UPDATE op_journal SET state=$1, error='abandoned before commit', updated_at=now()
+		WHERE state IN ($2, $3) AND updated_at < $4`,
+		journalAborted, journalReceived, journalExecuting, cutoff)
+	if err != nil {
+		return fmt.Errorf("abort stale journal entries: %w", err)
+	}
+	if n := tag.RowsAffected(); n > 0 {
+		journalRecoveries.WithLabelValues(journalExecuting).Add(float64(n))
+		slog.Warn("journal recovery: abandoned before commit, marked aborted", "operations", n)
+	}
+	return nil
+}
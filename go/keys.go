@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// All key material the service uses lives in one keyring, loaded from
+// KEYRING_SOURCE and refreshed every KEYRING_REFRESH_INTERVAL. Keys are
+// grouped by purpose; each purpose has exactly one active key, used to sign,
+// MAC or encrypt, and any number of verify keys that are still accepted for
+// verification and decryption. Every output carries the id of the key that
+// produced it, so rotating is: add the new key as active and demote the old
+// one to verify in the source; drop it once nothing signed with it is still
+// in use.
+//
+// Sources:
+//
+//	file:///etc/fintech/keyring.json      keyring JSON on disk
+//	vault://secret/fintech/keyring        Vault KV v2 (see vault.go);
+//	                                      the secret's "keyring" field holds the JSON
+//	awskms:///etc/fintech/keyring.enc     keyring JSON encrypted with AWS KMS,
+//	                                      decrypted with the ambient AWS credentials
+//
+// Without KEYRING_SOURCE, ATTESTATION_KEY_FILE (a PKCS#8 Ed25519 PEM) is
+// still honoured as a keyring holding only the attestation key.
+
+type keyPurpose string
+
+const (
+	purposeAttestation    keyPurpose = "attestation"
+	purposeWebhook        keyPurpose = "webhook"
+	purposeRequestSigning keyPurpose = "request_signing"
+	purposePII            keyPurpose = "pii"
+)
+
+// purposeAlgorithms fixes the algorithm of each purpose, so a keyring cannot
+// hand an HMAC secret to the attestation signer.
+var purposeAlgorithms = map[keyPurpose]string{
+	purposeAttestation:    "ed25519",
+	purposeWebhook:        "hmac-sha256",
+	purposeRequestSigning: "hmac-sha256",
+	purposePII:            "aes-256-gcm",
+}
+
+const (
+	keyActive = "active"
+	keyVerify = "verify"
+)
+
+var errNoActiveKey = errors.New("no active key")
+
+type managedKey struct {
+	ID        string     `json:"id"`
+	Purpose   keyPurpose `json:"purpose"`
+	Algorithm string     `json:"algorithm"`
+	Status    string     `json:"status"`
+	// Material is the Ed25519 seed, HMAC secret or AES key, base64 in JSON.
+	Material  []byte    `json:"material"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (k *managedKey) validate() error {
+	want, ok := purposeAlgorithms[k.Purpose]
+	if !ok {
+		return fmt.Errorf("key %s: unknown purpose %q", k.ID, k.Purpose)
+	}
+	if k.Algorithm != want {
+		return fmt.Errorf("key %s: purpose %s requires %s, got %q", k.ID, k.Purpose, want, k.Algorithm)
+	}
+	if k.Status != keyActive && k.Status != keyVerify {
+		return fmt.Errorf("key %s: status must be %s or %s", k.ID, keyActive, keyVerify)
+	}
+	switch k.Algorithm {
+	case "ed25519":
+		if len(k.Material) != ed25519.SeedSize {
+			return fmt.Errorf("key %s: ed25519 seed must be %d bytes", k.ID, ed25519.SeedSize)
+		}
+	case "hmac-sha256":
+		if len(k.Material) < 32 {
+			return fmt.Errorf("key %s: hmac secret must be at least 32 bytes", k.ID)
+		}
+	case "aes-256-gcm":
+		if len(k.Material) != 32 {
+			return fmt.Errorf("key %s: aes-256 key must be 32 bytes", k.ID)
+		}
+	}
+	return nil
+}
+
+// publicKey is the Ed25519 verification key of a signing key.
+func (k *managedKey) publicKey() ed25519.PublicKey {
+	return ed25519.NewKeyFromSeed(k.Material).Public().(ed25519.PublicKey)
+}
+
+func (k *managedKey) sign(msg []byte) []byte {
+	return ed25519.Sign(ed25519.NewKeyFromSeed(k.Material), msg)
+}
+
+func (k *managedKey) mac(msg []byte) []byte {
+	m := hmac.New(sha256.New, k.Material)
+	m.Write(msg)
+	return m.Sum(nil)
+}
+
+// keyring is an immutable, validated view of the loaded keys.
+type keyring struct {
+	byID   map[string]*managedKey
+	active map[keyPurpose]*managedKey
+	keys   []*managedKey
+}
+
+func parseKeyring(raw []byte) (*keyring, error) {
+	var doc struct {
+		Keys []*managedKey `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("keyring: %w", err)
+	}
+	return newKeyring(doc.Keys)
+}
+
+func newKeyring(keys []*managedKey) (*keyring, error) {
+	r := &keyring{byID: map[string]*managedKey{}, active: map[keyPurpose]*managedKey{}, keys: keys}
+	for _, k := range keys {
+		if err := k.validate(); err != nil {
+			return nil, err
+		}
+		if _, dup := r.byID[k.ID]; dup || k.ID == "" {
+			return nil, fmt.Errorf("keyring: key id %q is empty or repeated", k.ID)
+		}
+		r.byID[k.ID] = k
+		if k.Status == keyActive {
+			if prev := r.active[k.Purpose]; prev != nil {
+				return nil, fmt.Errorf("keyring: purpose %s has two active keys (%s, %s)", k.Purpose, prev.ID, k.ID)
+			}
+			r.active[k.Purpose] = k
+		}
+	}
+	return r, nil
+}
+
+type keySource interface {
+	load(ctx context.Context) ([]byte, error)
+}
+
+type keyManager struct {
+	source keySource
+	ring   atomic.Pointer[keyring]
+}
+
+// keyManagerFromEnv loads the keyring once; a service configured with keys
+// it cannot load must not start.
+func keyManagerFromEnv(ctx context.Context) (*keyManager, error) {
+	m := &keyManager{}
+	spec := os.Getenv("KEYRING_SOURCE")
+	if spec == "" {
+		ring, err := legacyAttestationKeyring()
+		if err != nil {
+			return nil, err
+		}
+		m.ring.Store(ring)
+		return m, nil
+	}
+	src, err := parseKeySource(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	m.source = src
+	if err := m.reload(ctx); err != nil {
+		return nil, err
+	}
+	ring := m.ring.Load()
+	slog.Info("keyring loaded", "source", spec, "keys", len(ring.keys))
+	return m, nil
+}
+
+func parseKeySource(ctx context.Context, spec string) (keySource, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("KEYRING_SOURCE: %w", err)
+	}
+	switch u.Scheme {
+	case "file":
+		return fileKeySource{path: u.Path}, nil
+	case "vault":
+		vault, err := vaultFromEnv()
+		if err != nil {
+			return nil, fmt.Errorf("KEYRING_SOURCE vault://: %w", err)
+		}
+		return &vaultKeySource{vault: vault, mount: u.Host, path: strings.TrimPrefix(u.Path, "/")}, nil
+	case "awskms":
+		cfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("KEYRING_SOURCE awskms://: %w", err)
+		}
+		return kmsKeySource{path: u.Path, client: kms.NewFromConfig(cfg)}, nil
+	}
+	return nil, fmt.Errorf("KEYRING_SOURCE: unsupported scheme %q", u.Scheme)
+}
+
+// legacyAttestationKeyring wraps ATTESTATION_KEY_FILE, keeping the key id
+// attestations were issued under before the keyring existed.
+func legacyAttestationKeyring() (*keyring, error) {
+	path := os.Getenv("ATTESTATION_KEY_FILE")
+	if path == "" {
+		return newKeyring(nil)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ATTESTATION_KEY_FILE: %w", err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("ATTESTATION_KEY_FILE: no PEM block")
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ATTESTATION_KEY_FILE: %w", err)
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("ATTESTATION_KEY_FILE: not an Ed25519 key")
+	}
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	return newKeyring([]*managedKey{{
+		ID: hex.EncodeToString(sum[:8]), Purpose: purposeAttestation, Algorithm: "ed25519", Status: keyActive, Material: key.Seed(),
+	}})
+}
+
+func (m *keyManager) reload(ctx context.Context) error {
+	raw, err := m.source.load(ctx)
+	if err != nil {
+		return err
+	}
+	ring, err := parseKeyring(raw)
+	if err != nil {
+		return err
+	}
+	m.ring.Store(ring)
+	return nil
+}
+
+// watch re-reads the source so rotations apply without a restart. A
+// keyring that fails to load or validate leaves the current one in place.
+func (m *keyManager) watch(ctx context.Context, every time.Duration) {
+	if m.source == nil {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := m.reload(ctx); err != nil {
+				slog.Error("reload keyring", "error", err)
+			}
+		}
+	}
+}
+
+// active returns the key new outputs for purpose are produced with.
+func (m *keyManager) active(purpose keyPurpose) (*managedKey, error) {
+	k := m.ring.Load().active[purpose]
+	if k == nil {
+		return nil, fmt.Errorf("%w for %s", errNoActiveKey, purpose)
+	}
+	return k, nil
+}
+
+// lookup finds a key by the id carried in a payload; it must belong to
+// purpose, so an id from one context cannot select a key of another.
+func (m *keyManager) lookup(purpose keyPurpose, id string) *managedKey {
+	k := m.ring.Load().byID[id]
+	if k == nil || k.Purpose != purpose {
+		return nil
+	}
+	return k
+}
+
+// verificationKeys lists the keys of purpose still accepted, active first.
+func (m *keyManager) verificationKeys(purpose keyPurpose) []*managedKey {
+	var out []*managedKey
+	for _, k := range m.ring.Load().keys {
+		if k.Purpose == purpose {
+			out = append(out, k)
+		}
+	}
+	slices.SortStableFunc(out, func(a, b *managedKey) int {
+		switch {
+		case a.Status == b.Status:
+			return 0
+		case a.Status == keyActive:
+			return -1
+		}
+		return 1
+	})
+	return out
+}
+
+// mac signs msg with the active key of purpose.
+func (m *keyManager) mac(purpose keyPurpose, msg []byte) (keyID string, sum []byte, err error) {
+	k, err := m.active(purpose)
+	if err != nil {
+		return "", nil, err
+	}
+	return k.ID, k.mac(msg), nil
+}
+
+func (m *keyManager) verifyMAC(purpose keyPurpose, keyID string, msg, sum []byte) bool {
+	k := m.lookup(purpose, keyID)
+	return k != nil && hmac.Equal(k.mac(msg), sum)
+}
+
+// encrypt seals plaintext with the active key of purpose as
+// "<key id>:<base64 nonce||ciphertext>"; aad binds it to its context (e.g.
+// the row and column it is stored in) so it cannot be moved elsewhere.
+func (m *keyManager) encrypt(purpose keyPurpose, plaintext, aad []byte) (string, error) {
+	k, err := m.active(purpose)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(k.Material)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return k.ID + ":" + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, aad)), nil
+}
+
+func (m *keyManager) decrypt(purpose keyPurpose, sealed string, aad []byte) ([]byte, error) {
+	id, enc, ok := strings.Cut(sealed, ":")
+	if !ok {
+		return nil, errors.New("sealed value has no key id")
+	}
+	k := m.lookup(purpose, id)
+	if k == nil {
+		return nil, fmt.Errorf("unknown %s key %q", purpose, id)
+	}
+	raw, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(k.Material)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < aead.NonceSize() {
+		return nil, errors.New("sealed value is truncated")
+	}
+	return aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type fileKeySource struct{ path string }
+
+func (s fileKeySource) load(context.Context) ([]byte, error) {
+	return os.ReadFile(s.path)
+}
+
+// vaultKeySource reads a KV v2 secret.
+type vaultKeySource struct {
+	vault       *vaultClient
+	mount, path string
+}
+
+func (s *vaultKeySource) load(ctx context.Context) ([]byte, error) {
+	var body struct {
+		Data struct {
+			Data map[string]json.RawMessage `json:"data"`
+		} `json:"data"`
+	}
+	if err := s.vault.do(ctx, http.MethodGet, s.mount+"/data/"+s.path, nil, &body); err != nil {
+		return nil, err
+	}
+	field, ok := body.Data.Data["keyring"]
+	if !ok {
+		return nil, fmt.Errorf("vault: %s/%s has no keyring field", s.mount, s.path)
+	}
+	// the field may hold the keyring as an object or as a JSON string
+	var s2 string
+	if json.Unmarshal(field, &s2) == nil {
+		return []byte(s2), nil
+	}
+	return field, nil
+}
+
+// kmsKeySource decrypts a KMS ciphertext blob; the blob names its key, so
+// no key id is configured here.
+type kmsKeySource struct {
+	path   string
+	client *kms.Client
+}
+
+func (s kmsKeySource) load(ctx context.Context) ([]byte, error) {
+	blob, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return nil, fmt.Errorf("kms: %w", err)
+	}
+	return out.Plaintext, nil
+}
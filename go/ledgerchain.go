@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Every ledger entry carries a hash chaining it to the previous entry of
+// the same account:
+//
+//	hash = SHA-256(prev hash || type \t amount \t currency \t fx_rate \t at \t transfer_id \t counterparty)
+//
+// with at in RFC 3339 (UTC, nanoseconds) and empty fields for NULLs. The
+// first entry of an account chains to nothing. Chains are per account
+// because the account row lock, which every transfer takes before writing
+// its ledger rows, already orders an account's entries; one chain over the
+// whole ledger would need a lock every transfer contends on.
+//
+// Editing, removing or reordering an entry breaks the link to the next
+// one. Removing the newest entries of an account leaves a shorter, valid
+// chain; the Merkle roots cover that once the entries are sealed.
+//
+// Compaction moves entries with their hashes to ledger_archive, so the
+// chain is walked over the archive in place of the summaries. Entries
+// written before the chain existed have no hash; a chain starts at an
+// account's first hashed entry.
+
+type ledgerEntry struct {
+	typ, accountID, currency string
+	amount                   Money
+	at                       time.Time
+	transferID               int64
+	fxRate                   string // "" when there was no conversion
+	counterparty             string
+}
+
+func (e ledgerEntry) hash(prev []byte) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	h.Write([]byte(strings.Join([]string{
+		e.typ, e.amount.String(), e.currency, e.fxRate,
+		e.at.UTC().Format(time.RFC3339Nano), strconv.FormatInt(e.transferID, 10), e.counterparty,
+	}, "\t")))
+	return h.Sum(nil)
+}
+
+// insertLedgerEntry appends e to its account's chain. The caller must hold
+// the account's row lock.
+func insertLedgerEntry(ctx context.Context, tx pgx.Tx, e ledgerEntry) error {
+	// hash what the column keeps
+	e.at = e.at.Truncate(time.Microsecond)
+	var prev []byte
+	err := tx.QueryRow(ctx, `
+		SELECT hash FROM (
+			(SELECT id, hash FROM ledger WHERE account_id = $1 AND hash IS NOT NULL ORDER BY id DESC LIMIT 1)
+			UNION ALL
+			(SELECT id, hash FROM ledger_archive WHERE account_id = $1 AND hash IS NOT NULL ORDER BY id DESC LIMIT 1)
+		) h ORDER BY id DESC LIMIT 1`, e.accountID).Scan(&prev)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("chain head: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO ledger (type, account_id, amount, at, transfer_id, currency, fx_rate, counterparty_account_id, hash)
+		VALUES ($1,$2,$3,$4,$5,$6,NULLIF($7,'')::numeric,$8,$9)`,
+		e.typ, e.accountID, e.amount, e.at, e.transferID, e.currency, e.fxRate, e.counterparty, e.hash(prev))
+	return err
+}
+
+// insertTransferEntries writes both sides of a movement from one account to
+// another. Both sides carry the transfer id, which is the transaction id
+// pairing them, and each names the other's account as counterparty.
+func insertTransferEntries(ctx context.Context, tx pgx.Tx, transferID int64, at time.Time, from, to ledgerEntry) error {
+	from.typ, from.counterparty, from.transferID, from.at = "DEBIT", to.accountID, transferID, at
+	to.typ, to.counterparty, to.transferID, to.at = "CREDIT", from.accountID, transferID, at
+	if err := insertLedgerEntry(ctx, tx, from); err != nil {
+		return fmt.Errorf("insert debit ledger: %w", err)
+	}
+	if err := insertLedgerEntry(ctx, tx, to); err != nil {
+		return fmt.Errorf("insert credit ledger: %w", err)
+	}
+	return nil
+}
+
+type chainBreak struct {
+	AccountID  string  `json:"accountId"`
+	LedgerID   int64   `json:"ledgerId"`
+	Reason     string  `json:"reason"`
+	Expected   string  `json:"expectedHash"`
+	Stored     *string `json:"storedHash"`
+	PreviousID *int64  `json:"previousLedgerId"`
+}
+
+type chainReport struct {
+	OK        bool        `json:"ok"`
+	Accounts  int         `json:"accounts"`
+	Entries   int         `json:"entries"`
+	Unchained int         `json:"unchained"`
+	Broken    *chainBreak `json:"brokenLink,omitempty"`
+}
+
+// verifyChain walks one account's chain and returns the first broken link.
+// Unhashed entries before the chain starts are counted, not checked.
+func (s *Store) verifyChain(ctx context.Context, accountID string, report *chainReport) (*chainBreak, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, type, amount, currency, COALESCE(fx_rate::text, ''), at, COALESCE(transfer_id, 0), COALESCE(counterparty_account_id, ''), hash
+		FROM ledger WHERE account_id = $1 AND summary_entries IS NULL
+		UNION ALL
+		SELECT id, type, amount, currency, COALESCE(fx_rate::text, ''), at, COALESCE(transfer_id, 0), COALESCE(counterparty_account_id, ''), hash
+		FROM ledger_archive WHERE account_id = $1
+		ORDER BY id`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var (
+		prev   []byte
+		prevID *int64
+	)
+	for rows.Next() {
+		var (
+			id     int64
+			e      = ledgerEntry{accountID: accountID}
+			stored []byte
+		)
+		if err := rows.Scan(&id, &e.typ, &e.amount, &e.currency, &e.fxRate, &e.at, &e.transferID, &e.counterparty, &stored); err != nil {
+			return nil, err
+		}
+		if prevID == nil && stored == nil {
+			report.Unchained++
+			continue
+		}
+		report.Entries++
+		want := e.hash(prev)
+		if !bytes.Equal(stored, want) {
+			b := &chainBreak{AccountID: accountID, LedgerID: id, Reason: "hash mismatch", Expected: hex.EncodeToString(want), PreviousID: prevID}
+			if stored == nil {
+				b.Reason = "missing hash"
+			} else {
+				h := hex.EncodeToString(stored)
+				b.Stored = &h
+			}
+			return b, nil
+		}
+		prev, prevID = stored, &id
+	}
+	return nil, rows.Err()
+}
+
+// handleVerifyLedger checks the hash chains of every account, or of the one
+// named by accountId, and reports the first broken link.
+func (s *Store) handleVerifyLedger(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	accounts := []string{r.URL.Query().Get("accountId")}
+	if accounts[0] == "" {
+		rows, err := s.pool.Query(ctx, "SELECT id FROM accounts ORDER BY id")
+		if err == nil {
+			accounts, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		}
+		if err != nil {
+			http.Error(w, "failed to list accounts", http.StatusInternalServerError)
+			return
+		}
+	}
+	report := chainReport{OK: true}
+	for _, id := range accounts {
+		b, err := s.verifyChain(ctx, id, &report)
+		if err != nil {
+			logger(ctx).Error("verify ledger chain", "account_id", id, "error", err)
+			http.Error(w, "failed to verify ledger", http.StatusInternalServerError)
+			return
+		}
+		report.Accounts++
+		if b != nil {
+			report.OK, report.Broken = false, b
+			logger(ctx).Warn("ledger chain broken", "account_id", id, "ledger_id", b.LedgerID, "reason", b.Reason)
+			break
+		}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
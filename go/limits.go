@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Daily limits cap what an account may send per day: its DEBIT ledger rows
+// since midnight in the tenant's time zone, on the tenant's clock, plus the
+// transfer and its fee. The account's daily_limit wins over the tenant's
+// dailyLimit; with neither there is no cap. The sum runs inside the
+// transfer transaction, after the sender's row lock, so two transfers from
+// one account cannot both squeeze under the cap. Movements out of system
+// accounts and internal ones such as sweeps are not capped, though their
+// debits count towards the day. Balance adjustments do not: an operator
+// correcting a balance is not the customer sending money.
+//
+// The per-transfer maximum, transfer_limit or the tenant's transferLimit,
+// is checked with the rest of the pricing in priceTransfer.
+
+// dailyUsage is the sender's daily limit and what it has used with the
+// transfer being checked; limit is nil when there is no cap.
+type dailyUsage struct {
+	limit *Money
+	used  Money
+}
+
+// checkDailyLimit returns 400 with errDailyLimitExceeded when the transfer
+// would take the sender over its daily limit.
+func (s *Store) checkDailyLimit(ctx context.Context, tx pgx.Tx, req TransferRequest, from *lockedAccount, fee Money, now time.Time) (dailyUsage, int, error) {
+	if isSystemAccount(req.FromAccountID) || req.internal {
+		return dailyUsage{}, http.StatusOK, nil
+	}
+	cfg := s.tenants.effective(from.tenantID)
+	limit := from.dailyLimit
+	if limit == nil {
+		limit = cfg.DailyLimit
+	}
+	if limit == nil {
+		return dailyUsage{}, http.StatusOK, nil
+	}
+	spent, err := debitedSince(ctx, tx, req.FromAccountID, dayStart(now, cfg))
+	if err != nil {
+		return dailyUsage{}, http.StatusInternalServerError, fmt.Errorf("sum today's debits: %w", err)
+	}
+	if spent+req.Amount+fee > *limit {
+		return dailyUsage{}, http.StatusBadRequest, fmt.Errorf("%w: %s left today", errDailyLimitExceeded, max(*limit-spent, 0))
+	}
+	return dailyUsage{limit: limit, used: spent + req.Amount + fee}, http.StatusOK, nil
+}
+
+// debitedSince sums the account's debits from since on that count against
+// its daily limit.
+func debitedSince(ctx context.Context, db querier, accountID string, since time.Time) (Money, error) {
+	var spent Money
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(sum(amount), 0) FROM ledger
+		WHERE account_id=$1 AND type='DEBIT' AND at >= $2 AND counterparty_account_id IS DISTINCT FROM $3`,
+		accountID, since, adjustmentsAccountID).Scan(&spent)
+	return spent, err
+}
+
+// Soft limits warn instead of refusing. A transfer that succeeds but takes
+// the sender to limitWarningPercent of its daily limit (LIMIT_WARNING_PERCENT,
+// default 80) or its available balance below lowBalanceWarning
+// (LOW_BALANCE_WARNING, default none) answers with warnings, so clients can
+// tell the customer before the next transfer fails. They are computed in
+// the transfer transaction and stored with the response, so a replay
+// carries the same warnings. Movements out of system accounts and internal
+// ones get none.
+const (
+	warningDailyLimit = "daily_limit_near"
+	warningLowBalance = "low_balance"
+)
+
+// transferWarning is one soft limit the transfer reached. For
+// daily_limit_near Limit is the daily limit and Remaining what is left of
+// it today; for low_balance Limit is the threshold and Remaining the
+// available balance.
+type transferWarning struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Limit     Money  `json:"limit"`
+	Remaining Money  `json:"remaining"`
+}
+
+// limitWarnings returns the soft limits a completed transfer reached;
+// available is the sender's balance less its holds after the transfer.
+func (s *Store) limitWarnings(req TransferRequest, from *lockedAccount, usage dailyUsage, available Money) []transferWarning {
+	if isSystemAccount(req.FromAccountID) || req.internal {
+		return nil
+	}
+	cfg := s.tenants.effective(from.tenantID)
+	var warnings []transferWarning
+	if usage.limit != nil && cfg.LimitWarningPercent > 0 && usage.used*100 >= *usage.limit*Money(cfg.LimitWarningPercent) {
+		left := *usage.limit - usage.used
+		warnings = append(warnings, transferWarning{Code: warningDailyLimit,
+			Message: fmt.Sprintf("%d%% of the daily limit used, %s left today", int64(usage.used*100 / *usage.limit), left),
+			Limit:   *usage.limit, Remaining: left})
+	}
+	if cfg.LowBalanceWarning != nil && available < *cfg.LowBalanceWarning {
+		warnings = append(warnings, transferWarning{Code: warningLowBalance,
+			Message: fmt.Sprintf("available balance %s is below %s", available, *cfg.LowBalanceWarning),
+			Limit:   *cfg.LowBalanceWarning, Remaining: available})
+	}
+	return warnings
+}
+
+// dayStart is midnight of now's day in the tenant's time zone.
+func dayStart(now time.Time, cfg effectiveConfig) time.Time {
+	t := now.In(cfg.formatter().Location)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
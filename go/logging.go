@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// setupLogging installs a JSON slog handler as the default logger, at the
+// level given by LOG_LEVEL (debug, info, warn, error; default info).
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(envOrDefault("LOG_LEVEL", "info"))); err != nil {
+		fatal("invalid LOG_LEVEL", "error", err)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+}
+
+// logger returns the default logger annotated with the request ID carried in
+// ctx, if any.
+func logger(ctx context.Context) *slog.Logger {
+	if id := metaFromContext(ctx).RequestID; id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// withRequestID makes sure every request carries an X-Request-ID: a
+// well-formed one from the caller is kept so IDs propagate across services,
+// anything else is replaced by a fresh one. The ID is echoed on the response
+// before the handler runs, so error bodies can include it too.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		// handlers that identify the caller replace this with metaFromRequest
+		next.ServeHTTP(w, r.WithContext(withMeta(r.Context(), requestMeta{Client: "unknown", Tenant: "default", RequestID: id})))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	return strings.IndexFunc(id, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.')
+	}) < 0
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,42 +1,141 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+
+	"fintech-go/internal/ledger"
+	"fintech-go/internal/store"
 )
 
 type TransferRequest struct {
-	FromAccountID string  `json:"fromAccountId"`
-	ToAccountID   string  `json:"toAccountId"`
-	Amount        float64 `json:"amount"`
-	OperationID   string  `json:"operationId"`
+	FromAccountID string   `json:"fromAccountId"`
+	ToAccountID   string   `json:"toAccountId"`
+	Amount        Money    `json:"amount"`
+	OperationID   string   `json:"operationId"`
+	Geo           *GeoInfo `json:"geo,omitempty"`
+	// FxRate converts a transfer between accounts of different currencies;
+	// without it the rate provider is asked.
+	FxRate *fxRate `json:"fxRate,omitempty"`
+	// QuoteID executes the transfer at the fee and rate of a quote from
+	// POST /transfer/quote.
+	QuoteID string `json:"quoteId,omitempty"`
+
+	// reverses links a returned payout's re-credit to the original
+	// transfer; it is set internally, never by clients.
+	reverses int64
+	// virtualAccount is the virtual account an inbound credit was addressed
+	// to, recorded so the client can attribute it.
+	virtualAccount string
+	// internal marks movements between a customer's own accounts, such as
+	// sweeps: they pay no tenant transfer fee and are not held to the daily
+	// limit.
+	internal bool
+	// standingOrder is the standing order an execution belongs to.
+	standingOrder int64
+	// screened is set by runTransfer when the risk rules apply, so the
+	// pre-commit checks run inside the transaction too.
+	screened bool
+	// hold is the authorization hold a capture books; see holds.go.
+	hold int64
+	// approval is the review case a reviewer released the transfer from;
+	// see handleApproveCase.
+	approval *caseApproval
+	// atomic marks an item of an all-or-nothing batch; see batch.go.
+	atomic bool
+}
+
+// GeoInfo is caller-declared origin metadata, used by geofencing rules
+// alongside the country resolved from the caller IP.
+type GeoInfo struct {
+	Country string `json:"country"`
 }
 
 type TransferResponse struct {
-	Status   string             `json:"status"`
-	Message  string             `json:"message"`
-	Balances map[string]float64 `json:"balances,omitempty"`
+	Status   string           `json:"status"`
+	Message  string           `json:"message"`
+	Balances map[string]Money `json:"balances,omitempty"`
+	CaseID   int64            `json:"caseId,omitempty"`
+	Fee      *Money           `json:"fee,omitempty"`
+	FX       *fxConversion    `json:"fx,omitempty"`
+	// ReceiptNumber is the completed transfer's reference for support.
+	ReceiptNumber string `json:"receiptNumber,omitempty"`
+	// RequestID is filled on error responses so support can find the
+	// matching log lines.
+	RequestID string `json:"requestId,omitempty"`
+	// Support is the white-label partner's contact, on error responses.
+	Support *supportContact `json:"support,omitempty"`
+	// Warnings lists the sender's soft limits a completed transfer reached
+	// (see limits.go).
+	Warnings []transferWarning `json:"warnings,omitempty"`
+
+	// raw, when set, is the exact body to send instead of re-encoding; it
+	// carries stored responses through to replays.
+	raw []byte
 }
 
 type LedgerEntry struct {
-	Type      string  `json:"type"`
-	AccountID string  `json:"accountId"`
-	Amount    float64 `json:"amount"`
-	At        string  `json:"at"`
+	Type      string `json:"type"`
+	AccountID string `json:"accountId"`
+	Amount    Money  `json:"amount"`
+	At        string `json:"at"`
 }
 
 type Store struct {
 	pool *pgxpool.Pool
+	// locks holds the connections of the operation locks (see oplock.go);
+	// nil takes them from pool.
+	locks      *pgxpool.Pool
+	isoLevel   pgx.TxIsoLevel
+	maxRetries int
+	lockWait   time.Duration
+	risk       []riskRule
+	checks     []transferCheck
+	rules      *dslEngine
+	tenants    *tenantConfigs
+	health     *healthMonitor
+	keys       *keyManager
+	rates      rateProvider
+	flags      *runtimeFlags
+	// outbox turns on the outbox writes; see outbox.go.
+	outbox bool
+	// webhooks turns on queueing webhook deliveries; see webhooks.go.
+	webhooks  bool
+	templates *messageTemplates
+	clocks    *tenantClocks
+	stats     *statsCache
+	cache     readCaches
+	// apiKeys is the API key authenticator, when API_KEYS_FILE is set; see
+	// apikeys.go.
+	apiKeys *apiKeyAuth
+	// limiter rate limits batch items; see ratelimit.go.
+	limiter *rateLimiter
+
+	jobHandlers map[string]jobHandler
 }
 
 var (
@@ -54,39 +153,561 @@ var (
 		},
 		[]string{"account"},
 	)
+	legacyRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "legacy_api_requests_total",
+			Help: "Requisições aos caminhos sem versão (obsoletos), por rota.",
+		},
+		[]string{"handler"},
+	)
+	journalRecoveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "journal_recoveries_total",
+			Help: "Operações do journal resolvidas na inicialização, por estado encontrado.",
+		},
+		[]string{"state"},
+	)
+	txRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transfer_tx_retries_total",
+			Help: "Transações de transferência repetidas após conflito, por motivo.",
+		},
+		[]string{"reason"},
+	)
+	opLockConflicts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "idempotency_lock_conflicts_total",
+			Help: "Requisições concorrentes com o mesmo operationId, por desfecho.",
+		},
+		[]string{"outcome"},
+	)
+	duplicateSubmissions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "duplicate_submissions_total",
+			Help: "Reenvios de operationId já processado, por cliente e se os parâmetros conferem com o original.",
+		},
+		[]string{"client", "params"},
+	)
+	duplicateAge = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "duplicate_original_age_seconds",
+			Help:    "Idade da operação original no momento do reenvio.",
+			Buckets: []float64{1, 5, 30, 60, 300, 900, 3600, 21600, 86400},
+		},
+		[]string{"client"},
+	)
+	idempotencyMismatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "idempotency_key_mismatch_total",
+			Help: "Reenvios com operationId repetido e parâmetros diferentes (candidato a alerta).",
+		},
+		[]string{"client"},
+	)
+	riskRuleHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "risk_rule_hits_total",
+			Help: "Regras de risco acionadas, por regra e decisão.",
+		},
+		[]string{"rule", "decision"},
+	)
+	dslRuleHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "risk_dsl_rule_hits_total",
+			Help: "Regras do DSL de monitoramento que casaram, por regra e versão do conjunto.",
+		},
+		[]string{"rule", "version"},
+	)
+	rulesetVersion = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "risk_ruleset_version",
+			Help: "Versão do conjunto de regras de monitoramento ativo.",
+		},
+	)
+	pendingExpired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pending_expired_total",
+			Help: "Itens pendentes cancelados por expiração, por estado.",
+		},
+		[]string{"state"},
+	)
+	jobsFinished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "jobs_finished_total",
+			Help: "Jobs em background finalizados, por tipo e status.",
+		},
+		[]string{"type", "status"},
+	)
+	suspensePostings = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "suspense_postings_total",
+			Help: "Créditos recebidos sem conta correspondente e lançados em suspense, por motivo.",
+		},
+		[]string{"reason"},
+	)
+	payoutReturns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "payout_returns_total",
+			Help: "Pagamentos devolvidos pelo banco recebedor, por código de motivo.",
+		},
+		[]string{"reason"},
+	)
+	scheduledJobFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "scheduled_job_failures_total",
+			Help: "Execuções de agendamentos que falharam, por agendamento.",
+		},
+		[]string{"schedule"},
+	)
+	authFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "auth_failures_total",
+			Help: "Requisições rejeitadas pela autenticação, por motivo.",
+		},
+		[]string{"reason"},
+	)
+	scheduledTransfersRun = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "scheduled_transfer_runs_total",
+			Help: "Execuções de transferências agendadas por status resultante.",
+		},
+		[]string{"status"},
+	)
+	rateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transfer_rate_limited_total",
+			Help: "Transferências recusadas com 429 pelo limite de taxa, por escopo (account ou global).",
+		},
+		[]string{"scope"},
+	)
+	usageQuotaExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "usage_quota_exceeded_total",
+			Help: "Tenants que ultrapassaram a cota flexível de uso no mês, por medidor.",
+		},
+		[]string{"meter"},
+	)
+	httpDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "http_request_duration_seconds",
+			Help: "Duração das requisições HTTP da API por rota, resultado e tenant.",
+			// transfers sit in the tens of milliseconds; the tail buckets
+			// catch lock waits and retries
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"handler", "result", "tenant"},
+	)
+	grpcDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "grpc_request_duration_seconds",
+			Help:    "Duração das chamadas gRPC por método e código de resultado.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"method", "code"},
+	)
+	metricLabelOverflow = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metric_label_overflow_total",
+			Help: "Valores de label fora da lista permitida, agrupados em \"other\", por label.",
+		},
+		[]string{"label"},
+	)
+	httpInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Requisições HTTP da API em andamento por rota.",
+		},
+		[]string{"handler"},
+	)
+	queryPatternDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ledger_query_duration_seconds",
+			Help:    "Duração das consultas ao banco por padrão de acesso (statements, search, analytics).",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"pattern"},
+	)
+	outboxPublished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "outbox_events_total",
+			Help: "Eventos do outbox enviados ao Kafka, por resultado.",
+		},
+		[]string{"result"},
+	)
+	outboxLag = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "outbox_lag_seconds",
+			Help: "Idade do evento mais antigo ainda não publicado no outbox.",
+		},
+	)
+	webhookDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_deliveries_total",
+			Help: "Tentativas de entrega de webhooks, por resultado (delivered, retried, failed).",
+		},
+		[]string{"result"},
+	)
+	webhookQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "webhook_queue_depth",
+			Help: "Entregas de webhook pendentes, por tenant.",
+		},
+		[]string{"tenant"},
+	)
+	webhookQueueOldest = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "webhook_queue_oldest_due_seconds",
+			Help: "Atraso da entrega de webhook vencida mais antiga, por tenant.",
+		},
+		[]string{"tenant"},
+	)
+	instanceHealthScore = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "instance_health_score",
+			Help: "Score de saúde da instância (0-100) usado pelo balanceador para drenar instâncias degradadas.",
+		},
+	)
+	readCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "read_cache_requests_total",
+			Help: "Leituras dos caches em memória por cache e resultado (hit, miss).",
+		},
+		[]string{"cache", "result"},
+	)
+	reconciliationDrift = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "reconciliation_drift",
+			Help: "Soma das diferenças absolutas entre saldo e razão na última reconciliação completa, por moeda.",
+		},
+		[]string{"currency"},
+	)
 )
 
 func init() {
-	prometheus.MustRegister(transferRequests, accountBalance)
+	prometheus.MustRegister(transferRequests, accountBalance, journalRecoveries, txRetries, opLockConflicts,
+		duplicateSubmissions, duplicateAge, idempotencyMismatches, riskRuleHits, dslRuleHits, rulesetVersion,
+		pendingExpired, jobsFinished, suspensePostings, payoutReturns, scheduledJobFailures, authFailures, rateLimited, scheduledTransfersRun, usageQuotaExceeded, httpDuration, metricLabelOverflow, httpInFlight, queryPatternDuration, instanceHealthScore,
+		reconciliationDrift, outboxPublished, outboxLag, webhookDeliveries, webhookQueueDepth, webhookQueueOldest,
+		grpcDuration, legacyRequests, readCacheRequests)
 }
 
-func main() {
-	ctx := context.Background()
-	dsn := buildDSN()
-	pool, err := pgxpool.New(ctx, dsn)
+// runServe is the serve command: the service itself, running the given
+// roles until SIGINT or SIGTERM.
+func runServe(args []string) {
+	fs, configFile := commandFlags("serve")
+	role := fs.String("role", envOrDefault("ROLE", "all"), "comma-separated roles to run: api, worker, scheduler, relay or all")
+	selftest := fs.Bool("selftest", false, "run the startup self-test against the database, print the report and exit")
+	fs.Parse(args)
+	roles, err := parseRoles(*role)
 	if err != nil {
-		log.Fatalf("failed to open pool: %v", err)
+		fatal("invalid -role", "error", err)
 	}
-	store := &Store{pool: pool}
-	if err := store.seed(ctx); err != nil {
-		log.Fatalf("failed to seed database: %v", err)
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
 	}
 
-	http.HandleFunc("/transfer", store.handleTransfer)
-	http.HandleFunc("/debug/state", store.handleDebug)
-	http.Handle("/metrics", promhttp.Handler())
+	// ctx is cancelled by SIGINT/SIGTERM; the background loops watch it,
+	// request handlers do not and are drained by shutdown instead
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	switch envOrDefault("STORE", "postgres") {
+	case "postgres":
+	case "memory":
+		runMemoryServe(ctx, cfg)
+		return
+	default:
+		fatal("invalid STORE; want postgres or memory", "store", os.Getenv("STORE"))
+	}
 
-	log.Println("Go service listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
+	var background sync.WaitGroup
+	spawn := func(f func()) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			f()
+		}()
+	}
 
-func buildDSN() string {
-	host := envOrDefault("DB_HOST", "postgres")
-	port := envOrDefault("DB_PORT", "5432")
-	user := envOrDefault("DB_USER", "fintech")
-	pass := envOrDefault("DB_PASSWORD", "fintech")
-	name := envOrDefault("DB_NAME", "fintech")
-	return fmt.Sprintf("postgres://%s:%s@%s:%s/%s", user, pass, host, port, name)
+	setupTracing(ctx)
+	store, dbCreds := openStore(ctx, cfg)
+	pool, tenants, rules, keys := store.pool, store.tenants, store.rules, store.keys
+	// registered here rather than in init: the collector needs the pool
+	prometheus.MustRegister(newPoolCollector(pool))
+	if dbCreds != nil {
+		spawn(func() { dbCreds.run(ctx, pool) })
+	}
+	auths, err := authenticatorsFromEnv()
+	if err != nil {
+		fatal("invalid auth configuration", "error", err)
+	}
+	tlsConfig, err := tlsConfigFromEnv()
+	if err != nil {
+		fatal("invalid TLS configuration", "error", err)
+	}
+	if *selftest {
+		store.runSelfTestCommand(ctx)
+	}
+	if cfg.Features.MigrateOnBoot {
+		if err := store.prepareDatabase(ctx); err != nil {
+			fatal("failed to prepare database", "error", err)
+		}
+	} else if state, detail := checkSchemaVersion(ctx, store); state == checkFail {
+		fatal("database schema is not ready", "detail", detail)
+	}
+	if cfg.Features.SelftestOnBoot {
+		if report := store.selfTest(ctx); report.Status == checkFail {
+			fatal("self-test failed; see the failed checks above")
+		}
+	}
+	// every role that moves money enforces tenant limits and fees
+	if err := tenants.load(ctx, pool); err != nil {
+		fatal("failed to load tenant configs", "error", err)
+	}
+	spawn(func() { tenants.watch(ctx, pool, durationOrDefault("TENANT_CONFIG_REFRESH_INTERVAL", 30*time.Second)) })
+	if err := store.flags.load(ctx, pool); err != nil {
+		fatal("failed to load runtime flags", "error", err)
+	}
+	spawn(func() {
+		store.flags.watch(ctx, pool, durationOrDefault("RUNTIME_FLAGS_REFRESH_INTERVAL", 5*time.Second))
+	})
+	if err := store.clocks.load(ctx, pool); err != nil {
+		fatal("failed to load tenant clocks", "error", err)
+	}
+	spawn(func() {
+		store.clocks.watch(ctx, pool, durationOrDefault("TENANT_CLOCK_REFRESH_INTERVAL", 5*time.Second))
+	})
+	if err := store.templates.load(ctx, pool); err != nil {
+		fatal("failed to load message templates", "error", err)
+	}
+	spawn(func() {
+		store.templates.watch(ctx, pool, durationOrDefault("TEMPLATE_REFRESH_INTERVAL", 30*time.Second))
+	})
+	for _, a := range auths {
+		if k, ok := a.(*apiKeyAuth); ok {
+			store.apiKeys = k
+		}
+	}
+	if roles[roleAPI] && store.apiKeys != nil {
+		if err := store.apiKeys.load(ctx, pool); err != nil {
+			fatal("failed to load api keys", "error", err)
+		}
+		spawn(func() { store.apiKeys.watch(ctx, pool, durationOrDefault("API_KEYS_REFRESH_INTERVAL", 15*time.Second)) })
+	}
+	if roles[roleAPI] {
+		if err := store.refreshBalanceGauges(ctx); err != nil {
+			fatal("failed to load balances", "error", err)
+		}
+		// only API processes create journal entries, so only they recover them
+		if err := store.recoverJournal(ctx, cfg.Timeouts.JournalRecoveryGrace); err != nil {
+			fatal("failed to recover operation journal", "error", err)
+		}
+		if err := store.bootstrapRules(ctx); err != nil {
+			fatal("failed to load risk rules", "error", err)
+		}
+		spawn(func() { rules.watch(ctx, pool, durationOrDefault("RULES_REFRESH_INTERVAL", 30*time.Second)) })
+	}
+	if roles[roleScheduler] {
+		spawn(func() { store.runPendingSweeper(ctx, durationOrDefault("PENDING_SWEEP_INTERVAL", time.Minute)) })
+		spawn(func() { store.runScheduler(ctx, durationOrDefault("SCHEDULER_INTERVAL", 15*time.Second)) })
+	}
+	if roles[roleRelay] {
+		relay, err := outboxRelayFromEnv(store)
+		if err != nil {
+			fatal("invalid outbox relay configuration", "error", err)
+		}
+		if relay != nil {
+			spawn(func() { relay.run(ctx, durationOrDefault("OUTBOX_POLL_INTERVAL", time.Second)) })
+		} else {
+			slog.Info("KAFKA_BROKERS not set; outbox relay disabled")
+		}
+		webhooks := webhookWorkerFromEnv(store)
+		spawn(func() {
+			webhooks.queue.watch(ctx, pool, durationOrDefault("WEBHOOK_QUEUE_REFRESH_INTERVAL", 2*time.Second))
+		})
+		for range cfg.Limits.WebhookConcurrency {
+			spawn(func() { webhooks.run(ctx, durationOrDefault("WEBHOOK_POLL_INTERVAL", time.Second)) })
+		}
+	}
+	if roles[roleWorker] {
+		spawn(func() { store.runJobWorker(ctx, durationOrDefault("JOB_POLL_INTERVAL", 2*time.Second)) })
+		spawn(func() {
+			store.runScheduledTransfers(ctx, durationOrDefault("SCHEDULED_TRANSFER_POLL_INTERVAL", 5*time.Second))
+		})
+	}
+	spawn(func() { keys.watch(ctx, durationOrDefault("KEYRING_REFRESH_INTERVAL", 5*time.Minute)) })
+	spawn(func() { store.health.run(ctx, durationOrDefault("HEALTH_SAMPLE_INTERVAL", 5*time.Second)) })
+
+	// every role serves health and metrics on the admin port, so background
+	// processes are scraped and probed like API pods
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("GET /health/score", store.health.handleScore)
+	adminMux.HandleFunc("GET /healthz", store.health.handleLive)
+	adminMux.HandleFunc("GET /readyz", store.health.handleReady)
+	adminMux.Handle("/metrics", promhttp.Handler())
+	servers := []*http.Server{cfg.HTTP.server(cfg.HTTP.AdminAddr, adminMux)}
+	var rpc *grpc.Server
+
+	if roles[roleAPI] {
+		limiter := newRateLimiter(cfg.Limits)
+		// batches charge the limiter per item themselves
+		store.limiter = limiter
+		api := newAPIRouter(http.DefaultServeMux)
+		api.HandleFunc("/transfer", store.health.track(traced("POST /transfer", limiter.wrap(store.handleTransfer))))
+		api.HandleFunc("POST /transfer/quote", traced("POST /transfer/quote", store.handleTransferQuote))
+		api.HandleFunc("POST /transfers/{operationId}/reverse", store.health.track(traced("POST /transfers/{operationId}/reverse", store.handleReverseTransfer)))
+		api.HandleFunc("POST /transfers/batch", store.health.track(traced("POST /transfers/batch", store.handleBatchTransfers)))
+		api.HandleFunc("GET /receipts/{number}", store.handleGetReceipt)
+		api.HandleFunc("GET /format", store.handleFormat)
+		api.HandleFunc("POST /scheduled-transfers", store.handleCreateScheduledTransfer)
+		api.HandleFunc("GET /scheduled-transfers", store.handleListScheduledTransfers)
+		api.HandleFunc("GET /scheduled-transfers/{id}", store.handleGetScheduledTransfer)
+		api.HandleFunc("DELETE /scheduled-transfers/{id}", store.handleCancelScheduledTransfer)
+		api.HandleFunc("POST /standing-orders", store.handleCreateStandingOrder)
+		api.HandleFunc("GET /standing-orders", store.handleListStandingOrders)
+		api.HandleFunc("GET /standing-orders/{id}", store.handleGetStandingOrder)
+		api.HandleFunc("POST /standing-orders/{id}/pause", store.handleStandingOrderAction("pause"))
+		api.HandleFunc("POST /standing-orders/{id}/resume", store.handleStandingOrderAction("resume"))
+		api.HandleFunc("POST /standing-orders/{id}/skip", store.handleStandingOrderAction("skip"))
+		api.HandleFunc("DELETE /standing-orders/{id}", store.handleStandingOrderAction("cancel"))
+		api.HandleFunc("GET /events/schemas", store.handleEventSchemas)
+		api.HandleFunc("POST /webhooks", store.handleCreateWebhook)
+		api.HandleFunc("GET /webhooks", store.handleListWebhooks)
+		api.HandleFunc("GET /webhooks/{id}", store.handleGetWebhook)
+		api.HandleFunc("DELETE /webhooks/{id}", store.handleDeleteWebhook)
+		api.HandleFunc("GET /webhooks/{id}/secrets", store.handleWebhookSecrets)
+		api.HandleFunc("GET /webhooks/{id}/attempts", store.handleWebhookAttempts)
+		api.HandleFunc("/debug/state", traced("GET /debug/state", store.handleDebug))
+		http.HandleFunc("GET /healthz", store.health.handleLive)
+		http.HandleFunc("GET /readyz", store.health.handleReady)
+		registerAPIRoutes(api, newAPIHandler(store))
+		api.HandleFunc("DELETE /accounts/{id}", store.handleCloseAccount)
+		api.HandleFunc("GET /accounts/{id}/statements", store.handleMonthlyStatement)
+		api.HandleFunc("GET /accounts/{id}/notifications", store.handleAccountNotifications)
+		api.HandleFunc("GET /accounts/{id}/attestation", store.handleAttestation)
+		api.HandleFunc("GET /attestations/public-key", store.handleAttestationKey)
+		api.HandleFunc("GET /ledger/merkle-roots", store.handleMerkleRoots)
+		api.HandleFunc("GET /ledger/entries/{id}/proof", store.handleInclusionProof)
+		api.HandleFunc("GET /ledger/entries/{id}/archived", store.handleArchivedEntries)
+		api.HandleFunc("GET /ledger/verify", store.handleVerifyLedger)
+		api.HandleFunc("GET /openapi.json", store.handleOpenAPI)
+		api.HandleFunc("POST /api-keys/rotate", store.handleRotateAPIKey)
+		api.HandleFunc("POST /accounts/{id}/virtual-accounts", store.handleCreateVirtualAccount)
+		api.HandleFunc("GET /accounts/{id}/virtual-accounts", store.handleListVirtualAccounts)
+		api.HandleFunc("DELETE /virtual-accounts/{vid}", store.handleCloseVirtualAccount)
+		api.HandleFunc("POST /accounts/{id}/deposit", store.health.track(store.handleDeposit))
+		api.HandleFunc("POST /accounts/{id}/withdraw", store.health.track(store.handleWithdraw))
+		api.HandleFunc("POST /accounts/{id}/simulate", store.handleSimulateAccount)
+		api.HandleFunc("POST /holds", store.health.track(store.handlePlaceHold))
+		api.HandleFunc("GET /holds", store.handleListHolds)
+		api.HandleFunc("GET /holds/{id}", store.handleGetHold)
+		api.HandleFunc("POST /holds/{id}/capture", store.health.track(store.handleCaptureHold))
+		api.HandleFunc("POST /holds/{id}/release", store.handleReleaseHold)
+		api.HandleFunc("POST /inbound/credits", store.health.track(store.handleInboundCredit))
+		api.HandleFunc("POST /payouts/{id}/return", store.handlePayoutReturn)
+		api.HandleFunc("GET /accounts/{id}/sweep", store.handleGetSweep)
+		api.HandleFunc("PUT /accounts/{id}/sweep", store.handlePutSweep)
+		api.HandleFunc("DELETE /accounts/{id}/sweep", store.handleDeleteSweep)
+		api.HandleFunc("GET /admin/risk/cases", store.handleRiskCases)
+		api.HandleFunc("GET /admin/risk/events", store.handleRiskEvents)
+		api.HandleFunc("POST /admin/risk/cases/{id}/approve", store.handleApproveCase)
+		api.HandleFunc("POST /admin/risk/cases/{id}/reject", store.handleRejectCase)
+		api.HandleFunc("GET /admin/rules", store.handleListRuleSets)
+		api.HandleFunc("POST /admin/rules", store.handleCreateRuleSet)
+		api.HandleFunc("POST /admin/rules/{version}/activate", store.handleActivateRuleSet)
+		api.HandleFunc("POST /admin/rules/simulate", store.handleSimulateRules)
+		api.HandleFunc("POST /admin/accounts/bulk", store.handleBulkAccounts)
+		api.HandleFunc("GET /admin/accounts/{id}/overdraft", store.handleGetOverdraft)
+		api.HandleFunc("PUT /admin/accounts/{id}/overdraft", store.handlePutOverdraft)
+		api.HandleFunc("POST /admin/accounts/{id}/status", store.handleSetAccountStatus)
+		api.HandleFunc("GET /admin/accounts/{id}/status-history", store.handleAccountStatusHistory)
+		api.HandleFunc("POST /admin/accounts/{id}/adjustments", store.handleAdjustBalance)
+		api.HandleFunc("GET /admin/accounts/{id}/adjustments", store.handleListAdjustments)
+		api.HandleFunc("GET /admin/jobs/{id}", store.handleGetJob)
+		api.HandleFunc("GET /admin/schedules", store.handleListSchedules)
+		api.HandleFunc("POST /admin/schedules", store.handleCreateSchedule)
+		api.HandleFunc("POST /admin/schedules/{id}/pause", store.handleSetScheduleEnabled(false))
+		api.HandleFunc("POST /admin/schedules/{id}/resume", store.handleSetScheduleEnabled(true))
+		api.HandleFunc("GET /admin/schedules/{id}/runs", store.handleScheduleRuns)
+		api.HandleFunc("POST /admin/recon/reports", store.handleImportRecon)
+		api.HandleFunc("GET /admin/recon/reports/{id}", store.handleGetRecon)
+		api.HandleFunc("GET /admin/suspense", store.handleSuspenseItems)
+		api.HandleFunc("POST /admin/suspense/{id}/allocate", store.handleAllocateSuspense)
+		api.HandleFunc("POST /admin/suspense/{id}/return", store.handleReturnSuspense)
+		api.HandleFunc("GET /admin/api-keys", store.handleListAPIKeys)
+		api.HandleFunc("POST /admin/api-keys/{id}/expire", store.handleExpireAPIKey)
+		api.HandleFunc("GET /admin/usage", store.handleUsage)
+		api.HandleFunc("GET /admin/tenants/{tenant}/config", store.handleGetTenantConfig)
+		api.HandleFunc("PUT /admin/tenants/{tenant}/config", store.handlePutTenantConfig)
+		api.HandleFunc("DELETE /admin/tenants/{tenant}/config", store.handleDeleteTenantConfig)
+		api.HandleFunc("GET /admin/tenants/{tenant}/config/effective", store.handleEffectiveTenantConfig)
+		api.HandleFunc("GET /admin/tenants/{tenant}/templates", store.handleListTemplates)
+		api.HandleFunc("GET /admin/tenants/{tenant}/templates/{channel}/{name}", store.handleTemplateVersions)
+		api.HandleFunc("POST /admin/tenants/{tenant}/templates/{channel}/{name}", store.handleSaveTemplate)
+		api.HandleFunc("POST /admin/tenants/{tenant}/templates/{channel}/{name}/versions/{version}/activate", store.handleActivateTemplate)
+		api.HandleFunc("POST /admin/tenants/{tenant}/templates/{channel}/{name}/preview", store.handlePreviewTemplate)
+		api.HandleFunc("POST /admin/tenants/{tenant}/templates/{channel}/{name}/test-send", store.handleTestSendTemplate)
+		api.HandleFunc("PUT /admin/usage/quotas/{tenant}/{meter}", store.handlePutQuota)
+		api.HandleFunc("DELETE /admin/usage/quotas/{tenant}/{meter}", store.handleDeleteQuota)
+		api.HandleFunc("GET /admin/index-advisor", store.handleIndexAdvisor)
+		api.HandleFunc("POST /admin/ledger/compaction", store.handleLedgerCompaction)
+		api.HandleFunc("POST /admin/reconcile", store.handleReconcileBalances)
+		api.HandleFunc("GET /admin/reconciliation/issues", store.handleReconciliationIssues)
+		api.HandleFunc("POST /admin/eod", store.handleRunEOD)
+		api.HandleFunc("GET /admin/eod", store.handleEODRuns)
+		api.HandleFunc("GET /admin/eod/{date}", store.handleGetEODRun)
+		api.HandleFunc("GET /admin/outbox", store.handleOutboxState)
+		api.HandleFunc("GET /admin/exports/incremental", store.handleIncrementalExport)
+		api.HandleFunc("POST /admin/exports", store.handleCreateExport)
+		api.HandleFunc("GET /admin/exports/{id}", store.handleGetExport)
+		api.HandleFunc("GET /admin/exports/{id}/output", store.handleExportOutput)
+		api.HandleFunc("GET /admin/runbook", store.handleRunbookState)
+		api.HandleFunc("GET /admin/runbook/actions", store.handleRunbookActions)
+		api.HandleFunc("POST /admin/runbook/scheduler/pause", store.handleSetFlag(flagSchedulerPaused, true))
+		api.HandleFunc("POST /admin/runbook/scheduler/resume", store.handleSetFlag(flagSchedulerPaused, false))
+		api.HandleFunc("POST /admin/runbook/read-only/enable", store.handleSetFlag(flagReadOnly, true))
+		api.HandleFunc("POST /admin/runbook/read-only/disable", store.handleSetFlag(flagReadOnly, false))
+		api.HandleFunc("POST /admin/runbook/operations/{id}/force-close", store.handleForceCloseOperation)
+		api.HandleFunc("POST /admin/runbook/jobs/requeue", store.handleRequeueFailedJobs)
+		api.HandleFunc("POST /admin/sandbox/reset", store.handleSandboxReset)
+		api.HandleFunc("GET /admin/sandbox/clock", store.handleGetClock)
+		api.HandleFunc("POST /admin/sandbox/clock/advance", store.handleAdvanceClock)
+		api.mount()
+		http.Handle("/metrics", promhttp.Handler())
+		srv := cfg.HTTP.server(cfg.HTTP.Addr, withRequestID(withMetrics(http.DefaultServeMux, tenantLabelsFromEnv(), withAuth(http.DefaultServeMux, auths, withTenantLabel(withBranding(tenants, withReadOnly(store.flags, http.DefaultServeMux)))))))
+		srv.TLSConfig = tlsConfig
+		servers = append(servers, srv)
+		rpc = newGRPCServer(store, auths, tlsConfig)
+	}
+	if rpc != nil {
+		addr := cfg.HTTP.GRPCAddr
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			fatal("listen", "addr", addr, "error", err)
+		}
+		go func() {
+			if err := rpc.Serve(lis); err != nil {
+				fatal("serve grpc", "addr", addr, "error", err)
+			}
+		}()
+	}
+
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			serve := srv.ListenAndServe
+			if srv.TLSConfig != nil {
+				// the certificate comes from TLSConfig.GetCertificate
+				serve = func() error { return srv.ListenAndServeTLS("", "") }
+			}
+			if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("listen", "addr", srv.Addr, "error", err)
+			}
+		}(srv)
+	}
+	slog.Info("Go service running", "roles", roles.String(), "isolation", string(store.isoLevel), "listen", listenAddrs(servers))
+
+	<-ctx.Done()
+	stop()
+	shutdown(store, servers, rpc, &background, cfg.Timeouts.Shutdown)
 }
 
 func envOrDefault(key, fallback string) string {
@@ -96,17 +717,131 @@ func envOrDefault(key, fallback string) string {
 	return fallback
 }
 
-func (s *Store) seed(ctx context.Context) error {
+func intOrDefault(key string, fallback int) int {
+	if v := os.Getenv(key); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			fatal("invalid setting", "key", key, "value", v)
+		}
+		return n
+	}
+	return fallback
+}
+
+func floatOrDefault(key string, fallback float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			fatal("invalid setting", "key", key, "value", v)
+		}
+		return f
+	}
+	return fallback
+}
+
+func durationOrDefault(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			fatal("invalid setting", "key", key, "error", err)
+		}
+		return d
+	}
+	return fallback
+}
+
+// seeds are versioned like migrations: each runs once per database and is
+// recorded in data_seeds, so accounts deleted on purpose are not recreated
+// by the next rolling restart.
+var seeds = []struct {
+	name string
+	stmt string
+}{
 	// Keep default seed aligned with init.sql but idempotent
-	_, err := s.pool.Exec(ctx, `
+	{"default_accounts_v1", `
 		INSERT INTO accounts (id, balance) VALUES
 		('A', 1000.0),
 		('B', 500.0)
-		ON CONFLICT (id) DO NOTHING`)
-	if err != nil {
+		ON CONFLICT (id) DO NOTHING`},
+	{"settlement_account_v1", `
+		INSERT INTO accounts (id, balance, tenant_id) VALUES ('` + settlementAccountID + `', 0, 'system')
+		ON CONFLICT (id) DO NOTHING`},
+	{"suspense_account_v1", `
+		INSERT INTO accounts (id, balance, tenant_id) VALUES ('` + suspenseAccountID + `', 0, 'system')
+		ON CONFLICT (id) DO NOTHING`},
+	{"fees_account_v1", `
+		INSERT INTO accounts (id, balance, tenant_id) VALUES ('` + feesAccountID + `', 0, 'system')
+		ON CONFLICT (id) DO NOTHING`},
+	{"adjustments_account_v1", `
+		INSERT INTO accounts (id, balance, tenant_id) VALUES ('` + adjustmentsAccountID + `', 0, 'system')
+		ON CONFLICT (id) DO NOTHING`},
+	// the nightly sweep runs at end of day UTC; operators retime it through
+	// the schedules API
+	{"nightly_sweeps_schedule_v1", `
+		INSERT INTO schedules (name, cron, job_type, params, created_by, next_run_at)
+		VALUES ('nightly_balance_sweeps', '55 23 * * *', 'balance_sweeps', '{}', 'seed',
+			date_trunc('day', now()) + interval '23 hours 55 minutes'
+				+ CASE WHEN now() >= date_trunc('day', now()) + interval '23 hours 55 minutes' THEN interval '1 day' ELSE interval '0' END)
+		ON CONFLICT (name) DO NOTHING`},
+	{"usage_schedules_v1", `
+		INSERT INTO schedules (name, cron, job_type, params, created_by, next_run_at) VALUES
+		('hourly_usage_meters', '7 * * * *', 'usage_meters', '{}', 'seed',
+			date_trunc('hour', now()) + interval '7 minutes'
+				+ CASE WHEN now() >= date_trunc('hour', now()) + interval '7 minutes' THEN interval '1 hour' ELSE interval '0' END),
+		('monthly_usage_summary', '30 0 1 * *', 'usage_summary', '{}', 'seed',
+			date_trunc('month', now()) + interval '30 minutes'
+				+ CASE WHEN now() >= date_trunc('month', now()) + interval '30 minutes' THEN interval '1 month' ELSE interval '0' END)
+		ON CONFLICT (name) DO NOTHING`},
+	{"merkle_schedule_v1", `
+		INSERT INTO schedules (name, cron, job_type, params, created_by, next_run_at) VALUES
+		('ledger_merkle_roots', '*/10 * * * *', 'ledger_merkle', '{}', 'seed',
+			date_trunc('hour', now()) + (floor(extract(minute FROM now()) / 10) + 1) * interval '10 minutes')
+		ON CONFLICT (name) DO NOTHING`},
+	// the demo accounts were seeded with balances that have no ledger entries
+	{"default_opening_balances_v1", `
+		UPDATE accounts a SET opening_balance = v.balance
+		FROM (VALUES ('A', 1000.0), ('B', 500.0)) v(id, balance) WHERE a.id = v.id`},
+	{"reconciliation_schedule_v1", `
+		INSERT INTO schedules (name, cron, job_type, params, created_by, next_run_at)
+		VALUES ('hourly_balance_reconciliation', '23 * * * *', 'balance_reconciliation', '{}', 'seed',
+			date_trunc('hour', now()) + interval '23 minutes'
+				+ CASE WHEN now() >= date_trunc('hour', now()) + interval '23 minutes' THEN interval '1 hour' ELSE interval '0' END)
+		ON CONFLICT (name) DO NOTHING`},
+	// the sweeps move into the end of day pipeline, which takes over their
+	// slot
+	{"eod_schedule_v1", `
+		WITH retired AS (UPDATE schedules SET enabled = false WHERE name = 'nightly_balance_sweeps')
+		INSERT INTO schedules (name, cron, job_type, params, created_by, next_run_at)
+		VALUES ('end_of_day', '55 23 * * *', 'eod', '{}', 'seed',
+			date_trunc('day', now()) + interval '23 hours 55 minutes'
+				+ CASE WHEN now() >= date_trunc('day', now()) + interval '23 hours 55 minutes' THEN interval '1 day' ELSE interval '0' END)
+		ON CONFLICT (name) DO NOTHING`},
+}
+
+func seed(ctx context.Context, conn *pgxpool.Conn) error {
+	if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS data_seeds (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
 		return err
 	}
-	// refresh gauges
+	for _, sd := range seeds {
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			tag, err := tx.Exec(ctx, "INSERT INTO data_seeds (name) VALUES ($1) ON CONFLICT DO NOTHING", sd.name)
+			if err != nil || tag.RowsAffected() == 0 {
+				return err
+			}
+			_, err = tx.Exec(ctx, sd.stmt)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("seed %s: %w", sd.name, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) refreshBalanceGauges(ctx context.Context) error {
 	rows, err := s.pool.Query(ctx, "SELECT id, balance FROM accounts")
 	if err != nil {
 		return err
@@ -114,11 +849,11 @@ func (s *Store) seed(ctx context.Context) error {
 	defer rows.Close()
 	for rows.Next() {
 		var id string
-		var bal float64
+		var bal Money
 		if err := rows.Scan(&id, &bal); err != nil {
 			return err
 		}
-		accountBalance.WithLabelValues(id).Set(bal)
+		accountBalance.WithLabelValues(id).Set(bal.Float())
 	}
 	return rows.Err()
 }
@@ -131,170 +866,610 @@ func (s *Store) handleTransfer(w http.ResponseWriter, r *http.Request) {
 
 	var req TransferRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if errors.Is(err, ledger.ErrTooPrecise) {
+			transferRequests.WithLabelValues("validation_error").Inc()
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+			return
+		}
 		http.Error(w, "invalid json", http.StatusBadRequest)
 		return
 	}
 
-	if req.FromAccountID == "" || req.ToAccountID == "" {
+	if msg := validateTransfer(req); msg != "" {
 		transferRequests.WithLabelValues("validation_error").Inc()
-		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "fromAccountId and toAccountId are required"})
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: msg})
 		return
 	}
-	if req.FromAccountID == req.ToAccountID {
-		transferRequests.WithLabelValues("validation_error").Inc()
-		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "fromAccountId and toAccountId must differ"})
+
+	ctx := withMeta(r.Context(), metaFromRequest(r))
+	resp, status, err := s.transfer(ctx, req)
+	if err != nil {
+		logger(ctx).Error("transfer failed", "operation_id", req.OperationID, "from", req.FromAccountID, "to", req.ToAccountID,
+			"amount", req.Amount, "status", status, "error", err)
+		if errors.Is(err, errOperationInFlight) {
+			w.Header().Set("Location", apiPath(r.Context(), "/operations/"+url.PathEscape(req.OperationID)))
+		}
+		writeError(w, status, err)
 		return
 	}
-	if req.Amount <= 0 {
-		transferRequests.WithLabelValues("validation_error").Inc()
-		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "amount must be > 0"})
-		return
+	logger(ctx).Info("transfer", "operation_id", req.OperationID, "from", req.FromAccountID, "to", req.ToAccountID,
+		"amount", req.Amount, "status", status, "result", resp.Status)
+	writeTransfer(w, status, resp)
+	s.markJournal(ctx, req.OperationID, journalResponded, "")
+}
+
+// validateTransfer checks a client transfer request before anything is
+// locked; it returns the message for the 400, or "" when the request is
+// well formed.
+func validateTransfer(req TransferRequest) string {
+	switch {
+	case req.FromAccountID == "" || req.ToAccountID == "":
+		return "fromAccountId and toAccountId are required"
+	case isSystemAccount(req.FromAccountID) || isSystemAccount(req.ToAccountID):
+		return "account is reserved"
+	case req.FromAccountID == req.ToAccountID:
+		return "fromAccountId and toAccountId must differ"
+	case req.Amount <= 0:
+		return "amount must be > 0"
 	}
+	return ""
+}
 
-	resp, status, err := s.transfer(r.Context(), req)
+func (s *Store) transfer(ctx context.Context, req TransferRequest) (TransferResponse, int, error) {
+	ctx, span := tracer.Start(ctx, "transfer", trace.WithAttributes(
+		attribute.String("transfer.operation_id", req.OperationID),
+		attribute.String("transfer.from", req.FromAccountID),
+		attribute.String("transfer.to", req.ToAccountID),
+	))
+	defer span.End()
+	resp, status, err := s.runTransfer(ctx, req, true)
+	span.SetAttributes(attribute.Int("transfer.status", status))
 	if err != nil {
-		log.Printf("transfer error: %v", err)
-		writeJSON(w, status, TransferResponse{Status: "error", Message: err.Error()})
-		return
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
-	writeJSON(w, status, resp)
+	return resp, status, err
 }
 
-func (s *Store) transfer(ctx context.Context, req TransferRequest) (TransferResponse, int, error) {
+// Transfer is store.Store's transfer: t goes through the full pipeline,
+// risk screening and fees included, like a POST /transfer carrying no FX
+// rate or quote. The tenant check reads the request's principal, which
+// t.TenantID is taken from. Refusals without a store error of their own,
+// such as the daily limit, come back as InvalidError.
+func (s *Store) Transfer(ctx context.Context, t store.Transfer) (store.TransferResult, error) {
+	req := TransferRequest{OperationID: t.OperationID, FromAccountID: t.FromAccountID, ToAccountID: t.ToAccountID, Amount: t.Amount}
+	if msg := validateTransfer(req); msg != "" {
+		return store.TransferResult{}, store.InvalidError(msg)
+	}
+	resp, status, err := s.transfer(ctx, req)
+	if err != nil {
+		if status >= 500 || slices.ContainsFunc(storeErrors, func(e error) bool { return errors.Is(err, e) }) {
+			return store.TransferResult{}, err
+		}
+		return store.TransferResult{}, store.InvalidError(err.Error())
+	}
+	return store.TransferResult{Status: resp.Status, Message: resp.Message, Balances: resp.Balances, CaseID: resp.CaseID,
+		ReceiptNumber: resp.ReceiptNumber}, nil
+}
+
+// runTransfer is the full transfer pipeline. screen=false skips the risk
+// rules and is used when a reviewer approves a transfer held for review.
+func (s *Store) runTransfer(ctx context.Context, req TransferRequest, screen bool) (TransferResponse, int, error) {
 	if req.OperationID != "" {
-		var exists bool
-		if err := s.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM processed_ops WHERE operation_id=$1)", req.OperationID).Scan(&exists); err != nil {
-			transferRequests.WithLabelValues("validation_error").Inc()
+		unlock, err := s.lockOperation(ctx, req.OperationID)
+		if errors.Is(err, errOperationInFlight) {
+			return TransferResponse{}, http.StatusConflict, err
+		}
+		if errors.Is(err, errLocksBusy) {
+			return TransferResponse{}, http.StatusServiceUnavailable, err
+		}
+		if err != nil {
+			return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("lock operation: %w", err)
+		}
+		defer unlock()
+
+		// fast path for retries; the authoritative check is the
+		// processed_ops claim inside the transfer transaction
+		processed, err := s.findProcessed(ctx, req.OperationID)
+		if err != nil {
+			transferRequests.WithLabelValues("internal_error").Inc()
 			return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("failed to check duplicate: %w", err)
 		}
-		if exists {
-			transferRequests.WithLabelValues("duplicate").Inc()
-			return TransferResponse{Status: "ok", Message: "operation already processed"}, http.StatusOK, nil
+		if processed != nil {
+			return replayProcessed(ctx, req, processed)
+		}
+		state, err := s.journalReceive(ctx, req)
+		if err != nil {
+			return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("journal operation: %w", err)
+		}
+		if screen && state == journalPendingReview {
+			return s.pendingReview(ctx, req.OperationID)
+		}
+	}
+
+	if screen {
+		outcome, caseID, err := s.evaluateRisk(ctx, riskInput{Req: req, Meta: metaFromContext(ctx)})
+		if err != nil {
+			s.markJournal(ctx, req.OperationID, journalFailed, err.Error())
+			s.transferFailed(ctx, req, http.StatusInternalServerError, err)
+			return TransferResponse{}, http.StatusInternalServerError, err
+		}
+		if outcome.Decision != riskAllow {
+			return s.riskResponse(ctx, req, outcome, caseID)
 		}
 	}
+	s.markJournal(ctx, req.OperationID, journalExecuting, "")
 
-	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	req.screened = screen
+	resp, status, err := s.executeWithRetry(ctx, req)
+	var held *errRuleHits
+	if errors.As(err, &held) {
+		outcome, caseID, err := s.decideRisk(ctx, riskInput{Req: req, Meta: metaFromContext(ctx)}, riskStagePreCommit, held.hits)
+		if err != nil {
+			s.markJournal(ctx, req.OperationID, journalFailed, err.Error())
+			s.transferFailed(ctx, req, http.StatusInternalServerError, err)
+			return TransferResponse{}, http.StatusInternalServerError, err
+		}
+		return s.riskResponse(ctx, req, outcome, caseID)
+	}
+	if errors.Is(err, errAlreadyProcessed) {
+		processed, err := s.findProcessed(ctx, req.OperationID)
+		if err != nil {
+			return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("load processed operation: %w", err)
+		}
+		if processed == nil {
+			return TransferResponse{}, http.StatusInternalServerError, errors.New("processed operation disappeared")
+		}
+		return replayProcessed(ctx, req, processed)
+	}
+	if err != nil {
+		s.markJournal(ctx, req.OperationID, journalFailed, err.Error())
+		s.transferFailed(ctx, req, status, err)
+	}
+	return resp, status, err
+}
+
+// Transfer failures the caller can branch on with errors.Is. The pipeline
+// wraps them with the side they apply to ("from account is frozen"), so the
+// message sent to clients reads as before.
+var (
+	errAccountNotFound    = store.ErrAccountNotFound
+	errOtherTenant        = store.ErrOtherTenant
+	errAccountFrozen      = store.ErrAccountFrozen
+	errAccountClosed      = store.ErrAccountClosed
+	errLimitExceeded      = store.ErrLimitExceeded
+	errDailyLimitExceeded = errors.New("amount exceeds account daily transfer limit")
+	errInsufficientFunds  = store.ErrInsufficientFunds
+)
+
+// storeErrors are the failures store.Store documents; Transfer passes them
+// through as they are.
+var storeErrors = []error{errAccountNotFound, errOtherTenant, errAccountFrozen, errAccountClosed, errLimitExceeded,
+	errInsufficientFunds, errBlockedByRule, errOperationInFlight}
+
+func (s *Store) executeTransfer(ctx context.Context, req TransferRequest) (TransferResponse, int, error) {
+	tx, err := s.beginTx(ctx, pgx.TxOptions{IsoLevel: s.isoLevel})
 	if err != nil {
 		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("failed to start tx: %w", err)
 	}
 	defer tx.Rollback(ctx) // safe to call after commit
 
-	var fromBalance, toBalance float64
-	if err := tx.QueryRow(ctx, "SELECT balance FROM accounts WHERE id=$1 FOR UPDATE", req.FromAccountID).Scan(&fromBalance); err != nil {
-		transferRequests.WithLabelValues("account_not_found").Inc()
-		if err == pgx.ErrNoRows {
-			return TransferResponse{}, http.StatusBadRequest, fmt.Errorf("from account not found")
+	b, status, err := s.bookTransfer(ctx, tx, req)
+	if err != nil {
+		return TransferResponse{}, status, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("commit tx: %w", err)
+	}
+	s.transferCommitted(req, b)
+	return b.resp, http.StatusOK, nil
+}
+
+// booking is a transfer written in a transaction not yet committed, with
+// the balances it left behind.
+type booking struct {
+	resp                   TransferResponse
+	fromBalance, toBalance Money
+}
+
+// transferCommitted does what follows the commit of a booked transfer.
+func (s *Store) transferCommitted(req TransferRequest, b booking) {
+	s.cache.accounts.invalidate(req.FromAccountID, req.ToAccountID, feesAccountID)
+
+	accountBalance.WithLabelValues(req.FromAccountID).Set(b.fromBalance.Float())
+	accountBalance.WithLabelValues(req.ToAccountID).Set(b.toBalance.Float())
+	transferRequests.WithLabelValues("success").Inc()
+}
+
+// bookTransfer writes req in tx: it claims the operation, locks both
+// accounts, runs the checks and moves the balances. Nothing is committed,
+// so a caller may book several transfers in one transaction.
+func (s *Store) bookTransfer(ctx context.Context, tx pgx.Tx, req TransferRequest) (booking, int, error) {
+	// Claim the operation before touching any balance. Two requests racing
+	// past the pre-check serialize on the processed_ops primary key: the
+	// loser waits for the winner's commit, inserts nothing and replays.
+	if req.OperationID != "" {
+		tag, err := tx.Exec(ctx, "INSERT INTO processed_ops (operation_id) VALUES ($1) ON CONFLICT DO NOTHING", req.OperationID)
+		if err != nil {
+			return booking{}, http.StatusInternalServerError, fmt.Errorf("claim operation: %w", err)
+		}
+		if tag.RowsAffected() == 0 {
+			return booking{}, http.StatusOK, errAlreadyProcessed
 		}
-		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("load from account: %w", err)
 	}
-	if err := tx.QueryRow(ctx, "SELECT balance FROM accounts WHERE id=$1 FOR UPDATE", req.ToAccountID).Scan(&toBalance); err != nil {
+
+	locked, err := lockAccounts(ctx, tx, req.FromAccountID, req.ToAccountID)
+	if err != nil {
+		return booking{}, http.StatusInternalServerError, fmt.Errorf("lock accounts: %w", err)
+	}
+	from, to := locked[req.FromAccountID], locked[req.ToAccountID]
+	if from == nil {
+		transferRequests.WithLabelValues("account_not_found").Inc()
+		return booking{}, http.StatusBadRequest, fmt.Errorf("from %w", errAccountNotFound)
+	}
+	if to == nil {
 		transferRequests.WithLabelValues("account_not_found").Inc()
-		if err == pgx.ErrNoRows {
-			return TransferResponse{}, http.StatusBadRequest, fmt.Errorf("to account not found")
+		return booking{}, http.StatusBadRequest, fmt.Errorf("to %w", errAccountNotFound)
+	}
+	// credentials bound to a tenant only move that tenant's money: the
+	// debited account must be theirs, or for deposits the credited one
+	if tenant := bookingTenant(ctx); tenant != "" {
+		owner := from
+		if isSystemAccount(req.FromAccountID) {
+			owner = to
+		}
+		if tenant != owner.tenantID {
+			transferRequests.WithLabelValues("forbidden").Inc()
+			return booking{}, http.StatusForbidden, errOtherTenant
 		}
-		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("load to account: %w", err)
 	}
-	if fromBalance < req.Amount {
-		transferRequests.WithLabelValues("insufficient_funds").Inc()
-		return TransferResponse{}, http.StatusBadRequest, fmt.Errorf("insufficient funds")
+	// deposits come from settlement, so they run on the receiving
+	// tenant's clock
+	clockTenant := from.tenantID
+	if clockTenant == "system" {
+		clockTenant = to.tenantID
 	}
+	now := s.clocks.now(clockTenant).UTC().Truncate(time.Second)
+	var quote *transferQuote
+	if req.QuoteID != "" {
+		var status int
+		if quote, status, err = claimQuote(ctx, tx, req, now); err != nil {
+			transferRequests.WithLabelValues("quote_rejected").Inc()
+			return booking{}, status, err
+		}
+	}
+	if req.hold != 0 {
+		if status, err := claimHold(ctx, tx, req, from, now); err != nil {
+			transferRequests.WithLabelValues(classify(status, err).result).Inc()
+			return booking{}, status, err
+		}
+	}
+	if req.approval != nil {
+		if status, err := approveCase(ctx, tx, req.approval); err != nil {
+			transferRequests.WithLabelValues(classify(status, err).result).Inc()
+			return booking{}, status, err
+		}
+	}
+	price, result, status, err := s.priceTransfer(ctx, req, from, to, quote)
+	if err != nil {
+		transferRequests.WithLabelValues(result).Inc()
+		return booking{}, status, err
+	}
+	usage, status, err := s.checkDailyLimit(ctx, tx, req, from, price.fee, now)
+	if err != nil {
+		if status == http.StatusBadRequest {
+			transferRequests.WithLabelValues("limit_exceeded").Inc()
+		}
+		return booking{}, status, err
+	}
+	if req.screened {
+		// only rule hits are a refusal; a check that failed to run is an
+		// internal error, retried like any other when it is a serialization
+		// failure
+		if err := s.checkTransfer(ctx, tx, riskInput{Req: req, Meta: metaFromContext(ctx)}); err != nil {
+			var held *errRuleHits
+			if errors.As(err, &held) {
+				return booking{}, http.StatusForbidden, err
+			}
+			return booking{}, http.StatusInternalServerError, err
+		}
+	}
+	fromCurrency, toCurrency, fee, credit, fx := price.fromCurrency, price.toCurrency, price.fee, price.credit, price.fx
+	fromBalance, toBalance := from.balance, to.balance
 
 	fromBalance -= req.Amount
-	toBalance += req.Amount
+	toBalance += credit
 
 	if _, err := tx.Exec(ctx, "UPDATE accounts SET balance=$1 WHERE id=$2", fromBalance, req.FromAccountID); err != nil {
-		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("update from account: %w", err)
+		return booking{}, http.StatusInternalServerError, fmt.Errorf("update from account: %w", err)
 	}
 	if _, err := tx.Exec(ctx, "UPDATE accounts SET balance=$1 WHERE id=$2", toBalance, req.ToAccountID); err != nil {
-		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("update to account: %w", err)
+		return booking{}, http.StatusInternalServerError, fmt.Errorf("update to account: %w", err)
 	}
 
-	now := time.Now().UTC().Format(time.RFC3339)
-	if _, err := tx.Exec(ctx, "INSERT INTO ledger (type, account_id, amount, at) VALUES ($1,$2,$3,$4)", "DEBIT", req.FromAccountID, req.Amount, now); err != nil {
-		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("insert debit ledger: %w", err)
+	var rate string
+	if fx != nil {
+		rate = fx.Rate
 	}
-	if _, err := tx.Exec(ctx, "INSERT INTO ledger (type, account_id, amount, at) VALUES ($1,$2,$3,$4)", "CREDIT", req.ToAccountID, req.Amount, now); err != nil {
-		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("insert credit ledger: %w", err)
+	var transferID int64
+	// the unique index on reverses_id makes a second reversal of the same
+	// transfer fail here instead of crediting twice
+	if err := tx.QueryRow(ctx, `
+		INSERT INTO transfers (operation_id, from_account_id, to_account_id, amount, reverses_id, virtual_account_id, standing_order_id,
+			currency, destination_amount, destination_currency, fx_rate)
+		VALUES (NULLIF($1,''),$2,$3,$4,NULLIF($5,0),NULLIF($6,''),NULLIF($7,0),$8,$9,$10,NULLIF($11,'')::numeric) RETURNING id`,
+		req.OperationID, req.FromAccountID, req.ToAccountID, req.Amount, req.reverses, req.virtualAccount, req.standingOrder,
+		fromCurrency, credit, toCurrency, rate).Scan(&transferID); err != nil {
+		return booking{}, http.StatusInternalServerError, fmt.Errorf("insert transfer: %w", err)
+	}
+	if req.hold != 0 {
+		if _, err := tx.Exec(ctx, "UPDATE holds SET transfer_id=$2 WHERE id=$1", req.hold, transferID); err != nil {
+			return booking{}, http.StatusInternalServerError, fmt.Errorf("link hold: %w", err)
+		}
+	}
+	receiptNumber, err := issueReceipt(ctx, tx, transferID)
+	if err != nil {
+		return booking{}, http.StatusInternalServerError, err
 	}
 
-	if req.OperationID != "" {
-		if _, err := tx.Exec(ctx, "INSERT INTO processed_ops (operation_id) VALUES ($1)", req.OperationID); err != nil {
-			return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("insert processed op: %w", err)
+	if err := insertTransferEntries(ctx, tx, transferID, now,
+		ledgerEntry{accountID: req.FromAccountID, amount: req.Amount, currency: fromCurrency, fxRate: rate},
+		ledgerEntry{accountID: req.ToAccountID, amount: credit, currency: toCurrency, fxRate: rate}); err != nil {
+		return booking{}, http.StatusInternalServerError, err
+	}
+	if fee > 0 {
+		if fromBalance, err = chargeFee(ctx, tx, req.FromAccountID, fromCurrency, fromBalance, fee, now); err != nil {
+			return booking{}, http.StatusInternalServerError, err
 		}
 	}
 
-	if err := tx.Commit(ctx); err != nil {
-		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("commit tx: %w", err)
+	resp := transferResult(req, fromBalance, toBalance)
+	if fee > 0 {
+		resp.Fee = &fee
+	}
+	resp.FX = fx
+	resp.ReceiptNumber = receiptNumber
+	resp.Warnings = s.limitWarnings(req, from, usage, fromBalance-from.held)
+	if err := s.writeOutbox(ctx, tx, "transfer.completed", strconv.FormatInt(transferID, 10), transferEvent{
+		TransferID: transferID, OperationID: req.OperationID, FromAccountID: req.FromAccountID, ToAccountID: req.ToAccountID,
+		Amount: req.Amount, Currency: fromCurrency, DestinationAmount: credit, DestinationCurrency: toCurrency,
+		FX: fx, Fee: resp.Fee, ReversesID: req.reverses, ReceiptNumber: receiptNumber, At: now,
+	}); err != nil {
+		return booking{}, http.StatusInternalServerError, fmt.Errorf("write outbox: %w", err)
+	}
+	if req.OperationID != "" {
+		raw, err := encodeResponse(resp)
+		if err != nil {
+			return booking{}, http.StatusInternalServerError, fmt.Errorf("encode response: %w", err)
+		}
+		if _, err := tx.Exec(ctx, "UPDATE processed_ops SET response=$2, status=$3 WHERE operation_id=$1", req.OperationID, raw, http.StatusOK); err != nil {
+			return booking{}, http.StatusInternalServerError, fmt.Errorf("store response: %w", err)
+		}
+		resp.raw = raw
+		// committed must land in the same tx as the balance change, otherwise
+		// recovery cannot tell a lost response from a lost transfer
+		if err := journalMark(ctx, tx, req.OperationID, journalCommitted, &resp, ""); err != nil {
+			return booking{}, http.StatusInternalServerError, fmt.Errorf("journal commit: %w", err)
+		}
 	}
 
-	accountBalance.WithLabelValues(req.FromAccountID).Set(fromBalance)
-	accountBalance.WithLabelValues(req.ToAccountID).Set(toBalance)
-	transferRequests.WithLabelValues("success").Inc()
+	return booking{resp: resp, fromBalance: fromBalance, toBalance: toBalance}, http.StatusOK, nil
+}
 
-	return TransferResponse{
-		Status:  "ok",
-		Message: "transfer completed",
-		Balances: map[string]float64{
-			req.FromAccountID: fromBalance,
-			req.ToAccountID:   toBalance,
-		},
-	}, http.StatusOK, nil
+// transferPricing is what a transfer debits and credits once fees and
+// currency conversion are applied.
+type transferPricing struct {
+	fromCurrency, toCurrency string
+	fee, credit              Money
+	fx                       *fxConversion
 }
 
-func (s *Store) handleDebug(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	accounts := make(map[string]float64)
-	rows, err := s.pool.Query(ctx, "SELECT id, balance FROM accounts ORDER BY id")
-	if err != nil {
-		http.Error(w, "failed to load accounts", http.StatusInternalServerError)
-		return
+// priceTransfer checks a transfer against the accounts and the tenant
+// configuration and prices it. On error it also returns the
+// transfer_requests_total result to count. A quote replaces the fee and
+// rate that would apply now with the quoted ones.
+func (s *Store) priceTransfer(ctx context.Context, req TransferRequest, from, to *lockedAccount, quote *transferQuote) (transferPricing, string, int, error) {
+	fromStatus, transferLimit, toStatus := from.status, from.transferLimit, to.status
+	// system accounts have no tenant configuration
+	cfg := s.tenants.effective(from.tenantID)
+	if isSystemAccount(req.FromAccountID) {
+		cfg = s.tenants.effective(to.tenantID)
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var id string
-		var bal float64
-		if err := rows.Scan(&id, &bal); err != nil {
-			http.Error(w, "failed to parse accounts", http.StatusInternalServerError)
-			return
+	if transferLimit == nil {
+		transferLimit = cfg.TransferLimit
+	}
+	// system accounts book in the customer account's currency
+	fromCurrency, toCurrency := from.currency, to.currency
+	if isSystemAccount(req.FromAccountID) {
+		fromCurrency = toCurrency
+	}
+	if isSystemAccount(req.ToAccountID) {
+		toCurrency = fromCurrency
+	}
+	var fee Money
+	if !isSystemAccount(req.FromAccountID) && !isSystemAccount(req.ToAccountID) && !req.internal {
+		fee = cfg.TransferFee
+	}
+	switch fromStatus {
+	case accountActive:
+	case accountFrozen:
+		return transferPricing{}, "account_frozen", http.StatusBadRequest, fmt.Errorf("from %w", errAccountFrozen)
+	case accountClosed:
+		return transferPricing{}, "account_closed", http.StatusBadRequest, fmt.Errorf("from %w", errAccountClosed)
+	default:
+		return transferPricing{}, "account_" + fromStatus, http.StatusBadRequest, fmt.Errorf("from account is %s", fromStatus)
+	}
+	if toStatus == accountClosed {
+		return transferPricing{}, "account_closed", http.StatusBadRequest, fmt.Errorf("to %w", errAccountClosed)
+	}
+	for _, code := range []string{fromCurrency, toCurrency} {
+		if !cfg.allowsCurrency(code) {
+			return transferPricing{}, "currency_not_enabled", http.StatusBadRequest, fmt.Errorf("tenant is not enabled for %s", code)
 		}
-		accounts[id] = bal
-	}
-	ledger := make([]LedgerEntry, 0)
-	lrows, err := s.pool.Query(ctx, "SELECT type, account_id, amount, at FROM ledger ORDER BY id DESC LIMIT 100")
-	if err == nil {
-		defer lrows.Close()
-		for lrows.Next() {
-			var e LedgerEntry
-			if err := lrows.Scan(&e.Type, &e.AccountID, &e.Amount, &e.At); err != nil {
-				http.Error(w, "failed to parse ledger", http.StatusInternalServerError)
-				return
-			}
-			ledger = append(ledger, e)
+	}
+	if quote != nil {
+		// the quoted price holds even if the tenant fee or the provider's
+		// rate changed since
+		fee = quote.Fee
+		if quote.FxRate != nil {
+			req.FxRate = quote.FxRate
+		}
+	}
+	var (
+		status int
+		err    error
+	)
+	credit := req.Amount
+	var fx *fxConversion
+	switch {
+	case fromCurrency != toCurrency:
+		if fx, status, err = s.convertTransfer(ctx, req, fromCurrency, toCurrency); err != nil {
+			return transferPricing{}, "fx_rejected", status, err
 		}
+		if quote != nil {
+			fx.RateSource = "quote"
+		}
+		credit = fx.DestinationAmount
+	case req.FxRate != nil:
+		return transferPricing{}, "validation_error", http.StatusBadRequest, errors.New("fxRate only applies between accounts of different currencies")
+	default:
+		if err := checkCurrencyPrecision(req.Amount, fromCurrency); err != nil {
+			return transferPricing{}, "validation_error", http.StatusBadRequest, err
+		}
+	}
+	if fee > 0 && quote == nil {
+		if fee, status, err = s.feeIn(ctx, fee, fromCurrency); err != nil {
+			return transferPricing{}, "fx_rejected", status, err
+		}
+	}
+	if transferLimit != nil && req.Amount > *transferLimit {
+		return transferPricing{}, "limit_exceeded", http.StatusBadRequest, errLimitExceeded
+	}
+	if from.balance-from.held-req.Amount-fee < -from.overdraftLimit && req.FromAccountID != settlementAccountID {
+		return transferPricing{}, "insufficient_funds", http.StatusBadRequest, errInsufficientFunds
 	}
 
-	processed := make([]string, 0)
-	prows, err := s.pool.Query(ctx, "SELECT operation_id FROM processed_ops ORDER BY created_at DESC LIMIT 100")
-	if err == nil {
-		defer prows.Close()
-		for prows.Next() {
-			var id string
-			if err := prows.Scan(&id); err != nil {
-				http.Error(w, "failed to parse processed ops", http.StatusInternalServerError)
-				return
-			}
-			processed = append(processed, id)
+	return transferPricing{fromCurrency: fromCurrency, toCurrency: toCurrency, fee: fee, credit: credit, fx: fx}, "", http.StatusOK, nil
+}
+
+type lockedAccount struct {
+	balance       Money
+	status        string
+	transferLimit *Money
+	dailyLimit    *Money
+	tenantID      string
+	currency      string
+	// overdraftLimit is how far below zero transfers may take the balance.
+	overdraftLimit Money
+	// held is reserved by active holds and not spendable.
+	held Money
+}
+
+// lockAccounts locks the given accounts FOR UPDATE in ascending id order and
+// returns the ones that exist. Every transaction touching more than one
+// account must lock through here: with a single global order, A->B and B->A
+// running concurrently queue on the same first row instead of each holding
+// the row the other one wants.
+func lockAccounts(ctx context.Context, tx pgx.Tx, ids ...string) (map[string]*lockedAccount, error) {
+	ids = append([]string(nil), ids...)
+	sort.Strings(ids)
+	locked := make(map[string]*lockedAccount, len(ids))
+	for _, id := range ids {
+		if _, seen := locked[id]; seen {
+			continue
+		}
+		var a lockedAccount
+		err := tx.QueryRow(ctx, "SELECT balance, status, transfer_limit, daily_limit, tenant_id, currency, overdraft_limit, held FROM accounts WHERE id=$1 FOR UPDATE", id).
+			Scan(&a.balance, &a.status, &a.transferLimit, &a.dailyLimit, &a.tenantID, &a.currency, &a.overdraftLimit, &a.held)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
 		}
+		locked[id] = &a
 	}
+	return locked, nil
+}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"accounts":     accounts,
-		"ledger":       ledger,
-		"processedOps": processed,
-	})
+// chargeFee books a transfer fee as its own transfer from the sender to the
+// fees account, in the same transaction as the transfer it belongs to, and
+// returns the sender's new balance. The fees account is locked here, after
+// the sorted customer locks: nothing ever locks it first, so this cannot
+// close a lock cycle, and holding it only for the tail of the transaction
+// keeps the contention on it short.
+func chargeFee(ctx context.Context, tx pgx.Tx, accountID, currency string, balance, fee Money, at time.Time) (Money, error) {
+	balance -= fee
+	if _, err := tx.Exec(ctx, "UPDATE accounts SET balance=$1 WHERE id=$2", balance, accountID); err != nil {
+		return 0, fmt.Errorf("charge fee: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE accounts SET balance=balance+$1 WHERE id=$2", fee, feesAccountID); err != nil {
+		return 0, fmt.Errorf("credit fee: %w", err)
+	}
+	var feeID int64
+	if err := tx.QueryRow(ctx, "INSERT INTO transfers (from_account_id, to_account_id, amount, currency, destination_amount, destination_currency) VALUES ($1,$2,$3,$4,$3,$4) RETURNING id",
+		accountID, feesAccountID, fee, currency).Scan(&feeID); err != nil {
+		return 0, fmt.Errorf("insert fee transfer: %w", err)
+	}
+	if err := insertTransferEntries(ctx, tx, feeID, at,
+		ledgerEntry{accountID: accountID, amount: fee, currency: currency},
+		ledgerEntry{accountID: feesAccountID, amount: fee, currency: currency}); err != nil {
+		return 0, fmt.Errorf("fee: %w", err)
+	}
+	return balance, nil
+}
+
+// transferResult is the success response. Deposits, withdrawals and
+// suspense postings are transfers against system accounts, whose balances
+// are internal.
+func transferResult(req TransferRequest, fromBalance, toBalance Money) TransferResponse {
+	resp := TransferResponse{Status: "ok", Message: "transfer completed", Balances: map[string]Money{}}
+	switch {
+	case req.FromAccountID == settlementAccountID && req.ToAccountID == suspenseAccountID:
+		resp.Message = "credit held in suspense"
+	case req.FromAccountID == settlementAccountID:
+		resp.Message = "deposit completed"
+	case req.ToAccountID == settlementAccountID:
+		resp.Message = "withdraw completed"
+	}
+	if !isSystemAccount(req.FromAccountID) {
+		resp.Balances[req.FromAccountID] = fromBalance
+	}
+	if !isSystemAccount(req.ToAccountID) {
+		resp.Balances[req.ToAccountID] = toBalance
+	}
+	return resp
+}
+
+// encodeResponse renders resp exactly as writeJSON would.
+func encodeResponse(resp TransferResponse) ([]byte, error) {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(resp)
+	return buf.Bytes(), err
+}
+
+// writeTransfer sends a pipeline response, using the stored bytes when the
+// response is a replay.
+func writeTransfer(w http.ResponseWriter, status int, resp TransferResponse) {
+	if resp.raw == nil {
+		writeJSON(w, status, resp)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(resp.raw)
 }
 
 func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	if resp, ok := body.(TransferResponse); ok && resp.Status == "error" {
+		if resp.RequestID == "" {
+			resp.RequestID = w.Header().Get(requestIDHeader)
+		}
+		if resp.Support == nil {
+			resp.Support = supportFor(w)
+		}
+		body = resp
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	_ = json.NewEncoder(w).Encode(body)
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"fintech-go/internal/store"
+)
+
+// STORE=memory serves the internal/api endpoints (accounts, statements,
+// operations and POST /transfer) from store.Memory instead of Postgres, for
+// local demos: no database, migrations or background roles. Transfers take
+// the plain request shape; fees, FX, quotes and risk rules need Postgres.
+// STORE_SEED names a file in the seed command's format whose accounts are
+// created at start with their balances. Everything is lost on exit.
+func runMemoryServe(ctx context.Context, cfg Config) {
+	mem := store.NewMemory()
+	if path := envOrDefault("STORE_SEED", ""); path != "" {
+		accounts := readSeedFile(path)
+		if err := (&Store{tenants: &tenantConfigs{}}).validateSeedAccounts(accounts); err != nil {
+			fatal("invalid seed file", "file", path, "error", err)
+		}
+		for _, a := range accounts {
+			mem.PutAccount(Account{ID: a.ID, TenantID: a.TenantID, DisplayName: a.DisplayName, Balance: a.Balance,
+				Currency: a.Currency, Status: a.Status, OverdraftLimit: a.OverdraftLimit})
+		}
+	}
+	auths, err := authenticatorsFromEnv()
+	if err != nil {
+		fatal("invalid auth configuration", "error", err)
+	}
+
+	h := newAPIHandler(mem)
+	mux := http.NewServeMux()
+	api := newAPIRouter(mux)
+	registerAPIRoutes(api, h)
+	// the Postgres server answers POST /transfer with its own handler
+	api.HandleFunc("POST /transfer", h.Transfer)
+	api.mount()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	srv := cfg.HTTP.server(cfg.HTTP.Addr, withRequestID(withAuth(mux, auths, mux)))
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("listen", "addr", srv.Addr, "error", err)
+		}
+	}()
+	slog.Warn("serving from the in-memory store; data is not persisted", "listen", srv.Addr)
+
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutdown server", "addr", srv.Addr, "error", err)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Ledger entries are sealed into Merkle trees over consecutive id ranges so
+// a third party holding only a published root can check that an entry is
+// part of the ledger with log2(n) hashes, without seeing the other entries.
+// Trees follow RFC 6962 (Certificate Transparency): leaf hashes are
+// SHA-256(0x00 || leaf), interior nodes SHA-256(0x01 || left || right), and
+// a tree of n leaves splits at the largest power of two below n, so proofs
+// verify with any CT-compatible library.
+//
+// A leaf is the entry's fields joined by tabs:
+//
+//	id \t type \t account_id \t amount \t at (RFC 3339, UTC) \t transfer_id
+//
+// with an empty transfer_id for entries that predate transfer rows.
+//
+// The ledger_merkle job seals ranges of entries older than a settle window.
+// Ids are taken from a sequence before commit, so a transaction still open
+// can commit an id below ones already visible; the window (longer than any
+// transfer transaction) keeps those from being skipped by a sealed range.
+
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+type merkleHash [sha256.Size]byte
+
+func (h merkleHash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h[:]))
+}
+
+func merkleLeafHash(leaf []byte) merkleHash {
+	return sha256.Sum256(append([]byte{merkleLeafPrefix}, leaf...))
+}
+
+func merkleNodeHash(l, r merkleHash) merkleHash {
+	b := make([]byte, 0, 1+2*sha256.Size)
+	b = append(append(append(b, merkleNodePrefix), l[:]...), r[:]...)
+	return sha256.Sum256(b)
+}
+
+// merkleSplit is the largest power of two strictly below n (n >= 2).
+func merkleSplit(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
+
+func merkleRoot(leaves []merkleHash) merkleHash {
+	switch len(leaves) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// merklePath is the audit path for leaf m, ordered from the leaf up.
+func merklePath(m int, leaves []merkleHash) []merkleHash {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if m < k {
+		return append(merklePath(m, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(m-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+type ledgerLeaf struct {
+	ID         int64
+	Type       string
+	AccountID  string
+	Amount     Money
+	At         time.Time
+	TransferID *int64
+}
+
+func (l ledgerLeaf) bytes() []byte {
+	var transfer string
+	if l.TransferID != nil {
+		transfer = strconv.FormatInt(*l.TransferID, 10)
+	}
+	return []byte(strings.Join([]string{
+		strconv.FormatInt(l.ID, 10), l.Type, l.AccountID, l.Amount.String(),
+		l.At.UTC().Format(time.RFC3339Nano), transfer,
+	}, "\t"))
+}
+
+// loadLeaves reads the entries with first <= id <= last in id order.
+// Compacted entries are read from the archive in place of the summaries
+// that replaced them, which are not leaves.
+func (s *Store) loadLeaves(ctx context.Context, q rowsQuerier, first, last int64) ([]ledgerLeaf, error) {
+	rows, err := q.Query(ctx, `
+		SELECT id, type, account_id, amount, at, transfer_id FROM ledger
+		WHERE id BETWEEN $1 AND $2 AND summary_entries IS NULL
+		UNION ALL
+		SELECT id, type, account_id, amount, at, transfer_id FROM ledger_archive
+		WHERE id BETWEEN $1 AND $2
+		ORDER BY id`, first, last)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ledgerLeaf, error) {
+		var l ledgerLeaf
+		err := row.Scan(&l.ID, &l.Type, &l.AccountID, &l.Amount, &l.At, &l.TransferID)
+		return l, err
+	})
+}
+
+type rowsQuerier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+type merkleParams struct {
+	// MaxLeaves bounds the size of one tree, and so the work of building a
+	// proof.
+	MaxLeaves int `json:"maxLeaves,omitempty"`
+	// Settle is how old an entry must be before it is sealed.
+	Settle string `json:"settle,omitempty"`
+}
+
+type merkleResult struct {
+	Roots  int   `json:"roots"`
+	Leaves int64 `json:"leaves"`
+}
+
+// runLedgerMerkle seals every settled entry past the last root, in trees of
+// at most MaxLeaves entries. Each tree is sealed in its own transaction under
+// an advisory lock, so overlapping runs cannot produce overlapping roots.
+func (s *Store) runLedgerMerkle(ctx context.Context, j *job) (any, error) {
+	p := merkleParams{MaxLeaves: 10000, Settle: "2m"}
+	if err := json.Unmarshal(j.Params, &p); err != nil {
+		return nil, err
+	}
+	settle, err := time.ParseDuration(p.Settle)
+	if err != nil || settle < 0 {
+		return nil, errors.New("settle must be a non-negative duration")
+	}
+	if p.MaxLeaves <= 0 {
+		return nil, errors.New("maxLeaves must be positive")
+	}
+	var res merkleResult
+	for {
+		n, err := s.sealMerkleRange(ctx, p.MaxLeaves, settle, j.DryRun)
+		if n > 0 {
+			res.Roots++
+			res.Leaves += int64(n)
+			j.progress(ctx, res.Leaves, res.Leaves)
+		}
+		if err != nil || n == 0 || j.DryRun {
+			return res, err
+		}
+	}
+}
+
+func (s *Store) sealMerkleRange(ctx context.Context, maxLeaves int, settle time.Duration, dryRun bool) (int, error) {
+	var sealed int
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('ledger_merkle'))"); err != nil {
+			return err
+		}
+		var after int64
+		if err := tx.QueryRow(ctx, "SELECT COALESCE(max(last_ledger_id), 0) FROM ledger_merkle_roots").Scan(&after); err != nil {
+			return err
+		}
+		// the range ends before the first unsettled entry, so an entry still
+		// inside the window is never jumped over
+		var last *int64
+		if err := tx.QueryRow(ctx, `
+			SELECT max(id) FROM (
+				SELECT id FROM ledger WHERE id > $1 AND id < COALESCE(
+					(SELECT min(id) FROM ledger WHERE id > $1 AND at > now() - $3 * interval '1 second'),
+					9223372036854775807)
+				ORDER BY id LIMIT $2) r`,
+			after, maxLeaves, settle.Seconds()).Scan(&last); err != nil {
+			return err
+		}
+		if last == nil {
+			return nil
+		}
+		leaves, err := s.loadLeaves(ctx, tx, after+1, *last)
+		if err != nil {
+			return err
+		}
+		hashes := make([]merkleHash, len(leaves))
+		for i, l := range leaves {
+			hashes[i] = merkleLeafHash(l.bytes())
+		}
+		root := merkleRoot(hashes)
+		sealed = len(leaves)
+		if dryRun {
+			return nil
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO ledger_merkle_roots (first_ledger_id, last_ledger_id, leaf_count, root)
+			VALUES ($1, $2, $3, $4)`, leaves[0].ID, *last, len(leaves), root[:])
+		return err
+	})
+	return sealed, err
+}
+
+type merkleRootView struct {
+	ID            int64      `json:"id"`
+	FirstLedgerID int64      `json:"firstLedgerId"`
+	LastLedgerID  int64      `json:"lastLedgerId"`
+	LeafCount     int        `json:"leafCount"`
+	Root          merkleHash `json:"root"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
+
+type merkleRootPage struct {
+	Roots []merkleRootView `json:"roots"`
+}
+
+func scanMerkleRoot(row pgx.Row) (merkleRootView, error) {
+	var (
+		v    merkleRootView
+		root []byte
+	)
+	err := row.Scan(&v.ID, &v.FirstLedgerID, &v.LastLedgerID, &v.LeafCount, &root, &v.CreatedAt)
+	copy(v.Root[:], root)
+	return v, err
+}
+
+// handleMerkleRoots lists published roots, newest first; ?before=<id>
+// pages backwards.
+func (s *Store) handleMerkleRoots(w http.ResponseWriter, r *http.Request) {
+	before := int64(1<<63 - 1)
+	if v := r.URL.Query().Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "invalid before"})
+			return
+		}
+		before = n
+	}
+	rows, err := s.pool.Query(r.Context(), `
+		SELECT id, first_ledger_id, last_ledger_id, leaf_count, root, created_at
+		FROM ledger_merkle_roots WHERE id < $1 ORDER BY id DESC LIMIT 100`, before)
+	if err != nil {
+		http.Error(w, "failed to list roots", http.StatusInternalServerError)
+		return
+	}
+	roots, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (merkleRootView, error) { return scanMerkleRoot(row) })
+	if err != nil {
+		http.Error(w, "failed to list roots", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, merkleRootPage{Roots: roots})
+}
+
+type inclusionProof struct {
+	LedgerID  int64          `json:"ledgerId"`
+	Leaf      string         `json:"leaf"`
+	LeafHash  merkleHash     `json:"leafHash"`
+	LeafIndex int            `json:"leafIndex"`
+	TreeSize  int            `json:"treeSize"`
+	Path      []merkleHash   `json:"path"`
+	Root      merkleRootView `json:"root"`
+}
+
+// handleInclusionProof rebuilds the tree sealing a ledger entry and returns
+// its audit path. Entries not sealed yet answer 404 with a hint to retry.
+func (s *Store) handleInclusionProof(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "invalid ledger id"})
+		return
+	}
+	root, err := scanMerkleRoot(s.pool.QueryRow(ctx, `
+		SELECT id, first_ledger_id, last_ledger_id, leaf_count, root, created_at
+		FROM ledger_merkle_roots WHERE first_ledger_id <= $1 AND last_ledger_id >= $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "entry is not sealed in a published root yet"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load root", http.StatusInternalServerError)
+		return
+	}
+	leaves, err := s.loadLeaves(ctx, s.pool, root.FirstLedgerID, root.LastLedgerID)
+	if err != nil {
+		http.Error(w, "failed to load entries", http.StatusInternalServerError)
+		return
+	}
+	p := inclusionProof{LedgerID: id, LeafIndex: -1, TreeSize: len(leaves), Root: root}
+	hashes := make([]merkleHash, len(leaves))
+	for i, l := range leaves {
+		hashes[i] = merkleLeafHash(l.bytes())
+		if l.ID == id {
+			p.LeafIndex = i
+			p.Leaf = string(l.bytes())
+		}
+	}
+	if p.LeafIndex < 0 {
+		// a gap in the sequence (rolled-back insert), not a sealed entry
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "ledger entry not found"})
+		return
+	}
+	if merkleRoot(hashes) != root.Root {
+		logger(ctx).Error("ledger range no longer matches its merkle root", "root_id", root.ID, "first_ledger_id", root.FirstLedgerID, "last_ledger_id", root.LastLedgerID)
+		http.Error(w, "ledger range does not match its published root", http.StatusInternalServerError)
+		return
+	}
+	p.LeafHash = hashes[p.LeafIndex]
+	p.Path = merklePath(p.LeafIndex, hashes)
+	writeJSON(w, http.StatusOK, p)
+}
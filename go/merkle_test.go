@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// rfc6962Leaves and rfc6962Roots are the reference vectors of the
+// Certificate Transparency implementations: rfc6962Roots[n-1] is the root
+// of the first n leaves.
+var (
+	rfc6962Leaves = []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"}
+	rfc6962Roots  = []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+		"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+		"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+		"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+	}
+)
+
+func rfc6962LeafHashes(t *testing.T) []merkleHash {
+	t.Helper()
+	hashes := make([]merkleHash, len(rfc6962Leaves))
+	for i, l := range rfc6962Leaves {
+		raw, err := hex.DecodeString(l)
+		if err != nil {
+			t.Fatalf("leaf %d: %v", i, err)
+		}
+		hashes[i] = merkleLeafHash(raw)
+	}
+	return hashes
+}
+
+// verifyInclusion checks an audit path the way a client holding only the
+// root does (RFC 9162, section 2.1.3.2).
+func verifyInclusion(index, size int, leaf merkleHash, path []merkleHash, root merkleHash) bool {
+	if index >= size {
+		return false
+	}
+	fn, sn, r := index, size-1, leaf
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && r == root
+}
+
+func TestMerkleRoot(t *testing.T) {
+	if empty := merkleRoot(nil); hex.EncodeToString(empty[:]) != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("empty tree root %x, want the hash of nothing", empty)
+	}
+	leaves := rfc6962LeafHashes(t)
+	for n := 1; n <= len(leaves); n++ {
+		root := merkleRoot(leaves[:n])
+		if got := hex.EncodeToString(root[:]); got != rfc6962Roots[n-1] {
+			t.Errorf("root of %d leaves = %s, want %s", n, got, rfc6962Roots[n-1])
+		}
+	}
+}
+
+func TestMerkleSplit(t *testing.T) {
+	for n, want := range map[int]int{2: 1, 3: 2, 4: 2, 5: 4, 7: 4, 8: 4, 9: 8, 1000: 512, 1025: 1024} {
+		if got := merkleSplit(n); got != want {
+			t.Errorf("merkleSplit(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+func TestMerklePath(t *testing.T) {
+	leaves := rfc6962LeafHashes(t)
+	// every leaf of every tree size, odd sizes included, proves against
+	// its root, and only in its own position
+	for n := 1; n <= len(leaves); n++ {
+		root := merkleRoot(leaves[:n])
+		for m := 0; m < n; m++ {
+			path := merklePath(m, leaves[:n])
+			if !verifyInclusion(m, n, leaves[m], path, root) {
+				t.Errorf("leaf %d of %d: path does not verify", m, n)
+			}
+			if n > 1 && verifyInclusion((m+1)%n, n, leaves[m], path, root) {
+				t.Errorf("leaf %d of %d: path verifies at index %d too", m, n, (m+1)%n)
+			}
+		}
+	}
+	if path := merklePath(0, leaves[:1]); len(path) != 0 {
+		t.Errorf("single leaf tree has a path of %d hashes, want none", len(path))
+	}
+	// 7 leaves: leaf 6 sits alone in the right subtree of 3, so its path
+	// is the roots of leaves 4-5 and 0-3
+	if path := merklePath(6, leaves[:7]); len(path) != 2 ||
+		path[0] != merkleRoot(leaves[4:6]) || path[1] != merkleRoot(leaves[:4]) {
+		t.Errorf("path of leaf 6 of 7 = %x", path)
+	}
+}
+
+func TestMerkleTamperedLeaf(t *testing.T) {
+	transfer := int64(42)
+	ledger := []ledgerLeaf{
+		{ID: 1, Type: "DEBIT", AccountID: "acc-1", Amount: 1500, At: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), TransferID: &transfer},
+		{ID: 2, Type: "CREDIT", AccountID: "acc-2", Amount: 1500, At: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), TransferID: &transfer},
+		{ID: 3, Type: "DEBIT", AccountID: "acc-3", Amount: 99, At: time.Date(2026, 1, 2, 3, 4, 6, 0, time.UTC)},
+	}
+	hashes := make([]merkleHash, len(ledger))
+	for i, l := range ledger {
+		hashes[i] = merkleLeafHash(l.bytes())
+	}
+	root := merkleRoot(hashes)
+	path := merklePath(1, hashes)
+	if !verifyInclusion(1, len(hashes), hashes[1], path, root) {
+		t.Fatal("untampered entry does not verify")
+	}
+
+	tampered := ledger[1]
+	tampered.Amount = 150000
+	if verifyInclusion(1, len(hashes), merkleLeafHash(tampered.bytes()), path, root) {
+		t.Error("entry with a changed amount verifies against the sealed root")
+	}
+	forged := append([]merkleHash(nil), hashes...)
+	forged[1] = merkleLeafHash(tampered.bytes())
+	if merkleRoot(forged) == root {
+		t.Error("changing an entry leaves the root unchanged")
+	}
+	// the children of an interior node passed off as one leaf's data must
+	// not verify in a smaller tree: the prefixes keep leaves and nodes apart
+	children := append(append([]byte(nil), hashes[0][:]...), hashes[1][:]...)
+	if verifyInclusion(0, 2, merkleLeafHash(children), []merkleHash{hashes[2]}, root) {
+		t.Error("interior node verifies as a leaf")
+	}
+	if got, want := string(ledger[2].bytes()), "3\tDEBIT\tacc-3\t0.99\t2026-01-02T03:04:06Z\t"; got != want {
+		t.Errorf("leaf bytes %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS op_journal (
+    operation_id TEXT PRIMARY KEY,
+    state TEXT NOT NULL,
+    request JSONB NOT NULL,
+    response JSONB,
+    error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_op_journal_state ON op_journal(state, updated_at);
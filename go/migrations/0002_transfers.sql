@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS transfers (
+    id BIGSERIAL PRIMARY KEY,
+    operation_id TEXT,
+    from_account_id TEXT NOT NULL REFERENCES accounts(id),
+    to_account_id TEXT NOT NULL REFERENCES accounts(id),
+    amount NUMERIC NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_transfers_from_created ON transfers(from_account_id, created_at DESC);
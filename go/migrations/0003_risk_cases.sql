@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS risk_cases (
+    id BIGSERIAL PRIMARY KEY,
+    rule TEXT NOT NULL,
+    decision TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    account_id TEXT NOT NULL,
+    operation_id TEXT,
+    client TEXT NOT NULL,
+    details JSONB,
+    status TEXT NOT NULL DEFAULT 'open',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_risk_cases_status ON risk_cases(status, id DESC);
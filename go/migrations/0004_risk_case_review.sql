@@ -0,0 +1,5 @@
+ALTER TABLE risk_cases
+    ADD COLUMN IF NOT EXISTS request JSONB,
+    ADD COLUMN IF NOT EXISTS resolved_by TEXT,
+    ADD COLUMN IF NOT EXISTS resolution TEXT,
+    ADD COLUMN IF NOT EXISTS resolved_at TIMESTAMPTZ;
@@ -0,0 +1,13 @@
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE TABLE IF NOT EXISTS rule_sets (
+    version SERIAL PRIMARY KEY,
+    source TEXT NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT false,
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    activated_by TEXT,
+    activated_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_rule_sets_active ON rule_sets(active) WHERE active;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS schedules (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    cron TEXT NOT NULL,
+    job_type TEXT NOT NULL,
+    params JSONB NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    next_run_at TIMESTAMPTZ,
+    last_run_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_schedules_due ON schedules(next_run_at) WHERE enabled;
+
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS schedule_id BIGINT REFERENCES schedules(id);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_schedule ON jobs(schedule_id, id) WHERE schedule_id IS NOT NULL;
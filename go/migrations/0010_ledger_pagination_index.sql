@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS idx_ledger_account_id ON ledger(account_id, id DESC);
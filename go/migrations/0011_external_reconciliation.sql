@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS recon_reports (
+    id BIGSERIAL PRIMARY KEY,
+    source TEXT NOT NULL,
+    period_from TIMESTAMPTZ NOT NULL,
+    period_to TIMESTAMPTZ NOT NULL,
+    rows INT NOT NULL,
+    imported_by TEXT NOT NULL,
+    imported_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS recon_rows (
+    report_id BIGINT NOT NULL REFERENCES recon_reports(id),
+    line INT NOT NULL,
+    reference TEXT NOT NULL,
+    amount NUMERIC NOT NULL,
+    PRIMARY KEY (report_id, line)
+);
+
+CREATE INDEX IF NOT EXISTS idx_recon_rows_reference ON recon_rows(report_id, reference);
+
+CREATE INDEX IF NOT EXISTS idx_transfers_created_at ON transfers(created_at);
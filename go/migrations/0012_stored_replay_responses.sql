@@ -0,0 +1,5 @@
+-- BYTEA rather than JSONB: JSONB normalizes key order and spacing,
+-- and replays must be byte-for-byte what the first caller received
+ALTER TABLE processed_ops
+    ADD COLUMN IF NOT EXISTS response BYTEA,
+    ADD COLUMN IF NOT EXISTS status INT;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS suspense_items (
+    id BIGSERIAL PRIMARY KEY,
+    operation_id TEXT NOT NULL UNIQUE,
+    reference TEXT NOT NULL,
+    amount NUMERIC NOT NULL,
+    source TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL,
+    status TEXT NOT NULL,
+    account_id TEXT,
+    resolved_by TEXT,
+    note TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_suspense_items_status ON suspense_items(status, id);
@@ -0,0 +1,14 @@
+ALTER TABLE ledger ADD COLUMN IF NOT EXISTS transfer_id BIGINT REFERENCES transfers(id);
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS reverses_id BIGINT REFERENCES transfers(id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_transfers_reverses ON transfers(reverses_id) WHERE reverses_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS payout_returns (
+    transfer_id BIGINT PRIMARY KEY REFERENCES transfers(id),
+    reason_code TEXT NOT NULL,
+    operation_id TEXT NOT NULL,
+    credited_account_id TEXT NOT NULL,
+    reported_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS sweep_rules (
+    account_id TEXT PRIMARY KEY REFERENCES accounts(id),
+    linked_account_id TEXT NOT NULL REFERENCES accounts(id),
+    max_balance NUMERIC,
+    min_balance NUMERIC,
+    updated_by TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,2 @@
+-- the request that last (re)started the operation, to find its logs
+ALTER TABLE op_journal ADD COLUMN IF NOT EXISTS request_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS virtual_accounts (
+    id TEXT PRIMARY KEY,
+    account_id TEXT NOT NULL REFERENCES accounts(id),
+    label TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL,
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    closed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_virtual_accounts_account ON virtual_accounts(account_id);
+
+-- the destination an inbound credit was attributed through
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS virtual_account_id TEXT;
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS usage (
+    tenant_id TEXT NOT NULL,
+    period DATE NOT NULL,
+    meter TEXT NOT NULL,
+    quantity BIGINT NOT NULL,
+    final BOOLEAN NOT NULL DEFAULT false,
+    quota_notified BOOLEAN NOT NULL DEFAULT false,
+    computed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, period, meter)
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_period ON usage(period, tenant_id);
+
+CREATE TABLE IF NOT EXISTS usage_quotas (
+    tenant_id TEXT NOT NULL,
+    meter TEXT NOT NULL,
+    soft_limit BIGINT NOT NULL,
+    updated_by TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, meter)
+);
+
+CREATE INDEX IF NOT EXISTS idx_events_created_at ON events(created_at);
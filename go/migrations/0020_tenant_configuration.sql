@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS tenant_configs (
+    tenant_id TEXT PRIMARY KEY,
+    config JSONB NOT NULL,
+    updated_by TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
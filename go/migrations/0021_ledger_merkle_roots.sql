@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS ledger_merkle_roots (
+    id BIGSERIAL PRIMARY KEY,
+    first_ledger_id BIGINT NOT NULL UNIQUE,
+    last_ledger_id BIGINT NOT NULL UNIQUE,
+    leaf_count INT NOT NULL,
+    root BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS scheduled_transfers (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    from_account_id TEXT NOT NULL REFERENCES accounts(id),
+    to_account_id TEXT NOT NULL,
+    amount NUMERIC NOT NULL,
+    execute_at TIMESTAMPTZ NOT NULL,
+    status TEXT NOT NULL DEFAULT 'scheduled',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    last_error TEXT,
+    response JSONB,
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_scheduled_transfers_due ON scheduled_transfers(next_attempt_at) WHERE status IN ('scheduled', 'running');
+
+CREATE INDEX IF NOT EXISTS idx_scheduled_transfers_from ON scheduled_transfers(from_account_id);
@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS standing_orders (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    from_account_id TEXT NOT NULL REFERENCES accounts(id),
+    to_account_id TEXT NOT NULL,
+    amount NUMERIC NOT NULL,
+    frequency TEXT NOT NULL,
+    start_at TIMESTAMPTZ NOT NULL,
+    end_at TIMESTAMPTZ,
+    max_executions INT,
+    status TEXT NOT NULL DEFAULT 'active',
+    occurrence INT NOT NULL DEFAULT 0,
+    executions INT NOT NULL DEFAULT 0,
+    skipped INT NOT NULL DEFAULT 0,
+    next_run_at TIMESTAMPTZ NOT NULL,
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_standing_orders_due ON standing_orders(next_run_at) WHERE status = 'active';
+
+CREATE INDEX IF NOT EXISTS idx_standing_orders_from ON standing_orders(from_account_id);
+
+ALTER TABLE scheduled_transfers ADD COLUMN IF NOT EXISTS standing_order_id BIGINT REFERENCES standing_orders(id);
+
+ALTER TABLE scheduled_transfers ADD COLUMN IF NOT EXISTS occurrence INT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_scheduled_transfers_occurrence ON scheduled_transfers(standing_order_id, occurrence);
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS standing_order_id BIGINT;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS selftest_probes (
+    instance TEXT PRIMARY KEY,
+    token TEXT NOT NULL,
+    written_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,16 @@
+-- existing accounts and rows are in the currency the service ran with
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT '${SERVICE_CURRENCY}';
+
+ALTER TABLE ledger ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT '${SERVICE_CURRENCY}';
+
+ALTER TABLE ledger ADD COLUMN IF NOT EXISTS fx_rate NUMERIC;
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT '${SERVICE_CURRENCY}';
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS destination_amount NUMERIC;
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS destination_currency TEXT;
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS fx_rate NUMERIC;
+
+UPDATE transfers SET destination_amount = amount, destination_currency = currency WHERE destination_amount IS NULL;
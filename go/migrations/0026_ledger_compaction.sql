@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS ledger_archive (
+    id BIGINT PRIMARY KEY,
+    type TEXT NOT NULL,
+    account_id TEXT NOT NULL,
+    amount NUMERIC NOT NULL,
+    at TIMESTAMPTZ NOT NULL,
+    transfer_id BIGINT,
+    currency TEXT NOT NULL,
+    fx_rate NUMERIC,
+    compacted_into BIGINT NOT NULL,
+    compacted_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_ledger_archive_compacted ON ledger_archive(compacted_into, id);
+
+ALTER TABLE ledger ADD COLUMN IF NOT EXISTS summary_entries INT;
+
+ALTER TABLE ledger ADD COLUMN IF NOT EXISTS summary_first_id BIGINT;
+
+ALTER TABLE ledger ADD COLUMN IF NOT EXISTS summary_period DATE;
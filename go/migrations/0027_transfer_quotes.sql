@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS transfer_quotes (
+    id TEXT PRIMARY KEY,
+    from_account_id TEXT NOT NULL,
+    to_account_id TEXT NOT NULL,
+    amount NUMERIC NOT NULL,
+    currency TEXT NOT NULL,
+    fee NUMERIC NOT NULL,
+    destination_amount NUMERIC NOT NULL,
+    destination_currency TEXT NOT NULL,
+    fx_rate NUMERIC,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    used_operation_id TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_transfer_quotes_unused ON transfer_quotes(expires_at) WHERE used_at IS NULL;
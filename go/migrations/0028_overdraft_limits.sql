@@ -0,0 +1,14 @@
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS overdraft_limit NUMERIC NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS overdraft_limit_changes (
+    id BIGSERIAL PRIMARY KEY,
+    account_id TEXT NOT NULL REFERENCES accounts(id),
+    old_limit NUMERIC NOT NULL,
+    new_limit NUMERIC NOT NULL,
+    balance_at_change NUMERIC NOT NULL,
+    actor TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_overdraft_limit_changes_account ON overdraft_limit_changes(account_id, id DESC);
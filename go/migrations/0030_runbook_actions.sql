@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS runtime_flags (
+    name TEXT PRIMARY KEY,
+    enabled BOOLEAN NOT NULL,
+    updated_by TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS runbook_actions (
+    id BIGSERIAL PRIMARY KEY,
+    action TEXT NOT NULL,
+    target TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    detail JSONB NOT NULL,
+    at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS transfer_reversals (
+    transfer_id BIGINT PRIMARY KEY REFERENCES transfers(id),
+    reversal_id BIGINT NOT NULL REFERENCES transfers(id),
+    fee_refunded NUMERIC NOT NULL DEFAULT 0,
+    reason TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
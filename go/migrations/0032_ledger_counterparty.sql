@@ -0,0 +1,11 @@
+-- transfer_id already pairs the two sides of a movement; the
+-- counterparty saves joining transfers to find the other account
+ALTER TABLE ledger ADD COLUMN IF NOT EXISTS counterparty_account_id TEXT;
+
+ALTER TABLE ledger_archive ADD COLUMN IF NOT EXISTS counterparty_account_id TEXT;
+
+UPDATE ledger l SET counterparty_account_id = CASE WHEN l.type = 'DEBIT' THEN t.to_account_id ELSE t.from_account_id END
+    FROM transfers t WHERE t.id = l.transfer_id AND l.counterparty_account_id IS NULL;
+
+UPDATE ledger_archive l SET counterparty_account_id = CASE WHEN l.type = 'DEBIT' THEN t.to_account_id ELSE t.from_account_id END
+    FROM transfers t WHERE t.id = l.transfer_id AND l.counterparty_account_id IS NULL;
@@ -0,0 +1,6 @@
+-- entries already written stay unhashed; see ledgerchain.go
+ALTER TABLE ledger ADD COLUMN IF NOT EXISTS hash BYTEA;
+
+ALTER TABLE ledger_archive ADD COLUMN IF NOT EXISTS hash BYTEA;
+
+CREATE INDEX IF NOT EXISTS idx_ledger_archive_account ON ledger_archive(account_id, id);
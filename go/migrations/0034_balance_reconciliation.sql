@@ -0,0 +1,19 @@
+-- opening_balance is what an account held before its first ledger
+-- entry; only balances seeded outside the ledger have one
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS opening_balance NUMERIC NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS reconciliation_issues (
+    id BIGSERIAL PRIMARY KEY,
+    account_id TEXT NOT NULL REFERENCES accounts(id),
+    currency TEXT NOT NULL,
+    balance NUMERIC NOT NULL,
+    ledger_balance NUMERIC NOT NULL,
+    drift NUMERIC NOT NULL,
+    job_id BIGINT NOT NULL REFERENCES jobs(id),
+    detected_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    resolved_at TIMESTAMPTZ,
+    resolved_by_job_id BIGINT REFERENCES jobs(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_reconciliation_issues_open ON reconciliation_issues(account_id) WHERE resolved_at IS NULL;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS transfer_receipts (
+    number TEXT PRIMARY KEY,
+    transfer_id BIGINT NOT NULL UNIQUE REFERENCES transfers(id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS eod_runs (
+    business_date DATE PRIMARY KEY,
+    status TEXT NOT NULL,
+    job_id BIGINT NOT NULL REFERENCES jobs(id),
+    started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS eod_steps (
+    business_date DATE NOT NULL REFERENCES eod_runs(business_date),
+    step TEXT NOT NULL,
+    status TEXT NOT NULL,
+    job_id BIGINT REFERENCES jobs(id),
+    attempts INT NOT NULL DEFAULT 0,
+    error TEXT,
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    PRIMARY KEY (business_date, step)
+);
@@ -0,0 +1,33 @@
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS heartbeat_at TIMESTAMPTZ;
+
+UPDATE jobs SET heartbeat_at = started_at WHERE heartbeat_at IS NULL AND started_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS exports (
+    id BIGSERIAL PRIMARY KEY,
+    job_id BIGINT NOT NULL REFERENCES jobs(id),
+    account_id TEXT,
+    range_from TIMESTAMPTZ NOT NULL,
+    range_to TIMESTAMPTZ NOT NULL,
+    watermark BIGINT NOT NULL,
+    idempotency_key TEXT UNIQUE,
+    total_entries BIGINT,
+    entries_written BIGINT NOT NULL DEFAULT 0,
+    cursor BIGINT NOT NULL DEFAULT 0,
+    chunks INT NOT NULL DEFAULT 0,
+    bytes BIGINT NOT NULL DEFAULT 0,
+    etag TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS export_chunks (
+    export_id BIGINT NOT NULL REFERENCES exports(id),
+    seq INT NOT NULL,
+    data BYTEA NOT NULL,
+    last_ledger_id BIGINT NOT NULL,
+    PRIMARY KEY (export_id, seq)
+);
+
+CREATE INDEX IF NOT EXISTS idx_ledger_archive_at ON ledger_archive(at, id);
@@ -0,0 +1,5 @@
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+
+ALTER TABLE webhook_subscriptions ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS payload_version INT NOT NULL DEFAULT 1;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+    id TEXT PRIMARY KEY,
+    sha256 BYTEA NOT NULL UNIQUE,
+    client_id TEXT NOT NULL,
+    tenant_id TEXT NOT NULL,
+    scopes TEXT[] NOT NULL,
+    source TEXT NOT NULL,
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ,
+    expired_by TEXT,
+    replaced_by TEXT
+);
@@ -0,0 +1,13 @@
+-- host is webhookHostSQL (webhooks.go) of the subscription URL
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS tenant_id TEXT;
+
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS host TEXT;
+
+UPDATE webhook_deliveries d SET tenant_id = w.tenant_id, host = lower(substring(w.url from '^[A-Za-z][A-Za-z0-9+.-]*://([^/?#]+)'))
+    FROM webhook_subscriptions w WHERE w.id = d.subscription_id AND d.host IS NULL;
+
+ALTER TABLE webhook_deliveries ALTER COLUMN tenant_id SET NOT NULL;
+
+ALTER TABLE webhook_deliveries ALTER COLUMN host SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_turn ON webhook_deliveries(tenant_id, host, next_attempt_at) WHERE status = 'pending';
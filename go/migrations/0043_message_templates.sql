@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS message_templates (
+    tenant_id TEXT NOT NULL,
+    channel TEXT NOT NULL,
+    name TEXT NOT NULL,
+    version INT NOT NULL,
+    subject TEXT NOT NULL DEFAULT '',
+    body TEXT NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT false,
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    activated_by TEXT,
+    activated_at TIMESTAMPTZ,
+    PRIMARY KEY (tenant_id, channel, name, version)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_message_templates_active ON message_templates(tenant_id, channel, name) WHERE active;
@@ -0,0 +1,3 @@
+DROP FUNCTION IF EXISTS tenant_now(TEXT);
+DROP FUNCTION IF EXISTS tenant_clock_offset(TEXT);
+DROP TABLE IF EXISTS tenant_clocks;
@@ -0,0 +1,16 @@
+-- Test clocks of sandbox tenants: how far ahead of real time the tenant
+-- runs. Tenants without a row run on real time.
+CREATE TABLE IF NOT EXISTS tenant_clocks (
+    tenant_id TEXT PRIMARY KEY,
+    offset_seconds BIGINT NOT NULL CHECK (offset_seconds >= 0),
+    updated_by TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE OR REPLACE FUNCTION tenant_clock_offset(tenant TEXT) RETURNS interval LANGUAGE sql STABLE AS $$
+    SELECT COALESCE((SELECT make_interval(secs => offset_seconds) FROM tenant_clocks WHERE tenant_id = tenant), interval '0')
+$$;
+
+CREATE OR REPLACE FUNCTION tenant_now(tenant TEXT) RETURNS timestamptz LANGUAGE sql STABLE AS $$
+    SELECT now() + tenant_clock_offset(tenant)
+$$;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_processed_ops_created;
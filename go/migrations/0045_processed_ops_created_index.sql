@@ -0,0 +1,3 @@
+-- /debug/state lists the newest processed operations; without this index
+-- it sorts the whole table.
+CREATE INDEX IF NOT EXISTS idx_processed_ops_created ON processed_ops(created_at DESC);
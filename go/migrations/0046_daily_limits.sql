@@ -0,0 +1,3 @@
+-- daily_limit caps what an account may send per day, summed from its DEBIT
+-- ledger rows; NULL falls back to the tenant's dailyLimit.
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS daily_limit NUMERIC;
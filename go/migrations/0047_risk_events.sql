@@ -0,0 +1,21 @@
+-- One row per risk rule hit, from either stage: pre_transfer rules run
+-- before the transfer transaction, pre_commit checks inside it. The case the
+-- hit opened is the review workflow; these rows are what rules are tuned
+-- against.
+CREATE TABLE IF NOT EXISTS risk_events (
+    id BIGSERIAL PRIMARY KEY,
+    stage TEXT NOT NULL,
+    rule TEXT NOT NULL,
+    decision TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    account_id TEXT NOT NULL,
+    to_account_id TEXT NOT NULL,
+    amount NUMERIC NOT NULL,
+    operation_id TEXT,
+    case_id BIGINT REFERENCES risk_cases(id),
+    details JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_risk_events_rule ON risk_events(rule, id DESC);
+CREATE INDEX IF NOT EXISTS idx_risk_events_account ON risk_events(account_id, id DESC);
@@ -0,0 +1,26 @@
+-- Authorization holds reserve funds without booking them: balance stays the
+-- booked balance and held is the sum of the account's active holds, so
+-- what it can spend is balance - held (plus its overdraft). Capturing a hold
+-- books it as a transfer and releases it in the same transaction.
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS held NUMERIC NOT NULL DEFAULT 0 CHECK (held >= 0);
+
+CREATE TABLE IF NOT EXISTS holds (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    account_id TEXT NOT NULL REFERENCES accounts(id),
+    to_account_id TEXT NOT NULL REFERENCES accounts(id),
+    amount NUMERIC NOT NULL CHECK (amount > 0),
+    currency TEXT NOT NULL,
+    operation_id TEXT UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'active',
+    expires_at TIMESTAMPTZ NOT NULL,
+    captured_amount NUMERIC,
+    transfer_id BIGINT REFERENCES transfers(id),
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    closed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_holds_account ON holds(account_id, id DESC);
+CREATE INDEX IF NOT EXISTS idx_holds_expiring ON holds(expires_at) WHERE status = 'active';
@@ -0,0 +1,19 @@
+-- Balance adjustments are operator corrections. Each one is booked as a
+-- transfer between the account and the ADJUSTMENTS system account, so the
+-- ledger and the hash chain stay the only way a balance moves, and is kept
+-- here with who made it, why, and the balance either side of it.
+CREATE TABLE IF NOT EXISTS balance_adjustments (
+    id BIGSERIAL PRIMARY KEY,
+    account_id TEXT NOT NULL REFERENCES accounts(id),
+    amount NUMERIC NOT NULL CHECK (amount <> 0),
+    currency TEXT NOT NULL,
+    balance_before NUMERIC NOT NULL,
+    balance_after NUMERIC NOT NULL,
+    actor TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    operation_id TEXT UNIQUE,
+    transfer_id BIGINT NOT NULL REFERENCES transfers(id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_balance_adjustments_account ON balance_adjustments(account_id, id DESC);
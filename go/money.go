@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+
+	"fintech-go/internal/ledger"
+)
+
+// Money is ledger.Money; the alias keeps package main reading as before.
+type Money = ledger.Money
+
+// serviceCurrency is the single currency all amounts are expressed in.
+var serviceCurrency, moneyExponent = loadServiceCurrency()
+
+func loadServiceCurrency() (string, int) {
+	code := strings.ToUpper(envOrDefault("CURRENCY", "BRL"))
+	exp, err := ledger.SetCurrency(code)
+	if err != nil {
+		fatal("unsupported CURRENCY", "currency", code)
+	}
+	return code, exp
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"fintech-go/internal/ledger"
+)
+
+// settlementAccountID is the internal counterpart of deposits and
+// withdrawals. Cash entering or leaving the system is booked as a transfer
+// against it, so every movement keeps its DEBIT/CREDIT pair and the ledger
+// sums to zero. Its balance is the negated total of customer funds and may go
+// negative.
+const settlementAccountID = "SETTLEMENT"
+
+// isSystemAccount reports whether id is one of the internal accounts that
+// clients can never move funds in or out of directly.
+func isSystemAccount(id string) bool {
+	return id == settlementAccountID || id == suspenseAccountID || id == feesAccountID || id == adjustmentsAccountID
+}
+
+type movementRequest struct {
+	Amount      Money  `json:"amount"`
+	OperationID string `json:"operationId"`
+	// Cash marks notes and coins paid in or out over the counter. The amount
+	// must then be payable in cash, which for some currencies is coarser
+	// than the minor unit: 0.05 for CHF.
+	Cash bool `json:"cash,omitempty"`
+}
+
+func (s *Store) handleDeposit(w http.ResponseWriter, r *http.Request) {
+	s.handleMovement(w, r, "deposit")
+}
+
+func (s *Store) handleWithdraw(w http.ResponseWriter, r *http.Request) {
+	s.handleMovement(w, r, "withdraw")
+}
+
+// handleMovement runs a deposit or withdrawal through the transfer pipeline,
+// so it gets the same operation lock, journal, risk screening and row
+// locking as transfers.
+func (s *Store) handleMovement(w http.ResponseWriter, r *http.Request, kind string) {
+	var body movementRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		if errors.Is(err, ledger.ErrTooPrecise) {
+			transferRequests.WithLabelValues("validation_error").Inc()
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+			return
+		}
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	id := r.PathValue("id")
+	if isSystemAccount(id) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "account is reserved"})
+		return
+	}
+	if body.Amount <= 0 {
+		transferRequests.WithLabelValues("validation_error").Inc()
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "amount must be > 0"})
+		return
+	}
+	if body.Cash {
+		msg, err := s.cashAmountError(r.Context(), id, body.Amount)
+		if err != nil {
+			http.Error(w, "failed to load account", http.StatusInternalServerError)
+			return
+		}
+		if msg != "" {
+			transferRequests.WithLabelValues("validation_error").Inc()
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: msg})
+			return
+		}
+	}
+
+	req := TransferRequest{FromAccountID: settlementAccountID, ToAccountID: id, Amount: body.Amount, OperationID: body.OperationID}
+	if kind == "withdraw" {
+		req.FromAccountID, req.ToAccountID = id, settlementAccountID
+	}
+	ctx := withMeta(r.Context(), metaFromRequest(r))
+	resp, status, err := s.transfer(ctx, req)
+	if err != nil {
+		logger(ctx).Error(kind+" failed", "operation_id", req.OperationID, "error", err)
+		if errors.Is(err, errOperationInFlight) {
+			w.Header().Set("Location", apiPath(r.Context(), "/operations/"+url.PathEscape(req.OperationID)))
+		}
+		writeError(w, status, err)
+		return
+	}
+	writeTransfer(w, status, resp)
+	s.markJournal(ctx, req.OperationID, journalResponded, "")
+}
+
+// cashAmountError says why amount cannot be paid in cash in the account's
+// currency, or returns "" when it can. An unknown account is left for the
+// transfer to report.
+func (s *Store) cashAmountError(ctx context.Context, accountID string, amount Money) (string, error) {
+	a, err := s.getAccount(ctx, accountID)
+	if errors.Is(err, errAccountNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	c, err := currency(a.Currency)
+	if err != nil {
+		return "", err
+	}
+	rounded, err := c.CashRound(amount)
+	if err != nil {
+		return "", err
+	}
+	if rounded != amount {
+		return fmt.Sprintf("%s %s cannot be paid in cash; the nearest cash amount is %s", c.Format(amount), c.Code, c.Format(rounded)), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"fintech-go/internal/api"
+	"fintech-go/internal/store"
+)
+
+// GET /v1/openapi.json describes the public transfer, account and ledger
+// endpoints. The operations are listed here, but their bodies are not:
+// schemas are reflected from the request and response structs the handlers
+// decode and encode, following their json tags, so a field added to a
+// struct shows up in the document without anyone editing it. Request
+// bodies name their required fields, taken from the handlers' validation;
+// response fields are required unless omitempty or a pointer.
+//
+// Money is documented as a decimal number in the account's currency; types
+// with their own MarshalJSON are strings.
+
+type apiParam struct {
+	name, in, description string
+	schema                map[string]any
+	required              bool
+}
+
+type apiOperation struct {
+	method, path, summary string
+	params                []apiParam
+	// request is the body type and required its mandatory fields.
+	request   any
+	required  []string
+	responses map[int]apiResponse
+}
+
+type apiResponse struct {
+	description string
+	body        any
+}
+
+func pathParam(name, description string) apiParam {
+	return apiParam{name: name, in: "path", description: description, schema: map[string]any{"type": "string"}, required: true}
+}
+
+func queryParam(name, typ, description string) apiParam {
+	return apiParam{name: name, in: "query", description: description, schema: map[string]any{"type": typ}}
+}
+
+var errorBody = apiResponse{"error; message says why", TransferResponse{}}
+
+var apiOperations = []apiOperation{
+	{method: "POST", path: "/transfer", summary: "Move funds between two accounts. operationId makes retries idempotent.",
+		request: TransferRequest{}, required: []string{"fromAccountId", "toAccountId", "amount"},
+		responses: map[int]apiResponse{
+			200: {"transfer completed", TransferResponse{}},
+			202: {"transfer held for manual review", TransferResponse{}},
+			400: errorBody, 403: errorBody, 409: errorBody, 422: errorBody,
+		}},
+	{method: "POST", path: "/transfer/quote", summary: "Quote the fee and FX rate of a transfer, to execute later with quoteId.",
+		request: TransferRequest{}, required: []string{"fromAccountId", "toAccountId", "amount"},
+		responses: map[int]apiResponse{200: {"quote", transferQuote{}}, 400: errorBody, 422: errorBody}},
+	{method: "POST", path: "/transfers/{operationId}/reverse", summary: "Reverse a completed transfer.",
+		params:  []apiParam{pathParam("operationId", "operation id of the transfer to reverse")},
+		request: reverseRequest{}, required: []string{"reason"},
+		responses: map[int]apiResponse{200: {"reversal booked", TransferResponse{}}, 400: errorBody, 404: errorBody, 409: errorBody}},
+	{method: "GET", path: "/receipts/{number}", summary: "Look a transfer up by its receipt number.",
+		params: []apiParam{pathParam("number", "receipt number, hyphens optional"),
+			queryParam("locale", "string", "display locale, default the tenant's"), queryParam("timeZone", "string", "IANA time zone, default the tenant's")},
+		responses: map[int]apiResponse{200: {"receipt", receipt{}}, 400: errorBody, 404: errorBody}},
+	{method: "GET", path: "/format", summary: "Format an amount and a time the way statements and receipts show them.",
+		params: []apiParam{queryParam("amount", "number", ""), queryParam("currency", "string", "default the service currency"),
+			queryParam("at", "string", "RFC 3339"), queryParam("locale", "string", "default the tenant's, e.g. pt-BR"),
+			queryParam("timeZone", "string", "IANA time zone, default the tenant's")},
+		responses: map[int]apiResponse{200: {"formatted values", formatResult{}}, 400: errorBody}},
+	{method: "POST", path: "/accounts", summary: "Open an account.",
+		request:   api.CreateAccountRequest{},
+		responses: map[int]apiResponse{201: {"account opened", Account{}}, 400: errorBody, 403: errorBody, 409: errorBody}},
+	{method: "GET", path: "/accounts", summary: "List accounts by id.",
+		params: []apiParam{queryParam("tenantId", "string", ""), queryParam("status", "string", ""),
+			queryParam("cursor", "string", "nextCursor of the previous page"), queryParam("limit", "integer", "at most 500, default 100")},
+		responses: map[int]apiResponse{200: {"page of accounts", store.AccountPage{}}}},
+	{method: "GET", path: "/accounts/{id}", summary: "Get an account.",
+		params:    []apiParam{pathParam("id", "account id")},
+		responses: map[int]apiResponse{200: {"account", Account{}}, 404: errorBody}},
+	{method: "POST", path: "/accounts:batchGet", summary: "Get up to 500 accounts in one call; missing ids are listed in notFound.",
+		request: api.BatchGetAccountsRequest{}, required: []string{"ids"},
+		responses: map[int]apiResponse{200: {"accounts", api.BatchGetAccountsResponse{}}, 400: errorBody}},
+	{method: "DELETE", path: "/accounts/{id}", summary: "Close an account; it must hold no funds.",
+		params:    []apiParam{pathParam("id", "account id")},
+		responses: map[int]apiResponse{200: {"account closed", Account{}}, 400: errorBody, 404: errorBody, 409: errorBody}},
+	{method: "GET", path: "/accounts/{id}/statements", summary: "Monthly statement: opening balance, the month's entries and closing balance, as JSON, CSV or PDF.",
+		params: []apiParam{pathParam("id", "account id"), queryParam("month", "string", "YYYY-MM, in the tenant's time zone; required"),
+			queryParam("format", "string", "json (default), csv or pdf")},
+		responses: map[int]apiResponse{200: {"statement", monthlyStatement{}}, 400: errorBody, 403: errorBody, 404: errorBody}},
+	{method: "GET", path: "/accounts/{id}/transactions", summary: "Page through the account's statement, newest first, as of the first page.",
+		params: []apiParam{pathParam("id", "account id"),
+			queryParam("from", "string", "RFC 3339, inclusive"), queryParam("to", "string", "RFC 3339, exclusive"),
+			queryParam("type", "string", "DEBIT or CREDIT"), queryParam("cursor", "string", "nextCursor of the previous page"),
+			queryParam("limit", "integer", "at most 500, default 50")},
+		responses: map[int]apiResponse{200: {"statement page", api.TransactionPage{}}, 400: errorBody, 404: errorBody}},
+	{method: "POST", path: "/accounts/{id}/deposit", summary: "Credit the account from settlement.",
+		params:  []apiParam{pathParam("id", "account id")},
+		request: movementRequest{}, required: []string{"amount"},
+		responses: map[int]apiResponse{200: {"deposit completed", TransferResponse{}}, 400: errorBody, 409: errorBody}},
+	{method: "POST", path: "/accounts/{id}/withdraw", summary: "Debit the account to settlement.",
+		params:  []apiParam{pathParam("id", "account id")},
+		request: movementRequest{}, required: []string{"amount"},
+		responses: map[int]apiResponse{200: {"withdrawal completed", TransferResponse{}}, 400: errorBody, 409: errorBody}},
+	{method: "POST", path: "/accounts/{id}/simulate", summary: "Project the balance day by day over scheduled transfers, standing orders, fees and interest; nothing is written.",
+		params:    []apiParam{pathParam("id", "account id")},
+		request:   projectionRequest{},
+		responses: map[int]apiResponse{200: {"projection", projection{}}, 400: errorBody, 403: errorBody, 404: errorBody}},
+	{method: "POST", path: "/holds", summary: "Reserve funds for a later capture; available drops, the booked balance does not.",
+		request: placeHoldRequest{}, required: []string{"accountId", "toAccountId", "amount"},
+		responses: map[int]apiResponse{201: {"hold placed", hold{}}, 200: {"hold already placed under operationId", hold{}},
+			400: errorBody, 403: errorBody, 409: errorBody}},
+	{method: "GET", path: "/holds", summary: "List an account's holds, newest first.",
+		params:    []apiParam{queryParam("accountId", "string", "required"), queryParam("status", "string", "active, captured, released or expired")},
+		responses: map[int]apiResponse{200: {"holds", map[string][]hold{}}, 400: errorBody}},
+	{method: "GET", path: "/holds/{id}", summary: "Get a hold.",
+		params:    []apiParam{pathParam("id", "hold id")},
+		responses: map[int]apiResponse{200: {"hold", hold{}}, 403: errorBody, 404: errorBody}},
+	{method: "POST", path: "/holds/{id}/capture", summary: "Book up to the held amount to the hold's destination and release the hold.",
+		params:  []apiParam{pathParam("id", "hold id")},
+		request: captureHoldRequest{},
+		responses: map[int]apiResponse{200: {"capture completed", TransferResponse{}}, 400: errorBody, 403: errorBody, 404: errorBody,
+			409: errorBody}},
+	{method: "POST", path: "/holds/{id}/release", summary: "Release an active hold without booking it.",
+		params:    []apiParam{pathParam("id", "hold id")},
+		responses: map[int]apiResponse{200: {"hold released", hold{}}, 403: errorBody, 404: errorBody, 409: errorBody}},
+	{method: "GET", path: "/ledger/verify", summary: "Verify the ledger hash chain of one account, or all.",
+		params:    []apiParam{queryParam("accountId", "string", "")},
+		responses: map[int]apiResponse{200: {"verification report", chainReport{}}}},
+	{method: "GET", path: "/ledger/merkle-roots", summary: "List published Merkle roots, newest first.",
+		params:    []apiParam{queryParam("before", "integer", "root id to page back from")},
+		responses: map[int]apiResponse{200: {"roots", merkleRootPage{}}, 400: errorBody}},
+	{method: "GET", path: "/ledger/entries/{id}/proof", summary: "Inclusion proof of a ledger entry in its published root.",
+		params:    []apiParam{pathParam("id", "ledger entry id")},
+		responses: map[int]apiResponse{200: {"proof", inclusionProof{}}, 400: errorBody, 404: errorBody}},
+	{method: "POST", path: "/admin/sandbox/reset", summary: "Wipe the caller's sandbox tenant and load a fixture profile (empty, basic or edge-cases).",
+		request: sandboxResetRequest{}, required: []string{"actor"},
+		responses: map[int]apiResponse{200: {"tenant reset", sandboxResetResult{}}, 400: errorBody, 403: errorBody, 409: errorBody}},
+	{method: "GET", path: "/admin/sandbox/clock", summary: "Show the caller's sandbox test clock.",
+		responses: map[int]apiResponse{200: {"clock", tenantClockView{}}, 403: errorBody}},
+	{method: "POST", path: "/admin/sandbox/clock/advance", summary: "Move the caller's sandbox test clock forward, by a duration or to a time.",
+		request: advanceClockRequest{}, required: []string{"actor"},
+		responses: map[int]apiResponse{200: {"clock advanced", tenantClockView{}}, 400: errorBody, 403: errorBody}},
+}
+
+// openAPISchemas reflects Go types into components/schemas.
+type openAPISchemas struct {
+	components map[string]any
+	// required overrides the required fields of request bodies.
+	required map[reflect.Type][]string
+}
+
+var (
+	moneyType      = reflect.TypeOf(Money(0))
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+	marshalerType  = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+func (g *openAPISchemas) schema(t reflect.Type) map[string]any {
+	switch {
+	case t == moneyType:
+		return map[string]any{"type": "number", "description": "decimal amount in the account's currency", "example": 10.5}
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		s := g.schema(t.Elem())
+		if _, ref := s["$ref"]; ref {
+			return map[string]any{"allOf": []any{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case t == rawMessageType:
+		return map[string]any{}
+	case t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType):
+		return map[string]any{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		name := componentName(t)
+		if _, done := g.components[name]; !done {
+			g.components[name] = nil // breaks cycles
+			g.components[name] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// object lists a struct's JSON fields, flattening embedded structs the way
+// encoding/json does.
+func (g *openAPISchemas) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = g.schema(f.Type)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+	if r, ok := g.required[t]; ok {
+		required = r
+	}
+	out := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		out["required"] = required
+	}
+	return out
+}
+
+// componentName exports unexported type names: transferQuote becomes
+// TransferQuote.
+func componentName(t reflect.Type) string {
+	r := []rune(t.Name())
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+func buildOpenAPI() map[string]any {
+	g := &openAPISchemas{components: map[string]any{}, required: map[reflect.Type][]string{}}
+	for _, op := range apiOperations {
+		if op.request != nil && op.required != nil {
+			g.required[reflect.TypeOf(op.request)] = op.required
+		}
+	}
+	paths := map[string]map[string]any{}
+	for _, op := range apiOperations {
+		o := map[string]any{"summary": op.summary}
+		var params []any
+		for _, p := range op.params {
+			param := map[string]any{"name": p.name, "in": p.in, "required": p.required, "schema": p.schema}
+			if p.description != "" {
+				param["description"] = p.description
+			}
+			params = append(params, param)
+		}
+		if params != nil {
+			o["parameters"] = params
+		}
+		if op.request != nil {
+			o["requestBody"] = map[string]any{"required": true, "content": map[string]any{
+				"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(op.request))}}}
+		}
+		responses := map[string]any{}
+		for code, resp := range op.responses {
+			responses[strconv.Itoa(code)] = map[string]any{"description": resp.description, "content": map[string]any{
+				"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(resp.body))}}}
+		}
+		o["responses"] = responses
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]any{}
+		}
+		paths[op.path][strings.ToLower(op.method)] = o
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Fintech transfer API",
+			"version": "1",
+		},
+		"components": map[string]any{
+			"schemas": g.components,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+		"servers":  []any{map[string]any{"url": "/v1"}},
+		"security": []any{map[string]any{"bearer": []any{}}, map[string]any{"apiKey": []any{}}},
+		"paths":    paths,
+	}
+}
+
+var openAPIDocument = sync.OnceValues(func() ([]byte, error) { return json.Marshal(buildOpenAPI()) })
+
+func (s *Store) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	doc, err := openAPIDocument()
+	if err != nil {
+		http.Error(w, "failed to render document", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(doc)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/store"
+)
+
+var errOperationInFlight = store.ErrOperationInFlight
+
+// errLocksBusy means every lock connection stayed taken for the whole lock
+// wait; the operation never started and can be retried as is.
+var errLocksBusy = errors.New("too many operations in flight, retry later")
+
+// lockOperation takes a session-level advisory lock keyed on operationID so
+// two identical requests cannot execute concurrently. A transaction-scoped
+// lock would be cheaper, but under RepeatableRead/Serializable its snapshot
+// predates the holder's commit and the duplicate check after acquiring it
+// would miss the processed_ops row. The lock therefore lives on its own
+// connection for the duration of the operation.
+//
+// Those connections come from s.locks, not s.pool: the operation itself
+// needs pool connections while the lock is held, so drawing both from one
+// pool deadlocks once every connection is a lock holder. Waiting for a lock
+// connection is bounded too, by s.lockWait, and past it gives errLocksBusy.
+//
+// When the lock is held elsewhere it polls for up to s.lockWait, so a retry
+// racing the original usually gets the stored result instead of an error;
+// after that it returns errOperationInFlight.
+func (s *Store) lockOperation(ctx context.Context, operationID string) (func(), error) {
+	locks := s.locks
+	if locks == nil {
+		locks = s.pool
+	}
+	// at least a second, so a zero lock wait still leaves time to dial
+	acquireCtx, cancel := context.WithTimeout(ctx, max(s.lockWait, time.Second))
+	conn, err := locks.Acquire(acquireCtx)
+	cancel()
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			opLockConflicts.WithLabelValues("busy").Inc()
+			return nil, errLocksBusy
+		}
+		return nil, err
+	}
+	deadline := time.Now().Add(s.lockWait)
+	waited := false
+	for {
+		var ok bool
+		if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock(hashtextextended($1, 0))", operationID).Scan(&ok); err != nil {
+			conn.Release()
+			return nil, err
+		}
+		if ok {
+			if waited {
+				opLockConflicts.WithLabelValues("waited").Inc()
+			}
+			break
+		}
+		waited = true
+		if time.Now().After(deadline) {
+			conn.Release()
+			opLockConflicts.WithLabelValues("rejected").Inc()
+			return nil, errOperationInFlight
+		}
+		select {
+		case <-ctx.Done():
+			conn.Release()
+			return nil, ctx.Err()
+		case <-time.After(25 * time.Millisecond):
+		}
+	}
+	return func() {
+		// unlock on a fresh context: the request context may already be gone
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtextextended($1, 0))", operationID); err != nil {
+			// a connection that failed to unlock must not go back to the pool
+			// still holding the lock
+			logger(ctx).Error("advisory unlock", "operation_id", operationID, "error", err)
+			conn.Conn().Close(context.Background())
+		}
+		conn.Release()
+	}, nil
+}
+
+// Operation reads the journal entry for an operation. The stored response
+// goes back through TransferResponse so it renders as it did when sent.
+func (s *Store) Operation(ctx context.Context, id string) (store.Operation, error) {
+	var (
+		op     = store.Operation{OperationID: id}
+		resp   *TransferResponse
+		errMsg *string
+	)
+	err := s.pool.QueryRow(ctx, `
+		SELECT state, request_id, response, error, created_at, updated_at
+		FROM op_journal WHERE operation_id=$1`, id).
+		Scan(&op.State, &op.RequestID, &resp, &errMsg, &op.CreatedAt, &op.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		return op, store.ErrOperationNotFound
+	}
+	if err != nil {
+		return op, err
+	}
+	if resp != nil {
+		if op.Response, err = json.Marshal(resp); err != nil {
+			return op, err
+		}
+	}
+	if errMsg != nil {
+		op.Error = *errMsg
+	}
+	return op, nil
+}
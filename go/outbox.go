@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/segmentio/kafka-go"
+)
+
+// Money movements are published to Kafka through a transactional outbox:
+// transfer.completed is written to the outbox table in the transaction that
+// books the transfer, so an event exists exactly when the transfer
+// committed. transfer.failed has no transaction to join and is written
+// after the failure, best-effort like the journal.
+//
+// The relay (role relay) publishes unpublished rows in id order and marks
+// them published once the brokers acknowledged them, so delivery is at
+// least once: a relay dying between the two publishes the batch again.
+// Consumers dedupe on the event id, sent as the message's event-id header
+// and in the body. Messages are keyed by transfer, or operation id for
+// failures, so the events of one movement stay in one partition. Each event
+// is published at the versions in EVENT_VERSIONS; see eventversions.go.
+//
+// One relay publishes at a time, holding an advisory lock; others wait as
+// standbys. outbox_relay records how far it got, for lag monitoring.
+//
+// OUTBOX_ENABLED turns the writes on; it should be set on every API
+// process once a relay with KAFKA_BROKERS is deployed, since nothing else
+// drains the table.
+
+const outboxRelayLockKey = 0x6f7574626f78 // "outbox"
+
+type outboxEvent struct {
+	ID         int64           `json:"id"`
+	Type       string          `json:"type"`
+	Version    int             `json:"version"`
+	Key        string          `json:"key"`
+	OccurredAt time.Time       `json:"occurredAt"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// writeOutbox appends an event and queues its webhook deliveries; q is the
+// booking transaction when there is one.
+func (s *Store) writeOutbox(ctx context.Context, q execer, eventType, key string, data any) error {
+	if !s.outbox && !s.webhooks {
+		return nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if s.outbox {
+		if _, err := q.Exec(ctx, "INSERT INTO outbox (type, key, payload, version) VALUES ($1, $2, $3, $4)", eventType, key, raw, eventWriteVersion); err != nil {
+			return err
+		}
+	}
+	if s.webhooks {
+		return s.queueWebhooks(ctx, q, eventType, raw)
+	}
+	return nil
+}
+
+type transferEvent struct {
+	TransferID          int64         `json:"transferId"`
+	OperationID         string        `json:"operationId,omitempty"`
+	FromAccountID       string        `json:"fromAccountId"`
+	ToAccountID         string        `json:"toAccountId"`
+	Amount              Money         `json:"amount"`
+	Currency            string        `json:"currency"`
+	DestinationAmount   Money         `json:"destinationAmount"`
+	DestinationCurrency string        `json:"destinationCurrency"`
+	FX                  *fxConversion `json:"fx,omitempty"`
+	Fee                 *Money        `json:"fee,omitempty"`
+	ReversesID          int64         `json:"reversesId,omitempty"`
+	ReceiptNumber       string        `json:"receiptNumber"`
+	At                  time.Time     `json:"at"`
+}
+
+type transferFailedEvent struct {
+	OperationID   string `json:"operationId,omitempty"`
+	FromAccountID string `json:"fromAccountId"`
+	ToAccountID   string `json:"toAccountId"`
+	Amount        Money  `json:"amount"`
+	Result        string `json:"result"`
+	Message       string `json:"message"`
+}
+
+// transferFailed writes transfer.failed with the message the caller got.
+func (s *Store) transferFailed(ctx context.Context, req TransferRequest, status int, err error) {
+	status, resp := errorResponse(status, err)
+	key := req.OperationID
+	if key == "" {
+		key = req.FromAccountID
+	}
+	if err := s.writeOutbox(context.WithoutCancel(ctx), s.pool, "transfer.failed", key, transferFailedEvent{
+		OperationID: req.OperationID, FromAccountID: req.FromAccountID, ToAccountID: req.ToAccountID, Amount: req.Amount,
+		Result: classify(status, err).result, Message: resp.Message,
+	}); err != nil {
+		logger(ctx).Error("write transfer.failed to outbox", "operation_id", req.OperationID, "error", err)
+	}
+}
+
+type outboxRelay struct {
+	store     *Store
+	writer    *kafka.Writer
+	batch     int
+	retention time.Duration
+	versions  []int
+	registry  *schemaRegistry
+	// schemaIDs maps "<type>.v<version>" to its registry id once
+	// registered.
+	schemaIDs map[string]int
+}
+
+func outboxRelayFromEnv(s *Store) (*outboxRelay, error) {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		return nil, nil
+	}
+	versions, err := parseEventVersions(envOrDefault("EVENT_VERSIONS", "1"))
+	if err != nil {
+		return nil, err
+	}
+	return &outboxRelay{
+		store: s,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(brokers, ",")...),
+			Topic:        envOrDefault("KAFKA_TOPIC", "transfers"),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+		},
+		batch:     intOrDefault("OUTBOX_BATCH", 500),
+		retention: durationOrDefault("OUTBOX_RETENTION", 7*24*time.Hour),
+		versions:  versions,
+		registry:  schemaRegistryFromEnv(),
+	}, nil
+}
+
+// registerSchemas registers the schema of every emitted type and version.
+func (o *outboxRelay) registerSchemas(ctx context.Context) error {
+	ids := map[string]int{}
+	for typ := range eventVersions {
+		for _, v := range o.versions {
+			schema, err := eventSchema(typ, v)
+			if err != nil {
+				return err
+			}
+			name := fmt.Sprintf("%s.v%d", typ, v)
+			if ids[name], err = o.registry.register(ctx, o.writer.Topic+"-"+name, schema); err != nil {
+				return err
+			}
+		}
+	}
+	o.schemaIDs = ids
+	slog.Info("event schemas registered", "schemas", len(ids))
+	return nil
+}
+
+// run publishes while it holds the relay lock, polling every interval
+// when the outbox is drained.
+func (o *outboxRelay) run(ctx context.Context, every time.Duration) {
+	defer o.writer.Close()
+	for ctx.Err() == nil {
+		if err := o.lead(ctx, every); err != nil && ctx.Err() == nil {
+			slog.Error("outbox relay", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(every):
+		}
+	}
+}
+
+// lead takes the relay lock and publishes until ctx ends or the database
+// fails; a standby returns at once.
+func (o *outboxRelay) lead(ctx context.Context, every time.Duration) error {
+	conn, err := o.store.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	var ok bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", outboxRelayLockKey).Scan(&ok); err != nil || !ok {
+		return err
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", outboxRelayLockKey); err != nil {
+			// the lock goes with the connection
+			conn.Conn().Close(context.Background())
+		}
+	}()
+	if o.registry != nil && o.schemaIDs == nil {
+		if err := o.registerSchemas(ctx); err != nil {
+			return err
+		}
+	}
+	slog.Info("outbox relay leading", "topic", o.writer.Topic, "versions", o.versions)
+	var pruned time.Time
+	for {
+		n, err := o.publishBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if n == o.batch {
+			continue
+		}
+		if time.Since(pruned) > time.Hour {
+			o.store.pruneOutbox(ctx, o.retention)
+			pruned = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(every):
+		}
+	}
+}
+
+func (o *outboxRelay) publishBatch(ctx context.Context) (int, error) {
+	pool := o.store.pool
+	rows, err := pool.Query(ctx, `
+		SELECT id, type, version, key, created_at, payload FROM outbox WHERE published_at IS NULL ORDER BY id LIMIT $1`, o.batch)
+	if err != nil {
+		return 0, err
+	}
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (outboxEvent, error) {
+		var e outboxEvent
+		err := row.Scan(&e.ID, &e.Type, &e.Version, &e.Key, &e.OccurredAt, &e.Data)
+		return e, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		outboxLag.Set(0)
+		return 0, nil
+	}
+	outboxLag.Set(time.Since(events[0].OccurredAt).Seconds())
+	// an event is published once per version, msgs[i*n:(i+1)*n] for events[i]
+	n := len(o.versions)
+	msgs := make([]kafka.Message, 0, len(events)*n)
+	for _, e := range events {
+		id := strconv.FormatInt(e.ID, 10)
+		for _, v := range o.versions {
+			body, err := kafkaEventValue(e, v)
+			if err != nil {
+				return 0, fmt.Errorf("outbox event %d: %w", e.ID, err)
+			}
+			if o.schemaIDs != nil {
+				body = frameSchema(o.schemaIDs[fmt.Sprintf("%s.v%d", e.Type, v)], body)
+			}
+			msgs = append(msgs, kafka.Message{Key: []byte(e.Key), Value: body, Headers: []kafka.Header{
+				{Key: "event-id", Value: []byte(id)}, {Key: "event-type", Value: []byte(e.Type)},
+				{Key: "event-version", Value: []byte(strconv.Itoa(v))},
+			}})
+		}
+	}
+	published := make([]int64, 0, len(events))
+	werr := o.writer.WriteMessages(ctx, msgs...)
+	var perMsg kafka.WriteErrors
+	switch {
+	case werr == nil:
+		for _, e := range events {
+			published = append(published, e.ID)
+		}
+	case errors.As(werr, &perMsg):
+		for i, e := range events {
+			// a version that failed is sent again with the others
+			if !slices.ContainsFunc(perMsg[i*n:(i+1)*n], func(err error) bool { return err != nil }) {
+				published = append(published, e.ID)
+			}
+		}
+	}
+	outboxPublished.WithLabelValues("published").Add(float64(len(published)))
+	outboxPublished.WithLabelValues("failed").Add(float64(len(events) - len(published)))
+	if len(published) > 0 {
+		if _, err := pool.Exec(context.WithoutCancel(ctx), `
+			WITH marked AS (UPDATE outbox SET published_at = now() WHERE id = ANY($1) RETURNING id)
+			INSERT INTO outbox_relay (name, last_published_id, last_published_at) SELECT 'kafka', max(id), now() FROM marked
+			ON CONFLICT (name) DO UPDATE SET last_published_id = GREATEST(outbox_relay.last_published_id, EXCLUDED.last_published_id),
+				last_published_at = EXCLUDED.last_published_at`, published); err != nil {
+			return 0, err
+		}
+	}
+	if werr != nil {
+		return 0, werr
+	}
+	return len(events), nil
+}
+
+// kafkaEventValue is the JSON of e, as stored, rendered at version.
+func kafkaEventValue(e outboxEvent, version int) ([]byte, error) {
+	data, err := renderEvent(e.Type, e.Version, e.Data, version)
+	if err != nil {
+		return nil, err
+	}
+	e.Version, e.Data = version, data
+	return json.Marshal(e)
+}
+
+// pruneOutbox deletes published events past the retention, a batch per
+// call.
+func (s *Store) pruneOutbox(ctx context.Context, retention time.Duration) {
+	tag, err := s.pool.Exec(ctx, `
+		DELETE FROM outbox WHERE id IN (
+			SELECT id FROM outbox WHERE published_at < now() - $1 * interval '1 second' ORDER BY id LIMIT 10000)`, retention.Seconds())
+	if err != nil {
+		slog.Error("prune outbox", "error", err)
+		return
+	}
+	if tag.RowsAffected() > 0 {
+		slog.Info("outbox pruned", "events", tag.RowsAffected())
+	}
+}
+
+// handleOutboxState reports the relay's progress and the backlog.
+func (s *Store) handleOutboxState(w http.ResponseWriter, r *http.Request) {
+	var (
+		pending         int64
+		oldest          *time.Time
+		lastID          *int64
+		lastPublishedAt *time.Time
+	)
+	err := s.pool.QueryRow(r.Context(), `
+		SELECT (SELECT count(*) FROM outbox WHERE published_at IS NULL),
+			(SELECT min(created_at) FROM outbox WHERE published_at IS NULL),
+			r.last_published_id, r.last_published_at
+		FROM (SELECT 1) one LEFT JOIN outbox_relay r ON r.name = 'kafka'`).Scan(&pending, &oldest, &lastID, &lastPublishedAt)
+	if err != nil {
+		http.Error(w, "failed to load outbox state", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"enabled":         s.outbox,
+		"pending":         pending,
+		"oldestPendingAt": oldest,
+		"lastPublishedId": lastID,
+		"lastPublishedAt": lastPublishedAt,
+	})
+}
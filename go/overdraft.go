@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// An overdraft limit is a credit line: transfers may take the account's
+// balance down to -overdraft_limit, fee included. Limits are set by
+// operators only, and every change is kept in overdraft_limit_changes with
+// who made it and why. Lowering a limit below what the account already
+// owes is allowed; it only blocks further debits until the balance is back
+// within the new line.
+
+type overdraftChange struct {
+	OldLimit  Money     `json:"oldLimit"`
+	NewLimit  Money     `json:"newLimit"`
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason"`
+	BalanceAt Money     `json:"balanceAtChange"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+type putOverdraftRequest struct {
+	Limit  *Money `json:"limit"`
+	Actor  string `json:"actor"`
+	Reason string `json:"reason"`
+}
+
+func (req putOverdraftRequest) validate() string {
+	switch {
+	case req.Actor == "":
+		return "actor is required"
+	case req.Reason == "":
+		return "reason is required"
+	case req.Limit == nil || *req.Limit < 0:
+		return "limit must be >= 0"
+	}
+	return ""
+}
+
+// handlePutOverdraft sets an account's overdraft limit. The account row is
+// locked so the change and its audit row see the same balance, and a
+// transfer running concurrently is checked against either the old limit or
+// the new one, never a mix.
+func (s *Store) handlePutOverdraft(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req putOverdraftRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if msg := req.validate(); msg != "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: msg})
+		return
+	}
+	if isSystemAccount(id) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "account is reserved"})
+		return
+	}
+	ctx := r.Context()
+	var change overdraftChange
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		var status string
+		if err := tx.QueryRow(ctx, "SELECT overdraft_limit, balance, status FROM accounts WHERE id=$1 FOR UPDATE", id).
+			Scan(&change.OldLimit, &change.BalanceAt, &status); err != nil {
+			return err
+		}
+		if status == accountClosed {
+			return errAccountClosed
+		}
+		if _, err := tx.Exec(ctx, "UPDATE accounts SET overdraft_limit=$2 WHERE id=$1", id, *req.Limit); err != nil {
+			return err
+		}
+		return tx.QueryRow(ctx, `
+			INSERT INTO overdraft_limit_changes (account_id, old_limit, new_limit, balance_at_change, actor, reason)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING new_limit, actor, reason, changed_at`,
+			id, change.OldLimit, *req.Limit, change.BalanceAt, req.Actor, req.Reason).
+			Scan(&change.NewLimit, &change.Actor, &change.Reason, &change.ChangedAt)
+	})
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "account not found"})
+		return
+	case errors.Is(err, errAccountClosed):
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: "account is closed"})
+		return
+	case err != nil:
+		http.Error(w, "failed to set overdraft limit", http.StatusInternalServerError)
+		return
+	}
+	s.cache.accounts.invalidate(id)
+	logger(ctx).Info("overdraft limit set", "account_id", id, "actor", req.Actor, "reason", req.Reason,
+		"old_limit", change.OldLimit, "new_limit", change.NewLimit, "balance", change.BalanceAt)
+	if err := s.recordEvent(ctx, "account.overdraft_limit_changed", "account/"+id, map[string]any{
+		"oldLimit": change.OldLimit, "newLimit": change.NewLimit, "actor": change.Actor, "reason": change.Reason,
+	}); err != nil {
+		logger(ctx).Warn("record overdraft event", "account_id", id, "error", err)
+	}
+	writeJSON(w, http.StatusOK, change)
+}
+
+// handleGetOverdraft returns the current limit and the change history,
+// newest first.
+func (s *Store) handleGetOverdraft(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	var limit, balance Money
+	err := s.pool.QueryRow(ctx, "SELECT overdraft_limit, balance FROM accounts WHERE id=$1", id).Scan(&limit, &balance)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "account not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	rows, err := s.pool.Query(ctx, `
+		SELECT old_limit, new_limit, actor, reason, balance_at_change, changed_at FROM overdraft_limit_changes
+		WHERE account_id=$1 ORDER BY id DESC LIMIT 100`, id)
+	if err != nil {
+		http.Error(w, "failed to load history", http.StatusInternalServerError)
+		return
+	}
+	history, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (overdraftChange, error) {
+		var c overdraftChange
+		err := row.Scan(&c.OldLimit, &c.NewLimit, &c.Actor, &c.Reason, &c.BalanceAt, &c.ChangedAt)
+		return c, err
+	})
+	if err != nil {
+		http.Error(w, "failed to load history", http.StatusInternalServerError)
+		return
+	}
+	available := balance + limit
+	if available < 0 {
+		available = 0
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"accountId": id, "limit": limit, "balance": balance, "available": available, "history": history})
+}
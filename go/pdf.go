@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// pdfDoc lays lines of text out on A4 pages and writes them as a PDF.
+// Statements are the only documents the service renders and they are
+// tables of text, so a fixed-pitch font keeps the columns aligned without
+// font metrics, and a few hundred bytes of PDF syntax replace a library.
+// Text is encoded in WinAnsi, which covers Latin-1 and the euro sign;
+// pdfEncodable tells whether a string survives that.
+type pdfDoc struct {
+	// header is repeated at the top of every page after the first.
+	header []pdfLine
+	pages  [][]pdfLine
+}
+
+type pdfLine struct {
+	text string
+	bold bool
+}
+
+const (
+	pdfPageWidth, pdfPageHeight = 595, 842
+	pdfMargin                   = 40
+	pdfFontSize, pdfLeading     = 9, 12
+	// pdfColumns is how many Courier characters fit between the margins.
+	pdfColumns = (pdfPageWidth - 2*pdfMargin) * 10 / (pdfFontSize * 6)
+	// the last line of every page is left for the page number
+	pdfLinesPerPage = (pdfPageHeight-2*pdfMargin)/pdfLeading - 2
+)
+
+func (d *pdfDoc) line(text string, bold bool) {
+	if len(d.pages) == 0 {
+		d.pages = append(d.pages, nil)
+	}
+	if len(d.pages[len(d.pages)-1]) == pdfLinesPerPage {
+		d.pages = append(d.pages, append([]pdfLine(nil), d.header...))
+	}
+	d.pages[len(d.pages)-1] = append(d.pages[len(d.pages)-1], pdfLine{text: text, bold: bold})
+}
+
+// winAnsi maps the runes outside Latin-1 that WinAnsi has; narrow and
+// thin spaces, as some locales group digits with, become spaces.
+var winAnsi = map[rune]byte{'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94,
+	'–': 0x96, '—': 0x97, '\u202f': ' ', '\u2009': ' '}
+
+func winAnsiByte(r rune) (byte, bool) {
+	if b, ok := winAnsi[r]; ok {
+		return b, true
+	}
+	if r < 0x20 || r > 0xff || (r >= 0x7f && r < 0xa0) {
+		return 0, false
+	}
+	return byte(r), true
+}
+
+func pdfEncodable(s string) bool {
+	for _, r := range s {
+		if _, ok := winAnsiByte(r); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// pdfString is s as a PDF literal string; runes WinAnsi lacks become '?'.
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range s {
+		c, ok := winAnsiByte(r)
+		if !ok {
+			c = '?'
+		}
+		if c == '(' || c == ')' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+func (d *pdfDoc) WriteTo(w io.Writer) (int64, error) {
+	pages := d.pages
+	if len(pages) == 0 {
+		pages = [][]pdfLine{nil}
+	}
+	var (
+		buf     bytes.Buffer
+		offsets []int
+	)
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	// 1 catalog, 2 page tree, 3 and 4 fonts, then a page and its content
+	// stream per page
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>")
+	for i, lines := range pages {
+		var content strings.Builder
+		fmt.Fprintf(&content, "BT\n%d TL\n%d %d Td\n", pdfLeading, pdfMargin, pdfPageHeight-pdfMargin-pdfFontSize)
+		font := ""
+		for _, l := range lines {
+			f := "/F1"
+			if l.bold {
+				f = "/F2"
+			}
+			if f != font {
+				fmt.Fprintf(&content, "%s %d Tf\n", f, pdfFontSize)
+				font = f
+			}
+			fmt.Fprintf(&content, "%s Tj T*\n", pdfString(l.text))
+		}
+		fmt.Fprintf(&content, "ET\nBT\n/F1 %d Tf\n%d %d Td\n%s Tj\nET", pdfFontSize, pdfMargin, pdfMargin,
+			pdfString(fmt.Sprintf("%d/%d", i+1, len(pages))))
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.WriteTo(w)
+}
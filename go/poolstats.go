@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolCollector reads pool.Stat() at scrape time instead of sampling it on a
+// timer, so the values are never staler than the scrape itself.
+type poolCollector struct {
+	pool *pgxpool.Pool
+
+	acquired, idle, constructing, total, max *prometheus.Desc
+	acquires, emptyAcquires, canceled        *prometheus.Desc
+	acquireSeconds, newConns                 *prometheus.Desc
+	lifetimeDestroys, idleDestroys           *prometheus.Desc
+}
+
+func newPoolCollector(pool *pgxpool.Pool) *poolCollector {
+	d := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("pgxpool_"+name, help, nil, nil)
+	}
+	return &poolCollector{
+		pool:             pool,
+		acquired:         d("acquired_conns", "Conexões do pool em uso no momento."),
+		idle:             d("idle_conns", "Conexões ociosas no pool."),
+		constructing:     d("constructing_conns", "Conexões sendo abertas no momento."),
+		total:            d("total_conns", "Total de conexões abertas no pool."),
+		max:              d("max_conns", "Tamanho máximo configurado do pool."),
+		acquires:         d("acquires_total", "Aquisições de conexão bem-sucedidas."),
+		emptyAcquires:    d("empty_acquires_total", "Aquisições que precisaram esperar por falta de conexão ociosa."),
+		canceled:         d("canceled_acquires_total", "Aquisições canceladas pelo contexto antes de obter conexão."),
+		acquireSeconds:   d("acquire_duration_seconds_total", "Tempo acumulado esperando por conexões do pool."),
+		newConns:         d("new_conns_total", "Conexões novas abertas pelo pool."),
+		lifetimeDestroys: d("max_lifetime_destroys_total", "Conexões fechadas por atingir o tempo máximo de vida."),
+		idleDestroys:     d("max_idle_destroys_total", "Conexões fechadas por ociosidade."),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.acquired, c.idle, c.constructing, c.total, c.max,
+		c.acquires, c.emptyAcquires, c.canceled, c.acquireSeconds, c.newConns, c.lifetimeDestroys, c.idleDestroys} {
+		ch <- d
+	}
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	st := c.pool.Stat()
+	gauge := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v)
+	}
+	counter := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v)
+	}
+	gauge(c.acquired, float64(st.AcquiredConns()))
+	gauge(c.idle, float64(st.IdleConns()))
+	gauge(c.constructing, float64(st.ConstructingConns()))
+	gauge(c.total, float64(st.TotalConns()))
+	gauge(c.max, float64(st.MaxConns()))
+	counter(c.acquires, float64(st.AcquireCount()))
+	counter(c.emptyAcquires, float64(st.EmptyAcquireCount()))
+	counter(c.canceled, float64(st.CanceledAcquireCount()))
+	counter(c.acquireSeconds, st.AcquireDuration().Seconds())
+	counter(c.newConns, float64(st.NewConnsCount()))
+	counter(c.lifetimeDestroys, float64(st.MaxLifetimeDestroyCount()))
+	counter(c.idleDestroys, float64(st.MaxIdleDestroyCount()))
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/ledger"
+)
+
+// POST /accounts/{id}/simulate projects an account's balance day by day
+// over a horizon, for the app's "projected balance". It replays what is
+// already booked to happen: pending scheduled transfers and the coming
+// occurrences of active standing orders, each with the tenant fee when it
+// would be charged, and accrues interest on the end-of-day balance at the
+// rates the client asks about. Nothing is written.
+//
+// An outgoing movement the account could not afford when it comes due, or
+// that breaks its transfer or daily limit, is listed with the result it
+// would fail with and left out of the balance, as the real transfer would
+// be. Days and the daily limit follow the tenant's time zone and clock.
+
+const (
+	projectionDefaultDays = 30
+	projectionMaxDays     = 366
+	// projectionMaxEvents bounds the response for accounts with many
+	// frequent standing orders.
+	projectionMaxEvents = 5000
+)
+
+type projectionRequest struct {
+	// Days is the horizon, whole days from the start of today; default 30,
+	// at most 366.
+	Days int `json:"days"`
+	// InterestRate is a nominal annual rate accrued daily on a positive
+	// balance, 0.12 for 12%; OverdraftRate is charged likewise on a
+	// negative one. Accrual is posted at each month end and at the horizon.
+	InterestRate  *fxRate `json:"interestRate,omitempty"`
+	OverdraftRate *fxRate `json:"overdraftRate,omitempty"`
+}
+
+// Projected event types.
+const (
+	projectedScheduled         = "scheduled_transfer"
+	projectedStandingOrder     = "standing_order"
+	projectedFee               = "fee"
+	projectedInterest          = "interest"
+	projectedOverdraftInterest = "overdraft_interest"
+)
+
+type projectedEvent struct {
+	At   time.Time `json:"at"`
+	Type string    `json:"type"`
+	// ScheduledTransferID or StandingOrderID is the source of a movement.
+	ScheduledTransferID   *int64  `json:"scheduledTransferId,omitempty"`
+	StandingOrderID       *int64  `json:"standingOrderId,omitempty"`
+	CounterpartyAccountID *string `json:"counterpartyAccountId,omitempty"`
+	// Amount is signed: debits are negative.
+	Amount  Money `json:"amount"`
+	Balance Money `json:"balance"`
+	// Fails is the result the transfer would fail with, such as
+	// insufficient_funds; a failing event does not move the balance.
+	Fails string `json:"fails,omitempty"`
+}
+
+type projectedDay struct {
+	Date    string `json:"date"`
+	Balance Money  `json:"balance"`
+}
+
+type projection struct {
+	AccountID        string           `json:"accountId"`
+	Currency         string           `json:"currency"`
+	From             time.Time        `json:"from"`
+	Until            time.Time        `json:"until"`
+	OpeningBalance   Money            `json:"openingBalance"`
+	ProjectedBalance Money            `json:"projectedBalance"`
+	LowestBalance    Money            `json:"lowestBalance"`
+	LowestAt         time.Time        `json:"lowestAt"`
+	Interest         Money            `json:"interest"`
+	Fees             Money            `json:"fees"`
+	Display          ledger.Display   `json:"display"`
+	Events           []projectedEvent `json:"events"`
+	Days             []projectedDay   `json:"days"`
+	Truncated        bool             `json:"truncated"`
+	Caveats          []string         `json:"caveats"`
+}
+
+// projectedMove is a movement the projection replays.
+type projectedMove struct {
+	at          time.Time
+	typ         string
+	scheduledID *int64
+	orderID     *int64
+	from, to    string
+	amount      Money
+}
+
+func (s *Store) handleSimulateAccount(w http.ResponseWriter, r *http.Request) {
+	var req projectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Days == 0 {
+		req.Days = projectionDefaultDays
+	}
+	if req.Days < 0 || req.Days > projectionMaxDays {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: fmt.Sprintf("days must be 1-%d", projectionMaxDays)})
+		return
+	}
+	p, status, err := s.projectAccount(r.Context(), r.PathValue("id"), req)
+	if status == http.StatusInternalServerError {
+		logger(r.Context()).Error("project balance", "account_id", r.PathValue("id"), "error", err)
+		http.Error(w, "failed to project balance", status)
+		return
+	}
+	if err != nil {
+		writeJSON(w, status, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Store) projectAccount(ctx context.Context, id string, req projectionRequest) (*projection, int, error) {
+	ctx = withQueryPattern(ctx, patternStatements)
+	var acc lockedAccount
+	err := s.pool.QueryRow(ctx, "SELECT balance, status, transfer_limit, daily_limit, tenant_id, currency, overdraft_limit, held FROM accounts WHERE id=$1", id).
+		Scan(&acc.balance, &acc.status, &acc.transferLimit, &acc.dailyLimit, &acc.tenantID, &acc.currency, &acc.overdraftLimit, &acc.held)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, http.StatusNotFound, errAccountNotFound
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if p := principalFromContext(ctx); p != nil && p.Tenant != "" && p.Tenant != acc.tenantID {
+		return nil, http.StatusForbidden, errOtherTenant
+	}
+	if acc.status == accountClosed {
+		return nil, http.StatusBadRequest, errAccountClosed
+	}
+	cfg := s.tenants.effective(acc.tenantID)
+	now := s.clocks.now(acc.tenantID).UTC()
+	today := dayStart(now, cfg)
+	until := today.AddDate(0, 0, req.Days)
+	p := &projection{AccountID: id, Currency: acc.currency, From: now, Until: until, OpeningBalance: acc.balance,
+		Events: make([]projectedEvent, 0), Days: make([]projectedDay, 0, req.Days), Caveats: make([]string, 0)}
+
+	moves, caveats, err := s.projectedMoves(ctx, id, now, until)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	p.Caveats = append(p.Caveats, caveats...)
+	others, err := s.counterparties(ctx, id, moves)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	spentToday, err := debitedSince(ctx, s.pool, id, today)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	dailyLimit := acc.dailyLimit
+	if dailyLimit == nil {
+		dailyLimit = cfg.DailyLimit
+	}
+	transferLimit := acc.transferLimit
+	if transferLimit == nil {
+		transferLimit = cfg.TransferLimit
+	}
+	unit, _ := currency(acc.currency)
+
+	balance := acc.balance
+	p.LowestBalance, p.LowestAt = balance, now
+	accrued := new(big.Rat)
+	add := func(e projectedEvent) {
+		if len(p.Events) == projectionMaxEvents {
+			p.Truncated = true
+			return
+		}
+		if e.Fails == "" {
+			balance += e.Amount
+		}
+		e.Balance = balance
+		p.Events = append(p.Events, e)
+		if balance < p.LowestBalance {
+			p.LowestBalance, p.LowestAt = balance, e.At
+		}
+	}
+	next := 0
+	for day := today; day.Before(until); {
+		end := day.AddDate(0, 0, 1)
+		spent := Money(0)
+		if day.Equal(today) {
+			spent = spentToday
+		}
+		for ; next < len(moves) && moves[next].at.Before(end); next++ {
+			m := moves[next]
+			e := projectedEvent{At: m.at, Type: m.typ, ScheduledTransferID: m.scheduledID, StandingOrderID: m.orderID}
+			if m.from != id {
+				// incoming: credited in this account's currency
+				from := others[m.from]
+				e.CounterpartyAccountID = publicAccountID(&m.from)
+				e.Amount = m.amount
+				if from != nil && !isSystemAccount(m.from) && from.currency != acc.currency {
+					fx, _, err := s.convertTransfer(ctx, TransferRequest{Amount: m.amount}, from.currency, acc.currency)
+					if err != nil {
+						p.Caveats = append(p.Caveats, fmt.Sprintf("a credit from %s is left out: %v", m.from, err))
+						continue
+					}
+					e.Amount = fx.DestinationAmount
+				}
+				add(e)
+				continue
+			}
+			to := others[m.to]
+			e.CounterpartyAccountID = publicAccountID(&m.to)
+			e.Amount = -m.amount
+			var fee Money
+			if to != nil && !isSystemAccount(m.to) && cfg.TransferFee > 0 {
+				if fee, _, err = s.feeIn(ctx, cfg.TransferFee, acc.currency); err != nil {
+					p.Caveats = append(p.Caveats, fmt.Sprintf("the fee in %s is left out: %v", acc.currency, err))
+					fee = 0
+				}
+			}
+			switch {
+			case to == nil:
+				e.Fails = "account_not_found"
+			case to.status == accountClosed:
+				e.Fails = "account_closed"
+			case acc.status == accountFrozen:
+				e.Fails = "account_frozen"
+			case transferLimit != nil && m.amount > *transferLimit:
+				e.Fails = "limit_exceeded"
+			case dailyLimit != nil && spent+m.amount+fee > *dailyLimit:
+				e.Fails = "limit_exceeded"
+			case balance-acc.held-m.amount-fee < -acc.overdraftLimit:
+				e.Fails = "insufficient_funds"
+			}
+			add(e)
+			if e.Fails == "" {
+				spent += m.amount + fee
+				if fee > 0 {
+					p.Fees += fee
+					add(projectedEvent{At: m.at, Type: projectedFee, ScheduledTransferID: m.scheduledID, StandingOrderID: m.orderID, Amount: -fee})
+				}
+			}
+		}
+
+		// accrue on the end-of-day balance and post at month end
+		rate := req.InterestRate
+		if balance < 0 {
+			rate = req.OverdraftRate
+		}
+		if rate != nil {
+			daily := new(big.Rat).Mul(rate.Rat, big.NewRat(int64(balance), 365))
+			accrued.Add(accrued, daily)
+		}
+		if (end.Day() == 1 || !end.Before(until)) && accrued.Sign() != 0 {
+			posted, err := unit.Round(accrued.Num(), accrued.Denom())
+			if err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+			if posted != 0 {
+				typ := projectedInterest
+				if posted < 0 {
+					typ = projectedOverdraftInterest
+				}
+				p.Interest += posted
+				add(projectedEvent{At: end, Type: typ, Amount: posted})
+			}
+			accrued.SetInt64(0)
+		}
+		p.Days = append(p.Days, projectedDay{Date: day.Format(time.DateOnly), Balance: balance})
+		day = end
+	}
+	p.ProjectedBalance = balance
+	p.Display = ledger.Display{Amount: cfg.formatter().Money(balance, acc.currency), At: cfg.formatter().Date(until.Add(-time.Second))}
+	if req.InterestRate != nil || req.OverdraftRate != nil {
+		p.Caveats = append(p.Caveats, "interest accrues daily at the annual rate / 365 on the end-of-day balance and is posted at month end")
+	}
+	if cfg.TransferFee > 0 || dailyLimit != nil {
+		p.Caveats = append(p.Caveats, "fees and limits are today's; a tenant change applies from when it is made")
+	}
+	return p, http.StatusOK, nil
+}
+
+// projectedMoves lists the pending scheduled transfers and coming standing
+// order occurrences touching the account before until, in time order. Due
+// ones not yet run, and retries already late, are placed at now.
+func (s *Store) projectedMoves(ctx context.Context, id string, now, until time.Time) ([]projectedMove, []string, error) {
+	var (
+		moves   []projectedMove
+		caveats []string
+	)
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, from_account_id, to_account_id, amount, next_attempt_at, standing_order_id
+		FROM scheduled_transfers
+		WHERE (from_account_id=$1 OR to_account_id=$1) AND status = ANY($2) AND next_attempt_at < $3`,
+		id, []string{scheduledPending, scheduledRunning}, until)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		m := projectedMove{typ: projectedScheduled}
+		var stID int64
+		if err := rows.Scan(&stID, &m.from, &m.to, &m.amount, &m.at, &m.orderID); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		m.scheduledID = &stID
+		if m.orderID != nil {
+			m.typ = projectedStandingOrder
+		}
+		moves = append(moves, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = s.pool.Query(ctx, "SELECT "+standingColumns+" FROM standing_orders WHERE (from_account_id=$1 OR to_account_id=$1) AND status = ANY($2)",
+		id, []string{standingActive, standingPaused})
+	if err != nil {
+		return nil, nil, err
+	}
+	orders, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (standingOrder, error) { return scanStandingOrder(row) })
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, o := range orders {
+		if o.Status == standingPaused {
+			caveats = append(caveats, fmt.Sprintf("standing order %d is paused and left out", o.ID))
+			continue
+		}
+		orderID := o.ID
+		for n := o.Occurrence; ; n++ {
+			at := standingOccurrence(o.StartAt, o.Frequency, n)
+			if o.finished(at) || !at.Before(until) {
+				break
+			}
+			o.Executions++
+			moves = append(moves, projectedMove{at: at, typ: projectedStandingOrder, orderID: &orderID, from: o.FromAccountID, to: o.ToAccountID, amount: o.Amount})
+		}
+	}
+	for i := range moves {
+		if moves[i].at.Before(now) {
+			moves[i].at = now
+		}
+	}
+	sort.SliceStable(moves, func(i, j int) bool { return moves[i].at.Before(moves[j].at) })
+	return moves, caveats, nil
+}
+
+// counterparties loads the other side of each move, keyed by id; a missing
+// account is absent.
+func (s *Store) counterparties(ctx context.Context, id string, moves []projectedMove) (map[string]*lockedAccount, error) {
+	ids := make([]string, 0, len(moves))
+	for _, m := range moves {
+		other := m.to
+		if other == id {
+			other = m.from
+		}
+		ids = append(ids, other)
+	}
+	out := map[string]*lockedAccount{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	rows, err := s.pool.Query(ctx, "SELECT id, status, tenant_id, currency FROM accounts WHERE id = ANY($1)", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			other string
+			a     lockedAccount
+		)
+		if err := rows.Scan(&other, &a.status, &a.tenantID, &a.currency); err != nil {
+			return nil, err
+		}
+		out[other] = &a
+	}
+	return out, rows.Err()
+}
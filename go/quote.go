@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/ledger"
+)
+
+// A quote prices a prospective transfer (fee and FX conversion) without
+// moving money and holds that price until it expires. Passing its quoteId
+// to POST /transfer executes the transfer at the quoted fee and rate, even
+// if the tenant fee or the provider's rate changed in between. A quote
+// is used at most once: it is claimed inside the transfer transaction.
+//
+// Quoting checks the same things a transfer does, against balances read
+// without locks; the transfer checks them again when it runs.
+
+type transferQuote struct {
+	ID            string        `json:"quoteId"`
+	FromAccountID string        `json:"fromAccountId"`
+	ToAccountID   string        `json:"toAccountId"`
+	Amount        Money         `json:"amount"`
+	Currency      string        `json:"currency"`
+	Fee           Money         `json:"fee"`
+	TotalDebit    Money         `json:"totalDebit"`
+	FX            *fxConversion `json:"fx,omitempty"`
+	ExpiresAt     time.Time     `json:"expiresAt"`
+
+	// FxRate is the quoted rate, applied when the quote is used.
+	FxRate *fxRate `json:"-"`
+}
+
+func newQuoteID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "qt_" + hex.EncodeToString(b)
+}
+
+func (s *Store) handleTransferQuote(w http.ResponseWriter, r *http.Request) {
+	var req TransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if errors.Is(err, ledger.ErrTooPrecise) {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+			return
+		}
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if msg := validateTransfer(req); msg != "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: msg})
+		return
+	}
+	if req.QuoteID != "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "quoteId is not accepted when quoting"})
+		return
+	}
+	ctx := r.Context()
+	accounts := map[string]*lockedAccount{}
+	rows, err := s.pool.Query(ctx, "SELECT id, balance, status, transfer_limit, tenant_id, currency, overdraft_limit, held FROM accounts WHERE id = ANY($1)",
+		[]string{req.FromAccountID, req.ToAccountID})
+	if err != nil {
+		http.Error(w, "failed to load accounts", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var (
+			id string
+			a  lockedAccount
+		)
+		if err := rows.Scan(&id, &a.balance, &a.status, &a.transferLimit, &a.tenantID, &a.currency, &a.overdraftLimit, &a.held); err != nil {
+			rows.Close()
+			http.Error(w, "failed to load accounts", http.StatusInternalServerError)
+			return
+		}
+		accounts[id] = &a
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, "failed to load accounts", http.StatusInternalServerError)
+		return
+	}
+	from, to := accounts[req.FromAccountID], accounts[req.ToAccountID]
+	switch {
+	case from == nil:
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "from account not found"})
+		return
+	case to == nil:
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "to account not found"})
+		return
+	}
+	price, _, status, err := s.priceTransfer(ctx, req, from, to, nil)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	q := transferQuote{
+		ID:            newQuoteID(),
+		FromAccountID: req.FromAccountID,
+		ToAccountID:   req.ToAccountID,
+		Amount:        req.Amount,
+		Currency:      price.fromCurrency,
+		Fee:           price.fee,
+		TotalDebit:    req.Amount + price.fee,
+		FX:            price.fx,
+		ExpiresAt:     s.clocks.now(from.tenantID).Add(durationOrDefault("TRANSFER_QUOTE_TTL", time.Minute)).UTC().Truncate(time.Second),
+	}
+	var rate string
+	if q.FX != nil {
+		rate = q.FX.Rate
+	}
+	if _, err := s.pool.Exec(ctx, `
+		INSERT INTO transfer_quotes (id, from_account_id, to_account_id, amount, currency, fee, destination_amount, destination_currency, fx_rate, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, '')::numeric, $10)`,
+		q.ID, q.FromAccountID, q.ToAccountID, q.Amount, q.Currency, q.Fee, price.credit, price.toCurrency, rate, q.ExpiresAt); err != nil {
+		http.Error(w, "failed to store quote", http.StatusInternalServerError)
+		return
+	}
+	logger(ctx).Info("transfer quoted", "quote_id", q.ID, "from", q.FromAccountID, "to", q.ToAccountID, "amount", q.Amount, "fee", q.Fee)
+	writeJSON(w, http.StatusCreated, q)
+}
+
+// claimQuote locks the quote a transfer executes against, checks the
+// transfer is the one quoted and marks the quote used. It runs in the
+// transfer transaction, so a failed transfer leaves the quote unused.
+func claimQuote(ctx context.Context, tx pgx.Tx, req TransferRequest, now time.Time) (*transferQuote, int, error) {
+	if req.FxRate != nil {
+		return nil, http.StatusBadRequest, errors.New("fxRate cannot be combined with quoteId")
+	}
+	q := &transferQuote{ID: req.QuoteID}
+	var (
+		rate *string
+		used bool
+	)
+	err := tx.QueryRow(ctx, `
+		SELECT from_account_id, to_account_id, amount, currency, fee, fx_rate::text, expires_at, used_at IS NOT NULL
+		FROM transfer_quotes WHERE id=$1 FOR UPDATE`, req.QuoteID).
+		Scan(&q.FromAccountID, &q.ToAccountID, &q.Amount, &q.Currency, &q.Fee, &rate, &q.ExpiresAt, &used)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, http.StatusBadRequest, errors.New("unknown quoteId")
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("load quote: %w", err)
+	}
+	switch {
+	case used:
+		return nil, http.StatusConflict, errors.New("quote was already used")
+	case now.After(q.ExpiresAt):
+		return nil, http.StatusUnprocessableEntity, errors.New("quote expired")
+	case q.FromAccountID != req.FromAccountID || q.ToAccountID != req.ToAccountID || q.Amount != req.Amount:
+		return nil, http.StatusBadRequest, errors.New("transfer does not match the quote")
+	}
+	if rate != nil {
+		r, err := parseRate(*rate)
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("quote rate: %w", err)
+		}
+		q.FxRate = &fxRate{r}
+	}
+	if _, err := tx.Exec(ctx, "UPDATE transfer_quotes SET used_at=now(), used_operation_id=NULLIF($2, '') WHERE id=$1",
+		req.QuoteID, req.OperationID); err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("claim quote: %w", err)
+	}
+	return q, http.StatusOK, nil
+}
+
+// purgeExpiredQuotes drops unused quotes a day past expiry; used ones stay
+// with the transfer that honoured them.
+func (s *Store) purgeExpiredQuotes(ctx context.Context) {
+	tag, err := s.pool.Exec(ctx, "DELETE FROM transfer_quotes WHERE used_at IS NULL AND expires_at < now() - interval '1 day'")
+	if err != nil {
+		slog.Error("purge expired quotes", "error", err)
+		return
+	}
+	if n := tag.RowsAffected(); n > 0 {
+		slog.Debug("expired quotes purged", "count", n)
+	}
+}
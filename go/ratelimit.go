@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transfers are rate limited with token buckets: one shared by the whole
+// instance, so a burst cannot exhaust the pool, and one per source account,
+// so a single runaway client cannot starve the others of that shared budget.
+// The per-account bucket is checked first; a request it rejects does not
+// spend a global token. A batch is charged per item, on each item's own
+// source account (see allowBatch).
+//
+// Limits are per instance, not cluster-wide: with N API pods the effective
+// global cap is N times RATE_LIMIT_GLOBAL_RPS.
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills b for the time elapsed since the last call and spends a
+// token. When empty it reports how long until one is available.
+func (b *tokenBucket) take(now time.Time, rps, burst float64) (bool, time.Duration) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rps)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rps * float64(time.Second))
+}
+
+type rateLimiter struct {
+	accountRPS, accountBurst float64
+	globalRPS, globalBurst   float64
+
+	mu       sync.Mutex
+	global   tokenBucket
+	accounts map[string]*tokenBucket
+	pruned   time.Time
+}
+
+func newRateLimiter(cfg limitsConfig) *rateLimiter {
+	l := &rateLimiter{
+		accountRPS:   cfg.AccountRPS,
+		accountBurst: cfg.AccountBurst,
+		globalRPS:    cfg.GlobalRPS,
+		globalBurst:  cfg.GlobalBurst,
+		accounts:     map[string]*tokenBucket{},
+	}
+	l.global = tokenBucket{tokens: l.globalBurst, last: time.Now()}
+	if l.accountRPS > 0 || l.globalRPS > 0 {
+		slog.Info("transfer rate limiting enabled", "account_rps", l.accountRPS, "account_burst", l.accountBurst,
+			"global_rps", l.globalRPS, "global_burst", l.globalBurst)
+	}
+	return l
+}
+
+// allow reports whether a transfer from account may proceed; when not, it
+// returns the scope that rejected it and the wait before retrying.
+func (l *rateLimiter) allow(account string, now time.Time) (string, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.take(account, now)
+}
+
+// allowBatch charges the items of a batch, one token each on its source
+// account, in order. It returns how many got one and, for the first that
+// did not, the scope that rejected it and the wait. With all set the batch
+// is charged whole or not at all, so an atomic batch needing more than the
+// account burst is always refused. A nil limiter allows everything.
+func (l *rateLimiter) allowBatch(accounts []string, all bool, now time.Time) (int, string, time.Duration) {
+	if l == nil || l.accountRPS <= 0 && l.globalRPS <= 0 {
+		return len(accounts), "", 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, account := range accounts {
+		scope, wait := l.take(account, now)
+		if scope == "" {
+			continue
+		}
+		if all {
+			// hand back what the earlier items took
+			for _, a := range accounts[:i] {
+				l.refund(a)
+			}
+			return 0, scope, wait
+		}
+		return i, scope, wait
+	}
+	return len(accounts), "", 0
+}
+
+func (l *rateLimiter) take(account string, now time.Time) (string, time.Duration) {
+	if l.accountRPS > 0 && account != "" {
+		b, ok := l.accounts[account]
+		if !ok {
+			b = &tokenBucket{tokens: l.accountBurst, last: now}
+			l.accounts[account] = b
+		}
+		if ok, wait := b.take(now, l.accountRPS, l.accountBurst); !ok {
+			return "account", wait
+		}
+		l.prune(now)
+	}
+	if l.globalRPS > 0 {
+		if ok, wait := l.global.take(now, l.globalRPS, l.globalBurst); !ok {
+			return "global", wait
+		}
+	}
+	return "", 0
+}
+
+// refund returns the tokens take spent on a transfer from account.
+func (l *rateLimiter) refund(account string) {
+	if b, ok := l.accounts[account]; ok && l.accountRPS > 0 && account != "" {
+		b.tokens = math.Min(l.accountBurst, b.tokens+1)
+	}
+	if l.globalRPS > 0 {
+		l.global.tokens = math.Min(l.globalBurst, l.global.tokens+1)
+	}
+}
+
+// prune drops buckets idle long enough to have refilled completely; a new
+// bucket starts full, so forgetting them changes nothing.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	full := time.Duration(l.accountBurst / l.accountRPS * float64(time.Second))
+	for k, b := range l.accounts {
+		if now.Sub(b.last) >= full {
+			delete(l.accounts, k)
+		}
+	}
+}
+
+// transferRateLimitBodyBytes bounds how much of the body the middleware
+// buffers to find the source account. The rest of a larger body is left
+// for the handler to read.
+const transferRateLimitBodyBytes = 1 << 20
+
+// wrap rate limits a transfer handler. It peeks at fromAccountId and hands
+// the unread body back to next untouched.
+func (l *rateLimiter) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if l.accountRPS <= 0 && l.globalRPS <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var account string
+		if l.accountRPS > 0 && r.Body != nil {
+			body, err := io.ReadAll(io.LimitReader(r.Body, transferRateLimitBodyBytes))
+			if err != nil {
+				http.Error(w, "failed to read body", http.StatusBadRequest)
+				return
+			}
+			var peek struct {
+				FromAccountID string `json:"fromAccountId"`
+			}
+			_ = json.Unmarshal(body, &peek)
+			account = peek.FromAccountID
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+		scope, wait := l.allow(account, time.Now())
+		if scope != "" {
+			rateLimited.WithLabelValues(scope).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSON(w, http.StatusTooManyRequests, TransferResponse{Status: "error", Message: "rate limit exceeded"})
+			return
+		}
+		next(w, r)
+	}
+}
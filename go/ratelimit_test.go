@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowBatch(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		accounts  []string
+		all       bool
+		allowed   int
+		scope     string
+		remaining map[string]float64 // tokens left per account afterwards
+	}{
+		{name: "fits", accounts: []string{"a", "a", "b"}, allowed: 3,
+			remaining: map[string]float64{"a": 0, "b": 1}},
+		{name: "cut at the first item past the account burst", accounts: []string{"a", "b", "a", "a", "b"}, allowed: 3, scope: "account",
+			remaining: map[string]float64{"a": 0, "b": 1}},
+		{name: "atomic refused whole and refunded", accounts: []string{"a", "b", "a", "a"}, all: true, scope: "account",
+			remaining: map[string]float64{"a": 2, "b": 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(limitsConfig{AccountRPS: 0.001, AccountBurst: 2})
+			allowed, scope, wait := l.allowBatch(tt.accounts, tt.all, now)
+			if allowed != tt.allowed || scope != tt.scope {
+				t.Fatalf("allowBatch = %d, %q; want %d, %q", allowed, scope, tt.allowed, tt.scope)
+			}
+			if scope != "" && wait <= 0 {
+				t.Errorf("wait %v, want a positive wait when refused", wait)
+			}
+			for account, want := range tt.remaining {
+				if got := l.accounts[account].tokens; got != want {
+					t.Errorf("account %s has %v tokens, want %v", account, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowBatchGlobal(t *testing.T) {
+	l := newRateLimiter(limitsConfig{GlobalRPS: 0.001, GlobalBurst: 3})
+	if allowed, scope, _ := l.allowBatch([]string{"a", "b", "c", "d"}, false, time.Now()); allowed != 3 || scope != "global" {
+		t.Fatalf("allowBatch = %d, %q; want 3, global", allowed, scope)
+	}
+	var nilLimiter *rateLimiter
+	if allowed, scope, _ := nilLimiter.allowBatch([]string{"a", "b"}, true, time.Now()); allowed != 2 || scope != "" {
+		t.Errorf("nil limiter allowed %d, %q; want every item", allowed, scope)
+	}
+}
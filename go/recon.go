@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/ledger"
+)
+
+// External reconciliation compares a settlement report from an acquirer or
+// bank with the movements we booked against the settlement account, i.e.
+// deposits and withdrawals; transfers between customer accounts never reach
+// a processor. Rows are matched on reference, which is the operationId we
+// sent the processor, and amounts compare by absolute value.
+//
+// The report is parsed as it arrives. Past reconMaxReportBytes, or at a line
+// longer than reconMaxRowBytes, the upload is rejected; only the parsed rows
+// are kept.
+
+const (
+	reconMaxReportBytes = 32 << 20
+	reconMaxRowBytes    = 4 << 10
+)
+
+type reconReport struct {
+	ID         int64     `json:"id"`
+	Source     string    `json:"source"`
+	PeriodFrom time.Time `json:"periodFrom"`
+	PeriodTo   time.Time `json:"periodTo"`
+	Rows       int       `json:"rows"`
+	ImportedBy string    `json:"importedBy"`
+	ImportedAt time.Time `json:"importedAt"`
+}
+
+type reconRow struct {
+	Line      int
+	Reference string
+	Amount    Money
+}
+
+type reconBreak struct {
+	Reference  string `json:"reference"`
+	Ours       *Money `json:"ours,omitempty"`
+	Theirs     *Money `json:"theirs,omitempty"`
+	TransferID *int64 `json:"transferId,omitempty"`
+	Line       *int   `json:"line,omitempty"`
+}
+
+type reconResult struct {
+	Report         reconReport  `json:"report"`
+	Matched        int          `json:"matched"`
+	OursNotTheirs  []reconBreak `json:"oursNotTheirs"`
+	TheirsNotOurs  []reconBreak `json:"theirsNotOurs"`
+	AmountMismatch []reconBreak `json:"amountMismatch"`
+	// DuplicateReferences lists references appearing more than once in the
+	// report; only their first line takes part in matching.
+	DuplicateReferences []reconBreak `json:"duplicateReferences"`
+}
+
+// handleImportRecon takes a CSV report as the request body. The header must
+// name a reference and an amount column; other columns are ignored. source,
+// from, to (RFC 3339, to exclusive) and actor come from the query string.
+func (s *Store) handleImportRecon(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	rep := reconReport{Source: q.Get("source"), ImportedBy: q.Get("actor")}
+	if rep.Source == "" || rep.ImportedBy == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "source and actor are required"})
+		return
+	}
+	var err error
+	if rep.PeriodFrom, err = time.Parse(time.RFC3339, q.Get("from")); err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "from must be an RFC 3339 timestamp"})
+		return
+	}
+	if rep.PeriodTo, err = time.Parse(time.RFC3339, q.Get("to")); err != nil || !rep.PeriodFrom.Before(rep.PeriodTo) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "to must be an RFC 3339 timestamp after from"})
+		return
+	}
+
+	rows, err := parseReconCSV(http.MaxBytesReader(w, r.Body, reconMaxReportBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSON(w, http.StatusRequestEntityTooLarge, TransferResponse{Status: "error",
+			Message: fmt.Sprintf("report is larger than %d bytes", reconMaxReportBytes)})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	rep.Rows = len(rows)
+
+	ctx := r.Context()
+	err = s.beginFunc(ctx, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO recon_reports (source, period_from, period_to, rows, imported_by)
+			VALUES ($1, $2, $3, $4, $5) RETURNING id, imported_at`,
+			rep.Source, rep.PeriodFrom, rep.PeriodTo, rep.Rows, rep.ImportedBy).Scan(&rep.ID, &rep.ImportedAt); err != nil {
+			return err
+		}
+		_, err := tx.CopyFrom(ctx, pgx.Identifier{"recon_rows"}, []string{"report_id", "line", "reference", "amount"},
+			pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+				return []any{rep.ID, rows[i].Line, rows[i].Reference, rows[i].Amount}, nil
+			}))
+		return err
+	})
+	if err != nil {
+		http.Error(w, "failed to store report", http.StatusInternalServerError)
+		return
+	}
+	logger(ctx).Info("recon report imported", "report_id", rep.ID, "actor", rep.ImportedBy, "source", rep.Source, "rows", rep.Rows)
+
+	res, err := s.reconcile(ctx, rep)
+	if err != nil {
+		http.Error(w, "failed to reconcile report", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, res)
+}
+
+func parseReconCSV(body io.Reader) ([]reconRow, error) {
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	refCol, amtCol := -1, -1
+	for i, h := range header {
+		switch strings.ToLower(strings.TrimSpace(h)) {
+		case "reference", "ref":
+			refCol = i
+		case "amount":
+			amtCol = i
+		}
+	}
+	if refCol < 0 || amtCol < 0 {
+		return nil, errors.New("header must include reference and amount columns")
+	}
+	var rows []reconRow
+	for line := 2; ; line++ {
+		start := cr.InputOffset()
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if cr.InputOffset()-start > reconMaxRowBytes {
+			return nil, fmt.Errorf("line %d: longer than %d bytes", line, reconMaxRowBytes)
+		}
+		if len(rec) <= max(refCol, amtCol) {
+			return nil, fmt.Errorf("line %d: missing columns", line)
+		}
+		amt, err := ledger.ParseMoney(rec[amtCol], moneyExponent)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if amt < 0 {
+			amt = -amt
+		}
+		ref := strings.TrimSpace(rec[refCol])
+		if ref == "" {
+			return nil, fmt.Errorf("line %d: empty reference", line)
+		}
+		rows = append(rows, reconRow{Line: line, Reference: ref, Amount: amt})
+	}
+}
+
+func (s *Store) handleGetRecon(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid report id", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	rep := reconReport{ID: id}
+	err = s.pool.QueryRow(ctx, `
+		SELECT source, period_from, period_to, rows, imported_by, imported_at FROM recon_reports WHERE id=$1`, id).
+		Scan(&rep.Source, &rep.PeriodFrom, &rep.PeriodTo, &rep.Rows, &rep.ImportedBy, &rep.ImportedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "report not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load report", http.StatusInternalServerError)
+		return
+	}
+	res, err := s.reconcile(ctx, rep)
+	if err != nil {
+		http.Error(w, "failed to reconcile report", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// reconcile builds the break report. It is computed on every read rather
+// than stored: booked transfers are immutable, so the result only changes
+// when a late movement lands inside the report period, which is exactly
+// what a re-check should show.
+func (s *Store) reconcile(ctx context.Context, rep reconReport) (reconResult, error) {
+	ctx = withQueryPattern(ctx, patternAnalytics)
+	res := reconResult{
+		Report:              rep,
+		OursNotTheirs:       make([]reconBreak, 0),
+		TheirsNotOurs:       make([]reconBreak, 0),
+		AmountMismatch:      make([]reconBreak, 0),
+		DuplicateReferences: make([]reconBreak, 0),
+	}
+
+	dups, err := s.pool.Query(ctx, `
+		SELECT reference, line, amount FROM (
+			SELECT reference, line, amount, row_number() OVER (PARTITION BY reference ORDER BY line) AS n
+			FROM recon_rows WHERE report_id=$1
+		) r WHERE n > 1 ORDER BY line`, rep.ID)
+	if err != nil {
+		return res, err
+	}
+	for dups.Next() {
+		var (
+			b    reconBreak
+			line int
+			amt  Money
+		)
+		if err := dups.Scan(&b.Reference, &line, &amt); err != nil {
+			dups.Close()
+			return res, err
+		}
+		b.Line, b.Theirs = &line, &amt
+		res.DuplicateReferences = append(res.DuplicateReferences, b)
+	}
+	dups.Close()
+	if err := dups.Err(); err != nil {
+		return res, err
+	}
+
+	rows, err := s.pool.Query(ctx, `
+		WITH theirs AS (
+			SELECT DISTINCT ON (reference) reference, line, amount
+			FROM recon_rows WHERE report_id=$1 ORDER BY reference, line
+		), ours AS (
+			SELECT operation_id AS reference, id, amount FROM transfers
+			WHERE operation_id IS NOT NULL AND created_at >= $2 AND created_at < $3
+			  AND (from_account_id=$4 OR to_account_id=$4)
+		)
+		SELECT COALESCE(o.reference, t.reference), o.id, o.amount, t.line, t.amount
+		FROM ours o FULL OUTER JOIN theirs t ON t.reference = o.reference
+		ORDER BY 1`, rep.ID, rep.PeriodFrom, rep.PeriodTo, settlementAccountID)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b reconBreak
+		if err := rows.Scan(&b.Reference, &b.TransferID, &b.Ours, &b.Line, &b.Theirs); err != nil {
+			return res, err
+		}
+		switch {
+		case b.Theirs == nil:
+			res.OursNotTheirs = append(res.OursNotTheirs, b)
+		case b.Ours == nil:
+			res.TheirsNotOurs = append(res.TheirsNotOurs, b)
+		case *b.Ours != *b.Theirs:
+			res.AmountMismatch = append(res.AmountMismatch, b)
+		default:
+			res.Matched++
+		}
+	}
+	return res, rows.Err()
+}
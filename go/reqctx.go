@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type ctxKey int
+
+const (
+	metaKey ctxKey = iota
+	principalKey
+	labelsKey
+	bookingTenantKey
+)
+
+// requestMeta carries caller attributes from the HTTP layer down to the
+// transfer pipeline (metrics, risk rules, audit).
+type requestMeta struct {
+	Client    string
+	Tenant    string
+	IP        string
+	RequestID string
+}
+
+// trustForwarded makes callerIP honour X-Forwarded-For; only enable it behind
+// a proxy that overwrites the header.
+var trustForwarded = envOrDefault("TRUST_FORWARDED_FOR", "false") == "true"
+
+// metaFromRequest identifies the caller: by its credential when auth is
+// enabled, otherwise by the X-Client-ID and X-Tenant-ID headers, whose values
+// are truncated to keep a misbehaving client from creating arbitrarily long
+// label values.
+func metaFromRequest(r *http.Request) requestMeta {
+	if p := principalFromContext(r.Context()); p != nil {
+		return requestMeta{Client: p.Client, Tenant: p.Tenant, IP: callerIP(r), RequestID: r.Header.Get(requestIDHeader)}
+	}
+	return requestMeta{
+		Client:    headerOr(r, "X-Client-ID", "unknown"),
+		Tenant:    headerOr(r, "X-Tenant-ID", "default"),
+		IP:        callerIP(r),
+		RequestID: r.Header.Get(requestIDHeader),
+	}
+}
+
+func headerOr(r *http.Request, key, fallback string) string {
+	v := r.Header.Get(key)
+	if v == "" {
+		return fallback
+	}
+	if len(v) > 64 {
+		v = v[:64]
+	}
+	return v
+}
+
+func callerIP(r *http.Request) string {
+	if trustForwarded {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func withMeta(ctx context.Context, m requestMeta) context.Context {
+	return context.WithValue(ctx, metaKey, m)
+}
+
+func metaFromContext(ctx context.Context) requestMeta {
+	if m, ok := ctx.Value(metaKey).(requestMeta); ok {
+		return m
+	}
+	return requestMeta{Client: "unknown", Tenant: "default"}
+}
+
+func clientFromContext(ctx context.Context) string {
+	return metaFromContext(ctx).Client
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// A payout is a withdrawal: a transfer from a customer account to the
+// settlement account. When the receiving bank bounces it, the funds come back
+// as a new transfer in the opposite direction that references the original
+// through reverses_id, so both sides of the round trip stay in the ledger.
+
+var returnReasonPattern = regexp.MustCompile(`^[A-Z0-9_]{1,16}$`)
+
+type payoutReturnRequest struct {
+	ReasonCode string `json:"reasonCode"`
+	Source     string `json:"source"`
+}
+
+// handlePayoutReturn is the callback for a bounced payout. The re-credit is
+// keyed by the payout, so the bank retrying its callback replays the first
+// answer. Funds for an account closed in the meantime go to suspense for an
+// operator to sort out.
+func (s *Store) handlePayoutReturn(w http.ResponseWriter, r *http.Request) {
+	payoutID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid payout id", http.StatusBadRequest)
+		return
+	}
+	var body payoutReturnRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if !returnReasonPattern.MatchString(body.ReasonCode) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "reasonCode must be 1-16 characters of A-Z, 0-9 or _"})
+		return
+	}
+	ctx := withMeta(r.Context(), metaFromRequest(r))
+	if body.Source == "" {
+		body.Source = clientFromContext(ctx)
+	}
+
+	var (
+		customer, to, status string
+		amount               Money
+	)
+	err = s.pool.QueryRow(ctx, `
+		SELECT t.from_account_id, t.to_account_id, t.amount, a.status
+		FROM transfers t JOIN accounts a ON a.id = t.from_account_id
+		WHERE t.id=$1`, payoutID).Scan(&customer, &to, &amount, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "payout not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load payout", http.StatusInternalServerError)
+		return
+	}
+	if to != settlementAccountID || isSystemAccount(customer) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "transfer is not a payout"})
+		return
+	}
+
+	credit := customer
+	if status == accountClosed {
+		credit = suspenseAccountID
+	}
+	req := TransferRequest{
+		FromAccountID: settlementAccountID,
+		ToAccountID:   credit,
+		Amount:        amount,
+		OperationID:   "payout-return-" + strconv.FormatInt(payoutID, 10),
+		reverses:      payoutID,
+	}
+	resp, code, err := s.runTransfer(onBehalfOf(ctx, ""), req, false)
+	if err != nil {
+		logger(ctx).Error("payout return failed", "payout_id", payoutID, "error", err)
+		writeError(w, code, err)
+		return
+	}
+
+	tag, err := s.pool.Exec(ctx, `
+		INSERT INTO payout_returns (transfer_id, reason_code, operation_id, credited_account_id, reported_by)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (transfer_id) DO NOTHING`,
+		payoutID, body.ReasonCode, req.OperationID, credit, body.Source)
+	if err != nil {
+		logger(ctx).Error("payout returned but not recorded", "payout_id", payoutID, "error", err)
+	} else if tag.RowsAffected() > 0 {
+		s.payoutReturned(ctx, payoutID, customer, credit, amount, body.ReasonCode, resp.ReceiptNumber)
+	}
+	writeTransfer(w, code, resp)
+	s.markJournal(ctx, req.OperationID, journalResponded, "")
+}
+
+// payoutReturned runs once per returned payout: it queues the suspense item
+// when the account was closed and emits the event customer notifications
+// are built from.
+func (s *Store) payoutReturned(ctx context.Context, payoutID int64, customer, credited string, amount Money, reason, receiptNumber string) {
+	payoutReturns.WithLabelValues(reason).Inc()
+	if credited == suspenseAccountID {
+		if _, err := s.pool.Exec(ctx, `
+			INSERT INTO suspense_items (operation_id, reference, amount, source, reason, status)
+			VALUES ($1, $2, $3, 'payout_return', 'account_closed', $4) ON CONFLICT (operation_id) DO NOTHING`,
+			"payout-return-"+strconv.FormatInt(payoutID, 10), customer, amount, suspenseOpen); err != nil {
+			logger(ctx).Error("suspense item for returned payout not recorded", "payout_id", payoutID, "error", err)
+		}
+	}
+	if err := s.recordEvent(ctx, "payout.returned", "account/"+customer, map[string]any{
+		"accountId":     customer,
+		"payoutId":      payoutID,
+		"amount":        amount,
+		"reasonCode":    reason,
+		"creditedTo":    credited,
+		"receiptNumber": receiptNumber,
+	}); err != nil {
+		logger(ctx).Error("record payout return event", "payout_id", payoutID, "error", err)
+	}
+	logger(ctx).Info("payout returned", "payout_id", payoutID, "reason_code", reason, "amount", amount, "credited_to", credited)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// A reversal undoes a transfer by booking its mirror image: the receiver is
+// debited what it was credited, the sender credited what it was debited,
+// in the original currencies and at the original rate, and a fee charged
+// on the transfer is refunded. Nothing of the original is edited; the
+// reversal references it through reverses_id, and its unique index keeps a
+// transfer from being reversed twice by any path (payout returns included).
+//
+// The reversal is an operation of its own, keyed "reversal:<operationId>",
+// so repeating the request replays the first answer.
+//
+// Support reverses transfers that should not have happened, so the usual
+// transfer rules do not apply: a frozen receiver is still debited and no
+// fee or limit is charged. A closed account cannot take part, and the
+// receiver must still hold the funds (overdraft included).
+
+type reverseRequest struct {
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`
+}
+
+var (
+	errAlreadyReversed = errors.New("transfer was already reversed")
+	errIsReversal      = errors.New("transfer is itself a reversal")
+)
+
+type reversedTransfer struct {
+	operationID                   string
+	id, reverses                  int64
+	from, to                      string
+	amount, destinationAmount     Money
+	currency, destinationCurrency string
+	rate                          *string
+}
+
+func reversalOperationID(operationID string) string {
+	return "reversal:" + operationID
+}
+
+func (s *Store) handleReverseTransfer(w http.ResponseWriter, r *http.Request) {
+	var body reverseRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if body.Reason == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "reason is required"})
+		return
+	}
+	ctx := withMeta(r.Context(), metaFromRequest(r))
+	if body.Actor == "" {
+		body.Actor = clientFromContext(ctx)
+	}
+	original := r.PathValue("operationId")
+	opID := reversalOperationID(original)
+	resp, status, err := s.reverseTransfer(ctx, original, body)
+	if err != nil {
+		logger(ctx).Error("reversal failed", "operation_id", original, "status", status, "error", err)
+		writeError(w, status, err)
+		return
+	}
+	writeTransfer(w, status, resp)
+	s.markJournal(ctx, opID, journalResponded, "")
+}
+
+func (s *Store) reverseTransfer(ctx context.Context, original string, body reverseRequest) (TransferResponse, int, error) {
+	opID := reversalOperationID(original)
+	unlock, err := s.lockOperation(ctx, opID)
+	if errors.Is(err, errOperationInFlight) {
+		return TransferResponse{}, http.StatusConflict, err
+	}
+	if errors.Is(err, errLocksBusy) {
+		return TransferResponse{}, http.StatusServiceUnavailable, err
+	}
+	if err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("lock operation: %w", err)
+	}
+	defer unlock()
+
+	if processed, err := s.findProcessed(ctx, opID); err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("failed to check duplicate: %w", err)
+	} else if processed != nil {
+		return replayProcessed(ctx, TransferRequest{OperationID: opID}, processed)
+	}
+
+	var (
+		t       = reversedTransfer{operationID: original}
+		rawResp []byte
+	)
+	err = s.pool.QueryRow(ctx, `
+		SELECT t.id, COALESCE(t.reverses_id, 0), t.from_account_id, t.to_account_id, t.amount,
+			COALESCE(t.destination_amount, t.amount), t.currency, COALESCE(t.destination_currency, t.currency), t.fx_rate::text, p.response
+		FROM transfers t LEFT JOIN processed_ops p USING (operation_id)
+		WHERE t.operation_id=$1`, original).
+		Scan(&t.id, &t.reverses, &t.from, &t.to, &t.amount, &t.destinationAmount, &t.currency, &t.destinationCurrency, &t.rate, &rawResp)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return TransferResponse{}, http.StatusNotFound, errors.New("transfer not found")
+	}
+	if err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("load transfer: %w", err)
+	}
+	if t.reverses != 0 {
+		return TransferResponse{}, http.StatusConflict, errIsReversal
+	}
+	var fee Money
+	if rawResp != nil {
+		var orig TransferResponse
+		if err := json.Unmarshal(rawResp, &orig); err == nil && orig.Fee != nil {
+			fee = *orig.Fee
+		}
+	}
+	req := TransferRequest{FromAccountID: t.to, ToAccountID: t.from, Amount: t.destinationAmount, OperationID: opID, reverses: t.id}
+	if _, err := s.journalReceive(ctx, req); err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("journal operation: %w", err)
+	}
+	s.markJournal(ctx, opID, journalExecuting, "")
+
+	resp, status, err := s.bookReversal(ctx, req, t, fee, body)
+	if err != nil {
+		s.markJournal(ctx, opID, journalFailed, err.Error())
+		s.transferFailed(ctx, req, status, err)
+		return TransferResponse{}, status, err
+	}
+
+	for id, balance := range resp.Balances {
+		accountBalance.WithLabelValues(id).Set(balance.Float())
+	}
+	transferRequests.WithLabelValues("reversed").Inc()
+	logger(ctx).Info("transfer reversed", "operation_id", original, "transfer_id", t.id, "actor", body.Actor, "reason", body.Reason,
+		"amount", t.amount, "fee_refunded", fee)
+	if err := s.recordEvent(ctx, "transfer.reversed", "transfer/"+original, map[string]any{
+		"transferId": t.id, "from": t.from, "to": t.to, "amount": t.amount, "feeRefunded": fee, "actor": body.Actor, "reason": body.Reason,
+		"receiptNumber": resp.ReceiptNumber,
+	}); err != nil {
+		logger(ctx).Warn("record reversal event", "operation_id", original, "error", err)
+	}
+	return resp, http.StatusOK, nil
+}
+
+// bookReversal writes the reversal in one transaction, the way
+// executeTransfer writes a transfer.
+func (s *Store) bookReversal(ctx context.Context, req TransferRequest, t reversedTransfer, fee Money, body reverseRequest) (TransferResponse, int, error) {
+	tx, err := s.beginTx(ctx, pgx.TxOptions{IsoLevel: s.isoLevel})
+	if err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("failed to start tx: %w", err)
+	}
+	defer tx.Rollback(ctx) // safe to call after commit
+
+	// the operation lock is held, so a claimed reversal here was committed
+	// by a request that lost its response; the caller replays it on retry
+	tag, err := tx.Exec(ctx, "INSERT INTO processed_ops (operation_id) VALUES ($1) ON CONFLICT DO NOTHING", req.OperationID)
+	if err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("claim operation: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return TransferResponse{}, http.StatusConflict, errOperationInFlight
+	}
+	ids := []string{t.from, t.to}
+	if fee > 0 {
+		ids = append(ids, feesAccountID)
+	}
+	locked, err := lockAccounts(ctx, tx, ids...)
+	if err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("lock accounts: %w", err)
+	}
+	payer, payee := locked[t.to], locked[t.from]
+	switch {
+	case payer == nil || payee == nil:
+		return TransferResponse{}, http.StatusInternalServerError, errors.New("account of the transfer disappeared")
+	case payer.status == accountClosed, payee.status == accountClosed:
+		return TransferResponse{}, http.StatusBadRequest, errAccountClosed
+	case payer.balance-payer.held-t.destinationAmount < -payer.overdraftLimit && t.to != settlementAccountID:
+		return TransferResponse{}, http.StatusBadRequest, errInsufficientFunds
+	}
+
+	var rate string
+	if t.rate != nil {
+		r, err := parseRate(*t.rate)
+		if err != nil {
+			return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("transfer rate: %w", err)
+		}
+		rate = formatRate(new(big.Rat).Inv(r))
+	}
+	payerBalance, payeeBalance := payer.balance-t.destinationAmount, payee.balance+t.amount
+	if _, err := tx.Exec(ctx, "UPDATE accounts SET balance=$1 WHERE id=$2", payerBalance, t.to); err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("update from account: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE accounts SET balance=$1 WHERE id=$2", payeeBalance, t.from); err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("update to account: %w", err)
+	}
+	var reversalID int64
+	if err := tx.QueryRow(ctx, `
+		INSERT INTO transfers (operation_id, from_account_id, to_account_id, amount, reverses_id, currency, destination_amount, destination_currency, fx_rate)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,NULLIF($9,'')::numeric) RETURNING id`,
+		req.OperationID, t.to, t.from, t.destinationAmount, t.id, t.destinationCurrency, t.amount, t.currency, rate).Scan(&reversalID); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return TransferResponse{}, http.StatusConflict, errAlreadyReversed
+		}
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("insert transfer: %w", err)
+	}
+	receiptNumber, err := issueReceipt(ctx, tx, reversalID)
+	if err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, err
+	}
+	clockTenant := payer.tenantID
+	if clockTenant == "system" {
+		clockTenant = payee.tenantID
+	}
+	now := s.clocks.now(clockTenant).UTC().Truncate(time.Second)
+	if err := insertTransferEntries(ctx, tx, reversalID, now,
+		ledgerEntry{accountID: t.to, amount: t.destinationAmount, currency: t.destinationCurrency, fxRate: rate},
+		ledgerEntry{accountID: t.from, amount: t.amount, currency: t.currency, fxRate: rate}); err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, err
+	}
+	if fee > 0 {
+		if payeeBalance, err = refundFee(ctx, tx, t.from, t.currency, payeeBalance, fee, now); err != nil {
+			return TransferResponse{}, http.StatusInternalServerError, err
+		}
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO transfer_reversals (transfer_id, reversal_id, fee_refunded, reason, actor) VALUES ($1, $2, $3, $4, $5)`,
+		t.id, reversalID, fee, body.Reason, body.Actor); err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("record reversal: %w", err)
+	}
+	if err := journalMark(ctx, tx, t.operationID, journalReversed, nil, ""); err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("journal original: %w", err)
+	}
+
+	resp := transferResult(req, payerBalance, payeeBalance)
+	resp.Message = "transfer reversed"
+	resp.ReceiptNumber = receiptNumber
+	if fee > 0 {
+		resp.Fee = &fee
+	}
+	if err := s.writeOutbox(ctx, tx, "transfer.completed", strconv.FormatInt(reversalID, 10), transferEvent{
+		TransferID: reversalID, OperationID: req.OperationID, FromAccountID: t.to, ToAccountID: t.from,
+		Amount: t.destinationAmount, Currency: t.destinationCurrency, DestinationAmount: t.amount, DestinationCurrency: t.currency,
+		Fee: resp.Fee, ReversesID: t.id, ReceiptNumber: receiptNumber, At: now,
+	}); err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("write outbox: %w", err)
+	}
+	raw, err := encodeResponse(resp)
+	if err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("encode response: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE processed_ops SET response=$2, status=$3 WHERE operation_id=$1", req.OperationID, raw, http.StatusOK); err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("store response: %w", err)
+	}
+	resp.raw = raw
+	if err := journalMark(ctx, tx, req.OperationID, journalCommitted, &resp, ""); err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("journal commit: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("commit tx: %w", err)
+	}
+	s.cache.accounts.invalidate(t.from, t.to, feesAccountID)
+	return resp, http.StatusOK, nil
+}
+
+// refundFee pays a transfer fee back from the fees account; it mirrors
+// chargeFee.
+func refundFee(ctx context.Context, tx pgx.Tx, accountID, currency string, balance, fee Money, at time.Time) (Money, error) {
+	balance += fee
+	if _, err := tx.Exec(ctx, "UPDATE accounts SET balance=$1 WHERE id=$2", balance, accountID); err != nil {
+		return 0, fmt.Errorf("refund fee: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE accounts SET balance=balance-$1 WHERE id=$2", fee, feesAccountID); err != nil {
+		return 0, fmt.Errorf("debit fee: %w", err)
+	}
+	var feeID int64
+	if err := tx.QueryRow(ctx, "INSERT INTO transfers (from_account_id, to_account_id, amount, currency, destination_amount, destination_currency) VALUES ($1,$2,$3,$4,$3,$4) RETURNING id",
+		feesAccountID, accountID, fee, currency).Scan(&feeID); err != nil {
+		return 0, fmt.Errorf("insert fee refund transfer: %w", err)
+	}
+	if err := insertTransferEntries(ctx, tx, feeID, at,
+		ledgerEntry{accountID: feesAccountID, amount: fee, currency: currency},
+		ledgerEntry{accountID: accountID, amount: fee, currency: currency}); err != nil {
+		return 0, fmt.Errorf("fee refund: %w", err)
+	}
+	return balance, nil
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/store"
+)
+
+// Risk decisions, ordered by severity: when several rules hit, the most
+// severe decision wins.
+const (
+	riskAllow  = "allow"
+	riskReview = "review"
+	riskBlock  = "block"
+)
+
+var errBlockedByRule = store.ErrBlockedByRule
+
+func riskSeverity(decision string) int {
+	switch decision {
+	case riskBlock:
+		return 2
+	case riskReview:
+		return 1
+	}
+	return 0
+}
+
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// riskInput is what rules get to look at. Rules are evaluated before the
+// transfer transaction starts so slow rules never extend account lock time;
+// only transferChecks run inside it.
+type riskInput struct {
+	Req  TransferRequest
+	Meta requestMeta
+}
+
+type riskOutcome struct {
+	Rule     string         `json:"rule"`
+	Decision string         `json:"decision"`
+	Reason   string         `json:"reason"`
+	Details  map[string]any `json:"details,omitempty"`
+}
+
+type riskRule interface {
+	Name() string
+	Evaluate(ctx context.Context, db querier, in riskInput) (riskOutcome, error)
+}
+
+// transferCheck is a rule evaluated inside the transfer transaction, after
+// the account rows are locked and before commit. Checks that count the
+// source's recent transfers belong here: under the lock every earlier
+// transfer from the account has committed, so a burst of concurrent
+// requests cannot all slip under a velocity limit. Checks should be cheap;
+// they run while the accounts are held.
+type transferCheck interface {
+	Name() string
+	Check(ctx context.Context, tx pgx.Tx, in riskInput) (riskOutcome, error)
+}
+
+// Risk stages, as recorded in risk_events.
+const (
+	riskStagePreTransfer = "pre_transfer"
+	riskStagePreCommit   = "pre_commit"
+)
+
+// errRuleHits carries the hits of the pre-commit checks out of the transfer
+// transaction, which has to roll back before the case is opened.
+type errRuleHits struct {
+	hits []riskOutcome
+}
+
+func (e *errRuleHits) Error() string {
+	return fmt.Sprintf("transfer stopped by %d pre-commit rule(s)", len(e.hits))
+}
+
+// evaluateRisk runs every configured rule and returns the most severe
+// outcome. Any non-allow outcome opens a single case carrying every hit and
+// the original request, so compliance can follow up on blocked transfers and
+// reviewers can approve held ones.
+func (s *Store) evaluateRisk(ctx context.Context, in riskInput) (riskOutcome, int64, error) {
+	var hits []riskOutcome
+	for _, rule := range s.risk {
+		out, err := rule.Evaluate(ctx, s.pool, in)
+		if err != nil {
+			return riskOutcome{}, 0, fmt.Errorf("risk rule %s: %w", rule.Name(), err)
+		}
+		if out.Decision == riskAllow {
+			continue
+		}
+		if out.Rule == "" {
+			out.Rule = rule.Name()
+		}
+		hits = append(hits, out)
+	}
+	return s.decideRisk(ctx, in, riskStagePreTransfer, hits)
+}
+
+// checkTransfer runs the pre-commit checks, returning errRuleHits when any
+// of them does not allow the transfer.
+func (s *Store) checkTransfer(ctx context.Context, tx pgx.Tx, in riskInput) error {
+	var hits []riskOutcome
+	for _, check := range s.checks {
+		out, err := check.Check(ctx, tx, in)
+		if err != nil {
+			return fmt.Errorf("risk check %s: %w", check.Name(), err)
+		}
+		if out.Decision == riskAllow {
+			continue
+		}
+		if out.Rule == "" {
+			out.Rule = check.Name()
+		}
+		hits = append(hits, out)
+	}
+	if len(hits) > 0 {
+		return &errRuleHits{hits: hits}
+	}
+	return nil
+}
+
+// decideRisk settles a stage's hits on the most severe one, counting each
+// and opening the case.
+func (s *Store) decideRisk(ctx context.Context, in riskInput, stage string, hits []riskOutcome) (riskOutcome, int64, error) {
+	final := riskOutcome{Decision: riskAllow}
+	for _, out := range hits {
+		riskRuleHits.WithLabelValues(out.Rule, out.Decision).Inc()
+		if riskSeverity(out.Decision) > riskSeverity(final.Decision) {
+			final = out
+		}
+	}
+	if len(hits) == 0 {
+		return final, 0, nil
+	}
+	if in.Req.atomic && final.Decision == riskReview {
+		// a reviewer could only release the item on its own, outside the
+		// batch it was submitted with
+		final.Decision = riskBlock
+	}
+	caseID, err := s.openRiskCase(ctx, in, final, hits)
+	if err != nil {
+		return final, 0, err
+	}
+	s.recordRiskEvents(ctx, in, stage, caseID, hits)
+	return final, caseID, nil
+}
+
+// recordRiskEvents appends one risk_events row per hit. Cases are the review
+// workflow, one per transfer; events are the per-rule record to tune rules
+// against, so they are written best-effort.
+func (s *Store) recordRiskEvents(ctx context.Context, in riskInput, stage string, caseID int64, hits []riskOutcome) {
+	batch := &pgx.Batch{}
+	for _, h := range hits {
+		var details []byte
+		if h.Details != nil {
+			details, _ = json.Marshal(h.Details)
+		}
+		batch.Queue(`
+			INSERT INTO risk_events (stage, rule, decision, reason, account_id, to_account_id, amount, operation_id, case_id, details)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,NULLIF($8,''),$9,$10)`,
+			stage, h.Rule, h.Decision, h.Reason, in.Req.FromAccountID, in.Req.ToAccountID, in.Req.Amount, in.Req.OperationID, caseID, details)
+	}
+	if err := s.pool.SendBatch(context.WithoutCancel(ctx), batch).Close(); err != nil {
+		logger(ctx).Error("record risk events", "case_id", caseID, "error", err)
+	}
+}
+
+// riskResponse answers a transfer whose risk outcome is not allow: a block
+// fails it, a review holds it behind its case.
+func (s *Store) riskResponse(ctx context.Context, req TransferRequest, outcome riskOutcome, caseID int64) (TransferResponse, int, error) {
+	if outcome.Decision == riskBlock {
+		transferRequests.WithLabelValues("blocked_by_rule").Inc()
+		s.markJournal(ctx, req.OperationID, journalFailed, outcome.Reason)
+		err := fmt.Errorf("%w: %s", errBlockedByRule, outcome.Reason)
+		s.transferFailed(ctx, req, http.StatusForbidden, err)
+		return TransferResponse{}, http.StatusForbidden, err
+	}
+	transferRequests.WithLabelValues("pending_review").Inc()
+	s.markJournal(ctx, req.OperationID, journalPendingReview, "")
+	return TransferResponse{Status: "pending_review", Message: "transfer held for manual review", CaseID: caseID}, http.StatusAccepted, nil
+}
+
+func (s *Store) openRiskCase(ctx context.Context, in riskInput, final riskOutcome, hits []riskOutcome) (int64, error) {
+	details, err := json.Marshal(map[string]any{"hits": hits, "tenant": in.Meta.Tenant, "ip": in.Meta.IP})
+	if err != nil {
+		return 0, err
+	}
+	request, err := json.Marshal(in.Req)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = s.pool.QueryRow(context.WithoutCancel(ctx), `
+		INSERT INTO risk_cases (rule, decision, reason, account_id, operation_id, client, details, request)
+		VALUES ($1,$2,$3,$4,NULLIF($5,''),$6,$7,$8) RETURNING id`,
+		final.Rule, final.Decision, final.Reason, in.Req.FromAccountID, in.Req.OperationID, in.Meta.Client, details, request).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("open risk case: %w", err)
+	}
+	logger(ctx).Info("risk case opened", "case_id", id, "rule", final.Rule, "decision", final.Decision, "account_id", in.Req.FromAccountID, "reason", final.Reason)
+	return id, nil
+}
+
+// pendingReview answers a retry of an operation that is still waiting for a
+// reviewer, pointing at its open case.
+func (s *Store) pendingReview(ctx context.Context, operationID string) (TransferResponse, int, error) {
+	var caseID int64
+	err := s.pool.QueryRow(ctx, `
+		SELECT id FROM risk_cases WHERE operation_id=$1 AND status='open' ORDER BY id DESC LIMIT 1`,
+		operationID).Scan(&caseID)
+	if err != nil && err != pgx.ErrNoRows {
+		return TransferResponse{}, http.StatusInternalServerError, fmt.Errorf("load review case: %w", err)
+	}
+	return TransferResponse{Status: "pending_review", Message: "transfer held for manual review", CaseID: caseID}, http.StatusAccepted, nil
+}
+
+// distinctDestinationsRule flags the mule-account pattern: one source paying
+// many different destinations in a short window.
+type distinctDestinationsRule struct {
+	max    int
+	window time.Duration
+	action string
+}
+
+func (r distinctDestinationsRule) Name() string { return "distinct_destinations" }
+
+func (r distinctDestinationsRule) Evaluate(ctx context.Context, db querier, in riskInput) (riskOutcome, error) {
+	var (
+		distinct int
+		known    bool
+	)
+	err := db.QueryRow(ctx, `
+		SELECT count(DISTINCT to_account_id), COALESCE(bool_or(to_account_id=$2), false)
+		FROM transfers
+		WHERE from_account_id=$1 AND created_at > $3 AND to_account_id <> $4`,
+		in.Req.FromAccountID, in.Req.ToAccountID, time.Now().Add(-r.window), adjustmentsAccountID).Scan(&distinct, &known)
+	if err != nil {
+		return riskOutcome{}, err
+	}
+	// paying an account already paid in the window never raises the count
+	if known || distinct < r.max {
+		return riskOutcome{Decision: riskAllow}, nil
+	}
+	return riskOutcome{
+		Decision: r.action,
+		Reason:   fmt.Sprintf("more than %d distinct destinations within %s", r.max, r.window),
+		Details: map[string]any{
+			"distinctDestinations": distinct + 1,
+			"limit":                r.max,
+			"window":               r.window.String(),
+		},
+	}, nil
+}
+
+// riskRulesFromEnv builds the rule set configured for this deployment.
+func riskRulesFromEnv() ([]riskRule, error) {
+	var rules []riskRule
+	if max := intOrDefault("RISK_MAX_DISTINCT_DESTINATIONS", 0); max > 0 {
+		action := envOrDefault("RISK_DISTINCT_DESTINATIONS_ACTION", riskBlock)
+		if riskSeverity(action) == 0 {
+			return nil, fmt.Errorf("RISK_DISTINCT_DESTINATIONS_ACTION must be %s or %s", riskBlock, riskReview)
+		}
+		rules = append(rules, distinctDestinationsRule{
+			max:    max,
+			window: durationOrDefault("RISK_DISTINCT_DESTINATIONS_WINDOW", time.Hour),
+			action: action,
+		})
+	}
+	geo, err := geoRuleFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if geo != nil {
+		rules = append(rules, geo)
+	}
+	return rules, nil
+}
+
+type riskCase struct {
+	ID          int64           `json:"id"`
+	Rule        string          `json:"rule"`
+	Decision    string          `json:"decision"`
+	Reason      string          `json:"reason"`
+	AccountID   string          `json:"accountId"`
+	OperationID *string         `json:"operationId,omitempty"`
+	Client      string          `json:"client"`
+	Details     json.RawMessage `json:"details,omitempty"`
+	Status      string          `json:"status"`
+	CreatedAt   time.Time       `json:"createdAt"`
+}
+
+func (s *Store) handleRiskCases(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "open"
+	}
+	rows, err := s.pool.Query(r.Context(), `
+		SELECT id, rule, decision, reason, account_id, operation_id, client, details, status, created_at
+		FROM risk_cases WHERE status=$1 ORDER BY id DESC LIMIT 100`, status)
+	if err != nil {
+		http.Error(w, "failed to load risk cases", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	cases := make([]riskCase, 0)
+	for rows.Next() {
+		var c riskCase
+		if err := rows.Scan(&c.ID, &c.Rule, &c.Decision, &c.Reason, &c.AccountID, &c.OperationID, &c.Client, &c.Details, &c.Status, &c.CreatedAt); err != nil {
+			http.Error(w, "failed to parse risk cases", http.StatusInternalServerError)
+			return
+		}
+		cases = append(cases, c)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"cases": cases})
+}
+
+type riskEvent struct {
+	ID          int64           `json:"id"`
+	Stage       string          `json:"stage"`
+	Rule        string          `json:"rule"`
+	Decision    string          `json:"decision"`
+	Reason      string          `json:"reason"`
+	AccountID   string          `json:"accountId"`
+	ToAccountID string          `json:"toAccountId"`
+	Amount      Money           `json:"amount"`
+	OperationID *string         `json:"operationId,omitempty"`
+	CaseID      *int64          `json:"caseId,omitempty"`
+	Details     json.RawMessage `json:"details,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+}
+
+// handleRiskEvents lists rule hits newest first, optionally for one rule,
+// account or stage; before pages back from an event id.
+func (s *Store) handleRiskEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	where, args := "true", []any{}
+	for _, f := range []struct{ param, column string }{{"rule", "rule"}, {"accountId", "account_id"}, {"stage", "stage"}} {
+		if v := q.Get(f.param); v != "" {
+			args = append(args, v)
+			where += fmt.Sprintf(" AND %s=$%d", f.column, len(args))
+		}
+	}
+	if v := q.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+		args = append(args, before)
+		where += fmt.Sprintf(" AND id<$%d", len(args))
+	}
+	rows, err := s.pool.Query(r.Context(), `
+		SELECT id, stage, rule, decision, reason, account_id, to_account_id, amount, operation_id, case_id, details, created_at
+		FROM risk_events WHERE `+where+` ORDER BY id DESC LIMIT 100`, args...)
+	if err != nil {
+		http.Error(w, "failed to load risk events", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	events := make([]riskEvent, 0)
+	for rows.Next() {
+		var e riskEvent
+		if err := rows.Scan(&e.ID, &e.Stage, &e.Rule, &e.Decision, &e.Reason, &e.AccountID, &e.ToAccountID, &e.Amount,
+			&e.OperationID, &e.CaseID, &e.Details, &e.CreatedAt); err != nil {
+			http.Error(w, "failed to parse risk events", http.StatusInternalServerError)
+			return
+		}
+		events = append(events, e)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": events})
+}
+
+type caseResolution struct {
+	Actor string `json:"actor"`
+	Note  string `json:"note"`
+}
+
+func decodeResolution(w http.ResponseWriter, r *http.Request) (int64, caseResolution, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid case id", http.StatusBadRequest)
+		return 0, caseResolution{}, false
+	}
+	var res caseResolution
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil || res.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return 0, caseResolution{}, false
+	}
+	return id, res, true
+}
+
+// handleApproveCase releases a transfer held for review. The transfer runs
+// through the normal pipeline minus the risk rules, so idempotency and
+// balance checks still apply; if it fails the case records why. The case is
+// resolved inside the transfer's transaction (see approveCase), so a crash
+// leaves it either open or approved with its transfer booked.
+func (s *Store) handleApproveCase(w http.ResponseWriter, r *http.Request) {
+	id, res, ok := decodeResolution(w, r)
+	if !ok {
+		return
+	}
+	var (
+		raw    []byte
+		tenant string
+	)
+	err := s.pool.QueryRow(r.Context(), `
+		SELECT request, COALESCE(details->>'tenant', '') FROM risk_cases
+		WHERE id=$1 AND status='open' AND decision=$2 AND request IS NOT NULL`, id, riskReview).Scan(&raw, &tenant)
+	if err == pgx.ErrNoRows {
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: errCaseNotOpen.Error()})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load case", http.StatusInternalServerError)
+		return
+	}
+	var req TransferRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		http.Error(w, "failed to parse case request", http.StatusInternalServerError)
+		return
+	}
+	req.approval = &caseApproval{id: id, actor: res.Actor, note: res.Note}
+
+	ctx := withMeta(r.Context(), metaFromRequest(r))
+	if principalFromContext(ctx) != nil {
+		// the transfer is held before its accounts are checked, so it is
+		// booked for the tenant that sent it, not the reviewer's
+		ctx = onBehalfOf(ctx, tenant)
+	}
+	resp, status, txErr := s.runTransfer(ctx, req, false)
+	caseStatus := "approved"
+	if txErr != nil {
+		caseStatus = "approval_failed"
+		// a case another reviewer resolved meanwhile keeps their outcome
+		if _, err := s.pool.Exec(context.WithoutCancel(ctx), `
+			UPDATE risk_cases SET status=$2, resolved_by=$3, resolution=$4, resolved_at=now() WHERE id=$1 AND status='open'`,
+			id, caseStatus, res.Actor, txErr.Error()); err != nil {
+			logger(ctx).Error("record risk case resolution", "case_id", id, "error", err)
+		}
+	}
+	logger(ctx).Info("risk case resolved", "case_id", id, "status", caseStatus, "actor", res.Actor)
+	if txErr != nil {
+		status, resp := errorResponse(status, txErr)
+		resp.CaseID = id
+		writeJSON(w, status, resp)
+		return
+	}
+	// the original caller only got 202; it learns the outcome from
+	// GET /operations/{id}
+	s.markJournal(ctx, req.OperationID, journalResponded, "")
+	resp.CaseID, resp.raw = id, nil
+	writeJSON(w, status, resp)
+}
+
+var errCaseNotOpen = errors.New("case is not an open review")
+
+// caseApproval is the review case a transfer releases.
+type caseApproval struct {
+	id          int64
+	actor, note string
+}
+
+// approveCase resolves the case of an approved transfer in the transfer's
+// transaction. The case must still be open: when two reviewers approve at
+// once, the second waits on the row and then fails, rolling its transfer
+// back.
+func approveCase(ctx context.Context, tx pgx.Tx, a *caseApproval) (int, error) {
+	tag, err := tx.Exec(ctx, `
+		UPDATE risk_cases SET status='approved', resolved_by=$2, resolution=$3, resolved_at=now()
+		WHERE id=$1 AND status='open'`, a.id, a.actor, a.note)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("approve case: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return http.StatusConflict, errCaseNotOpen
+	}
+	return http.StatusOK, nil
+}
+
+func (s *Store) handleRejectCase(w http.ResponseWriter, r *http.Request) {
+	id, res, ok := decodeResolution(w, r)
+	if !ok {
+		return
+	}
+	var operationID *string
+	err := s.pool.QueryRow(r.Context(), `
+		UPDATE risk_cases SET status='rejected', resolved_by=$2, resolution=$3, resolved_at=now()
+		WHERE id=$1 AND status='open'
+		RETURNING operation_id`, id, res.Actor, res.Note).Scan(&operationID)
+	if err == pgx.ErrNoRows {
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: "case is not open"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to update case", http.StatusInternalServerError)
+		return
+	}
+	if operationID != nil {
+		s.markJournal(r.Context(), *operationID, journalFailed, "rejected in manual review")
+	}
+	logger(r.Context()).Info("risk case resolved", "case_id", id, "status", "rejected", "actor", res.Actor)
+	writeJSON(w, http.StatusOK, TransferResponse{Status: "ok", Message: "case rejected", CaseID: id})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A process runs one or more roles, so the latency-sensitive API can be
+// scaled separately from background work while shipping a single binary and
+// config. "all" keeps the single-process deployment.
+const (
+	roleAPI       = "api"       // public HTTP API, risk rules, journal recovery
+	roleWorker    = "worker"    // background job queue
+	roleScheduler = "scheduler" // periodic sweeps and operator schedules
+	roleRelay     = "relay"     // outbound delivery: the outbox to Kafka, webhooks
+)
+
+var knownRoles = []string{roleAPI, roleWorker, roleScheduler, roleRelay}
+
+type roleSet map[string]bool
+
+// parseRoles accepts a comma-separated list of roles or "all".
+func parseRoles(v string) (roleSet, error) {
+	set := roleSet{}
+	for _, r := range strings.Split(v, ",") {
+		r = strings.ToLower(strings.TrimSpace(r))
+		if r == "all" {
+			for _, k := range knownRoles {
+				set[k] = true
+			}
+			continue
+		}
+		known := false
+		for _, k := range knownRoles {
+			known = known || k == r
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown role %q (want %s or all)", r, strings.Join(knownRoles, ", "))
+		}
+		set[r] = true
+	}
+	return set, nil
+}
+
+func (rs roleSet) String() string {
+	names := make([]string, 0, len(rs))
+	for r := range rs {
+		names = append(names, r)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
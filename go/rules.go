@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ruleSet is one immutable, versioned revision of the monitoring rules.
+type ruleSet struct {
+	Version int
+	Source  string
+	Rules   []dslRule
+}
+
+// dslEngine evaluates the active rule set as one stage of the risk pipeline.
+// The active revision lives in rule_sets and is swapped atomically when an
+// admin activates another version, here or on another replica.
+type dslEngine struct {
+	current atomic.Pointer[ruleSet]
+	// tenants may pin a tenant to another revision; pinned holds those
+	// revisions parsed, keyed by version. Revisions are immutable, so the
+	// cache never needs invalidating.
+	tenants *tenantConfigs
+	mu      sync.Mutex
+	pinned  map[int]*ruleSet
+}
+
+func (e *dslEngine) Name() string { return "rules" }
+
+// Evaluate runs the rules that can be decided before the transfer
+// transaction; Check runs the pre-commit ones inside it.
+func (e *dslEngine) Evaluate(ctx context.Context, db querier, in riskInput) (riskOutcome, error) {
+	return e.evaluate(ctx, db, in, false)
+}
+
+func (e *dslEngine) Check(ctx context.Context, tx pgx.Tx, in riskInput) (riskOutcome, error) {
+	return e.evaluate(ctx, tx, in, true)
+}
+
+func (e *dslEngine) evaluate(ctx context.Context, db querier, in riskInput, precommit bool) (riskOutcome, error) {
+	set := e.current.Load()
+	if e.tenants != nil && e.tenants.pinnedRuleSets() {
+		var tenant string
+		err := db.QueryRow(ctx, "SELECT tenant_id FROM accounts WHERE id=$1", in.Req.FromAccountID).Scan(&tenant)
+		if err != nil && err != pgx.ErrNoRows {
+			return riskOutcome{}, err
+		}
+		if v := e.tenants.effective(tenant).RuleSetVersion; v != nil {
+			if set, err = e.revision(ctx, db, *v); err != nil {
+				return riskOutcome{}, err
+			}
+		}
+	}
+	if set == nil {
+		return riskOutcome{Decision: riskAllow}, nil
+	}
+	var rules []dslRule
+	for _, r := range set.Rules {
+		if r.precommit == precommit {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return riskOutcome{Decision: riskAllow}, nil
+	}
+	stage := &ruleSet{Version: set.Version, Source: set.Source, Rules: rules}
+	vars, err := loadRuleVars(ctx, dbAccountLookup(db), dbHistoryLookup(db), rules, in.Req, in.Meta, time.Now())
+	if err != nil {
+		return riskOutcome{}, err
+	}
+	out, matched := evaluateRuleSet(stage, vars)
+	for _, name := range matched {
+		dslRuleHits.WithLabelValues(name, strconv.Itoa(set.Version)).Inc()
+	}
+	return out, nil
+}
+
+// evaluateRuleSet returns the most severe matching rule as the outcome, plus
+// the names of every rule that matched.
+func evaluateRuleSet(set *ruleSet, vars map[string]any) (riskOutcome, []string) {
+	out := riskOutcome{Decision: riskAllow}
+	var matched []string
+	for _, rule := range set.Rules {
+		if hit, _ := evalDSL(rule.expr, vars).(bool); !hit {
+			continue
+		}
+		matched = append(matched, rule.Name)
+		if riskSeverity(rule.Action) > riskSeverity(out.Decision) {
+			out.Decision = rule.Action
+			out.Rule = rule.Name
+			out.Reason = fmt.Sprintf("rule %s (v%d): %s", rule.Name, set.Version, rule.Source)
+		}
+	}
+	if len(matched) > 0 {
+		out.Details = map[string]any{"version": set.Version, "matched": matched}
+	}
+	return out, matched
+}
+
+type accountAttrs struct {
+	Balance Money
+	Created time.Time
+}
+
+// accountLookup returns the attributes of an account, or nil when it does
+// not exist.
+type accountLookup func(ctx context.Context, id string) (*accountAttrs, error)
+
+func dbAccountLookup(db querier) accountLookup {
+	return func(ctx context.Context, id string) (*accountAttrs, error) {
+		var a accountAttrs
+		err := db.QueryRow(ctx, "SELECT balance, created_at FROM accounts WHERE id=$1", id).Scan(&a.Balance, &a.Created)
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &a, nil
+	}
+}
+
+// senderHistory is what the history variables know of the source's
+// earlier transfers. Balance adjustments are not transfers the source
+// made and are left out.
+type senderHistory struct {
+	Last1m, Last1h, Last24h int
+	// PaidBefore is whether the source has paid the destination before.
+	PaidBefore bool
+}
+
+// historyLookup returns the source's transfers before at.
+type historyLookup func(ctx context.Context, from, to string, at time.Time) (senderHistory, error)
+
+func dbHistoryLookup(db querier) historyLookup {
+	return func(ctx context.Context, from, to string, at time.Time) (senderHistory, error) {
+		var h senderHistory
+		err := db.QueryRow(ctx, `
+			SELECT count(*) FILTER (WHERE created_at > $3 - interval '1 minute'),
+				count(*) FILTER (WHERE created_at > $3 - interval '1 hour'),
+				count(*),
+				EXISTS (SELECT 1 FROM transfers WHERE from_account_id=$1 AND to_account_id=$2 AND created_at < $3)
+			FROM transfers
+			WHERE from_account_id=$1 AND created_at > $3 - interval '24 hours' AND created_at < $3 AND to_account_id <> $4`,
+			from, to, at, adjustmentsAccountID).Scan(&h.Last1m, &h.Last1h, &h.Last24h, &h.PaidBefore)
+		return h, err
+	}
+}
+
+// loadRuleVars builds the variables a rule set may reference for a
+// transfer happening at at. Account attributes and the source's history
+// are only looked up when a rule needs them.
+func loadRuleVars(ctx context.Context, lookup accountLookup, history historyLookup, rules []dslRule, req TransferRequest, meta requestMeta, at time.Time) (map[string]any, error) {
+	vars := map[string]any{
+		"amount": req.Amount.Float(),
+		"from":   req.FromAccountID,
+		"to":     req.ToAccountID,
+		"hour":   float64(at.UTC().Hour()),
+	}
+	for name, v := range map[string]string{"client": meta.Client, "tenant": meta.Tenant, "ip": meta.IP} {
+		if v != "" {
+			vars[name] = v
+		}
+	}
+	if req.Geo != nil && req.Geo.Country != "" {
+		vars["country"] = strings.ToUpper(req.Geo.Country)
+	}
+	for prefix, id := range map[string]string{"account.": req.FromAccountID, "dest.": req.ToAccountID} {
+		if !ruleSetUses(rules, prefix+"balance") && !ruleSetUses(rules, prefix+"age_days") {
+			continue
+		}
+		a, err := lookup(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("load %s attributes: %w", strings.TrimSuffix(prefix, "."), err)
+		}
+		if a == nil {
+			continue
+		}
+		vars[prefix+"balance"] = a.Balance.Float()
+		vars[prefix+"age_days"] = at.Sub(a.Created).Hours() / 24
+	}
+	if slices.ContainsFunc(rules, func(r dslRule) bool { return r.precommit }) {
+		h, err := history(ctx, req.FromAccountID, req.ToAccountID, at)
+		if err != nil {
+			return nil, fmt.Errorf("load transfer history: %w", err)
+		}
+		vars["account.transfers_1m"] = float64(h.Last1m)
+		vars["account.transfers_1h"] = float64(h.Last1h)
+		vars["account.transfers_24h"] = float64(h.Last24h)
+		vars["dest.new"] = !h.PaidBefore
+	}
+	return vars, nil
+}
+
+// revision returns a parsed rule set by version, for tenants pinned to one.
+func (e *dslEngine) revision(ctx context.Context, db querier, version int) (*ruleSet, error) {
+	if cur := e.current.Load(); cur != nil && cur.Version == version {
+		return cur, nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if set, ok := e.pinned[version]; ok {
+		return set, nil
+	}
+	var source string
+	if err := db.QueryRow(ctx, "SELECT source FROM rule_sets WHERE version=$1", version).Scan(&source); err != nil {
+		return nil, fmt.Errorf("rule set v%d: %w", version, err)
+	}
+	rules, err := parseRuleSet(source)
+	if err != nil {
+		return nil, fmt.Errorf("rule set v%d: %w", version, err)
+	}
+	if e.pinned == nil {
+		e.pinned = map[int]*ruleSet{}
+	}
+	set := &ruleSet{Version: version, Source: source, Rules: rules}
+	e.pinned[version] = set
+	return set, nil
+}
+
+// loadActive swaps in the active rule set when its version changed.
+func (e *dslEngine) loadActive(ctx context.Context, db querier) error {
+	var (
+		version int
+		source  string
+	)
+	err := db.QueryRow(ctx, "SELECT version, source FROM rule_sets WHERE active").Scan(&version, &source)
+	if err == pgx.ErrNoRows {
+		e.current.Store(nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if cur := e.current.Load(); cur != nil && cur.Version == version {
+		return nil
+	}
+	rules, err := parseRuleSet(source)
+	if err != nil {
+		return fmt.Errorf("rule set v%d: %w", version, err)
+	}
+	e.current.Store(&ruleSet{Version: version, Source: source, Rules: rules})
+	rulesetVersion.Set(float64(version))
+	slog.Info("risk rules active", "version", version, "rules", len(rules))
+	return nil
+}
+
+// watch keeps the engine in sync with activations made on other replicas.
+func (e *dslEngine) watch(ctx context.Context, db querier, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := e.loadActive(ctx, db); err != nil {
+				slog.Error("refresh risk rules", "error", err)
+			}
+		}
+	}
+}
+
+// bootstrapRules seeds rule_sets from RULES_FILE when no version is active
+// yet, so a fresh deployment can ship its rules as config.
+func (s *Store) bootstrapRules(ctx context.Context) error {
+	path := os.Getenv("RULES_FILE")
+	if path == "" {
+		return s.rules.loadActive(ctx, s.pool)
+	}
+	var active bool
+	if err := s.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM rule_sets WHERE active)").Scan(&active); err != nil {
+		return err
+	}
+	if !active {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if _, err := s.createRuleSet(ctx, string(raw), "config:"+path, true); err != nil {
+			return err
+		}
+	}
+	return s.rules.loadActive(ctx, s.pool)
+}
+
+// createRuleSet validates and stores a new revision, optionally activating
+// it in the same transaction.
+func (s *Store) createRuleSet(ctx context.Context, source, actor string, activate bool) (int, error) {
+	if _, err := parseRuleSet(source); err != nil {
+		return 0, err
+	}
+	tx, err := s.beginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	var version int
+	if err := tx.QueryRow(ctx, "INSERT INTO rule_sets (source, created_by) VALUES ($1, $2) RETURNING version", source, actor).Scan(&version); err != nil {
+		return 0, err
+	}
+	if activate {
+		if err := activateRuleSet(ctx, tx, version, actor); err != nil {
+			return 0, err
+		}
+	}
+	return version, tx.Commit(ctx)
+}
+
+func activateRuleSet(ctx context.Context, tx pgx.Tx, version int, actor string) error {
+	if _, err := tx.Exec(ctx, "UPDATE rule_sets SET active=false WHERE active"); err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, "UPDATE rule_sets SET active=true, activated_by=$2, activated_at=now() WHERE version=$1", version, actor)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+type ruleSetView struct {
+	Version     int        `json:"version"`
+	Source      string     `json:"source"`
+	Active      bool       `json:"active"`
+	CreatedBy   string     `json:"createdBy"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ActivatedBy *string    `json:"activatedBy,omitempty"`
+	ActivatedAt *time.Time `json:"activatedAt,omitempty"`
+}
+
+func (s *Store) handleListRuleSets(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.pool.Query(r.Context(), `
+		SELECT version, source, active, created_by, created_at, activated_by, activated_at
+		FROM rule_sets ORDER BY version DESC LIMIT 50`)
+	if err != nil {
+		http.Error(w, "failed to load rule sets", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	sets := make([]ruleSetView, 0)
+	for rows.Next() {
+		var v ruleSetView
+		if err := rows.Scan(&v.Version, &v.Source, &v.Active, &v.CreatedBy, &v.CreatedAt, &v.ActivatedBy, &v.ActivatedAt); err != nil {
+			http.Error(w, "failed to parse rule sets", http.StatusInternalServerError)
+			return
+		}
+		sets = append(sets, v)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ruleSets": sets, "variables": ruleVariables})
+}
+
+type ruleSetRequest struct {
+	Source   string `json:"source"`
+	Actor    string `json:"actor"`
+	Activate bool   `json:"activate"`
+}
+
+func (s *Store) handleCreateRuleSet(w http.ResponseWriter, r *http.Request) {
+	var req ruleSetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	if _, err := parseRuleSet(req.Source); err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	version, err := s.createRuleSet(r.Context(), req.Source, req.Actor, req.Activate)
+	if err != nil {
+		http.Error(w, "failed to store rule set", http.StatusInternalServerError)
+		return
+	}
+	if req.Activate {
+		if err := s.rules.loadActive(r.Context(), s.pool); err != nil {
+			slog.Error("load risk rules", "version", version, "error", err)
+		}
+	}
+	slog.Info("risk rules created", "version", version, "actor", req.Actor, "activate", req.Activate)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"version": version, "active": req.Activate})
+}
+
+func (s *Store) handleActivateRuleSet(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return
+	}
+	var req ruleSetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	tx, err := s.beginTx(r.Context(), pgx.TxOptions{})
+	if err != nil {
+		http.Error(w, "failed to start tx", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context())
+	if err := activateRuleSet(r.Context(), tx, version, req.Actor); err != nil {
+		if err == pgx.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "rule set not found"})
+			return
+		}
+		http.Error(w, "failed to activate rule set", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(r.Context()); err != nil {
+		http.Error(w, "failed to activate rule set", http.StatusInternalServerError)
+		return
+	}
+	if err := s.rules.loadActive(r.Context(), s.pool); err != nil {
+		slog.Error("load risk rules", "version", version, "error", err)
+	}
+	slog.Info("risk rules activated", "version", version, "actor", req.Actor)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"version": version, "active": true})
+}
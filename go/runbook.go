@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Runbook actions are the incident steps on-call used to run by hand with
+// kubectl exec and SQL, exposed under /admin/runbook so they need the admin
+// scope. Each one takes an actor and a reason and is recorded in
+// runbook_actions in the same transaction as its effect.
+//
+// Cluster-wide switches (scheduler paused, read-only) live in
+// runtime_flags. The replica flipping one applies it at once; the others
+// pick it up on their next refresh (RUNTIME_FLAGS_REFRESH_INTERVAL).
+//
+// There is no outbound delivery queue yet (the relay role has nothing to
+// relay), so draining it is not an action here; the failed-job queue is the
+// dead-letter queue that can be requeued.
+
+const (
+	flagSchedulerPaused = "scheduler_paused"
+	flagReadOnly        = "read_only"
+)
+
+type runtimeFlags struct {
+	schedulerPaused atomic.Bool
+	readOnly        atomic.Bool
+}
+
+func (f *runtimeFlags) set(name string, enabled bool) {
+	switch name {
+	case flagSchedulerPaused:
+		f.schedulerPaused.Store(enabled)
+	case flagReadOnly:
+		f.readOnly.Store(enabled)
+	}
+}
+
+func (f *runtimeFlags) load(ctx context.Context, db *pgxpool.Pool) error {
+	rows, err := db.Query(ctx, "SELECT name, enabled FROM runtime_flags")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	seen := map[string]bool{}
+	for rows.Next() {
+		var (
+			name    string
+			enabled bool
+		)
+		if err := rows.Scan(&name, &enabled); err != nil {
+			return err
+		}
+		seen[name] = enabled
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, name := range []string{flagSchedulerPaused, flagReadOnly} {
+		f.set(name, seen[name])
+	}
+	return nil
+}
+
+func (f *runtimeFlags) watch(ctx context.Context, db *pgxpool.Pool, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.load(ctx, db); err != nil {
+				slog.Error("refresh runtime flags", "error", err)
+			}
+		}
+	}
+}
+
+// withReadOnly rejects writes while the service is read-only. Admin routes
+// stay writable so the flag can be turned off again and incidents worked.
+func withReadOnly(flags *runtimeFlags, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if flags.readOnly.Load() && !strings.HasPrefix(unversionedPath(r.URL.Path), "/admin/") {
+				w.Header().Set("Retry-After", "60")
+				writeJSON(w, http.StatusServiceUnavailable, TransferResponse{Status: "error", Message: "service is read-only for maintenance"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type runbookRequest struct {
+	Actor  string `json:"actor"`
+	Reason string `json:"reason"`
+}
+
+func (req runbookRequest) validate() string {
+	if req.Actor == "" || req.Reason == "" {
+		return "actor and reason are required"
+	}
+	return ""
+}
+
+// decodeRunbook decodes the request body into v and checks the actor and
+// reason; it writes the error response itself and reports whether to go on.
+func decodeRunbook(w http.ResponseWriter, r *http.Request, v any, req *runbookRequest) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return false
+	}
+	if msg := req.validate(); msg != "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: msg})
+		return false
+	}
+	return true
+}
+
+func recordRunbookAction(ctx context.Context, db execer, action, target string, req runbookRequest, detail map[string]any) error {
+	raw, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, `
+		INSERT INTO runbook_actions (action, target, actor, reason, detail) VALUES ($1, $2, $3, $4, $5)`,
+		action, target, req.Actor, req.Reason, raw)
+	return err
+}
+
+// afterRunbook logs a completed action and emits its event.
+func (s *Store) afterRunbook(ctx context.Context, action, target string, req runbookRequest, detail map[string]any) {
+	logger(ctx).Warn("runbook action", "action", action, "target", target, "actor", req.Actor, "reason", req.Reason)
+	payload := map[string]any{"actor": req.Actor, "reason": req.Reason}
+	for k, v := range detail {
+		payload[k] = v
+	}
+	if err := s.recordEvent(ctx, "runbook."+action, target, payload); err != nil {
+		logger(ctx).Warn("record runbook event", "action", action, "error", err)
+	}
+}
+
+func (s *Store) setFlag(ctx context.Context, name string, enabled bool, req runbookRequest) error {
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO runtime_flags (name, enabled, updated_by, reason, updated_at) VALUES ($1, $2, $3, $4, now())
+			ON CONFLICT (name) DO UPDATE SET enabled=EXCLUDED.enabled, updated_by=EXCLUDED.updated_by, reason=EXCLUDED.reason, updated_at=now()`,
+			name, enabled, req.Actor, req.Reason); err != nil {
+			return err
+		}
+		return recordRunbookAction(ctx, tx, "set_flag", "flag/"+name, req, map[string]any{"enabled": enabled})
+	})
+	if err != nil {
+		return err
+	}
+	s.flags.set(name, enabled)
+	s.afterRunbook(ctx, "set_flag", "flag/"+name, req, map[string]any{"enabled": enabled})
+	return nil
+}
+
+// handleSetFlag serves the pause/resume and read-only switches; the flag
+// and value are fixed per route.
+func (s *Store) handleSetFlag(name string, enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req runbookRequest
+		if !decodeRunbook(w, r, &req, &req) {
+			return
+		}
+		if err := s.setFlag(r.Context(), name, enabled, req); err != nil {
+			http.Error(w, "failed to set flag", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"flag": name, "enabled": enabled})
+	}
+}
+
+var errNotInDoubt = errors.New("operation is not in doubt")
+
+// handleForceCloseOperation resolves an operation stuck in the journal
+// without waiting for journal recovery on the next boot. It resolves the
+// same way recovery does: an operation that committed is marked recovered
+// and its operationId processed, anything earlier is aborted so the client
+// can retry. The operation lock is taken first, so an operation still
+// executing somewhere is refused rather than closed under it.
+func (s *Store) handleForceCloseOperation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	var req runbookRequest
+	if !decodeRunbook(w, r, &req, &req) {
+		return
+	}
+	unlock, err := s.lockOperation(ctx, id)
+	if errors.Is(err, errOperationInFlight) {
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: "operation is still executing"})
+		return
+	}
+	if errors.Is(err, errLocksBusy) {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to lock operation", http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
+	var from, to string
+	err = s.beginFunc(ctx, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, "SELECT state FROM op_journal WHERE operation_id=$1 FOR UPDATE", id).Scan(&from); err != nil {
+			return err
+		}
+		switch from {
+		case journalCommitted:
+			to = journalRecovered
+			if _, err := tx.Exec(ctx, "INSERT INTO processed_ops (operation_id) VALUES ($1) ON CONFLICT DO NOTHING", id); err != nil {
+				return err
+			}
+			if err := journalMark(ctx, tx, id, to, nil, ""); err != nil {
+				return err
+			}
+		case journalReceived, journalExecuting:
+			to = journalAborted
+			if err := journalMark(ctx, tx, id, to, nil, "force-closed by "+req.Actor+": "+req.Reason); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w (state %s)", errNotInDoubt, from)
+		}
+		return recordRunbookAction(ctx, tx, "force_close_operation", "operation/"+id, req, map[string]any{"from": from, "to": to})
+	})
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "operation not found"})
+		return
+	case errors.Is(err, errNotInDoubt):
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	case err != nil:
+		http.Error(w, "failed to close operation", http.StatusInternalServerError)
+		return
+	}
+	journalRecoveries.WithLabelValues(from).Inc()
+	s.afterRunbook(ctx, "force_close_operation", "operation/"+id, req, map[string]any{"from": from, "to": to})
+	writeJSON(w, http.StatusOK, map[string]any{"operationId": id, "from": from, "state": to})
+}
+
+type requeueJobsRequest struct {
+	runbookRequest
+	JobIDs []int64 `json:"jobIds"`
+	Type   string  `json:"type"`
+}
+
+// handleRequeueFailedJobs puts failed jobs back on the queue, either the
+// listed ones or every failed job of a type. Handlers are rerun from the
+// start, which they are written to tolerate.
+func (s *Store) handleRequeueFailedJobs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req requeueJobsRequest
+	if !decodeRunbook(w, r, &req, &req.runbookRequest) {
+		return
+	}
+	if len(req.JobIDs) == 0 && req.Type == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "jobIds or type is required"})
+		return
+	}
+	var ids []int64
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			UPDATE jobs SET status=$1, total=0, processed=0, result=NULL, error=NULL, started_at=NULL, finished_at=NULL
+			WHERE status=$2 AND ($3::bigint[] IS NULL OR id = ANY($3)) AND ($4 = '' OR type = $4)
+			RETURNING id`, jobQueued, jobFailed, req.JobIDs, req.Type)
+		if err != nil {
+			return err
+		}
+		if ids, err = pgx.CollectRows(rows, pgx.RowTo[int64]); err != nil {
+			return err
+		}
+		return recordRunbookAction(ctx, tx, "requeue_failed_jobs", "jobs", req.runbookRequest, map[string]any{"jobIds": ids, "type": req.Type})
+	})
+	if err != nil {
+		http.Error(w, "failed to requeue jobs", http.StatusInternalServerError)
+		return
+	}
+	s.afterRunbook(ctx, "requeue_failed_jobs", "jobs", req.runbookRequest, map[string]any{"jobIds": ids, "type": req.Type})
+	writeJSON(w, http.StatusOK, map[string]any{"requeued": ids})
+}
+
+// handleRunbookState is the first thing to look at during an incident: the
+// switches as this replica sees them and what is stuck.
+func (s *Store) handleRunbookState(w http.ResponseWriter, r *http.Request) {
+	var inDoubt, failedJobs int64
+	if err := s.pool.QueryRow(r.Context(), `
+		SELECT (SELECT count(*) FROM op_journal WHERE state = ANY($1)),
+			(SELECT count(*) FROM jobs WHERE status=$2)`,
+		[]string{journalReceived, journalExecuting, journalCommitted}, jobFailed).Scan(&inDoubt, &failedJobs); err != nil {
+		http.Error(w, "failed to load state", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"schedulerPaused":     s.flags.schedulerPaused.Load(),
+		"readOnly":            s.flags.readOnly.Load(),
+		"operationsInDoubt":   inDoubt,
+		"failedJobs":          failedJobs,
+		"flagRefreshInterval": durationOrDefault("RUNTIME_FLAGS_REFRESH_INTERVAL", 5*time.Second).String(),
+	})
+}
+
+type runbookAction struct {
+	ID     int64           `json:"id"`
+	Action string          `json:"action"`
+	Target string          `json:"target"`
+	Actor  string          `json:"actor"`
+	Reason string          `json:"reason"`
+	Detail json.RawMessage `json:"detail"`
+	At     time.Time       `json:"at"`
+}
+
+// handleRunbookActions lists recorded actions, newest first.
+func (s *Store) handleRunbookActions(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.pool.Query(r.Context(), `
+		SELECT id, action, target, actor, reason, detail, at FROM runbook_actions ORDER BY id DESC LIMIT 200`)
+	if err != nil {
+		http.Error(w, "failed to load actions", http.StatusInternalServerError)
+		return
+	}
+	actions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (runbookAction, error) {
+		var a runbookAction
+		err := row.Scan(&a.ID, &a.Action, &a.Target, &a.Actor, &a.Reason, &a.Detail, &a.At)
+		return a, err
+	})
+	if err != nil {
+		http.Error(w, "failed to load actions", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, actions)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"fintech-go/internal/ledger"
+)
+
+// Tenants with "sandbox": true in their configuration can wipe their own
+// state between test suites with POST /admin/sandbox/reset. In one
+// transaction the reset deletes the caller's tenant's accounts with their
+// ledger entries (archived ones included), transfers, receipts, reversals,
+// journal entries and everything hanging off the accounts (sweeps, virtual
+// accounts, scheduled transfers, pending webhooks...) and stops its test
+// clock, then opens the accounts of the chosen fixture profile.
+// Configuration stays: tenant
+// overrides, API keys, templates and tenant-wide webhook subscriptions
+// survive a reset.
+//
+// Only self-contained tenants can be reset. A transfer with an account
+// outside the tenant (a payout through settlement, a fee credited to FEES)
+// has entries in someone else's hash chain, which deleting would break, so
+// the reset is refused while the tenant has any. Sandbox entries sealed
+// into a Merkle root stop verifying once a reset removes them; sandbox
+// tenants belong on deployments whose roots nobody relies on.
+//
+// Fixture accounts are named <tenant>-<name> so profiles can be loaded by
+// several tenants, and open with their fixture balance as opening balance,
+// which keeps balance reconciliation clean without ledger entries.
+
+type sandboxAccount struct {
+	Name        string
+	DisplayName string
+	Balance     string
+	Overdraft   string
+	Status      string
+}
+
+// sandboxProfiles are the fixture profiles a reset can load.
+var sandboxProfiles = map[string][]sandboxAccount{
+	"empty": nil,
+	"basic": {
+		{Name: "alice", DisplayName: "Alice", Balance: "1000", Status: accountActive},
+		{Name: "bob", DisplayName: "Bob", Balance: "500", Status: accountActive},
+	},
+	// edge cases partners test rejections against
+	"edge-cases": {
+		{Name: "alice", DisplayName: "Alice", Balance: "1000", Status: accountActive},
+		{Name: "empty", DisplayName: "Zero balance", Balance: "0", Status: accountActive},
+		{Name: "overdraft", DisplayName: "Overdraft allowed", Balance: "0", Overdraft: "200", Status: accountActive},
+		{Name: "frozen", DisplayName: "Frozen", Balance: "300", Status: accountFrozen},
+	},
+}
+
+type sandboxResetRequest struct {
+	// Profile names the fixture profile to load; "basic" when omitted.
+	Profile string `json:"profile,omitempty"`
+	Actor   string `json:"actor"`
+}
+
+type sandboxRemoved struct {
+	Accounts      int64 `json:"accounts"`
+	Transfers     int64 `json:"transfers"`
+	LedgerEntries int64 `json:"ledgerEntries"`
+	Operations    int64 `json:"operations"`
+}
+
+type sandboxResetResult struct {
+	TenantID string         `json:"tenantId"`
+	Profile  string         `json:"profile"`
+	Removed  sandboxRemoved `json:"removed"`
+	Accounts []Account      `json:"accounts"`
+}
+
+var errSandboxNotIsolated = errors.New("tenant has transfers with accounts outside it")
+
+// sandboxCleanup deletes what hangs off the tenant's accounts and
+// transfers, children first. $1 is the tenant; sandbox_accounts and
+// sandbox_transfers hold the ids being removed.
+var sandboxCleanup = []string{
+	"DELETE FROM transfer_receipts WHERE transfer_id IN (SELECT id FROM sandbox_transfers)",
+	"DELETE FROM transfer_reversals WHERE transfer_id IN (SELECT id FROM sandbox_transfers) OR reversal_id IN (SELECT id FROM sandbox_transfers)",
+	"DELETE FROM payout_returns WHERE transfer_id IN (SELECT id FROM sandbox_transfers)",
+	"DELETE FROM ledger_archive WHERE account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM risk_cases WHERE account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM suspense_items WHERE account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM sweep_rules WHERE account_id IN (SELECT id FROM sandbox_accounts) OR linked_account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM virtual_accounts WHERE account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM scheduled_transfers WHERE tenant_id = $1 OR from_account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM standing_orders WHERE tenant_id = $1 OR from_account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM transfer_quotes WHERE from_account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM holds WHERE account_id IN (SELECT id FROM sandbox_accounts) OR to_account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM overdraft_limit_changes WHERE account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM account_status_changes WHERE account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM reconciliation_issues WHERE account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM export_chunks WHERE export_id IN (SELECT id FROM exports WHERE account_id IN (SELECT id FROM sandbox_accounts))",
+	"DELETE FROM exports WHERE account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM webhook_attempts WHERE delivery_id IN (SELECT id FROM webhook_deliveries WHERE tenant_id = $1)",
+	"DELETE FROM webhook_deliveries WHERE tenant_id = $1",
+	"DELETE FROM webhook_subscriptions WHERE account_id IN (SELECT id FROM sandbox_accounts)",
+	"DELETE FROM tenant_clocks WHERE tenant_id = $1",
+}
+
+func (s *Store) handleSandboxReset(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req sandboxResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	if req.Profile == "" {
+		req.Profile = "basic"
+	}
+	profile, ok := sandboxProfiles[req.Profile]
+	if !ok {
+		names := make([]string, 0, len(sandboxProfiles))
+		for name := range sandboxProfiles {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "unknown profile; want one of " + strings.Join(names, ", ")})
+		return
+	}
+	tenant, ok := s.sandboxTenant(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := s.resetSandbox(ctx, tenant, req.Profile, profile)
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, errSandboxNotIsolated):
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: err.Error() + "; it cannot be reset"})
+		return
+	case errors.As(err, &pgErr) && pgErr.Code == "23505":
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: "a fixture account id is taken by another tenant"})
+		return
+	case err != nil:
+		logger(ctx).Error("sandbox reset failed", "tenant_id", tenant, "error", err)
+		http.Error(w, "failed to reset sandbox", http.StatusInternalServerError)
+		return
+	}
+	if err := s.clocks.load(ctx, s.pool); err != nil {
+		logger(ctx).Error("reload tenant clocks", "error", err)
+	}
+	s.cache.accounts.purge()
+	s.cache.aliases.purge()
+	logger(ctx).Info("sandbox reset", "tenant_id", tenant, "profile", req.Profile, "actor", req.Actor,
+		"accounts", res.Removed.Accounts, "transfers", res.Removed.Transfers)
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Store) resetSandbox(ctx context.Context, tenant, name string, profile []sandboxAccount) (sandboxResetResult, error) {
+	res := sandboxResetResult{TenantID: tenant, Profile: name, Accounts: []Account{}}
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		// one reset per tenant at a time; the row locks wait out transfers
+		// in flight on the tenant's accounts
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('sandbox_reset/' || $1))", tenant); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `
+			CREATE TEMP TABLE sandbox_accounts (id TEXT PRIMARY KEY) ON COMMIT DROP;
+			CREATE TEMP TABLE sandbox_transfers (id BIGINT PRIMARY KEY, operation_id TEXT, from_account_id TEXT, to_account_id TEXT) ON COMMIT DROP`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "INSERT INTO sandbox_accounts SELECT id FROM accounts WHERE tenant_id = $1 ORDER BY id FOR UPDATE", tenant); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO sandbox_transfers SELECT id, operation_id, from_account_id, to_account_id FROM transfers
+			WHERE from_account_id IN (SELECT id FROM sandbox_accounts) OR to_account_id IN (SELECT id FROM sandbox_accounts)`); err != nil {
+			return err
+		}
+		var outside bool
+		if err := tx.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM sandbox_transfers
+				WHERE from_account_id NOT IN (SELECT id FROM sandbox_accounts) OR to_account_id NOT IN (SELECT id FROM sandbox_accounts))`).
+			Scan(&outside); err != nil {
+			return err
+		}
+		if outside {
+			return errSandboxNotIsolated
+		}
+
+		for _, stmt := range sandboxCleanup {
+			args := []any{}
+			if strings.Contains(stmt, "$1") {
+				args = append(args, tenant)
+			}
+			if _, err := tx.Exec(ctx, stmt, args...); err != nil {
+				return fmt.Errorf("%s: %w", strings.Fields(stmt)[2], err)
+			}
+		}
+		tag, err := tx.Exec(ctx, "DELETE FROM ledger WHERE account_id IN (SELECT id FROM sandbox_accounts)")
+		if err != nil {
+			return err
+		}
+		res.Removed.LedgerEntries = tag.RowsAffected()
+		tag, err = tx.Exec(ctx, `
+			DELETE FROM op_journal WHERE operation_id IN (SELECT operation_id FROM sandbox_transfers)
+				OR request->>'fromAccountId' IN (SELECT id FROM sandbox_accounts)
+				OR request->>'toAccountId' IN (SELECT id FROM sandbox_accounts)`)
+		if err != nil {
+			return err
+		}
+		res.Removed.Operations = tag.RowsAffected()
+		if _, err := tx.Exec(ctx, "DELETE FROM processed_ops WHERE operation_id IN (SELECT operation_id FROM sandbox_transfers)"); err != nil {
+			return err
+		}
+		if tag, err = tx.Exec(ctx, "DELETE FROM transfers WHERE id IN (SELECT id FROM sandbox_transfers)"); err != nil {
+			return err
+		}
+		res.Removed.Transfers = tag.RowsAffected()
+		if tag, err = tx.Exec(ctx, "DELETE FROM accounts WHERE id IN (SELECT id FROM sandbox_accounts)"); err != nil {
+			return err
+		}
+		res.Removed.Accounts = tag.RowsAffected()
+
+		for _, f := range profile {
+			balance, err := ledger.ParseMoney(f.Balance, moneyExponent)
+			if err != nil {
+				return fmt.Errorf("fixture %s: %w", f.Name, err)
+			}
+			var overdraft Money
+			if f.Overdraft != "" {
+				if overdraft, err = ledger.ParseMoney(f.Overdraft, moneyExponent); err != nil {
+					return fmt.Errorf("fixture %s: %w", f.Name, err)
+				}
+			}
+			a, err := scanAccount(tx.QueryRow(ctx, `
+				INSERT INTO accounts (id, balance, opening_balance, tenant_id, display_name, status, currency, overdraft_limit)
+				VALUES ($1, $2, $2, $3, $4, $5, $6, $7)
+				RETURNING `+accountColumns, tenant+"-"+f.Name, balance, tenant, f.DisplayName, f.Status, serviceCurrency, overdraft))
+			if err != nil {
+				return err
+			}
+			res.Accounts = append(res.Accounts, a)
+		}
+		return nil
+	})
+	return res, err
+}
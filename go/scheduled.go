@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/ledger"
+)
+
+// A scheduled transfer is a one-off transfer the client asked to run at a
+// later time. The worker claims due rows and runs them through s.transfer,
+// so they are screened, journaled and fee-charged like a live request. Each
+// row gets the operation id "scheduled-transfer/<id>"; a worker that dies
+// after the transfer commits but before the row is updated leaves it due,
+// and the next attempt replays the stored result instead of paying twice.
+//
+// Failures the client cannot fix by waiting (insufficient funds, closed
+// accounts, blocked by a rule) fail the row at once; server errors and
+// contention are retried with exponential backoff up to
+// SCHEDULED_TRANSFER_MAX_ATTEMPTS. A transfer held for review is finished
+// by its risk case; GET /operations/{operationId} shows the outcome.
+
+const (
+	scheduledPending  = "scheduled"
+	scheduledRunning  = "running"
+	scheduledDone     = "succeeded"
+	scheduledReview   = "pending_review"
+	scheduledFailed   = "failed"
+	scheduledCanceled = "cancelled"
+)
+
+// scheduledClaimLease is how long a claimed row is hidden from other
+// workers; a worker that dies mid-run releases it when the lease runs out.
+const scheduledClaimLease = 5 * time.Minute
+
+type scheduledTransfer struct {
+	ID            int64      `json:"id"`
+	TenantID      string     `json:"tenantId"`
+	FromAccountID string     `json:"fromAccountId"`
+	ToAccountID   string     `json:"toAccountId"`
+	Amount        Money      `json:"amount"`
+	ExecuteAt     time.Time  `json:"executeAt"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+	LastError     *string    `json:"lastError,omitempty"`
+	OperationID   string     `json:"operationId"`
+	// StandingOrderID and Occurrence are set on executions of a standing
+	// order.
+	StandingOrderID *int64          `json:"standingOrderId,omitempty"`
+	Occurrence      *int            `json:"occurrence,omitempty"`
+	Response        json.RawMessage `json:"response,omitempty"`
+	CreatedBy       string          `json:"createdBy"`
+	CreatedAt       time.Time       `json:"createdAt"`
+	UpdatedAt       time.Time       `json:"updatedAt"`
+}
+
+const scheduledColumns = `id, tenant_id, from_account_id, to_account_id, amount, execute_at, status, attempts,
+	CASE WHEN status IN ('scheduled', 'running') THEN next_attempt_at END, last_error,
+	'scheduled-transfer/' || id, standing_order_id, occurrence, response, created_by, created_at, updated_at`
+
+func scanScheduledTransfer(row pgx.Row) (scheduledTransfer, error) {
+	var st scheduledTransfer
+	err := row.Scan(&st.ID, &st.TenantID, &st.FromAccountID, &st.ToAccountID, &st.Amount, &st.ExecuteAt, &st.Status, &st.Attempts,
+		&st.NextAttemptAt, &st.LastError, &st.OperationID, &st.StandingOrderID, &st.Occurrence, &st.Response, &st.CreatedBy, &st.CreatedAt, &st.UpdatedAt)
+	return st, err
+}
+
+type createScheduledTransferRequest struct {
+	FromAccountID string    `json:"fromAccountId"`
+	ToAccountID   string    `json:"toAccountId"`
+	Amount        Money     `json:"amount"`
+	ExecuteAt     time.Time `json:"executeAt"`
+}
+
+func (s *Store) handleCreateScheduledTransfer(w http.ResponseWriter, r *http.Request) {
+	var req createScheduledTransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if errors.Is(err, ledger.ErrTooPrecise) {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+			return
+		}
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if msg := validateTransfer(TransferRequest{FromAccountID: req.FromAccountID, ToAccountID: req.ToAccountID, Amount: req.Amount}); msg != "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: msg})
+		return
+	}
+	if req.ExecuteAt.IsZero() {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "executeAt is required"})
+		return
+	}
+	meta := metaFromRequest(r)
+	// funds and limits are checked when the transfer runs; only the
+	// accounts' existence and ownership are settled now
+	var tenant string
+	err := s.pool.QueryRow(r.Context(), "SELECT tenant_id FROM accounts WHERE id=$1", req.FromAccountID).Scan(&tenant)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "from account not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	if p := principalFromContext(r.Context()); p != nil && p.Tenant != "" && p.Tenant != tenant {
+		writeJSON(w, http.StatusForbidden, TransferResponse{Status: "error", Message: errOtherTenant.Error()})
+		return
+	}
+	st, err := scanScheduledTransfer(s.pool.QueryRow(r.Context(), `
+		INSERT INTO scheduled_transfers (tenant_id, from_account_id, to_account_id, amount, execute_at, next_attempt_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $5, $6) RETURNING `+scheduledColumns,
+		tenant, req.FromAccountID, req.ToAccountID, req.Amount, req.ExecuteAt, meta.Client))
+	if err != nil {
+		http.Error(w, "failed to schedule transfer", http.StatusInternalServerError)
+		return
+	}
+	logger(r.Context()).Info("transfer scheduled", "scheduled_transfer_id", st.ID, "from", st.FromAccountID, "to", st.ToAccountID,
+		"amount", st.Amount, "execute_at", st.ExecuteAt)
+	writeJSON(w, http.StatusCreated, st)
+}
+
+// handleListScheduledTransfers lists by ?accountId= (either side) and
+// ?status=, newest first.
+func (s *Store) handleListScheduledTransfers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "limit must be between 1 and 1000"})
+			return
+		}
+		limit = n
+	}
+	rows, err := s.pool.Query(r.Context(), `
+		SELECT `+scheduledColumns+` FROM scheduled_transfers
+		WHERE ($1 = '' OR from_account_id = $1 OR to_account_id = $1) AND ($2 = '' OR status = $2)
+		ORDER BY id DESC LIMIT $3`, q.Get("accountId"), q.Get("status"), limit)
+	if err != nil {
+		http.Error(w, "failed to list scheduled transfers", http.StatusInternalServerError)
+		return
+	}
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (scheduledTransfer, error) { return scanScheduledTransfer(row) })
+	if err != nil {
+		http.Error(w, "failed to list scheduled transfers", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Store) handleGetScheduledTransfer(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid scheduled transfer id", http.StatusBadRequest)
+		return
+	}
+	st, err := scanScheduledTransfer(s.pool.QueryRow(r.Context(),
+		"SELECT "+scheduledColumns+" FROM scheduled_transfers WHERE id=$1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "scheduled transfer not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load scheduled transfer", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// handleCancelScheduledTransfer cancels a transfer that has not started.
+// One already claimed by a worker may be mid-execution and cannot be
+// cancelled any more.
+func (s *Store) handleCancelScheduledTransfer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid scheduled transfer id", http.StatusBadRequest)
+		return
+	}
+	st, err := scanScheduledTransfer(s.pool.QueryRow(ctx, `
+		UPDATE scheduled_transfers SET status=$2, updated_at=now()
+		WHERE id=$1 AND status=$3 RETURNING `+scheduledColumns,
+		id, scheduledCanceled, scheduledPending))
+	if errors.Is(err, pgx.ErrNoRows) {
+		cur, err := scanScheduledTransfer(s.pool.QueryRow(ctx,
+			"SELECT "+scheduledColumns+" FROM scheduled_transfers WHERE id=$1", id))
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "scheduled transfer not found"})
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to cancel scheduled transfer", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: "scheduled transfer is " + cur.Status + " and can no longer be cancelled"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to cancel scheduled transfer", http.StatusInternalServerError)
+		return
+	}
+	logger(ctx).Info("scheduled transfer cancelled", "scheduled_transfer_id", st.ID)
+	writeJSON(w, http.StatusOK, st)
+}
+
+// runScheduledTransfers executes due transfers until ctx is cancelled,
+// draining everything due on each tick.
+func (s *Store) runScheduledTransfers(ctx context.Context, every time.Duration) {
+	maxAttempts := intOrDefault("SCHEDULED_TRANSFER_MAX_ATTEMPTS", 5)
+	backoff := durationOrDefault("SCHEDULED_TRANSFER_BACKOFF", 30*time.Second)
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		// read-only holds due transfers; they run late once it is lifted
+		readOnly := s.flags.readOnly.Load()
+		if !readOnly {
+			s.materializeStandingOrders(ctx)
+		}
+		for ctx.Err() == nil && !readOnly {
+			ran, err := s.runDueScheduledTransfer(ctx, maxAttempts, backoff)
+			if err != nil {
+				slog.Error("run scheduled transfer", "error", err)
+			}
+			if !ran {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// runDueScheduledTransfer claims one due row by pushing its next attempt out
+// by the claim lease, then runs it outside the claiming transaction so no
+// row lock is held across the transfer.
+func (s *Store) runDueScheduledTransfer(ctx context.Context, maxAttempts int, backoff time.Duration) (bool, error) {
+	st, err := scanScheduledTransfer(s.pool.QueryRow(ctx, `
+		UPDATE scheduled_transfers SET status=$1, attempts=attempts+1, next_attempt_at=tenant_now(tenant_id)+$2*interval '1 second', updated_at=now()
+		WHERE id = (
+			SELECT id FROM scheduled_transfers
+			WHERE status IN ($3, $1) AND next_attempt_at <= now()+$4*interval '1 second' AND next_attempt_at <= tenant_now(tenant_id)
+			ORDER BY next_attempt_at FOR UPDATE SKIP LOCKED LIMIT 1)
+		RETURNING `+scheduledColumns, scheduledRunning, scheduledClaimLease.Seconds(), scheduledPending, s.clocks.maxOffset().Seconds()))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	req := TransferRequest{FromAccountID: st.FromAccountID, ToAccountID: st.ToAccountID, Amount: st.Amount, OperationID: st.OperationID}
+	if st.StandingOrderID != nil {
+		req.standingOrder = *st.StandingOrderID
+	}
+	tctx := withMeta(ctx, requestMeta{Client: "scheduler", Tenant: st.TenantID})
+	resp, status, terr := s.transfer(tctx, req)
+
+	next, errMsg := scheduledDone, ""
+	var retryAt *time.Time
+	switch {
+	case terr == nil && status == http.StatusAccepted:
+		next = scheduledReview
+	case terr == nil:
+	case retryableTransferStatus(status) && st.Attempts < maxAttempts:
+		next, errMsg = scheduledPending, terr.Error()
+		at := s.clocks.now(st.TenantID).Add(backoff << (st.Attempts - 1))
+		retryAt = &at
+	default:
+		next, errMsg = scheduledFailed, terr.Error()
+	}
+	var raw []byte
+	if terr == nil {
+		if raw = resp.raw; raw == nil {
+			raw, _ = json.Marshal(resp)
+		}
+	}
+	if _, err := s.pool.Exec(ctx, `
+		UPDATE scheduled_transfers SET status=$2, next_attempt_at=COALESCE($3, next_attempt_at), last_error=NULLIF($4, ''),
+			response=COALESCE($5, response), updated_at=now()
+		WHERE id=$1`, st.ID, next, retryAt, errMsg, raw); err != nil {
+		// the row stays claimed until the lease runs out and is then replayed
+		return true, fmt.Errorf("record scheduled transfer %d: %w", st.ID, err)
+	}
+	scheduledTransfersRun.WithLabelValues(next).Inc()
+	slog.Info("scheduled transfer run", "scheduled_transfer_id", st.ID, "operation_id", st.OperationID, "attempt", st.Attempts,
+		"status", next, "http_status", status, "error", errMsg)
+	if terr == nil {
+		s.markJournal(tctx, req.OperationID, journalResponded, "")
+	}
+	return true, nil
+}
+
+// retryableTransferStatus is true for outcomes that may succeed unchanged
+// later: server errors, an in-flight duplicate and rate limiting.
+func retryableTransferStatus(status int) bool {
+	return status >= 500 || status == http.StatusConflict || status == http.StatusTooManyRequests
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Schedules are operator-defined cron entries that enqueue a job of a given
+// type and params on every tick. The scheduler only enqueues; the job worker
+// runs the job, so schedules get the same progress tracking and results as
+// jobs triggered through the API, and each run is a row in jobs.
+
+type schedule struct {
+	ID        int64           `json:"id"`
+	Name      string          `json:"name"`
+	Cron      string          `json:"cron"`
+	JobType   string          `json:"jobType"`
+	Params    json.RawMessage `json:"params"`
+	Enabled   bool            `json:"enabled"`
+	CreatedBy string          `json:"createdBy"`
+	CreatedAt time.Time       `json:"createdAt"`
+	NextRunAt *time.Time      `json:"nextRunAt,omitempty"`
+	LastRunAt *time.Time      `json:"lastRunAt,omitempty"`
+}
+
+const scheduleColumns = "id, name, cron, job_type, params, enabled, created_by, created_at, next_run_at, last_run_at"
+
+func scanSchedule(row pgx.Row) (schedule, error) {
+	var sc schedule
+	err := row.Scan(&sc.ID, &sc.Name, &sc.Cron, &sc.JobType, &sc.Params, &sc.Enabled, &sc.CreatedBy, &sc.CreatedAt, &sc.NextRunAt, &sc.LastRunAt)
+	return sc, err
+}
+
+type createScheduleRequest struct {
+	Name    string          `json:"name"`
+	Cron    string          `json:"cron"`
+	JobType string          `json:"jobType"`
+	Params  json.RawMessage `json:"params"`
+	Actor   string          `json:"actor"`
+}
+
+func (s *Store) handleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	var req createScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	spec, err := req.validate(s.jobHandlers)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	if len(req.Params) == 0 {
+		req.Params = json.RawMessage("{}")
+	}
+	sc, err := scanSchedule(s.pool.QueryRow(r.Context(), `
+		INSERT INTO schedules (name, cron, job_type, params, created_by, next_run_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING `+scheduleColumns,
+		req.Name, req.Cron, req.JobType, req.Params, req.Actor, spec.next(time.Now())))
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: "schedule name already exists"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to create schedule", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("schedule created", "schedule_id", sc.ID, "name", sc.Name, "actor", sc.CreatedBy, "cron", sc.Cron, "job_type", sc.JobType)
+	writeJSON(w, http.StatusCreated, sc)
+}
+
+func (req createScheduleRequest) validate(handlers map[string]jobHandler) (*cronSpec, error) {
+	if req.Name == "" || req.Actor == "" {
+		return nil, fmt.Errorf("name and actor are required")
+	}
+	if _, ok := handlers[req.JobType]; !ok {
+		return nil, fmt.Errorf("unknown job type %q", req.JobType)
+	}
+	spec, err := parseCron(req.Cron)
+	if err != nil {
+		return nil, err
+	}
+	if spec.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression never fires")
+	}
+	return spec, nil
+}
+
+func (s *Store) handleListSchedules(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.pool.Query(r.Context(), "SELECT "+scheduleColumns+" FROM schedules ORDER BY id")
+	if err != nil {
+		http.Error(w, "failed to load schedules", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := make([]schedule, 0)
+	for rows.Next() {
+		sc, err := scanSchedule(rows)
+		if err != nil {
+			http.Error(w, "failed to parse schedules", http.StatusInternalServerError)
+			return
+		}
+		list = append(list, sc)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "failed to load schedules", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleSetScheduleEnabled pauses or resumes a schedule. Resuming computes
+// the next run from now rather than firing the ticks missed while paused.
+func (s *Store) handleSetScheduleEnabled(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid schedule id", http.StatusBadRequest)
+			return
+		}
+		ctx := r.Context()
+		sc, err := scanSchedule(s.pool.QueryRow(ctx, "SELECT "+scheduleColumns+" FROM schedules WHERE id=$1", id))
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "schedule not found"})
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to load schedule", http.StatusInternalServerError)
+			return
+		}
+		var next *time.Time
+		if enabled {
+			spec, err := parseCron(sc.Cron)
+			if err != nil {
+				http.Error(w, "stored cron expression is invalid", http.StatusInternalServerError)
+				return
+			}
+			t := spec.next(time.Now())
+			next = &t
+		}
+		sc, err = scanSchedule(s.pool.QueryRow(ctx, "UPDATE schedules SET enabled=$2, next_run_at=$3 WHERE id=$1 RETURNING "+scheduleColumns, id, enabled, next))
+		if err != nil {
+			http.Error(w, "failed to update schedule", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, sc)
+	}
+}
+
+// handleScheduleRuns is the run history of a schedule, newest first.
+func (s *Store) handleScheduleRuns(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid schedule id", http.StatusBadRequest)
+		return
+	}
+	rows, err := s.pool.Query(r.Context(), `
+		SELECT id, type, params, dry_run, status, total, processed, result, error, created_by, created_at, started_at, finished_at
+		FROM jobs WHERE schedule_id=$1 ORDER BY id DESC LIMIT 100`, id)
+	if err != nil {
+		http.Error(w, "failed to load runs", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	runs := make([]job, 0)
+	for rows.Next() {
+		var j job
+		if err := rows.Scan(&j.ID, &j.Type, &j.Params, &j.DryRun, &j.Status, &j.Total, &j.Processed, &j.Result, &j.Error, &j.CreatedBy, &j.CreatedAt, &j.StartedAt, &j.EndedAt); err != nil {
+			http.Error(w, "failed to parse runs", http.StatusInternalServerError)
+			return
+		}
+		runs = append(runs, j)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "failed to load runs", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// runScheduler enqueues due schedules until ctx is cancelled. Due rows are
+// claimed with SKIP LOCKED and advanced in the same transaction as the
+// enqueue, so several scheduler replicas never fire the same tick twice.
+// Ticks missed while no scheduler was running collapse into one run, and so
+// do ticks missed while the scheduler was paused from the runbook.
+func (s *Store) runScheduler(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		for !s.flags.schedulerPaused.Load() {
+			fired, err := s.fireDueSchedule(ctx)
+			if err != nil {
+				slog.Error("fire due schedule", "error", err)
+			}
+			if !fired {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Store) fireDueSchedule(ctx context.Context) (bool, error) {
+	fired := false
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		sc, err := scanSchedule(tx.QueryRow(ctx, `
+			SELECT `+scheduleColumns+` FROM schedules
+			WHERE enabled AND next_run_at <= now()
+			ORDER BY next_run_at FOR UPDATE SKIP LOCKED LIMIT 1`))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var next *time.Time
+		if spec, err := parseCron(sc.Cron); err != nil {
+			slog.Error("disabling schedule with invalid cron", "schedule_id", sc.ID, "cron", sc.Cron, "error", err)
+		} else if t := spec.next(time.Now()); !t.IsZero() {
+			next = &t
+		}
+		var jobID int64
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO jobs (type, params, status, created_by, schedule_id) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+			sc.JobType, sc.Params, jobQueued, "schedule:"+sc.Name, sc.ID).Scan(&jobID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "UPDATE schedules SET last_run_at=now(), next_run_at=$2, enabled=enabled AND $2::timestamptz IS NOT NULL WHERE id=$1", sc.ID, next); err != nil {
+			return err
+		}
+		slog.Info("schedule enqueued job", "schedule_id", sc.ID, "name", sc.Name, "job_id", jobID)
+		fired = true
+		return nil
+	})
+	return fired, err
+}
+
+// scheduleFailed is called by the job runner when a scheduled run fails.
+// The counter feeds the ScheduledJobFailed alert; the event lets operators
+// subscribe to failures of a specific schedule.
+func (s *Store) scheduleFailed(ctx context.Context, j *job, errMsg string) {
+	var name string
+	if err := s.pool.QueryRow(ctx, "SELECT name FROM schedules WHERE id=$1", *j.ScheduleID).Scan(&name); err != nil {
+		slog.Error("look up schedule", "schedule_id", *j.ScheduleID, "error", err)
+		name = strconv.FormatInt(*j.ScheduleID, 10)
+	}
+	scheduledJobFailures.WithLabelValues(name).Inc()
+	if err := s.recordEvent(ctx, "schedule.run_failed", "schedule/"+strconv.FormatInt(*j.ScheduleID, 10), map[string]any{
+		"schedule": name,
+		"jobId":    j.ID,
+		"jobType":  j.Type,
+		"error":    errMsg,
+	}); err != nil {
+		slog.Error("record schedule failure event", "error", err)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migration is one versioned schema change owned by the Go service, a file
+// in migrations/ named <version>_<name>.sql and embedded in the binary.
+// Migration 0 creates the base tables (accounts, ledger, processed_ops)
+// that db/init.sql shares with the other implementations, so an empty
+// database works too. Applied versions are recorded in schema_migrations
+// with the checksum of their file; statements use IF NOT EXISTS so
+// databases prepared before versioning existed upgrade cleanly.
+//
+// A file runs as one multi-statement query in its own transaction, after
+// ${SERVICE_CURRENCY} is replaced with the configured currency. Never edit
+// an applied file: add a new one. Migrations run at boot unless
+// MIGRATE_ON_BOOT=false, in which case the migrate command applies them
+// and a process finding the schema behind refuses to start.
+//
+// A migration may come with <version>_<name>.down.sql, which undoes it for
+// "migrate down"; down files are not part of the checksum. Only migrations
+// from firstReversibleMigration on have one, and loading fails for a later
+// migration without it. The schema therefore cannot be rolled back below
+// firstReversibleMigration, and "migrate down" refuses a request that
+// would go further before undoing anything.
+type migration struct {
+	version  int
+	name     string
+	sql      string
+	checksum string
+	// down is the SQL of the down file, empty when there is none.
+	down string
+}
+
+// firstReversibleMigration is the oldest migration with a down file.
+const firstReversibleMigration = 44
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrations = mustLoadMigrations(migrationFiles)
+
+func mustLoadMigrations(fsys fs.FS) []migration {
+	ms, err := loadMigrations(fsys)
+	if err != nil {
+		panic(err)
+	}
+	return ms
+}
+
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	names, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	var ms []migration
+	downs := map[int]string{}
+	for _, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".sql")
+		base, isDown := strings.CutSuffix(base, ".down")
+		num, label, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %s: name must be <version>_<name>.sql", name)
+		}
+		raw, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		if isDown {
+			downs[version] = string(raw)
+			continue
+		}
+		sum := sha256.Sum256(raw)
+		ms = append(ms, migration{version: version, name: strings.ReplaceAll(label, "_", " "), sql: string(raw), checksum: hex.EncodeToString(sum[:])})
+	}
+	slices.SortFunc(ms, func(a, b migration) int { return a.version - b.version })
+	for i := 1; i < len(ms); i++ {
+		if ms[i].version == ms[i-1].version {
+			return nil, fmt.Errorf("migration version %d is used twice", ms[i].version)
+		}
+	}
+	if len(ms) == 0 {
+		return nil, errors.New("no migrations embedded")
+	}
+	for i := range ms {
+		if sql, ok := downs[ms[i].version]; ok {
+			ms[i].down = sql
+			delete(downs, ms[i].version)
+		} else if ms[i].version >= firstReversibleMigration {
+			return nil, fmt.Errorf("migration %d has no down file; every migration from %d on needs one", ms[i].version, firstReversibleMigration)
+		}
+	}
+	for version := range downs {
+		return nil, fmt.Errorf("down file of migration %d has no migration", version)
+	}
+	return ms, nil
+}
+
+// statements is the SQL to run, with the placeholders filled in.
+func (m migration) statements() string {
+	return strings.ReplaceAll(m.sql, "${SERVICE_CURRENCY}", serviceCurrency)
+}
+
+// downStatements is the SQL of the down file, filled in the same way.
+func (m migration) downStatements() string {
+	return strings.ReplaceAll(m.down, "${SERVICE_CURRENCY}", serviceCurrency)
+}
+
+// schemaVersion is the version this build migrates to.
+func schemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// bootLockKey serializes migrations and seeding across replicas booting at
+// the same time. Any constant works as long as every replica uses the same.
+const bootLockKey = 0x66696e74656368 // "fintech"
+
+// prepareDatabase applies pending migrations and seeds under a cluster-wide
+// advisory lock. Replicas that lose the race block on the lock and then find
+// nothing left to do.
+func (s *Store) prepareDatabase(ctx context.Context) error {
+	return s.withBootLock(ctx, func(conn *pgxpool.Conn) error {
+		if err := migrate(ctx, conn); err != nil {
+			return err
+		}
+		if err := seed(ctx, conn); err != nil {
+			return err
+		}
+		if indexAutoCreate() {
+			createVettedIndexes(ctx, conn)
+		}
+		return nil
+	})
+}
+
+// withBootLock runs f on a connection holding the boot lock.
+func (s *Store) withBootLock(ctx context.Context, f func(conn *pgxpool.Conn) error) error {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", bootLockKey); err != nil {
+		return fmt.Errorf("acquire boot lock: %w", err)
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", bootLockKey)
+	return f(conn)
+}
+
+func migrate(ctx context.Context, conn *pgxpool.Conn) error {
+	if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+	if _, err := conn.Exec(ctx, `ALTER TABLE schema_migrations ADD COLUMN IF NOT EXISTS checksum TEXT`); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if a, ok := applied[m.version]; ok {
+			switch a.checksum {
+			case m.checksum:
+			case "":
+				// applied before checksums were recorded
+				if _, err := conn.Exec(ctx, "UPDATE schema_migrations SET checksum = $2 WHERE version = $1", m.version, m.checksum); err != nil {
+					return err
+				}
+			default:
+				slog.Warn("applied migration differs from its file; add a new migration instead of editing one",
+					"version", m.version, "name", m.name)
+			}
+			continue
+		}
+		// one transaction per migration: a crash mid-way leaves it unrecorded
+		// and it is retried as a whole on the next boot
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, m.statements()); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)", m.version, m.name, m.checksum)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		slog.Info("applied migration", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+// rollback undoes the newest steps applied migrations with their down
+// files, newest first, each in its own transaction that also drops its
+// schema_migrations row. The whole request is checked first (see
+// rollbackPlan), so a refused one changes nothing.
+func rollback(ctx context.Context, conn *pgxpool.Conn, steps int) error {
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	versions := make([]int, 0, len(applied))
+	for v := range applied {
+		versions = append(versions, v)
+	}
+	plan, err := rollbackPlan(migrations, versions, steps)
+	if err != nil {
+		return err
+	}
+	for _, m := range plan {
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, m.downStatements()); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("roll back migration %d (%s): %w", m.version, m.name, err)
+		}
+		slog.Info("rolled back migration", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+// rollbackPlan picks the migrations that undo the newest steps of applied,
+// newest first. It refuses when one of them is newer than this build or
+// has no down file, naming the oldest version the schema can go back to.
+func rollbackPlan(ms []migration, applied []int, steps int) ([]migration, error) {
+	if len(applied) < steps {
+		return nil, fmt.Errorf("only %d migrations are applied", len(applied))
+	}
+	applied = slices.Clone(applied)
+	slices.Sort(applied)
+	slices.Reverse(applied)
+	plan := make([]migration, 0, steps)
+	for _, v := range applied[:steps] {
+		i, found := slices.BinarySearchFunc(ms, v, func(m migration, v int) int { return m.version - v })
+		if !found {
+			return nil, fmt.Errorf("migration %d is newer than this build; roll back with the build that applied it", v)
+		}
+		if ms[i].down == "" {
+			return nil, fmt.Errorf("cannot roll back %d migrations: migration %d (%s) has no down file, so the schema cannot go below version %d",
+				steps, ms[i].version, ms[i].name, ms[i].version)
+		}
+		plan = append(plan, ms[i])
+	}
+	return plan, nil
+}
+
+type appliedMigration struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+func appliedMigrations(ctx context.Context, q interface {
+	Query(context.Context, string, ...any) (pgx.Rows, error)
+}) (map[int]appliedMigration, error) {
+	// through to_jsonb, so databases without the checksum column yet can
+	// still be read
+	rows, err := q.Query(ctx, "SELECT version, COALESCE(to_jsonb(m)->>'checksum', ''), applied_at FROM schema_migrations m")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var (
+			v int
+			a appliedMigration
+		)
+		if err := rows.Scan(&v, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[v] = a
+	}
+	return applied, rows.Err()
+}
+
+type migrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name,omitempty"`
+	State     string     `json:"state"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+// runMigrateCommand is the migrate command. "up", the default, applies the
+// pending migrations and seeds; "down [n]" rolls back the newest n applied
+// migrations, one by default; "status" prints each migration as applied,
+// pending, modified (its file changed since) or unknown (newer than this
+// build) and exits 1 while any is pending.
+//
+// A process that migrates on boot reapplies what down removed, so roll back
+// with MIGRATE_ON_BOOT=false or after deploying the older build. Down undoes
+// migrations back to firstReversibleMigration at most; older ones have no
+// down files, so going back further means restoring a backup.
+func (s *Store) runMigrateCommand(ctx context.Context, args []string) {
+	action := ""
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch action {
+	case "", "up":
+		if err := s.prepareDatabase(ctx); err != nil {
+			fatal("failed to migrate database", "error", err)
+		}
+		slog.Info("database migrated", "schema_version", schemaVersion())
+		os.Exit(0)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				fatal("migrate down takes a positive number of migrations", "value", args[1])
+			}
+			steps = n
+		}
+		err := s.withBootLock(ctx, func(conn *pgxpool.Conn) error { return rollback(ctx, conn, steps) })
+		if err != nil {
+			fatal("failed to roll back database", "error", err)
+		}
+		os.Exit(0)
+	case "status":
+	default:
+		fatal("unknown migrate action; use up, down or status", "action", action)
+	}
+
+	applied := map[int]appliedMigration{}
+	var exists bool
+	if err := s.pool.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		fatal("failed to read schema_migrations", "error", err)
+	}
+	if exists {
+		var err error
+		if applied, err = appliedMigrations(ctx, s.pool); err != nil {
+			fatal("failed to read schema_migrations", "error", err)
+		}
+	}
+	var list []migrationStatus
+	pending := false
+	for _, m := range migrations {
+		st := migrationStatus{Version: m.version, Name: m.name, State: "pending"}
+		if a, ok := applied[m.version]; ok {
+			st.State, st.AppliedAt = "applied", &a.appliedAt
+			if a.checksum != "" && a.checksum != m.checksum {
+				st.State = "modified"
+			}
+			delete(applied, m.version)
+		} else {
+			pending = true
+		}
+		list = append(list, st)
+	}
+	for v, a := range applied {
+		list = append(list, migrationStatus{Version: v, State: "unknown", AppliedAt: &a.appliedAt})
+	}
+	slices.SortFunc(list, func(a, b migrationStatus) int { return a.Version - b.Version })
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(map[string]any{"schemaVersion": schemaVersion(), "migrations": list})
+	if pending {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
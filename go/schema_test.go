@@ -0,0 +1,87 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRollbackPlan(t *testing.T) {
+	ms := []migration{
+		{version: 42, name: "a"},
+		{version: 43, name: "b"},
+		{version: 44, name: "c", down: "DROP TABLE c"},
+		{version: 45, name: "d", down: "DROP TABLE d"},
+	}
+	tests := []struct {
+		name    string
+		applied []int
+		steps   int
+		want    []int
+		err     string
+	}{
+		{name: "newest", applied: []int{45, 42, 44, 43}, steps: 1, want: []int{45}},
+		{name: "back to the oldest reversible", applied: []int{42, 43, 44, 45}, steps: 2, want: []int{45, 44}},
+		{name: "below the oldest reversible", applied: []int{42, 43, 44, 45}, steps: 3,
+			err: "migration 43 (b) has no down file, so the schema cannot go below version 43"},
+		{name: "more than applied", applied: []int{42, 43}, steps: 3, err: "only 2 migrations are applied"},
+		{name: "newer than this build", applied: []int{42, 43, 44, 45, 46}, steps: 1, err: "migration 46 is newer than this build"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := rollbackPlan(ms, tt.applied, tt.steps)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) || plan != nil {
+					t.Fatalf("got %v, %v; want no plan and an error containing %q", plan, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rollbackPlan: %v", err)
+			}
+			var got []int
+			for _, m := range plan {
+				got = append(got, m.version)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("plan %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMigrationsDownFiles(t *testing.T) {
+	file := func(s string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(s)} }
+	ms, err := loadMigrations(fstest.MapFS{
+		"migrations/0043_old.sql":      file("CREATE TABLE old ()"),
+		"migrations/0044_new.sql":      file("CREATE TABLE new ()"),
+		"migrations/0044_new.down.sql": file("DROP TABLE new"),
+	})
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	if len(ms) != 2 || ms[0].down != "" || ms[1].down != "DROP TABLE new" {
+		t.Errorf("loaded %+v", ms)
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"reversible migration without a down file": {
+			"migrations/0044_new.sql":       file("CREATE TABLE new ()"),
+			"migrations/0045_next.sql":      file("CREATE TABLE next ()"),
+			"migrations/0045_next.down.sql": file("DROP TABLE next"),
+		},
+		"down file without a migration": {
+			"migrations/0043_old.sql":       file("CREATE TABLE old ()"),
+			"migrations/0042_gone.down.sql": file("DROP TABLE gone"),
+		},
+	} {
+		if _, err := loadMigrations(fsys); err == nil {
+			t.Errorf("%s: loaded without an error", name)
+		}
+	}
+	if _, err := loadMigrations(fstest.MapFS{"migrations/0044_new.sql": file("CREATE TABLE new ()")}); err == nil ||
+		!strings.Contains(err.Error(), "migration 44 has no down file") {
+		t.Errorf("got %v, want the missing down file named", err)
+	}
+}
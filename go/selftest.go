@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"time"
+)
+
+// The self-test runs at boot, after migrations, and on demand with
+// -selftest (which exits with its result and migrates nothing, so it can
+// gate a deploy against the target database). A failed check stops the
+// process with a message saying what to fix, instead of the first customer
+// request finding out; a warning is logged and the service starts.
+
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+type checkResult struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Detail   string `json:"detail"`
+	Duration string `json:"duration"`
+}
+
+type selfTestReport struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+type selfCheck struct {
+	name string
+	run  func(ctx context.Context, s *Store) (status, detail string)
+}
+
+var selfChecks = []selfCheck{
+	{"schema_version", checkSchemaVersion},
+	{"indexes", checkIndexes},
+	{"clock_skew", checkClockSkew},
+	{"write_read", checkWriteRead},
+	{"system_accounts", checkSystemAccounts},
+	{"pool_size", checkPoolSize},
+}
+
+func (s *Store) selfTest(ctx context.Context) selfTestReport {
+	report := selfTestReport{Status: checkOK}
+	for _, c := range selfChecks {
+		cctx, cancel := context.WithTimeout(ctx, durationOrDefault("SELFTEST_CHECK_TIMEOUT", 5*time.Second))
+		start := time.Now()
+		status, detail := c.run(cctx, s)
+		cancel()
+		res := checkResult{Name: c.name, Status: status, Detail: detail, Duration: time.Since(start).Round(time.Millisecond).String()}
+		report.Checks = append(report.Checks, res)
+		switch {
+		case status == checkFail:
+			report.Status = checkFail
+			slog.Error("self-test check failed", "check", c.name, "detail", detail)
+		case status == checkWarn:
+			if report.Status == checkOK {
+				report.Status = checkWarn
+			}
+			slog.Warn("self-test check warning", "check", c.name, "detail", detail)
+		default:
+			slog.Debug("self-test check passed", "check", c.name, "detail", detail)
+		}
+	}
+	return report
+}
+
+// runSelfTestCommand implements -selftest: print the report as JSON and
+// exit non-zero on failure.
+func (s *Store) runSelfTestCommand(ctx context.Context) {
+	report := s.selfTest(ctx)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(report)
+	if report.Status == checkFail {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func checkSchemaVersion(ctx context.Context, s *Store) (string, string) {
+	want := schemaVersion()
+	var got int
+	if err := s.pool.QueryRow(ctx, "SELECT COALESCE(max(version), 0) FROM schema_migrations").Scan(&got); err != nil {
+		return checkFail, fmt.Sprintf("cannot read schema_migrations: %v; start the service once with migrations enabled", err)
+	}
+	switch {
+	case got < want:
+		return checkFail, fmt.Sprintf("database is at schema version %d, this build needs %d; run the migrate command", got, want)
+	case got > want:
+		// expected mid-rollout, while older pods still run
+		return checkWarn, fmt.Sprintf("database is at schema version %d, newer than this build's %d", got, want)
+	}
+	return checkOK, fmt.Sprintf("schema version %d", got)
+}
+
+var createIndexPattern = regexp.MustCompile(`CREATE (?:UNIQUE )?INDEX IF NOT EXISTS (\w+)`)
+
+// checkIndexes verifies every index the migrations create exists and is
+// valid; a failed CREATE INDEX CONCURRENTLY run by hand leaves an invalid
+// one that Postgres keeps but never uses.
+func checkIndexes(ctx context.Context, s *Store) (string, string) {
+	var want []string
+	for _, m := range migrations {
+		for _, sub := range createIndexPattern.FindAllStringSubmatch(m.sql, -1) {
+			want = append(want, sub[1])
+		}
+	}
+	rows, err := s.pool.Query(ctx, `
+		SELECT c.relname, i.indisvalid FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid
+		WHERE c.relname = ANY($1) AND pg_table_is_visible(c.oid)`, want)
+	if err != nil {
+		return checkFail, fmt.Sprintf("cannot list indexes: %v", err)
+	}
+	defer rows.Close()
+	valid := map[string]bool{}
+	for rows.Next() {
+		var (
+			name string
+			ok   bool
+		)
+		if err := rows.Scan(&name, &ok); err != nil {
+			return checkFail, fmt.Sprintf("cannot list indexes: %v", err)
+		}
+		valid[name] = ok
+	}
+	if err := rows.Err(); err != nil {
+		return checkFail, fmt.Sprintf("cannot list indexes: %v", err)
+	}
+	var missing, invalid []string
+	for _, name := range want {
+		ok, found := valid[name]
+		switch {
+		case !found:
+			missing = append(missing, name)
+		case !ok:
+			invalid = append(invalid, name)
+		}
+	}
+	switch {
+	case len(missing) > 0:
+		return checkFail, fmt.Sprintf("missing indexes %v; they are created by migrations, so someone dropped them: recreate them from migrations/", missing)
+	case len(invalid) > 0:
+		return checkFail, fmt.Sprintf("invalid indexes %v; DROP and recreate them", invalid)
+	}
+	return checkOK, fmt.Sprintf("%d indexes present", len(want))
+}
+
+// checkClockSkew compares the local clock with the database's, allowing for
+// the round-trip. The service writes some timestamps itself (ledger at) that
+// are later compared with now() (Merkle settle window, pending expiry), so
+// the two clocks must agree.
+func checkClockSkew(ctx context.Context, s *Store) (string, string) {
+	start := time.Now()
+	var db time.Time
+	if err := s.pool.QueryRow(ctx, "SELECT clock_timestamp()").Scan(&db); err != nil {
+		return checkFail, fmt.Sprintf("cannot read database clock: %v", err)
+	}
+	rtt := time.Since(start)
+	skew := db.Sub(start.Add(rtt / 2))
+	if skew < 0 {
+		skew = -skew
+	}
+	limit := durationOrDefault("SELFTEST_MAX_CLOCK_SKEW", 2*time.Second)
+	detail := fmt.Sprintf("skew %s (round-trip %s)", skew.Round(time.Millisecond), rtt.Round(time.Millisecond))
+	if skew > limit {
+		return checkFail, detail + fmt.Sprintf(", over %s: check NTP on this host and the database server", limit)
+	}
+	return checkOK, detail
+}
+
+// checkWriteRead commits a row to selftest_probes and reads it back, which
+// catches read-only replicas behind the DSN and missing write grants.
+func checkWriteRead(ctx context.Context, s *Store) (string, string) {
+	host, _ := os.Hostname()
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	token := hex.EncodeToString(b)
+	if _, err := s.pool.Exec(ctx, `
+		INSERT INTO selftest_probes (instance, token, written_at) VALUES ($1, $2, now())
+		ON CONFLICT (instance) DO UPDATE SET token = excluded.token, written_at = excluded.written_at`, host, token); err != nil {
+		return checkFail, fmt.Sprintf("cannot write: %v; is DB_HOST a read-only replica, or does the user lack INSERT?", err)
+	}
+	var got string
+	if err := s.pool.QueryRow(ctx, "SELECT token FROM selftest_probes WHERE instance=$1", host).Scan(&got); err != nil {
+		return checkFail, fmt.Sprintf("cannot read back: %v", err)
+	}
+	if got != token {
+		return checkFail, "read back a different value than written; is the DSN behind a load balancer mixing primaries?"
+	}
+	return checkOK, "round-trip ok"
+}
+
+func checkSystemAccounts(ctx context.Context, s *Store) (string, string) {
+	var missing []string
+	for _, id := range []string{settlementAccountID, suspenseAccountID, feesAccountID, adjustmentsAccountID} {
+		var exists bool
+		if err := s.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM accounts WHERE id=$1)", id).Scan(&exists); err != nil {
+			return checkFail, fmt.Sprintf("cannot read accounts: %v", err)
+		}
+		if !exists {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		return checkFail, fmt.Sprintf("system accounts %v missing; they are created by seeds, check data_seeds and db/init.sql", missing)
+	}
+	return checkOK, "settlement, suspense and fees accounts present"
+}
+
+// checkPoolSize warns when this instance alone could take most of the
+// server's connections, which starves the other replicas at scale-out.
+func checkPoolSize(ctx context.Context, s *Store) (string, string) {
+	var maxConns, reserved int32
+	if err := s.pool.QueryRow(ctx, "SELECT current_setting('max_connections')::int, current_setting('superuser_reserved_connections')::int").
+		Scan(&maxConns, &reserved); err != nil {
+		return checkFail, fmt.Sprintf("cannot read connection limits: %v", err)
+	}
+	pool := s.pool.Config().MaxConns
+	if s.locks != nil {
+		pool += s.locks.Config().MaxConns
+	}
+	detail := fmt.Sprintf("pool_max_conns plus lock_conns %d of %d available server connections", pool, maxConns-reserved)
+	switch {
+	case pool > maxConns-reserved:
+		return checkFail, detail + "; lower pool_max_conns or lock_conns, or raise max_connections"
+	case pool > (maxConns-reserved)/2:
+		return checkWarn, detail + "; a second replica would exhaust the server"
+	}
+	return checkOK, detail
+}
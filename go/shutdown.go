@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// shutdown drains the process within timeout: the health score switches to
+// drain so load balancers stop routing here, the API servers stop accepting
+// and wait for in-flight requests (gRPC calls too), background loops (already cancelled)
+// finish their current iteration, and only then is the pool closed, so no
+// transfer loses its connection mid-transaction. Buffered spans are flushed
+// last, after the work that produced them.
+func shutdown(s *Store, servers []*http.Server, rpc *grpc.Server, background *sync.WaitGroup, timeout time.Duration) {
+	slog.Info("shutting down", "drain_timeout", timeout.String())
+	s.health.draining.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// the admin server is first in the list; keep it up until the end so
+	// probes see the drain
+	for i := len(servers) - 1; i > 0; i-- {
+		if err := servers[i].Shutdown(ctx); err != nil {
+			slog.Error("shutdown server", "addr", servers[i].Addr, "error", err)
+		}
+	}
+	if rpc != nil {
+		stopped := make(chan struct{})
+		go func() {
+			rpc.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			rpc.Stop()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("background work still running at shutdown deadline")
+	}
+
+	if err := servers[0].Shutdown(ctx); err != nil {
+		slog.Error("shutdown server", "addr", servers[0].Addr, "error", err)
+	}
+	flushTraces(ctx)
+	s.locks.Close()
+	s.pool.Close()
+	slog.Info("shutdown complete")
+}
+
+func listenAddrs(servers []*http.Server) string {
+	addrs := make([]string, len(servers))
+	for i, srv := range servers {
+		addrs[i] = srv.Addr
+	}
+	return strings.Join(addrs, ", ")
+}
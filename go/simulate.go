@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type simulateRequest struct {
+	Source string    `json:"source"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Limit  int       `json:"limit"`
+}
+
+type simulateCounts struct {
+	Allowed  int            `json:"allowed"`
+	Reviewed int            `json:"reviewed"`
+	Blocked  int            `json:"blocked"`
+	ByRule   map[string]int `json:"byRule"`
+}
+
+type simulateHit struct {
+	TransferID int64     `json:"transferId"`
+	From       string    `json:"fromAccountId"`
+	To         string    `json:"toAccountId"`
+	Amount     Money     `json:"amount"`
+	At         time.Time `json:"at"`
+	Decision   string    `json:"decision"`
+	Matched    []string  `json:"matched"`
+}
+
+type simulateResponse struct {
+	Evaluated int            `json:"evaluated"`
+	Truncated bool           `json:"truncated"`
+	Proposed  simulateCounts `json:"proposed"`
+	// Active is the same window evaluated against the rule set currently
+	// enforced, so the response reads as a before/after comparison.
+	Active        *simulateCounts `json:"active,omitempty"`
+	ActiveVersion int             `json:"activeVersion,omitempty"`
+	Samples       []simulateHit   `json:"samples"`
+	Caveats       []string        `json:"caveats"`
+}
+
+const (
+	simulateDefaultLimit = 10000
+	simulateMaxLimit     = 100000
+	simulateMaxSamples   = 50
+)
+
+// handleSimulateRules replays recorded transfers in a time window against a
+// proposed rule set without touching any real transfer or case.
+func (s *Store) handleSimulateRules(w http.ResponseWriter, r *http.Request) {
+	var req simulateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	rules, err := parseRuleSet(req.Source)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	if req.To.IsZero() {
+		req.To = time.Now()
+	}
+	if req.From.IsZero() {
+		req.From = req.To.Add(-24 * time.Hour)
+	}
+	if !req.From.Before(req.To) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "from must be before to"})
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = simulateDefaultLimit
+	}
+	if req.Limit > simulateMaxLimit {
+		req.Limit = simulateMaxLimit
+	}
+
+	ctx := withQueryPattern(r.Context(), patternAnalytics)
+	proposed := &ruleSet{Version: 0, Source: req.Source, Rules: rules}
+	active := s.rules.current.Load()
+
+	resp := simulateResponse{
+		Proposed: simulateCounts{ByRule: map[string]int{}},
+		Samples:  make([]simulateHit, 0),
+		Caveats: []string{
+			"client, tenant, ip and country are not recorded per transfer; rules on them never match",
+			"account.balance and dest.balance use current balances, not balances at transfer time",
+		},
+	}
+	if active != nil {
+		resp.Active = &simulateCounts{ByRule: map[string]int{}}
+		resp.ActiveVersion = active.Version
+	}
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, from_account_id, to_account_id, amount, created_at
+		FROM transfers WHERE created_at >= $1 AND created_at < $2
+		ORDER BY id LIMIT $3`, req.From, req.To, req.Limit+1)
+	if err != nil {
+		http.Error(w, "failed to load transfers", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	lookup := cachedAccountLookup(dbAccountLookup(s.pool))
+	for rows.Next() {
+		var h simulateHit
+		if err := rows.Scan(&h.TransferID, &h.From, &h.To, &h.Amount, &h.At); err != nil {
+			http.Error(w, "failed to parse transfers", http.StatusInternalServerError)
+			return
+		}
+		if resp.Evaluated == req.Limit {
+			resp.Truncated = true
+			break
+		}
+		resp.Evaluated++
+		tr := TransferRequest{FromAccountID: h.From, ToAccountID: h.To, Amount: h.Amount}
+
+		out, matched, err := simulateOne(ctx, s.pool, lookup, proposed, tr, h.At)
+		if err != nil {
+			http.Error(w, "failed to evaluate rules", http.StatusInternalServerError)
+			return
+		}
+		resp.Proposed.add(out.Decision, matched)
+		if out.Decision != riskAllow && len(resp.Samples) < simulateMaxSamples {
+			h.Decision, h.Matched = out.Decision, matched
+			resp.Samples = append(resp.Samples, h)
+		}
+		if active != nil {
+			out, matched, err := simulateOne(ctx, s.pool, lookup, active, tr, h.At)
+			if err != nil {
+				http.Error(w, "failed to evaluate rules", http.StatusInternalServerError)
+				return
+			}
+			resp.Active.add(out.Decision, matched)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "failed to load transfers", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func simulateOne(ctx context.Context, db querier, lookup accountLookup, set *ruleSet, tr TransferRequest, at time.Time) (riskOutcome, []string, error) {
+	vars, err := loadRuleVars(ctx, lookup, dbHistoryLookup(db), set.Rules, tr, requestMeta{}, at)
+	if err != nil {
+		return riskOutcome{}, nil, err
+	}
+	out, matched := evaluateRuleSet(set, vars)
+	return out, matched, nil
+}
+
+func (c *simulateCounts) add(decision string, matched []string) {
+	switch decision {
+	case riskBlock:
+		c.Blocked++
+	case riskReview:
+		c.Reviewed++
+	default:
+		c.Allowed++
+	}
+	for _, name := range matched {
+		c.ByRule[name]++
+	}
+}
+
+// cachedAccountLookup memoizes lookups for the duration of one simulation,
+// which typically touches the same few accounts thousands of times.
+func cachedAccountLookup(next accountLookup) accountLookup {
+	cache := make(map[string]*accountAttrs)
+	return func(ctx context.Context, id string) (*accountAttrs, error) {
+		if a, ok := cache[id]; ok {
+			return a, nil
+		}
+		a, err := next(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		cache[id] = a
+		return a, nil
+	}
+}
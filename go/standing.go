@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/ledger"
+)
+
+// A standing order is a recurring transfer. Occurrence n falls n periods
+// after start_at; monthly orders keep the start day and clamp it to the last
+// day of shorter months (a 31st order runs on Feb 28/29 and is back on the
+// 31st in March). Each due occurrence is materialized as a scheduled
+// transfer carrying the order id and occurrence number, so execution,
+// retries and idempotency are the scheduled-transfer worker's; the unique
+// (standing_order_id, occurrence) index keeps two workers from materializing
+// the same occurrence. The resulting transfer row carries standing_order_id,
+// which is how statement lines link back to the order.
+//
+// Skipping advances past the next occurrence without running it. Pausing
+// stops materialization; on resume, occurrences that fell inside the pause
+// are skipped rather than run late in a burst. An order completes after its
+// end date or its execution count, whichever comes first; skipped
+// occurrences do not count as executions.
+
+const (
+	standingActive    = "active"
+	standingPaused    = "paused"
+	standingCompleted = "completed"
+	standingCanceled  = "cancelled"
+)
+
+var standingFrequencies = map[string]bool{"daily": true, "weekly": true, "monthly": true}
+
+// standingOccurrence is the time of occurrence n of an order anchored at
+// start.
+func standingOccurrence(start time.Time, frequency string, n int) time.Time {
+	switch frequency {
+	case "daily":
+		return start.AddDate(0, 0, n)
+	case "weekly":
+		return start.AddDate(0, 0, 7*n)
+	}
+	// AddDate would roll Jan 31 + 1 month over into March
+	y, m, d := start.Date()
+	first := time.Date(y, m+time.Month(n), 1, start.Hour(), start.Minute(), start.Second(), start.Nanosecond(), start.Location())
+	if last := first.AddDate(0, 1, -1).Day(); d > last {
+		d = last
+	}
+	return first.AddDate(0, 0, d-1)
+}
+
+type standingOrder struct {
+	ID            int64      `json:"id"`
+	TenantID      string     `json:"tenantId"`
+	FromAccountID string     `json:"fromAccountId"`
+	ToAccountID   string     `json:"toAccountId"`
+	Amount        Money      `json:"amount"`
+	Frequency     string     `json:"frequency"`
+	StartAt       time.Time  `json:"startAt"`
+	EndAt         *time.Time `json:"endAt,omitempty"`
+	MaxExecutions *int       `json:"count,omitempty"`
+	Status        string     `json:"status"`
+	Occurrence    int        `json:"occurrence"`
+	Executions    int        `json:"executions"`
+	Skipped       int        `json:"skipped"`
+	NextRunAt     *time.Time `json:"nextRunAt,omitempty"`
+	CreatedBy     string     `json:"createdBy"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
+
+const standingColumns = `id, tenant_id, from_account_id, to_account_id, amount, frequency, start_at, end_at, max_executions,
+	status, occurrence, executions, skipped, CASE WHEN status IN ('active', 'paused') THEN next_run_at END,
+	created_by, created_at, updated_at`
+
+func scanStandingOrder(row pgx.Row) (standingOrder, error) {
+	var o standingOrder
+	err := row.Scan(&o.ID, &o.TenantID, &o.FromAccountID, &o.ToAccountID, &o.Amount, &o.Frequency, &o.StartAt, &o.EndAt, &o.MaxExecutions,
+		&o.Status, &o.Occurrence, &o.Executions, &o.Skipped, &o.NextRunAt, &o.CreatedBy, &o.CreatedAt, &o.UpdatedAt)
+	return o, err
+}
+
+// finished reports whether occurrence n at is past the order's end.
+func (o *standingOrder) finished(at time.Time) bool {
+	return o.EndAt != nil && at.After(*o.EndAt) || o.MaxExecutions != nil && o.Executions >= *o.MaxExecutions
+}
+
+// advance moves the order to occurrence n, completing it when n is past
+// its end.
+func (o *standingOrder) advance(n int) {
+	o.Occurrence = n
+	next := standingOccurrence(o.StartAt, o.Frequency, n)
+	o.NextRunAt = &next
+	if o.finished(next) {
+		o.Status = standingCompleted
+	}
+}
+
+type createStandingOrderRequest struct {
+	FromAccountID string     `json:"fromAccountId"`
+	ToAccountID   string     `json:"toAccountId"`
+	Amount        Money      `json:"amount"`
+	Frequency     string     `json:"frequency"`
+	StartAt       time.Time  `json:"startAt"`
+	EndAt         *time.Time `json:"endAt"`
+	Count         *int       `json:"count"`
+}
+
+func (s *Store) handleCreateStandingOrder(w http.ResponseWriter, r *http.Request) {
+	var req createStandingOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if errors.Is(err, ledger.ErrTooPrecise) {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+			return
+		}
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	msg := validateTransfer(TransferRequest{FromAccountID: req.FromAccountID, ToAccountID: req.ToAccountID, Amount: req.Amount})
+	switch {
+	case msg != "":
+	case !standingFrequencies[req.Frequency]:
+		msg = "frequency must be daily, weekly or monthly"
+	case req.StartAt.IsZero():
+		msg = "startAt is required"
+	case req.EndAt != nil && req.EndAt.Before(req.StartAt):
+		msg = "endAt must not be before startAt"
+	case req.Count != nil && *req.Count <= 0:
+		msg = "count must be positive"
+	}
+	if msg != "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: msg})
+		return
+	}
+	ctx := r.Context()
+	var tenant string
+	err := s.pool.QueryRow(ctx, "SELECT tenant_id FROM accounts WHERE id=$1", req.FromAccountID).Scan(&tenant)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "from account not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	if p := principalFromContext(ctx); p != nil && p.Tenant != "" && p.Tenant != tenant {
+		writeJSON(w, http.StatusForbidden, TransferResponse{Status: "error", Message: errOtherTenant.Error()})
+		return
+	}
+	o, err := scanStandingOrder(s.pool.QueryRow(ctx, `
+		INSERT INTO standing_orders (tenant_id, from_account_id, to_account_id, amount, frequency, start_at, end_at, max_executions, next_run_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $6, $9) RETURNING `+standingColumns,
+		tenant, req.FromAccountID, req.ToAccountID, req.Amount, req.Frequency, req.StartAt, req.EndAt, req.Count, metaFromRequest(r).Client))
+	if err != nil {
+		http.Error(w, "failed to create standing order", http.StatusInternalServerError)
+		return
+	}
+	logger(ctx).Info("standing order created", "standing_order_id", o.ID, "from", o.FromAccountID, "to", o.ToAccountID,
+		"amount", o.Amount, "frequency", o.Frequency, "start_at", o.StartAt)
+	writeJSON(w, http.StatusCreated, o)
+}
+
+func (s *Store) handleListStandingOrders(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.pool.Query(r.Context(), `
+		SELECT `+standingColumns+` FROM standing_orders
+		WHERE $1 = '' OR from_account_id = $1 OR to_account_id = $1
+		ORDER BY id DESC LIMIT 500`, r.URL.Query().Get("accountId"))
+	if err != nil {
+		http.Error(w, "failed to list standing orders", http.StatusInternalServerError)
+		return
+	}
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (standingOrder, error) { return scanStandingOrder(row) })
+	if err != nil {
+		http.Error(w, "failed to list standing orders", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func standingOrderID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid standing order id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// handleGetStandingOrder returns the order with its executions, i.e. the
+// scheduled transfers it has materialized, newest first.
+func (s *Store) handleGetStandingOrder(w http.ResponseWriter, r *http.Request) {
+	id, ok := standingOrderID(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	o, err := scanStandingOrder(s.pool.QueryRow(ctx, "SELECT "+standingColumns+" FROM standing_orders WHERE id=$1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "standing order not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load standing order", http.StatusInternalServerError)
+		return
+	}
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+scheduledColumns+` FROM scheduled_transfers
+		WHERE standing_order_id=$1 ORDER BY occurrence DESC LIMIT 100`, id)
+	if err != nil {
+		http.Error(w, "failed to load executions", http.StatusInternalServerError)
+		return
+	}
+	executions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (scheduledTransfer, error) { return scanScheduledTransfer(row) })
+	if err != nil {
+		http.Error(w, "failed to load executions", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"standingOrder": o, "executions": executions})
+}
+
+// handleStandingOrderAction applies pause, resume, skip or cancel. Each
+// reads and rewrites the order under a row lock so it cannot interleave
+// with the materializer advancing it.
+func (s *Store) handleStandingOrderAction(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := standingOrderID(w, r)
+		if !ok {
+			return
+		}
+		ctx := r.Context()
+		var (
+			o        standingOrder
+			conflict string
+		)
+		err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+			var err error
+			o, err = scanStandingOrder(tx.QueryRow(ctx, "SELECT "+standingColumns+" FROM standing_orders WHERE id=$1 FOR UPDATE", id))
+			if err != nil {
+				return err
+			}
+			switch {
+			case action == "pause" && o.Status == standingActive:
+				o.Status = standingPaused
+			case action == "resume" && o.Status == standingPaused:
+				o.Status = standingActive
+				n, now := o.Occurrence, s.clocks.now(o.TenantID)
+				for standingOccurrence(o.StartAt, o.Frequency, n).Before(now) {
+					n++
+				}
+				o.Skipped += n - o.Occurrence
+				o.advance(n)
+			case action == "skip" && (o.Status == standingActive || o.Status == standingPaused):
+				o.Skipped++
+				o.advance(o.Occurrence + 1)
+			case action == "cancel" && (o.Status == standingActive || o.Status == standingPaused):
+				o.Status = standingCanceled
+			default:
+				conflict = fmt.Sprintf("cannot %s a %s standing order", action, o.Status)
+				return nil
+			}
+			o, err = scanStandingOrder(tx.QueryRow(ctx, `
+				UPDATE standing_orders SET status=$2, occurrence=$3, skipped=$4, next_run_at=COALESCE($5, next_run_at), updated_at=now()
+				WHERE id=$1 RETURNING `+standingColumns, id, o.Status, o.Occurrence, o.Skipped, o.NextRunAt))
+			return err
+		})
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "standing order not found"})
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to update standing order", http.StatusInternalServerError)
+			return
+		}
+		if conflict != "" {
+			writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: conflict})
+			return
+		}
+		logger(ctx).Info("standing order "+action, "standing_order_id", o.ID, "status", o.Status, "occurrence", o.Occurrence)
+		writeJSON(w, http.StatusOK, o)
+	}
+}
+
+// materializeStandingOrders turns every due occurrence into a scheduled
+// transfer. An order that fell behind (workers down for a while) catches
+// up one occurrence per call, each becoming its own transfer.
+func (s *Store) materializeStandingOrders(ctx context.Context) {
+	for ctx.Err() == nil {
+		done, err := s.materializeDueOccurrence(ctx)
+		if err != nil {
+			slog.Error("materialize standing order", "error", err)
+			return
+		}
+		if done {
+			return
+		}
+	}
+}
+
+func (s *Store) materializeDueOccurrence(ctx context.Context) (done bool, err error) {
+	err = s.beginFunc(ctx, func(tx pgx.Tx) error {
+		o, err := scanStandingOrder(tx.QueryRow(ctx, `
+			SELECT `+standingColumns+` FROM standing_orders
+			WHERE status=$1 AND next_run_at <= now()+$2*interval '1 second' AND next_run_at <= tenant_now(tenant_id)
+			ORDER BY next_run_at FOR UPDATE SKIP LOCKED LIMIT 1`, standingActive, s.clocks.maxOffset().Seconds()))
+		if errors.Is(err, pgx.ErrNoRows) {
+			done = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		at := standingOccurrence(o.StartAt, o.Frequency, o.Occurrence)
+		if !o.finished(at) {
+			var stID int64
+			if err := tx.QueryRow(ctx, `
+				INSERT INTO scheduled_transfers (tenant_id, from_account_id, to_account_id, amount, execute_at, next_attempt_at, created_by,
+					standing_order_id, occurrence)
+				VALUES ($1, $2, $3, $4, $5, now(), $6, $7, $8) ON CONFLICT (standing_order_id, occurrence) DO NOTHING RETURNING id`,
+				o.TenantID, o.FromAccountID, o.ToAccountID, o.Amount, at, "standing-order/"+strconv.FormatInt(o.ID, 10), o.ID, o.Occurrence).
+				Scan(&stID); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				return err
+			}
+			o.Executions++
+			slog.Info("standing order occurrence scheduled", "standing_order_id", o.ID, "occurrence", o.Occurrence, "scheduled_transfer_id", stID)
+		}
+		o.advance(o.Occurrence + 1)
+		_, err = tx.Exec(ctx, `
+			UPDATE standing_orders SET status=$2, occurrence=$3, executions=$4, next_run_at=$5, updated_at=now() WHERE id=$1`,
+			o.ID, o.Status, o.Occurrence, o.Executions, o.NextRunAt)
+		return err
+	})
+	return done, err
+}
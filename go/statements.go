@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/ledger"
+)
+
+// GET /accounts/{id}/statements?month=2024-05 is the account's monthly
+// statement: the balance at the start of the month, every ledger entry in
+// it oldest first with the balance after each, and the balance at the end.
+// The month runs midnight to midnight in the tenant's time zone. The
+// opening balance is opening_balance plus every entry before the month, so
+// the statement is the ledger's own account of itself, compaction
+// summaries included, and all of it is read in one snapshot. The current
+// month is a statement so far; complete is false until the month ends on
+// the tenant's clock.
+//
+// ?format= picks json (the default), csv or pdf. CSV keeps amounts and
+// times in their machine forms so spreadsheets can sum them, with the
+// opening and closing balances as the first and last rows; PDF is the
+// customer's copy, in the tenant's locale.
+
+const (
+	statementFormatJSON = "json"
+	statementFormatCSV  = "csv"
+	statementFormatPDF  = "pdf"
+)
+
+type monthlyStatement struct {
+	AccountID      string          `json:"accountId"`
+	TenantID       string          `json:"tenantId"`
+	DisplayName    string          `json:"displayName,omitempty"`
+	Currency       string          `json:"currency"`
+	Month          string          `json:"month"`
+	From           time.Time       `json:"from"`
+	To             time.Time       `json:"to"`
+	Complete       bool            `json:"complete"`
+	OpeningBalance Money           `json:"openingBalance"`
+	Credits        Money           `json:"credits"`
+	Debits         Money           `json:"debits"`
+	ClosingBalance Money           `json:"closingBalance"`
+	Entries        []statementLine `json:"entries"`
+	Display        statementTotals `json:"display"`
+	GeneratedAt    time.Time       `json:"generatedAt"`
+}
+
+// statementLine is a ledger entry with the account's balance after it.
+type statementLine struct {
+	ledger.Transaction
+	BalanceAfter Money `json:"balanceAfter"`
+}
+
+type statementTotals struct {
+	Period         string `json:"period"`
+	OpeningBalance string `json:"openingBalance"`
+	Credits        string `json:"credits"`
+	Debits         string `json:"debits"`
+	ClosingBalance string `json:"closingBalance"`
+}
+
+func (s *Store) handleMonthlyStatement(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	month, err := time.Parse("2006-01", q.Get("month"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "month must be YYYY-MM"})
+		return
+	}
+	format := q.Get("format")
+	switch format {
+	case "":
+		format = statementFormatJSON
+	case statementFormatJSON, statementFormatCSV, statementFormatPDF:
+	default:
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "format must be json, csv or pdf"})
+		return
+	}
+	st, status, err := s.monthlyStatement(r.Context(), r.PathValue("id"), month)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			logger(r.Context()).Error("monthly statement failed", "account_id", r.PathValue("id"), "error", err)
+			http.Error(w, "failed to build statement", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, status, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	if format == statementFormatJSON {
+		writeJSON(w, http.StatusOK, st)
+		return
+	}
+	name := "statement-" + st.AccountID + "-" + st.Month + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if format == statementFormatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		if err := writeStatementCSV(w, st); err != nil {
+			logger(r.Context()).Warn("statement csv write failed", "account_id", st.AccountID, "error", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	if _, err := statementPDF(st, s.tenants.effective(st.TenantID).formatter()).WriteTo(w); err != nil {
+		logger(r.Context()).Warn("statement pdf write failed", "account_id", st.AccountID, "error", err)
+	}
+}
+
+// monthlyStatement builds the statement of the month starting at month's
+// first day in the account's tenant time zone.
+func (s *Store) monthlyStatement(ctx context.Context, id string, month time.Time) (monthlyStatement, int, error) {
+	ctx = withQueryPattern(ctx, patternStatements)
+	tx, err := s.beginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return monthlyStatement{}, http.StatusInternalServerError, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	st := monthlyStatement{AccountID: id, Month: month.Format("2006-01"), Entries: make([]statementLine, 0)}
+	var opening Money
+	err = tx.QueryRow(ctx, "SELECT tenant_id, display_name, currency, opening_balance FROM accounts WHERE id=$1", id).
+		Scan(&st.TenantID, &st.DisplayName, &st.Currency, &opening)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return monthlyStatement{}, http.StatusNotFound, errAccountNotFound
+	}
+	if err != nil {
+		return monthlyStatement{}, http.StatusInternalServerError, fmt.Errorf("load account: %w", err)
+	}
+	if p := principalFromContext(ctx); p != nil && p.Tenant != "" && p.Tenant != st.TenantID {
+		return monthlyStatement{}, http.StatusForbidden, errOtherTenant
+	}
+	cfg := s.tenants.effective(st.TenantID)
+	format := cfg.formatter()
+	now := s.clocks.now(st.TenantID)
+	st.From = time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, format.Location)
+	st.To = st.From.AddDate(0, 1, 0)
+	if st.From.After(now) {
+		return monthlyStatement{}, http.StatusBadRequest, errors.New("month has not started")
+	}
+	st.Complete = !now.Before(st.To)
+	st.GeneratedAt = now
+
+	var before Money
+	if err := tx.QueryRow(ctx, `
+		SELECT COALESCE(sum(CASE type WHEN 'CREDIT' THEN amount ELSE -amount END), 0) FROM ledger WHERE account_id=$1 AND at < $2`,
+		id, st.From).Scan(&before); err != nil {
+		return monthlyStatement{}, http.StatusInternalServerError, fmt.Errorf("sum entries before the month: %w", err)
+	}
+	st.OpeningBalance = opening + before
+
+	rows, err := tx.Query(ctx, `
+		SELECT l.id, l.type, l.amount, l.at, l.currency, l.fx_rate::text, l.summary_entries, l.summary_first_id,
+			to_char(l.summary_period, 'YYYY-MM'), l.transfer_id, l.counterparty_account_id, t.virtual_account_id, t.standing_order_id
+		FROM ledger l LEFT JOIN transfers t ON t.id = l.transfer_id
+		WHERE l.account_id=$1 AND l.at >= $2 AND l.at < $3 ORDER BY l.at, l.id`, id, st.From, st.To)
+	if err != nil {
+		return monthlyStatement{}, http.StatusInternalServerError, fmt.Errorf("load entries: %w", err)
+	}
+	var txs []ledger.Transaction
+	for rows.Next() {
+		var (
+			t             ledger.Transaction
+			summaryCount  *int64
+			summaryFirst  *int64
+			summaryPeriod *string
+		)
+		if err := rows.Scan(&t.ID, &t.Type, &t.Amount, &t.At, &t.Currency, &t.FxRate, &summaryCount, &summaryFirst, &summaryPeriod,
+			&t.TransactionID, &t.CounterpartyAccountID, &t.VirtualAccountID, &t.StandingOrderID); err != nil {
+			rows.Close()
+			return monthlyStatement{}, http.StatusInternalServerError, fmt.Errorf("scan entry: %w", err)
+		}
+		t.CounterpartyAccountID = publicAccountID(t.CounterpartyAccountID)
+		if summaryCount != nil {
+			t.Summary = &ledger.LedgerSummary{Entries: *summaryCount, FirstLedgerID: *summaryFirst, Period: *summaryPeriod}
+		}
+		txs = append(txs, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return monthlyStatement{}, http.StatusInternalServerError, fmt.Errorf("load entries: %w", err)
+	}
+	if err := s.enrichTransactions(ctx, id, cfg.Branding, txs); err != nil {
+		// statements stay usable without display info
+		logger(ctx).Warn("transaction enrichment failed", "account_id", id, "error", err)
+	}
+
+	balance := st.OpeningBalance
+	for _, t := range txs {
+		if t.Type == "CREDIT" {
+			balance += t.Amount
+			st.Credits += t.Amount
+		} else {
+			balance -= t.Amount
+			st.Debits += t.Amount
+		}
+		t.Display = &ledger.Display{Amount: format.Money(t.Amount, t.Currency), At: format.DateTime(t.At)}
+		st.Entries = append(st.Entries, statementLine{Transaction: t, BalanceAfter: balance})
+	}
+	st.ClosingBalance = balance
+	st.Display = statementTotals{Period: format.Date(st.From) + " - " + format.Date(st.To.Add(-time.Nanosecond)),
+		OpeningBalance: format.Money(st.OpeningBalance, st.Currency), Credits: format.Money(st.Credits, st.Currency),
+		Debits: format.Money(st.Debits, st.Currency), ClosingBalance: format.Money(st.ClosingBalance, st.Currency)}
+	return st, http.StatusOK, nil
+}
+
+// statementDescription is what a statement line says about an entry.
+func statementDescription(t ledger.Transaction) string {
+	switch {
+	case t.Summary != nil:
+		return fmt.Sprintf("%d entries of %s (compacted)", t.Summary.Entries, t.Summary.Period)
+	case t.Descriptor != "":
+		return t.Descriptor
+	case t.Counterparty != nil && t.Counterparty.Name != "":
+		return t.Counterparty.Name
+	case t.CounterpartyAccountID != nil:
+		return *t.CounterpartyAccountID
+	}
+	return strings.ToLower(t.Type)
+}
+
+func writeStatementCSV(w http.ResponseWriter, st monthlyStatement) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"ledger_id", "at", "type", "description", "counterparty_account_id", "transaction_id", "amount", "currency",
+		"balance"})
+	_ = cw.Write([]string{"", st.From.Format(time.RFC3339), "OPENING_BALANCE", "", "", "", "", st.Currency, st.OpeningBalance.String()})
+	for _, l := range st.Entries {
+		amount := l.Amount
+		if l.Type != "CREDIT" {
+			amount = -amount
+		}
+		var counterparty, transaction string
+		if l.CounterpartyAccountID != nil {
+			counterparty = *l.CounterpartyAccountID
+		}
+		if l.TransactionID != nil {
+			transaction = strconv.FormatInt(*l.TransactionID, 10)
+		}
+		_ = cw.Write([]string{strconv.FormatInt(l.ID, 10), l.At.Format(time.RFC3339), l.Type, statementDescription(l.Transaction),
+			counterparty, transaction, amount.String(), l.Currency, l.BalanceAfter.String()})
+	}
+	end := st.To
+	if !st.Complete {
+		end = st.GeneratedAt
+	}
+	_ = cw.Write([]string{"", end.Format(time.RFC3339), "CLOSING_BALANCE", "", "", "", "", st.Currency, st.ClosingBalance.String()})
+	cw.Flush()
+	return cw.Error()
+}
+
+// statementPDF lays the statement out as date, description, amount and
+// balance columns.
+func statementPDF(st monthlyStatement, format ledger.Formatter) *pdfDoc {
+	money := func(m Money) string {
+		// symbols WinAnsi cannot draw fall back to the plain amount and code
+		if v := format.Money(m, st.Currency); pdfEncodable(v) {
+			return v
+		}
+		return m.String() + " " + st.Currency
+	}
+	const dateWidth, amountWidth = 10, 20
+	descWidth := pdfColumns - dateWidth - 2*amountWidth - 3
+	row := func(date, desc, amount, balance string) string {
+		return pad(date, dateWidth, false) + " " + pad(desc, descWidth, false) + " " + pad(amount, amountWidth, true) + " " +
+			pad(balance, amountWidth, true)
+	}
+	d := &pdfDoc{}
+	title := "Statement " + st.Month
+	if !st.Complete {
+		title += " (to " + format.DateTime(st.GeneratedAt) + ")"
+	}
+	d.line(title, true)
+	name := st.AccountID
+	if st.DisplayName != "" {
+		name = st.DisplayName + " - " + st.AccountID
+	}
+	d.line(name, false)
+	d.line(st.Display.Period, false)
+	d.line("", false)
+	d.header = []pdfLine{{text: row("Date", "Description", "Amount", "Balance"), bold: true}}
+	d.line(d.header[0].text, true)
+	d.line(row(format.Date(st.From), "Opening balance", "", money(st.OpeningBalance)), false)
+	for _, l := range st.Entries {
+		amount := l.Amount
+		if l.Type != "CREDIT" {
+			amount = -amount
+		}
+		d.line(row(format.Date(l.At), statementDescription(l.Transaction), money(amount), money(l.BalanceAfter)), false)
+	}
+	d.line(row("", "Closing balance", "", money(st.ClosingBalance)), true)
+	d.line("", false)
+	d.line("Credits "+money(st.Credits)+"   Debits "+money(st.Debits), false)
+	return d
+}
+
+// pad cuts or pads s to width runes, on the left when right aligned.
+func pad(s string, width int, right bool) string {
+	n := utf8.RuneCountInString(s)
+	if n > width {
+		r := []rune(s)
+		return string(r[:width-1]) + "…"
+	}
+	fill := strings.Repeat(" ", width-n)
+	if right {
+		return fill + s
+	}
+	return s + fill
+}
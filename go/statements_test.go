@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fintech-go/internal/ledger"
+)
+
+// sampleStatement is May 2024 of an account with one credit from another
+// account and one debit with a descriptor.
+func sampleStatement() monthlyStatement {
+	from := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	other, txID := "acme-main", int64(77)
+	return monthlyStatement{
+		AccountID: "ops-float", DisplayName: "Operations float", Currency: "BRL", Month: "2024-05",
+		From: from, To: from.AddDate(0, 1, 0), Complete: true,
+		OpeningBalance: 100000, Credits: 2550, Debits: 123456, ClosingBalance: -20906,
+		Entries: []statementLine{
+			{Transaction: ledger.Transaction{ID: 10, Type: "CREDIT", Amount: 2550, At: from.Add(time.Hour), Currency: "BRL",
+				TransactionID: &txID, CounterpartyAccountID: &other}, BalanceAfter: 102550},
+			{Transaction: ledger.Transaction{ID: 11, Type: "DEBIT", Amount: 123456, At: from.Add(48 * time.Hour), Currency: "BRL",
+				Descriptor: "Card, \"ACME\""}, BalanceAfter: -20906},
+		},
+		Display:     statementTotals{Period: "01/05/2024 - 31/05/2024"},
+		GeneratedAt: time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestWriteStatementCSV(t *testing.T) {
+	tests := []struct {
+		name     string
+		complete bool
+		want     string
+	}{
+		{"complete", true, `ledger_id,at,type,description,counterparty_account_id,transaction_id,amount,currency,balance
+,2024-05-01T03:00:00Z,OPENING_BALANCE,,,,,BRL,1000.00
+10,2024-05-01T04:00:00Z,CREDIT,acme-main,acme-main,77,25.50,BRL,1025.50
+11,2024-05-03T03:00:00Z,DEBIT,"Card, ""ACME""",,,-1234.56,BRL,-209.06
+,2024-06-01T03:00:00Z,CLOSING_BALANCE,,,,,BRL,-209.06
+`},
+		// a month still running closes when the statement was generated
+		{"so far", false, `ledger_id,at,type,description,counterparty_account_id,transaction_id,amount,currency,balance
+,2024-05-01T03:00:00Z,OPENING_BALANCE,,,,,BRL,1000.00
+10,2024-05-01T04:00:00Z,CREDIT,acme-main,acme-main,77,25.50,BRL,1025.50
+11,2024-05-03T03:00:00Z,DEBIT,"Card, ""ACME""",,,-1234.56,BRL,-209.06
+,2024-05-20T12:00:00Z,CLOSING_BALANCE,,,,,BRL,-209.06
+`},
+	}
+	for _, tt := range tests {
+		st := sampleStatement()
+		st.Complete = tt.complete
+		w := httptest.NewRecorder()
+		if err := writeStatementCSV(w, st); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStatementDescription(t *testing.T) {
+	other := "acme-main"
+	tests := []struct {
+		tx   ledger.Transaction
+		want string
+	}{
+		{ledger.Transaction{Type: "DEBIT", Summary: &ledger.LedgerSummary{Entries: 12, Period: "2023-01"}, Descriptor: "ignored"},
+			"12 entries of 2023-01 (compacted)"},
+		{ledger.Transaction{Type: "DEBIT", Descriptor: "Card ACME", Counterparty: &ledger.Counterparty{Name: "Acme"}}, "Card ACME"},
+		{ledger.Transaction{Type: "CREDIT", Counterparty: &ledger.Counterparty{Name: "Acme"}, CounterpartyAccountID: &other}, "Acme"},
+		{ledger.Transaction{Type: "CREDIT", Counterparty: &ledger.Counterparty{}, CounterpartyAccountID: &other}, "acme-main"},
+		{ledger.Transaction{Type: "CREDIT"}, "credit"},
+	}
+	for _, tt := range tests {
+		if got := statementDescription(tt.tx); got != tt.want {
+			t.Errorf("statementDescription(%+v) = %q; want %q", tt.tx, got, tt.want)
+		}
+	}
+}
+
+func TestStatementPDF(t *testing.T) {
+	ptBR, _ := ledger.LookupLocale("pt-BR")
+	format := ledger.Formatter{Locale: ptBR}
+	tests := []struct {
+		name     string
+		currency string
+		complete bool
+		want     []string
+	}{
+		{"complete", "BRL", true, []string{
+			"Statement 2024-05",
+			"Operations float - ops-float",
+			"01/05/2024 Opening balance",
+			"01/05/2024 acme-main",
+			"R$\u00a025,50",
+			"-R$\u00a01.234,56",
+			"Closing balance",
+			"Credits R$\u00a025,50   Debits R$\u00a01.234,56",
+		}},
+		{"so far", "BRL", false, []string{"Statement 2024-05 (to 20/05/2024 12:00)"}},
+		// WinAnsi has no ₩, so amounts fall back to the plain form
+		{"no symbol", "KRW", true, []string{"-1234.56 KRW", "Credits 25.50 KRW"}},
+	}
+	for _, tt := range tests {
+		st := sampleStatement()
+		st.Currency, st.Complete = tt.currency, tt.complete
+		d := statementPDF(st, format)
+		var lines []string
+		for _, page := range d.pages {
+			for _, l := range page {
+				lines = append(lines, l.text)
+			}
+		}
+		text := strings.Join(lines, "\n")
+		for _, want := range tt.want {
+			if !strings.Contains(text, want) {
+				t.Errorf("%s: statement lacks %q:\n%s", tt.name, want, text)
+			}
+		}
+		for _, l := range lines {
+			if len([]rune(l)) > pdfColumns {
+				t.Errorf("%s: line wider than the page: %q", tt.name, l)
+			}
+		}
+	}
+}
+
+func TestPDFPages(t *testing.T) {
+	tests := []struct {
+		lines, pages int
+	}{
+		{0, 1},
+		{pdfLinesPerPage, 1},
+		{pdfLinesPerPage + 1, 2},
+		{3 * pdfLinesPerPage, 4}, // pages after the first repeat the header
+	}
+	for _, tt := range tests {
+		d := &pdfDoc{header: []pdfLine{{text: "Date", bold: true}}}
+		for i := 0; i < tt.lines; i++ {
+			d.line("row", false)
+		}
+		var buf bytes.Buffer
+		if _, err := d.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		out := buf.String()
+		if !strings.HasPrefix(out, "%PDF-1.4\n") || !strings.HasSuffix(out, "%%EOF\n") {
+			t.Errorf("%d lines: not a PDF:\n%s", tt.lines, out)
+		}
+		if want := fmt.Sprintf("/Count %d ", tt.pages); !strings.Contains(out, want) {
+			t.Errorf("%d lines: page tree lacks %q", tt.lines, want)
+		}
+		for i, page := range d.pages[min(1, len(d.pages)):] {
+			if page[0].text != "Date" {
+				t.Errorf("%d lines: page %d starts with %q, not the header", tt.lines, i+2, page[0].text)
+			}
+		}
+	}
+}
+
+func TestPDFString(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"Saldo (R$)", `(Saldo \(R$\))`, true},
+		{`a\b`, `(a\\b)`, true},
+		{"10 €", "(10 \x80)", true},
+		{"1\u202f234", "(1 234)", true},
+		{"São Paulo", "(S\xe3o Paulo)", true},
+		{"₩100", "(?100)", false},
+		{"中", "(?)", false},
+	}
+	for _, tt := range tests {
+		if got := pdfString(tt.in); got != tt.want {
+			t.Errorf("pdfString(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+		if got := pdfEncodable(tt.in); got != tt.ok {
+			t.Errorf("pdfEncodable(%q) = %t; want %t", tt.in, got, tt.ok)
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	tests := []struct {
+		in    string
+		width int
+		right bool
+		want  string
+	}{
+		{"abc", 5, false, "abc  "},
+		{"abc", 5, true, "  abc"},
+		{"abcde", 5, false, "abcde"},
+		{"abcdef", 5, false, "abcd…"},
+		{"R$\u00a01,00", 7, true, "R$\u00a01,00"},
+		{"ção", 4, true, " ção"},
+	}
+	for _, tt := range tests {
+		if got := pad(tt.in, tt.width, tt.right); got != tt.want {
+			t.Errorf("pad(%q, %d, %t) = %q; want %q", tt.in, tt.width, tt.right, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GET /debug/state reports aggregate statistics, gathered by one query and
+// cached for DEBUG_STATS_TTL (5s by default). Concurrent requests for an
+// expired snapshot wait for a single refresh instead of each running the
+// query. The response is:
+//
+//	{
+//	  "generatedAt": "2024-05-01T12:00:00Z",
+//	  "accounts": {
+//	    "total": 1200,
+//	    "byStatus": {"active": 1180, "frozen": 20},
+//	    "balances": [{"currency": "BRL", "accounts": 1200, "total": "152300.00"}]
+//	  },
+//	  "ledger": {"entries": 10000, "estimated": true, "lastId": 48211934, "latest": [{"type": "DEBIT", ...}]},
+//	  "processedOps": {"count": 734, "estimated": false, "latest": ["op-1", ...]}
+//	}
+//
+// Counts are exact up to statsExactLimit rows; past that they are the
+// planner's estimate from the last ANALYZE and flagged estimated, since an
+// exact count would scan the whole table. latest holds the newest
+// statsLatest ledger entries and operation ids. Individual balances are
+// not listed; GET /accounts pages through them.
+
+const (
+	statsExactLimit = 10000
+	statsLatest     = 100
+)
+
+type debugStats struct {
+	GeneratedAt  time.Time         `json:"generatedAt"`
+	Accounts     accountStats      `json:"accounts"`
+	Ledger       ledgerStats       `json:"ledger"`
+	ProcessedOps processedOpsStats `json:"processedOps"`
+}
+
+type accountStats struct {
+	Total    int64            `json:"total"`
+	ByStatus map[string]int64 `json:"byStatus"`
+	Balances []currencyTotal  `json:"balances"`
+}
+
+type currencyTotal struct {
+	Currency string `json:"currency"`
+	Accounts int64  `json:"accounts"`
+	Total    Money  `json:"total"`
+}
+
+type ledgerStats struct {
+	Entries   int64         `json:"entries"`
+	Estimated bool          `json:"estimated"`
+	LastID    int64         `json:"lastId"`
+	Latest    []LedgerEntry `json:"latest"`
+}
+
+type processedOpsStats struct {
+	Count     int64    `json:"count"`
+	Estimated bool     `json:"estimated"`
+	Latest    []string `json:"latest"`
+}
+
+type statsCache struct {
+	ttl time.Duration
+	// mu is held while refreshing, so one query serves every waiting request.
+	mu   sync.Mutex
+	last atomic.Pointer[debugStats]
+}
+
+func (c *statsCache) get(ctx context.Context, s *Store) (*debugStats, error) {
+	fresh := func() *debugStats {
+		if st := c.last.Load(); st != nil && time.Since(st.GeneratedAt) < c.ttl {
+			return st
+		}
+		return nil
+	}
+	if st := fresh(); st != nil {
+		return st, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st := fresh(); st != nil {
+		return st, nil
+	}
+	st, err := s.loadStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.last.Store(st)
+	return st, nil
+}
+
+func (s *Store) loadStats(ctx context.Context) (*debugStats, error) {
+	var (
+		groups []struct {
+			Currency string `json:"currency"`
+			Status   string `json:"status"`
+			Accounts int64  `json:"accounts"`
+			Total    Money  `json:"total"`
+		}
+		ledgerCount, opsCount       int64
+		ledgerEstimate, opsEstimate float64
+	)
+	st := &debugStats{GeneratedAt: time.Now().UTC()}
+	err := s.pool.QueryRow(ctx, `
+		WITH account_groups AS (
+			SELECT currency, status, count(*) AS accounts, sum(balance) AS total FROM accounts GROUP BY currency, status
+		)
+		SELECT
+			COALESCE((SELECT jsonb_agg(to_jsonb(g) ORDER BY currency, status) FROM account_groups g), '[]'),
+			(SELECT count(*) FROM (SELECT 1 FROM ledger LIMIT $1) l),
+			(SELECT reltuples::float8 FROM pg_class WHERE oid = 'ledger'::regclass),
+			COALESCE((SELECT max(id) FROM ledger), 0),
+			COALESCE((SELECT jsonb_agg(jsonb_build_object('type', type, 'accountId', account_id, 'amount', amount, 'at', at) ORDER BY id DESC)
+				FROM (SELECT id, type, account_id, amount, at FROM ledger ORDER BY id DESC LIMIT $2) l), '[]'),
+			(SELECT count(*) FROM (SELECT 1 FROM processed_ops LIMIT $1) p),
+			(SELECT reltuples::float8 FROM pg_class WHERE oid = 'processed_ops'::regclass),
+			COALESCE((SELECT jsonb_agg(operation_id ORDER BY created_at DESC)
+				FROM (SELECT operation_id, created_at FROM processed_ops ORDER BY created_at DESC LIMIT $2) p), '[]')`,
+		statsExactLimit, statsLatest).
+		Scan(&groups, &ledgerCount, &ledgerEstimate, &st.Ledger.LastID, &st.Ledger.Latest, &opsCount, &opsEstimate, &st.ProcessedOps.Latest)
+	if err != nil {
+		return nil, err
+	}
+	st.Ledger.Entries, st.Ledger.Estimated = statsCount(ledgerCount, ledgerEstimate)
+	st.ProcessedOps.Count, st.ProcessedOps.Estimated = statsCount(opsCount, opsEstimate)
+
+	st.Accounts.ByStatus = map[string]int64{}
+	st.Accounts.Balances = make([]currencyTotal, 0)
+	for _, g := range groups {
+		st.Accounts.Total += g.Accounts
+		st.Accounts.ByStatus[g.Status] += g.Accounts
+		if n := len(st.Accounts.Balances); n > 0 && st.Accounts.Balances[n-1].Currency == g.Currency {
+			st.Accounts.Balances[n-1].Accounts += g.Accounts
+			st.Accounts.Balances[n-1].Total += g.Total
+			continue
+		}
+		st.Accounts.Balances = append(st.Accounts.Balances, currencyTotal{Currency: g.Currency, Accounts: g.Accounts, Total: g.Total})
+	}
+	return st, nil
+}
+
+// statsCount is the exact count while it stayed under statsExactLimit, and
+// the planner's estimate (never below the limit) otherwise. reltuples is -1
+// for a table never analyzed.
+func statsCount(exact int64, estimate float64) (int64, bool) {
+	if exact < statsExactLimit {
+		return exact, false
+	}
+	return int64(max(estimate, statsExactLimit)), true
+}
+
+func (s *Store) handleDebug(w http.ResponseWriter, r *http.Request) {
+	st, err := s.stats.get(r.Context(), s)
+	if err != nil {
+		http.Error(w, "failed to load stats", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(st.GeneratedAt).Seconds())))
+	writeJSON(w, http.StatusOK, st)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/ledger"
+)
+
+// suspenseAccountID holds inbound funds that could not be matched to a
+// customer account. Each posting is a suspense item in a work queue that an
+// operator resolves by allocating it to the right account or returning it to
+// the sender, so unmatched money is always visible instead of rejected.
+const suspenseAccountID = "SUSPENSE"
+
+const (
+	suspenseOpen         = "open"
+	suspenseResolving    = "resolving"
+	suspenseAllocated    = "allocated"
+	suspenseReturned     = "returned"
+	suspenseMaxReference = 64
+)
+
+type inboundCredit struct {
+	Reference   string `json:"reference"`
+	Amount      Money  `json:"amount"`
+	OperationID string `json:"operationId"`
+	Source      string `json:"source"`
+}
+
+// handleInboundCredit books a top-up notified by a bank or acquirer. The
+// reference is the account the payer was told to quote; when it names no
+// open account the funds go to suspense. Risk rules do not run: the money has
+// already arrived, and holding it is what suspense is for.
+func (s *Store) handleInboundCredit(w http.ResponseWriter, r *http.Request) {
+	var in inboundCredit
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		if errors.Is(err, ledger.ErrTooPrecise) {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+			return
+		}
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if in.OperationID == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "operationId is required"})
+		return
+	}
+	if in.Amount <= 0 {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "amount must be > 0"})
+		return
+	}
+	if len(in.Reference) > suspenseMaxReference {
+		in.Reference = in.Reference[:suspenseMaxReference]
+	}
+	ctx := withMeta(r.Context(), metaFromRequest(r))
+
+	target, virtual, reason, err := s.matchInbound(ctx, in.Reference)
+	if err != nil {
+		http.Error(w, "failed to match reference", http.StatusInternalServerError)
+		return
+	}
+	req := TransferRequest{FromAccountID: settlementAccountID, ToAccountID: target, Amount: in.Amount, OperationID: in.OperationID, virtualAccount: virtual}
+	resp, status, err := s.runTransfer(onBehalfOf(ctx, ""), req, false)
+	if err != nil {
+		logger(ctx).Error("inbound credit failed", "operation_id", req.OperationID, "error", err)
+		if errors.Is(err, errOperationInFlight) {
+			w.Header().Set("Location", "/operations/"+url.PathEscape(req.OperationID))
+		}
+		writeJSON(w, status, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	if target == suspenseAccountID && status == http.StatusOK {
+		// ON CONFLICT keeps replays of the same notification from queueing
+		// the item twice
+		tag, err := s.pool.Exec(ctx, `
+			INSERT INTO suspense_items (operation_id, reference, amount, source, reason, status)
+			VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (operation_id) DO NOTHING`,
+			in.OperationID, in.Reference, in.Amount, in.Source, reason, suspenseOpen)
+		if err != nil {
+			logger(ctx).Error("suspense item not recorded", "operation_id", in.OperationID, "error", err)
+		} else if tag.RowsAffected() > 0 {
+			suspensePostings.WithLabelValues(reason).Inc()
+			logger(ctx).Info("inbound credit posted to suspense", "operation_id", in.OperationID, "reference", in.Reference, "reason", reason)
+		}
+	}
+	writeTransfer(w, status, resp)
+	s.markJournal(ctx, req.OperationID, journalResponded, "")
+}
+
+// matchInbound resolves a payer reference to the account to credit, or to
+// the suspense account with the reason it did not match. A reference that
+// is a virtual account number resolves to its real account and is returned
+// as virtual so the posting records it.
+func (s *Store) matchInbound(ctx context.Context, reference string) (target, virtual, reason string, err error) {
+	if reference == "" {
+		return suspenseAccountID, "", "missing_reference", nil
+	}
+	if isSystemAccount(reference) {
+		return suspenseAccountID, "", "unknown_reference", nil
+	}
+	accountID := reference
+	if strings.HasPrefix(reference, "VA") {
+		id, why, err := s.resolveVirtualAccount(ctx, reference)
+		if err != nil {
+			return "", "", "", err
+		}
+		if why != "" {
+			return suspenseAccountID, "", why, nil
+		}
+		accountID, virtual = id, reference
+	}
+	var status string
+	err = s.pool.QueryRow(ctx, "SELECT status FROM accounts WHERE id=$1", accountID).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return suspenseAccountID, "", "unknown_reference", nil
+	}
+	if err != nil {
+		return "", "", "", err
+	}
+	if status == accountClosed {
+		return suspenseAccountID, "", "account_closed", nil
+	}
+	return accountID, virtual, "", nil
+}
+
+type suspenseItem struct {
+	ID          int64      `json:"id"`
+	OperationID string     `json:"operationId"`
+	Reference   string     `json:"reference"`
+	Amount      Money      `json:"amount"`
+	Source      string     `json:"source,omitempty"`
+	Reason      string     `json:"reason"`
+	Status      string     `json:"status"`
+	AccountID   *string    `json:"accountId,omitempty"`
+	ResolvedBy  *string    `json:"resolvedBy,omitempty"`
+	Note        *string    `json:"note,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ResolvedAt  *time.Time `json:"resolvedAt,omitempty"`
+}
+
+const suspenseColumns = "id, operation_id, reference, amount, source, reason, status, account_id, resolved_by, note, created_at, resolved_at"
+
+func scanSuspenseItem(row pgx.Row) (suspenseItem, error) {
+	var it suspenseItem
+	err := row.Scan(&it.ID, &it.OperationID, &it.Reference, &it.Amount, &it.Source, &it.Reason, &it.Status,
+		&it.AccountID, &it.ResolvedBy, &it.Note, &it.CreatedAt, &it.ResolvedAt)
+	return it, err
+}
+
+func (s *Store) handleSuspenseItems(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = suspenseOpen
+	}
+	rows, err := s.pool.Query(r.Context(), "SELECT "+suspenseColumns+" FROM suspense_items WHERE status=$1 ORDER BY id LIMIT 500", status)
+	if err != nil {
+		http.Error(w, "failed to load suspense items", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	items := make([]suspenseItem, 0)
+	for rows.Next() {
+		it, err := scanSuspenseItem(rows)
+		if err != nil {
+			http.Error(w, "failed to parse suspense items", http.StatusInternalServerError)
+			return
+		}
+		items = append(items, it)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "failed to load suspense items", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+type suspenseResolution struct {
+	AccountID string `json:"accountId"`
+	Actor     string `json:"actor"`
+	Note      string `json:"note"`
+}
+
+// handleAllocateSuspense moves an item's funds to the account the operator
+// identified.
+func (s *Store) handleAllocateSuspense(w http.ResponseWriter, r *http.Request) {
+	s.resolveSuspense(w, r, suspenseAllocated)
+}
+
+// handleReturnSuspense sends an item's funds back out through settlement,
+// for payments that belong to nobody here.
+func (s *Store) handleReturnSuspense(w http.ResponseWriter, r *http.Request) {
+	s.resolveSuspense(w, r, suspenseReturned)
+}
+
+// resolveSuspense claims an open item, moves its funds out of suspense and
+// records the outcome. The movement uses a deterministic operationId, so a
+// resolution retried after a crash cannot move the funds twice; a failed
+// movement puts the item back in the queue.
+func (s *Store) resolveSuspense(w http.ResponseWriter, r *http.Request, outcome string) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid item id", http.StatusBadRequest)
+		return
+	}
+	var res suspenseResolution
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if res.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	target := settlementAccountID
+	if outcome == suspenseAllocated {
+		if res.AccountID == "" || isSystemAccount(res.AccountID) {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "accountId of a customer account is required"})
+			return
+		}
+		target = res.AccountID
+	}
+
+	ctx := withMeta(r.Context(), metaFromRequest(r))
+	it, err := scanSuspenseItem(s.pool.QueryRow(ctx, `
+		UPDATE suspense_items SET status=$2 WHERE id=$1 AND status=$3 RETURNING `+suspenseColumns,
+		id, suspenseResolving, suspenseOpen))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: "item is not open"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load suspense item", http.StatusInternalServerError)
+		return
+	}
+
+	req := TransferRequest{
+		FromAccountID: suspenseAccountID,
+		ToAccountID:   target,
+		Amount:        it.Amount,
+		OperationID:   fmt.Sprintf("suspense-%d-%s", it.ID, outcome),
+	}
+	_, status, txErr := s.runTransfer(onBehalfOf(ctx, ""), req, false)
+	if txErr != nil {
+		if _, err := s.pool.Exec(context.WithoutCancel(ctx), "UPDATE suspense_items SET status=$2 WHERE id=$1", id, suspenseOpen); err != nil {
+			logger(ctx).Error("reopen suspense item", "item_id", id, "error", err)
+		}
+		writeJSON(w, status, TransferResponse{Status: "error", Message: txErr.Error()})
+		return
+	}
+	s.markJournal(ctx, req.OperationID, journalResponded, "")
+	it, err = scanSuspenseItem(s.pool.QueryRow(context.WithoutCancel(ctx), `
+		UPDATE suspense_items SET status=$2, account_id=$3, resolved_by=$4, note=NULLIF($5, ''), resolved_at=now()
+		WHERE id=$1 RETURNING `+suspenseColumns, id, outcome, target, res.Actor, res.Note))
+	if err != nil {
+		logger(ctx).Error("record suspense resolution", "item_id", id, "outcome", outcome, "error", err)
+		http.Error(w, "funds moved but item not updated", http.StatusInternalServerError)
+		return
+	}
+	logger(ctx).Info("suspense item resolved", "item_id", id, "outcome", outcome, "account_id", target, "actor", res.Actor)
+	writeJSON(w, http.StatusOK, it)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// A sweep rule keeps an account's end-of-day balance within a band by moving
+// money to or from a linked account of the same tenant: anything above
+// maxBalance is swept out, and a balance below minBalance is topped up from
+// the linked account as far as its funds allow. Balances are available
+// balances, net of holds. Rules run in the nightly balance_sweeps job.
+
+type sweepRule struct {
+	AccountID       string    `json:"accountId"`
+	LinkedAccountID string    `json:"linkedAccountId"`
+	MaxBalance      *Money    `json:"maxBalance,omitempty"`
+	MinBalance      *Money    `json:"minBalance,omitempty"`
+	UpdatedBy       string    `json:"updatedBy"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+type putSweepRequest struct {
+	LinkedAccountID string `json:"linkedAccountId"`
+	MaxBalance      *Money `json:"maxBalance"`
+	MinBalance      *Money `json:"minBalance"`
+	Actor           string `json:"actor"`
+}
+
+func (req putSweepRequest) validate(accountID string) error {
+	if req.Actor == "" {
+		return fmt.Errorf("actor is required")
+	}
+	if req.LinkedAccountID == "" || req.LinkedAccountID == accountID || isSystemAccount(req.LinkedAccountID) {
+		return fmt.Errorf("linkedAccountId must be another customer account")
+	}
+	if req.MaxBalance == nil && req.MinBalance == nil {
+		return fmt.Errorf("maxBalance or minBalance is required")
+	}
+	if req.MaxBalance != nil && req.MinBalance != nil && *req.MinBalance > *req.MaxBalance {
+		return fmt.Errorf("minBalance must not exceed maxBalance")
+	}
+	if (req.MaxBalance != nil && *req.MaxBalance < 0) || (req.MinBalance != nil && *req.MinBalance < 0) {
+		return fmt.Errorf("thresholds must be >= 0")
+	}
+	return nil
+}
+
+func (s *Store) handlePutSweep(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req putSweepRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(id); err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx := r.Context()
+	var (
+		tenant     string
+		sameTenant bool
+	)
+	err := s.pool.QueryRow(ctx, `
+		SELECT a.tenant_id, a.tenant_id = l.tenant_id FROM accounts a, accounts l
+		WHERE a.id=$1 AND l.id=$2 AND a.status<>$3 AND l.status<>$3`, id, req.LinkedAccountID, accountClosed).Scan(&tenant, &sameTenant)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "account or linked account not found or closed"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load accounts", http.StatusInternalServerError)
+		return
+	}
+	if !sameTenant {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "linked account belongs to another tenant"})
+		return
+	}
+	if !s.tenants.effective(tenant).enabled(featureSweeps) {
+		writeJSON(w, http.StatusForbidden, TransferResponse{Status: "error", Message: "sweeps are not enabled for this tenant"})
+		return
+	}
+
+	var rule sweepRule
+	err = s.pool.QueryRow(ctx, `
+		INSERT INTO sweep_rules (account_id, linked_account_id, max_balance, min_balance, updated_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (account_id) DO UPDATE SET linked_account_id=EXCLUDED.linked_account_id,
+			max_balance=EXCLUDED.max_balance, min_balance=EXCLUDED.min_balance,
+			updated_by=EXCLUDED.updated_by, updated_at=now()
+		RETURNING account_id, linked_account_id, max_balance, min_balance, updated_by, updated_at`,
+		id, req.LinkedAccountID, req.MaxBalance, req.MinBalance, req.Actor).
+		Scan(&rule.AccountID, &rule.LinkedAccountID, &rule.MaxBalance, &rule.MinBalance, &rule.UpdatedBy, &rule.UpdatedAt)
+	if err != nil {
+		http.Error(w, "failed to save sweep rule", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("sweep rule set", "account_id", id, "actor", req.Actor, "linked_account_id", req.LinkedAccountID)
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func (s *Store) handleGetSweep(w http.ResponseWriter, r *http.Request) {
+	var rule sweepRule
+	err := s.pool.QueryRow(r.Context(), `
+		SELECT account_id, linked_account_id, max_balance, min_balance, updated_by, updated_at
+		FROM sweep_rules WHERE account_id=$1`, r.PathValue("id")).
+		Scan(&rule.AccountID, &rule.LinkedAccountID, &rule.MaxBalance, &rule.MinBalance, &rule.UpdatedBy, &rule.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "no sweep rule for account"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load sweep rule", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func (s *Store) handleDeleteSweep(w http.ResponseWriter, r *http.Request) {
+	tag, err := s.pool.Exec(r.Context(), "DELETE FROM sweep_rules WHERE account_id=$1", r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "failed to delete sweep rule", http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "no sweep rule for account"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type sweepResult struct {
+	Rules   int            `json:"rules"`
+	Swept   int            `json:"swept"`
+	Moved   Money          `json:"moved"`
+	Skipped map[string]int `json:"skipped"`
+	Failed  []sweepFailure `json:"failed"`
+	Planned []plannedSweep `json:"planned,omitempty"`
+}
+
+type sweepFailure struct {
+	AccountID string `json:"accountId"`
+	Error     string `json:"error"`
+}
+
+type plannedSweep struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount Money  `json:"amount"`
+}
+
+// runSweeps is the balance_sweeps job. Each movement's operationId is keyed
+// by account and business date (the job's creation day, UTC), so re-running
+// the night's job cannot sweep an account twice. Amounts come from balances
+// read just before the transfer; a payment landing in between only shifts
+// the result by that payment and is corrected the next night.
+func (s *Store) runSweeps(ctx context.Context, j *job) (any, error) {
+	res := sweepResult{Skipped: map[string]int{}, Failed: make([]sweepFailure, 0)}
+	day := j.CreatedAt.UTC().Format("2006-01-02")
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT r.account_id, r.linked_account_id, r.max_balance, r.min_balance, a.balance - a.held, a.status, l.balance - l.held, l.status, a.tenant_id
+		FROM sweep_rules r JOIN accounts a ON a.id = r.account_id JOIN accounts l ON l.id = r.linked_account_id
+		ORDER BY r.account_id`)
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		rule                 sweepRule
+		balance, linked      Money
+		status, linkedStatus string
+		tenant               string
+	}
+	var cands []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.rule.AccountID, &c.rule.LinkedAccountID, &c.rule.MaxBalance, &c.rule.MinBalance,
+			&c.balance, &c.status, &c.linked, &c.linkedStatus, &c.tenant); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		cands = append(cands, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	res.Rules = len(cands)
+	j.progress(ctx, 0, int64(len(cands)))
+
+	for i, c := range cands {
+		var mv plannedSweep
+		switch {
+		case !s.tenants.effective(c.tenant).enabled(featureSweeps):
+			// rules survive a disabled feature and resume when it is back
+			res.Skipped["feature_disabled"]++
+		case c.status != accountActive || c.linkedStatus != accountActive:
+			res.Skipped["account_not_active"]++
+		case c.rule.MaxBalance != nil && c.balance > *c.rule.MaxBalance:
+			mv = plannedSweep{From: c.rule.AccountID, To: c.rule.LinkedAccountID, Amount: c.balance - *c.rule.MaxBalance}
+		case c.rule.MinBalance != nil && c.balance < *c.rule.MinBalance:
+			mv = plannedSweep{From: c.rule.LinkedAccountID, To: c.rule.AccountID, Amount: min(*c.rule.MinBalance-c.balance, c.linked)}
+			if mv.Amount <= 0 {
+				res.Skipped["linked_account_empty"]++
+			}
+		default:
+			res.Skipped["within_band"]++
+		}
+		if mv.Amount > 0 {
+			if j.DryRun {
+				res.Planned = append(res.Planned, mv)
+				res.Swept++
+				res.Moved += mv.Amount
+			} else {
+				req := TransferRequest{
+					FromAccountID: mv.From,
+					ToAccountID:   mv.To,
+					Amount:        mv.Amount,
+					OperationID:   "sweep-" + c.rule.AccountID + "-" + day,
+					internal:      true,
+				}
+				if _, _, err := s.runTransfer(ctx, req, false); err != nil {
+					res.Failed = append(res.Failed, sweepFailure{AccountID: c.rule.AccountID, Error: err.Error()})
+				} else {
+					s.markJournal(ctx, req.OperationID, journalResponded, "")
+					res.Swept++
+					res.Moved += mv.Amount
+				}
+			}
+		}
+		j.progress(ctx, int64(i+1), int64(len(cands)))
+	}
+	if len(res.Failed) > 0 {
+		return res, fmt.Errorf("%d sweep(s) failed", len(res.Failed))
+	}
+	return res, nil
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"fintech-go/internal/ledger"
+)
+
+// Message templates customize what tenants' customers receive: "email"
+// templates render notification emails (a subject and a plain-text body)
+// and "webhook" templates replace the body of webhook deliveries. They are
+// Go text/templates named after the event they render, executed with a
+// templateData; a field the event does not have is an error rather than an
+// empty string, so a typo fails the preview instead of reaching customers.
+// Webhook templates must produce JSON: the json function quotes a value,
+// as in {"amount": {{json .Data.amount}}}.
+//
+// Tenants' templates are versioned like rule sets: each save is a new
+// inactive version, previewed with sample or given data and test-sent to
+// an address, then activated; activating an older version rolls back.
+// Events without an active tenant version use the defaults embedded from
+// templates/<channel>/<event>.tmpl, defining "subject" and "body", or no
+// template at all. Active versions are cached and reloaded every
+// TEMPLATE_REFRESH_INTERVAL (default 30s).
+//
+// Test sends go through SMTP_ADDR as SMTP_FROM, authenticating with
+// SMTP_USERNAME and SMTP_PASSWORD when set.
+
+const (
+	channelEmail   = "email"
+	channelWebhook = "webhook"
+
+	maxMessageTemplate = 64 << 10
+	maxRenderedMessage = 256 << 10
+)
+
+// templateData is what a template is executed with.
+type templateData struct {
+	// Event is the event type, and Data its payload.
+	Event  string         `json:"event"`
+	Tenant string         `json:"tenant"`
+	Data   map[string]any `json:"data"`
+	// Support is the tenant's branded support contact, if any.
+	Support *supportContact `json:"support,omitempty"`
+	// ID, Version and CreatedAt describe a webhook delivery.
+	ID        int64     `json:"id,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+
+	format ledger.Formatter
+}
+
+// Money formats an amount in the tenant's locale, as in
+// {{.Money .Data.amount .Data.currency}}: "R$ 10,50" for pt-BR. The
+// currency defaults to the service currency.
+func (d templateData) Money(amount any, code ...string) (string, error) {
+	c := serviceCurrency
+	if len(code) > 0 {
+		c = strings.ToUpper(code[0])
+	}
+	if _, err := currency(c); err != nil {
+		return "", err
+	}
+	m, err := ledger.ParseMoney(fmt.Sprint(amount), moneyExponent)
+	if err != nil {
+		return "", err
+	}
+	return d.format.Money(m, c), nil
+}
+
+// Date and DateTime format an RFC 3339 timestamp in the tenant's locale
+// and time zone, as in {{.DateTime .Data.at}}.
+func (d templateData) Date(v any) (string, error) {
+	t, err := time.Parse(time.RFC3339Nano, fmt.Sprint(v))
+	if err != nil {
+		return "", err
+	}
+	return d.format.Date(t), nil
+}
+
+func (d templateData) DateTime(v any) (string, error) {
+	t, err := time.Parse(time.RFC3339Nano, fmt.Sprint(v))
+	if err != nil {
+		return "", err
+	}
+	return d.format.DateTime(t), nil
+}
+
+// templateSamples are the events templates can be written for, with the
+// data previews use by default.
+var templateSamples = map[string]map[string]any{
+	"transfer.completed": {"transferId": 1, "operationId": "op-1", "fromAccountId": "A", "toAccountId": "B",
+		"amount": json.Number("10.50"), "currency": "BRL", "destinationAmount": json.Number("10.50"), "destinationCurrency": "BRL",
+		"receiptNumber": "RCP-2026-000001", "at": "2026-03-14T15:09:26Z"},
+	webhookTransferReceived: {"transferId": 1, "fromAccountId": "A", "toAccountId": "B", "amount": json.Number("10.50"),
+		"currency": "BRL", "destinationAmount": json.Number("10.50"), "destinationCurrency": "BRL",
+		"receiptNumber": "RCP-2026-000001", "at": "2026-03-14T15:09:26Z"},
+	"transfer.failed": {"operationId": "op-2", "fromAccountId": "A", "toAccountId": "B", "amount": json.Number("9999.99"),
+		"result": "insufficient_funds", "message": "insufficient funds"},
+	"deposit.completed": {"transferId": 3, "operationId": "dep-1", "fromAccountId": settlementAccountID, "toAccountId": "A",
+		"amount": json.Number("250.00"), "currency": "BRL", "receiptNumber": "RCP-2026-000003", "at": "2026-03-14T15:09:26Z"},
+	"deposit.failed": {"operationId": "dep-2", "fromAccountId": settlementAccountID, "toAccountId": "A", "amount": json.Number("250.00"),
+		"result": "not_found", "message": "account not found"},
+	"withdrawal.completed": {"transferId": 4, "operationId": "wd-1", "fromAccountId": "A", "toAccountId": settlementAccountID,
+		"amount": json.Number("50.00"), "currency": "BRL", "receiptNumber": "RCP-2026-000004", "at": "2026-03-14T15:09:26Z"},
+	"withdrawal.failed": {"operationId": "wd-2", "fromAccountId": "A", "toAccountId": settlementAccountID, "amount": json.Number("50.00"),
+		"result": "insufficient_funds", "message": "insufficient funds"},
+	"payout.returned": {"accountId": "A", "payoutId": 7, "amount": json.Number("120.00"), "reasonCode": "AC04",
+		"creditedTo": "A", "receiptNumber": "RCP-2026-000007"},
+	"transfer.expired": {"state": "review", "operationId": "op-3", "accountId": "A", "ttl": "24h0m0s"},
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	// money renders a decimal amount with the currency's own decimals, as
+	// in {{money .Data.amount .Data.currency}}: "1500" for JPY.
+	"money": func(amount any, code string) (string, error) {
+		c, err := currency(code)
+		if err != nil {
+			return "", err
+		}
+		m, err := ledger.ParseMoney(fmt.Sprint(amount), moneyExponent)
+		if err != nil {
+			return "", err
+		}
+		return c.Format(m), nil
+	},
+	// date reformats an RFC 3339 timestamp with a Go layout.
+	"date": func(layout string, v any) (string, error) {
+		t, err := time.Parse(time.RFC3339Nano, fmt.Sprint(v))
+		if err != nil {
+			return "", err
+		}
+		return t.Format(layout), nil
+	},
+}
+
+type messageTemplate struct {
+	Tenant      string     `json:"tenant"`
+	Channel     string     `json:"channel"`
+	Name        string     `json:"name"`
+	Version     int        `json:"version"`
+	Subject     string     `json:"subject,omitempty"`
+	Body        string     `json:"body"`
+	Active      bool       `json:"active"`
+	CreatedBy   string     `json:"createdBy"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ActivatedBy *string    `json:"activatedBy,omitempty"`
+	ActivatedAt *time.Time `json:"activatedAt,omitempty"`
+
+	compiled *template.Template
+}
+
+// compileTemplate parses a subject and body into one template with
+// "subject" and "body" defined.
+func compileTemplate(channel, name, subject, body string) (*template.Template, error) {
+	if len(subject)+len(body) > maxMessageTemplate {
+		return nil, fmt.Errorf("template must be at most %d bytes", maxMessageTemplate)
+	}
+	t := template.New(name).Funcs(templateFuncs).Option("missingkey=error")
+	if channel == channelEmail {
+		if strings.TrimSpace(subject) == "" {
+			return nil, errors.New("email templates need a subject")
+		}
+		if _, err := t.New("subject").Parse(subject); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := t.New("body").Parse(body); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// renderedMessage is a template's output.
+type renderedMessage struct {
+	Subject string `json:"subject,omitempty"`
+	Body    string `json:"body"`
+	// Version is the tenant version rendered; 0 for a built-in default.
+	Version int `json:"version"`
+}
+
+func renderMessage(t *template.Template, channel string, data templateData) (renderedMessage, error) {
+	var out renderedMessage
+	exec := func(name string) (string, error) {
+		var b bytes.Buffer
+		if err := t.ExecuteTemplate(&limitedBuffer{Buffer: &b, max: maxRenderedMessage}, name, data); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+	var err error
+	if channel == channelEmail {
+		if out.Subject, err = exec("subject"); err != nil {
+			return out, err
+		}
+		// a subject is a header: one line
+		out.Subject = strings.Join(strings.Fields(out.Subject), " ")
+	}
+	if out.Body, err = exec("body"); err != nil {
+		return out, err
+	}
+	if channel == channelEmail {
+		out.Body = strings.TrimSpace(out.Body) + "\n"
+	}
+	if channel == channelWebhook && !json.Valid([]byte(out.Body)) {
+		return out, errors.New("webhook template did not render valid JSON")
+	}
+	return out, nil
+}
+
+type limitedBuffer struct {
+	*bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		return 0, fmt.Errorf("rendered message exceeds %d bytes", b.max)
+	}
+	return b.Buffer.Write(p)
+}
+
+//go:embed templates
+var defaultTemplateFiles embed.FS
+
+var defaultTemplates = mustLoadDefaultTemplates(defaultTemplateFiles)
+
+func mustLoadDefaultTemplates(fsys fs.FS) map[string]*template.Template {
+	names, err := fs.Glob(fsys, "templates/*/*.tmpl")
+	if err != nil {
+		panic(err)
+	}
+	out := map[string]*template.Template{}
+	for _, name := range names {
+		channel, event := path.Base(path.Dir(name)), strings.TrimSuffix(path.Base(name), ".tmpl")
+		t, err := template.New(event).Funcs(templateFuncs).Option("missingkey=error").ParseFS(fsys, name)
+		if err != nil {
+			panic(fmt.Sprintf("template %s: %v", name, err))
+		}
+		out[channel+"/"+event] = t
+	}
+	return out
+}
+
+// messageTemplates caches the active tenant versions.
+type messageTemplates struct {
+	active atomic.Pointer[map[string]*messageTemplate]
+}
+
+func templateKey(tenant, channel, name string) string {
+	return tenant + "/" + channel + "/" + name
+}
+
+// lookup returns the template to render an event with for a tenant, and
+// the tenant version it is (0 for a default), or nil when there is none.
+func (m *messageTemplates) lookup(tenant, channel, name string) (*template.Template, int) {
+	if a := m.active.Load(); a != nil {
+		if t, ok := (*a)[templateKey(tenant, channel, name)]; ok {
+			return t.compiled, t.Version
+		}
+	}
+	return defaultTemplates[channel+"/"+name], 0
+}
+
+func (m *messageTemplates) load(ctx context.Context, db *pgxpool.Pool) error {
+	rows, err := db.Query(ctx, `SELECT tenant_id, channel, name, version, subject, body FROM message_templates WHERE active`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	active := map[string]*messageTemplate{}
+	for rows.Next() {
+		var t messageTemplate
+		if err := rows.Scan(&t.Tenant, &t.Channel, &t.Name, &t.Version, &t.Subject, &t.Body); err != nil {
+			return err
+		}
+		if t.compiled, err = compileTemplate(t.Channel, t.Name, t.Subject, t.Body); err != nil {
+			// validated when saved, so only a hand-edited row gets here
+			slog.Error("skip invalid message template", "tenant", t.Tenant, "channel", t.Channel, "name", t.Name, "version", t.Version, "error", err)
+			continue
+		}
+		active[templateKey(t.Tenant, t.Channel, t.Name)] = &t
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	m.active.Store(&active)
+	return nil
+}
+
+func (m *messageTemplates) watch(ctx context.Context, db *pgxpool.Pool, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.load(ctx, db); err != nil {
+				slog.Error("refresh message templates", "error", err)
+			}
+		}
+	}
+}
+
+// customWebhookBody is the tenant's templated body for a delivery, its
+// data rendered at the subscription's version like webhookBody's, or nil to
+// send the standard body.
+func (s *Store) customWebhookBody(tenant string, id int64, typ string, createdAt time.Time, payload json.RawMessage, stored, version int) ([]byte, error) {
+	t, _ := s.templates.lookup(tenant, channelWebhook, typ)
+	if t == nil {
+		return nil, nil
+	}
+	raw, err := renderEvent(webhookSourceType(typ), stored, payload, version)
+	if err != nil {
+		return nil, err
+	}
+	cfg := s.tenants.effective(tenant)
+	data := templateData{Event: typ, Tenant: tenant, ID: id, Version: version, CreatedAt: createdAt, format: cfg.formatter()}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&data.Data); err != nil {
+		return nil, err
+	}
+	if b := cfg.Branding; b != nil {
+		data.Support = b.Support
+	}
+	out, err := renderMessage(t, channelWebhook, data)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out.Body), nil
+}
+
+func validTemplateTarget(channel, name string) bool {
+	if _, ok := templateSamples[name]; !ok {
+		return false
+	}
+	switch channel {
+	case channelEmail:
+		return true
+	case channelWebhook:
+		return slices.Contains(webhookEventTypes, name)
+	}
+	return false
+}
+
+// templateTarget reads {tenant}/{channel}/{name} and answers 404 for
+// events that cannot be templated.
+func templateTarget(w http.ResponseWriter, r *http.Request) (string, string, string, bool) {
+	tenant, channel, name := r.PathValue("tenant"), r.PathValue("channel"), r.PathValue("name")
+	if !validTemplateTarget(channel, name) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: fmt.Sprintf("no %s template can be written for %q", channel, name)})
+		return "", "", "", false
+	}
+	return tenant, channel, name, true
+}
+
+const messageTemplateColumns = "tenant_id, channel, name, version, subject, body, active, created_by, created_at, activated_by, activated_at"
+
+func scanMessageTemplate(row pgx.Row) (messageTemplate, error) {
+	var t messageTemplate
+	err := row.Scan(&t.Tenant, &t.Channel, &t.Name, &t.Version, &t.Subject, &t.Body, &t.Active, &t.CreatedBy, &t.CreatedAt, &t.ActivatedBy, &t.ActivatedAt)
+	return t, err
+}
+
+func (s *Store) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.pool.Query(r.Context(), "SELECT "+messageTemplateColumns+` FROM message_templates
+		WHERE tenant_id = $1 AND active ORDER BY channel, name`, r.PathValue("tenant"))
+	if err != nil {
+		http.Error(w, "failed to load templates", http.StatusInternalServerError)
+		return
+	}
+	active, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (messageTemplate, error) { return scanMessageTemplate(row) })
+	if err != nil {
+		http.Error(w, "failed to load templates", http.StatusInternalServerError)
+		return
+	}
+	// defaults the tenant has not replaced
+	var defaults []string
+	for key := range defaultTemplates {
+		channel, name, _ := strings.Cut(key, "/")
+		if !slices.ContainsFunc(active, func(t messageTemplate) bool { return t.Channel == channel && t.Name == name }) {
+			defaults = append(defaults, key)
+		}
+	}
+	slices.Sort(defaults)
+	writeJSON(w, http.StatusOK, map[string]any{"active": active, "defaults": defaults})
+}
+
+func (s *Store) handleTemplateVersions(w http.ResponseWriter, r *http.Request) {
+	tenant, channel, name, ok := templateTarget(w, r)
+	if !ok {
+		return
+	}
+	rows, err := s.pool.Query(r.Context(), "SELECT "+messageTemplateColumns+` FROM message_templates
+		WHERE tenant_id = $1 AND channel = $2 AND name = $3 ORDER BY version DESC`, tenant, channel, name)
+	if err != nil {
+		http.Error(w, "failed to load templates", http.StatusInternalServerError)
+		return
+	}
+	versions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (messageTemplate, error) { return scanMessageTemplate(row) })
+	if err != nil {
+		http.Error(w, "failed to load templates", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"versions": versions})
+}
+
+type saveTemplateRequest struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	Actor   string `json:"actor"`
+}
+
+// handleSaveTemplate stores a new, inactive version after checking it
+// renders the event's sample.
+func (s *Store) handleSaveTemplate(w http.ResponseWriter, r *http.Request) {
+	tenant, channel, name, ok := templateTarget(w, r)
+	if !ok {
+		return
+	}
+	var req saveTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	t, err := compileTemplate(channel, name, req.Subject, req.Body)
+	if err == nil {
+		_, err = renderMessage(t, channel, templateData{Event: name, Tenant: tenant, Data: templateSamples[name],
+			format: s.tenants.effective(tenant).formatter()})
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "invalid template: " + err.Error()})
+		return
+	}
+	saved, err := scanMessageTemplate(s.pool.QueryRow(r.Context(), `
+		INSERT INTO message_templates (tenant_id, channel, name, version, subject, body, created_by)
+		SELECT $1, $2, $3, COALESCE(max(version), 0) + 1, $4, $5, $6 FROM message_templates
+		WHERE tenant_id = $1 AND channel = $2 AND name = $3
+		RETURNING `+messageTemplateColumns, tenant, channel, name, req.Subject, req.Body, req.Actor))
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		writeJSON(w, http.StatusConflict, TransferResponse{Status: "error", Message: "another version was saved at the same time; retry"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to save template", http.StatusInternalServerError)
+		return
+	}
+	logger(r.Context()).Info("message template saved", "tenant", tenant, "channel", channel, "name", name, "version", saved.Version, "actor", req.Actor)
+	writeJSON(w, http.StatusCreated, saved)
+}
+
+func (s *Store) handleActivateTemplate(w http.ResponseWriter, r *http.Request) {
+	tenant, channel, name, ok := templateTarget(w, r)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return
+	}
+	var req ruleSetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	ctx := r.Context()
+	err = s.beginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `UPDATE message_templates SET active = false
+			WHERE tenant_id = $1 AND channel = $2 AND name = $3 AND active`, tenant, channel, name); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, `UPDATE message_templates SET active = true, activated_by = $5, activated_at = now()
+			WHERE tenant_id = $1 AND channel = $2 AND name = $3 AND version = $4`, tenant, channel, name, version, req.Actor)
+		if err == nil && tag.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+		return err
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "template version not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to activate template", http.StatusInternalServerError)
+		return
+	}
+	if err := s.templates.load(ctx, s.pool); err != nil {
+		slog.Error("load message templates", "error", err)
+	}
+	logger(ctx).Info("message template activated", "tenant", tenant, "channel", channel, "name", name, "version", version, "actor", req.Actor)
+	writeJSON(w, http.StatusOK, map[string]any{"version": version, "active": true})
+}
+
+type previewTemplateRequest struct {
+	// Version renders a saved version; without it Subject and Body are
+	// rendered as a draft, and without those the active template.
+	Version *int   `json:"version"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	// Data replaces the event's sample data.
+	Data map[string]any `json:"data"`
+}
+
+// previewTemplate renders the template a preview or test send asks for.
+func (s *Store) previewTemplate(ctx context.Context, tenant, channel, name string, req previewTemplateRequest) (renderedMessage, int, error) {
+	var (
+		t       *template.Template
+		version int
+		err     error
+	)
+	switch {
+	case req.Version != nil:
+		var subject, body string
+		err = s.pool.QueryRow(ctx, `SELECT subject, body FROM message_templates
+			WHERE tenant_id = $1 AND channel = $2 AND name = $3 AND version = $4`, tenant, channel, name, *req.Version).Scan(&subject, &body)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return renderedMessage{}, http.StatusNotFound, errors.New("template version not found")
+		}
+		if err != nil {
+			return renderedMessage{}, http.StatusInternalServerError, err
+		}
+		version = *req.Version
+		t, err = compileTemplate(channel, name, subject, body)
+	case req.Body != "":
+		t, err = compileTemplate(channel, name, req.Subject, req.Body)
+	default:
+		if t, version = s.templates.lookup(tenant, channel, name); t == nil {
+			return renderedMessage{}, http.StatusNotFound, errors.New("no template is active for this event")
+		}
+	}
+	if err != nil {
+		return renderedMessage{}, http.StatusBadRequest, fmt.Errorf("invalid template: %w", err)
+	}
+	cfg := s.tenants.effective(tenant)
+	data := templateData{Event: name, Tenant: tenant, Data: templateSamples[name], format: cfg.formatter()}
+	if req.Data != nil {
+		data.Data = req.Data
+	}
+	if b := cfg.Branding; b != nil {
+		data.Support = b.Support
+	}
+	out, err := renderMessage(t, channel, data)
+	if err != nil {
+		return renderedMessage{}, http.StatusBadRequest, fmt.Errorf("render: %w", err)
+	}
+	out.Version = version
+	return out, http.StatusOK, nil
+}
+
+func (s *Store) handlePreviewTemplate(w http.ResponseWriter, r *http.Request) {
+	tenant, channel, name, ok := templateTarget(w, r)
+	if !ok {
+		return
+	}
+	var req previewTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	out, code, err := s.previewTemplate(r.Context(), tenant, channel, name, req)
+	if code == http.StatusInternalServerError {
+		http.Error(w, "failed to preview template", code)
+		return
+	}
+	if err != nil {
+		writeJSON(w, code, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+type testSendRequest struct {
+	previewTemplateRequest
+	To string `json:"to"`
+}
+
+// handleTestSendTemplate emails a rendered template to one address, marked
+// as a test in the subject.
+func (s *Store) handleTestSendTemplate(w http.ResponseWriter, r *http.Request) {
+	tenant, channel, name, ok := templateTarget(w, r)
+	if !ok {
+		return
+	}
+	if channel != channelEmail {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "only email templates can be test-sent; preview webhook templates"})
+		return
+	}
+	var req testSendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if !validEmailAddress(req.To) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "to must be an email address"})
+		return
+	}
+	mailer := mailerFromEnv()
+	if mailer == nil {
+		writeJSON(w, http.StatusServiceUnavailable, TransferResponse{Status: "error", Message: "SMTP_ADDR is not configured"})
+		return
+	}
+	out, code, err := s.previewTemplate(r.Context(), tenant, channel, name, req.previewTemplateRequest)
+	if code == http.StatusInternalServerError {
+		http.Error(w, "failed to render template", code)
+		return
+	}
+	if err != nil {
+		writeJSON(w, code, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	out.Subject = "[TEST] " + out.Subject
+	if err := mailer.send(req.To, out); err != nil {
+		logger(r.Context()).Warn("template test send failed", "tenant", tenant, "name", name, "error", err)
+		writeJSON(w, http.StatusBadGateway, TransferResponse{Status: "error", Message: "smtp: " + err.Error()})
+		return
+	}
+	logger(r.Context()).Info("template test sent", "tenant", tenant, "name", name, "version", out.Version)
+	writeJSON(w, http.StatusOK, out)
+}
+
+func validEmailAddress(addr string) bool {
+	local, domain, ok := strings.Cut(addr, "@")
+	return ok && local != "" && strings.Contains(domain, ".") && !strings.ContainsAny(addr, " \r\n<>,")
+}
+
+type mailer struct {
+	addr, from string
+	auth       smtp.Auth
+}
+
+func mailerFromEnv() *mailer {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return nil
+	}
+	m := &mailer{addr: addr, from: envOrDefault("SMTP_FROM", "no-reply@localhost")}
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		m.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return m
+}
+
+func (m *mailer) send(to string, msg renderedMessage) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", m.from, to,
+		mime.QEncoding.Encode("utf-8", msg.Subject), time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, b.Bytes())
+}
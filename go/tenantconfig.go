@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"fintech-go/internal/ledger"
+)
+
+// feesAccountID collects transfer fees charged under tenant configuration.
+const feesAccountID = "FEES"
+
+// tenantConfig holds a tenant's overrides. Unset fields fall back to the
+// service-wide defaults, so a tenant row only lists what differs.
+type tenantConfig struct {
+	// TransferLimit applies to the tenant's accounts that have no limit of
+	// their own.
+	TransferLimit *Money `json:"transferLimit,omitempty"`
+	// DailyLimit likewise caps what each account may send per day.
+	DailyLimit *Money `json:"dailyLimit,omitempty"`
+	// LimitWarningPercent is the share of the daily limit from which
+	// transfers answer with a warning; 0 turns the warning off.
+	LimitWarningPercent *int `json:"limitWarningPercent,omitempty"`
+	// LowBalanceWarning is the available balance under which transfers
+	// answer with a warning.
+	LowBalanceWarning *Money `json:"lowBalanceWarning,omitempty"`
+	// TransferFee is charged to the sender of every customer-to-customer
+	// transfer and credited to the FEES account.
+	TransferFee *Money `json:"transferFee,omitempty"`
+	// Currencies the tenant may transact in.
+	Currencies []string        `json:"currencies,omitempty"`
+	Features   map[string]bool `json:"features,omitempty"`
+	// RuleSetVersion pins the tenant to a rule set revision instead of the
+	// active one.
+	RuleSetVersion *int            `json:"ruleSetVersion,omitempty"`
+	Branding       *tenantBranding `json:"branding,omitempty"`
+	// Sandbox marks a test tenant, whose state POST /admin/sandbox/reset
+	// may wipe.
+	Sandbox bool `json:"sandbox,omitempty"`
+	// Locale and TimeZone are how the tenant's customers read amounts and
+	// dates (see format.go).
+	Locale   string `json:"locale,omitempty"`
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// Feature flags a tenant can turn off; all default to on.
+const (
+	featureVirtualAccounts = "virtual_accounts"
+	featureSweeps          = "sweeps"
+)
+
+var knownFeatures = []string{featureVirtualAccounts, featureSweeps}
+
+// effectiveConfig is a tenant's configuration after applying the defaults.
+type effectiveConfig struct {
+	TenantID      string `json:"tenantId"`
+	TransferLimit *Money `json:"transferLimit,omitempty"`
+	DailyLimit    *Money `json:"dailyLimit,omitempty"`
+	TransferFee   Money  `json:"transferFee"`
+	// LimitWarningPercent and LowBalanceWarning are the soft limits (see
+	// limits.go).
+	LimitWarningPercent int             `json:"limitWarningPercent"`
+	LowBalanceWarning   *Money          `json:"lowBalanceWarning,omitempty"`
+	Currencies          []string        `json:"currencies"`
+	Features            map[string]bool `json:"features"`
+	RuleSetVersion      *int            `json:"ruleSetVersion,omitempty"`
+	Branding            *tenantBranding `json:"branding,omitempty"`
+	Sandbox             bool            `json:"sandbox"`
+	Locale              string          `json:"locale"`
+	TimeZone            string          `json:"timeZone"`
+	// Overridden names the fields that come from the tenant row.
+	Overridden []string `json:"overridden"`
+}
+
+func (c effectiveConfig) enabled(feature string) bool {
+	return c.Features[feature]
+}
+
+func (c effectiveConfig) allowsCurrency(code string) bool {
+	return slices.Contains(c.Currencies, code)
+}
+
+// defaultTransferFee is the fee for tenants without an override.
+var defaultTransferFee = loadDefaultTransferFee()
+
+// defaultTransferLimit and defaultDailyLimit are TRANSFER_LIMIT and
+// DAILY_TRANSFER_LIMIT, the limits of tenants without an override. Unset
+// means none.
+var defaultTransferLimit, defaultDailyLimit = loadDefaultLimit("TRANSFER_LIMIT"), loadDefaultLimit("DAILY_TRANSFER_LIMIT")
+
+// defaultLimitWarningPercent and defaultLowBalanceWarning are
+// LIMIT_WARNING_PERCENT and LOW_BALANCE_WARNING, the soft limits of tenants
+// without an override.
+var defaultLimitWarningPercent, defaultLowBalanceWarning = loadLimitWarningPercent(), loadDefaultLimit("LOW_BALANCE_WARNING")
+
+func loadLimitWarningPercent() int {
+	n := intOrDefault("LIMIT_WARNING_PERCENT", 80)
+	if n > 100 {
+		fatal("invalid LIMIT_WARNING_PERCENT", "value", n)
+	}
+	return n
+}
+
+func loadDefaultLimit(key string) *Money {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	limit, err := ledger.ParseMoney(v, moneyExponent)
+	if err != nil || limit <= 0 {
+		fatal("invalid "+key, "value", v)
+	}
+	return &limit
+}
+
+func loadDefaultTransferFee() Money {
+	v := envOrDefault("TRANSFER_FEE", "0")
+	fee, err := ledger.ParseMoney(v, moneyExponent)
+	if err != nil || fee < 0 {
+		fatal("invalid TRANSFER_FEE", "value", v)
+	}
+	return fee
+}
+
+func resolveConfig(tenant string, c *tenantConfig) effectiveConfig {
+	eff := effectiveConfig{
+		TenantID:      tenant,
+		TransferLimit: defaultTransferLimit,
+		DailyLimit:    defaultDailyLimit,
+		TransferFee:   defaultTransferFee,
+		Currencies:    []string{serviceCurrency},
+		Features:      map[string]bool{},
+		Locale:        defaultLocale,
+		TimeZone:      defaultTimeZone,
+		Overridden:    make([]string, 0),
+
+		LimitWarningPercent: defaultLimitWarningPercent,
+		LowBalanceWarning:   defaultLowBalanceWarning,
+	}
+	for _, f := range knownFeatures {
+		eff.Features[f] = true
+	}
+	if c == nil {
+		return eff
+	}
+	if c.TransferLimit != nil {
+		eff.TransferLimit = c.TransferLimit
+		eff.Overridden = append(eff.Overridden, "transferLimit")
+	}
+	if c.DailyLimit != nil {
+		eff.DailyLimit = c.DailyLimit
+		eff.Overridden = append(eff.Overridden, "dailyLimit")
+	}
+	if c.LimitWarningPercent != nil {
+		eff.LimitWarningPercent = *c.LimitWarningPercent
+		eff.Overridden = append(eff.Overridden, "limitWarningPercent")
+	}
+	if c.LowBalanceWarning != nil {
+		eff.LowBalanceWarning = c.LowBalanceWarning
+		eff.Overridden = append(eff.Overridden, "lowBalanceWarning")
+	}
+	if c.TransferFee != nil {
+		eff.TransferFee = *c.TransferFee
+		eff.Overridden = append(eff.Overridden, "transferFee")
+	}
+	if len(c.Currencies) > 0 {
+		eff.Currencies = c.Currencies
+		eff.Overridden = append(eff.Overridden, "currencies")
+	}
+	for f, on := range c.Features {
+		eff.Features[f] = on
+		eff.Overridden = append(eff.Overridden, "features."+f)
+	}
+	if c.RuleSetVersion != nil {
+		eff.RuleSetVersion = c.RuleSetVersion
+		eff.Overridden = append(eff.Overridden, "ruleSetVersion")
+	}
+	if c.Branding != nil {
+		eff.Branding = c.Branding
+		eff.Overridden = append(eff.Overridden, "branding")
+	}
+	if c.Sandbox {
+		eff.Sandbox = true
+		eff.Overridden = append(eff.Overridden, "sandbox")
+	}
+	if c.Locale != "" {
+		eff.Locale = c.Locale
+		eff.Overridden = append(eff.Overridden, "locale")
+	}
+	if c.TimeZone != "" {
+		eff.TimeZone = c.TimeZone
+		eff.Overridden = append(eff.Overridden, "timeZone")
+	}
+	return eff
+}
+
+func (c tenantConfig) validate(ctx context.Context, db querier) error {
+	if c.TransferLimit != nil && *c.TransferLimit <= 0 {
+		return fmt.Errorf("transferLimit must be > 0")
+	}
+	if c.DailyLimit != nil && *c.DailyLimit <= 0 {
+		return fmt.Errorf("dailyLimit must be > 0")
+	}
+	if c.LimitWarningPercent != nil && (*c.LimitWarningPercent < 0 || *c.LimitWarningPercent > 100) {
+		return fmt.Errorf("limitWarningPercent must be between 0 and 100")
+	}
+	if c.LowBalanceWarning != nil && *c.LowBalanceWarning <= 0 {
+		return fmt.Errorf("lowBalanceWarning must be > 0")
+	}
+	if c.TransferFee != nil && *c.TransferFee < 0 {
+		return fmt.Errorf("transferFee must be >= 0")
+	}
+	for i, code := range c.Currencies {
+		code = strings.ToUpper(code)
+		if _, err := currencyUnit(code); err != nil {
+			return err
+		}
+		c.Currencies[i] = code
+	}
+	for f := range c.Features {
+		if !slices.Contains(knownFeatures, f) {
+			return fmt.Errorf("unknown feature %q", f)
+		}
+	}
+	if err := c.Branding.validate(); err != nil {
+		return err
+	}
+	if c.Locale != "" {
+		if err := validateLocale(c.Locale); err != nil {
+			return err
+		}
+	}
+	if c.TimeZone != "" {
+		if err := validateTimeZone(c.TimeZone); err != nil {
+			return err
+		}
+	}
+	if c.RuleSetVersion != nil {
+		var exists bool
+		err := db.QueryRow(ctx, "SELECT true FROM rule_sets WHERE version=$1", *c.RuleSetVersion).Scan(&exists)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("rule set v%d does not exist", *c.RuleSetVersion)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tenantConfigs caches every tenant's overrides in memory; transfers read
+// it on the hot path. Like the rule engine it is refreshed periodically so
+// changes made on another replica apply within the refresh interval.
+type tenantConfigs struct {
+	current atomic.Pointer[map[string]*tenantConfig]
+}
+
+func (t *tenantConfigs) effective(tenant string) effectiveConfig {
+	var c *tenantConfig
+	if m := t.current.Load(); m != nil {
+		c = (*m)[tenant]
+	}
+	return resolveConfig(tenant, c)
+}
+
+// pinnedRuleSets reports whether any tenant overrides the rule set, so the
+// risk stage only looks up the sender's tenant when it can matter.
+func (t *tenantConfigs) pinnedRuleSets() bool {
+	m := t.current.Load()
+	if m == nil {
+		return false
+	}
+	for _, c := range *m {
+		if c.RuleSetVersion != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tenantConfigs) load(ctx context.Context, db *pgxpool.Pool) error {
+	rows, err := db.Query(ctx, "SELECT tenant_id, config FROM tenant_configs")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	m := map[string]*tenantConfig{}
+	for rows.Next() {
+		var (
+			tenant string
+			raw    []byte
+		)
+		if err := rows.Scan(&tenant, &raw); err != nil {
+			return err
+		}
+		var c tenantConfig
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant, err)
+		}
+		m[tenant] = &c
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	t.current.Store(&m)
+	return nil
+}
+
+func (t *tenantConfigs) watch(ctx context.Context, db *pgxpool.Pool, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.load(ctx, db); err != nil {
+				slog.Error("refresh tenant configs", "error", err)
+			}
+		}
+	}
+}
+
+type tenantConfigView struct {
+	TenantID  string       `json:"tenantId"`
+	Config    tenantConfig `json:"config"`
+	UpdatedBy string       `json:"updatedBy"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+}
+
+func (s *Store) handleGetTenantConfig(w http.ResponseWriter, r *http.Request) {
+	v := tenantConfigView{TenantID: r.PathValue("tenant")}
+	var raw []byte
+	err := s.pool.QueryRow(r.Context(), "SELECT config, updated_by, updated_at FROM tenant_configs WHERE tenant_id=$1", v.TenantID).
+		Scan(&raw, &v.UpdatedBy, &v.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "tenant has no overrides"})
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(raw, &v.Config)
+	}
+	if err != nil {
+		http.Error(w, "failed to load tenant config", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+type putTenantConfigRequest struct {
+	Config tenantConfig `json:"config"`
+	Actor  string       `json:"actor"`
+}
+
+// handlePutTenantConfig replaces a tenant's overrides as a whole.
+func (s *Store) handlePutTenantConfig(w http.ResponseWriter, r *http.Request) {
+	tenant := r.PathValue("tenant")
+	var req putTenantConfigRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	if tenant == "system" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "tenant is reserved"})
+		return
+	}
+	ctx := r.Context()
+	if err := req.Config.validate(ctx, s.pool); err != nil {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+		return
+	}
+	raw, err := json.Marshal(req.Config)
+	if err != nil {
+		http.Error(w, "failed to encode config", http.StatusInternalServerError)
+		return
+	}
+	v := tenantConfigView{TenantID: tenant, Config: req.Config}
+	if err := s.pool.QueryRow(ctx, `
+		INSERT INTO tenant_configs (tenant_id, config, updated_by) VALUES ($1, $2, $3)
+		ON CONFLICT (tenant_id) DO UPDATE SET config=EXCLUDED.config, updated_by=EXCLUDED.updated_by, updated_at=now()
+		RETURNING updated_by, updated_at`, tenant, raw, req.Actor).Scan(&v.UpdatedBy, &v.UpdatedAt); err != nil {
+		http.Error(w, "failed to save tenant config", http.StatusInternalServerError)
+		return
+	}
+	s.reloadTenants(ctx)
+	logger(ctx).Info("tenant config updated", "tenant_id", tenant, "actor", req.Actor)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Store) handleDeleteTenantConfig(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tag, err := s.pool.Exec(ctx, "DELETE FROM tenant_configs WHERE tenant_id=$1", r.PathValue("tenant"))
+	if err != nil {
+		http.Error(w, "failed to delete tenant config", http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "tenant has no overrides"})
+		return
+	}
+	s.reloadTenants(ctx)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleEffectiveTenantConfig shows what this replica currently enforces for
+// the tenant, defaults included.
+func (s *Store) handleEffectiveTenantConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.tenants.effective(r.PathValue("tenant")))
+}
+
+// reloadTenants applies a change on this replica right away; the others
+// pick it up on their next refresh.
+func (s *Store) reloadTenants(ctx context.Context) {
+	if err := s.tenants.load(ctx, s.pool); err != nil {
+		logger(ctx).Error("reload tenant configs", "error", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// The API port can terminate TLS itself for deployments without a proxy in
+// front. TLS_CERT_FILE and TLS_KEY_FILE enable HTTPS; TLS_CLIENT_CA_FILE adds
+// mutual TLS, requiring every client to present a certificate signed by one
+// of those CAs (TLS_CLIENT_AUTH=optional only verifies certificates that are
+// presented). The admin port stays plain HTTP: probes and scrapers reach it
+// from inside the cluster.
+//
+// Certificates are re-read when the files change, so a rotated certificate
+// is picked up without a restart.
+
+func tlsConfigFromEnv() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	certs := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := certs.reload(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.get}
+
+	caFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	if caFile == "" {
+		slog.Info("serving HTTPS", "cert", certFile)
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("TLS_CLIENT_CA_FILE: %w", err)
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("TLS_CLIENT_CA_FILE: no certificates found")
+	}
+	mode := envOrDefault("TLS_CLIENT_AUTH", "require")
+	switch mode {
+	case "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH must be require or optional, got %q", mode)
+	}
+	slog.Info("serving HTTPS with client certificates", "cert", certFile, "client_ca", caFile, "client_auth", mode)
+	return cfg, nil
+}
+
+// certReloader serves the key pair from disk, checking the files for changes
+// at most every certCheckInterval. A pair that fails to load keeps the
+// previous one in service.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+const certCheckInterval = 30 * time.Second
+
+func (c *certReloader) reload() error {
+	st, err := os.Stat(c.certFile)
+	if err != nil {
+		return fmt.Errorf("load TLS key pair: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS key pair: %w", err)
+	}
+	c.cert, c.modTime = &cert, st.ModTime()
+	return nil
+}
+
+func (c *certReloader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.checked) >= certCheckInterval {
+		c.checked = now
+		if st, err := os.Stat(c.certFile); err == nil && !st.ModTime().Equal(c.modTime) {
+			if err := c.reload(); err != nil {
+				slog.Error("reload TLS certificate", "cert", c.certFile, "error", err)
+			} else {
+				slog.Info("reloaded TLS certificate", "cert", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing is off unless an OTLP endpoint is configured. The exporter reads
+// the standard OTEL_EXPORTER_OTLP_* variables (endpoint, headers, insecure,
+// timeout) and the SDK reads OTEL_TRACES_SAMPLER / OTEL_TRACES_SAMPLER_ARG,
+// so collectors and sampling are set up the same way as for any other OTel
+// service. OTEL_SERVICE_NAME overrides the default service name.
+var tracer = otel.Tracer("fintech-go")
+
+// tracerProvider is nil while tracing is disabled.
+var tracerProvider *sdktrace.TracerProvider
+
+func setupTracing(ctx context.Context) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		fatal("failed to create OTLP exporter", "error", err)
+	}
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(semconv.ServiceName("fintech-go")))
+	if err != nil {
+		fatal("failed to build trace resource", "error", err)
+	}
+	// resource.WithFromEnv last so OTEL_SERVICE_NAME and
+	// OTEL_RESOURCE_ATTRIBUTES win over the defaults
+	env, err := resource.New(ctx, resource.WithFromEnv())
+	if err == nil {
+		res, err = resource.Merge(res, env)
+	}
+	if err != nil {
+		fatal("failed to build trace resource", "error", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tracerProvider)
+	slog.Info("tracing enabled")
+}
+
+// flushTraces exports buffered spans; called at shutdown before the pool
+// closes so the last transfers are not lost.
+func flushTraces(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Error("flush traces", "error", err)
+	}
+}
+
+// traced starts a server span per request, continuing the caller's trace
+// when it sends a traceparent header.
+func traced(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("request.id", r.Header.Get(requestIDHeader)),
+			))
+		defer span.End()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	}
+}
+
+// queryTracer turns pgx queries into child spans. Queries outside a traced
+// request (background loops, migrations) have no parent and are skipped
+// rather than each becoming a root trace.
+type queryTracer struct{}
+
+type querySpanKey struct{}
+
+type queryStartKey struct{}
+
+func (queryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	if queryPatternFromContext(ctx) != "" {
+		ctx = context.WithValue(ctx, queryStartKey{}, time.Now())
+	}
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	ctx, span := tracer.Start(ctx, "pgx.query", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBQueryText(data.SQL)))
+	return context.WithValue(ctx, querySpanKey{}, span)
+}
+
+func (queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	if start, ok := ctx.Value(queryStartKey{}).(time.Time); ok {
+		observeQueryPattern(queryPatternFromContext(ctx), time.Since(start))
+	}
+	span, ok := ctx.Value(querySpanKey{}).(trace.Span)
+	if !ok {
+		return
+	}
+	if data.Err != nil {
+		span.RecordError(data.Err)
+		span.SetStatus(codes.Error, data.Err.Error())
+	} else {
+		span.SetAttributes(attribute.Int64("db.rows_affected", data.CommandTag.RowsAffected()))
+	}
+	span.End()
+}
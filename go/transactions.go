@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"fintech-go/internal/ledger"
+	"fintech-go/internal/store"
+)
+
+// publicAccountID hides system account ids from customer-facing output.
+func publicAccountID(id *string) *string {
+	if id == nil || isSystemAccount(*id) {
+		return nil
+	}
+	return id
+}
+
+// Statement pages through an account's ledger rows newest first, for the
+// HTTP and gRPC APIs. Rows are ordered by ledger id, which never changes
+// once written, so a page boundary is stable even while new rows arrive.
+//
+// A statement spanning several pages must read as of one instant. The first
+// page reads the balance and the highest ledger id of the account in a
+// single snapshot and every later page is bounded by that id, carried in
+// the cursor ("<asOf>.<lastId>"). The bound is exact because a transfer
+// takes the account row lock before its ledger rows draw ids from the
+// sequence: per account, ids are assigned in commit order, so every row at
+// or below the bound was committed when the balance was read and every row
+// committed later lies above it.
+func (s *Store) Statement(ctx context.Context, id string, sq store.StatementQuery) (store.StatementPage, error) {
+	ctx = withQueryPattern(ctx, patternStatements)
+	where := []string{"account_id=$1"}
+	args := []any{id}
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, strings.Replace(cond, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+	if !sq.From.IsZero() {
+		add("at >= ?", sq.From)
+	}
+	if !sq.To.IsZero() {
+		add("at < ?", sq.To)
+	}
+	if v := sq.Type; v != "" {
+		v = strings.ToUpper(v)
+		if v != "DEBIT" && v != "CREDIT" {
+			return store.StatementPage{}, store.InvalidError("type must be DEBIT or CREDIT")
+		}
+		add("type = ?", v)
+	}
+	var asOf int64
+	if v := sq.Cursor; v != "" {
+		bound, last, err := store.ParseStatementCursor(v)
+		if err != nil {
+			return store.StatementPage{}, store.InvalidError("invalid cursor")
+		}
+		asOf = bound
+		add("id < ?", last)
+	}
+	limit := sq.Limit
+	if limit <= 0 {
+		limit = store.StatementDefaultLimit
+	}
+	if limit > store.StatementMaxLimit {
+		limit = store.StatementMaxLimit
+	}
+
+	// one statement, one snapshot: the balance matches exactly the rows at
+	// or below the bound
+	var (
+		balance Money
+		head    int64
+		tenant  string
+	)
+	if err := s.pool.QueryRow(ctx, `
+		SELECT balance, (SELECT COALESCE(max(id), 0) FROM ledger WHERE account_id=$1), tenant_id
+		FROM accounts WHERE id=$1`, id).Scan(&balance, &head, &tenant); err == pgx.ErrNoRows {
+		return store.StatementPage{}, errAccountNotFound
+	} else if err != nil {
+		return store.StatementPage{}, err
+	}
+	if asOf == 0 {
+		asOf = head
+	}
+	add("id <= ?", asOf)
+
+	args = append(args, limit)
+	rows, err := s.pool.Query(ctx, "SELECT id, type, amount, at, currency, fx_rate::text, summary_entries, summary_first_id, to_char(summary_period, 'YYYY-MM'), transfer_id, counterparty_account_id, (SELECT virtual_account_id FROM transfers t WHERE t.id=ledger.transfer_id), "+
+		"(SELECT standing_order_id FROM transfers t WHERE t.id=ledger.transfer_id) FROM ledger WHERE "+strings.Join(where, " AND ")+
+		" ORDER BY id DESC LIMIT $"+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return store.StatementPage{}, err
+	}
+	defer rows.Close()
+	txs := make([]ledger.Transaction, 0, limit)
+	for rows.Next() {
+		var (
+			t             ledger.Transaction
+			summaryCount  *int64
+			summaryFirst  *int64
+			summaryPeriod *string
+		)
+		if err := rows.Scan(&t.ID, &t.Type, &t.Amount, &t.At, &t.Currency, &t.FxRate, &summaryCount, &summaryFirst, &summaryPeriod, &t.TransactionID, &t.CounterpartyAccountID, &t.VirtualAccountID, &t.StandingOrderID); err != nil {
+			return store.StatementPage{}, err
+		}
+		t.CounterpartyAccountID = publicAccountID(t.CounterpartyAccountID)
+		if summaryCount != nil {
+			t.Summary = &ledger.LedgerSummary{Entries: *summaryCount, FirstLedgerID: *summaryFirst, Period: *summaryPeriod}
+		}
+		txs = append(txs, t)
+	}
+	if err := rows.Err(); err != nil {
+		return store.StatementPage{}, err
+	}
+	rows.Close()
+	cfg := s.tenants.effective(tenant)
+	if err := s.enrichTransactions(ctx, id, cfg.Branding, txs); err != nil {
+		// statements stay usable without display info
+		logger(ctx).Warn("transaction enrichment failed", "account_id", id, "error", err)
+	}
+	format := cfg.formatter()
+	for i := range txs {
+		t := &txs[i]
+		t.Display = &ledger.Display{Amount: format.Money(t.Amount, t.Currency), At: format.DateTime(t.At)}
+	}
+	page := store.StatementPage{Transactions: txs, AsOf: asOf}
+	if asOf == head {
+		page.Balance = &balance
+	}
+	if len(txs) == limit {
+		page.NextCursor = store.StatementCursor(asOf, txs[len(txs)-1].ID)
+	}
+	return page, nil
+}
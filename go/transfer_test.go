@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testStore connects to the database in TEST_DATABASE_URL, applying the
+// base schema and migrations. Tests needing it are skipped when unset.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatalf("open pool: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	base, err := os.ReadFile("../db/init.sql")
+	if err != nil {
+		t.Fatalf("read base schema: %v", err)
+	}
+	if _, err := pool.Exec(ctx, string(base)); err != nil {
+		t.Fatalf("apply base schema: %v", err)
+	}
+	s := &Store{pool: pool, isoLevel: pgx.ReadCommitted, tenants: &tenantConfigs{}, health: newHealthMonitor(pool, healthThresholds{})}
+	if err := s.prepareDatabase(ctx); err != nil {
+		t.Fatalf("prepare database: %v", err)
+	}
+	return s
+}
+
+// TestOppositeTransfersDoNotDeadlock hammers A->B and B->A concurrently.
+// executeTransfer is called without the retry wrapper so a deadlock surfaces
+// as an error instead of being absorbed by a retry.
+func TestOppositeTransfersDoNotDeadlock(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	suffix := time.Now().UnixNano()
+	a, b := fmt.Sprintf("lock-a-%d", suffix), fmt.Sprintf("lock-b-%d", suffix)
+	if _, err := s.pool.Exec(ctx, "INSERT INTO accounts (id, balance) VALUES ($1, 100000), ($2, 100000)", a, b); err != nil {
+		t.Fatalf("create accounts: %v", err)
+	}
+	before := sumBalances(t, s, a, b)
+
+	const workers, perWorker = 16, 50
+	errs := make(chan error, workers*perWorker)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			from, to := a, b
+			if w%2 == 1 {
+				from, to = b, a
+			}
+			for i := 0; i < perWorker; i++ {
+				req := TransferRequest{FromAccountID: from, ToAccountID: to, Amount: 1}
+				if _, _, err := s.executeTransfer(ctx, req); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if reason, ok := retryReason(err); ok {
+			t.Fatalf("transfer failed with %s: %v", reason, err)
+		}
+		t.Fatalf("transfer failed: %v", err)
+	}
+
+	if after := sumBalances(t, s, a, b); after != before {
+		t.Fatalf("balances sum to %s after transfers, want %s", after, before)
+	}
+}
+
+func sumBalances(t *testing.T, s *Store, ids ...string) Money {
+	t.Helper()
+	var total Money
+	if err := s.pool.QueryRow(context.Background(), "SELECT sum(balance) FROM accounts WHERE id = ANY($1)", ids).Scan(&total); err != nil {
+		t.Fatalf("sum balances: %v", err)
+	}
+	return total
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// parseIsolation maps the TX_ISOLATION setting to a pgx isolation level.
+func parseIsolation(v string) (pgx.TxIsoLevel, error) {
+	switch strings.ToLower(strings.ReplaceAll(v, "-", "_")) {
+	case "", "read_committed":
+		return pgx.ReadCommitted, nil
+	case "repeatable_read":
+		return pgx.RepeatableRead, nil
+	case "serializable":
+		return pgx.Serializable, nil
+	}
+	return "", fmt.Errorf("unknown isolation level %q (want read_committed, repeatable_read or serializable)", v)
+}
+
+// retryReason reports whether err is a transient conflict that Postgres
+// expects the client to retry, returning a metric label when it is.
+// Serialization failures only show up under RepeatableRead/Serializable, but
+// deadlocks can happen at any level.
+func retryReason(err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return "", false
+	}
+	switch pgErr.Code {
+	case "40001":
+		return "serialization_failure", true
+	case "40P01":
+		return "deadlock", true
+	}
+	return "", false
+}
+
+// executeWithRetry runs executeTransfer until it succeeds, fails with a
+// non-retryable error or exhausts s.maxRetries.
+func (s *Store) executeWithRetry(ctx context.Context, req TransferRequest) (TransferResponse, int, error) {
+	var resp TransferResponse
+	status, err := s.retryTx(ctx, func() (status int, err error) {
+		resp, status, err = s.executeTransfer(ctx, req)
+		return status, err
+	})
+	return resp, status, err
+}
+
+// retryTx runs fn, a whole transaction, again while it fails with a
+// serialization failure or a deadlock, up to s.maxRetries times.
+func (s *Store) retryTx(ctx context.Context, fn func() (int, error)) (int, error) {
+	for attempt := 0; ; attempt++ {
+		status, err := fn()
+		reason, retryable := retryReason(err)
+		if !retryable || attempt >= s.maxRetries {
+			return status, err
+		}
+		txRetries.WithLabelValues(reason).Inc()
+		// jittered linear backoff keeps colliding transactions from lining up again
+		backoff := time.Duration(attempt+1)*5*time.Millisecond + time.Duration(rand.Intn(5))*time.Millisecond
+		select {
+		case <-ctx.Done():
+			return status, err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// beginTx starts a transaction tagged with the caller: application_name
+// carries the request id, so pg_stat_activity and lock waits point at a
+// specific API request, and app.request_id / app.principal are readable
+// with current_setting() from triggers and audit functions. The settings
+// are transaction-local and revert on commit or rollback, so a pooled
+// connection never carries a previous caller's identity.
+//
+// Client and tenant come from headers when authentication is off, so the
+// settings are bound as parameters of a statement after BEGIN, never
+// spliced into SQL; that costs one round-trip per transaction.
+func (s *Store) beginTx(ctx context.Context, opts pgx.TxOptions) (pgx.Tx, error) {
+	tx, err := s.pool.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := tagTx(ctx, tx); err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, err
+	}
+	return tx, nil
+}
+
+// beginFunc is pgx.BeginFunc with the transaction tagged as in beginTx.
+func (s *Store) beginFunc(ctx context.Context, fn func(pgx.Tx) error) error {
+	return pgx.BeginTxFunc(ctx, s.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		if err := tagTx(ctx, tx); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+const applicationName = "fintech-go"
+
+func tagTx(ctx context.Context, tx pgx.Tx) error {
+	meta := metaFromContext(ctx)
+	name, principal := applicationName, meta.Client+"@"+meta.Tenant
+	if meta.RequestID != "" {
+		name += " " + meta.RequestID
+	}
+	if p := principalFromContext(ctx); p != nil {
+		principal = p.Client + "@" + p.Tenant
+	}
+	_, err := tx.Exec(ctx, "SELECT set_config('application_name', $1, true), set_config('app.request_id', $2, true), set_config('app.principal', $3, true)",
+		name, meta.RequestID, principal)
+	if err != nil {
+		return fmt.Errorf("tag transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Usage is metered per tenant and calendar month (UTC) for invoicing. The
+// meters are recomputed from the tables that record the activity rather
+// than counted on the hot path: a per-tenant counter row updated inside
+// every transfer would serialize all of a tenant's transfers on it. The
+// hourly usage_meters job keeps the open month current; usage_summary
+// recomputes the previous month one last time, marks it final and emits a
+// usage.monthly_summary event per tenant for the billing system.
+//
+// Quotas are soft: crossing one records a usage.quota_exceeded event and
+// bumps a metric once per month, but nothing is rejected.
+
+const (
+	meterTransfers      = "transfers"
+	meterActiveAccounts = "active_accounts"
+	meterEvents         = "events"
+)
+
+var usageMeters = []string{meterTransfers, meterActiveAccounts, meterEvents}
+
+// meterQueries yield (tenant_id, quantity) for the month [$1, $2). A
+// transfer is billed to the tenant of the sending account, or of the
+// receiving one when money comes in from a system account; transfers
+// between two system accounts and fee postings are not billed.
+var meterQueries = map[string]string{
+	meterTransfers: `
+		SELECT a.tenant_id, count(*)
+		FROM transfers t
+		JOIN accounts a ON a.id = CASE WHEN t.from_account_id IN ('` + settlementAccountID + `', '` + suspenseAccountID + `')
+			THEN t.to_account_id ELSE t.from_account_id END
+		WHERE t.created_at >= $1 AND t.created_at < $2 AND a.tenant_id <> 'system'
+			AND t.to_account_id <> '` + feesAccountID + `'
+		GROUP BY a.tenant_id`,
+	// an account is billable for a month it was open at any point of
+	meterActiveAccounts: `
+		SELECT tenant_id, count(*) FROM accounts
+		WHERE created_at < $2 AND (closed_at IS NULL OR closed_at >= $1) AND tenant_id <> 'system'
+		GROUP BY tenant_id`,
+	meterEvents: `
+		SELECT a.tenant_id, count(*)
+		FROM events e JOIN accounts a ON e.subject = 'account/' || a.id
+		WHERE e.created_at >= $1 AND e.created_at < $2 AND a.tenant_id <> 'system'
+		GROUP BY a.tenant_id`,
+}
+
+type usageRow struct {
+	TenantID   string    `json:"tenantId"`
+	Period     string    `json:"period"`
+	Meter      string    `json:"meter"`
+	Quantity   int64     `json:"quantity"`
+	SoftLimit  *int64    `json:"softLimit,omitempty"`
+	Final      bool      `json:"final"`
+	ComputedAt time.Time `json:"computedAt"`
+}
+
+type usageParams struct {
+	// Period is the month to meter as YYYY-MM; empty means the month the
+	// job was enqueued in (usage_meters) or the one before it
+	// (usage_summary).
+	Period string `json:"period,omitempty"`
+}
+
+func parsePeriod(v string) (time.Time, error) {
+	t, err := time.Parse("2006-01", v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("period must be YYYY-MM")
+	}
+	return t, nil
+}
+
+func monthOf(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (p usageParams) month(fallback time.Time) (time.Time, error) {
+	if p.Period == "" {
+		return fallback, nil
+	}
+	return parsePeriod(p.Period)
+}
+
+func (s *Store) runUsageMeters(ctx context.Context, j *job) (any, error) {
+	var p usageParams
+	if err := json.Unmarshal(j.Params, &p); err != nil {
+		return nil, err
+	}
+	month, err := p.month(monthOf(j.CreatedAt))
+	if err != nil {
+		return nil, err
+	}
+	return s.meterUsage(ctx, j, month, false)
+}
+
+func (s *Store) runUsageSummary(ctx context.Context, j *job) (any, error) {
+	var p usageParams
+	if err := json.Unmarshal(j.Params, &p); err != nil {
+		return nil, err
+	}
+	month, err := p.month(monthOf(j.CreatedAt).AddDate(0, -1, 0))
+	if err != nil {
+		return nil, err
+	}
+	if !month.Before(monthOf(time.Now())) {
+		return nil, fmt.Errorf("period %s has not ended", month.Format("2006-01"))
+	}
+	res, err := s.meterUsage(ctx, j, month, true)
+	if err != nil || j.DryRun {
+		return res, err
+	}
+
+	summaries, err := s.loadUsage(ctx, month, "")
+	if err != nil {
+		return res, err
+	}
+	byTenant := map[string]map[string]int64{}
+	for _, u := range summaries {
+		if byTenant[u.TenantID] == nil {
+			byTenant[u.TenantID] = map[string]int64{}
+		}
+		byTenant[u.TenantID][u.Meter] = u.Quantity
+	}
+	for tenant, meters := range byTenant {
+		if err := s.recordEvent(ctx, "usage.monthly_summary", "tenant/"+tenant, map[string]any{
+			"tenantId": tenant, "period": month.Format("2006-01"), "meters": meters,
+		}); err != nil {
+			logger(ctx).Error("record usage summary", "tenant_id", tenant, "error", err)
+		}
+	}
+	res.Tenants = len(byTenant)
+	return res, nil
+}
+
+type usageResult struct {
+	Period        string           `json:"period"`
+	Final         bool             `json:"final"`
+	Meters        map[string]int64 `json:"meters"`
+	Tenants       int              `json:"tenants,omitempty"`
+	QuotaExceeded []string         `json:"quotaExceeded"`
+}
+
+// meterUsage recomputes every meter for month and upserts the totals.
+// Months already marked final are left alone, so a late rerun cannot
+// change what was invoiced.
+func (s *Store) meterUsage(ctx context.Context, j *job, month time.Time, final bool) (usageResult, error) {
+	ctx = withQueryPattern(ctx, patternAnalytics)
+	from, to := month, month.AddDate(0, 1, 0)
+	res := usageResult{Period: month.Format("2006-01"), Final: final, Meters: map[string]int64{}, QuotaExceeded: make([]string, 0)}
+	j.progress(ctx, 0, int64(len(usageMeters)))
+	for i, meter := range usageMeters {
+		rows, err := s.pool.Query(ctx, meterQueries[meter], from, to)
+		if err != nil {
+			return res, fmt.Errorf("meter %s: %w", meter, err)
+		}
+		totals := map[string]int64{}
+		for rows.Next() {
+			var (
+				tenant string
+				n      int64
+			)
+			if err := rows.Scan(&tenant, &n); err != nil {
+				rows.Close()
+				return res, err
+			}
+			totals[tenant] = n
+			res.Meters[meter] += n
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return res, fmt.Errorf("meter %s: %w", meter, err)
+		}
+		if !j.DryRun {
+			for tenant, n := range totals {
+				if _, err := s.pool.Exec(ctx, `
+					INSERT INTO usage (tenant_id, period, meter, quantity, final, computed_at) VALUES ($1, $2, $3, $4, $5, now())
+					ON CONFLICT (tenant_id, period, meter) DO UPDATE SET quantity=EXCLUDED.quantity, final=EXCLUDED.final, computed_at=now()
+					WHERE NOT usage.final`, tenant, month, meter, n, final); err != nil {
+					return res, err
+				}
+			}
+		}
+		j.progress(ctx, int64(i+1), int64(len(usageMeters)))
+	}
+	if j.DryRun {
+		return res, nil
+	}
+	s.cache.usage.purge()
+	exceeded, err := s.checkQuotas(ctx, month)
+	if err != nil {
+		return res, err
+	}
+	res.QuotaExceeded = exceeded
+	return res, nil
+}
+
+// checkQuotas flags usage over its soft limit. quota_notified makes the
+// event fire once per tenant, meter and month however often metering runs.
+func (s *Store) checkQuotas(ctx context.Context, month time.Time) ([]string, error) {
+	rows, err := s.pool.Query(ctx, `
+		UPDATE usage u SET quota_notified=true
+		FROM usage_quotas q
+		WHERE q.tenant_id=u.tenant_id AND q.meter=u.meter AND u.period=$1
+			AND u.quantity > q.soft_limit AND NOT u.quota_notified
+		RETURNING u.tenant_id, u.meter, u.quantity, q.soft_limit`, month)
+	if err != nil {
+		return nil, err
+	}
+	type hit struct {
+		tenant, meter    string
+		quantity, limitN int64
+	}
+	var hits []hit
+	for rows.Next() {
+		var h hit
+		if err := rows.Scan(&h.tenant, &h.meter, &h.quantity, &h.limitN); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	exceeded := make([]string, 0, len(hits))
+	for _, h := range hits {
+		usageQuotaExceeded.WithLabelValues(h.meter).Inc()
+		logger(ctx).Warn("usage over soft quota", "tenant_id", h.tenant, "meter", h.meter, "quantity", h.quantity, "soft_limit", h.limitN)
+		if err := s.recordEvent(ctx, "usage.quota_exceeded", "tenant/"+h.tenant, map[string]any{
+			"tenantId": h.tenant, "period": month.Format("2006-01"), "meter": h.meter, "quantity": h.quantity, "softLimit": h.limitN,
+		}); err != nil {
+			logger(ctx).Error("record quota event", "tenant_id", h.tenant, "error", err)
+		}
+		exceeded = append(exceeded, h.tenant+"/"+h.meter)
+	}
+	return exceeded, nil
+}
+
+func (s *Store) loadUsage(ctx context.Context, month time.Time, tenant string) ([]usageRow, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT u.tenant_id, u.period, u.meter, u.quantity, q.soft_limit, u.final, u.computed_at
+		FROM usage u LEFT JOIN usage_quotas q ON q.tenant_id=u.tenant_id AND q.meter=u.meter
+		WHERE u.period=$1 AND ($2='' OR u.tenant_id=$2)
+		ORDER BY u.tenant_id, u.meter`, month, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]usageRow, 0)
+	for rows.Next() {
+		var (
+			u      usageRow
+			period time.Time
+		)
+		if err := rows.Scan(&u.TenantID, &period, &u.Meter, &u.Quantity, &u.SoftLimit, &u.Final, &u.ComputedAt); err != nil {
+			return nil, err
+		}
+		u.Period = period.Format("2006-01")
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
+
+// handleUsage lists metered usage for one month (default: the current one),
+// optionally for a single tenant. Open months are at most an hour stale.
+func (s *Store) handleUsage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	month := monthOf(time.Now())
+	if v := q.Get("period"); v != "" {
+		m, err := parsePeriod(v)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: err.Error()})
+			return
+		}
+		month = m
+	}
+	tenant := q.Get("tenantId")
+	list, err := s.cache.usage.fetch(month.Format("2006-01")+"/"+tenant, func() ([]usageRow, error) {
+		return s.loadUsage(r.Context(), month, tenant)
+	})
+	if err != nil {
+		http.Error(w, "failed to load usage", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+type putQuotaRequest struct {
+	SoftLimit int64  `json:"softLimit"`
+	Actor     string `json:"actor"`
+}
+
+func (s *Store) handlePutQuota(w http.ResponseWriter, r *http.Request) {
+	tenant, meter := r.PathValue("tenant"), r.PathValue("meter")
+	var req putQuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	if _, ok := meterQueries[meter]; !ok {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "unknown meter"})
+		return
+	}
+	if req.SoftLimit <= 0 {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "softLimit must be > 0"})
+		return
+	}
+	ctx := r.Context()
+	err := s.beginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO usage_quotas (tenant_id, meter, soft_limit, updated_by) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (tenant_id, meter) DO UPDATE SET soft_limit=EXCLUDED.soft_limit, updated_by=EXCLUDED.updated_by, updated_at=now()`,
+			tenant, meter, req.SoftLimit, req.Actor); err != nil {
+			return err
+		}
+		// a raised limit re-arms the notification for the open month
+		_, err := tx.Exec(ctx, `UPDATE usage SET quota_notified=false
+			WHERE tenant_id=$1 AND meter=$2 AND period=$3 AND quantity <= $4`, tenant, meter, monthOf(time.Now()), req.SoftLimit)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "failed to save quota", http.StatusInternalServerError)
+		return
+	}
+	s.cache.usage.purge()
+	writeJSON(w, http.StatusOK, map[string]any{"tenantId": tenant, "meter": meter, "softLimit": req.SoftLimit})
+}
+
+func (s *Store) handleDeleteQuota(w http.ResponseWriter, r *http.Request) {
+	tag, err := s.pool.Exec(r.Context(), "DELETE FROM usage_quotas WHERE tenant_id=$1 AND meter=$2", r.PathValue("tenant"), r.PathValue("meter"))
+	if err != nil {
+		http.Error(w, "failed to delete quota", http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "quota not found"})
+		return
+	}
+	s.cache.usage.purge()
+	w.WriteHeader(http.StatusNoContent)
+}
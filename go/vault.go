@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Vault is reached at VAULT_ADDR with the token in VAULT_TOKEN, or in the
+// file named by VAULT_TOKEN_FILE (re-read on every call, so an agent
+// sidecar can refresh it). The keyring reads it through vault:// sources.
+//
+// With DB_VAULT_PATH set (e.g. database/creds/fintech), database
+// credentials come from that database secrets engine role instead of
+// DB_USER/DB_PASSWORD. New pool connections always use the current
+// credentials. The lease is renewed when two thirds of it have passed; once
+// Vault stops extending it (the role's max TTL) or renewing fails, fresh
+// credentials are fetched and the pool is reset, so connections opened
+// with the old user are closed as they are released instead of being cut
+// when Vault revokes the lease.
+
+type vaultClient struct {
+	addr, token, tokenFile string
+	client                 *http.Client
+}
+
+func vaultFromEnv() (*vaultClient, error) {
+	c := &vaultClient{
+		addr:      strings.TrimRight(os.Getenv("VAULT_ADDR"), "/"),
+		token:     os.Getenv("VAULT_TOKEN"),
+		tokenFile: os.Getenv("VAULT_TOKEN_FILE"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+	if c.addr == "" || (c.token == "" && c.tokenFile == "") {
+		return nil, errors.New("vault needs VAULT_ADDR and VAULT_TOKEN or VAULT_TOKEN_FILE")
+	}
+	return c, nil
+}
+
+// do calls the Vault API at path (without /v1) and decodes the response
+// into out when it is not nil.
+func (c *vaultClient) do(ctx context.Context, method, path string, in, out any) error {
+	token := c.token
+	if c.tokenFile != "" {
+		raw, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return fmt.Errorf("vault: %w", err)
+		}
+		token = strings.TrimSpace(string(raw))
+	}
+	var body io.Reader = http.NoBody
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.addr+"/v1/"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("vault: %s: %s", path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("vault: %s: %w", path, err)
+	}
+	return nil
+}
+
+type dbCredentials struct {
+	user, password string
+	leaseID        string
+	renewable      bool
+	// expires is when the lease runs out unless renewed.
+	expires time.Time
+}
+
+type vaultLease struct {
+	LeaseID       string `json:"lease_id"`
+	LeaseDuration int64  `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+type vaultDBCredentials struct {
+	vault   *vaultClient
+	path    string
+	current atomic.Pointer[dbCredentials]
+}
+
+// newVaultDBCredentials fetches the first credentials, so a misconfigured
+// role fails the boot rather than every connection attempt.
+func newVaultDBCredentials(ctx context.Context, path string) (*vaultDBCredentials, error) {
+	vault, err := vaultFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	v := &vaultDBCredentials{vault: vault, path: strings.Trim(path, "/")}
+	creds, err := v.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.current.Store(creds)
+	slog.Info("database credentials loaded from vault", "path", v.path, "user", creds.user, "expires", creds.expires)
+	return v, nil
+}
+
+func (v *vaultDBCredentials) fetch(ctx context.Context) (*dbCredentials, error) {
+	var resp struct {
+		vaultLease
+		Data struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"data"`
+	}
+	if err := v.vault.do(ctx, http.MethodGet, v.path, nil, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Data.Username == "" {
+		return nil, fmt.Errorf("vault: %s returned no username", v.path)
+	}
+	return &dbCredentials{
+		user: resp.Data.Username, password: resp.Data.Password,
+		leaseID: resp.LeaseID, renewable: resp.Renewable,
+		expires: time.Now().Add(time.Duration(resp.LeaseDuration) * time.Second),
+	}, nil
+}
+
+// beforeConnect is the pool's BeforeConnect hook.
+func (v *vaultDBCredentials) beforeConnect(_ context.Context, cfg *pgx.ConnConfig) error {
+	creds := v.current.Load()
+	cfg.User, cfg.Password = creds.user, creds.password
+	return nil
+}
+
+// renew extends the lease by its original length. It reports false when
+// Vault granted less than asked, meaning the lease is near its max TTL.
+func (v *vaultDBCredentials) renew(ctx context.Context, creds *dbCredentials, ttl time.Duration) (bool, error) {
+	var resp vaultLease
+	err := v.vault.do(ctx, http.MethodPut, "sys/leases/renew",
+		map[string]any{"lease_id": creds.leaseID, "increment": int64(ttl.Seconds())}, &resp)
+	if err != nil {
+		return false, err
+	}
+	granted := time.Duration(resp.LeaseDuration) * time.Second
+	renewed := *creds
+	renewed.expires = time.Now().Add(granted)
+	v.current.Store(&renewed)
+	return granted >= ttl, nil
+}
+
+// run keeps the credentials alive until ctx is done. Credentials without
+// a lease (a static role) need nothing.
+func (v *vaultDBCredentials) run(ctx context.Context, pool *pgxpool.Pool) {
+	creds := v.current.Load()
+	if creds.leaseID == "" {
+		return
+	}
+	ttl := time.Until(creds.expires)
+	for {
+		creds := v.current.Load()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(creds.expires) * 2 / 3):
+		}
+		if creds.renewable {
+			extended, err := v.renew(ctx, creds, ttl)
+			if err == nil && extended {
+				continue
+			}
+			if err != nil && ctx.Err() == nil {
+				slog.Warn("renew database credentials", "lease", creds.leaseID, "error", err)
+			}
+		}
+		fresh, ok := v.rotate(ctx)
+		if !ok {
+			return
+		}
+		ttl = time.Until(fresh.expires)
+		pool.Reset()
+		slog.Info("database credentials rotated", "user", fresh.user, "expires", fresh.expires)
+	}
+}
+
+// rotate fetches new credentials, retrying until it succeeds or ctx is
+// done; the current ones keep serving new connections meanwhile.
+func (v *vaultDBCredentials) rotate(ctx context.Context) (*dbCredentials, bool) {
+	for {
+		fresh, err := v.fetch(ctx)
+		if err == nil {
+			v.current.Store(fresh)
+			return fresh, true
+		}
+		if ctx.Err() != nil {
+			return nil, false
+		}
+		slog.Error("rotate database credentials", "path", v.path, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Virtual accounts are extra payable identifiers for one real account. A B2B
+// client hands a different one to each of its payers, and inbound credits
+// quoting it land in the real account tagged with the virtual account, so
+// the client can tell who paid without parsing free-text references.
+//
+// Numbers are "VA" followed by 14 random digits and a Luhn check digit, so a
+// mistyped reference is rejected as unknown instead of crediting a stranger.
+
+const (
+	virtualActive = "active"
+	virtualClosed = "closed"
+)
+
+type virtualAccount struct {
+	ID        string     `json:"id"`
+	AccountID string     `json:"accountId"`
+	Label     string     `json:"label,omitempty"`
+	Status    string     `json:"status"`
+	CreatedBy string     `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ClosedAt  *time.Time `json:"closedAt,omitempty"`
+}
+
+const virtualColumns = "id, account_id, label, status, created_by, created_at, closed_at"
+
+func scanVirtualAccount(row pgx.Row) (virtualAccount, error) {
+	var v virtualAccount
+	err := row.Scan(&v.ID, &v.AccountID, &v.Label, &v.Status, &v.CreatedBy, &v.CreatedAt, &v.ClosedAt)
+	return v, err
+}
+
+func newVirtualAccountNumber() (string, error) {
+	digits := make([]byte, 14)
+	for i := range digits {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		digits[i] = byte('0' + n.Int64())
+	}
+	return "VA" + string(digits) + string(luhnDigit(string(digits))), nil
+}
+
+// luhnDigit computes the check digit to append to digits.
+func luhnDigit(digits string) byte {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if (len(digits)-1-i)%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// isVirtualAccountNumber validates the format and check digit.
+func isVirtualAccountNumber(ref string) bool {
+	if len(ref) != 17 || !strings.HasPrefix(ref, "VA") {
+		return false
+	}
+	body := ref[2:16]
+	for _, r := range ref[2:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return luhnDigit(body) == ref[16]
+}
+
+type createVirtualAccountRequest struct {
+	Label string `json:"label"`
+	Actor string `json:"actor"`
+}
+
+func (s *Store) handleCreateVirtualAccount(w http.ResponseWriter, r *http.Request) {
+	accountID := r.PathValue("id")
+	var req createVirtualAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Actor == "" {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "actor is required"})
+		return
+	}
+	if len(req.Label) > 128 {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "label must be at most 128 characters"})
+		return
+	}
+	if isSystemAccount(accountID) {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "account is reserved"})
+		return
+	}
+	ctx := r.Context()
+	var status, tenant string
+	err := s.pool.QueryRow(ctx, "SELECT status, tenant_id FROM accounts WHERE id=$1", accountID).Scan(&status, &tenant)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "account not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	if status == accountClosed {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "account is closed"})
+		return
+	}
+	if !s.tenants.effective(tenant).enabled(featureVirtualAccounts) {
+		writeJSON(w, http.StatusForbidden, TransferResponse{Status: "error", Message: "virtual accounts are not enabled for this tenant"})
+		return
+	}
+
+	// a collision in 10^14 numbers is unlikely but cheap to retry
+	for attempt := 0; attempt < 3; attempt++ {
+		number, err := newVirtualAccountNumber()
+		if err != nil {
+			http.Error(w, "failed to generate number", http.StatusInternalServerError)
+			return
+		}
+		v, err := scanVirtualAccount(s.pool.QueryRow(ctx, `
+			INSERT INTO virtual_accounts (id, account_id, label, status, created_by) VALUES ($1, $2, $3, $4, $5)
+			RETURNING `+virtualColumns, number, accountID, req.Label, virtualActive, req.Actor))
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			continue
+		}
+		if err != nil {
+			http.Error(w, "failed to create virtual account", http.StatusInternalServerError)
+			return
+		}
+		// the number may be cached as unknown
+		s.cache.aliases.invalidate(v.ID)
+		slog.Info("virtual account issued", "virtual_account_id", v.ID, "account_id", accountID, "actor", req.Actor)
+		writeJSON(w, http.StatusCreated, v)
+		return
+	}
+	http.Error(w, "failed to allocate a unique number", http.StatusInternalServerError)
+}
+
+func (s *Store) handleListVirtualAccounts(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.pool.Query(r.Context(), "SELECT "+virtualColumns+" FROM virtual_accounts WHERE account_id=$1 ORDER BY created_at, id", r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "failed to load virtual accounts", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := make([]virtualAccount, 0)
+	for rows.Next() {
+		v, err := scanVirtualAccount(rows)
+		if err != nil {
+			http.Error(w, "failed to parse virtual accounts", http.StatusInternalServerError)
+			return
+		}
+		list = append(list, v)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "failed to load virtual accounts", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleCloseVirtualAccount retires a number. Payments still quoting it go
+// to suspense rather than the real account.
+func (s *Store) handleCloseVirtualAccount(w http.ResponseWriter, r *http.Request) {
+	v, err := scanVirtualAccount(s.pool.QueryRow(r.Context(), `
+		UPDATE virtual_accounts SET status=$2, closed_at=COALESCE(closed_at, now())
+		WHERE id=$1 RETURNING `+virtualColumns, r.PathValue("vid"), virtualClosed))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "virtual account not found"})
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to close virtual account", http.StatusInternalServerError)
+		return
+	}
+	s.cache.aliases.invalidate(v.ID)
+	writeJSON(w, http.StatusOK, v)
+}
+
+// resolveVirtualAccount maps a virtual account number to its real account.
+// ok is false when ref is not an active virtual account; reason then says
+// why for suspense.
+func (s *Store) resolveVirtualAccount(ctx context.Context, ref string) (accountID, reason string, err error) {
+	if !isVirtualAccountNumber(ref) {
+		return "", "unknown_reference", nil
+	}
+	res, err := s.cache.aliases.fetch(ref, func() (aliasResolution, error) {
+		var status, accountID string
+		err := s.pool.QueryRow(ctx, "SELECT account_id, status FROM virtual_accounts WHERE id=$1", ref).Scan(&accountID, &status)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return aliasResolution{reason: "unknown_reference"}, nil
+		}
+		if err != nil {
+			return aliasResolution{}, fmt.Errorf("load virtual account: %w", err)
+		}
+		if status != virtualActive {
+			return aliasResolution{reason: "virtual_account_closed"}, nil
+		}
+		return aliasResolution{accountID: accountID}, nil
+	})
+	return res.accountID, res.reason, err
+}
+
+// aliasResolution is what resolveVirtualAccount found for a number.
+type aliasResolution struct {
+	accountID, reason string
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Webhook deliveries are scheduled fairly rather than oldest first. Every
+// WEBHOOK_QUEUE_REFRESH_INTERVAL (default 2s) the relay counts the pending
+// deliveries per tenant and destination host, and its workers then take
+// turns between the tenants with due work: a tenant with 100k queued
+// notifications gets one turn in N like everyone else, instead of holding
+// the workers until its backlog drains. Within a tenant the turns rotate
+// between its hosts.
+//
+// Each destination host has a token bucket of WEBHOOK_HOST_RPS deliveries a
+// second (default 10; 0 turns the limit off) and bursts of
+// WEBHOOK_HOST_BURST (default 20), shared by every tenant sending there, so
+// a receiver is not flooded and a slow one only holds back its own queue.
+// Like the transfer limits, buckets are per relay process.
+//
+// The same count feeds webhook_queue_depth and webhook_queue_oldest_due_seconds
+// per tenant (METRICS_TENANTS bounds the label).
+
+type webhookQueue struct {
+	rps, burst float64
+	labels     *labelGuard
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// hosts lists each tenant's hosts with due deliveries, in turn order.
+	hosts   map[string][]string
+	tenants []string
+	next    int
+}
+
+func webhookQueueFromEnv() *webhookQueue {
+	return &webhookQueue{
+		rps:     floatOrDefault("WEBHOOK_HOST_RPS", 10),
+		burst:   floatOrDefault("WEBHOOK_HOST_BURST", 20),
+		labels:  tenantLabelsFromEnv(),
+		buckets: map[string]*tokenBucket{},
+		hosts:   map[string][]string{},
+	}
+}
+
+// pick returns the tenant and host to deliver for next, spending a token of
+// the host, or false when nothing is due or every due host is throttled.
+func (q *webhookQueue) pick(now time.Time) (string, string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for range q.tenants {
+		tenant := q.tenants[q.next%len(q.tenants)]
+		q.next = (q.next + 1) % len(q.tenants)
+		hosts := q.hosts[tenant]
+		for i, host := range hosts {
+			if !q.take(host, now) {
+				continue
+			}
+			// the host goes to the back of the tenant's turn
+			q.hosts[tenant] = append(append(hosts[:i:i], hosts[i+1:]...), host)
+			return tenant, host, true
+		}
+	}
+	return "", "", false
+}
+
+func (q *webhookQueue) take(host string, now time.Time) bool {
+	if q.rps <= 0 {
+		return true
+	}
+	b, ok := q.buckets[host]
+	if !ok {
+		b = &tokenBucket{tokens: q.burst, last: now}
+		q.buckets[host] = b
+	}
+	ok, _ = b.take(now, q.rps, q.burst)
+	return ok
+}
+
+// drained drops a tenant's host that had nothing left to claim, giving back
+// the token pick spent on it.
+func (q *webhookQueue) drained(tenant, host string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if b, ok := q.buckets[host]; ok {
+		b.tokens = math.Min(q.burst, b.tokens+1)
+	}
+	hosts := q.hosts[tenant]
+	for i, h := range hosts {
+		if h == host {
+			q.hosts[tenant] = append(hosts[:i:i], hosts[i+1:]...)
+			break
+		}
+	}
+	if len(q.hosts[tenant]) == 0 {
+		delete(q.hosts, tenant)
+		for i, t := range q.tenants {
+			if t == tenant {
+				q.tenants = append(q.tenants[:i:i], q.tenants[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// refresh reloads the tenants and hosts with due work and the queue
+// gauges. Turn order survives for tenants still queued, so a refresh does
+// not send everyone back to the first tenant.
+func (q *webhookQueue) refresh(ctx context.Context, db *pgxpool.Pool) error {
+	rows, err := db.Query(ctx, `
+		SELECT tenant_id, host, count(*), count(*) FILTER (WHERE next_attempt_at <= now()),
+			COALESCE(EXTRACT(EPOCH FROM now() - min(next_attempt_at) FILTER (WHERE next_attempt_at <= now())), 0)::float8
+		FROM webhook_deliveries WHERE status = $1
+		GROUP BY tenant_id, host ORDER BY tenant_id, host`, webhookPending)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	hosts := map[string][]string{}
+	var order []string
+	depth, oldest := map[string]float64{}, map[string]float64{}
+	for rows.Next() {
+		var (
+			tenant, host string
+			pending, due int64
+			age          float64
+		)
+		if err := rows.Scan(&tenant, &host, &pending, &due, &age); err != nil {
+			return err
+		}
+		label := q.labels.label(tenant)
+		depth[label] += float64(pending)
+		oldest[label] = math.Max(oldest[label], age)
+		if due == 0 {
+			continue
+		}
+		if _, seen := hosts[tenant]; !seen {
+			order = append(order, tenant)
+		}
+		hosts[tenant] = append(hosts[tenant], host)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	webhookQueueDepth.Reset()
+	webhookQueueOldest.Reset()
+	for label, n := range depth {
+		webhookQueueDepth.WithLabelValues(label).Set(n)
+		webhookQueueOldest.WithLabelValues(label).Set(oldest[label])
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var current string
+	if len(q.tenants) > 0 {
+		current = q.tenants[q.next%len(q.tenants)]
+	}
+	q.tenants, q.hosts, q.next = order, hosts, 0
+	for i, t := range order {
+		if t >= current {
+			// resume at the tenant whose turn it was, or the one after it
+			q.next = i
+			break
+		}
+	}
+	return nil
+}
+
+func (q *webhookQueue) watch(ctx context.Context, db *pgxpool.Pool, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		if err := q.refresh(ctx, db); err != nil && ctx.Err() == nil {
+			slog.Error("refresh webhook queue", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
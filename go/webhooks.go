@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Tenants subscribe a URL to money-movement events with POST /webhooks.
+// Deliveries are queued by writeOutbox, in the transaction that writes the
+// event, so a subscriber hears about exactly the transfers that committed;
+// WEBHOOKS_ENABLED turns the queueing on. A subscription sees the events
+// of its tenant's accounts, or of one account with accountId, where the
+// account is the initiator: the payer of a transfer or withdrawal and the
+// payee of a deposit. The payee of a completed transfer hears of it as
+// transfer.received, so recipients need not poll for credits; its payload
+// is the credit as the payee books it, without the payer's operation id,
+// fee or conversion.
+//
+// The relay role delivers pending rows: WEBHOOK_CONCURRENCY workers each
+// claim one due delivery at a time, of the tenant and host whose turn it is
+// (webhookqueue.go), by pushing its next attempt past the request timeout,
+// and POST it. A 2xx answer delivers it; anything else is
+// retried with exponential backoff from WEBHOOK_RETRY_BACKOFF, capped at
+// WEBHOOK_RETRY_MAX_BACKOFF, until WEBHOOK_MAX_ATTEMPTS fails it. Every
+// attempt is logged in webhook_attempts. Delivery is at least once;
+// receivers dedupe on Webhook-Id.
+//
+// Bodies are signed with a per-subscription secret derived from the active
+// webhook key of the keyring: Webhook-Signature is "k=<key id>,v1=<hex
+// HMAC-SHA256 of id.timestamp.body>". The secret is returned when the
+// subscription is created and, for each verification key, by
+// GET /webhooks/{id}/secrets, so receivers can accept both sides of a key
+// rotation.
+//
+// Each subscription receives its events at one version (eventversions.go),
+// the latest when it does not ask for one; deliveries keep the payload as
+// written and are upgraded when sent.
+// A tenant's webhook template (templates.go) for the event replaces the
+// standard body.
+
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+	webhookCancelled = "cancelled"
+)
+
+const webhookTransferReceived = "transfer.received"
+
+// webhookEventTypes are the types a subscription can ask for.
+var webhookEventTypes = []string{
+	"transfer.completed", "transfer.failed", webhookTransferReceived,
+	"deposit.completed", "deposit.failed",
+	"withdrawal.completed", "withdrawal.failed",
+}
+
+// webhookEvent names an outbox event for subscribers, who tell deposits
+// and withdrawals from transfers by their type rather than by the
+// settlement account; it also returns the initiating account.
+func webhookEvent(eventType, from, to string) (string, string) {
+	_, outcome, _ := strings.Cut(eventType, ".")
+	switch {
+	case from == settlementAccountID:
+		return "deposit." + outcome, to
+	case to == settlementAccountID:
+		return "withdrawal." + outcome, from
+	}
+	return eventType, from
+}
+
+// webhookSourceType is the outbox type a webhook type was named from.
+func webhookSourceType(typ string) string {
+	if typ == webhookTransferReceived {
+		return "transfer.completed"
+	}
+	_, outcome, _ := strings.Cut(typ, ".")
+	return "transfer." + outcome
+}
+
+// receivedPayload scopes a transfer.completed payload to its payee: the
+// amount and currency credited, and no payer-side detail. A system
+// account paying out is not named, as on statements.
+func receivedPayload(data json.RawMessage) (json.RawMessage, error) {
+	var e transferEvent
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	from := e.FromAccountID
+	if isSystemAccount(from) {
+		from = ""
+	}
+	return json.Marshal(transferEvent{TransferID: e.TransferID, FromAccountID: from, ToAccountID: e.ToAccountID,
+		Amount: e.DestinationAmount, Currency: e.DestinationCurrency, DestinationAmount: e.DestinationAmount,
+		DestinationCurrency: e.DestinationCurrency, ReversesID: e.ReversesID, ReceiptNumber: e.ReceiptNumber, At: e.At})
+}
+
+// queueWebhooks fans an event out to the matching subscriptions; q is the
+// transaction writing the event when there is one.
+func (s *Store) queueWebhooks(ctx context.Context, q execer, eventType string, data json.RawMessage) error {
+	var parties struct {
+		From string `json:"fromAccountId"`
+		To   string `json:"toAccountId"`
+	}
+	if err := json.Unmarshal(data, &parties); err != nil {
+		return err
+	}
+	queue := func(typ, account string, data json.RawMessage) error {
+		_, err := q.Exec(ctx, `
+			INSERT INTO webhook_deliveries (subscription_id, event_type, account_id, payload, payload_version, tenant_id, host)
+			SELECT w.id, $1, $2, $3, $4, w.tenant_id, `+webhookHostSQL+` FROM webhook_subscriptions w
+			WHERE w.active AND $1 = ANY(w.events)
+				AND (w.account_id = $2 OR w.account_id IS NULL AND w.tenant_id = (SELECT tenant_id FROM accounts WHERE id = $2))`,
+			typ, account, data, eventWriteVersion)
+		return err
+	}
+	typ, account := webhookEvent(eventType, parties.From, parties.To)
+	if err := queue(typ, account, data); err != nil {
+		return err
+	}
+	if typ != "transfer.completed" || isSystemAccount(parties.To) {
+		return nil
+	}
+	received, err := receivedPayload(data)
+	if err != nil {
+		return err
+	}
+	return queue(webhookTransferReceived, parties.To, received)
+}
+
+// webhookHostSQL is the destination host of subscription w's URL, the key
+// of its rate limit.
+const webhookHostSQL = `lower(substring(w.url from '^[A-Za-z][A-Za-z0-9+.-]*://([^/?#]+)'))`
+
+// webhookSecret derives the subscription's signing secret from a webhook
+// key, so secrets follow the keyring's rotation without being stored.
+func webhookSecret(k *managedKey, subscriptionID int64) string {
+	return "whsec_" + hex.EncodeToString(k.mac([]byte("webhook-subscription:"+strconv.FormatInt(subscriptionID, 10))))
+}
+
+func signWebhook(secret string, deliveryID int64, ts int64, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(m, "%d.%d.", deliveryID, ts)
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+type webhookSubscription struct {
+	ID          int64     `json:"id"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	AccountID   *string   `json:"accountId"`
+	Description string    `json:"description"`
+	Version     int       `json:"version"`
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Secret and KeyID are only set on creation.
+	Secret string `json:"secret,omitempty"`
+	KeyID  string `json:"keyId,omitempty"`
+}
+
+const webhookColumns = "id, url, events, account_id, description, version, active, created_at"
+
+func scanWebhook(row pgx.Row) (webhookSubscription, error) {
+	var w webhookSubscription
+	err := row.Scan(&w.ID, &w.URL, &w.Events, &w.AccountID, &w.Description, &w.Version, &w.Active, &w.CreatedAt)
+	return w, err
+}
+
+type createWebhookRequest struct {
+	URL         string   `json:"url"`
+	Events      []string `json:"events"`
+	AccountID   string   `json:"accountId"`
+	Description string   `json:"description"`
+	Version     int      `json:"version"`
+}
+
+// validWebhookURL accepts absolute https URLs, and http ones when
+// WEBHOOK_ALLOW_HTTP is set for local receivers.
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.User != nil {
+		return false
+	}
+	return u.Scheme == "https" || u.Scheme == "http" && envOrDefault("WEBHOOK_ALLOW_HTTP", "false") == "true"
+}
+
+func (s *Store) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req createWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if !validWebhookURL(req.URL) || len(req.URL) > 2048 {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "url must be an absolute https URL"})
+		return
+	}
+	if len(req.Events) == 0 {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "events is required"})
+		return
+	}
+	for _, e := range req.Events {
+		if !slices.Contains(webhookEventTypes, e) {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error",
+				Message: fmt.Sprintf("unknown event %q (want %s)", e, strings.Join(webhookEventTypes, ", "))})
+			return
+		}
+	}
+	slices.Sort(req.Events)
+	req.Events = slices.Compact(req.Events)
+	if len(req.Description) > 256 {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "description must be at most 256 characters"})
+		return
+	}
+	if req.Version == 0 {
+		req.Version = eventLatestVersion()
+	}
+	if req.Version < 0 || req.Version > eventLatestVersion() {
+		writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: fmt.Sprintf("version must be between 1 and %d", eventLatestVersion())})
+		return
+	}
+	key, err := s.keys.active(purposeWebhook)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, TransferResponse{Status: "error", Message: "webhooks are not configured"})
+		return
+	}
+	ctx := r.Context()
+	meta := metaFromRequest(r)
+	var account *string
+	if req.AccountID != "" {
+		var tenant string
+		err := s.pool.QueryRow(ctx, "SELECT tenant_id FROM accounts WHERE id = $1", req.AccountID).Scan(&tenant)
+		if errors.Is(err, pgx.ErrNoRows) || err == nil && (tenant != meta.Tenant || isSystemAccount(req.AccountID)) {
+			writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "account not found"})
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to load account", http.StatusInternalServerError)
+			return
+		}
+		account = &req.AccountID
+	}
+	sub, err := scanWebhook(s.pool.QueryRow(ctx, `
+		INSERT INTO webhook_subscriptions (tenant_id, url, events, account_id, description, version, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING `+webhookColumns,
+		meta.Tenant, req.URL, req.Events, account, req.Description, req.Version, meta.Client))
+	if err != nil {
+		http.Error(w, "failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	sub.Secret, sub.KeyID = webhookSecret(key, sub.ID), key.ID
+	logger(ctx).Info("webhook subscribed", "webhook_id", sub.ID, "events", sub.Events)
+	w.Header().Set("Location", fmt.Sprintf("/webhooks/%d", sub.ID))
+	writeJSON(w, http.StatusCreated, sub)
+}
+
+func (s *Store) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.pool.Query(r.Context(), "SELECT "+webhookColumns+" FROM webhook_subscriptions WHERE tenant_id = $1 ORDER BY id",
+		metaFromRequest(r).Tenant)
+	if err != nil {
+		http.Error(w, "failed to list webhooks", http.StatusInternalServerError)
+		return
+	}
+	subs, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (webhookSubscription, error) { return scanWebhook(row) })
+	if err != nil {
+		http.Error(w, "failed to list webhooks", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"webhooks": subs})
+}
+
+// loadWebhook answers 404 itself for a missing subscription or one of
+// another tenant.
+func (s *Store) loadWebhook(w http.ResponseWriter, r *http.Request) (webhookSubscription, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "webhook not found"})
+		return webhookSubscription{}, false
+	}
+	sub, err := scanWebhook(s.pool.QueryRow(r.Context(), "SELECT "+webhookColumns+" FROM webhook_subscriptions WHERE id = $1 AND tenant_id = $2",
+		id, metaFromRequest(r).Tenant))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, TransferResponse{Status: "error", Message: "webhook not found"})
+		return sub, false
+	}
+	if err != nil {
+		http.Error(w, "failed to load webhook", http.StatusInternalServerError)
+		return sub, false
+	}
+	return sub, true
+}
+
+func (s *Store) handleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	if sub, ok := s.loadWebhook(w, r); ok {
+		writeJSON(w, http.StatusOK, sub)
+	}
+}
+
+// handleDeleteWebhook deactivates the subscription and cancels what it
+// still had pending; its attempt log stays readable.
+func (s *Store) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	sub, ok := s.loadWebhook(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	var cancelled int64
+	err := s.pool.QueryRow(ctx, `
+		WITH off AS (UPDATE webhook_subscriptions SET active = false WHERE id = $1),
+		c AS (UPDATE webhook_deliveries SET status = $2 WHERE subscription_id = $1 AND status = $3 RETURNING 1)
+		SELECT count(*) FROM c`, sub.ID, webhookCancelled, webhookPending).Scan(&cancelled)
+	if err != nil {
+		http.Error(w, "failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	logger(ctx).Info("webhook unsubscribed", "webhook_id", sub.ID, "cancelled_deliveries", cancelled)
+	sub.Active = false
+	writeJSON(w, http.StatusOK, map[string]any{"webhook": sub, "cancelledDeliveries": cancelled})
+}
+
+// handleWebhookSecrets lists the subscription's secret under each webhook
+// key still accepted, active first.
+func (s *Store) handleWebhookSecrets(w http.ResponseWriter, r *http.Request) {
+	sub, ok := s.loadWebhook(w, r)
+	if !ok {
+		return
+	}
+	keys := s.keys.verificationKeys(purposeWebhook)
+	if len(keys) == 0 {
+		writeJSON(w, http.StatusServiceUnavailable, TransferResponse{Status: "error", Message: "webhooks are not configured"})
+		return
+	}
+	type secret struct {
+		KeyID  string `json:"keyId"`
+		Status string `json:"status"`
+		Secret string `json:"secret"`
+	}
+	out := make([]secret, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, secret{KeyID: k.ID, Status: k.Status, Secret: webhookSecret(k, sub.ID)})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"secrets": out})
+}
+
+type webhookAttempt struct {
+	DeliveryID int64     `json:"deliveryId"`
+	EventType  string    `json:"eventType"`
+	Attempt    int       `json:"attempt"`
+	At         time.Time `json:"at"`
+	StatusCode *int      `json:"statusCode"`
+	Error      *string   `json:"error"`
+	DurationMS int64     `json:"durationMs"`
+	// DeliveryStatus is the delivery's state now, not after this attempt.
+	DeliveryStatus string `json:"deliveryStatus"`
+}
+
+// handleWebhookAttempts is the subscription's delivery log, newest first:
+// ?deliveryId narrows it to one delivery, ?limit (default 100, at most
+// 1000) caps it.
+func (s *Store) handleWebhookAttempts(w http.ResponseWriter, r *http.Request) {
+	sub, ok := s.loadWebhook(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "limit must be between 1 and 1000"})
+			return
+		}
+		limit = n
+	}
+	var delivery int64
+	if v := q.Get("deliveryId"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, TransferResponse{Status: "error", Message: "deliveryId must be an integer"})
+			return
+		}
+		delivery = n
+	}
+	rows, err := s.pool.Query(r.Context(), `
+		SELECT a.delivery_id, d.event_type, a.attempt, a.at, a.status_code, a.error, a.duration_ms, d.status
+		FROM webhook_attempts a JOIN webhook_deliveries d ON d.id = a.delivery_id
+		WHERE d.subscription_id = $1 AND ($2 = 0 OR d.id = $2)
+		ORDER BY a.id DESC LIMIT $3`, sub.ID, delivery, limit)
+	if err != nil {
+		http.Error(w, "failed to load attempts", http.StatusInternalServerError)
+		return
+	}
+	attempts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (webhookAttempt, error) {
+		var a webhookAttempt
+		err := row.Scan(&a.DeliveryID, &a.EventType, &a.Attempt, &a.At, &a.StatusCode, &a.Error, &a.DurationMS, &a.DeliveryStatus)
+		return a, err
+	})
+	if err != nil {
+		http.Error(w, "failed to load attempts", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"attempts": attempts})
+}
+
+type webhookWorker struct {
+	store       *Store
+	queue       *webhookQueue
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+}
+
+func webhookWorkerFromEnv(s *Store) *webhookWorker {
+	return &webhookWorker{
+		store:       s,
+		queue:       webhookQueueFromEnv(),
+		client:      &http.Client{Timeout: durationOrDefault("WEBHOOK_TIMEOUT", 10*time.Second)},
+		maxAttempts: intOrDefault("WEBHOOK_MAX_ATTEMPTS", 12),
+		backoff:     durationOrDefault("WEBHOOK_RETRY_BACKOFF", 30*time.Second),
+		maxBackoff:  durationOrDefault("WEBHOOK_RETRY_MAX_BACKOFF", 6*time.Hour),
+	}
+}
+
+// run delivers until ctx is cancelled, draining what is due on each tick.
+func (d *webhookWorker) run(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		for ctx.Err() == nil {
+			ran, err := d.deliverDue(ctx)
+			if err != nil {
+				slog.Error("deliver webhook", "error", err)
+			}
+			if !ran {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// retryAfter is the wait before the next attempt once attempt failed.
+func (d *webhookWorker) retryAfter(attempt int) time.Duration {
+	wait := d.backoff << min(attempt-1, 30)
+	if wait <= 0 || wait > d.maxBackoff {
+		return d.maxBackoff
+	}
+	return wait
+}
+
+// deliverDue claims one due delivery, of the tenant and host the queue
+// picks, and POSTs it outside the claiming statement, like
+// runDueScheduledTransfer.
+func (d *webhookWorker) deliverDue(ctx context.Context) (bool, error) {
+	tenant, host, ok := d.queue.pick(time.Now())
+	if !ok {
+		return false, nil
+	}
+	var (
+		id, subID int64
+		target    string
+		typ       string
+		payload   json.RawMessage
+		stored    int
+		version   int
+		attempt   int
+		createdAt time.Time
+	)
+	lease := d.client.Timeout + 30*time.Second
+	err := d.store.pool.QueryRow(ctx, `
+		UPDATE webhook_deliveries d SET attempts = attempts + 1, next_attempt_at = now() + $1 * interval '1 second'
+		FROM webhook_subscriptions w
+		WHERE w.id = d.subscription_id AND d.id = (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $2 AND tenant_id = $3 AND host = $4 AND next_attempt_at <= now()
+			ORDER BY next_attempt_at FOR UPDATE SKIP LOCKED LIMIT 1)
+		RETURNING d.id, d.subscription_id, w.url, d.event_type, d.payload, d.payload_version, w.version, d.attempts, d.created_at`,
+		lease.Seconds(), webhookPending, tenant, host).Scan(&id, &subID, &target, &typ, &payload, &stored, &version, &attempt, &createdAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// another worker took the last one; try the next turn
+		d.queue.drained(tenant, host)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	key, err := d.store.keys.active(purposeWebhook)
+	if err != nil {
+		// left claimed: it is retried when the lease runs out
+		return true, err
+	}
+	body, err := webhookBody(id, typ, createdAt, payload, stored, version)
+	if err != nil {
+		return true, fmt.Errorf("webhook delivery %d: %w", id, err)
+	}
+	if custom, err := d.store.customWebhookBody(tenant, id, typ, createdAt, payload, stored, version); err != nil {
+		slog.Warn("webhook template failed; sending the standard body", "delivery_id", id, "tenant", tenant, "event", typ, "error", err)
+	} else if custom != nil {
+		body = custom
+	}
+
+	start := time.Now()
+	code, derr := d.post(ctx, target, id, key, webhookSecret(key, subID), body)
+	elapsed := time.Since(start)
+
+	next, retryAt, result := webhookDelivered, (*time.Time)(nil), "delivered"
+	var errMsg *string
+	if derr != nil {
+		msg := derr.Error()
+		errMsg = &msg
+		next, result = webhookFailed, "failed"
+		if attempt < d.maxAttempts {
+			at := time.Now().Add(d.retryAfter(attempt))
+			next, retryAt, result = webhookPending, &at, "retried"
+		}
+	}
+	if _, err := d.store.pool.Exec(context.WithoutCancel(ctx), `
+		WITH logged AS (
+			INSERT INTO webhook_attempts (delivery_id, attempt, status_code, error, duration_ms) VALUES ($1, $2, $3, $4, $5))
+		UPDATE webhook_deliveries SET status = $6, next_attempt_at = COALESCE($7, next_attempt_at), last_attempt_at = now(),
+			delivered_at = CASE WHEN $6 = 'delivered' THEN now() END
+		WHERE id = $1`, id, attempt, code, errMsg, elapsed.Milliseconds(), next, retryAt); err != nil {
+		return true, fmt.Errorf("record webhook delivery %d: %w", id, err)
+	}
+	webhookDeliveries.WithLabelValues(result).Inc()
+	slog.Info("webhook delivery attempted", "delivery_id", id, "webhook_id", subID, "event", typ, "attempt", attempt,
+		"status", next, "http_status", code, "duration_ms", elapsed.Milliseconds())
+	return true, nil
+}
+
+// webhookBody is what a delivery POSTs: its payload, stored at version
+// stored, rendered at version.
+func webhookBody(id int64, typ string, createdAt time.Time, payload json.RawMessage, stored, version int) ([]byte, error) {
+	data, err := renderEvent(webhookSourceType(typ), stored, payload, version)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]any{"id": id, "type": typ, "version": version, "createdAt": createdAt, "data": data})
+}
+
+// post sends one attempt; a non-2xx answer is an error carrying the start
+// of the response body.
+func (d *webhookWorker) post(ctx context.Context, target string, id int64, key *managedKey, secret string, body []byte) (*int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "fintech-webhooks/1")
+	req.Header.Set("Webhook-Id", strconv.FormatInt(id, 10))
+	req.Header.Set("Webhook-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("Webhook-Signature", "k="+key.ID+",v1="+signWebhook(secret, id, ts, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	code := resp.StatusCode
+	if code < 200 || code > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return &code, fmt.Errorf("receiver answered %d: %s", code, strings.TrimSpace(string(snippet)))
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return &code, nil
+}